@@ -0,0 +1,178 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// AccountTokenType identifies what an account token can be used for.
+type AccountTokenType string
+
+const (
+	AccountTokenVerifyEmail   AccountTokenType = "verify_email"   // Verifies a new user's email address, enabling the user
+	AccountTokenPasswordReset AccountTokenType = "password_reset" // Sets a new password for a user that has forgotten theirs
+
+	accountTokenLength = 32 // Bytes of randomness in an account token
+)
+
+// ErrInvalidAccountToken is returned for account tokens that don't exist, have expired, or are of the wrong type.
+var ErrInvalidAccountToken = base.HTTPErrorf(http.StatusBadRequest, "Invalid or expired token")
+
+// accountToken is the stored form of a single-use account token, which is delivered to the user out of band (e.g. by
+// email).  The document ID is derived from a hash of the token, so that tokens can't be read from the bucket.
+type accountToken struct {
+	Type       AccountTokenType `json:"type"`
+	Username   string           `json:"username"`
+	Expiration time.Time        `json:"expiration"`
+}
+
+// CreateAccountToken creates a single-use token of the given type for a user, valid for ttl.
+func (auth *Authenticator) CreateAccountToken(username string, tokenType AccountTokenType, ttl time.Duration) (token string, expiration time.Time, err error) {
+	tokenBytes := make([]byte, accountTokenLength)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", time.Time{}, err
+	}
+	token = hex.EncodeToString(tokenBytes)
+	expiration = time.Now().Add(ttl)
+	stored := accountToken{Type: tokenType, Username: username, Expiration: expiration}
+	if err := auth.bucket.Set(docIDForAccountToken(token), base.DurationToCbsExpiry(ttl), stored); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiration, nil
+}
+
+// StartEmailVerification marks the user's email address as unverified, and creates a verification token valid for
+// ttl.  The user should be disabled until the address is verified with VerifyEmail.
+func (auth *Authenticator) StartEmailVerification(user User, ttl time.Duration) (token string, expiration time.Time, err error) {
+	if !user.EmailUnverified() {
+		err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+			currentUser, ok := p.(User)
+			if !ok {
+				return nil, base.ErrUpdateCancel
+			}
+			currentUser.SetEmailUnverified(true)
+			return currentUser, nil
+		})
+		if err != nil {
+			return "", time.Time{}, err
+		}
+	}
+	return auth.CreateAccountToken(user.Name(), AccountTokenVerifyEmail, ttl)
+}
+
+// VerifyEmail completes email verification for the user the token was created for, clearing their pending
+// verification and enabling them.
+func (auth *Authenticator) VerifyEmail(token string) (User, error) {
+	user, err := auth.getAccountTokenUser(token, AccountTokenVerifyEmail)
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.deleteAccountToken(token); err != nil {
+		return nil, err
+	}
+	if !user.EmailUnverified() {
+		return user, nil
+	}
+
+	err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok || !currentUser.EmailUnverified() {
+			return nil, base.ErrUpdateCancel
+		}
+		currentUser.SetEmailUnverified(false)
+		currentUser.SetDisabled(false)
+		return currentUser, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	base.Infof(base.KeyAuth, "Verified email address for user %s", base.UD(user.Name()))
+	return user, nil
+}
+
+// ResetPassword sets a new password for the user the token was created for.  The password is validated against the
+// password policy before the token is used, so that the user can retry with another password.  As with
+// ChangePassword, the new password must differ from the current one, so that an expired password can't be renewed.
+func (auth *Authenticator) ResetPassword(token, newPassword string) (User, error) {
+	user, err := auth.getAccountTokenUser(token, AccountTokenPasswordReset)
+	if err != nil {
+		return nil, err
+	}
+	if current, ok := user.(*userImpl); ok && current.passwordMatches(newPassword) {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "New password must be different from the current password")
+	}
+	if err := auth.ValidatePassword(user, newPassword); err != nil {
+		return nil, err
+	}
+	if err := auth.deleteAccountToken(token); err != nil {
+		return nil, err
+	}
+
+	err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		currentUser.SetPassword(newPassword)
+		return currentUser, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	base.Infof(base.KeyAuth, "Reset password for user %s", base.UD(user.Name()))
+	return user, nil
+}
+
+// getAccountTokenUser returns the user an unexpired token of the given type was created for.
+func (auth *Authenticator) getAccountTokenUser(token string, tokenType AccountTokenType) (User, error) {
+	if token == "" {
+		return nil, ErrInvalidAccountToken
+	}
+	var stored accountToken
+	if _, err := auth.bucket.Get(docIDForAccountToken(token), &stored); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, ErrInvalidAccountToken
+		}
+		return nil, err
+	}
+	if stored.Type != tokenType || time.Now().After(stored.Expiration) {
+		return nil, ErrInvalidAccountToken
+	}
+	user, err := auth.GetUser(stored.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrInvalidAccountToken
+	}
+	return user, nil
+}
+
+// deleteAccountToken removes a token once used.  Returns ErrInvalidAccountToken if it was used concurrently.
+func (auth *Authenticator) deleteAccountToken(token string) error {
+	if err := auth.bucket.Delete(docIDForAccountToken(token)); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return ErrInvalidAccountToken
+		}
+		return err
+	}
+	return nil
+}
+
+func docIDForAccountToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return base.AccountTokenPrefix + hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyEmail(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	user.SetDisabled(true)
+	require.NoError(t, auth.Save(user))
+
+	token, expiration, err := auth.StartEmailVerification(user, time.Hour)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expiration, 5*time.Second)
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, user.EmailUnverified())
+
+	// Tokens are stored hashed, and can only be used for their own type
+	_, err = auth.bucket.Get(base.AccountTokenPrefix+token, &accountToken{})
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = auth.ResetPassword(token, "newpassword")
+	assert.Equal(t, ErrInvalidAccountToken, err)
+	_, err = auth.VerifyEmail("unknown")
+	assert.Equal(t, ErrInvalidAccountToken, err)
+
+	_, err = auth.VerifyEmail(token)
+	require.NoError(t, err)
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.False(t, user.EmailUnverified())
+	assert.False(t, user.Disabled())
+
+	// Tokens can only be used once
+	_, err = auth.VerifyEmail(token)
+	assert.Equal(t, ErrInvalidAccountToken, err)
+
+	// Verification tokens don't enable users that were disabled for another reason
+	user.SetDisabled(true)
+	require.NoError(t, auth.Save(user))
+	token, _, err = auth.CreateAccountToken("alice", AccountTokenVerifyEmail, time.Hour)
+	require.NoError(t, err)
+	_, err = auth.VerifyEmail(token)
+	require.NoError(t, err)
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, user.Disabled())
+}
+
+func TestResetPassword(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.PasswordPolicy = &PasswordPolicyOptions{MinLength: 8}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// Expired tokens can't be used
+	token, _, err := auth.CreateAccountToken("alice", AccountTokenPasswordReset, time.Hour)
+	require.NoError(t, err)
+	expired := accountToken{Type: AccountTokenPasswordReset, Username: "alice", Expiration: time.Now().Add(-time.Second)}
+	require.NoError(t, bucket.Set(docIDForAccountToken(token), 0, expired))
+	_, err = auth.ResetPassword(token, "newpassword")
+	assert.Equal(t, ErrInvalidAccountToken, err)
+
+	// A password that doesn't meet the policy doesn't use the token
+	token, _, err = auth.CreateAccountToken("alice", AccountTokenPasswordReset, time.Hour)
+	require.NoError(t, err)
+	_, err = auth.ResetPassword(token, "short")
+	requireHTTPStatus(t, err, http.StatusBadRequest)
+
+	// Nor does the current password, which would otherwise leave an expired password in place
+	_, err = auth.ResetPassword(token, "password")
+	requireHTTPStatus(t, err, http.StatusBadRequest)
+	_, err = auth.ResetPassword(token, "newpassword")
+	require.NoError(t, err)
+	_, err = auth.ResetPassword(token, "otherpassword")
+	assert.Equal(t, ErrInvalidAccountToken, err)
+
+	user, err = auth.AuthenticateUser("alice", "newpassword")
+	require.NoError(t, err)
+	assert.NotNil(t, user)
+}
@@ -0,0 +1,332 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// maxAPIKeysPerUser bounds the number of API keys that can be created for a single user, to keep the user
+// document small.
+const maxAPIKeysPerUser = 20
+
+// apiKeyLastUsedInterval is the resolution of an API key's last used time.  The user document is only updated when
+// a key is used if its last used time is older than this, so that keys used for every request don't cause a write
+// per request.
+const apiKeyLastUsedInterval = time.Minute
+
+// apiKeyTokenPrefix identifies API key tokens, which have the form sgk_<base64 username>.<key ID>.<secret>
+const apiKeyTokenPrefix = "sgk_"
+
+// The scopes that restrict what can be done with an API key.  An API key without scopes has the same access as
+// its user.
+type APIKeyScopes struct {
+	ReadOnly bool     `json:"read_only,omitempty"` // If true, the key can't be used to write documents
+	Channels []string `json:"channels,omitempty"`  // If set, the key can only access these of the user's channels
+}
+
+// An API key used to authenticate as a user, without the user's password.  Only a hash of the key's secret is stored.
+type APIKey struct {
+	ID       string       `json:"id"`                  // Identifies the key within the user's API keys
+	Name     string       `json:"name"`                // Name given to the key when created
+	Hash     string       `json:"hash,omitempty"`      // Hex encoded SHA-256 hash of the key's secret
+	Scopes   APIKeyScopes `json:"scopes"`              // Restrictions on the key's access
+	Created  time.Time    `json:"created"`             // Time the key was created
+	Expiry   *time.Time   `json:"expiry,omitempty"`    // Time after which the key can't be used, if set
+	LastUsed *time.Time   `json:"last_used,omitempty"` // Approximate time the key was last used to authenticate
+}
+
+func (key APIKey) validate() error {
+	if key.Name == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "API key name is required")
+	}
+	for _, channel := range key.Scopes.Channels {
+		if !ch.IsValidChannel(channel) || channel == ch.UserStarChannel {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid API key channel %q", channel)
+		}
+	}
+	return nil
+}
+
+func (key APIKey) expired(now time.Time) bool {
+	return key.Expiry != nil && !now.Before(*key.Expiry)
+}
+
+// CreateAPIKey creates a new API key for the user.  Returns the key, and the token used to authenticate with it.  The
+// token isn't stored, and can't be retrieved later.
+func (auth *Authenticator) CreateAPIKey(u User, name string, scopes APIKeyScopes, expiry *time.Time) (*APIKey, string, error) {
+	secret := base.GenerateRandomSecret()
+	hash := sha256.Sum256([]byte(secret))
+	key := APIKey{
+		ID:      base.GenerateRandomID()[:16],
+		Name:    name,
+		Hash:    hex.EncodeToString(hash[:]),
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Expiry:  expiry,
+	}
+	if err := key.validate(); err != nil {
+		return nil, "", err
+	}
+	if key.expired(key.Created) {
+		return nil, "", base.HTTPErrorf(http.StatusBadRequest, "API key expiry must be in the future")
+	}
+
+	createAPIKeyCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+
+		if len(currentUser.APIKeys()) >= maxAPIKeysPerUser {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "User already has the maximum of %d API keys", maxAPIKeysPerUser)
+		}
+		for _, existing := range currentUser.APIKeys() {
+			if existing.Name == name {
+				return nil, base.HTTPErrorf(http.StatusConflict, "User already has an API key named %q", name)
+			}
+		}
+
+		base.Debugf(base.KeyAuth, "Creating API key %s for user %s", key.ID, base.UD(u.Name()))
+		if err := currentUser.AddAPIKey(key); err != nil {
+			return nil, err
+		}
+		return currentUser, nil
+	}
+
+	if err := auth.casUpdatePrincipal(u, createAPIKeyCallback); err != nil {
+		return nil, "", err
+	}
+	token := apiKeyTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(u.Name())) + "." + key.ID + "." + secret
+	return &key, token, nil
+}
+
+// RevokeAPIKey removes the API key with the given ID from the user's API keys.  Returns a 404 error if the user has
+// no such key.
+func (auth *Authenticator) RevokeAPIKey(u User, id string) error {
+
+	revokeAPIKeyCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+
+		if !currentUser.RemoveAPIKey(id) {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "API key not found")
+		}
+		base.Debugf(base.KeyAuth, "Revoked API key %s for user %s", id, base.UD(u.Name()))
+		return currentUser, nil
+	}
+
+	return auth.casUpdatePrincipal(u, revokeAPIKeyCallback)
+}
+
+// AuthenticateAPIKey authenticates an API key token.  Returns nil if the token isn't valid, has expired, or belongs
+// to a disabled user.  Otherwise returns the key's user, restricted to the key's channel scopes; use
+// AuthenticatedAPIKey to get the key.
+func (auth *Authenticator) AuthenticateAPIKey(token string) (User, error) {
+	username, id, secret, ok := parseAPIKeyToken(token)
+	if !ok {
+		return nil, nil
+	}
+	user, err := auth.GetUser(username)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if user == nil || user.Disabled() {
+		return nil, nil
+	}
+
+	key := findAPIKey(user, id)
+	if key == nil {
+		return nil, nil
+	}
+	hash := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(hash[:])), []byte(key.Hash)) != 1 {
+		return nil, nil
+	}
+	now := time.Now().UTC()
+	if key.expired(now) {
+		base.Debugf(base.KeyAuth, "API key %s for user %s has expired", id, base.UD(username))
+		return nil, nil
+	}
+
+	if key.LastUsed == nil || now.Sub(*key.LastUsed) >= apiKeyLastUsedInterval {
+		// Updating the last used time is best effort, and shouldn't fail the request
+		if err := auth.setAPIKeyLastUsed(user, id, now); err != nil {
+			base.Debugf(base.KeyAuth, "Unable to update last used time of API key %s for user %s: %v", id, base.UD(username), err)
+		}
+		if updated := findAPIKey(user, id); updated != nil {
+			key = updated
+		}
+	}
+
+	return newAPIKeyUser(user, *key), nil
+}
+
+func (auth *Authenticator) setAPIKeyLastUsed(u User, id string, lastUsed time.Time) error {
+	return auth.casUpdatePrincipal(u, func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok || !currentUser.SetAPIKeyLastUsed(id, lastUsed) {
+			return nil, base.ErrUpdateCancel
+		}
+		return currentUser, nil
+	})
+}
+
+func parseAPIKeyToken(token string) (username, id, secret string, ok bool) {
+	if !strings.HasPrefix(token, apiKeyTokenPrefix) {
+		return "", "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(token, apiKeyTokenPrefix), ".")
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(name) == 0 {
+		return "", "", "", false
+	}
+	return string(name), parts[1], parts[2], true
+}
+
+func findAPIKey(user User, id string) *APIKey {
+	for _, key := range user.APIKeys() {
+		if key.ID == id {
+			return &key
+		}
+	}
+	return nil
+}
+
+// AuthenticatedAPIKey returns the API key used to authenticate the user, if the user was returned by
+// AuthenticateAPIKey.
+func AuthenticatedAPIKey(user User) (key APIKey, ok bool) {
+	if keyUser, ok := user.(*apiKeyUser); ok {
+		return keyUser.key, true
+	}
+	return APIKey{}, false
+}
+
+// WithAPIKeyScopes returns the reloaded user, restricted to the same API key scopes as previous if previous was
+// authenticated with an API key.  Used when a user is reloaded during a request, so that the reloaded user doesn't
+// gain access the API key doesn't allow.
+func WithAPIKeyScopes(previous User, reloaded User) User {
+	if keyUser, ok := previous.(*apiKeyUser); ok && reloaded != nil {
+		return newAPIKeyUser(reloaded, keyUser.key)
+	}
+	return reloaded
+}
+
+// apiKeyUser is a user authenticated with an API key, whose channel access is restricted to the key's channel scopes.
+type apiKeyUser struct {
+	User
+	key      APIKey
+	channels base.Set // Channels the key is restricted to, or nil if unrestricted
+}
+
+func newAPIKeyUser(user User, key APIKey) *apiKeyUser {
+	keyUser := &apiKeyUser{User: user, key: key}
+	if len(key.Scopes.Channels) > 0 {
+		keyUser.channels = base.SetFromArray(key.Scopes.Channels)
+	}
+	return keyUser
+}
+
+// MarshalJSON marshals the underlying user, so that updates made through an apiKeyUser are saved as usual.
+func (user *apiKeyUser) MarshalJSON() ([]byte, error) {
+	return base.JSONMarshal(user.User)
+}
+
+// restrict returns the channels in the set that the key is allowed to access.  Access to all channels via the star
+// channel is replaced with access to each of the key's channels.
+func (user *apiKeyUser) restrict(channels ch.TimedSet) ch.TimedSet {
+	if user.channels == nil {
+		return channels
+	}
+	starSeq, hasStar := channels[ch.UserStarChannel]
+	restricted := ch.TimedSet{}
+	for channel := range user.channels {
+		if seq, ok := channels[channel]; ok {
+			restricted[channel] = seq
+		} else if hasStar {
+			restricted[channel] = starSeq
+		}
+	}
+	return restricted
+}
+
+func (user *apiKeyUser) Channels() ch.TimedSet {
+	return user.restrict(user.User.Channels())
+}
+
+func (user *apiKeyUser) InheritedChannels() ch.TimedSet {
+	return user.restrict(user.User.InheritedChannels())
+}
+
+func (user *apiKeyUser) CanSeeChannel(channel string) bool {
+	if user.channels != nil && !user.channels.Contains(channel) {
+		return false
+	}
+	return user.User.CanSeeChannel(channel)
+}
+
+func (user *apiKeyUser) CanSeeChannelSince(channel string) uint64 {
+	if user.channels != nil && !user.channels.Contains(channel) {
+		return 0
+	}
+	return user.User.CanSeeChannelSince(channel)
+}
+
+func (user *apiKeyUser) AuthorizeAllChannels(channels base.Set) error {
+	return authorizeAllChannels(user, channels)
+}
+
+func (user *apiKeyUser) AuthorizeAnyChannel(channels base.Set) error {
+	return authorizeAnyChannel(user, channels)
+}
+
+func (user *apiKeyUser) ExpandWildCardChannel(channels base.Set) base.Set {
+	if channels.Contains(ch.AllChannelWildcard) {
+		channels = user.InheritedChannels().AsSet()
+	}
+	return channels
+}
+
+func (user *apiKeyUser) FilterToAvailableChannels(channels base.Set) (filtered ch.TimedSet, removed []string) {
+	filtered = ch.TimedSet{}
+	for channel := range channels {
+		if channel == ch.AllChannelWildcard {
+			return user.InheritedChannels().Copy(), nil
+		}
+		added := filtered.AddChannel(channel, user.CanSeeChannelSince(channel))
+		if !added {
+			removed = append(removed, channel)
+		}
+	}
+	return filtered, removed
+}
+
+func (user *apiKeyUser) GetAddedChannels(channels ch.TimedSet) base.Set {
+	output := base.Set{}
+	for userChannel := range user.InheritedChannels() {
+		if _, found := channels[userChannel]; !found {
+			output[userChannel] = struct{}{}
+		}
+	}
+	return output
+}
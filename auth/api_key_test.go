@@ -0,0 +1,144 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeys(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+	user, err := auth.NewUser("alice", "password", base.SetOf("a", "b"))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// Invalid keys are rejected
+	_, _, err = auth.CreateAPIKey(user, "", APIKeyScopes{}, nil)
+	assert.EqualError(t, err, "400 API key name is required")
+	_, _, err = auth.CreateAPIKey(user, "star", APIKeyScopes{Channels: []string{"*"}}, nil)
+	requireHTTPStatus(t, err, http.StatusBadRequest)
+	expired := time.Now().Add(-time.Minute)
+	_, _, err = auth.CreateAPIKey(user, "expired", APIKeyScopes{}, &expired)
+	requireHTTPStatus(t, err, http.StatusBadRequest)
+
+	key, token, err := auth.CreateAPIKey(user, "job", APIKeyScopes{ReadOnly: true, Channels: []string{"a", "c"}}, nil)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(token, apiKeyTokenPrefix))
+	assert.NotContains(t, key.Hash, strings.Split(token, ".")[2])
+	_, _, err = auth.CreateAPIKey(user, "job", APIKeyScopes{}, nil)
+	requireHTTPStatus(t, err, http.StatusConflict)
+
+	// The key authenticates as the user, restricted to the key's channels
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	require.NotNil(t, keyUser)
+	assert.Equal(t, "alice", keyUser.Name())
+	assert.True(t, keyUser.CanSeeChannel("a"))
+	assert.False(t, keyUser.CanSeeChannel("b"))
+	assert.False(t, keyUser.CanSeeChannel("c"))
+	assert.Equal(t, base.SetOf("a"), keyUser.InheritedChannels().AsSet())
+	assert.Error(t, keyUser.AuthorizeAllChannels(base.SetOf("a", "b")))
+	assert.Equal(t, base.SetOf("a"), keyUser.ExpandWildCardChannel(base.SetOf(ch.AllChannelWildcard)))
+	authenticatedKey, ok := AuthenticatedAPIKey(keyUser)
+	require.True(t, ok)
+	assert.True(t, authenticatedKey.Scopes.ReadOnly)
+	require.NotNil(t, authenticatedKey.LastUsed)
+	_, ok = AuthenticatedAPIKey(user)
+	assert.False(t, ok)
+
+	// Reloaded users keep the key's scopes
+	reloaded, err := auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, reloaded.CanSeeChannel("b"))
+	assert.False(t, WithAPIKeyScopes(keyUser, reloaded).CanSeeChannel("b"))
+	assert.True(t, WithAPIKeyScopes(user, reloaded).CanSeeChannel("b"))
+
+	// Invalid tokens, and keys of disabled users, don't authenticate
+	for _, invalid := range []string{"", "sgk_", "sgk_YWxpY2U.id.secret", token + "x", strings.Replace(token, "sgk_", "", 1)} {
+		keyUser, err = auth.AuthenticateAPIKey(invalid)
+		require.NoError(t, err)
+		assert.Nil(t, keyUser, "token %q", invalid)
+	}
+	reloaded.SetDisabled(true)
+	require.NoError(t, auth.Save(reloaded))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.Nil(t, keyUser)
+	reloaded.SetDisabled(false)
+	require.NoError(t, auth.Save(reloaded))
+
+	// Revoked keys don't authenticate
+	require.NoError(t, auth.RevokeAPIKey(reloaded, key.ID))
+	requireHTTPStatus(t, auth.RevokeAPIKey(reloaded, key.ID), http.StatusNotFound)
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.Nil(t, keyUser)
+}
+
+// A user with access to all channels only has access to the key's channels.
+func TestAPIKeyStarChannel(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+	user, err := auth.NewUser("admin", "password", base.SetOf(ch.UserStarChannel))
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	_, token, err := auth.CreateAPIKey(user, "reports", APIKeyScopes{Channels: []string{"reports"}}, nil)
+	require.NoError(t, err)
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	require.NotNil(t, keyUser)
+	assert.True(t, keyUser.CanSeeChannel("reports"))
+	assert.False(t, keyUser.CanSeeChannel("other"))
+	assert.Equal(t, base.SetOf("reports"), keyUser.InheritedChannels().AsSet())
+	assert.NotZero(t, keyUser.CanSeeChannelSince("reports"))
+}
+
+func TestAPIKeyExpiry(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	expiry := time.Now().Add(time.Second)
+	_, token, err := auth.CreateAPIKey(user, "short", APIKeyScopes{}, &expiry)
+	require.NoError(t, err)
+	keyUser, err := auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.NotNil(t, keyUser)
+
+	time.Sleep(time.Until(expiry))
+	keyUser, err = auth.AuthenticateAPIKey(token)
+	require.NoError(t, err)
+	assert.Nil(t, keyUser)
+}
+
+func requireHTTPStatus(t *testing.T, err error, expectedStatus int) {
+	require.Error(t, err)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, expectedStatus, status)
+}
@@ -34,6 +34,9 @@ type AuthenticatorOptions struct {
 	ChannelsWarningThreshold *uint32
 	SessionCookieName        string
 	BcryptCost               int
+	MFA                      *MFAOptions            // Multi-factor authentication settings, if enabled
+	Lockout                  *LockoutOptions        // Lockout after failed password logins, if enabled
+	PasswordPolicy           *PasswordPolicyOptions // Requirements for new passwords, and password expiry, if enabled
 }
 
 // Interface for deriving the set of channels and roles a User/Role has access to.
@@ -184,6 +187,9 @@ func (auth *Authenticator) getPrincipal(docID string, factory func() Principal)
 
 func (auth *Authenticator) rebuildChannels(princ Principal) error {
 	channels := princ.ExplicitChannels().Copy()
+	if user, ok := princ.(User); ok {
+		channels.Add(user.JWTChannels())
+	}
 
 	if auth.channelComputer != nil {
 		viewChannels, err := auth.channelComputer.ComputeChannelsForPrincipal(princ)
@@ -292,6 +298,9 @@ func (auth *Authenticator) rebuildRoles(user User) error {
 	if explicit := user.ExplicitRoles(); explicit != nil {
 		roles.Add(explicit)
 	}
+	if jwtRoles := user.JWTRoles(); jwtRoles != nil {
+		roles.Add(jwtRoles)
+	}
 
 	roleHistory := auth.calculateHistory(user.Name(), user.GetRoleInvalSeq(), user.InvalidatedRoles(), roles, user.RoleHistory())
 
@@ -497,7 +506,7 @@ func (auth *Authenticator) rehashPassword(user User, password string) error {
 		if costErr == nil && hashCost != auth.BcryptCost {
 			// the cost of the existing hash is different than the configured bcrypt cost.
 			// We'll re-hash the password to adopt the new cost:
-			currentUserImpl.SetPassword(password)
+			currentUserImpl.setPasswordHash(password)
 			return currentUserImpl, nil
 		} else {
 			return nil, base.ErrUpdateCancel
@@ -606,8 +615,10 @@ func (auth *Authenticator) AuthenticateUser(username string, password string) (U
 // issuer in the token with a provider.
 // Used to authenticate a JWT token coming from an insecure source (e.g. client request)
 // If the token is validated but the user for the username defined in the subject claim doesn't exist,
-// creates the user when autoRegister=true.
-func (auth *Authenticator) AuthenticateUntrustedJWT(token string, providers OIDCProviderMap, callbackURLFunc OIDCCallbackURLFunc) (User, error) {
+// creates the user when autoRegister=true.  Also returns the roles and channels granted by the token's claims,
+// if the provider maps them.  Tokens from the issuer of a local JWT provider are verified with its keys, without
+// any network access.
+func (auth *Authenticator) AuthenticateUntrustedJWT(token string, providers OIDCProviderMap, localProviders LocalJWTProviderMap, callbackURLFunc OIDCCallbackURLFunc) (User, *JWTGrants, error) {
 
 	base.Debugf(base.KeyAuth, "AuthenticateUntrustedJWT called with token: %s", base.UD(token))
 	var provider *OIDCProvider
@@ -615,38 +626,45 @@ func (auth *Authenticator) AuthenticateUntrustedJWT(token string, providers OIDC
 
 	provider, ok := providers.getProviderWhenSingle()
 
-	if !ok {
+	if !ok || len(localProviders) > 0 {
 		// Parse JWT (needed to determine issuer/provider)
-		jwt, err := jwt.ParseSigned(token)
+		parsedToken, err := jwt.ParseSigned(token)
 		if err != nil {
 			base.Debugf(base.KeyAuth, "Error parsing JWT in AuthenticateUntrustedJWT: %v", err)
-			return nil, err
+			return nil, nil, err
 		}
 
 		// Extract issuer and audience(s) from JSON Web Token.
 		var audiences []string
-		issuer, audiences, err = getIssuerWithAudience(jwt)
+		issuer, audiences, err = getIssuerWithAudience(parsedToken)
 		base.Debugf(base.KeyAuth, "JWT issuer: %v, audiences: %v", base.UD(issuer), base.UD(audiences))
 		if err != nil {
 			base.Debugf(base.KeyAuth, "Error getting issuer and audience from token: %v", err)
-			return nil, err
+			return nil, nil, err
 		}
 
-		base.Debugf(base.KeyAuth, "Call GetProviderForIssuer w/ providers: %+v", base.UD(providers))
-		provider = providers.GetProviderForIssuer(issuer, audiences)
-		base.Debugf(base.KeyAuth, "Provider for issuer: %+v", base.UD(provider))
+		if localProvider := localProviders.getProviderForIssuer(issuer, audiences); localProvider != nil {
+			base.Debugf(base.KeyAuth, "Local JWT provider for issuer: %v", base.UD(localProvider.Name))
+			return auth.authenticateLocalJWT(parsedToken, localProvider)
+		}
+
+		if !ok {
+			base.Debugf(base.KeyAuth, "Call GetProviderForIssuer w/ providers: %+v", base.UD(providers))
+			provider = providers.GetProviderForIssuer(issuer, audiences)
+			base.Debugf(base.KeyAuth, "Provider for issuer: %+v", base.UD(provider))
+		}
 	}
 
 	if provider == nil {
-		return nil, base.RedactErrorf("No provider found for issuer %v", base.UD(issuer))
+		return nil, nil, base.RedactErrorf("No provider found for issuer %v", base.UD(issuer))
 	}
 
 	identity, verifyErr := verifyToken(token, provider, callbackURLFunc)
 	if verifyErr != nil {
-		return nil, verifyErr
+		return nil, nil, verifyErr
 	}
-	user, _, err := auth.authenticateOIDCIdentity(identity, provider)
-	return user, err
+	user, grants, _, err := auth.authenticateOIDCIdentity(identity, provider)
+	return user, grants, err
 }
 
 // verifyToken verifies claims and signature on the token; ensure that it's been signed by the provider.
@@ -679,9 +697,10 @@ func verifyToken(token string, provider *OIDCProvider, callbackURLFunc OIDCCallb
 // Authenticates a user based on a JWT token obtained directly from a provider (auth code flow, refresh flow).
 // Verifies the token claims, but doesn't require signature verification if allow_unsigned_provider_tokens is enabled.
 // If the token is validated but the user for the username defined in the subject claim doesn't exist,
-// creates the user when autoRegister=true.
+// creates the user when autoRegister=true.  Also returns the roles and channels granted by the token's claims,
+// if the provider maps them.
 func (auth *Authenticator) AuthenticateTrustedJWT(token string, provider *OIDCProvider, callbackURLFunc OIDCCallbackURLFunc) (user User,
-	tokenExpiry time.Time, err error) {
+	grants *JWTGrants, tokenExpiry time.Time, err error) {
 	base.Debugf(base.KeyAuth, "AuthenticateTrustedJWT called with token: %s", base.UD(token))
 
 	var identity *Identity
@@ -690,60 +709,77 @@ func (auth *Authenticator) AuthenticateTrustedJWT(token string, provider *OIDCPr
 		identity, err = VerifyClaims(token, provider.ClientID, provider.Issuer)
 		if err != nil {
 			base.Debugf(base.KeyAuth, "Error verifying raw token in AuthenticateTrustedJWT: %v", err)
-			return nil, time.Time{}, err
+			return nil, nil, time.Time{}, err
 		}
 	} else {
 		// Verify claims and signature on the JWT.
 		var verifyErr error
 		identity, verifyErr = verifyToken(token, provider, callbackURLFunc)
 		if verifyErr != nil {
-			return nil, time.Time{}, verifyErr
+			return nil, nil, time.Time{}, verifyErr
 		}
 	}
 
 	return auth.authenticateOIDCIdentity(identity, provider)
 }
 
-// Obtains a Sync Gateway User for the JWT. Expects that the JWT has already been verified for OIDC compliance.
-func (auth *Authenticator) authenticateOIDCIdentity(identity *Identity, provider *OIDCProvider) (user User, tokenExpiry time.Time, err error) {
+// Obtains a Sync Gateway User for the JWT, and the roles and channels granted by its claims. Expects that the JWT has
+// already been verified for OIDC compliance.
+func (auth *Authenticator) authenticateOIDCIdentity(identity *Identity, provider *OIDCProvider) (user User, grants *JWTGrants, tokenExpiry time.Time, err error) {
 	if identity == nil || identity.Subject == "" {
 		base.Debugf(base.KeyAuth, "Empty subject found in OIDC identity: %v", base.UD(identity))
-		return nil, time.Time{}, errors.New("subject not found in OIDC identity")
+		return nil, nil, time.Time{}, errors.New("subject not found in OIDC identity")
 	}
 	username, err := getOIDCUsername(provider, identity)
 	if err != nil {
 		base.Debugf(base.KeyAuth, "Error retrieving OIDCUsername: %v", err)
-		return nil, time.Time{}, err
+		return nil, nil, time.Time{}, err
 	}
 	base.Debugf(base.KeyAuth, "OIDCUsername: %v", base.UD(username))
 
-	user, err = auth.GetUser(username)
+	grants, err = provider.jwtGrants(identity)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error mapping claims to roles and channels: %v", err)
+		return nil, nil, time.Time{}, err
+	}
+
+	user, err = auth.getOrRegisterJWTUser(username, identity.Email, provider.Register)
+	if err != nil {
+		return nil, nil, time.Time{}, err
+	}
+	return user, grants, identity.Expiry, nil
+}
+
+// getOrRegisterJWTUser returns the user authenticated by a verified token, updating their email address if it's
+// changed.  If the user doesn't exist, it's created if register is true, otherwise nil is returned.
+func (auth *Authenticator) getOrRegisterJWTUser(username, email string, register bool) (User, error) {
+	user, err := auth.GetUser(username)
 	if err != nil {
 		base.Debugf(base.KeyAuth, "Error retrieving user for username %q: %v", base.UD(username), err)
-		return nil, time.Time{}, err
+		return nil, err
 	}
 
 	// If user found, check whether the email needs to be updated (e.g. user has changed email in external auth system)
-	if user != nil && identity.Email != "" && user.Email() != identity.Email {
-		err = auth.UpdateUserEmail(user, identity.Email)
+	if user != nil && email != "" && user.Email() != email {
+		err = auth.UpdateUserEmail(user, email)
 		if err != nil {
-			base.Warnf("Unable to set user email to %v for OIDC", base.UD(identity.Email))
+			base.Warnf("Unable to set user email to %v for OIDC", base.UD(email))
 		}
 	}
 
 	// Auto-registration. This will normally be done when token is originally returned
 	// to client by oidc callback, but also needed here to handle clients obtaining their own tokens.
-	if user == nil && provider.Register {
-		base.Debugf(base.KeyAuth, "Registering new user: %v with email: %v", base.UD(username), base.UD(identity.Email))
+	if user == nil && register {
+		base.Debugf(base.KeyAuth, "Registering new user: %v with email: %v", base.UD(username), base.UD(email))
 		var err error
-		user, err = auth.RegisterNewUser(username, identity.Email)
+		user, err = auth.RegisterNewUser(username, email)
 		if err != nil && !base.IsCasMismatch(err) {
 			base.Debugf(base.KeyAuth, "Error registering new user: %v", err)
-			return nil, time.Time{}, err
+			return nil, err
 		}
 	}
 
-	return user, identity.Expiry, nil
+	return user, nil
 }
 
 // Registers a new user account based on the given verified username and optional email address.
@@ -690,14 +690,14 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 	require.NoError(t, err, "Failed to create RSA signer")
 
 	t.Run("malformed token with bad header no payload", func(t *testing.T) {
-		user, expiry, err := auth.AuthenticateTrustedJWT("DmBb9C5", providerGoogle, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT("DmBb9C5", providerGoogle, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
 	})
 
 	t.Run("malformed token with bad header bad payload", func(t *testing.T) {
-		user, expiry, err := auth.AuthenticateTrustedJWT("DmBb9C5.C#m7G#7", providerGoogle, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT("DmBb9C5.C#m7G#7", providerGoogle, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -705,7 +705,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 
 	t.Run("malformed token with bad header bad base64 payload", func(t *testing.T) {
 		token := "DmBb9C5." + ToBase64String(`{"unknown":"value"}`)
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, providerGoogle, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, providerGoogle, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -719,7 +719,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 			Name:        providerGoogle.Name,
 			Issuer:      issuerGoogleAccounts,
 			CallbackURL: providerGoogle.CallbackURL}
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Error checking clientID config")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -749,7 +749,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted JWT")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Equal(t, claims.Expiry.Time(), expiry)
@@ -776,7 +776,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Error verifying issuer claim from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -803,7 +803,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Error verifying audience claim from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -829,7 +829,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Error verifying audience claim from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -856,7 +856,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Can't authenticate with expired token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -887,7 +887,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted token")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Equal(t, claims.Expiry.Time(), expiry)
@@ -915,7 +915,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Token with expired nbf (not before) time")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -941,7 +941,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.Error(t, err, "Token must contain valid subject claim")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 		assert.Equal(t, time.Time{}, expiry, "Expiry should be zero time instant")
@@ -980,7 +980,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims).Claims(claimEmail)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted JWT")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Equal(t, claims.Expiry.Time(), expiry)
@@ -1018,7 +1018,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims).Claims(claimEmail)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted JWT")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Equal(t, claims.Expiry.Time(), expiry)
@@ -1057,7 +1057,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims).Claims(claimEmail)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted JWT")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Equal(t, claims.Expiry.Time(), expiry)
@@ -1090,7 +1090,7 @@ func TestAuthenticateTrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims).Claims(claimEmail)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
+		user, _, expiry, err := auth.AuthenticateTrustedJWT(token, provider, callbackURLFunc)
 		assert.NoError(t, err, "Error authenticating with trusted JWT")
 		assert.Equal(t, wantUsername, user.Name())
 		assert.Empty(t, "", user.Email(), "Should skip updating invalid email from token")
@@ -1197,28 +1197,28 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 
 	t.Run("no provider malformed token with bad header no payload", func(t *testing.T) {
 		var providers OIDCProviderMap
-		user, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, nil, callbackURLFunc)
 		assert.Error(t, err, "No provider found to authenticate token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
 
 	t.Run("single provider malformed token with bad header no payload", func(t *testing.T) {
 		providers := OIDCProviderMap{providerGoogle.Name: providerGoogle}
-		user, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, nil, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
 
 	t.Run("multiple providers malformed token with bad header no payload", func(t *testing.T) {
 		providers := OIDCProviderMap{providerGoogle.Name: providerGoogle, providerFacebook.Name: providerFacebook}
-		user, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT("DmBb9C5", providers, nil, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
 
 	t.Run("multiple providers malformed token with bad header bad payload", func(t *testing.T) {
 		providers := OIDCProviderMap{providerGoogle.Name: providerGoogle, providerFacebook.Name: providerFacebook}
-		user, err := auth.AuthenticateUntrustedJWT("DmBb9C5.C#m7G#7", providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT("DmBb9C5.C#m7G#7", providers, nil, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1226,7 +1226,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 	t.Run("multiple providers malformed token with bad header bad base64 payload", func(t *testing.T) {
 		providers := OIDCProviderMap{providerGoogle.Name: providerGoogle, providerFacebook.Name: providerFacebook}
 		token := "DmBb9C5." + ToBase64String(`{"unknown":"value"}`)
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		assert.Error(t, err, "Error parsing malformed token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1236,7 +1236,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "Error getting issuer and audience from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1246,7 +1246,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{Issuer: issuerGoogleAccounts})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "Error getting issuer and audience from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1256,7 +1256,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{Issuer: issuerGoogleAccounts, Audience: jwt.Audience{}})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "Error getting issuer and audience from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1266,7 +1266,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{Audience: jwt.Audience{"aud1", "aud2", "aud3"}})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "Error getting issuer and audience from token")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1276,7 +1276,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{Issuer: issuerAmazonAccounts, Audience: jwt.Audience{"aud1"}})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "No provider found against the configured issuer")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1286,7 +1286,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(jwt.Claims{Issuer: issuerGoogleAccounts, Audience: jwt.Audience{"aud2"}})
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		require.Error(t, err, "No provider found against the configured issuer")
 		assert.Nil(t, user, "User shouldn't be created or retrieved")
 	})
@@ -1313,7 +1313,7 @@ func TestAuthenticateUntrustedJWT(t *testing.T) {
 		builder := jwt.Signed(signer).Claims(claims)
 		token, err := builder.CompactSerialize()
 		require.NoError(t, err, "Error serializing token using compact serialization format")
-		user, err := auth.AuthenticateUntrustedJWT(token, providers, callbackURLFunc)
+		user, _, err := auth.AuthenticateUntrustedJWT(token, providers, nil, callbackURLFunc)
 		assert.Error(t, err, "Error authenticating with trusted JWT")
 		assert.Nil(t, user, "User shouldn't be returned without signature verification")
 	})
@@ -0,0 +1,143 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"fmt"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+)
+
+// JWTGrants are the roles and channels granted to a user by the claims of the token they authenticated with.  The
+// caller is responsible for saving them to the user at a new sequence, as they would for grants made through the
+// admin API.
+type JWTGrants struct {
+	Roles    base.Set
+	Channels base.Set
+}
+
+// JWTClaimMapping maps the values of a claim to the roles or channels they grant, e.g. an identity provider group to
+// the roles of its members.
+type JWTClaimMapping map[string][]string
+
+// jwtClaimGrant grants the values of a claim as roles or channels, mapping them through the mapping if set.
+type jwtClaimGrant struct {
+	claim   string
+	mapping JWTClaimMapping
+}
+
+// jwtGrants returns the roles and channels granted by the provider's RolesClaim and ChannelsClaim, or nil if neither
+// is configured.
+func (op *OIDCProvider) jwtGrants(identity *Identity) (*JWTGrants, error) {
+	return getJWTGrants(jwtClaimGrant{op.RolesClaim, op.RolesMap}, jwtClaimGrant{op.ChannelsClaim, op.ChannelsMap}, identity)
+}
+
+// ValidateClaimMappings returns an error if the provider's RolesMap or ChannelsMap is invalid.
+func (op *OIDCProvider) ValidateClaimMappings() error {
+	return validateJWTClaimMappings(op.Name, jwtClaimGrant{op.RolesClaim, op.RolesMap}, jwtClaimGrant{op.ChannelsClaim, op.ChannelsMap})
+}
+
+// validateJWTClaimMappings checks that mappings are only set for configured claims, and only map to valid role and
+// channel names.
+func validateJWTClaimMappings(providerName string, roles, channels jwtClaimGrant) error {
+	if (roles.mapping != nil && roles.claim == "") || (channels.mapping != nil && channels.claim == "") {
+		return fmt.Errorf("provider %q: roles_map and channels_map require roles_claim and channels_claim", providerName)
+	}
+	for value, mapped := range roles.mapping {
+		for _, role := range mapped {
+			if !IsValidPrincipalName(role) {
+				return fmt.Errorf("provider %q: roles_map value %q maps to invalid role name %q", providerName, value, role)
+			}
+		}
+	}
+	for value, mapped := range channels.mapping {
+		for _, channel := range mapped {
+			if !ch.IsValidChannel(channel) {
+				return fmt.Errorf("provider %q: channels_map value %q maps to invalid channel name %q", providerName, value, channel)
+			}
+		}
+	}
+	return nil
+}
+
+// getJWTGrants returns the roles and channels granted by the values of the roles and channels claims, or nil if
+// neither claim is set.  A missing claim grants nothing, revoking any previous grants.  When a claim has a mapping,
+// each value grants the roles or channels it maps to, and values that aren't mapped grant nothing.  Otherwise the
+// values are granted as-is, and values that aren't valid role or channel names are ignored.
+func getJWTGrants(roles, channels jwtClaimGrant, identity *Identity) (*JWTGrants, error) {
+	if roles.claim == "" && channels.claim == "" {
+		return nil, nil
+	}
+	grants := &JWTGrants{Roles: base.Set{}, Channels: base.Set{}}
+	if roles.claim != "" {
+		values, err := roles.grantedValues(identity, "role", IsValidPrincipalName)
+		if err != nil {
+			return nil, err
+		}
+		grants.Roles = grants.Roles.UpdateWithSlice(values)
+	}
+	if channels.claim != "" {
+		values, err := channels.grantedValues(identity, "channel", ch.IsValidChannel)
+		if err != nil {
+			return nil, err
+		}
+		grants.Channels = grants.Channels.UpdateWithSlice(values)
+	}
+	return grants, nil
+}
+
+// grantedValues returns the roles or channels granted by the claim's values.
+func (g jwtClaimGrant) grantedValues(identity *Identity, kind string, isValid func(string) bool) ([]string, error) {
+	values, err := claimValues(identity.Claims, g.claim)
+	if err != nil {
+		return nil, err
+	}
+	granted := make([]string, 0, len(values))
+	for _, value := range values {
+		if g.mapping != nil {
+			mapped, ok := g.mapping[value]
+			if !ok {
+				base.Debugf(base.KeyAuth, "No %s mapping for value %q of claim %q", kind, base.UD(value), g.claim)
+			}
+			granted = append(granted, mapped...)
+			continue
+		}
+		if !isValid(value) {
+			base.Warnf("Ignoring invalid %s name %q in claim %q of token for %s", kind, base.UD(value), g.claim, base.UD(identity.Subject))
+			continue
+		}
+		granted = append(granted, value)
+	}
+	return granted, nil
+}
+
+// claimValues returns the value of a string or string array claim.  Returns no values if the claim is missing.
+func claimValues(claims map[string]interface{}, claim string) ([]string, error) {
+	switch value := claims[claim].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{value}, nil
+	case []string:
+		return value, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			str, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("oidc: claim %q must be a string or an array of strings", claim)
+			}
+			values = append(values, str)
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("oidc: claim %q must be a string or an array of strings", claim)
+	}
+}
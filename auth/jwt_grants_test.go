@@ -0,0 +1,141 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	ch "github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJWTGrants(t *testing.T) {
+	provider := &OIDCProvider{Name: "foo", RolesClaim: "groups", ChannelsClaim: "tenant"}
+
+	tests := []struct {
+		name     string
+		claims   map[string]interface{}
+		roles    base.Set
+		channels base.Set
+		err      bool
+	}{
+		{
+			name:     "array and string claims",
+			claims:   map[string]interface{}{"groups": []interface{}{"admins", "users"}, "tenant": "acme"},
+			roles:    base.SetOf("admins", "users"),
+			channels: base.SetOf("acme"),
+		},
+		{
+			name:     "missing claims grant nothing",
+			claims:   map[string]interface{}{},
+			roles:    base.Set{},
+			channels: base.Set{},
+		},
+		{
+			name:     "invalid names are ignored",
+			claims:   map[string]interface{}{"groups": []interface{}{"in/valid", "users"}, "tenant": "a,b"},
+			roles:    base.SetOf("users"),
+			channels: base.Set{},
+		},
+		{
+			name:   "non-string array value",
+			claims: map[string]interface{}{"groups": []interface{}{"users", 1.0}},
+			err:    true,
+		},
+		{
+			name:   "non-string value",
+			claims: map[string]interface{}{"tenant": true},
+			err:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			grants, err := provider.jwtGrants(&Identity{Subject: "noah", Claims: test.claims})
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.NotNil(t, grants)
+			assert.Equal(t, test.roles, grants.Roles)
+			assert.Equal(t, test.channels, grants.Channels)
+		})
+	}
+
+	// Providers that don't map claims don't return grants, so that existing grants are left unchanged
+	grants, err := (&OIDCProvider{Name: "bar"}).jwtGrants(&Identity{Subject: "noah", Claims: map[string]interface{}{"groups": "users"}})
+	require.NoError(t, err)
+	assert.Nil(t, grants)
+}
+
+func TestJWTGrantsMapping(t *testing.T) {
+	provider := &OIDCProvider{
+		Name:          "foo",
+		RolesClaim:    "groups",
+		RolesMap:      JWTClaimMapping{"engineering": {"developer", "reviewer"}, "admins": {"admin"}},
+		ChannelsClaim: "tenant",
+		ChannelsMap:   JWTClaimMapping{"acme": {"tenant-acme"}},
+	}
+	require.NoError(t, provider.ValidateClaimMappings())
+
+	// Mapped values grant the roles and channels they map to, and unmapped values grant nothing, even when valid names
+	grants, err := provider.jwtGrants(&Identity{Subject: "noah", Claims: map[string]interface{}{
+		"groups": []interface{}{"engineering", "sales", "in/valid"},
+		"tenant": "acme",
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, base.SetOf("developer", "reviewer"), grants.Roles)
+	assert.Equal(t, base.SetOf("tenant-acme"), grants.Channels)
+
+	grants, err = provider.jwtGrants(&Identity{Subject: "noah", Claims: map[string]interface{}{"groups": "sales", "tenant": "other"}})
+	require.NoError(t, err)
+	assert.Equal(t, base.Set{}, grants.Roles)
+	assert.Equal(t, base.Set{}, grants.Channels)
+
+	// Mappings must map to valid names, and require their claim
+	for _, invalid := range []*OIDCProvider{
+		{Name: "foo", RolesClaim: "groups", RolesMap: JWTClaimMapping{"engineering": {"in/valid"}}},
+		{Name: "foo", ChannelsClaim: "tenant", ChannelsMap: JWTClaimMapping{"acme": {"a,b"}}},
+		{Name: "foo", RolesMap: JWTClaimMapping{"engineering": {"developer"}}},
+	} {
+		assert.Error(t, invalid.ValidateClaimMappings(), "provider %+v", invalid)
+	}
+}
+
+func TestRebuildWithJWTGrants(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+
+	user, err := auth.NewUser("testUser", "letmein", ch.SetOf(t, "explicit"))
+	require.NoError(t, err)
+	user.SetExplicitRoles(ch.AtSequence(base.SetOf("admin_role"), 1), 1)
+	user.SetJWTRoles(ch.AtSequence(base.SetOf("jwt_role"), 2), 2)
+	user.SetJWTChannels(ch.AtSequence(base.SetOf("jwt_channel"), 2), 2)
+	require.NoError(t, auth.Save(user))
+
+	// Roles and channels granted by claims are included alongside those granted through the admin API
+	user, err = auth.GetUser("testUser")
+	require.NoError(t, err)
+	assert.Equal(t, base.SetOf("admin_role", "jwt_role"), user.RoleNames().AsSet())
+	assert.Equal(t, base.SetOf("explicit", "jwt_channel", "!"), user.Channels().AsSet())
+
+	// Revoking a claim grant records history, as for any other revocation
+	user.SetJWTRoles(ch.TimedSet{}, 3)
+	user.SetJWTChannels(ch.TimedSet{}, 3)
+	require.NoError(t, auth.Save(user))
+	user, err = auth.GetUser("testUser")
+	require.NoError(t, err)
+	assert.Equal(t, base.SetOf("admin_role"), user.RoleNames().AsSet())
+	assert.Equal(t, base.SetOf("explicit", "!"), user.Channels().AsSet())
+	assert.Contains(t, user.RoleHistory(), "jwt_role")
+	assert.Contains(t, user.ChannelHistory(), "jwt_channel")
+}
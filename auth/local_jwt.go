@@ -0,0 +1,233 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// DefaultLocalJWTAlgorithms are the signing algorithms accepted by a local JWT provider, if not configured.  Only
+// asymmetric algorithms are supported, as tokens are verified with public keys.
+var DefaultLocalJWTAlgorithms = []string{
+	string(jose.RS256), string(jose.RS384), string(jose.RS512),
+	string(jose.PS256), string(jose.PS384), string(jose.PS512),
+	string(jose.ES256), string(jose.ES384), string(jose.ES512),
+	string(jose.EdDSA),
+}
+
+// LocalJWTProvider authenticates bearer tokens signed with keys configured locally, as PEM encoded public keys or a
+// JWKS file, for services that mint their own tokens.  Unlike OIDCProvider, no discovery or other network access is
+// needed.
+type LocalJWTProvider struct {
+	Issuer        string   `json:"issuer"`                   // Required value of the token's iss claim
+	Audience      string   `json:"audience"`                 // Value that must be included in the token's aud claim
+	Algorithms    []string `json:"algorithms,omitempty"`     // Accepted signing algorithms.  Defaults to DefaultLocalJWTAlgorithms
+	PublicKeys    []string `json:"public_keys,omitempty"`    // PEM encoded public keys or certificates that tokens may be signed with
+	JWKSFile      string   `json:"jwks_file,omitempty"`      // Path to a JSON Web Key Set file of keys that tokens may be signed with
+	Register      bool     `json:"register,omitempty"`       // If true, users are created on their first login
+	UserPrefix    string   `json:"user_prefix,omitempty"`    // Username prefix for users authenticated by this provider.  Defaults to the provider name
+	UsernameClaim string   `json:"username_claim,omitempty"` // Claim used as the username instead of the subject
+	RolesClaim    string   `json:"roles_claim,omitempty"`    // Claim whose values are granted as roles on every login
+	ChannelsClaim string   `json:"channels_claim,omitempty"` // Claim whose values are granted as channels on every login
+
+	RolesMap    JWTClaimMapping `json:"roles_map,omitempty"`    // Maps RolesClaim values to the roles they grant.  Unmapped values grant nothing
+	ChannelsMap JWTClaimMapping `json:"channels_map,omitempty"` // Maps ChannelsClaim values to the channels they grant.  Unmapped values grant nothing
+
+	// Name represents the name of this provider.
+	Name string `json:"-"`
+
+	// keys are the public keys loaded by Init.
+	keys []jose.JSONWebKey
+}
+
+type LocalJWTProviderMap map[string]*LocalJWTProvider
+
+// Init loads the provider's keys, and sets its default user prefix.  Must be called before the provider is used.
+func (lp *LocalJWTProvider) Init(name string) error {
+	lp.Name = name
+	if lp.UserPrefix == "" && lp.UsernameClaim == "" {
+		lp.UserPrefix = name
+	}
+
+	lp.keys = nil
+	for i, encoded := range lp.PublicKeys {
+		key, err := parsePEMPublicKey([]byte(encoded))
+		if err != nil {
+			return fmt.Errorf("invalid public key %d for local JWT provider %q: %w", i, name, err)
+		}
+		lp.keys = append(lp.keys, jose.JSONWebKey{Key: key})
+	}
+	if lp.JWKSFile != "" {
+		keys, err := loadJWKSFile(lp.JWKSFile)
+		if err != nil {
+			return fmt.Errorf("unable to load JWKS file for local JWT provider %q: %w", name, err)
+		}
+		lp.keys = append(lp.keys, keys...)
+	}
+	if len(lp.keys) == 0 {
+		return fmt.Errorf("no keys configured for local JWT provider %q", name)
+	}
+	return validateJWTClaimMappings(name, jwtClaimGrant{lp.RolesClaim, lp.RolesMap}, jwtClaimGrant{lp.ChannelsClaim, lp.ChannelsMap})
+}
+
+// algorithmAllowed returns true if tokens signed with the given algorithm are accepted.
+func (lp *LocalJWTProvider) algorithmAllowed(algorithm string) bool {
+	algorithms := lp.Algorithms
+	if len(algorithms) == 0 {
+		algorithms = DefaultLocalJWTAlgorithms
+	}
+	return base.ContainsString(algorithms, algorithm)
+}
+
+// verifyToken verifies the token's signature with the provider's keys, and its issuer, audience, expiry and
+// not-before claims.  Returns the identity claims from the token.
+func (lp *LocalJWTProvider) verifyToken(token *jwt.JSONWebToken) (*Identity, error) {
+	if len(token.Headers) != 1 {
+		return nil, errors.New("local jwt: token must have a single signature")
+	}
+	header := token.Headers[0]
+	if !lp.algorithmAllowed(header.Algorithm) {
+		return nil, fmt.Errorf("local jwt: signing algorithm %q not allowed", header.Algorithm)
+	}
+
+	// Only keys with a matching key ID are tried, if the token specifies one
+	var payload json.RawMessage
+	verified := false
+	for _, key := range lp.keys {
+		if header.KeyID != "" && key.KeyID != "" && key.KeyID != header.KeyID {
+			continue
+		}
+		if err := token.Claims(key.Key, &payload); err == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("local jwt: failed to verify signature")
+	}
+
+	var claims jwt.Claims
+	if err := base.JSONUnmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("local jwt: failed to unmarshal claims: %v", err)
+	}
+	if claims.Expiry == nil {
+		return nil, errors.New("local jwt: token has no expiry")
+	}
+	expected := jwt.Expected{Issuer: lp.Issuer, Audience: jwt.Audience{lp.Audience}, Time: time.Now()}
+	if err := claims.ValidateWithLeeway(expected, jwt.DefaultLeeway); err != nil {
+		return nil, fmt.Errorf("local jwt: %v", err)
+	}
+
+	identityJson, err := UnmarshalIdentityJSON(payload)
+	if err != nil {
+		return nil, fmt.Errorf("local jwt: failed to unmarshal claims: %v", err)
+	}
+	return &Identity{
+		Issuer:   identityJson.Issuer,
+		Subject:  identityJson.Subject,
+		Audience: []string(identityJson.Audience),
+		Expiry:   time.Time(identityJson.Expiry),
+		IssuedAt: time.Time(identityJson.IssuedAt),
+		Email:    identityJson.Email,
+		Claims:   identityJson.Claims,
+	}, nil
+}
+
+// getProviderForIssuer returns the provider for the token's issuer and audience, or nil if there's none.
+func (lpm LocalJWTProviderMap) getProviderForIssuer(issuer string, audiences []string) *LocalJWTProvider {
+	for _, provider := range lpm {
+		if provider.Issuer == issuer && base.ContainsString(audiences, provider.Audience) {
+			return provider
+		}
+	}
+	return nil
+}
+
+// authenticateLocalJWT authenticates a token issued by a local JWT provider.
+func (auth *Authenticator) authenticateLocalJWT(token *jwt.JSONWebToken, provider *LocalJWTProvider) (User, *JWTGrants, error) {
+	identity, err := provider.verifyToken(token)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Local JWT provider %s could not verify JWT. Error: %v", base.UD(provider.Name), err)
+		return nil, nil, err
+	}
+	if identity.Subject == "" {
+		return nil, nil, errors.New("subject not found in local JWT")
+	}
+	username, err := getJWTUsername(provider.UserPrefix, provider.UsernameClaim, identity)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error retrieving username for local JWT: %v", err)
+		return nil, nil, err
+	}
+	grants, err := getJWTGrants(jwtClaimGrant{provider.RolesClaim, provider.RolesMap}, jwtClaimGrant{provider.ChannelsClaim, provider.ChannelsMap}, identity)
+	if err != nil {
+		base.Debugf(base.KeyAuth, "Error mapping claims to roles and channels: %v", err)
+		return nil, nil, err
+	}
+	user, err := auth.getOrRegisterJWTUser(username, identity.Email, provider.Register)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, grants, nil
+}
+
+// parsePEMPublicKey parses a PEM encoded PKIX or PKCS #1 public key, or the public key of a certificate.
+func parsePEMPublicKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+}
+
+// loadJWKSFile loads the signing keys in a JSON Web Key Set file.  Private keys are rejected, so that they aren't
+// mistakenly deployed with Sync Gateway.
+func loadJWKSFile(path string) ([]jose.JSONWebKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keySet jose.JSONWebKeySet
+	if err := base.JSONUnmarshal(data, &keySet); err != nil {
+		return nil, err
+	}
+	keys := make([]jose.JSONWebKey, 0, len(keySet.Keys))
+	for _, key := range keySet.Keys {
+		if !key.IsPublic() {
+			return nil, fmt.Errorf("key %q is not a public key", key.KeyID)
+		}
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,223 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	localJWTIssuer   = "https://auth.example.com"
+	localJWTAudience = "sync"
+)
+
+// signLocalJWT returns a token with the given claims, signed with key.
+func signLocalJWT(t *testing.T, key interface{}, algorithm jose.SignatureAlgorithm, keyID string, claims map[string]interface{}) string {
+	options := &jose.SignerOptions{}
+	if keyID != "" {
+		options = options.WithHeader(jose.HeaderKey("kid"), keyID)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, options)
+	require.NoError(t, err)
+	token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+	require.NoError(t, err)
+	return token
+}
+
+// localJWTClaims returns valid claims for a token issued to subject.
+func localJWTClaims(subject string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss": localJWTIssuer,
+		"aud": localJWTAudience,
+		"sub": subject,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	}
+}
+
+func encodePublicKeyPEM(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestLocalJWTVerifyToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	edPublicKey, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	provider := &LocalJWTProvider{
+		Issuer:     localJWTIssuer,
+		Audience:   localJWTAudience,
+		PublicKeys: []string{encodePublicKeyPEM(t, &rsaKey.PublicKey), encodePublicKeyPEM(t, edPublicKey)},
+	}
+	require.NoError(t, provider.Init("internal"))
+	assert.Equal(t, "internal", provider.UserPrefix)
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := localJWTClaims("alice")
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name      string
+		key       interface{}
+		algorithm jose.SignatureAlgorithm
+		claims    map[string]interface{}
+		err       bool
+	}{
+		{name: "RSA", key: rsaKey, algorithm: jose.RS256, claims: localJWTClaims("alice")},
+		{name: "RSA-PSS", key: rsaKey, algorithm: jose.PS256, claims: localJWTClaims("alice")},
+		{name: "EdDSA", key: edKey, algorithm: jose.EdDSA, claims: localJWTClaims("alice")},
+		{name: "audience list", key: rsaKey, algorithm: jose.RS256, claims: withClaim("aud", []string{"other", localJWTAudience})},
+		{name: "unknown key", key: otherRSAKey, algorithm: jose.RS256, claims: localJWTClaims("alice"), err: true},
+		{name: "symmetric algorithm", key: []byte("secretsecretsecretsecretsecret!!"), algorithm: jose.HS256, claims: localJWTClaims("alice"), err: true},
+		{name: "wrong issuer", key: rsaKey, algorithm: jose.RS256, claims: withClaim("iss", "https://other.example.com"), err: true},
+		{name: "wrong audience", key: rsaKey, algorithm: jose.RS256, claims: withClaim("aud", "other"), err: true},
+		{name: "expired", key: rsaKey, algorithm: jose.RS256, claims: withClaim("exp", time.Now().Add(-time.Hour).Unix()), err: true},
+		{name: "no expiry", key: rsaKey, algorithm: jose.RS256, claims: withClaim("exp", nil), err: true},
+		{name: "not yet valid", key: rsaKey, algorithm: jose.RS256, claims: withClaim("nbf", time.Now().Add(time.Hour).Unix()), err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, err := jwt.ParseSigned(signLocalJWT(t, test.key, test.algorithm, "", test.claims))
+			require.NoError(t, err)
+			identity, err := provider.verifyToken(token)
+			if test.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "alice", identity.Subject)
+			assert.Equal(t, localJWTIssuer, identity.Issuer)
+		})
+	}
+
+	// Only configured algorithms are accepted
+	provider.Algorithms = []string{string(jose.EdDSA)}
+	token, err := jwt.ParseSigned(signLocalJWT(t, rsaKey, jose.RS256, "", localJWTClaims("alice")))
+	require.NoError(t, err)
+	_, err = provider.verifyToken(token)
+	assert.Error(t, err)
+}
+
+func TestLocalJWTProviderJWKSFile(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: &otherRSAKey.PublicKey, KeyID: "old", Algorithm: string(jose.RS256), Use: "sig"},
+		{Key: &rsaKey.PublicKey, KeyID: "current", Algorithm: string(jose.RS256), Use: "sig"},
+	}}
+	data, err := base.JSONMarshal(keySet)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+
+	provider := &LocalJWTProvider{Issuer: localJWTIssuer, Audience: localJWTAudience, JWKSFile: path}
+	require.NoError(t, provider.Init("internal"))
+
+	// Tokens are verified with the key with a matching key ID, or any key if there's no key ID
+	for _, keyID := range []string{"current", ""} {
+		token, err := jwt.ParseSigned(signLocalJWT(t, rsaKey, jose.RS256, keyID, localJWTClaims("alice")))
+		require.NoError(t, err)
+		_, err = provider.verifyToken(token)
+		assert.NoError(t, err, "key ID %q", keyID)
+	}
+	token, err := jwt.ParseSigned(signLocalJWT(t, rsaKey, jose.RS256, "old", localJWTClaims("alice")))
+	require.NoError(t, err)
+	_, err = provider.verifyToken(token)
+	assert.Error(t, err)
+
+	// Private keys are rejected
+	privateKeySet := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: rsaKey, KeyID: "private", Algorithm: string(jose.RS256)}}}
+	data, err = base.JSONMarshal(privateKeySet)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(path, data, 0600))
+	assert.Error(t, provider.Init("internal"))
+
+	// A provider must have keys
+	assert.Error(t, (&LocalJWTProvider{Issuer: localJWTIssuer, Audience: localJWTAudience}).Init("empty"))
+	assert.Error(t, (&LocalJWTProvider{Issuer: localJWTIssuer, Audience: localJWTAudience, PublicKeys: []string{"not a key"}}).Init("invalid"))
+}
+
+func TestAuthenticateUntrustedJWTLocalProvider(t *testing.T) {
+	testBucket := base.GetTestBucket(t)
+	defer testBucket.Close()
+	auth := NewAuthenticator(testBucket, nil, DefaultAuthenticatorOptions())
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	provider := &LocalJWTProvider{
+		Issuer:     localJWTIssuer,
+		Audience:   localJWTAudience,
+		PublicKeys: []string{encodePublicKeyPEM(t, &rsaKey.PublicKey)},
+		RolesClaim: "groups",
+	}
+	require.NoError(t, provider.Init("internal"))
+	localProviders := LocalJWTProviderMap{"internal": provider}
+
+	claims := localJWTClaims("alice")
+	claims["groups"] = []string{"editors"}
+	token := signLocalJWT(t, rsaKey, jose.RS256, "", claims)
+
+	// Users aren't created unless the provider registers them
+	user, _, err := auth.AuthenticateUntrustedJWT(token, nil, localProviders, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, user)
+
+	provider.Register = true
+	user, grants, err := auth.AuthenticateUntrustedJWT(token, nil, localProviders, nil)
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	assert.Equal(t, "internal_alice", user.Name())
+	require.NotNil(t, grants)
+	assert.Equal(t, base.SetOf("editors"), grants.Roles)
+
+	// Claim values can be mapped to the roles they grant
+	provider.RolesMap = JWTClaimMapping{"editors": {"writer", "reviewer"}}
+	require.NoError(t, provider.Init("internal"))
+	_, grants, err = auth.AuthenticateUntrustedJWT(token, nil, localProviders, nil)
+	require.NoError(t, err)
+	require.NotNil(t, grants)
+	assert.Equal(t, base.SetOf("writer", "reviewer"), grants.Roles)
+	provider.RolesMap = JWTClaimMapping{"editors": {"in/valid"}}
+	assert.Error(t, provider.Init("internal"))
+
+	// Tokens from other issuers aren't verified by local providers
+	claims["iss"] = "https://other.example.com"
+	user, _, err = auth.AuthenticateUntrustedJWT(signLocalJWT(t, rsaKey, jose.RS256, "", claims), nil, localProviders, nil)
+	assert.Error(t, err)
+	assert.Nil(t, user)
+}
@@ -0,0 +1,236 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	DefaultLockoutMaxFailedAttempts = 5               // Failed logins within the window after which a user is locked out
+	DefaultLockoutWindow            = 5 * time.Minute // Window in which failed logins are counted
+	DefaultLockoutDuration          = time.Minute     // Duration of a first lockout
+	DefaultMaxLockoutDuration       = time.Hour       // Maximum duration of a lockout, after repeated lockouts
+	lockoutUserKeyPrefix            = "user:"         // Lockout doc ID prefix for users
+	lockoutSourceKeyPrefix          = "ip:"           // Lockout doc ID prefix for source IP addresses
+	maxLockoutBackoffShift          = 20              // Limits the exponential backoff calculation, to avoid overflow
+)
+
+// ErrLockedOut is returned for password logins by a user or source that has been locked out.
+var ErrLockedOut = base.HTTPErrorf(http.StatusTooManyRequests, "Too many failed login attempts, try again later")
+
+// LockoutOptions configures locking out users, and optionally source IP addresses, after repeated failed password
+// logins.  Invalid multi-factor authentication codes count as failed logins for the user.  Each consecutive lockout is
+// twice as long as the previous one, up to MaxLockoutDuration.
+type LockoutOptions struct {
+	MaxFailedAttempts      uint             // Failed logins within Window after which a user is locked out
+	MaxFailedAttemptsPerIP uint             // Failed logins within Window after which a source IP is locked out.  Zero disables IP lockout
+	Window                 time.Duration    // Window in which failed logins are counted
+	LockoutDuration        time.Duration    // Duration of a first lockout
+	MaxLockoutDuration     time.Duration    // Maximum duration of a lockout.  Consecutive lockouts are remembered for this long after the last failure
+	LockoutCount           *base.SgwIntStat // Incremented for each lockout, if set
+}
+
+// LockoutState tracks the failed logins of a user or source IP.  It's stored in a document with an expiry, so that it's
+// shared between nodes and removed once no longer relevant.
+type LockoutState struct {
+	FailedAttempts uint       `json:"failed_attempts"`        // Failed logins in the current window
+	WindowStart    time.Time  `json:"window_start"`           // Time of the first failed login in the current window
+	LockedUntil    *time.Time `json:"locked_until,omitempty"` // End of the current or most recent lockout
+	Lockouts       uint       `json:"lockouts,omitempty"`     // Number of consecutive lockouts, used for backoff
+	Locked         bool       `json:"locked"`                 // Whether currently locked out.  Calculated when read
+}
+
+func (state *LockoutState) locked(now time.Time) bool {
+	return state.LockedUntil != nil && now.Before(*state.LockedUntil)
+}
+
+// lockoutDuration returns the duration of a lockout, given the number of previous consecutive lockouts.
+func (opts *LockoutOptions) lockoutDuration(previousLockouts uint) time.Duration {
+	if previousLockouts > maxLockoutBackoffShift {
+		previousLockouts = maxLockoutBackoffShift
+	}
+	duration := opts.LockoutDuration << previousLockouts
+	if duration > opts.MaxLockoutDuration {
+		duration = opts.MaxLockoutDuration
+	}
+	return duration
+}
+
+// AuthenticateUserFromSource authenticates a user with their password, as AuthenticateUser, recording failed logins
+// if lockout is enabled.  Returns ErrLockedOut if the user or source IP address has been locked out, whether or not
+// the password is correct.  A successful login resets the user's failed logins, but not those of the source.  Returns
+// ErrPasswordExpired if the password is correct but has expired.
+func (auth *Authenticator) AuthenticateUserFromSource(username, password, sourceIP string) (User, error) {
+	user, err := auth.authenticateUserFromSource(username, password, sourceIP)
+	if err != nil || user == nil {
+		return nil, err
+	}
+	if auth.PasswordExpired(user) {
+		base.Infof(base.KeyAuth, "Rejected login for user %s with expired password", base.UD(username))
+		return nil, ErrPasswordExpired
+	}
+	return user, nil
+}
+
+func (auth *Authenticator) authenticateUserFromSource(username, password, sourceIP string) (User, error) {
+	if auth.Lockout == nil || username == "" {
+		return auth.AuthenticateUser(username, password)
+	}
+	now := time.Now()
+
+	userDocID := docIDForUserLockout(username)
+	userState, err := auth.getLockoutState(userDocID)
+	if err != nil {
+		return nil, err
+	}
+	if userState != nil && userState.locked(now) {
+		base.Infof(base.KeyAuth, "Rejected login for locked out user %s", base.UD(username))
+		return nil, ErrLockedOut
+	}
+	sourceDocID := ""
+	if auth.Lockout.MaxFailedAttemptsPerIP > 0 && sourceIP != "" {
+		sourceDocID = docIDForSourceLockout(sourceIP)
+		sourceState, err := auth.getLockoutState(sourceDocID)
+		if err != nil {
+			return nil, err
+		}
+		if sourceState != nil && sourceState.locked(now) {
+			base.Infof(base.KeyAuth, "Rejected login for user %s from locked out source %s", base.UD(username), base.UD(sourceIP))
+			return nil, ErrLockedOut
+		}
+	}
+
+	user, err := auth.GetUser(username)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if user != nil && user.Authenticate(password) {
+		// Users with multi-factor authentication enabled only have their failures reset once the second step succeeds,
+		// so that invalid codes are counted across password logins
+		if userState != nil && userState.FailedAttempts > 0 && !MFAEnabled(user) {
+			if err := auth.bucket.Delete(userDocID); err != nil && !base.IsDocNotFoundError(err) {
+				base.Debugf(base.KeyAuth, "Unable to reset failed logins for user %s: %v", base.UD(username), err)
+			}
+		}
+		return user, nil
+	}
+
+	// Failures are tracked whether or not the user exists, so that lockouts don't reveal which usernames are valid.
+	// Lockout documents expire, so those for guessed usernames don't accumulate.
+	if err := auth.recordLoginFailure(userDocID, auth.Lockout.MaxFailedAttempts, now); err != nil {
+		return nil, err
+	}
+	if sourceDocID != "" {
+		if err := auth.recordLoginFailure(sourceDocID, auth.Lockout.MaxFailedAttemptsPerIP, now); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// GetUserLockout returns the lockout state of a user, or nil if the user has no recent failed logins.
+func (auth *Authenticator) GetUserLockout(username string) (*LockoutState, error) {
+	state, err := auth.getLockoutState(docIDForUserLockout(username))
+	if err != nil || state == nil {
+		return nil, err
+	}
+	state.Locked = state.locked(time.Now())
+	return state, nil
+}
+
+// UnlockUser removes a user's lockout, and resets their failed logins and lockout backoff.
+func (auth *Authenticator) UnlockUser(username string) error {
+	err := auth.bucket.Delete(docIDForUserLockout(username))
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	base.Infof(base.KeyAuth, "Unlocked user %s", base.UD(username))
+	return nil
+}
+
+func (auth *Authenticator) getLockoutState(docID string) (*LockoutState, error) {
+	var state LockoutState
+	if _, err := auth.bucket.Get(docID, &state); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &state, nil
+}
+
+// recordLoginFailure increments the failed logins in the lockout document, locking out if there have been
+// maxFailedAttempts within the window.
+func (auth *Authenticator) recordLoginFailure(docID string, maxFailedAttempts uint, now time.Time) error {
+	opts := auth.Lockout
+	lockedOut := false
+	_, err := auth.bucket.Update(docID, 0, func(current []byte) (updated []byte, expiry *uint32, delete bool, err error) {
+		var state LockoutState
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, &state); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		if state.locked(now) {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+
+		if state.FailedAttempts == 0 || now.Sub(state.WindowStart) >= opts.Window {
+			state.FailedAttempts = 0
+			state.WindowStart = now
+		}
+		state.FailedAttempts++
+		lockedOut = false
+		ttl := opts.Window
+		if state.FailedAttempts >= maxFailedAttempts {
+			duration := opts.lockoutDuration(state.Lockouts)
+			lockedUntil := now.Add(duration)
+			state.LockedUntil = &lockedUntil
+			state.Lockouts++
+			state.FailedAttempts = 0
+			lockedOut = true
+			if duration > ttl {
+				ttl = duration
+			}
+		}
+
+		// Consecutive lockouts are remembered for MaxLockoutDuration after the last failure, for backoff
+		if state.Lockouts > 0 {
+			ttl += opts.MaxLockoutDuration
+		}
+		cbsExpiry := base.DurationToCbsExpiry(ttl)
+		updated, err = base.JSONMarshal(state)
+		return updated, &cbsExpiry, false, err
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if lockedOut {
+		base.Infof(base.KeyAuth, "Locked out %s after %d failed logins", base.UD(docID), maxFailedAttempts)
+		if opts.LockoutCount != nil {
+			opts.LockoutCount.Add(1)
+		}
+	}
+	return nil
+}
+
+func docIDForUserLockout(username string) string {
+	return base.LockoutPrefix + lockoutUserKeyPrefix + username
+}
+
+func docIDForSourceLockout(sourceIP string) string {
+	return base.LockoutPrefix + lockoutSourceKeyPrefix + sourceIP
+}
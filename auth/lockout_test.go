@@ -0,0 +1,229 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	opts := &LockoutOptions{LockoutDuration: time.Minute, MaxLockoutDuration: 10 * time.Minute}
+	assert.Equal(t, time.Minute, opts.lockoutDuration(0))
+	assert.Equal(t, 2*time.Minute, opts.lockoutDuration(1))
+	assert.Equal(t, 8*time.Minute, opts.lockoutDuration(3))
+	assert.Equal(t, 10*time.Minute, opts.lockoutDuration(4))
+	assert.Equal(t, 10*time.Minute, opts.lockoutDuration(1000))
+}
+
+func TestUserLockout(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	lockoutCount := &base.SgwIntStat{}
+	options := DefaultAuthenticatorOptions()
+	options.Lockout = &LockoutOptions{
+		MaxFailedAttempts:  3,
+		Window:             time.Minute,
+		LockoutDuration:    time.Minute,
+		MaxLockoutDuration: time.Hour,
+		LockoutCount:       lockoutCount,
+	}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// A successful login resets failed logins
+	for i := 0; i < 2; i++ {
+		user, err = auth.AuthenticateUserFromSource("alice", "wrong", "10.0.0.1")
+		require.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	state, err := auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, uint(2), state.FailedAttempts)
+	assert.False(t, state.Locked)
+	user, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.1")
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	state, err = auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	// Once locked out, the correct password is rejected too
+	for i := 0; i < 3; i++ {
+		_, err = auth.AuthenticateUserFromSource("alice", "wrong", "10.0.0.1")
+		require.NoError(t, err)
+	}
+	_, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.2")
+	assert.Equal(t, ErrLockedOut, err)
+	assert.Equal(t, int64(1), lockoutCount.Value())
+	state, err = auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.True(t, state.Locked)
+	assert.Equal(t, uint(1), state.Lockouts)
+	require.NotNil(t, state.LockedUntil)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *state.LockedUntil, 5*time.Second)
+
+	// Unlocking resets the backoff
+	require.NoError(t, auth.UnlockUser("alice"))
+	require.NoError(t, auth.UnlockUser("alice"))
+	user, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.1")
+	require.NoError(t, err)
+	assert.NotNil(t, user)
+
+	// Unknown users are locked out the same way, so that lockouts don't reveal which users exist
+	for i := 0; i < 3; i++ {
+		user, err = auth.AuthenticateUserFromSource("nobody", "wrong", "10.0.0.1")
+		require.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	_, err = auth.AuthenticateUserFromSource("nobody", "wrong", "10.0.0.1")
+	assert.Equal(t, ErrLockedOut, err)
+	state, err = auth.GetUserLockout("nobody")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.True(t, state.Locked)
+}
+
+func TestUserLockoutBackoff(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.Lockout = &LockoutOptions{
+		MaxFailedAttempts:  1,
+		Window:             time.Minute,
+		LockoutDuration:    time.Minute,
+		MaxLockoutDuration: time.Hour,
+	}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	_, err = auth.AuthenticateUserFromSource("alice", "wrong", "")
+	require.NoError(t, err)
+
+	// Simulate the first lockout expiring, then fail again
+	docID := docIDForUserLockout("alice")
+	state, err := auth.getLockoutState(docID)
+	require.NoError(t, err)
+	expired := time.Now().Add(-time.Second)
+	state.LockedUntil = &expired
+	require.NoError(t, bucket.Set(docID, 0, state))
+	_, err = auth.AuthenticateUserFromSource("alice", "wrong", "")
+	require.NoError(t, err)
+
+	state, err = auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	assert.True(t, state.Locked)
+	assert.Equal(t, uint(2), state.Lockouts)
+	assert.WithinDuration(t, time.Now().Add(2*time.Minute), *state.LockedUntil, 5*time.Second)
+}
+
+func TestSourceLockout(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.Lockout = &LockoutOptions{
+		MaxFailedAttempts:      10,
+		MaxFailedAttemptsPerIP: 2,
+		Window:                 time.Minute,
+		LockoutDuration:        time.Minute,
+		MaxLockoutDuration:     time.Hour,
+	}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// Failures for unknown users count towards the source lockout
+	for _, name := range []string{"bob", "carol"} {
+		user, err = auth.AuthenticateUserFromSource(name, "wrong", "10.0.0.1")
+		require.NoError(t, err)
+		assert.Nil(t, user)
+	}
+	_, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.1")
+	assert.Equal(t, ErrLockedOut, err)
+
+	// Other sources aren't affected, and the user isn't locked out
+	user, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.2")
+	require.NoError(t, err)
+	assert.NotNil(t, user)
+}
+
+func TestMFALockout(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.MFA = &MFAOptions{EncryptionKey: make([]byte, mfaEncryptionKeyLength)}
+	options.Lockout = &LockoutOptions{
+		MaxFailedAttempts:  3,
+		Window:             time.Minute,
+		LockoutDuration:    time.Minute,
+		MaxLockoutDuration: time.Hour,
+	}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+	_, err = auth.EnrollMFA(user)
+	require.NoError(t, err)
+	secret, err := auth.MFA.decrypt("alice", user.MFA().Secret)
+	require.NoError(t, err)
+	recoveryCodes, err := auth.ConfirmMFAEnrollment(user, totpCode(secret, currentTOTPCounter()))
+	require.NoError(t, err)
+
+	// Invalid codes count as failed logins, and restarting the login with the password doesn't reset them
+	for i := 0; i < 2; i++ {
+		user, err = auth.AuthenticateUserFromSource("alice", "password", "10.0.0.1")
+		require.NoError(t, err)
+		require.NotNil(t, user)
+		challenge, err := auth.CreateMFAChallenge("alice")
+		require.NoError(t, err)
+		_, err = auth.AuthenticateMFAChallenge(challenge.ID, "000000")
+		assert.Equal(t, ErrInvalidMFACode, err)
+	}
+	state, err := auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, uint(2), state.FailedAttempts)
+
+	// A successful second step resets them
+	challenge, err := auth.CreateMFAChallenge("alice")
+	require.NoError(t, err)
+	user, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[0])
+	require.NoError(t, err)
+	require.NotNil(t, user)
+	state, err = auth.GetUserLockout("alice")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	// Once locked out, valid codes are rejected too
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, "000000"))
+	}
+	assert.Equal(t, ErrLockedOut, auth.VerifyMFA(user, recoveryCodes[1]))
+	challenge, err = auth.CreateMFAChallenge("alice")
+	require.NoError(t, err)
+	_, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[1])
+	assert.Equal(t, ErrLockedOut, err)
+}
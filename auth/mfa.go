@@ -0,0 +1,472 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	mfaSecretLength         = 20                                // Length in bytes of TOTP secrets, as recommended by RFC 4226
+	totpPeriod              = 30                                // Seconds each TOTP code is valid for
+	totpDigits              = 6                                 // Number of digits in a TOTP code
+	totpSkew                = 1                                 // Number of periods either side of the current one that codes are accepted for, to allow for clock drift
+	mfaRecoveryCodeCount    = 10                                // Number of recovery codes generated for a user
+	mfaRecoveryCodeLength   = 10                                // Number of characters in a recovery code, excluding the separator
+	mfaChallengeTTL         = 5 * time.Minute                   // How long a user has to complete a login with their second factor
+	maxMFAChallengeAttempts = 5                                 // Number of invalid codes after which a login has to be restarted
+	DefaultMFAIssuer        = "Sync Gateway"                    // Issuer shown in authenticator apps, if not configured
+	mfaEncryptionKeyLength  = 32                                // Length in bytes of the AES-256 key used to encrypt TOTP secrets
+	mfaChallengeIDLength    = 16                                // Length in bytes of login challenge IDs
+	mfaRecoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz23456789" // Recovery code characters, without those easily confused
+)
+
+// ErrInvalidMFACode is returned when a TOTP or recovery code doesn't match.
+var ErrInvalidMFACode = base.HTTPErrorf(http.StatusUnauthorized, "Invalid multi-factor authentication code")
+
+// ErrMFANotConfigured is returned when multi-factor authentication is used on a database without an MFA config.
+var ErrMFANotConfigured = base.HTTPErrorf(http.StatusBadRequest, "Multi-factor authentication isn't configured for this database")
+
+// MFAOptions configures TOTP multi-factor authentication for a database.
+type MFAOptions struct {
+	EncryptionKey []byte // AES-256 key used to encrypt users' TOTP secrets
+	Issuer        string // Issuer shown in authenticator apps
+	Required      bool   // If true, users must complete multi-factor authentication to create a session with a password
+}
+
+// DecodeMFAEncryptionKey decodes a base64 encoded AES-256 key.
+func DecodeMFAEncryptionKey(key string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != mfaEncryptionKeyLength {
+		return nil, fmt.Errorf("key must be %d bytes, not %d", mfaEncryptionKeyLength, len(decoded))
+	}
+	return decoded, nil
+}
+
+// A user's TOTP (RFC 6238) multi-factor authentication settings.
+type UserMFA struct {
+	Secret        string   `json:"secret"`                   // TOTP secret, encrypted with the database's MFA encryption key
+	Enabled       bool     `json:"enabled"`                  // False until enrollment has been verified with a valid code
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // Hex encoded SHA-256 hashes of unused recovery codes
+	LastCounter   uint64   `json:"last_counter,omitempty"`   // TOTP counter of the last code used, so that codes can't be reused
+}
+
+// MFAEnrollment is returned when enrolling a user, for adding to an authenticator app.
+type MFAEnrollment struct {
+	Secret string `json:"secret"` // Base32 encoded TOTP secret
+	URI    string `json:"uri"`    // otpauth:// URI, usually shown as a QR code
+}
+
+// MFAChallenge is a login that has been authenticated with a password, awaiting a TOTP or recovery code.
+type MFAChallenge struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	Expiration time.Time `json:"expiration"`
+	Attempts   int       `json:"attempts,omitempty"`
+}
+
+// MFAEnabled returns true if the user has verified their multi-factor authentication enrollment.
+func MFAEnabled(user User) bool {
+	return user != nil && user.MFA() != nil && user.MFA().Enabled
+}
+
+// EnrollMFA generates a new TOTP secret for the user.  The enrollment is pending until verified with
+// ConfirmMFAEnrollment, so replaces any previous pending enrollment.  Returns a 409 error if the user has already
+// enabled multi-factor authentication.
+func (auth *Authenticator) EnrollMFA(u User) (*MFAEnrollment, error) {
+	if auth.MFA == nil {
+		return nil, ErrMFANotConfigured
+	}
+	secret := make([]byte, mfaSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	encryptedSecret, err := auth.MFA.encrypt(u.Name(), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	enrollMFACallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		if MFAEnabled(currentUser) {
+			return nil, base.HTTPErrorf(http.StatusConflict, "Multi-factor authentication is already enabled")
+		}
+		currentUser.SetMFA(&UserMFA{Secret: encryptedSecret})
+		return currentUser, nil
+	}
+	if err := auth.casUpdatePrincipal(u, enrollMFACallback); err != nil {
+		return nil, err
+	}
+
+	base.Debugf(base.KeyAuth, "Started multi-factor authentication enrollment for user %s", base.UD(u.Name()))
+	encodedSecret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)
+	issuer := auth.MFA.Issuer
+	if issuer == "" {
+		issuer = DefaultMFAIssuer
+	}
+	query := url.Values{}
+	query.Set("secret", encodedSecret)
+	query.Set("issuer", issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	uri := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + issuer + ":" + u.Name(), RawQuery: query.Encode()}
+	return &MFAEnrollment{Secret: encodedSecret, URI: uri.String()}, nil
+}
+
+// ConfirmMFAEnrollment enables multi-factor authentication for a user with a pending enrollment, if the code is valid
+// for the enrolled secret.  Returns the user's recovery codes, which aren't stored and can't be retrieved later.
+func (auth *Authenticator) ConfirmMFAEnrollment(u User, code string) (recoveryCodes []string, err error) {
+	if auth.MFA == nil {
+		return nil, ErrMFANotConfigured
+	}
+	recoveryCodes, recoveryCodeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	confirmMFACallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		mfa := currentUser.MFA()
+		if mfa == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Multi-factor authentication enrollment not found")
+		}
+		if mfa.Enabled {
+			return nil, base.HTTPErrorf(http.StatusConflict, "Multi-factor authentication is already enabled")
+		}
+		counter, err := auth.matchTOTP(currentUser.Name(), mfa, code, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		currentUser.SetMFA(&UserMFA{Secret: mfa.Secret, Enabled: true, RecoveryCodes: recoveryCodeHashes, LastCounter: counter})
+		return currentUser, nil
+	}
+	if err := auth.casUpdatePrincipal(u, confirmMFACallback); err != nil {
+		return nil, err
+	}
+	base.Infof(base.KeyAuth, "Enabled multi-factor authentication for user %s", base.UD(u.Name()))
+	return recoveryCodes, nil
+}
+
+// VerifyMFA checks a TOTP or recovery code for a user with multi-factor authentication enabled.  Codes can only be
+// used once.  Returns ErrInvalidMFACode if the code doesn't match.  If lockout is enabled, invalid codes count as failed
+// logins for the user, and ErrLockedOut is returned without checking the code while the user is locked out.
+func (auth *Authenticator) VerifyMFA(u User, code string) error {
+	if auth.MFA == nil {
+		return ErrMFANotConfigured
+	}
+	now := time.Now()
+	if auth.Lockout != nil {
+		state, err := auth.getLockoutState(docIDForUserLockout(u.Name()))
+		if err != nil {
+			return err
+		}
+		if state != nil && state.locked(now) {
+			base.Infof(base.KeyAuth, "Rejected multi-factor authentication code for locked out user %s", base.UD(u.Name()))
+			return ErrLockedOut
+		}
+	}
+
+	verifyMFACallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		mfa := currentUser.MFA()
+		if mfa == nil || !mfa.Enabled {
+			return nil, ErrInvalidMFACode
+		}
+		updated := *mfa
+		if counter, err := auth.matchTOTP(currentUser.Name(), mfa, code, time.Now()); err == nil {
+			updated.LastCounter = counter
+		} else if i := matchRecoveryCode(mfa.RecoveryCodes, code); i >= 0 {
+			base.Infof(base.KeyAuth, "User %s used a multi-factor authentication recovery code", base.UD(currentUser.Name()))
+			updated.RecoveryCodes = append(append([]string{}, mfa.RecoveryCodes[:i]...), mfa.RecoveryCodes[i+1:]...)
+		} else {
+			return nil, err
+		}
+		currentUser.SetMFA(&updated)
+		return currentUser, nil
+	}
+	err := auth.casUpdatePrincipal(u, verifyMFACallback)
+	if err == ErrInvalidMFACode && auth.Lockout != nil {
+		if lockoutErr := auth.recordLoginFailure(docIDForUserLockout(u.Name()), auth.Lockout.MaxFailedAttempts, now); lockoutErr != nil {
+			return lockoutErr
+		}
+	}
+	return err
+}
+
+// RegenerateMFARecoveryCodes replaces the recovery codes of a user with multi-factor authentication enabled.
+func (auth *Authenticator) RegenerateMFARecoveryCodes(u User) (recoveryCodes []string, err error) {
+	recoveryCodes, recoveryCodeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	regenerateCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		if !MFAEnabled(currentUser) {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Multi-factor authentication isn't enabled")
+		}
+		updated := *currentUser.MFA()
+		updated.RecoveryCodes = recoveryCodeHashes
+		currentUser.SetMFA(&updated)
+		return currentUser, nil
+	}
+	if err := auth.casUpdatePrincipal(u, regenerateCallback); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// DisableMFA removes the user's multi-factor authentication settings, including any pending enrollment.
+func (auth *Authenticator) DisableMFA(u User) error {
+	disableMFACallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		if currentUser.MFA() == nil {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Multi-factor authentication isn't enabled")
+		}
+		currentUser.SetMFA(nil)
+		return currentUser, nil
+	}
+	if err := auth.casUpdatePrincipal(u, disableMFACallback); err != nil {
+		return err
+	}
+	base.Infof(base.KeyAuth, "Disabled multi-factor authentication for user %s", base.UD(u.Name()))
+	return nil
+}
+
+// CreateMFAChallenge starts the second step of a login, for a user that has been authenticated with their password.
+func (auth *Authenticator) CreateMFAChallenge(username string) (*MFAChallenge, error) {
+	id := make([]byte, mfaChallengeIDLength)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	challenge := &MFAChallenge{
+		ID:         hex.EncodeToString(id),
+		Username:   username,
+		Expiration: time.Now().Add(mfaChallengeTTL),
+	}
+	if err := auth.bucket.Set(docIDForMFAChallenge(challenge.ID), base.DurationToCbsExpiry(mfaChallengeTTL), challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// AuthenticateMFAChallenge completes a login started with CreateMFAChallenge, returning the user if the code is
+// valid.  Returns nil if the challenge doesn't exist or has expired, and ErrInvalidMFACode if the code doesn't match.
+// A challenge can only be completed once, and can't be used after too many invalid codes.  Each attempt is counted
+// before the code is checked, so that concurrent attempts can't exceed the limit.  A successful login resets the
+// user's failed logins.
+func (auth *Authenticator) AuthenticateMFAChallenge(challengeID, code string) (User, error) {
+	var challenge MFAChallenge
+	docID := docIDForMFAChallenge(challengeID)
+	_, err := auth.bucket.Update(docID, 0, func(current []byte) (updated []byte, expiry *uint32, delete bool, err error) {
+		if len(current) == 0 {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		challenge = MFAChallenge{}
+		if err := base.JSONUnmarshal(current, &challenge); err != nil {
+			return nil, nil, false, err
+		}
+		ttl := time.Until(challenge.Expiration)
+		if ttl <= 0 || challenge.Attempts >= maxMFAChallengeAttempts {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		challenge.Attempts++
+		cbsExpiry := base.DurationToCbsExpiry(ttl)
+		updated, err = base.JSONMarshal(challenge)
+		return updated, &cbsExpiry, false, err
+	})
+	if err != nil {
+		if err == base.ErrUpdateCancel || base.IsDocNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	user, err := auth.GetUser(challenge.Username)
+	if err != nil || user == nil || user.Disabled() {
+		return nil, err
+	}
+
+	if err := auth.VerifyMFA(user, code); err != nil {
+		if err == ErrInvalidMFACode && challenge.Attempts >= maxMFAChallengeAttempts {
+			base.Infof(base.KeyAuth, "Too many invalid multi-factor authentication codes for user %s", base.UD(challenge.Username))
+			if err := auth.bucket.Delete(docID); err != nil && !base.IsDocNotFoundError(err) {
+				base.Debugf(base.KeyAuth, "Unable to delete multi-factor authentication challenge for user %s: %v", base.UD(challenge.Username), err)
+			}
+		}
+		return nil, err
+	}
+
+	if err := auth.bucket.Delete(docID); err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if auth.Lockout != nil {
+		if err := auth.bucket.Delete(docIDForUserLockout(user.Name())); err != nil && !base.IsDocNotFoundError(err) {
+			base.Debugf(base.KeyAuth, "Unable to reset failed logins for user %s: %v", base.UD(user.Name()), err)
+		}
+	}
+	return user, nil
+}
+
+func docIDForMFAChallenge(challengeID string) string {
+	return base.MFAChallengePrefix + challengeID
+}
+
+// matchTOTP returns the counter of the TOTP code, if valid for the user's secret at the given time and not
+// previously used.
+func (auth *Authenticator) matchTOTP(username string, mfa *UserMFA, code string, now time.Time) (uint64, error) {
+	secret, err := auth.MFA.decrypt(username, mfa.Secret)
+	if err != nil {
+		base.Warnf("Unable to decrypt multi-factor authentication secret for user %s: %v", base.UD(username), err)
+		return 0, ErrInvalidMFACode
+	}
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, ErrInvalidMFACode
+	}
+	current := uint64(now.Unix() / totpPeriod)
+	for skew := -totpSkew; skew <= totpSkew; skew++ {
+		counter := uint64(int64(current) + int64(skew))
+		if counter <= mfa.LastCounter {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, nil
+		}
+	}
+	return 0, ErrInvalidMFACode
+}
+
+// totpCode returns the RFC 6238 code for the secret and counter, using HMAC-SHA1.
+func totpCode(secret []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	_, _ = mac.Write(message[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// generateRecoveryCodes returns new recovery codes, and the hashes of them to be stored.
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	codes = make([]string, mfaRecoveryCodeCount)
+	hashes = make([]string, mfaRecoveryCodeCount)
+	random := make([]byte, mfaRecoveryCodeLength)
+	for i := range codes {
+		if _, err := rand.Read(random); err != nil {
+			return nil, nil, err
+		}
+		code := make([]byte, mfaRecoveryCodeLength)
+		for j, b := range random {
+			code[j] = mfaRecoveryCodeAlphabet[int(b)%len(mfaRecoveryCodeAlphabet)]
+		}
+		half := mfaRecoveryCodeLength / 2
+		codes[i] = string(code[:half]) + "-" + string(code[half:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code, ignoring case and separators.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(hash[:])
+}
+
+// matchRecoveryCode returns the index of the code's hash, or -1 if it doesn't match any of the hashes.
+func matchRecoveryCode(hashes []string, code string) int {
+	hash := []byte(hashRecoveryCode(code))
+	for i, existing := range hashes {
+		if subtle.ConstantTimeCompare(hash, []byte(existing)) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+// encrypt encrypts a user's TOTP secret with AES-GCM, authenticating the username so that secrets can't be copied
+// between users.
+func (opts *MFAOptions) encrypt(username string, plaintext []byte) (string, error) {
+	gcm, err := opts.cipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, []byte(username))), nil
+}
+
+func (opts *MFAOptions) decrypt(username string, ciphertext string) ([]byte, error) {
+	gcm, err := opts.cipher()
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, decoded[:gcm.NonceSize()], decoded[gcm.NonceSize():], []byte(username))
+}
+
+func (opts *MFAOptions) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(opts.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,185 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"encoding/base32"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Test vectors from RFC 6238 appendix B, truncated to 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	testCases := []struct {
+		unixTime int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, testCase := range testCases {
+		assert.Equal(t, testCase.expected, totpCode(secret, uint64(testCase.unixTime/totpPeriod)), "time %d", testCase.unixTime)
+	}
+}
+
+func TestMFAEnrollment(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	_, err = auth.EnrollMFA(user)
+	assert.Equal(t, ErrMFANotConfigured, err)
+
+	options.MFA = &MFAOptions{EncryptionKey: make([]byte, mfaEncryptionKeyLength), Issuer: "Example"}
+	auth = NewAuthenticator(bucket, nil, options)
+	enrollment, err := auth.EnrollMFA(user)
+	require.NoError(t, err)
+	assert.Contains(t, enrollment.URI, "otpauth://totp/Example:alice?")
+	assert.Contains(t, enrollment.URI, "secret="+enrollment.Secret)
+	secret, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(enrollment.Secret)
+	require.NoError(t, err)
+
+	// The secret is stored encrypted, and the enrollment is pending until confirmed
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	require.NotNil(t, user.MFA())
+	assert.False(t, user.MFA().Enabled)
+	assert.NotContains(t, user.MFA().Secret, enrollment.Secret)
+	assert.False(t, MFAEnabled(user))
+	assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, totpCode(secret, currentTOTPCounter())))
+
+	_, err = auth.ConfirmMFAEnrollment(user, "000000")
+	assert.Equal(t, ErrInvalidMFACode, err)
+	counter := currentTOTPCounter()
+	code := totpCode(secret, counter)
+	recoveryCodes, err := auth.ConfirmMFAEnrollment(user, code)
+	require.NoError(t, err)
+	assert.Len(t, recoveryCodes, mfaRecoveryCodeCount)
+	assert.True(t, MFAEnabled(user))
+	_, err = auth.EnrollMFA(user)
+	requireHTTPStatus(t, err, http.StatusConflict)
+
+	// Codes can't be reused
+	assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, code))
+	nextCode := totpCode(secret, counter+1)
+	assert.NoError(t, auth.VerifyMFA(user, nextCode))
+	assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, nextCode))
+
+	// Recovery codes can be used once, ignoring case and separators
+	assert.NoError(t, auth.VerifyMFA(user, recoveryCodes[0]))
+	assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, recoveryCodes[0]))
+	assert.NoError(t, auth.VerifyMFA(user, " "+strings.ToUpper(recoveryCodes[1])))
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.Len(t, user.MFA().RecoveryCodes, mfaRecoveryCodeCount-2)
+
+	newRecoveryCodes, err := auth.RegenerateMFARecoveryCodes(user)
+	require.NoError(t, err)
+	assert.Equal(t, ErrInvalidMFACode, auth.VerifyMFA(user, recoveryCodes[2]))
+	assert.NoError(t, auth.VerifyMFA(user, newRecoveryCodes[2]))
+
+	// Secrets can't be decrypted for another user, or with another key
+	_, err = auth.MFA.decrypt("bob", user.MFA().Secret)
+	assert.Error(t, err)
+	otherKey := &MFAOptions{EncryptionKey: []byte(base.GenerateRandomSecret())}
+	_, err = otherKey.decrypt("alice", user.MFA().Secret)
+	assert.Error(t, err)
+
+	require.NoError(t, auth.DisableMFA(user))
+	assert.False(t, MFAEnabled(user))
+	requireHTTPStatus(t, auth.DisableMFA(user), http.StatusNotFound)
+	_, err = auth.RegenerateMFARecoveryCodes(user)
+	requireHTTPStatus(t, err, http.StatusNotFound)
+}
+
+func TestMFAChallenge(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.MFA = &MFAOptions{EncryptionKey: make([]byte, mfaEncryptionKeyLength)}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+	_, err = auth.EnrollMFA(user)
+	require.NoError(t, err)
+	secret, err := auth.MFA.decrypt("alice", user.MFA().Secret)
+	require.NoError(t, err)
+	recoveryCodes, err := auth.ConfirmMFAEnrollment(user, totpCode(secret, currentTOTPCounter()))
+	require.NoError(t, err)
+
+	// Unknown challenges don't authenticate
+	challengeUser, err := auth.AuthenticateMFAChallenge("unknown", recoveryCodes[0])
+	require.NoError(t, err)
+	assert.Nil(t, challengeUser)
+
+	// A challenge can only be completed once
+	challenge, err := auth.CreateMFAChallenge("alice")
+	require.NoError(t, err)
+	_, err = auth.AuthenticateMFAChallenge(challenge.ID, "000000")
+	assert.Equal(t, ErrInvalidMFACode, err)
+	challengeUser, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[0])
+	require.NoError(t, err)
+	require.NotNil(t, challengeUser)
+	assert.Equal(t, "alice", challengeUser.Name())
+	challengeUser, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[1])
+	require.NoError(t, err)
+	assert.Nil(t, challengeUser)
+
+	// A challenge can't be completed after too many invalid codes
+	challenge, err = auth.CreateMFAChallenge("alice")
+	require.NoError(t, err)
+	for i := 0; i < maxMFAChallengeAttempts; i++ {
+		_, err = auth.AuthenticateMFAChallenge(challenge.ID, "000000")
+		assert.Equal(t, ErrInvalidMFACode, err)
+	}
+	challengeUser, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[1])
+	require.NoError(t, err)
+	assert.Nil(t, challengeUser)
+
+	// Concurrent attempts are all counted
+	challenge, err = auth.CreateMFAChallenge("alice")
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 2*maxMFAChallengeAttempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = auth.AuthenticateMFAChallenge(challenge.ID, "000000")
+		}()
+	}
+	wg.Wait()
+	challengeUser, err = auth.AuthenticateMFAChallenge(challenge.ID, recoveryCodes[1])
+	require.NoError(t, err)
+	assert.Nil(t, challengeUser)
+}
+
+func currentTOTPCounter() uint64 {
+	return uint64(time.Now().Unix() / totpPeriod)
+}
@@ -159,6 +159,17 @@ type OIDCProvider struct {
 	// Sync Gateway and the underlying OIDC library.
 	UsernameClaim string `json:"username_claim"`
 
+	// RolesClaim and ChannelsClaim specify claims whose values are granted to the user as roles and channels, on
+	// every login with a token from this provider.  Each claim's value must be a string or an array of strings.
+	// These grants are stored separately from those made through the admin API, and replaced on each login.
+	RolesClaim    string `json:"roles_claim,omitempty"`
+	ChannelsClaim string `json:"channels_claim,omitempty"`
+
+	// RolesMap and ChannelsMap optionally map the values of RolesClaim and ChannelsClaim to the roles and channels
+	// they grant, e.g. {"engineering": ["developer", "reviewer"]}.  When set, values that aren't mapped grant nothing.
+	RolesMap    JWTClaimMapping `json:"roles_map,omitempty"`
+	ChannelsMap JWTClaimMapping `json:"channels_map,omitempty"`
+
 	// AllowUnsignedProviderTokens allows users to opt-in to accepting unsigned tokens from providers.
 	AllowUnsignedProviderTokens bool `json:"allow_unsigned_provider_tokens"`
 
@@ -422,20 +433,26 @@ func (op *OIDCProvider) standardDiscovery(discoveryURL string) (metadata Provide
 
 // getOIDCUsername returns the username to be used as the Sync Gateway username.
 func getOIDCUsername(provider *OIDCProvider, identity *Identity) (username string, err error) {
-	if provider.UsernameClaim != "" {
-		value, ok := identity.Claims[provider.UsernameClaim]
+	return getJWTUsername(provider.UserPrefix, provider.UsernameClaim, identity)
+}
+
+// getJWTUsername returns the Sync Gateway username for a verified token's identity - the value of usernameClaim if
+// set, otherwise the subject, prefixed with userPrefix.
+func getJWTUsername(userPrefix, usernameClaim string, identity *Identity) (username string, err error) {
+	if usernameClaim != "" {
+		value, ok := identity.Claims[usernameClaim]
 		if !ok {
-			return "", fmt.Errorf("oidc: specified claim %q not found in id_token, identity: %v", provider.UsernameClaim, identity)
+			return "", fmt.Errorf("oidc: specified claim %q not found in id_token, identity: %v", usernameClaim, identity)
 		}
 		if username, err = formatUsername(value); err != nil {
 			return "", err
 		}
-		if provider.UserPrefix == "" {
+		if userPrefix == "" {
 			return url.QueryEscape(username), nil
 		}
-		return fmt.Sprintf("%s_%s", provider.UserPrefix, url.QueryEscape(username)), nil
+		return fmt.Sprintf("%s_%s", userPrefix, url.QueryEscape(username)), nil
 	}
-	return fmt.Sprintf("%s_%s", provider.UserPrefix, url.QueryEscape(identity.Subject)), nil
+	return fmt.Sprintf("%s_%s", userPrefix, url.QueryEscape(identity.Subject)), nil
 }
 
 // formatUsername returns the string representation of the given username value.
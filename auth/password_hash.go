@@ -55,6 +55,12 @@ func compareHashAndPassword(cache Cache, hash []byte, password []byte) bool {
 	return true
 }
 
+// CompareHashAndPassword returns true if the password matches the bcrypt hash.  Successful matches are cached, as
+// for user passwords.
+func CompareHashAndPassword(hash []byte, password string) bool {
+	return compareHashAndPassword(cachedHashes, hash, []byte(password))
+}
+
 // SetBcryptCost will set the bcrypt cost for Sync Gateway to use
 // Values of zero or less will use bcryptDefaultCost instead
 // An error is returned if the cost is not between bcryptDefaultCost and bcrypt.MaxCost
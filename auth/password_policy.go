@@ -0,0 +1,154 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// ErrPasswordExpired is returned for password logins by a user whose password is older than the policy's MaxAge.
+var ErrPasswordExpired = base.HTTPErrorf(http.StatusForbidden, "Password has expired and must be changed")
+
+// PasswordPolicyOptions are the requirements for users' passwords.  They're checked when a password is set or changed,
+// and unchanged passwords are allowed even if they don't meet the current requirements.
+type PasswordPolicyOptions struct {
+	MinLength            int           // Minimum number of characters
+	RequireUppercase     bool          // Require at least one uppercase letter
+	RequireLowercase     bool          // Require at least one lowercase letter
+	RequireDigit         bool          // Require at least one digit
+	RequireSymbol        bool          // Require at least one character that isn't a letter or digit
+	CompromisedPasswords base.Set      // Known compromised passwords, lowercased
+	HistoryCount         int           // Number of previous passwords that can't be reused
+	MaxAge               time.Duration // Age after which a password expires.  Zero for no expiry
+}
+
+// LoadCompromisedPasswords reads a file of compromised passwords, one per line, for PasswordPolicyOptions.
+func LoadCompromisedPasswords(path string) (base.Set, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = file.Close() }()
+
+	passwords := base.Set{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if password := strings.TrimSpace(scanner.Text()); password != "" {
+			passwords.Add(strings.ToLower(password))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return passwords, nil
+}
+
+// ValidatePassword checks a new password for the user against the password policy, including whether it's one of
+// their previous passwords.  The user is nil for new users.  Returns a 400 error describing the first unmet requirement.
+func (auth *Authenticator) ValidatePassword(user User, password string) error {
+	policy := auth.PasswordPolicy
+	if policy == nil {
+		return nil
+	}
+	current, _ := user.(*userImpl)
+	if current != nil && current.passwordMatches(password) {
+		return nil
+	}
+
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must be at least %d characters", policy.MinLength)
+	}
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case !unicode.IsLetter(r):
+			hasSymbol = true
+		}
+	}
+	if policy.RequireUppercase && !hasUpper {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain an uppercase letter")
+	}
+	if policy.RequireLowercase && !hasLower {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a lowercase letter")
+	}
+	if policy.RequireDigit && !hasDigit {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a digit")
+	}
+	if policy.RequireSymbol && !hasSymbol {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password must contain a symbol")
+	}
+	if policy.CompromisedPasswords.Contains(strings.ToLower(password)) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Password is known to be compromised")
+	}
+
+	if current != nil {
+		for _, hash := range current.PasswordHistory_ {
+			if compareHashAndPassword(cachedHashes, hash, []byte(password)) {
+				return base.HTTPErrorf(http.StatusBadRequest, "Password has been used recently")
+			}
+		}
+	}
+	return nil
+}
+
+// PasswordExpired returns true if the user's password is older than the policy's MaxAge.  Passwords set before their
+// change time was recorded don't expire.
+func (auth *Authenticator) PasswordExpired(user User) bool {
+	if auth.PasswordPolicy == nil || auth.PasswordPolicy.MaxAge <= 0 {
+		return false
+	}
+	changed := user.PasswordChanged()
+	return !changed.IsZero() && time.Since(changed) > auth.PasswordPolicy.MaxAge
+}
+
+// ChangePassword changes a user's password, after verifying their current password.  The current password may have
+// expired, but failed attempts still count towards lockout.
+func (auth *Authenticator) ChangePassword(username, oldPassword, newPassword, sourceIP string) error {
+	user, err := auth.authenticateUserFromSource(username, oldPassword, sourceIP)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
+	}
+	if newPassword == oldPassword {
+		return base.HTTPErrorf(http.StatusBadRequest, "New password must be different from the current password")
+	}
+	if err := auth.ValidatePassword(user, newPassword); err != nil {
+		return err
+	}
+
+	err = auth.casUpdatePrincipal(user, func(p Principal) (Principal, error) {
+		currentUser, ok := p.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+		currentUser.SetPassword(newPassword)
+		return currentUser, nil
+	})
+	if err != nil {
+		return err
+	}
+	base.Infof(base.KeyAuth, "User %s changed their password", base.UD(username))
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePassword(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	auth := NewAuthenticator(bucket, nil, options)
+	assert.NoError(t, auth.ValidatePassword(nil, "a"))
+
+	options.PasswordPolicy = &PasswordPolicyOptions{
+		MinLength:            8,
+		RequireUppercase:     true,
+		RequireLowercase:     true,
+		RequireDigit:         true,
+		RequireSymbol:        true,
+		CompromisedPasswords: base.SetOf("passw0rd!a"),
+	}
+	auth = NewAuthenticator(bucket, nil, options)
+	testCases := []struct {
+		password string
+		err      string
+	}{
+		{"Ab1!", "Password must be at least 8 characters"},
+		{"abcdefg1!", "Password must contain an uppercase letter"},
+		{"ABCDEFG1!", "Password must contain a lowercase letter"},
+		{"Abcdefgh!", "Password must contain a digit"},
+		{"Abcdefgh1", "Password must contain a symbol"},
+		{"Passw0rd!A", "Password is known to be compromised"},
+		{"Abcdefg1!", ""},
+		{"Äbcdéfg1 ", ""},
+	}
+	for _, testCase := range testCases {
+		err := auth.ValidatePassword(nil, testCase.password)
+		if testCase.err == "" {
+			assert.NoError(t, err, "password %q", testCase.password)
+		} else {
+			requireHTTPStatus(t, err, http.StatusBadRequest)
+			assert.Contains(t, err.Error(), testCase.err, "password %q", testCase.password)
+		}
+	}
+
+	// Unchanged passwords don't need to meet the policy
+	options.PasswordPolicy = nil
+	user, err := NewAuthenticator(bucket, nil, options).NewUser("alice", "weak", base.Set{})
+	require.NoError(t, err)
+	assert.NoError(t, auth.ValidatePassword(user, "weak"))
+	requireHTTPStatus(t, auth.ValidatePassword(user, "weaker"), http.StatusBadRequest)
+}
+
+func TestPasswordHistory(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.PasswordPolicy = &PasswordPolicyOptions{HistoryCount: 2}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password1", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	require.NoError(t, auth.ChangePassword("alice", "password1", "password2", ""))
+	require.NoError(t, auth.ChangePassword("alice", "password2", "password3", ""))
+	for _, previous := range []string{"password1", "password2"} {
+		err = auth.ChangePassword("alice", "password3", previous, "")
+		requireHTTPStatus(t, err, http.StatusBadRequest)
+		assert.Contains(t, err.Error(), "Password has been used recently")
+	}
+	err = auth.ChangePassword("alice", "password3", "password3", "")
+	requireHTTPStatus(t, err, http.StatusBadRequest)
+
+	// Only the configured number of previous passwords are kept
+	require.NoError(t, auth.ChangePassword("alice", "password3", "password4", ""))
+	require.NoError(t, auth.ChangePassword("alice", "password4", "password1", ""))
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	assert.Len(t, user.(*userImpl).PasswordHistory_, 2)
+
+	// Setting the current password again doesn't affect the history
+	user.SetPassword("password1")
+	assert.Len(t, user.(*userImpl).PasswordHistory_, 2)
+
+	requireHTTPStatus(t, auth.ChangePassword("alice", "wrong", "password5", ""), http.StatusUnauthorized)
+	requireHTTPStatus(t, auth.ChangePassword("nobody", "wrong", "password5", ""), http.StatusUnauthorized)
+}
+
+func TestPasswordExpiry(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	options := DefaultAuthenticatorOptions()
+	options.PasswordPolicy = &PasswordPolicyOptions{MaxAge: time.Hour}
+	auth := NewAuthenticator(bucket, nil, options)
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), user.PasswordChanged(), 5*time.Second)
+	changed := time.Now().Add(-2 * time.Hour)
+	user.(*userImpl).PasswordChanged_ = &changed
+	require.NoError(t, auth.Save(user))
+
+	assert.True(t, auth.PasswordExpired(user))
+	_, err = auth.AuthenticateUserFromSource("alice", "password", "")
+	assert.Equal(t, ErrPasswordExpired, err)
+	user, err = auth.AuthenticateUserFromSource("alice", "wrong", "")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+
+	// An expired password can be changed
+	require.NoError(t, auth.ChangePassword("alice", "password", "newpassword", ""))
+	user, err = auth.AuthenticateUserFromSource("alice", "newpassword", "")
+	require.NoError(t, err)
+	assert.NotNil(t, user)
+
+	// Passwords without a recorded change time don't expire
+	user.(*userImpl).PasswordChanged_ = nil
+	assert.False(t, auth.PasswordExpired(user))
+}
+
+func TestLoadCompromisedPasswords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "passwords.txt")
+	require.NoError(t, os.WriteFile(path, []byte("123456\nPassword\n\n  qwerty  \n"), 0600))
+	passwords, err := LoadCompromisedPasswords(path)
+	require.NoError(t, err)
+	assert.Equal(t, base.SetOf("123456", "password", "qwerty"), passwords)
+
+	_, err = LoadCompromisedPasswords(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(t, err)
+}
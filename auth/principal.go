@@ -9,6 +9,8 @@
 package auth
 
 import (
+	"time"
+
 	"github.com/couchbase/sync_gateway/base"
 	ch "github.com/couchbase/sync_gateway/channels"
 )
@@ -89,6 +91,39 @@ type User interface {
 	// Sets the user's email address.
 	SetEmail(string) error
 
+	// The devices registered to receive push notifications for the user.
+	PushDevices() []PushDevice
+
+	// Registers a device for push notifications, replacing any existing registration with the same token.
+	AddPushDevice(device PushDevice) error
+
+	// Removes the device with the given token.  Returns false if no such device was registered.
+	RemovePushDevice(token string) bool
+
+	// The API keys that can be used to authenticate as the user.
+	APIKeys() []APIKey
+
+	// Adds an API key.
+	AddAPIKey(key APIKey) error
+
+	// Removes the API key with the given ID.  Returns false if no such key exists.
+	RemoveAPIKey(id string) bool
+
+	// Sets the last used time of the API key with the given ID.  Returns false if no such key exists.
+	SetAPIKeyLastUsed(id string, lastUsed time.Time) bool
+
+	// The user's TOTP multi-factor authentication settings, or nil if the user hasn't enrolled.
+	MFA() *UserMFA
+
+	// Sets the user's multi-factor authentication settings.  Nil removes them.
+	SetMFA(mfa *UserMFA)
+
+	// If true, the user signed up and is disabled until their email address is verified.
+	EmailUnverified() bool
+
+	// Sets whether the user's email address needs to be verified.
+	SetEmailUnverified(bool)
+
 	// If true, the user is unable to authenticate.
 	Disabled() bool
 
@@ -101,6 +136,9 @@ type User interface {
 	// Changes the user's password.
 	SetPassword(password string)
 
+	// When the user's password was last set, or the zero time if unknown.
+	PasswordChanged() time.Time
+
 	// The set of Roles the user belongs to (including ones given to it by the sync function)
 	// Returns nil if invalidated
 	RoleNames() ch.TimedSet
@@ -111,6 +149,18 @@ type User interface {
 	// Sets the explicit roles the user belongs to.
 	SetExplicitRoles(ch.TimedSet, uint64)
 
+	// The roles granted to the user by the claims of the token they last authenticated with.
+	JWTRoles() ch.TimedSet
+
+	// Sets the roles granted by token claims.
+	SetJWTRoles(ch.TimedSet, uint64)
+
+	// The channels granted to the user by the claims of the token they last authenticated with.
+	JWTChannels() ch.TimedSet
+
+	// Sets the channels granted by token claims.
+	SetJWTChannels(ch.TimedSet, uint64)
+
 	GetRoleInvalSeq() uint64
 
 	SetRoleInvalSeq(uint64)
@@ -0,0 +1,101 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package auth
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Push notification platforms understood by the push gateway.
+const (
+	PushPlatformFCM  = "fcm"
+	PushPlatformAPNs = "apns"
+)
+
+// maxPushDevicesPerUser bounds the number of devices that can be registered to a single user, to keep the
+// user document small.
+const maxPushDevicesPerUser = 50
+
+// A device registered to receive push notifications on behalf of a user.
+type PushDevice struct {
+	Token    string    `json:"token"`             // Device token issued by FCM/APNs
+	Platform string    `json:"platform"`          // fcm or apns
+	Created  time.Time `json:"created,omitempty"` // Time the device was registered
+}
+
+func (device PushDevice) validate() error {
+	if device.Token == "" {
+		return base.HTTPErrorf(http.StatusBadRequest, "Push device token is required")
+	}
+	if device.Platform != PushPlatformFCM && device.Platform != PushPlatformAPNs {
+		return base.HTTPErrorf(http.StatusBadRequest, "Push device platform must be %q or %q", PushPlatformFCM, PushPlatformAPNs)
+	}
+	return nil
+}
+
+// RegisterPushDevice adds the device to the user's push devices, replacing any existing registration for the same token.
+func (auth *Authenticator) RegisterPushDevice(u User, device PushDevice) error {
+	if err := device.validate(); err != nil {
+		return err
+	}
+	if device.Created.IsZero() {
+		device.Created = time.Now().UTC()
+	}
+
+	registerPushDeviceCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+
+		if len(currentUser.PushDevices()) >= maxPushDevicesPerUser && !hasPushDevice(currentUser, device.Token) {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "User already has the maximum of %d push devices registered", maxPushDevicesPerUser)
+		}
+
+		base.Debugf(base.KeyAuth, "Registering %s push device for user %s", device.Platform, base.UD(u.Name()))
+		if err := currentUser.AddPushDevice(device); err != nil {
+			return nil, err
+		}
+		return currentUser, nil
+	}
+
+	return auth.casUpdatePrincipal(u, registerPushDeviceCallback)
+}
+
+// UnregisterPushDevice removes the device with the given token from the user's push devices.  Returns a 404 error
+// if the user has no such device registered.
+func (auth *Authenticator) UnregisterPushDevice(u User, token string) error {
+
+	unregisterPushDeviceCallback := func(currentPrincipal Principal) (updatedPrincipal Principal, err error) {
+		currentUser, ok := currentPrincipal.(User)
+		if !ok {
+			return nil, base.ErrUpdateCancel
+		}
+
+		if !currentUser.RemovePushDevice(token) {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Push device not found")
+		}
+		base.Debugf(base.KeyAuth, "Unregistered push device for user %s", base.UD(u.Name()))
+		return currentUser, nil
+	}
+
+	return auth.casUpdatePrincipal(u, unregisterPushDeviceCallback)
+}
+
+func hasPushDevice(user User, token string) bool {
+	for _, device := range user.PushDevices() {
+		if device.Token == token {
+			return true
+		}
+	}
+	return false
+}
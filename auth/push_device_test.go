@@ -0,0 +1,63 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package auth
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterPushDevice(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	auth := NewAuthenticator(bucket, nil, DefaultAuthenticatorOptions())
+	user, err := auth.NewUser("alice", "password", base.Set{})
+	require.NoError(t, err)
+	require.NoError(t, auth.Save(user))
+
+	// Invalid devices are rejected
+	err = auth.RegisterPushDevice(user, PushDevice{Platform: PushPlatformFCM})
+	assert.EqualError(t, err, "400 Push device token is required")
+	err = auth.RegisterPushDevice(user, PushDevice{Token: "abc", Platform: "sms"})
+	require.Error(t, err)
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	require.NoError(t, auth.RegisterPushDevice(user, PushDevice{Token: "abc", Platform: PushPlatformFCM}))
+	require.NoError(t, auth.RegisterPushDevice(user, PushDevice{Token: "def", Platform: PushPlatformAPNs}))
+	// Re-registering an existing token replaces the existing registration
+	require.NoError(t, auth.RegisterPushDevice(user, PushDevice{Token: "abc", Platform: PushPlatformAPNs}))
+
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	devices := user.PushDevices()
+	require.Len(t, devices, 2)
+	assert.Equal(t, "abc", devices[0].Token)
+	assert.Equal(t, PushPlatformAPNs, devices[0].Platform)
+	assert.False(t, devices[0].Created.IsZero())
+	assert.Equal(t, "def", devices[1].Token)
+
+	require.NoError(t, auth.UnregisterPushDevice(user, "abc"))
+	err = auth.UnregisterPushDevice(user, "abc")
+	require.Error(t, err)
+	status, _ = base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	user, err = auth.GetUser("alice")
+	require.NoError(t, err)
+	require.Len(t, user.PushDevices(), 1)
+	assert.Equal(t, "def", user.PushDevices()[0].Token)
+}
@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"regexp"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -43,8 +44,16 @@ type userImplBody struct {
 	OldPasswordHash_ interface{}     `json:"passwordhash,omitempty"` // For pre-beta compatibility
 	ExplicitRoles_   ch.TimedSet     `json:"explicit_roles,omitempty"`
 	RolesSince_      ch.TimedSet     `json:"rolesSince"`
-	RoleInvalSeq     uint64          `json:"role_inval_seq,omitempty"` // Sequence at which the roles were invalidated. Data remains in RolesSince_ for history calculation.
-	RoleHistory_     TimedSetHistory `json:"role_history,omitempty"`   // Added to when a previously granted role is revoked. Calculated inside of rebuildRoles.
+	RoleInvalSeq     uint64          `json:"role_inval_seq,omitempty"`   // Sequence at which the roles were invalidated. Data remains in RolesSince_ for history calculation.
+	RoleHistory_     TimedSetHistory `json:"role_history,omitempty"`     // Added to when a previously granted role is revoked. Calculated inside of rebuildRoles.
+	PushDevices_     []PushDevice    `json:"push_devices,omitempty"`     // Devices registered to receive push notifications
+	APIKeys_         []APIKey        `json:"api_keys,omitempty"`         // API keys that can be used to authenticate as the user
+	MFA_             *UserMFA        `json:"mfa,omitempty"`              // TOTP multi-factor authentication settings
+	PasswordChanged_ *time.Time      `json:"password_changed,omitempty"` // When the password was last set
+	PasswordHistory_ [][]byte        `json:"password_history,omitempty"` // Hashes of previous passwords, most recent first, when the password policy prevents reuse
+	EmailUnverified_ bool            `json:"email_unverified,omitempty"` // Signed up, and disabled until their email address is verified
+	JWTRoles_        ch.TimedSet     `json:"jwt_roles,omitempty"`        // Roles granted by the claims of the token the user last authenticated with
+	JWTChannels_     ch.TimedSet     `json:"jwt_channels,omitempty"`     // Channels granted by the claims of the token the user last authenticated with
 
 	OldExplicitRoles_ []string `json:"admin_roles,omitempty"` // obsolete; declared for migration
 }
@@ -144,6 +153,89 @@ func (user *userImpl) SetEmail(email string) error {
 	return nil
 }
 
+func (user *userImpl) PushDevices() []PushDevice {
+	return user.PushDevices_
+}
+
+func (user *userImpl) AddPushDevice(device PushDevice) error {
+	if err := device.validate(); err != nil {
+		return err
+	}
+	for i, existing := range user.PushDevices_ {
+		if existing.Token == device.Token {
+			user.PushDevices_[i] = device
+			return nil
+		}
+	}
+	user.PushDevices_ = append(user.PushDevices_, device)
+	return nil
+}
+
+func (user *userImpl) RemovePushDevice(token string) bool {
+	for i, existing := range user.PushDevices_ {
+		if existing.Token == token {
+			user.PushDevices_ = append(user.PushDevices_[:i], user.PushDevices_[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (user *userImpl) APIKeys() []APIKey {
+	return user.APIKeys_
+}
+
+func (user *userImpl) AddAPIKey(key APIKey) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+	user.APIKeys_ = append(user.APIKeys_, key)
+	return nil
+}
+
+func (user *userImpl) RemoveAPIKey(id string) bool {
+	for i, existing := range user.APIKeys_ {
+		if existing.ID == id {
+			user.APIKeys_ = append(user.APIKeys_[:i], user.APIKeys_[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (user *userImpl) SetAPIKeyLastUsed(id string, lastUsed time.Time) bool {
+	for i := range user.APIKeys_ {
+		if user.APIKeys_[i].ID == id {
+			user.APIKeys_[i].LastUsed = &lastUsed
+			return true
+		}
+	}
+	return false
+}
+
+func (user *userImpl) MFA() *UserMFA {
+	return user.MFA_
+}
+
+func (user *userImpl) SetMFA(mfa *UserMFA) {
+	user.MFA_ = mfa
+}
+
+func (user *userImpl) EmailUnverified() bool {
+	return user.EmailUnverified_
+}
+
+func (user *userImpl) SetEmailUnverified(unverified bool) {
+	user.EmailUnverified_ = unverified
+}
+
+func (user *userImpl) PasswordChanged() time.Time {
+	if user.PasswordChanged_ == nil {
+		return time.Time{}
+	}
+	return *user.PasswordChanged_
+}
+
 func (user *userImpl) RoleNames() ch.TimedSet {
 	if user.RoleInvalSeq != 0 {
 		return nil
@@ -165,6 +257,24 @@ func (user *userImpl) SetExplicitRoles(roles ch.TimedSet, invalSeq uint64) {
 	user.SetRoleInvalSeq(invalSeq)
 }
 
+func (user *userImpl) JWTRoles() ch.TimedSet {
+	return user.JWTRoles_
+}
+
+func (user *userImpl) SetJWTRoles(roles ch.TimedSet, invalSeq uint64) {
+	user.JWTRoles_ = roles
+	user.SetRoleInvalSeq(invalSeq)
+}
+
+func (user *userImpl) JWTChannels() ch.TimedSet {
+	return user.JWTChannels_
+}
+
+func (user *userImpl) SetJWTChannels(channels ch.TimedSet, invalSeq uint64) {
+	user.JWTChannels_ = channels
+	user.SetChannelInvalSeq(invalSeq)
+}
+
 func (user *userImpl) GetRoleInvalSeq() uint64 {
 	return user.RoleInvalSeq
 }
@@ -439,8 +549,27 @@ func (user *userImpl) Authenticate(password string) bool {
 	return true
 }
 
-// Changes a user's password to the given string.
+// Changes a user's password to the given string, and records when it was changed.  When there's a password policy,
+// setting the current password again has no effect, and the previous hash is kept in the history if reuse is limited.
 func (user *userImpl) SetPassword(password string) {
+	if policy := user.auth.PasswordPolicy; policy != nil {
+		if user.passwordMatches(password) {
+			return
+		}
+		if policy.HistoryCount > 0 && user.PasswordHash_ != nil {
+			user.PasswordHistory_ = append([][]byte{user.PasswordHash_}, user.PasswordHistory_...)
+			if len(user.PasswordHistory_) > policy.HistoryCount {
+				user.PasswordHistory_ = user.PasswordHistory_[:policy.HistoryCount]
+			}
+		}
+	}
+	user.setPasswordHash(password)
+	changed := time.Now().UTC()
+	user.PasswordChanged_ = &changed
+}
+
+// setPasswordHash hashes the password with the configured bcrypt cost, without affecting the password history.
+func (user *userImpl) setPasswordHash(password string) {
 	if password == "" {
 		user.PasswordHash_ = nil
 	} else {
@@ -452,6 +581,11 @@ func (user *userImpl) SetPassword(password string) {
 	}
 }
 
+// passwordMatches returns true if the password is the user's current (non-empty) password.
+func (user *userImpl) passwordMatches(password string) bool {
+	return user.PasswordHash_ != nil && password != "" && compareHashAndPassword(cachedHashes, user.PasswordHash_, []byte(password))
+}
+
 //////// CHANNEL ACCESS:
 
 func (user *userImpl) GetRoles() []Role {
@@ -110,11 +110,15 @@ const (
 	//==== Sync Prefix Documents & Keys ====
 	SyncPrefix = "_sync:"
 
+	AccountTokenPrefix     = SyncPrefix + "account_token:"
 	AttPrefix              = SyncPrefix + "att:"
 	Att2Prefix             = SyncPrefix + "att2:"
+	AttRenditionPrefix     = SyncPrefix + "attr:"
 	BackfillCompletePrefix = SyncPrefix + "backfill:complete:"
 	BackfillPendingPrefix  = SyncPrefix + "backfill:pending:"
 	DCPCheckpointPrefix    = SyncPrefix + "dcp_ck:"
+	LockoutPrefix          = SyncPrefix + "lockout:"
+	MFAChallengePrefix     = SyncPrefix + "mfa_challenge:"
 	RepairBackup           = SyncPrefix + "repair:backup:"
 	RepairDryRun           = SyncPrefix + "repair:dryrun:"
 	RevBodyPrefix          = SyncPrefix + "rb:"
@@ -144,11 +148,33 @@ const (
 
 	SGRStatusPrefix = SyncPrefix + "sgrStatus:"
 
+	// Prefix for sg-replicate dead letter documents, used to track revisions rejected by the remote
+	SGRDeadLetterPrefix = SyncPrefix + "sgrDLQ:"
+
+	// Prefix for the conflict index shard documents, used to track documents with conflicting branches
+	ConflictIndexPrefix = SyncPrefix + "conflicts:"
+
+	// Prefix for the shard documents tracking users with registered push notification devices
+	PushDeviceRegistryPrefix = SyncPrefix + "pushdevices:"
+
+	// Document holding sampled sequence/timestamp checkpoints, used to translate times into since values
+	SeqTimeIndexKey = SyncPrefix + "seqtimeindex"
+
+	// Prefix for changes feed subscription documents, used to persist the cursor of each named subscription
+	ChangesSubscriptionPrefix = SyncPrefix + "subscription:"
+
+	// Prefix for broker event handler checkpoints, used to resume publishing changes from the last published sequence
+	BrokerCheckpointPrefix = SyncPrefix + "brokercheckpoint:"
+
+	// Prefix for durable webhook outbox documents, used to persist events until they're delivered
+	WebhookOutboxPrefix = SyncPrefix + "webhookoutbox:"
+
 	// Prefix for transaction metadata documents
 	TxnPrefix = "_txn:"
 
 	// Replication filter constants
 	ByChannelFilter = "sync_gateway/bychannel"
+	PredicateFilter = "sync_gateway/predicate"
 
 	// Increase default gocbv2 op timeout to match the standard SG backoff retry timing used for gocb v1
 	DefaultGocbV2OperationTimeout = 10 * time.Second
@@ -240,18 +240,23 @@ type CBLReplicationPullStats struct {
 }
 
 type CBLReplicationPushStats struct {
-	AttachmentPushBytes *SgwIntStat `json:"attachment_push_bytes"`
-	AttachmentPushCount *SgwIntStat `json:"attachment_push_count"`
-	DocPushCount        *SgwIntStat `json:"doc_push_count"`
-	ProposeChangeCount  *SgwIntStat `json:"propose_change_count"`
-	ProposeChangeTime   *SgwIntStat `json:"propose_change_time"`
-	WriteProcessingTime *SgwIntStat `json:"write_processing_time"`
+	AttachmentPushBytes         *SgwIntStat `json:"attachment_push_bytes"`
+	AttachmentPushCount         *SgwIntStat `json:"attachment_push_count"`
+	ConflictResolvedLocalCount  *SgwIntStat `json:"conflict_resolved_local_count"`
+	ConflictResolvedMergedCount *SgwIntStat `json:"conflict_resolved_merge_count"`
+	ConflictResolvedRemoteCount *SgwIntStat `json:"conflict_resolved_remote_count"`
+	DocPushCount                *SgwIntStat `json:"doc_push_count"`
+	ProposeChangeCount          *SgwIntStat `json:"propose_change_count"`
+	ProposeChangeTime           *SgwIntStat `json:"propose_change_time"`
+	WriteProcessingTime         *SgwIntStat `json:"write_processing_time"`
 }
 
 type DatabaseStats struct {
 	CompactionAttachmentStartTime *SgwIntStat `json:"compaction_attachment_start_time"`
 	CompactionTombstoneStartTime  *SgwIntStat `json:"compaction_tombstone_start_time"`
 	ConflictWriteCount            *SgwIntStat `json:"conflict_write_count"`
+	ConflictedDocsCount           *SgwIntStat `json:"conflicted_docs_count"`
+	ConflictsResolvedCount        *SgwIntStat `json:"conflicts_resolved_count"`
 	Crc32MatchCount               *SgwIntStat `json:"crc32c_match_count"`
 	DCPCachingCount               *SgwIntStat `json:"dcp_caching_count"`
 	DCPCachingTime                *SgwIntStat `json:"dcp_caching_time"`
@@ -263,12 +268,15 @@ type DatabaseStats struct {
 	DocWritesXattrBytes           *SgwIntStat `json:"doc_writes_xattr_bytes"`
 	HighSeqFeed                   *SgwIntStat `json:"high_seq_feed"`
 	NumAttachmentsCompacted       *SgwIntStat `json:"num_attachments_compacted"`
+	NumAttachmentsRejected        *SgwIntStat `json:"num_attachments_rejected"`
 	NumDocReadsBlip               *SgwIntStat `json:"num_doc_reads_blip"`
 	NumDocReadsRest               *SgwIntStat `json:"num_doc_reads_rest"`
 	NumDocWrites                  *SgwIntStat `json:"num_doc_writes"`
 	NumReplicationsActive         *SgwIntStat `json:"num_replications_active"`
 	NumReplicationsTotal          *SgwIntStat `json:"num_replications_total"`
 	NumTombstonesCompacted        *SgwIntStat `json:"num_tombstones_compacted"`
+	PushNotificationErrors        *SgwIntStat `json:"push_notification_errors"`
+	PushNotificationsSent         *SgwIntStat `json:"push_notifications_sent"`
 	SequenceAssignedCount         *SgwIntStat `json:"sequence_assigned_count"`
 	SequenceGetCount              *SgwIntStat `json:"sequence_get_count"`
 	SequenceIncrCount             *SgwIntStat `json:"sequence_incr_count"`
@@ -400,11 +408,15 @@ type DbReplicatorStats struct {
 	ConflictResolvedLocalCount  *SgwIntStat `json:"sgr_conflict_resolved_local_count"`
 	ConflictResolvedRemoteCount *SgwIntStat `json:"sgr_conflict_resolved_remote_count"`
 	ConflictResolvedMergedCount *SgwIntStat `json:"sgr_conflict_resolved_merge_count"`
+
+	DeadLetterCount *SgwIntStat `json:"sgr_dead_letter_count"`
 }
 
 type SecurityStats struct {
 	AuthFailedCount  *SgwIntStat `json:"auth_failed_count"`
 	AuthSuccessCount *SgwIntStat `json:"auth_success_count"`
+	LockoutCount     *SgwIntStat `json:"lockout_count"`
+	MFAFailedCount   *SgwIntStat `json:"mfa_failed_count"`
 	NumAccessErrors  *SgwIntStat `json:"num_access_errors"`
 	NumDocsRejected  *SgwIntStat `json:"num_docs_rejected"`
 	TotalAuthTime    *SgwIntStat `json:"total_auth_time"`
@@ -791,18 +803,24 @@ func (d *DbStats) initCBLReplicationPushStats() {
 	labelKeys := []string{DatabaseLabelKey}
 	labelVals := []string{d.dbName}
 	d.CBLReplicationPushStats = &CBLReplicationPushStats{
-		AttachmentPushBytes: NewIntStat(SubsystemReplicationPush, "attachment_push_bytes", labelKeys, labelVals, prometheus.CounterValue, 0),
-		AttachmentPushCount: NewIntStat(SubsystemReplicationPush, "attachment_push_count", labelKeys, labelVals, prometheus.CounterValue, 0),
-		DocPushCount:        NewIntStat(SubsystemReplicationPush, "doc_push_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
-		ProposeChangeCount:  NewIntStat(SubsystemReplicationPush, "propose_change_count", labelKeys, labelVals, prometheus.CounterValue, 0),
-		ProposeChangeTime:   NewIntStat(SubsystemReplicationPush, "propose_change_time", labelKeys, labelVals, prometheus.CounterValue, 0),
-		WriteProcessingTime: NewIntStat(SubsystemReplicationPush, "write_processing_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
+		AttachmentPushBytes:         NewIntStat(SubsystemReplicationPush, "attachment_push_bytes", labelKeys, labelVals, prometheus.CounterValue, 0),
+		AttachmentPushCount:         NewIntStat(SubsystemReplicationPush, "attachment_push_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		ConflictResolvedLocalCount:  NewIntStat(SubsystemReplicationPush, "conflict_resolved_local_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		ConflictResolvedMergedCount: NewIntStat(SubsystemReplicationPush, "conflict_resolved_merge_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		ConflictResolvedRemoteCount: NewIntStat(SubsystemReplicationPush, "conflict_resolved_remote_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		DocPushCount:                NewIntStat(SubsystemReplicationPush, "doc_push_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
+		ProposeChangeCount:          NewIntStat(SubsystemReplicationPush, "propose_change_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		ProposeChangeTime:           NewIntStat(SubsystemReplicationPush, "propose_change_time", labelKeys, labelVals, prometheus.CounterValue, 0),
+		WriteProcessingTime:         NewIntStat(SubsystemReplicationPush, "write_processing_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
 	}
 }
 
 func (d *DbStats) unregisterCBLReplicationPushStats() {
 	prometheus.Unregister(d.CBLReplicationPushStats.AttachmentPushBytes)
 	prometheus.Unregister(d.CBLReplicationPushStats.AttachmentPushCount)
+	prometheus.Unregister(d.CBLReplicationPushStats.ConflictResolvedLocalCount)
+	prometheus.Unregister(d.CBLReplicationPushStats.ConflictResolvedMergedCount)
+	prometheus.Unregister(d.CBLReplicationPushStats.ConflictResolvedRemoteCount)
 	prometheus.Unregister(d.CBLReplicationPushStats.DocPushCount)
 	prometheus.Unregister(d.CBLReplicationPushStats.ProposeChangeCount)
 	prometheus.Unregister(d.CBLReplicationPushStats.ProposeChangeTime)
@@ -820,6 +838,8 @@ func (d *DbStats) initDatabaseStats() {
 		CompactionAttachmentStartTime: NewIntStat(SubsystemDatabaseKey, "compaction_attachment_start_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		CompactionTombstoneStartTime:  NewIntStat(SubsystemDatabaseKey, "compaction_tombstone_start_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		ConflictWriteCount:            NewIntStat(SubsystemDatabaseKey, "conflict_write_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+		ConflictedDocsCount:           NewIntStat(SubsystemDatabaseKey, "conflicted_docs_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
+		ConflictsResolvedCount:        NewIntStat(SubsystemDatabaseKey, "conflicts_resolved_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 		Crc32MatchCount:               NewIntStat(SubsystemDatabaseKey, "crc32c_match_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		DCPCachingCount:               NewIntStat(SubsystemDatabaseKey, "dcp_caching_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		DCPCachingTime:                NewIntStat(SubsystemDatabaseKey, "dcp_caching_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
@@ -830,6 +850,7 @@ func (d *DbStats) initDatabaseStats() {
 		DocWritesXattrBytes:           NewIntStat(SubsystemDatabaseKey, "doc_writes_xattr_bytes", labelKeys, labelVals, prometheus.CounterValue, 0),
 		HighSeqFeed:                   NewIntStat(SubsystemDatabaseKey, "high_seq_feed", labelKeys, labelVals, prometheus.CounterValue, 0),
 		NumAttachmentsCompacted:       NewIntStat(SubsystemDatabaseKey, "num_attachments_compacted", labelKeys, labelVals, prometheus.CounterValue, 0),
+		NumAttachmentsRejected:        NewIntStat(SubsystemDatabaseKey, "num_attachments_rejected", labelKeys, labelVals, prometheus.CounterValue, 0),
 		DocWritesBytesBlip:            NewIntStat(SubsystemDatabaseKey, "doc_writes_bytes_blip", labelKeys, labelVals, prometheus.CounterValue, 0),
 		NumDocReadsBlip:               NewIntStat(SubsystemDatabaseKey, "num_doc_reads_blip", labelKeys, labelVals, prometheus.CounterValue, 0),
 		NumDocReadsRest:               NewIntStat(SubsystemDatabaseKey, "num_doc_reads_rest", labelKeys, labelVals, prometheus.CounterValue, 0),
@@ -837,6 +858,8 @@ func (d *DbStats) initDatabaseStats() {
 		NumReplicationsActive:         NewIntStat(SubsystemDatabaseKey, "num_replications_active", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		NumReplicationsTotal:          NewIntStat(SubsystemDatabaseKey, "num_replications_total", labelKeys, labelVals, prometheus.CounterValue, 0),
 		NumTombstonesCompacted:        NewIntStat(SubsystemDatabaseKey, "num_tombstones_compacted", labelKeys, labelVals, prometheus.CounterValue, 0),
+		PushNotificationErrors:        NewIntStat(SubsystemDatabaseKey, "push_notification_errors", labelKeys, labelVals, prometheus.CounterValue, 0),
+		PushNotificationsSent:         NewIntStat(SubsystemDatabaseKey, "push_notifications_sent", labelKeys, labelVals, prometheus.CounterValue, 0),
 		SequenceAssignedCount:         NewIntStat(SubsystemDatabaseKey, "sequence_assigned_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 		SequenceGetCount:              NewIntStat(SubsystemDatabaseKey, "sequence_get_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 		SequenceIncrCount:             NewIntStat(SubsystemDatabaseKey, "sequence_incr_count", labelKeys, labelVals, prometheus.CounterValue, 0),
@@ -857,6 +880,8 @@ func (d *DbStats) unregisterDatabaseStats() {
 	prometheus.Unregister(d.DatabaseStats.CompactionAttachmentStartTime)
 	prometheus.Unregister(d.DatabaseStats.CompactionTombstoneStartTime)
 	prometheus.Unregister(d.DatabaseStats.ConflictWriteCount)
+	prometheus.Unregister(d.DatabaseStats.ConflictedDocsCount)
+	prometheus.Unregister(d.DatabaseStats.ConflictsResolvedCount)
 	prometheus.Unregister(d.DatabaseStats.Crc32MatchCount)
 	prometheus.Unregister(d.DatabaseStats.DCPCachingCount)
 	prometheus.Unregister(d.DatabaseStats.DCPCachingTime)
@@ -868,12 +893,15 @@ func (d *DbStats) unregisterDatabaseStats() {
 	prometheus.Unregister(d.DatabaseStats.HighSeqFeed)
 	prometheus.Unregister(d.DatabaseStats.DocWritesBytesBlip)
 	prometheus.Unregister(d.DatabaseStats.NumAttachmentsCompacted)
+	prometheus.Unregister(d.DatabaseStats.NumAttachmentsRejected)
 	prometheus.Unregister(d.DatabaseStats.NumDocReadsBlip)
 	prometheus.Unregister(d.DatabaseStats.NumDocReadsRest)
 	prometheus.Unregister(d.DatabaseStats.NumDocWrites)
 	prometheus.Unregister(d.DatabaseStats.NumReplicationsActive)
 	prometheus.Unregister(d.DatabaseStats.NumReplicationsTotal)
 	prometheus.Unregister(d.DatabaseStats.NumTombstonesCompacted)
+	prometheus.Unregister(d.DatabaseStats.PushNotificationErrors)
+	prometheus.Unregister(d.DatabaseStats.PushNotificationsSent)
 	prometheus.Unregister(d.DatabaseStats.SequenceAssignedCount)
 	prometheus.Unregister(d.DatabaseStats.SequenceGetCount)
 	prometheus.Unregister(d.DatabaseStats.SequenceIncrCount)
@@ -924,6 +952,8 @@ func (d *DbStats) initSecurityStats() {
 		d.SecurityStats = &SecurityStats{
 			AuthFailedCount:  NewIntStat(SubsystemSecurity, "auth_failed_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 			AuthSuccessCount: NewIntStat(SubsystemSecurity, "auth_success_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+			LockoutCount:     NewIntStat(SubsystemSecurity, "lockout_count", labelKeys, labelVals, prometheus.CounterValue, 0),
+			MFAFailedCount:   NewIntStat(SubsystemSecurity, "mfa_failed_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 			NumAccessErrors:  NewIntStat(SubsystemSecurity, "num_access_errors", labelKeys, labelVals, prometheus.CounterValue, 0),
 			NumDocsRejected:  NewIntStat(SubsystemSecurity, "num_docs_rejected", labelKeys, labelVals, prometheus.CounterValue, 0),
 			TotalAuthTime:    NewIntStat(SubsystemSecurity, "total_auth_time", labelKeys, labelVals, prometheus.GaugeValue, 0),
@@ -934,6 +964,8 @@ func (d *DbStats) initSecurityStats() {
 func (d *DbStats) unregisterSecurityStats() {
 	prometheus.Unregister(d.SecurityStats.AuthFailedCount)
 	prometheus.Unregister(d.SecurityStats.AuthSuccessCount)
+	prometheus.Unregister(d.SecurityStats.LockoutCount)
+	prometheus.Unregister(d.SecurityStats.MFAFailedCount)
 	prometheus.Unregister(d.SecurityStats.NumAccessErrors)
 	prometheus.Unregister(d.SecurityStats.NumDocsRejected)
 	prometheus.Unregister(d.SecurityStats.TotalAuthTime)
@@ -971,6 +1003,7 @@ func (d *DbStats) DBReplicatorStats(replicationID string) *DbReplicatorStats {
 			ConflictResolvedMergedCount: NewIntStat(SubsystemReplication, "sgr_conflict_resolved_merge_count", labelKeys, labelVals, prometheus.CounterValue, 0),
 			NumConnectAttemptsPull:      NewIntStat(SubsystemReplication, "sgr_num_connect_attempts_pull", labelKeys, labelVals, prometheus.CounterValue, 0),
 			NumReconnectsAbortedPull:    NewIntStat(SubsystemReplication, "sgr_num_reconnects_aborted_pull", labelKeys, labelVals, prometheus.CounterValue, 0),
+			DeadLetterCount:             NewIntStat(SubsystemReplication, "sgr_dead_letter_count", labelKeys, labelVals, prometheus.GaugeValue, 0),
 		}
 	}
 
@@ -998,6 +1031,8 @@ func (dbr *DbReplicatorStats) Reset() {
 	dbr.ConflictResolvedLocalCount.Set(0)
 	dbr.ConflictResolvedRemoteCount.Set(0)
 	dbr.ConflictResolvedMergedCount.Set(0)
+	// DeadLetterCount isn't reset, as it tracks the size of the persisted dead letter queue, which is maintained by the
+	// queue itself
 }
 
 func (d *DbStats) Security() *SecurityStats {
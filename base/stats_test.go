@@ -131,6 +131,18 @@ func TestSetIfMax(t *testing.T) {
 	assert.Equal(t, float64(100), sgwStats.GlobalStats.ResourceUtilizationStats().CpuPercentUtil.Value())
 }
 
+func TestDbReplicatorStatsReset(t *testing.T) {
+	sgwStats := NewSyncGatewayStats()
+	replicationStats := sgwStats.NewDBStats(t.Name(), false, false, false).DBReplicatorStats("replication1")
+	replicationStats.PulledCount.Set(5)
+	replicationStats.DeadLetterCount.Set(2)
+
+	// The dead letter gauge tracks the persisted queue, so is left for the queue to update
+	replicationStats.Reset()
+	assert.Equal(t, int64(0), replicationStats.PulledCount.Value())
+	assert.Equal(t, int64(2), replicationStats.DeadLetterCount.Value())
+}
+
 func initExpvarBaseEquivalent() *expvar.Map {
 	expvarMap := new(expvar.Map).Init()
 	expvarMap.Set("global", new(expvar.Map).Init())
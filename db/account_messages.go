@@ -0,0 +1,183 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// accountMessageSendTimeout bounds the time spent delivering a single account message.
+const accountMessageSendTimeout = 30 * time.Second
+
+// AccountMessage delivers a single-use account token to a user, for email verification or password reset.
+type AccountMessage struct {
+	Type     auth.AccountTokenType `json:"type"`
+	Database string                `json:"db"`
+	Username string                `json:"username"`
+	Email    string                `json:"email"`
+	Token    string                `json:"token"`
+	Link     string                `json:"link,omitempty"` // The configured link URL with the token substituted, if set
+	Expires  time.Time             `json:"expires"`
+}
+
+// AccountMessageSender delivers account messages to users.  Implementations must be safe for concurrent use.
+type AccountMessageSender interface {
+	SendAccountMessage(message *AccountMessage) error
+}
+
+// SMTPAccountMessageSender emails account messages via an SMTP server, using STARTTLS when the server supports it.
+type SMTPAccountMessageSender struct {
+	Host     string // SMTP server host
+	Port     int    // SMTP server port
+	Username string // Username for PLAIN authentication, if required
+	Password string // Password for PLAIN authentication
+	From     string // Sender address
+}
+
+func (s *SMTPAccountMessageSender) SendAccountMessage(message *AccountMessage) error {
+	if strings.ContainsAny(message.Email, "\r\n") {
+		return fmt.Errorf("invalid email address %q", message.Email)
+	}
+	var smtpAuth smtp.Auth
+	if s.Username != "" {
+		smtpAuth = smtp.PlainAuth("", s.Username, s.Password, s.Host)
+	}
+	subject, text := accountMessageText(message)
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "From: %s\r\n", s.From)
+	fmt.Fprintf(&body, "To: %s\r\n", message.Email)
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	body.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(text, "\n", "\r\n"))
+
+	return s.send(message.Email, body.Bytes(), smtpAuth)
+}
+
+// send delivers a message to a single recipient.  This is equivalent to smtp.SendMail, with a deadline so that an
+// unresponsive server doesn't block the caller indefinitely.
+func (s *SMTPAccountMessageSender) send(to string, msg []byte, smtpAuth smtp.Auth) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), accountMessageSendTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(accountMessageSendTimeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	client, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.Host}); err != nil {
+			return err
+		}
+	}
+	if smtpAuth != nil {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("SMTP server %s doesn't support authentication", s.Host)
+		}
+		if err := client.Auth(smtpAuth); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(msg); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// WebhookAccountMessageSender POSTs account messages as JSON to a webhook, which is responsible for delivering them.
+type WebhookAccountMessageSender struct {
+	URL    string
+	client *http.Client
+}
+
+func NewWebhookAccountMessageSender(url string) *WebhookAccountMessageSender {
+	return &WebhookAccountMessageSender{
+		URL:    url,
+		client: &http.Client{Timeout: accountMessageSendTimeout},
+	}
+}
+
+func (s *WebhookAccountMessageSender) SendAccountMessage(message *AccountMessage) error {
+	body, err := base.JSONMarshal(message)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), accountMessageSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("account message webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// accountMessageText returns the subject and plain text body of an emailed account message.
+func accountMessageText(message *AccountMessage) (subject, text string) {
+	var action string
+	switch message.Type {
+	case auth.AccountTokenVerifyEmail:
+		subject = "Verify your email address"
+		action = "verify your email address"
+	case auth.AccountTokenPasswordReset:
+		subject = "Reset your password"
+		action = "reset your password"
+	}
+	var body strings.Builder
+	fmt.Fprintf(&body, "Hello %s,\n\n", message.Username)
+	if message.Link != "" {
+		fmt.Fprintf(&body, "To %s, open this link:\n\n%s\n\n", action, message.Link)
+	} else {
+		fmt.Fprintf(&body, "To %s, use this code:\n\n%s\n\n", action, message.Token)
+	}
+	fmt.Fprintf(&body, "This expires at %s.  If you didn't request this, you can ignore this message.\n", message.Expires.UTC().Format(time.RFC1123))
+	return subject, body.String()
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testSMTPServer is a minimal SMTP server that accepts a single message per connection, for testing
+// SMTPAccountMessageSender without a real mail server.
+type testSMTPServer struct {
+	listener net.Listener
+	messages chan testSMTPMessage
+}
+
+type testSMTPMessage struct {
+	from, to, data string
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &testSMTPServer{listener: listener, messages: make(chan testSMTPMessage, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *testSMTPServer) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+	reply("220 localhost ESMTP test")
+	var message testSMTPMessage
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			message.from = strings.Trim(line[len("MAIL FROM:"):], "<>")
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			message.to = strings.Trim(line[len("RCPT TO:"):], "<>")
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if dataLine == ".\r\n" {
+					break
+				}
+				data.WriteString(dataLine)
+			}
+			message.data = data.String()
+			s.messages <- message
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func (s *testSMTPServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestSMTPAccountMessageSender(t *testing.T) {
+	server := newTestSMTPServer(t)
+	defer func() { _ = server.listener.Close() }()
+
+	sender := &SMTPAccountMessageSender{Host: "127.0.0.1", Port: server.port(), From: "noreply@example.com"}
+	message := &AccountMessage{
+		Type:     auth.AccountTokenVerifyEmail,
+		Database: "db",
+		Username: "alice",
+		Email:    "alice@example.com",
+		Token:    "abc123",
+		Link:     "https://example.com/verify?token=abc123",
+		Expires:  time.Now().Add(time.Hour),
+	}
+	require.NoError(t, sender.SendAccountMessage(message))
+
+	select {
+	case received := <-server.messages:
+		assert.Equal(t, "noreply@example.com", received.from)
+		assert.Equal(t, "alice@example.com", received.to)
+		assert.Contains(t, received.data, "Subject: Verify your email address\r\n")
+		assert.Contains(t, received.data, "https://example.com/verify?token=abc123")
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for message")
+	}
+
+	// Addresses that could inject headers are rejected
+	message.Email = "alice@example.com\r\nBcc: mallory@example.com"
+	assert.Error(t, sender.SendAccountMessage(message))
+}
+
+func TestWebhookAccountMessageSender(t *testing.T) {
+	received := make(chan AccountMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var message AccountMessage
+		require.NoError(t, base.JSONUnmarshal(body, &message))
+		received <- message
+		if message.Username == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	sender := NewWebhookAccountMessageSender(server.URL)
+	message := &AccountMessage{
+		Type:     auth.AccountTokenPasswordReset,
+		Database: "db",
+		Username: "alice",
+		Email:    "alice@example.com",
+		Token:    "abc123",
+		Expires:  time.Now().Add(time.Hour),
+	}
+	require.NoError(t, sender.SendAccountMessage(message))
+	sent := <-received
+	assert.Equal(t, auth.AccountTokenPasswordReset, sent.Type)
+	assert.Equal(t, "abc123", sent.Token)
+	assert.Equal(t, "alice@example.com", sent.Email)
+
+	message.Username = "fail"
+	assert.Error(t, sender.SendAccountMessage(message))
+}
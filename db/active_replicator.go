@@ -114,14 +114,20 @@ func (ar *ActiveReplicator) Stop() error {
 }
 
 func (ar *ActiveReplicator) Reset() error {
+	return ar.ResetSince("")
+}
+
+// ResetSince resets the replication to restart from the changes made since the RFC 3339 sinceTime, or from zero when
+// sinceTime is empty.
+func (ar *ActiveReplicator) ResetSince(sinceTime string) error {
 	var pushErr error
 	if ar.Push != nil {
-		pushErr = ar.Push.reset()
+		pushErr = ar.Push.reset(sinceTime)
 	}
 
 	var pullErr error
 	if ar.Pull != nil {
-		pullErr = ar.Pull.reset()
+		pullErr = ar.Pull.reset(sinceTime)
 	}
 
 	if pushErr != nil {
@@ -324,11 +330,11 @@ func combinedState(state1, state2 string) (combinedState string) {
 
 func (ar *ActiveReplicator) purgeCheckpoints() {
 	if ar.Pull != nil {
-		_ = ar.Pull.reset()
+		_ = ar.Pull.reset("")
 	}
 
 	if ar.Push != nil {
-		_ = ar.Push.reset()
+		_ = ar.Push.reset("")
 	}
 }
 
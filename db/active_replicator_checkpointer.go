@@ -28,6 +28,7 @@ type Checkpointer struct {
 	clientID           string
 	configHash         string
 	blipSender         *blip.Sender
+	remoteStore        remoteCheckpointStore // used for remote checkpoints when there's no blipSender
 	activeDB           *Database
 	checkpointInterval time.Duration
 	statusCallback     statusFunc // callback to retrieve status for associated replication
@@ -48,6 +49,8 @@ type Checkpointer struct {
 	lastLocalCheckpointRevID string
 	// lastCheckpointSeq is the last checkpointed sequence
 	lastCheckpointSeq string
+	// sinceTime is the RFC 3339 time the replication was reset to, when there's no checkpointed sequence yet
+	sinceTime string
 
 	stats CheckpointerStats
 
@@ -57,6 +60,12 @@ type Checkpointer struct {
 
 type statusFunc func(lastSeq string) *ReplicationStatus
 
+// remoteCheckpointStore reads and writes remote checkpoints for replications that don't use BLIP.
+type remoteCheckpointStore interface {
+	getCheckpoint(clientID string) (*replicationCheckpoint, error)
+	setCheckpoint(clientID string, checkpoint *replicationCheckpoint) (newRev string, err error)
+}
+
 type CheckpointerStats struct {
 	ExpectedSequenceCount     int64
 	ProcessedSequenceCount    int64
@@ -113,6 +122,25 @@ func (c *Checkpointer) AddProcessedSeq(seq string) {
 	c.lock.Unlock()
 }
 
+// SetProcessedSeq marks seq as the highest processed sequence, discarding any expected or processed sequences not
+// yet checkpointed.  Used by replications that process sequences strictly in order, where sequences are opaque and
+// can't be sorted (e.g. sequences from a CouchDB _changes feed).
+func (c *Checkpointer) SetProcessedSeq(seq string) {
+	select {
+	case <-c.ctx.Done():
+		// replicator already closed, bail out of checkpointing work
+		return
+	default:
+	}
+
+	c.lock.Lock()
+	c.expectedSeqs = []string{seq}
+	c.processedSeqs = map[string]struct{}{seq: {}}
+	c.stats.ExpectedSequenceCount++
+	c.stats.ProcessedSequenceCount++
+	c.lock.Unlock()
+}
+
 func (c *Checkpointer) AddProcessedSeqIDAndRev(seq string, idAndRev IDAndRev) {
 	select {
 	case <-c.ctx.Done():
@@ -301,6 +329,7 @@ const (
 	checkpointBodyLastSeq = "last_sequence"
 	checkpointBodyHash    = "config_hash"
 	checkpointBodyStatus  = "status"
+	checkpointBodyTime    = "since_time"
 )
 
 type replicationCheckpoint struct {
@@ -308,16 +337,21 @@ type replicationCheckpoint struct {
 	ConfigHash string             `json:"config_hash"`
 	LastSeq    string             `json:"last_sequence"`
 	Status     *ReplicationStatus `json:"status,omitempty"`
+	SinceTime  string             `json:"since_time,omitempty"` // Set when the replication is reset to a point in time
 }
 
 // AsBody returns a Body representation of replicationCheckpoint for use with putSpecial
 func (r *replicationCheckpoint) AsBody() Body {
-	return Body{
+	body := Body{
 		checkpointBodyRev:     r.Rev,
 		checkpointBodyLastSeq: r.LastSeq,
 		checkpointBodyHash:    r.ConfigHash,
 		checkpointBodyStatus:  r.Status,
 	}
+	if r.SinceTime != "" {
+		body[checkpointBodyTime] = r.SinceTime
+	}
+	return body
 }
 
 // NewReplicationCheckpoint converts a revID and checkpoint body into a replicationCheckpoint
@@ -415,6 +449,13 @@ func (c *Checkpointer) fetchCheckpoints() (*ReplicationStatus, error) {
 		checkpointSeq = ""
 	}
 
+	// A replication reset to a point in time starts from that time until the first checkpoint is set
+	c.sinceTime = ""
+	if checkpointSeq == "" && localCheckpoint.SinceTime != "" {
+		c.sinceTime = localCheckpoint.SinceTime
+		base.InfofCtx(c.ctx, base.KeyReplicate, "replication was reset, starting from time: %s", c.sinceTime)
+	}
+
 	base.InfofCtx(c.ctx, base.KeyReplicate, "using checkpointed seq: %q", checkpointSeq)
 
 	if checkpointSeq == "" {
@@ -494,20 +535,39 @@ func (c *Checkpointer) setLocalCheckpointWithRetry(checkpoint *replicationCheckp
 	)
 }
 
-// resetLocalCheckpoint removes the local checkpoint to roll back the replication.
-func resetLocalCheckpoint(activeDB *Database, checkpointID string) error {
+// resetLocalCheckpoint removes the local checkpoint to roll back the replication.  When sinceTime is set, it's
+// recorded in place of the checkpoint for the replication to restart from.
+func resetLocalCheckpoint(activeDB *Database, checkpointID string, sinceTime string) error {
 	key := RealSpecialDocID(DocTypeLocal, checkpointDocIDPrefix+checkpointID)
 	if err := activeDB.Bucket.Delete(key); err != nil && !base.IsDocNotFoundError(err) {
 		return err
 	}
+	if sinceTime != "" {
+		checkpoint := &replicationCheckpoint{SinceTime: sinceTime}
+		if _, err := activeDB.putSpecial(DocTypeLocal, checkpointDocIDPrefix+checkpointID, "", checkpoint.AsBody()); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// startSequence returns the local sequence to start replicating changes from.
+func (c *Checkpointer) startSequence() (SequenceID, error) {
+	if c.lastCheckpointSeq == "" && c.sinceTime != "" {
+		return c.activeDB.ParseSinceTime(c.sinceTime)
+	}
+	return c.activeDB.ParseSequenceID(c.lastCheckpointSeq)
+}
+
 // getRemoteCheckpoint returns the sequence and rev for the remote checkpoint.
 // if the checkpoint does not exist, returns empty sequence and rev.
 func (c *Checkpointer) getRemoteCheckpoint() (checkpoint *replicationCheckpoint, err error) {
 	base.TracefCtx(c.ctx, base.KeyReplicate, "getRemoteCheckpoint")
 
+	if c.remoteStore != nil {
+		return c.remoteStore.getCheckpoint(c.clientID)
+	}
+
 	rq := GetSGR2CheckpointRequest{
 		Client: c.clientID,
 	}
@@ -532,6 +592,10 @@ func (c *Checkpointer) getRemoteCheckpoint() (checkpoint *replicationCheckpoint,
 func (c *Checkpointer) setRemoteCheckpoint(checkpoint *replicationCheckpoint) (newRev string, err error) {
 	base.TracefCtx(c.ctx, base.KeyReplicate, "setRemoteCheckpoint(%v)", checkpoint)
 
+	if c.remoteStore != nil {
+		return c.remoteStore.setCheckpoint(c.clientID, checkpoint)
+	}
+
 	checkpointBody := checkpoint.AsBody()
 	rq := SetSGR2CheckpointRequest{
 		Client:     c.clientID,
@@ -29,6 +29,7 @@ const (
 // and ActivePullReplicator
 type activeReplicatorCommon struct {
 	config                *ActiveReplicatorConfig
+	direction             ActiveReplicatorDirection // push or pull
 	blipSyncContext       *BlipSyncContext
 	blipSender            *blip.Sender
 	Stats                 expvar.Map
@@ -48,6 +49,8 @@ type activeReplicatorCommon struct {
 	reconnectActive       base.AtomicBool // Tracks whether reconnect goroutine is active
 	replicatorConnectFn   func() error    // the function called inside reconnectLoop.
 	activeSendChanges     base.AtomicBool // Tracks whether sendChanges goroutine is active.
+	couchDBClient         *couchDBClient  // Client for the remote, when replicating using the CouchDB protocol
+	activeCouchDBFeed     base.AtomicBool // Tracks whether the CouchDB protocol replication goroutine is active.
 }
 
 func newActiveReplicatorCommon(config *ActiveReplicatorConfig, direction ActiveReplicatorDirection) *activeReplicatorCommon {
@@ -64,6 +67,7 @@ func newActiveReplicatorCommon(config *ActiveReplicatorConfig, direction ActiveR
 
 	return &activeReplicatorCommon{
 		config:           config,
+		direction:        direction,
 		state:            ReplicationStateStopped,
 		replicationStats: replicationStats,
 		CheckpointID:     config.checkpointPrefix + checkpointID,
@@ -193,6 +197,8 @@ func (a *activeReplicatorCommon) _disconnect() error {
 		a.blipSyncContext = nil
 	}
 
+	a.couchDBClient = nil
+
 	return nil
 }
 
@@ -211,9 +217,11 @@ type ReplicatorCompleteFunc func()
 func (a *activeReplicatorCommon) setError(err error) (passThrough error) {
 	base.InfofCtx(a.ctx, base.KeyReplicate, "ActiveReplicator had error state set with err: %v", err)
 	a.stateErrorLock.Lock()
+	oldState := a.state
 	a.state = ReplicationStateError
 	a.lastError = err
 	a.stateErrorLock.Unlock()
+	a.raiseStateChangeEvent(oldState, ReplicationStateError, err)
 	return err
 }
 
@@ -227,11 +235,29 @@ func (a *activeReplicatorCommon) setLastError(err error) {
 // to be holding a.lock
 func (a *activeReplicatorCommon) setState(state string) {
 	a.stateErrorLock.Lock()
+	oldState := a.state
 	a.state = state
 	if state == ReplicationStateRunning {
 		a.lastError = nil
 	}
+	lastError := a.lastError
 	a.stateErrorLock.Unlock()
+	a.raiseStateChangeEvent(oldState, state, lastError)
+}
+
+// raiseStateChangeEvent raises a ReplicationStateChange event when the state has changed.
+func (a *activeReplicatorCommon) raiseStateChangeEvent(oldState, state string, lastError error) {
+	if oldState == state || a.config.ActiveDB == nil || a.config.ActiveDB.EventMgr == nil {
+		return
+	}
+	lastErrorMessage := ""
+	if lastError != nil {
+		lastErrorMessage = lastError.Error()
+	}
+	err := a.config.ActiveDB.EventMgr.RaiseReplicationStateChangeEvent(a.config.ActiveDB.Name, a.config.ID, a.direction, oldState, state, lastErrorMessage)
+	if err != nil {
+		base.DebugfCtx(a.ctx, base.KeyReplicate, "Unable to raise replication state change event: %v", err)
+	}
 }
 
 func (a *activeReplicatorCommon) getState() string {
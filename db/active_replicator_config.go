@@ -39,6 +39,24 @@ func (d ActiveReplicatorDirection) IsValid() bool {
 	}
 }
 
+// ReplicationProtocol identifies the protocol used by an active replicator to communicate with the remote.
+type ReplicationProtocol string
+
+const (
+	ReplicationProtocolBLIP    ReplicationProtocol = "blip"    // BLIP over websockets, to a Sync Gateway remote
+	ReplicationProtocolCouchDB ReplicationProtocol = "couchdb" // CouchDB replication protocol over HTTP
+)
+
+// IsValid returns true for known protocols.  An empty protocol defaults to BLIP.
+func (p ReplicationProtocol) IsValid() bool {
+	switch p {
+	case "", ReplicationProtocolBLIP, ReplicationProtocolCouchDB:
+		return true
+	default:
+		return false
+	}
+}
+
 // ActiveReplicatorConfig controls the behaviour of the active replicator.
 // TODO: This might be replaced with ReplicatorConfig in the future.
 type ActiveReplicatorConfig struct {
@@ -75,6 +93,8 @@ type ActiveReplicatorConfig struct {
 	ConflictResolutionType ConflictResolverType
 	// Conflict resolver source, for custom conflict resolver.  Required for Equals comparison only
 	ConflictResolverFuncSrc string
+	// Merge policies, for merge conflict resolver.  Required for Equals comparison only
+	MergePolicies MergePolicies
 	// InitialReconnectInterval is the initial time to wait for exponential backoff reconnects.
 	InitialReconnectInterval time.Duration
 	// MaxReconnectInterval is the maximum amount of time to wait between exponential backoff reconnect attempts.
@@ -85,6 +105,9 @@ type ActiveReplicatorConfig struct {
 	// Delta sync enabled
 	DeltasEnabled bool
 
+	// Protocol used to replicate with the remote.  Defaults to BLIP when empty.
+	Protocol ReplicationProtocol
+
 	// InsecureSkipVerify determines whether the TLS certificate verification should be
 	// disabled during replication. TLS certificate verification is enabled by default.
 	InsecureSkipVerify bool
@@ -137,6 +160,9 @@ func (arc ActiveReplicatorConfig) CheckpointHash() (string, error) {
 	if _, err := hash.Write([]byte(arc.RunAs)); err != nil {
 		return "", err
 	}
+	if _, err := hash.Write([]byte(arc.Protocol)); err != nil {
+		return "", err
+	}
 	bucketUUID, err := arc.ActiveDB.Bucket.UUID()
 	if err != nil {
 		return "", err
@@ -206,6 +232,10 @@ func (arc *ActiveReplicatorConfig) Equals(other *ActiveReplicatorConfig) bool {
 		return false
 	}
 
+	if !reflect.DeepEqual(arc.MergePolicies, other.MergePolicies) {
+		return false
+	}
+
 	if arc.InitialReconnectInterval != other.InitialReconnectInterval {
 		return false
 	}
@@ -222,5 +252,9 @@ func (arc *ActiveReplicatorConfig) Equals(other *ActiveReplicatorConfig) bool {
 		return false
 	}
 
+	if arc.Protocol != other.Protocol {
+		return false
+	}
+
 	return true
 }
@@ -0,0 +1,473 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// couchDBLongpollTimeoutMs is the timeout requested for longpoll _changes requests made by continuous pull
+// replications using the CouchDB protocol.
+const couchDBLongpollTimeoutMs = 60000
+
+// _connectCouchDB verifies the remote is reachable and initializes a CouchDB protocol client for the replication.
+func (a *activeReplicatorCommon) _connectCouchDB() (*couchDBClient, error) {
+	a.replicationStats.NumConnectAttempts.Add(1)
+
+	client := newCouchDBClient(a.config.RemoteDBURL, a.config.InsecureSkipVerify)
+	if err := client.checkRemote(a.ctx); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// changesBatchSize returns the number of changes to be requested or sent in a single batch.
+func (a *activeReplicatorCommon) changesBatchSize() int {
+	if a.config.ChangesBatchSize == 0 {
+		return defaultChangesBatchSize
+	}
+	return int(a.config.ChangesBatchSize)
+}
+
+// couchDBFeedFailed handles an error from a running CouchDB protocol replication.  Unless the replication has been
+// stopped, the error is recorded and the replicator falls into a reconnect loop, in the same way as an unexpectedly
+// closed BLIP connection.
+func (a *activeReplicatorCommon) couchDBFeedFailed(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		// replication was disconnected, error is expected
+		return
+	}
+	base.WarnfCtx(a.ctx, "CouchDB protocol replication %s failed, will reconnect: %v", a.config.ID, err)
+	a.setLastError(err)
+	if a.ctx.Err() == nil {
+		a.reconnectActive.Set(true)
+		go a.reconnectLoop()
+	}
+}
+
+// _connectCouchDB starts a pull replication from a CouchDB-compatible remote, using _changes, _revs_diff and
+// _bulk_get.
+func (apr *ActivePullReplicator) _connectCouchDB() error {
+	client, err := apr.activeReplicatorCommon._connectCouchDB()
+	if err != nil {
+		return err
+	}
+	apr.couchDBClient = client
+
+	// wrap the replicator context with a cancelFunc that can be called to abort the checkpointer from _disconnect
+	apr.checkpointerCtx, apr.checkpointerCtxCancel = context.WithCancel(apr.ctx)
+	if err := apr._initCheckpointer(); err != nil {
+		apr.checkpointerCtx = nil
+		apr.couchDBClient = nil
+		return err
+	}
+
+	var conflictResolver *ConflictResolver
+	if apr.config.ConflictResolverFunc != nil {
+		conflictResolver = NewConflictResolver(apr.config.ConflictResolverFunc, apr.config.ReplicationStatsMap)
+		conflictResolver.includeAncestor = apr.config.ConflictResolutionType == ConflictResolverMerge
+	}
+
+	apr.activeCouchDBFeed.Set(true)
+	go apr.pullCouchDBChanges(apr.checkpointerCtx, client, apr.Checkpointer, conflictResolver)
+
+	apr.setState(ReplicationStateRunning)
+	return nil
+}
+
+// changesQuery returns the _changes query parameters for the replication's filter and options.
+func (apr *ActivePullReplicator) changesQuery() url.Values {
+	query := url.Values{}
+	query.Set("style", "all_docs")
+	query.Set("limit", strconv.Itoa(apr.changesBatchSize()))
+	if apr.config.Continuous {
+		query.Set("feed", "longpoll")
+		query.Set("timeout", strconv.Itoa(couchDBLongpollTimeoutMs))
+	} else {
+		query.Set("feed", "normal")
+	}
+	if apr.config.ActiveOnly {
+		query.Set("active_only", "true")
+	}
+	if len(apr.config.DocIDs) > 0 {
+		docIDs, _ := base.JSONMarshal(apr.config.DocIDs)
+		query.Set("filter", "_doc_ids")
+		query.Set("doc_ids", string(docIDs))
+	} else if apr.config.Filter == base.ByChannelFilter {
+		query.Set("filter", base.ByChannelFilter)
+		query.Set("channels", strings.Join(apr.config.FilterChannels, ","))
+	}
+	return query
+}
+
+// pullCouchDBChanges requests pages of changes from the remote until the replication is stopped, or a one-shot
+// replication has caught up.  The checkpoint is advanced to the last_seq of each page once its revisions have been
+// written.
+func (apr *ActivePullReplicator) pullCouchDBChanges(ctx context.Context, client *couchDBClient, checkpointer *Checkpointer, conflictResolver *ConflictResolver) {
+	defer apr.activeCouchDBFeed.Set(false)
+
+	since := checkpointer.lastCheckpointSeq
+	query := apr.changesQuery()
+	batchSize := apr.changesBatchSize()
+	if since == "" && checkpointer.sinceTime != "" {
+		// Remotes other than Sync Gateway ignore since_time, and replicate from zero
+		query.Set("since_time", checkpointer.sinceTime)
+	}
+	base.InfofCtx(apr.ctx, base.KeyReplicate, "Pulling changes from CouchDB protocol remote since %q", since)
+	for {
+		changes, err := client.changes(ctx, since, query)
+		if err != nil {
+			apr.couchDBFeedFailed(ctx, err)
+			return
+		}
+
+		if err := apr.pullCouchDBRevisions(ctx, client, changes.Results, conflictResolver); err != nil {
+			apr.couchDBFeedFailed(ctx, err)
+			return
+		}
+
+		if changes.LastSeq != "" {
+			since = changes.LastSeq
+			query.Del("since_time")
+			checkpointer.SetProcessedSeq(since)
+		}
+
+		if !apr.config.Continuous && len(changes.Results) < batchSize {
+			apr.Complete()
+			return
+		}
+	}
+}
+
+// pullCouchDBRevisions retrieves the revisions in the given changes that are missing locally, and writes them to the
+// active database.  Returns an error if any revision other than one missing on the remote couldn't be written.
+func (apr *ActivePullReplicator) pullCouchDBRevisions(ctx context.Context, client *couchDBClient, changes []couchDBChange, conflictResolver *ConflictResolver) error {
+	activeDB := apr.config.ActiveDB
+	items := make([]couchDBBulkGetItem, 0)
+	for _, change := range changes {
+		// Removals are only sent by Sync Gateway remotes, and don't carry a revision body to be pulled
+		if strings.HasPrefix(change.ID, "_") || len(change.Removed) > 0 {
+			continue
+		}
+		revIDs := make([]string, 0, len(change.Changes))
+		for _, item := range change.Changes {
+			revIDs = append(revIDs, item.Rev)
+		}
+		apr.replicationStats.HandleChangesCount.Add(int64(len(revIDs)))
+
+		missing, possible := activeDB.RevDiff(change.ID, revIDs)
+		for _, revID := range missing {
+			items = append(items, couchDBBulkGetItem{ID: change.ID, Rev: revID, AttsSince: possible})
+		}
+	}
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	results, err := client.bulkGet(ctx, items)
+	if err != nil {
+		return err
+	}
+
+	// Revisions the remote no longer has are skipped.  Any other failure is returned once the rest of the page has been
+	// written, so that the checkpoint isn't advanced past it and the page is retried on reconnect.
+	var firstErr error
+	for _, result := range results {
+		if result.Err == nil {
+			result.Err = apr.putCouchDBRevision(result.Body, conflictResolver)
+		}
+		if result.Err != nil {
+			apr.replicationStats.HandleRevErrorCount.Add(1)
+			base.InfofCtx(apr.ctx, base.KeyReplicate, "Unable to pull doc %s/%s: %v", base.UD(result.DocID), result.RevID, result.Err)
+			if status, _ := base.ErrorAsHTTPStatus(result.Err); status != http.StatusNotFound && firstErr == nil {
+				firstErr = fmt.Errorf("unable to pull doc %s/%s: %w", base.UD(result.DocID), result.RevID, result.Err)
+			}
+			continue
+		}
+		apr.replicationStats.HandleRevCount.Add(1)
+	}
+	return firstErr
+}
+
+// putCouchDBRevision writes a revision retrieved via _bulk_get to the active database, resolving any conflict with
+// the replication's conflict resolver.
+func (apr *ActivePullReplicator) putCouchDBRevision(body Body, conflictResolver *ConflictResolver) error {
+	docID, _ := body[BodyId].(string)
+	history := ParseRevisions(body)
+	if docID == "" || len(history) == 0 {
+		return base.HTTPErrorf(http.StatusBadRequest, "Revision retrieved from remote is missing _id or _rev")
+	}
+
+	newDoc := &Document{
+		ID:      docID,
+		Deleted: body.ExtractDeleted(),
+	}
+	delete(body, BodyId)
+	delete(body, BodyRev)
+	delete(body, BodyRevisions)
+	newDoc.DocAttachments = GetBodyAttachments(body)
+	delete(body, BodyAttachments)
+	newDoc.UpdateBody(body)
+
+	db := apr.config.ActiveDB
+	var err error
+	if conflictResolver != nil {
+		_, _, err = db.PutExistingRevWithConflictResolution(newDoc, history, true, conflictResolver, newDoc.Deleted, nil)
+	} else {
+		_, _, err = db.PutExistingRev(newDoc, history, false, newDoc.Deleted, nil)
+	}
+	return err
+}
+
+// _connectCouchDB starts a push replication to a CouchDB-compatible remote, using _revs_diff and _bulk_docs.
+func (apr *ActivePushReplicator) _connectCouchDB() error {
+	client, err := apr.activeReplicatorCommon._connectCouchDB()
+	if err != nil {
+		return err
+	}
+	apr.couchDBClient = client
+
+	// wrap the replicator context with a cancelFunc that can be called to abort the checkpointer from _disconnect
+	apr.checkpointerCtx, apr.checkpointerCtxCancel = context.WithCancel(apr.ctx)
+	if err := apr._initCheckpointer(); err != nil {
+		apr.checkpointerCtx = nil
+		apr.couchDBClient = nil
+		return err
+	}
+
+	if err := apr.deadLetters.load(); err != nil {
+		base.WarnfCtx(apr.ctx, "Unable to load dead letter queue for replication %s: %v", apr.config.ID, err)
+	}
+
+	since, err := apr.Checkpointer.startSequence()
+	if err != nil {
+		base.WarnfCtx(apr.ctx, "couldn't parse checkpointed sequence ID, starting push from seq:0")
+	}
+
+	apr.activeCouchDBFeed.Set(true)
+	go apr.pushCouchDBChanges(apr.checkpointerCtx, client, apr.Checkpointer, since)
+
+	apr.setState(ReplicationStateRunning)
+	return nil
+}
+
+// pushCouchDBChanges sends local changes to the remote in batches until the replication is stopped, or a one-shot
+// replication has caught up.  The checkpoint is advanced to the last sequence of each batch once it has been sent.
+func (apr *ActivePushReplicator) pushCouchDBChanges(ctx context.Context, client *couchDBClient, checkpointer *Checkpointer, since SequenceID) {
+	defer apr.activeCouchDBFeed.Set(false)
+
+	terminator := make(chan bool)
+	go func() {
+		<-ctx.Done()
+		close(terminator)
+	}()
+
+	options := ChangesOptions{
+		Since:      since,
+		Conflicts:  true, // The CouchDB protocol supports branched rev trees, so all leaf revisions are pushed
+		Continuous: apr.config.Continuous,
+		ActiveOnly: apr.config.ActiveOnly,
+		Terminator: terminator,
+		Ctx:        apr.ctx,
+	}
+
+	channelSet := base.SetOf(channels.AllChannelWildcard)
+	if apr.config.FilterChannels != nil {
+		channelSet = base.SetFromArray(apr.config.FilterChannels)
+	}
+
+	batchSize := apr.changesBatchSize()
+	pending := make([]*ChangeEntry, 0, batchSize)
+	sendPending := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		if err := apr.pushCouchDBRevisions(ctx, client, pending); err != nil {
+			return err
+		}
+		checkpointer.SetProcessedSeq(pending[len(pending)-1].Seq.String())
+		pending = make([]*ChangeEntry, 0, batchSize)
+		return nil
+	}
+
+	base.InfofCtx(apr.ctx, base.KeyReplicate, "Pushing changes to CouchDB protocol remote since %v", since)
+	err, forceClose := GenerateChanges(ctx, apr.config.ActiveDB, channelSet, options, apr.config.DocIDs, func(changes []*ChangeEntry) error {
+		pending = append(pending, changes...)
+		// An empty set of changes indicates the feed has caught up
+		if len(pending) >= batchSize || len(changes) == 0 {
+			return sendPending()
+		}
+		return nil
+	})
+	if err == nil && !forceClose {
+		err = sendPending()
+	}
+	if err != nil {
+		apr.couchDBFeedFailed(ctx, err)
+		return
+	}
+
+	if !forceClose {
+		apr.Complete()
+	}
+}
+
+// pushCouchDBRevisions sends the revisions in the given changes that are missing on the remote.  Revisions rejected by
+// the remote are added to the dead letter queue.
+func (apr *ActivePushReplicator) pushCouchDBRevisions(ctx context.Context, client *couchDBClient, changes []*ChangeEntry) error {
+	revs := make(map[string][]string)
+	seqs := make(map[IDAndRev]string)
+	for _, change := range changes {
+		if strings.HasPrefix(change.ID, "_") {
+			continue
+		}
+		for _, item := range change.Changes {
+			revs[change.ID] = append(revs[change.ID], item["rev"])
+			seqs[IDAndRev{DocID: change.ID, RevID: item["rev"]}] = change.Seq.String()
+		}
+	}
+	return apr.pushCouchDBRevs(ctx, client, revs, seqs)
+}
+
+// pushCouchDBRevs offers the given revisions to the remote via _revs_diff, and writes any that are missing with
+// _bulk_docs.  seqs optionally maps each revision to its local sequence, for dead letter entries.
+func (apr *ActivePushReplicator) pushCouchDBRevs(ctx context.Context, client *couchDBClient, revs map[string][]string, seqs map[IDAndRev]string) error {
+	if len(revs) == 0 {
+		return nil
+	}
+	for _, revIDs := range revs {
+		apr.replicationStats.SendChangesCount.Add(int64(len(revIDs)))
+	}
+
+	diff, err := client.revsDiff(ctx, revs)
+	if err != nil {
+		return err
+	}
+
+	activeDB := apr.config.ActiveDB
+	docs := make([]Body, 0)
+	sent := make([]IDAndRev, 0)
+	for docID, docDiff := range diff {
+		attsSince := docDiff.PossibleAncestors
+		if attsSince == nil {
+			attsSince = []string{}
+		}
+		for _, revID := range docDiff.Missing {
+			body, err := activeDB.Get1xRevBodyWithHistory(docID, revID, math.MaxInt32, docDiff.PossibleAncestors, attsSince, false)
+			if err != nil {
+				apr.replicationStats.SendRevErrorTotal.Add(1)
+				base.InfofCtx(apr.ctx, base.KeyReplicate, "Unable to retrieve doc %s/%s to push: %v", base.UD(docID), revID, err)
+				continue
+			}
+			docs = append(docs, body)
+			sent = append(sent, IDAndRev{DocID: docID, RevID: revID})
+		}
+	}
+
+	if len(docs) == 0 {
+		return nil
+	}
+
+	statuses, err := client.bulkDocs(ctx, docs)
+	if err != nil {
+		return err
+	}
+
+	failures := bulkDocsFailures(sent, statuses)
+	for _, idAndRev := range sent {
+		status, failed := failures[idAndRev]
+		if !failed {
+			apr.replicationStats.SendRevCount.Add(1)
+			apr.removeDeadLetter(idAndRev.DocID)
+			continue
+		}
+
+		apr.replicationStats.SendRevErrorTotal.Add(1)
+		base.InfofCtx(apr.ctx, base.KeyReplicate, "Remote rejected doc %s/%s: %s %s", base.UD(idAndRev.DocID), idAndRev.RevID, status.Error, base.UD(status.Reason))
+		statusCode := status.statusCode()
+		switch statusCode {
+		case http.StatusConflict:
+			// Conflicts aren't treated as dead letters, as they'll be resolved by the pull side of the replication
+			apr.replicationStats.SendRevErrorConflictCount.Add(1)
+			continue
+		case http.StatusForbidden:
+			apr.replicationStats.SendRevErrorRejectedCount.Add(1)
+		default:
+			apr.replicationStats.SendRevErrorOtherCount.Add(1)
+		}
+		apr.addDeadLetter(DeadLetterEntry{
+			DocID:        idAndRev.DocID,
+			RevID:        idAndRev.RevID,
+			Seq:          seqs[idAndRev],
+			ErrorDomain:  "HTTP",
+			ErrorCode:    strconv.Itoa(statusCode),
+			ErrorMessage: fmt.Sprintf("%s: %s", status.Error, status.Reason),
+		})
+	}
+	return nil
+}
+
+// bulkDocsFailures returns the _bulk_docs statuses of the sent revisions that failed.  CouchDB only reports documents
+// that failed when new_edits=false, and may omit the revision, in which case all revisions sent for the document are
+// treated as failed.  Sync Gateway reports all documents, with their revisions.
+func bulkDocsFailures(sent []IDAndRev, statuses []couchDBDocStatus) map[IDAndRev]couchDBDocStatus {
+	failures := make(map[IDAndRev]couchDBDocStatus)
+	for _, status := range statuses {
+		if status.Error == "" {
+			continue
+		}
+		if status.Rev != "" {
+			failures[IDAndRev{DocID: status.ID, RevID: status.Rev}] = status
+			continue
+		}
+		for _, idAndRev := range sent {
+			if idAndRev.DocID == status.ID {
+				failures[idAndRev] = status
+			}
+		}
+	}
+	return failures
+}
+
+// retryDeadLettersCouchDB re-sends the current revision of the requested documents in the dead letter queue to a
+// CouchDB protocol remote.  Returns the number of documents re-sent.
+func (apr *ActivePushReplicator) retryDeadLettersCouchDB(client *couchDBClient, entries []*DeadLetterEntry, requested base.Set) (retried int, err error) {
+	revs := make(map[string][]string)
+	for _, entry := range entries {
+		if requested != nil && !requested.Contains(entry.DocID) {
+			continue
+		}
+		doc, err := apr.config.ActiveDB.GetDocument(entry.DocID, DocUnmarshalSync)
+		if err != nil {
+			base.InfofCtx(apr.ctx, base.KeyReplicate, "Unable to retrieve doc %s for dead letter retry, skipping: %v", base.UD(entry.DocID), err)
+			continue
+		}
+		revs[doc.ID] = []string{doc.CurrentRev}
+	}
+
+	if err := apr.pushCouchDBRevs(apr.ctx, client, revs, nil); err != nil {
+		return 0, err
+	}
+	retried = len(revs)
+
+	base.InfofCtx(apr.ctx, base.KeyReplicate, "Retried %d documents from dead letter queue for replication %s", retried, apr.config.ID)
+	return retried, nil
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkDocsFailures(t *testing.T) {
+	sent := []IDAndRev{
+		{DocID: "doc1", RevID: "1-a"},
+		{DocID: "doc2", RevID: "1-b"},
+		{DocID: "doc3", RevID: "2-c"},
+	}
+
+	// CouchDB only reports the failures, without revisions, so statuses don't line up with the sent revisions
+	failures := bulkDocsFailures(sent, []couchDBDocStatus{
+		{ID: "doc3", Error: "forbidden", Reason: "rejected"},
+	})
+	assert.Len(t, failures, 1)
+	assert.Equal(t, "forbidden", failures[IDAndRev{DocID: "doc3", RevID: "2-c"}].Error)
+
+	// Sync Gateway reports every document, with its revision
+	failures = bulkDocsFailures(sent, []couchDBDocStatus{
+		{ID: "doc1", Rev: "1-a"},
+		{ID: "doc2", Rev: "1-b", Error: "conflict"},
+		{ID: "doc3", Rev: "2-c"},
+	})
+	assert.Len(t, failures, 1)
+	assert.Equal(t, "conflict", failures[IDAndRev{DocID: "doc2", RevID: "1-b"}].Error)
+}
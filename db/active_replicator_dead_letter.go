@@ -0,0 +1,251 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// maxDeadLetterDocBytes bounds the size of a replication's dead letter document.  The whole document is rewritten
+	// for every failure, so this is well below the 20MB maximum document size.  At around 200 bytes for a typical
+	// entry this holds ~10000 entries, or ~1500 entries with the longest doc IDs and error messages.
+	maxDeadLetterDocBytes = 2 * 1024 * 1024
+
+	// maxDeadLetterErrorMessageLength is the number of bytes of the remote's error response kept in an entry.
+	maxDeadLetterErrorMessageLength = 1024
+)
+
+// DeadLetterEntry records a revision that was pushed to the remote but rejected by it (e.g. a 403 from the remote's
+// sync function, or a failure to handle the revision's attachments).
+type DeadLetterEntry struct {
+	DocID        string    `json:"doc_id"`
+	RevID        string    `json:"rev_id"`
+	Seq          string    `json:"seq,omitempty"`
+	ErrorDomain  string    `json:"error_domain,omitempty"`
+	ErrorCode    string    `json:"error_code"`
+	ErrorMessage string    `json:"error_message,omitempty"`
+	Attempts     int       `json:"attempts"`
+	FirstFailure time.Time `json:"first_failure"`
+	LastFailure  time.Time `json:"last_failure"`
+}
+
+// deadLetterDoc is the persisted form of a replication's dead letter queue, keyed by doc ID.  Only the most recent
+// failed revision is retained for each document.
+type deadLetterDoc struct {
+	Entries map[string]*DeadLetterEntry `json:"entries"`
+}
+
+// deadLetterQueue is the per-replication store of revisions rejected by the remote.  Entries are persisted in a single
+// _sync:sgrDLQ document so that they can be inspected and discarded from any node, and survive replication restarts.
+type deadLetterQueue struct {
+	bucket base.Bucket
+	key    string
+	stat   *base.SgwIntStat // Gauge tracking the number of entries in the queue, may be nil
+	lock   sync.RWMutex     // lock guards docIDs
+	docIDs map[string]struct{}
+}
+
+// deadLetterQueueKey returns the key of the document used to store the dead letter queue for the given replication.
+// Follows the same hashing approach as replicationStatusKey for long replication IDs.
+func deadLetterQueueKey(checkpointPrefix, replicationID string) string {
+	keyID := replicationID
+	if len(keyID) >= 40 {
+		keyID = base.Sha1HashString(replicationID, "")
+	}
+	return base.SGRDeadLetterPrefix + checkpointPrefix + keyID
+}
+
+func newDeadLetterQueue(bucket base.Bucket, key string, stat *base.SgwIntStat) *deadLetterQueue {
+	return &deadLetterQueue{
+		bucket: bucket,
+		key:    key,
+		stat:   stat,
+		docIDs: make(map[string]struct{}),
+	}
+}
+
+// load populates the in-memory doc ID index from the persisted queue.
+func (q *deadLetterQueue) load() error {
+	doc, err := q.getDoc()
+	if err != nil {
+		return err
+	}
+	q.setDocIDs(doc)
+	return nil
+}
+
+// contains returns true if the given doc ID is known to have an entry in the queue.  Used to avoid a bucket read
+// for every revision that is successfully pushed.
+func (q *deadLetterQueue) contains(docID string) bool {
+	q.lock.RLock()
+	_, ok := q.docIDs[docID]
+	q.lock.RUnlock()
+	return ok
+}
+
+// add records a failed revision, replacing any existing entry for the same document.
+func (q *deadLetterQueue) add(entry DeadLetterEntry) error {
+	if entry.LastFailure.IsZero() {
+		entry.LastFailure = time.Now().UTC()
+	}
+	entry.ErrorMessage = truncateUTF8(entry.ErrorMessage, maxDeadLetterErrorMessageLength)
+	return q.update(func(doc *deadLetterDoc) bool {
+		existing, ok := doc.Entries[entry.DocID]
+		if ok {
+			entry.Attempts = existing.Attempts + 1
+			entry.FirstFailure = existing.FirstFailure
+			if entry.Seq == "" {
+				entry.Seq = existing.Seq
+			}
+		} else {
+			entry.Attempts = 1
+			entry.FirstFailure = entry.LastFailure
+		}
+		doc.Entries[entry.DocID] = &entry
+		return true
+	})
+}
+
+// remove deletes the entries for the given doc IDs, or all entries when no doc IDs are specified.  Returns the number
+// of entries removed.
+func (q *deadLetterQueue) remove(docIDs ...string) (removed int, err error) {
+	err = q.update(func(doc *deadLetterDoc) bool {
+		removed = 0 // reset in case the update is retried
+		if len(docIDs) == 0 {
+			removed = len(doc.Entries)
+			doc.Entries = map[string]*DeadLetterEntry{}
+			return removed > 0
+		}
+		for _, docID := range docIDs {
+			if _, ok := doc.Entries[docID]; ok {
+				delete(doc.Entries, docID)
+				removed++
+			}
+		}
+		return removed > 0
+	})
+	return removed, err
+}
+
+// list returns all entries in the queue, ordered by doc ID.
+func (q *deadLetterQueue) list() ([]*DeadLetterEntry, error) {
+	doc, err := q.getDoc()
+	if err != nil {
+		return nil, err
+	}
+	q.setDocIDs(doc)
+
+	entries := make([]*DeadLetterEntry, 0, len(doc.Entries))
+	for _, entry := range doc.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DocID < entries[j].DocID
+	})
+	return entries, nil
+}
+
+// get returns the entry for the given doc ID, or a 404 error if the document isn't in the queue.
+func (q *deadLetterQueue) get(docID string) (*DeadLetterEntry, error) {
+	doc, err := q.getDoc()
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := doc.Entries[docID]
+	if !ok {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Dead letter entry not found")
+	}
+	return entry, nil
+}
+
+func (q *deadLetterQueue) getDoc() (*deadLetterDoc, error) {
+	doc := &deadLetterDoc{}
+	_, err := q.bucket.Get(q.key, doc)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	if doc.Entries == nil {
+		doc.Entries = map[string]*DeadLetterEntry{}
+	}
+	return doc, nil
+}
+
+// update applies updateFn to the persisted queue with CAS handling.  When updateFn returns false the write is
+// cancelled.  The persisted document is removed once the last entry has been removed.
+func (q *deadLetterQueue) update(updateFn func(doc *deadLetterDoc) (updated bool)) error {
+	var updatedDoc *deadLetterDoc
+	_, err := q.bucket.Update(q.key, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		doc := &deadLetterDoc{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, doc); err != nil {
+				return nil, nil, false, fmt.Errorf("unable to unmarshal dead letter queue %s: %w", q.key, err)
+			}
+		}
+		if doc.Entries == nil {
+			doc.Entries = map[string]*DeadLetterEntry{}
+		}
+		if !updateFn(doc) {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		updatedDoc = doc
+		if len(doc.Entries) == 0 {
+			return nil, nil, true, nil
+		}
+		docBytes, err := base.JSONMarshal(doc)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(docBytes) > maxDeadLetterDocBytes && len(docBytes) > len(current) {
+			base.Warnf("Dead letter queue %s is full (%d entries) - not recording failure", base.MD(q.key), len(doc.Entries))
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		return docBytes, nil, false, nil
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	q.setDocIDs(updatedDoc)
+	return nil
+}
+
+func (q *deadLetterQueue) setDocIDs(doc *deadLetterDoc) {
+	q.lock.Lock()
+	q.docIDs = make(map[string]struct{}, len(doc.Entries))
+	for docID := range doc.Entries {
+		q.docIDs[docID] = struct{}{}
+	}
+	q.lock.Unlock()
+	if q.stat != nil {
+		q.stat.Set(int64(len(doc.Entries)))
+	}
+}
+
+// truncateUTF8 returns s truncated to at most maxBytes, without splitting a multi-byte character.
+func truncateUTF8(s string, maxBytes int) string {
+	if len(s) <= maxBytes {
+		return s
+	}
+	for maxBytes > 0 && !utf8.RuneStart(s[maxBytes]) {
+		maxBytes--
+	}
+	return s[:maxBytes]
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLetterQueue(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	stat := &base.SgwIntStat{}
+	queue := newDeadLetterQueue(bucket, deadLetterQueueKey("", t.Name()), stat)
+	require.NoError(t, queue.load())
+	assert.False(t, queue.contains("doc1"))
+
+	entries, err := queue.list()
+	require.NoError(t, err)
+	assert.Len(t, entries, 0)
+
+	require.NoError(t, queue.add(DeadLetterEntry{DocID: "doc2", RevID: "1-abc", Seq: "5", ErrorDomain: "HTTP", ErrorCode: "403"}))
+	require.NoError(t, queue.add(DeadLetterEntry{DocID: "doc1", RevID: "1-abc", Seq: "3", ErrorDomain: "HTTP", ErrorCode: "403"}))
+	assert.True(t, queue.contains("doc1"))
+	assert.Equal(t, int64(2), stat.Value())
+
+	// A subsequent failure for the same doc replaces the revision and increments attempts
+	require.NoError(t, queue.add(DeadLetterEntry{DocID: "doc1", RevID: "2-def", ErrorDomain: "HTTP", ErrorCode: "500"}))
+	entry, err := queue.get("doc1")
+	require.NoError(t, err)
+	assert.Equal(t, "2-def", entry.RevID)
+	assert.Equal(t, "500", entry.ErrorCode)
+	assert.Equal(t, "3", entry.Seq)
+	assert.Equal(t, 2, entry.Attempts)
+	assert.False(t, entry.FirstFailure.After(entry.LastFailure))
+
+	entries, err = queue.list()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "doc1", entries[0].DocID)
+	assert.Equal(t, "doc2", entries[1].DocID)
+
+	// A second queue for the same replication (e.g. on another node) sees the persisted entries
+	otherQueue := newDeadLetterQueue(bucket, deadLetterQueueKey("", t.Name()), nil)
+	require.NoError(t, otherQueue.load())
+	assert.True(t, otherQueue.contains("doc2"))
+
+	removed, err := queue.remove("doc1", "unknown")
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, queue.contains("doc1"))
+	assert.Equal(t, int64(1), stat.Value())
+
+	_, err = queue.get("doc1")
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// Removing the last entry removes the document
+	removed, err = queue.remove()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, int64(0), stat.Value())
+	_, _, err = bucket.GetRaw(deadLetterQueueKey("", t.Name()))
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestDeadLetterQueueErrorMessageTruncated(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	queue := newDeadLetterQueue(bucket, deadLetterQueueKey("", t.Name()), nil)
+	require.NoError(t, queue.add(DeadLetterEntry{DocID: "doc1", RevID: "1-abc", ErrorCode: "500", ErrorMessage: strings.Repeat("é", maxDeadLetterErrorMessageLength)}))
+	entry, err := queue.get("doc1")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("é", maxDeadLetterErrorMessageLength/2), entry.ErrorMessage)
+
+	assert.Equal(t, "ab", truncateUTF8("abé", 3))
+	assert.Equal(t, "abé", truncateUTF8("abé", 4))
+}
+
+func TestDeadLetterQueueKey(t *testing.T) {
+	assert.Equal(t, base.SGRDeadLetterPrefix+"repl1", deadLetterQueueKey("", "repl1"))
+	assert.Equal(t, base.SGRDeadLetterPrefix+"group:repl1", deadLetterQueueKey("group:", "repl1"))
+
+	longID := strings.Repeat("a", 50)
+	assert.Equal(t, base.SGRDeadLetterPrefix+base.Sha1HashString(longID, ""), deadLetterQueueKey("", longID))
+}
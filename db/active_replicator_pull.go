@@ -28,6 +28,9 @@ func NewPullReplicator(config *ActiveReplicatorConfig) *ActivePullReplicator {
 		activeReplicatorCommon: newActiveReplicatorCommon(config, ActiveReplicatorTypePull),
 	}
 	apr.replicatorConnectFn = apr._connect
+	if config.Protocol == ReplicationProtocolCouchDB {
+		apr.replicatorConnectFn = apr._connectCouchDB
+	}
 	return &apr
 }
 
@@ -47,7 +50,7 @@ func (apr *ActivePullReplicator) Start() error {
 	logCtx := context.WithValue(context.Background(), base.LogContextKey{}, base.LogContext{CorrelationID: apr.config.ID + "-" + string(ActiveReplicatorTypePull)})
 	apr.ctx, apr.ctxCancel = context.WithCancel(logCtx)
 
-	err := apr._connect()
+	err := apr.replicatorConnectFn()
 	if err != nil {
 		_ = apr.setError(err)
 		base.WarnfCtx(apr.ctx, "Couldn't connect. Attempting to reconnect in background: %v", err)
@@ -67,6 +70,7 @@ func (apr *ActivePullReplicator) _connect() error {
 
 	if apr.config.ConflictResolverFunc != nil {
 		apr.blipSyncContext.conflictResolver = NewConflictResolver(apr.config.ConflictResolverFunc, apr.config.ReplicationStatsMap)
+		apr.blipSyncContext.conflictResolver.includeAncestor = apr.config.ConflictResolutionType == ConflictResolverMerge
 	}
 	apr.blipSyncContext.purgeOnRemoval = apr.config.PurgeOnRemoval
 
@@ -84,6 +88,7 @@ func (apr *ActivePullReplicator) _connect() error {
 		Continuous:     apr.config.Continuous,
 		Batch:          apr.config.ChangesBatchSize,
 		Since:          apr.Checkpointer.lastCheckpointSeq,
+		SinceTime:      apr.Checkpointer.sinceTime,
 		Filter:         apr.config.Filter,
 		FilterChannels: apr.config.FilterChannels,
 		DocIDs:         apr.config.DocIDs,
@@ -103,7 +108,7 @@ func (apr *ActivePullReplicator) _connect() error {
 
 	apr.setState(ReplicationStateRunning)
 
-	if apr.blipSyncContext.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV2 && apr.config.PurgeOnRemoval {
+	if apr.blipSyncContext.activeSubprotocol() == BlipCBMobileReplicationV2 && apr.config.PurgeOnRemoval {
 		base.ErrorfCtx(apr.config.ActiveDB.Ctx, "Pull replicator ID:%s running with revocations enabled but target does not support revocations. Sync Gateway 3.0 required.", apr.config.ID)
 	}
 
@@ -152,6 +157,9 @@ func (apr *ActivePullReplicator) _initCheckpointer() error {
 	}
 
 	apr.Checkpointer = NewCheckpointer(apr.checkpointerCtx, apr.CheckpointID, checkpointHash, apr.blipSender, apr.config, apr.getPullStatus)
+	if apr.couchDBClient != nil {
+		apr.Checkpointer.remoteStore = apr.couchDBClient
+	}
 
 	var err error
 	apr.initialStatus, err = apr.Checkpointer.fetchCheckpoints()
@@ -160,7 +168,9 @@ func (apr *ActivePullReplicator) _initCheckpointer() error {
 		return err
 	}
 
-	apr.registerCheckpointerCallbacks()
+	if apr.blipSyncContext != nil {
+		apr.registerCheckpointerCallbacks()
+	}
 	apr.Checkpointer.Start()
 
 	return nil
@@ -198,11 +208,13 @@ func (apr *ActivePullReplicator) getPullStatus(lastSeqPulled string) *Replicatio
 	return status
 }
 
-func (apr *ActivePullReplicator) reset() error {
+// reset performs a reset on the replication by removing the local checkpoint document.  When sinceTime is set, the
+// replication restarts from the remote's changes since that time instead of from zero.
+func (apr *ActivePullReplicator) reset(sinceTime string) error {
 	if apr.state != ReplicationStateStopped {
 		return fmt.Errorf("reset invoked for replication %s when the replication was not stopped", apr.config.ID)
 	}
-	if err := resetLocalCheckpoint(apr.config.ActiveDB, apr.CheckpointID); err != nil {
+	if err := resetLocalCheckpoint(apr.config.ActiveDB, apr.CheckpointID, sinceTime); err != nil {
 		return err
 	}
 
@@ -230,13 +242,13 @@ func (apr *ActivePullReplicator) registerCheckpointerCallbacks() {
 	}
 }
 
-// Stop stops the pull replication and waits for the sub changes goroutine to finish.
+// Stop stops the pull replication and waits for the sub changes (or CouchDB protocol changes) goroutine to finish.
 func (apr *ActivePullReplicator) Stop() error {
 	if err := apr.stopAndDisconnect(); err != nil {
 		return err
 	}
 	teardownStart := time.Now()
-	for (apr.blipSyncContext != nil && apr.blipSyncContext.activeSubChanges.IsTrue()) &&
+	for ((apr.blipSyncContext != nil && apr.blipSyncContext.activeSubChanges.IsTrue()) || apr.activeCouchDBFeed.IsTrue()) &&
 		(time.Since(teardownStart) < time.Second*10) {
 		time.Sleep(10 * time.Millisecond)
 	}
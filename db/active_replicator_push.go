@@ -14,6 +14,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -25,6 +26,7 @@ import (
 // ActivePushReplicator is a unidirectional push active replicator.
 type ActivePushReplicator struct {
 	*activeReplicatorCommon
+	deadLetters *deadLetterQueue // revisions rejected by the remote
 }
 
 func NewPushReplicator(config *ActiveReplicatorConfig) *ActivePushReplicator {
@@ -32,6 +34,15 @@ func NewPushReplicator(config *ActiveReplicatorConfig) *ActivePushReplicator {
 		activeReplicatorCommon: newActiveReplicatorCommon(config, ActiveReplicatorTypePush),
 	}
 	apr.replicatorConnectFn = apr._connect
+	if config.Protocol == ReplicationProtocolCouchDB {
+		apr.replicatorConnectFn = apr._connectCouchDB
+	}
+
+	var deadLetterStat *base.SgwIntStat
+	if config.ReplicationStatsMap != nil {
+		deadLetterStat = config.ReplicationStatsMap.DeadLetterCount
+	}
+	apr.deadLetters = newDeadLetterQueue(config.ActiveDB.Bucket, deadLetterQueueKey(config.checkpointPrefix, config.ID), deadLetterStat)
 	return &apr
 }
 
@@ -51,7 +62,7 @@ func (apr *ActivePushReplicator) Start() error {
 	logCtx := context.WithValue(context.Background(), base.LogContextKey{}, base.LogContext{CorrelationID: apr.config.ID + "-" + string(ActiveReplicatorTypePush)})
 	apr.ctx, apr.ctxCancel = context.WithCancel(logCtx)
 
-	err := apr._connect()
+	err := apr.replicatorConnectFn()
 	if err != nil {
 		_ = apr.setError(err)
 		base.WarnfCtx(apr.ctx, "Couldn't connect. Attempting to reconnect in background: %v", err)
@@ -85,13 +96,19 @@ func (apr *ActivePushReplicator) _connect() error {
 		return err
 	}
 
+	if err := apr.deadLetters.load(); err != nil {
+		base.WarnfCtx(apr.ctx, "Unable to load dead letter queue for replication %s: %v", apr.config.ID, err)
+	}
+	apr.blipSyncContext.sgr2PushRevFailedCallback = apr.addDeadLetter
+	apr.blipSyncContext.sgr2PushRevSucceededCallback = apr.removeDeadLetter
+
 	bh := blipHandler{
 		BlipSyncContext: apr.blipSyncContext,
 		db:              apr.config.ActiveDB,
 		serialNumber:    apr.blipSyncContext.incrementSerialNumber(),
 	}
 
-	seq, err := apr.config.ActiveDB.ParseSequenceID(apr.Checkpointer.lastCheckpointSeq)
+	seq, err := apr.Checkpointer.startSequence()
 	if err != nil {
 		base.WarnfCtx(apr.ctx, "couldn't parse checkpointed sequence ID, starting push from seq:0")
 	}
@@ -187,6 +204,9 @@ func (apr *ActivePushReplicator) _initCheckpointer() error {
 		return hashErr
 	}
 	apr.Checkpointer = NewCheckpointer(apr.checkpointerCtx, apr.CheckpointID, checkpointHash, apr.blipSender, apr.config, apr.getPushStatus)
+	if apr.couchDBClient != nil {
+		apr.Checkpointer.remoteStore = apr.couchDBClient
+	}
 
 	var err error
 	apr.initialStatus, err = apr.Checkpointer.fetchCheckpoints()
@@ -195,7 +215,9 @@ func (apr *ActivePushReplicator) _initCheckpointer() error {
 		return err
 	}
 
-	apr.registerCheckpointerCallbacks()
+	if apr.blipSyncContext != nil {
+		apr.registerCheckpointerCallbacks()
+	}
 	apr.Checkpointer.Start()
 
 	return nil
@@ -233,12 +255,18 @@ func (apr *ActivePushReplicator) getPushStatus(lastSeqPushed string) *Replicatio
 	return status
 }
 
-// reset performs a reset on the replication by removing the local checkpoint document.
-func (apr *ActivePushReplicator) reset() error {
+// reset performs a reset on the replication by removing the local checkpoint document.  When sinceTime is set, the
+// replication restarts from the local changes since that time instead of from zero.
+func (apr *ActivePushReplicator) reset(sinceTime string) error {
 	if apr.state != ReplicationStateStopped {
 		return fmt.Errorf("reset invoked for replication %s when the replication was not stopped", apr.config.ID)
 	}
-	if err := resetLocalCheckpoint(apr.config.ActiveDB, apr.CheckpointID); err != nil {
+	if err := resetLocalCheckpoint(apr.config.ActiveDB, apr.CheckpointID, sinceTime); err != nil {
+		return err
+	}
+
+	// Everything will be re-pushed after a reset, so there's no need to retain previously rejected revisions
+	if _, err := apr.deadLetters.remove(); err != nil {
 		return err
 	}
 
@@ -278,14 +306,105 @@ func (apr *ActivePushReplicator) _waitForPendingChangesResponse() error {
 	return errors.New("checkpointer _waitForPendingChangesResponse failed to complete after waiting 10s")
 }
 
-// Stop stops the push replication and waits for the send changes goroutine to finish.
+// Stop stops the push replication and waits for the send changes (or CouchDB protocol changes) goroutine to finish.
 func (apr *ActivePushReplicator) Stop() error {
 	if err := apr.stopAndDisconnect(); err != nil {
 		return err
 	}
 	teardownStart := time.Now()
-	for apr.activeSendChanges.IsTrue() && (time.Since(teardownStart) < time.Second*10) {
+	for (apr.activeSendChanges.IsTrue() || apr.activeCouchDBFeed.IsTrue()) && (time.Since(teardownStart) < time.Second*10) {
 		time.Sleep(10 * time.Millisecond)
 	}
 	return nil
 }
+
+// addDeadLetter records a revision rejected by the remote in the dead letter queue.
+func (apr *ActivePushReplicator) addDeadLetter(entry DeadLetterEntry) {
+	base.InfofCtx(apr.ctx, base.KeyReplicate, "Adding doc %s/%s to dead letter queue for replication %s, error %s: %s", base.UD(entry.DocID), entry.RevID, apr.config.ID, entry.ErrorCode, base.UD(entry.ErrorMessage))
+	if err := apr.deadLetters.add(entry); err != nil {
+		base.WarnfCtx(apr.ctx, "Unable to add doc %s to dead letter queue for replication %s: %v", base.UD(entry.DocID), apr.config.ID, err)
+	}
+}
+
+// removeDeadLetter removes a document from the dead letter queue once a revision of it has been accepted by the remote.
+func (apr *ActivePushReplicator) removeDeadLetter(docID string) {
+	if !apr.deadLetters.contains(docID) {
+		return
+	}
+	base.DebugfCtx(apr.ctx, base.KeyReplicate, "Removing doc %s from dead letter queue for replication %s", base.UD(docID), apr.config.ID)
+	if _, err := apr.deadLetters.remove(docID); err != nil {
+		base.WarnfCtx(apr.ctx, "Unable to remove doc %s from dead letter queue for replication %s: %v", base.UD(docID), apr.config.ID, err)
+	}
+}
+
+// retryDeadLetters re-sends the current revision of the given documents in the dead letter queue, or of every document
+// in the queue when no doc IDs are specified.  Revisions are offered to the remote via a changes message with a zero
+// sequence, so that they don't affect the replication's checkpoint.  Entries are removed from the queue once the
+// remote accepts the revision, and updated with the new error otherwise.  Returns the number of documents re-sent.
+func (apr *ActivePushReplicator) retryDeadLetters(docIDs ...string) (retried int, err error) {
+	apr.lock.RLock()
+	sender := apr.blipSender
+	bsc := apr.blipSyncContext
+	client := apr.couchDBClient
+	apr.lock.RUnlock()
+
+	if (client == nil && (sender == nil || bsc == nil)) || apr.getState() != ReplicationStateRunning {
+		return 0, base.HTTPErrorf(http.StatusServiceUnavailable, "Replication %s must be running to retry dead letters", apr.config.ID)
+	}
+
+	entries, err := apr.deadLetters.list()
+	if err != nil {
+		return 0, err
+	}
+
+	var requested base.Set
+	if len(docIDs) > 0 {
+		requested = base.SetFromArray(docIDs)
+	}
+
+	if client != nil {
+		return apr.retryDeadLettersCouchDB(client, entries, requested)
+	}
+
+	bh := blipHandler{
+		BlipSyncContext: bsc,
+		db:              apr.config.ActiveDB,
+		serialNumber:    bsc.incrementSerialNumber(),
+	}
+
+	batchSize := int(apr.config.ChangesBatchSize)
+	if batchSize <= 0 {
+		batchSize = int(BlipDefaultBatchSize)
+	}
+
+	changeArray := make([][]interface{}, 0, batchSize)
+	for _, entry := range entries {
+		if requested != nil && !requested.Contains(entry.DocID) {
+			continue
+		}
+		doc, err := apr.config.ActiveDB.GetDocument(entry.DocID, DocUnmarshalSync)
+		if err != nil {
+			base.InfofCtx(apr.ctx, base.KeyReplicate, "Unable to retrieve doc %s for dead letter retry, skipping: %v", base.UD(entry.DocID), err)
+			continue
+		}
+		change := &ChangeEntry{ID: doc.ID, Deleted: doc.IsDeleted()}
+		changeArray = append(changeArray, bh.buildChangesRow(change, doc.CurrentRev))
+		if len(changeArray) >= batchSize {
+			if err := bh.sendBatchOfChanges(sender, changeArray, true); err != nil {
+				return retried, err
+			}
+			retried += len(changeArray)
+			changeArray = make([][]interface{}, 0, batchSize)
+		}
+	}
+
+	if len(changeArray) > 0 {
+		if err := bh.sendBatchOfChanges(sender, changeArray, true); err != nil {
+			return retried, err
+		}
+		retried += len(changeArray)
+	}
+
+	base.InfofCtx(apr.ctx, base.KeyReplicate, "Retried %d documents from dead letter queue for replication %s", retried, apr.config.ID)
+	return retried, nil
+}
@@ -76,6 +76,9 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 				return nil, err
 			}
 			digest := Sha1DigestKey(attachment)
+			if err := db.checkNewAttachment(doc.ID, name, digest, meta, attachment); err != nil {
+				return nil, err
+			}
 			key := MakeAttachmentKey(AttVersion2, doc.ID, digest)
 			newAttachmentData[key] = attachment
 
@@ -127,6 +130,14 @@ func (db *Database) storeAttachments(doc *Document, newAttachmentsMeta Attachmen
 			}
 		}
 	}
+
+	// The total size limit only applies to revisions adding attachment data, so that documents exceeding a newly
+	// lowered limit can still be updated.
+	if len(newAttachmentData) > 0 {
+		if err := db.checkDocAttachmentsSize(doc.ID, atts); err != nil {
+			return nil, err
+		}
+	}
 	return newAttachmentData, nil
 }
 
@@ -228,13 +239,18 @@ func DeleteAttachmentVersion(attachments AttachmentsMeta) {
 
 // GetAttachment retrieves an attachment given its key.
 func (db *Database) GetAttachment(key string) ([]byte, error) {
-	v, _, err := db.Bucket.GetRaw(key)
-	return v, err
+	return db.attachmentStore.Get(key)
+}
+
+// GetAttachmentRange retrieves part of an attachment, along with the attachment's total length.  See
+// AttachmentStore.GetRange.
+func (db *Database) GetAttachmentRange(key string, offset, length int64) ([]byte, int64, error) {
+	return db.attachmentStore.GetRange(key, offset, length)
 }
 
 // Stores a base64-encoded attachment and returns the key to get it by.
 func (db *Database) setAttachment(key string, value []byte) error {
-	_, err := db.Bucket.AddRaw(key, 0, value)
+	_, err := db.attachmentStore.Add(key, value)
 	if err == nil {
 		base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(key))
 	}
@@ -244,7 +260,7 @@ func (db *Database) setAttachment(key string, value []byte) error {
 func (db *Database) setAttachments(attachments AttachmentData) error {
 	for key, data := range attachments {
 		attachmentSize := int64(len(data))
-		_, err := db.Bucket.AddRaw(key, 0, data)
+		_, err := db.attachmentStore.Add(key, data)
 		if err == nil {
 			base.InfofCtx(db.Ctx, base.KeyCRUD, "\tAdded attachment %q", base.UD(key))
 			db.DbStats.CBLReplicationPush().AttachmentPushCount.Add(1)
@@ -0,0 +1,143 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"hash"
+	"sync"
+	"time"
+)
+
+// attachmentChunkSize is the amount of attachment data requested by each getAttachment message when the peer
+// supports chunked attachment transfer.
+var attachmentChunkSize int64 = 1024 * 1024
+
+const (
+	// partialAttachmentTTL is how long an interrupted attachment transfer is retained for the peer to resume.
+	partialAttachmentTTL = 10 * time.Minute
+
+	// maxPartialAttachmentBytes bounds the attachment data retained for interrupted transfers across all of a
+	// database's connections.
+	maxPartialAttachmentBytes = 128 * 1024 * 1024
+)
+
+// partialAttachment is the data received so far for an attachment being transferred in chunks.  The digest is
+// computed incrementally as each chunk is received, so a resumed transfer doesn't rehash the data already received.
+type partialAttachment struct {
+	length   int64     // Expected total length of the attachment
+	data     []byte    // Data received so far
+	digester hash.Hash // Running SHA-1 of data
+	updated  time.Time // Time the last chunk was received
+}
+
+func newPartialAttachment(length int64) *partialAttachment {
+	return &partialAttachment{
+		length:   length,
+		digester: sha1.New(),
+		updated:  time.Now(),
+	}
+}
+
+// offset returns the offset of the next chunk to request.
+func (pa *partialAttachment) offset() int64 {
+	return int64(len(pa.data))
+}
+
+func (pa *partialAttachment) write(chunk []byte) {
+	pa.data = append(pa.data, chunk...)
+	_, _ = pa.digester.Write(chunk)
+	pa.updated = time.Now()
+}
+
+// digest returns the digest of the data received so far, in the same form as Sha1DigestKey.
+func (pa *partialAttachment) digest() string {
+	return "sha1-" + base64.StdEncoding.EncodeToString(pa.digester.Sum(nil))
+}
+
+// partialAttachmentCache retains interrupted chunked attachment transfers by digest, so that when a peer reconnects
+// and resends the revision only the remaining chunks are requested.  Transfers are held in memory, and so are only
+// resumed when the peer reconnects to the same node.
+type partialAttachmentCache struct {
+	lock      sync.Mutex
+	transfers map[string]*partialAttachment
+	size      int64 // Total bytes of data in transfers
+}
+
+func newPartialAttachmentCache() *partialAttachmentCache {
+	return &partialAttachmentCache{
+		transfers: make(map[string]*partialAttachment),
+	}
+}
+
+// take removes and returns the unexpired partial transfer for the digest, or nil if there isn't one.  Removing the
+// transfer ensures it's only resumed by a single handler.
+func (c *partialAttachmentCache) take(digest string) *partialAttachment {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	transfer, ok := c.transfers[digest]
+	if !ok {
+		return nil
+	}
+	c.remove(digest)
+	if time.Since(transfer.updated) > partialAttachmentTTL {
+		return nil
+	}
+	return transfer
+}
+
+// put retains a partial transfer.  Expired transfers, and then the least recently updated transfers, are evicted to
+// stay within maxPartialAttachmentBytes.
+func (c *partialAttachmentCache) put(digest string, transfer *partialAttachment) {
+	transferSize := transfer.offset()
+	if transferSize == 0 || transferSize > maxPartialAttachmentBytes {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Keep whichever transfer has made the most progress, when the same attachment was transferred concurrently
+	if existing, ok := c.transfers[digest]; ok {
+		if existing.offset() >= transferSize {
+			return
+		}
+		c.remove(digest)
+	}
+
+	for key, existing := range c.transfers {
+		if time.Since(existing.updated) > partialAttachmentTTL {
+			c.remove(key)
+		}
+	}
+	for c.size+transferSize > maxPartialAttachmentBytes {
+		var oldestKey string
+		var oldest *partialAttachment
+		for key, existing := range c.transfers {
+			if oldest == nil || existing.updated.Before(oldest.updated) {
+				oldestKey, oldest = key, existing
+			}
+		}
+		c.remove(oldestKey)
+	}
+
+	c.transfers[digest] = transfer
+	c.size += transferSize
+}
+
+// remove deletes the transfer for the digest.  Requires the lock to be held.
+func (c *partialAttachmentCache) remove(digest string) {
+	if transfer, ok := c.transfers[digest]; ok {
+		c.size -= transfer.offset()
+		delete(c.transfers, digest)
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartialAttachmentDigest(t *testing.T) {
+	data := []byte("hello world, in several chunks")
+	transfer := newPartialAttachment(int64(len(data)))
+	transfer.write(data[:5])
+	transfer.write(data[5:12])
+	transfer.write(data[12:])
+	assert.Equal(t, int64(len(data)), transfer.offset())
+	assert.Equal(t, Sha1DigestKey(data), transfer.digest())
+}
+
+func TestPartialAttachmentCache(t *testing.T) {
+	cache := newPartialAttachmentCache()
+
+	// Transfers without any data aren't retained
+	cache.put("sha1-empty", newPartialAttachment(10))
+	assert.Nil(t, cache.take("sha1-empty"))
+
+	transfer := newPartialAttachment(10)
+	transfer.write([]byte("abc"))
+	cache.put("sha1-a", transfer)
+
+	// The transfer with the most progress is retained
+	lessProgress := newPartialAttachment(10)
+	lessProgress.write([]byte("a"))
+	cache.put("sha1-a", lessProgress)
+	assert.Equal(t, int64(3), cache.size)
+
+	// Transfers can only be taken once
+	taken := cache.take("sha1-a")
+	require.NotNil(t, taken)
+	assert.Equal(t, int64(3), taken.offset())
+	assert.Nil(t, cache.take("sha1-a"))
+	assert.Equal(t, int64(0), cache.size)
+
+	// Expired transfers aren't resumed
+	transfer.updated = time.Now().Add(-2 * partialAttachmentTTL)
+	cache.put("sha1-a", transfer)
+	assert.Nil(t, cache.take("sha1-a"))
+
+	// The least recently updated transfers are evicted to stay within the size limit
+	older := newPartialAttachment(maxPartialAttachmentBytes)
+	older.write(make([]byte, maxPartialAttachmentBytes/2))
+	older.updated = time.Now().Add(-time.Minute)
+	cache.put("sha1-older", older)
+	newer := newPartialAttachment(maxPartialAttachmentBytes)
+	newer.write(make([]byte, maxPartialAttachmentBytes/2+1))
+	cache.put("sha1-newer", newer)
+	assert.Nil(t, cache.take("sha1-older"))
+	assert.NotNil(t, cache.take("sha1-newer"))
+}
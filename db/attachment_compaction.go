@@ -3,7 +3,6 @@ package db
 import (
 	"bytes"
 	"errors"
-	"strconv"
 	"strings"
 	"time"
 
@@ -99,8 +98,8 @@ func attachmentCompactMarkPhase(db *Database, compactionID string, terminator *b
 		}
 
 		for attachmentName, attachmentDocID := range attachmentKeys {
-			// Stamp the current compaction ID into the attachment xattr. This is performing the actual marking
-			_, err = db.Bucket.SetXattr(attachmentDocID, getCompactionIDSubDocPath(compactionID), []byte(strconv.Itoa(int(time.Now().Unix()))))
+			// Stamp the current compaction ID into the attachment store. This is performing the actual marking
+			err = db.attachmentStore.Mark(attachmentDocID, compactionID)
 
 			// If an error occurs while stamping in that ID we need to fail this process and then the entire compaction
 			// process. Otherwise, an attachment could end up getting erroneously deleted in the later sweep phase.
@@ -257,12 +256,36 @@ func attachmentCompactSweepPhase(db *Database, compactionID string, vbUUIDs []ui
 	base.InfofCtx(db.Ctx, base.KeyAll, "Starting second phase of attachment compaction (sweep phase) with compactionID: %q", compactionID)
 	compactionLoggingID := "Compaction Sweep: " + compactionID
 
+	inBucket, externalStores := db.attachmentStoresForCompaction()
+	for _, store := range externalStores {
+		err := attachmentCompactExternalSweep(db, store, compactionID, dryRun, terminator, purgedAttachmentCount)
+		if err != nil {
+			return purgedAttachmentCount.Value(), err
+		}
+	}
+	if !inBucket || terminator.IsClosed() {
+		base.InfofCtx(db.Ctx, base.KeyAll, "[%s] Sweep phase of attachment compaction completed. Deleted %d attachments", compactionLoggingID, purgedAttachmentCount.Value())
+		return purgedAttachmentCount.Value(), nil
+	}
+
 	// Iterate over v1 attachments and if not marked with supplied compactionID we can purge the attachments.
 	// In the event of an error we can return but continue - Worst case is an attachment which should be deleted won't
 	// be deleted.
 	callback := func(event sgbucket.FeedEvent) bool {
 		docID := string(event.Key)
 
+		// Renditions are derived from attachment data and are regenerated on demand, so are purged on every run
+		if strings.HasPrefix(docID, base.AttRenditionPrefix) {
+			if !dryRun {
+				if _, err := db.Bucket.Remove(docID, event.Cas); err != nil {
+					base.WarnfCtx(db.Ctx, "[%s] Unable to purge attachment rendition %s: %v", compactionLoggingID, base.UD(docID), err)
+					return true
+				}
+				base.DebugfCtx(db.Ctx, base.KeyAll, "[%s] Purged attachment rendition %s", compactionLoggingID, base.UD(docID))
+			}
+			return true
+		}
+
 		// We only want to look over v1 attachment docs, skip otherwise
 		if !strings.HasPrefix(docID, base.AttPrefix) {
 			return true
@@ -347,6 +370,17 @@ func attachmentCompactCleanupPhase(db *Database, compactionID string, vbUUIDs []
 	base.InfofCtx(db.Ctx, base.KeyAll, "Starting third phase of attachment compaction (cleanup phase) with compactionID: %q", compactionID)
 	compactionLoggingID := "Compaction Cleanup: " + compactionID
 
+	inBucket, externalStores := db.attachmentStoresForCompaction()
+	for _, store := range externalStores {
+		if err := store.ClearMarks(compactionID); err != nil {
+			return err
+		}
+	}
+	if !inBucket {
+		base.InfofCtx(db.Ctx, base.KeyAll, "[%s] Cleanup phase of attachment compaction completed", compactionLoggingID)
+		return nil
+	}
+
 	callback := func(event sgbucket.FeedEvent) bool {
 
 		docID := string(event.Key)
@@ -457,6 +491,64 @@ func attachmentCompactCleanupPhase(db *Database, compactionID string, vbUUIDs []
 	return dcpClient.Close()
 }
 
+// attachmentCompactExternalSweep purges the v1 attachments in an external store that weren't marked during the mark
+// phase.  As with the bucket sweep, errors purging individual attachments are logged rather than failing the sweep.
+func attachmentCompactExternalSweep(db *Database, store externalAttachmentStore, compactionID string, dryRun bool, terminator *base.SafeTerminator, purgedAttachmentCount *base.AtomicInt) error {
+	compactionLoggingID := "Compaction Sweep: " + compactionID
+
+	var sweepErr error
+	err := store.ForEach(func(key string) bool {
+		if terminator.IsClosed() {
+			return false
+		}
+
+		// Renditions are derived from attachment data and are regenerated on demand, so are purged on every run
+		if strings.HasPrefix(key, base.AttRenditionPrefix) {
+			if !dryRun {
+				if err := store.Delete(key); err != nil {
+					base.WarnfCtx(db.Ctx, "[%s] Unable to purge attachment rendition %s: %v", compactionLoggingID, base.UD(key), err)
+					return true
+				}
+				base.DebugfCtx(db.Ctx, base.KeyAll, "[%s] Purged attachment rendition %s", compactionLoggingID, base.UD(key))
+			}
+			return true
+		}
+
+		// We only want to look over v1 attachments, skip otherwise
+		if !strings.HasPrefix(key, base.AttPrefix) {
+			return true
+		}
+
+		marked, err := store.IsMarked(key, compactionID)
+		if err != nil {
+			// Unable to determine whether the attachment is in use, so the sweep can't safely continue
+			sweepErr = err
+			return false
+		}
+		if marked {
+			return true
+		}
+
+		if !dryRun {
+			if err := store.Delete(key); err != nil {
+				base.WarnfCtx(db.Ctx, "[%s] Unable to purge attachment %s: %v", compactionLoggingID, base.UD(key), err)
+				return true
+			}
+			base.DebugfCtx(db.Ctx, base.KeyAll, "[%s] Purged attachment %s", compactionLoggingID, base.UD(key))
+			db.DbStats.Database().NumAttachmentsCompacted.Add(1)
+		} else {
+			base.DebugfCtx(db.Ctx, base.KeyAll, "[%s] Would have purged attachment %s (not purged, running with dry run)", compactionLoggingID, base.UD(key))
+		}
+
+		purgedAttachmentCount.Add(1)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return sweepErr
+}
+
 // getCompactionIDSubDocPath is just a tiny helper func that just concatenates the subdoc path we're using to store
 // compactionIDs
 func getCompactionIDSubDocPath(compactionID string) string {
@@ -101,11 +101,17 @@ func TestAttachmentSweep(t *testing.T) {
 		makeUnmarkedDoc(docID)
 	}
 
+	// Make renditions - always purged, but not counted as attachments
+	renditionKey := MakeAttachmentRenditionKey("sha1-marked", &AttachmentRenditionSpec{Width: 64, Format: AttachmentRenditionFormatPNG})
+	makeUnmarkedDoc(renditionKey)
+
 	terminator := base.NewSafeTerminator()
 	purged, err := attachmentCompactSweepPhase(testDb, t.Name(), nil, false, terminator, &base.AtomicInt{})
 	assert.NoError(t, err)
 
 	assert.Equal(t, int64(11), purged)
+	_, _, err = testDb.Bucket.GetRaw(renditionKey)
+	assert.True(t, base.IsDocNotFoundError(err))
 }
 
 func TestAttachmentCleanup(t *testing.T) {
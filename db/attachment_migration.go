@@ -0,0 +1,158 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/google/uuid"
+)
+
+// ErrNoAttachmentMigration is returned when an attachment migration is requested for a database that doesn't have
+// an attachment store to migrate from configured.
+var ErrNoAttachmentMigration = errors.New("no attachment store migration is configured for this database")
+
+// migrateAttachments copies every attachment from the store being migrated from into the configured store.
+// Attachments already present in the configured store are skipped.  When deleteSource is true each attachment is
+// removed from the source once it has been copied.
+func migrateAttachments(db *Database, deleteSource bool, terminator *base.SafeTerminator, migratedCount, skippedCount *base.AtomicInt) error {
+	migratingStore, ok := db.attachmentStore.(*migratingAttachmentStore)
+	if !ok {
+		return ErrNoAttachmentMigration
+	}
+	source, destination := migratingStore.source, migratingStore.AttachmentStore
+
+	migrateAttachment := func(key string, data []byte) error {
+		added, err := destination.Add(key, data)
+		if err != nil {
+			return fmt.Errorf("unable to copy attachment %s: %w", base.UD(key), err)
+		}
+		if added {
+			migratedCount.Add(1)
+		} else {
+			skippedCount.Add(1)
+		}
+		if deleteSource {
+			if err := source.Delete(key); err != nil {
+				return fmt.Errorf("unable to delete migrated attachment %s: %w", base.UD(key), err)
+			}
+		}
+		return nil
+	}
+
+	if externalSource, ok := source.(externalAttachmentStore); ok {
+		var migrateErr error
+		err := externalSource.ForEach(func(key string) bool {
+			if terminator.IsClosed() {
+				return false
+			}
+			data, err := externalSource.Get(key)
+			if base.IsDocNotFoundError(err) {
+				return true
+			}
+			if err == nil {
+				err = migrateAttachment(key, data)
+			}
+			migrateErr = err
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+		return migrateErr
+	}
+
+	return migrateBucketAttachments(db, migrateAttachment, terminator)
+}
+
+// migrateBucketAttachments invokes migrateAttachment for each attachment document in the bucket, via a one-shot DCP
+// feed.
+func migrateBucketAttachments(db *Database, migrateAttachment func(key string, data []byte) error, terminator *base.SafeTerminator) error {
+	migrationID, err := uuid.NewRandom()
+	if err != nil {
+		return err
+	}
+	migrationLoggingID := "Attachment Migration: " + migrationID.String()
+
+	var failureLock sync.Mutex
+	var migrateErr error
+	failProcess := func(err error) bool {
+		failureLock.Lock()
+		defer failureLock.Unlock()
+		if migrateErr == nil {
+			migrateErr = err
+			terminator.Close()
+		}
+		return false
+	}
+
+	callback := func(event sgbucket.FeedEvent) bool {
+		key := string(event.Key)
+		if !strings.HasPrefix(key, base.AttPrefix) && !strings.HasPrefix(key, base.Att2Prefix) {
+			return true
+		}
+		if event.Opcode != sgbucket.FeedOpMutation {
+			return true
+		}
+
+		// Attachments marked by compaction have an xattr, which isn't part of the attachment data
+		data := event.Value
+		if event.DataType&base.MemcachedDataTypeXattr != 0 {
+			body, _, _, err := parseXattrStreamData(base.AttachmentCompactionXattrName, "", event.Value)
+			if err != nil && !errors.Is(err, base.ErrXattrNotFound) {
+				return failProcess(err)
+			}
+			data = body
+		}
+
+		if err := migrateAttachment(key, data); err != nil {
+			return failProcess(err)
+		}
+		return true
+	}
+
+	clientOptions := base.DCPClientOptions{
+		OneShot: true,
+	}
+
+	base.InfofCtx(db.Ctx, base.KeyAll, "[%s] Starting DCP feed to migrate attachments from bucket", migrationLoggingID)
+	dcpClient, err := base.NewDCPClient(migrationID.String(), callback, clientOptions, db.Bucket, db.Options.GroupID)
+	if err != nil {
+		return err
+	}
+
+	doneChan, err := dcpClient.Start()
+	if err != nil {
+		_ = dcpClient.Close()
+		return err
+	}
+
+	select {
+	case <-doneChan:
+		base.InfofCtx(db.Ctx, base.KeyAll, "[%s] Attachment migration from bucket completed", migrationLoggingID)
+	case <-terminator.Done():
+		base.InfofCtx(db.Ctx, base.KeyAll, "[%s] Attachment migration from bucket was terminated", migrationLoggingID)
+	}
+
+	closeErr := dcpClient.Close()
+
+	failureLock.Lock()
+	defer failureLock.Unlock()
+	if migrateErr != nil {
+		return migrateErr
+	}
+	return closeErr
+}
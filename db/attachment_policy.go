@@ -0,0 +1,249 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultAttachmentScannerTimeout is the default time allowed for the content scanner to respond for a single
+// attachment.
+const DefaultAttachmentScannerTimeout = 30 * time.Second
+
+// defaultAttachmentContentType is the content type assumed for attachments uploaded without one.
+const defaultAttachmentContentType = "application/octet-stream"
+
+type AttachmentPolicyOptions struct {
+	MaxAttachmentSize     int64                     // Max size of a single attachment in bytes, zero for no limit
+	MaxDocAttachmentsSize int64                     // Max total size of a document's attachments in bytes, zero for no limit
+	AllowedContentTypes   []string                  // When set, only attachments with a matching content type are accepted
+	DeniedContentTypes    []string                  // Attachments with a matching content type are rejected
+	Scanner               *AttachmentScannerOptions // When set, new attachments are sent to the scanner before being stored
+}
+
+// AttachmentScannerOptions configures a synchronous content scanning hook (e.g. an HTTP front end to an antivirus
+// daemon).  Each new attachment is POSTed to the URL, with the document ID, attachment name and digest as the doc_id,
+// name and digest query parameters.  A 2xx response accepts the attachment, and a 403, 406 or 422 response rejects it.
+type AttachmentScannerOptions struct {
+	URL      string
+	Timeout  time.Duration // Time allowed for the scanner to respond
+	FailOpen bool          // Accept attachments when the scanner can't be reached or returns an unexpected response
+}
+
+// attachmentPolicy enforces the AttachmentPolicyOptions for a database.
+type attachmentPolicy struct {
+	options AttachmentPolicyOptions
+	client  *http.Client
+}
+
+func newAttachmentPolicy(options *AttachmentPolicyOptions) *attachmentPolicy {
+	policy := &attachmentPolicy{options: *options}
+	if options.Scanner != nil {
+		timeout := options.Scanner.Timeout
+		if timeout <= 0 {
+			timeout = DefaultAttachmentScannerTimeout
+		}
+		policy.client = &http.Client{Timeout: timeout}
+	}
+	return policy
+}
+
+// checkAttachment returns an error if an attachment with the given content type and size (-1 if unknown) can't be
+// uploaded.
+func (p *attachmentPolicy) checkAttachment(name string, contentType string, size int64) error {
+	if p.options.MaxAttachmentSize > 0 && size > p.options.MaxAttachmentSize {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Attachment %q exceeds the maximum attachment size of %d bytes", name, p.options.MaxAttachmentSize)
+	}
+
+	if len(p.options.AllowedContentTypes) == 0 && len(p.options.DeniedContentTypes) == 0 {
+		return nil
+	}
+	mediaType := normalizeContentType(contentType)
+	if matchContentType(mediaType, p.options.DeniedContentTypes) {
+		return base.HTTPErrorf(http.StatusUnsupportedMediaType, "Attachment %q has a content type that isn't allowed: %s", name, mediaType)
+	}
+	if len(p.options.AllowedContentTypes) > 0 && !matchContentType(mediaType, p.options.AllowedContentTypes) {
+		return base.HTTPErrorf(http.StatusUnsupportedMediaType, "Attachment %q has a content type that isn't allowed: %s", name, mediaType)
+	}
+	return nil
+}
+
+// checkDocAttachmentsSize returns an error if the total size of the attachments exceeds the per-document limit.
+func (p *attachmentPolicy) checkDocAttachmentsSize(attachments AttachmentsMeta) error {
+	if p.options.MaxDocAttachmentsSize <= 0 {
+		return nil
+	}
+	var total int64
+	for _, value := range attachments {
+		meta, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if size, ok := base.ToInt64(meta["encoded_length"]); ok {
+			total += size
+		} else if size, ok := base.ToInt64(meta["length"]); ok {
+			total += size
+		}
+	}
+	if total > p.options.MaxDocAttachmentsSize {
+		return base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Document attachments exceed the maximum total size of %d bytes", p.options.MaxDocAttachmentsSize)
+	}
+	return nil
+}
+
+// scan sends the attachment to the content scanner, returning an error if the attachment was rejected.
+func (p *attachmentPolicy) scan(ctx context.Context, docID, name, digest, contentType string, data []byte) error {
+	scanner := p.options.Scanner
+	if scanner == nil {
+		return nil
+	}
+
+	scanErr := p.sendToScanner(docID, name, digest, contentType, data)
+	if scanErr == nil {
+		return nil
+	}
+	if httpErr, ok := scanErr.(*base.HTTPError); ok && httpErr.Status == http.StatusForbidden {
+		return scanErr
+	}
+	if scanner.FailOpen {
+		base.WarnfCtx(ctx, "Attachment %q of doc %s accepted without scanning: %v", base.UD(name), base.UD(docID), scanErr)
+		return nil
+	}
+	base.WarnfCtx(ctx, "Attachment %q of doc %s rejected as it couldn't be scanned: %v", base.UD(name), base.UD(docID), scanErr)
+	return base.HTTPErrorf(http.StatusServiceUnavailable, "Attachment %q couldn't be scanned", name)
+}
+
+// sendToScanner returns a 403 HTTPError when the scanner rejects the attachment, or any other error if the scanner
+// couldn't be reached or returned an unexpected response.
+func (p *attachmentPolicy) sendToScanner(docID, name, digest, contentType string, data []byte) error {
+	scanURL, err := url.Parse(p.options.Scanner.URL)
+	if err != nil {
+		return err
+	}
+	query := scanURL.Query()
+	query.Set("doc_id", docID)
+	query.Set("name", name)
+	query.Set("digest", digest)
+	scanURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, scanURL.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = defaultAttachmentContentType
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	reason, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 256))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusNotAcceptable, resp.StatusCode == http.StatusUnprocessableEntity:
+		if len(bytes.TrimSpace(reason)) > 0 {
+			return base.HTTPErrorf(http.StatusForbidden, "Attachment %q was rejected by the content scanner: %s", name, bytes.TrimSpace(reason))
+		}
+		return base.HTTPErrorf(http.StatusForbidden, "Attachment %q was rejected by the content scanner", name)
+	}
+	return fmt.Errorf("content scanner returned status %d", resp.StatusCode)
+}
+
+// normalizeContentType returns the lower case media type of a Content-Type value, without parameters.
+func normalizeContentType(contentType string) string {
+	if contentType == "" {
+		return defaultAttachmentContentType
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	}
+	return strings.ToLower(mediaType)
+}
+
+// matchContentType returns true if the media type matches any of the patterns.  Patterns are either a media type, or
+// a type followed by a wildcard subtype (e.g. image/*).
+func matchContentType(mediaType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckAttachmentUpload returns an error if an attachment with the given content type and size (-1 if unknown) would
+// be rejected by the database's attachment policy, allowing uploads to be rejected before the data is received.
+func (context *DatabaseContext) CheckAttachmentUpload(name string, contentType string, size int64) error {
+	if context.attachmentPolicy == nil {
+		return nil
+	}
+	if err := context.attachmentPolicy.checkAttachment(name, contentType, size); err != nil {
+		context.DbStats.Database().NumAttachmentsRejected.Add(1)
+		return err
+	}
+	return nil
+}
+
+// checkNewAttachment applies the attachment policy to an attachment with inline data that's about to be stored.
+func (db *Database) checkNewAttachment(docID, name, digest string, meta map[string]interface{}, data []byte) error {
+	if db.attachmentPolicy == nil {
+		return nil
+	}
+	contentType, _ := meta["content_type"].(string)
+	size := int64(len(data))
+	if length, ok := base.ToInt64(meta["length"]); ok && length > size {
+		size = length
+	}
+	err := db.attachmentPolicy.checkAttachment(name, contentType, size)
+	if err == nil {
+		err = db.attachmentPolicy.scan(db.Ctx, docID, name, digest, contentType, data)
+	}
+	if err != nil {
+		base.InfofCtx(db.Ctx, base.KeyCRUD, "Rejected attachment %q of doc %s: %v", base.UD(name), base.UD(docID), err)
+		db.DbStats.Database().NumAttachmentsRejected.Add(1)
+		return err
+	}
+	return nil
+}
+
+// checkDocAttachmentsSize applies the attachment policy's total size limit to a document's attachments.
+func (db *Database) checkDocAttachmentsSize(docID string, attachments AttachmentsMeta) error {
+	if db.attachmentPolicy == nil {
+		return nil
+	}
+	if err := db.attachmentPolicy.checkDocAttachmentsSize(attachments); err != nil {
+		base.InfofCtx(db.Ctx, base.KeyCRUD, "Rejected attachments of doc %s: %v", base.UD(docID), err)
+		db.DbStats.Database().NumAttachmentsRejected.Add(1)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchContentType(t *testing.T) {
+	patterns := []string{"image/*", "Application/PDF"}
+	assert.True(t, matchContentType(normalizeContentType("image/png"), patterns))
+	assert.True(t, matchContentType(normalizeContentType("application/pdf; charset=binary"), patterns))
+	assert.False(t, matchContentType(normalizeContentType("application/pdfx"), patterns))
+	assert.False(t, matchContentType(normalizeContentType("imagex/png"), patterns))
+	assert.False(t, matchContentType(normalizeContentType(""), patterns))
+	assert.True(t, matchContentType(normalizeContentType(""), []string{"*/*"}))
+}
+
+func TestAttachmentPolicyCheckAttachment(t *testing.T) {
+	policy := newAttachmentPolicy(&AttachmentPolicyOptions{
+		MaxAttachmentSize:   10,
+		AllowedContentTypes: []string{"image/*", "text/plain"},
+		DeniedContentTypes:  []string{"image/svg+xml"},
+	})
+
+	assert.NoError(t, policy.checkAttachment("a", "image/png", 10))
+	assert.NoError(t, policy.checkAttachment("a", "text/plain", -1))
+	assertHTTPError(t, policy.checkAttachment("a", "image/png", 11), http.StatusRequestEntityTooLarge)
+	assertHTTPError(t, policy.checkAttachment("a", "image/svg+xml", 1), http.StatusUnsupportedMediaType)
+	assertHTTPError(t, policy.checkAttachment("a", "application/x-msdownload", 1), http.StatusUnsupportedMediaType)
+	assertHTTPError(t, policy.checkAttachment("a", "", 1), http.StatusUnsupportedMediaType)
+}
+
+func TestAttachmentPolicyDocAttachmentsSize(t *testing.T) {
+	policy := newAttachmentPolicy(&AttachmentPolicyOptions{MaxDocAttachmentsSize: 10})
+	assert.NoError(t, policy.checkDocAttachmentsSize(AttachmentsMeta{
+		"a": map[string]interface{}{"length": 5},
+		"b": map[string]interface{}{"length": float64(5)},
+	}))
+	assertHTTPError(t, policy.checkDocAttachmentsSize(AttachmentsMeta{
+		"a": map[string]interface{}{"length": 5},
+		"b": map[string]interface{}{"length": 6},
+	}), http.StatusRequestEntityTooLarge)
+
+	// Encoded attachments count towards the limit by their stored size
+	assert.NoError(t, policy.checkDocAttachmentsSize(AttachmentsMeta{
+		"a": map[string]interface{}{"length": 100, "encoded_length": 10},
+	}))
+}
+
+func TestAttachmentPolicyScanner(t *testing.T) {
+	var scannedQuery map[string][]string
+	var scannedContentType string
+	scanner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scannedQuery = r.URL.Query()
+		scannedContentType = r.Header.Get("Content-Type")
+		body, _ := ioutil.ReadAll(r.Body)
+		switch string(body) {
+		case "clean":
+			w.WriteHeader(http.StatusNoContent)
+		case "infected":
+			w.WriteHeader(http.StatusNotAcceptable)
+			_, _ = w.Write([]byte("Eicar-Test-Signature FOUND"))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer scanner.Close()
+
+	policy := newAttachmentPolicy(&AttachmentPolicyOptions{Scanner: &AttachmentScannerOptions{URL: scanner.URL + "/scan?mode=full"}})
+	require.NoError(t, policy.scan(context.Background(), "doc1", "a.txt", "sha1-abc", "text/plain", []byte("clean")))
+	assert.Equal(t, []string{"doc1"}, scannedQuery["doc_id"])
+	assert.Equal(t, []string{"a.txt"}, scannedQuery["name"])
+	assert.Equal(t, []string{"sha1-abc"}, scannedQuery["digest"])
+	assert.Equal(t, []string{"full"}, scannedQuery["mode"])
+	assert.Equal(t, "text/plain", scannedContentType)
+
+	err := policy.scan(context.Background(), "doc1", "a.txt", "sha1-abc", "", []byte("infected"))
+	assertHTTPError(t, err, http.StatusForbidden)
+	assert.Contains(t, err.Error(), "Eicar-Test-Signature FOUND")
+	assert.Equal(t, defaultAttachmentContentType, scannedContentType)
+
+	// Scanner failures reject attachments unless failing open
+	assertHTTPError(t, policy.scan(context.Background(), "doc1", "a.txt", "sha1-abc", "", []byte("error")), http.StatusServiceUnavailable)
+	policy.options.Scanner.FailOpen = true
+	assert.NoError(t, policy.scan(context.Background(), "doc1", "a.txt", "sha1-abc", "", []byte("error")))
+	assertHTTPError(t, policy.scan(context.Background(), "doc1", "a.txt", "sha1-abc", "", []byte("infected")), http.StatusForbidden)
+}
+
+func TestStoreAttachmentsPolicy(t *testing.T) {
+	db := setupTestDBWithOptions(t, DatabaseContextOptions{
+		AttachmentPolicyOptions: &AttachmentPolicyOptions{
+			MaxAttachmentSize:     8,
+			MaxDocAttachmentsSize: 12,
+			DeniedContentTypes:    []string{"application/x-msdownload"},
+		},
+	})
+	defer db.Close()
+
+	putDoc := func(docID string, body string) (string, error) {
+		var docBody Body
+		require.NoError(t, base.JSONUnmarshal([]byte(body), &docBody))
+		revID, _, err := db.Put(docID, docBody)
+		return revID, err
+	}
+
+	// "aGVsbG8gd29ybGQ=" is "hello world", which exceeds the max attachment size
+	_, err := putDoc("doc1", `{"_attachments": {"hello.txt": {"data": "aGVsbG8gd29ybGQ="}}}`)
+	assertHTTPError(t, err, http.StatusRequestEntityTooLarge)
+
+	_, err = putDoc("doc1", `{"_attachments": {"setup.exe": {"data": "aGVsbG8=", "content_type": "application/x-msdownload"}}}`)
+	assertHTTPError(t, err, http.StatusUnsupportedMediaType)
+	assert.Equal(t, int64(2), db.DbStats.Database().NumAttachmentsRejected.Value())
+
+	// "aGVsbG8=" is "hello", so a second attachment exceeds the total size
+	revID, err := putDoc("doc1", `{"_attachments": {"a.txt": {"data": "aGVsbG8="}}}`)
+	require.NoError(t, err)
+	_, err = putDoc("doc1", `{"_rev": "`+revID+`", "_attachments": {"a.txt": {"stub": true, "revpos": 1}, "b.txt": {"data": "d29ybGQ="}, "c.txt": {"data": "IUAjJA=="}}}`)
+	assertHTTPError(t, err, http.StatusRequestEntityTooLarge)
+	_, err = putDoc("doc1", `{"_rev": "`+revID+`", "_attachments": {"a.txt": {"stub": true, "revpos": 1}, "b.txt": {"data": "d29ybGQ="}}}`)
+	require.NoError(t, err)
+}
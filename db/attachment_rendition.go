@@ -0,0 +1,327 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// MaxAttachmentRenditionDimension is the largest width or height that can be requested for a rendition.
+	MaxAttachmentRenditionDimension = 4096
+
+	// maxAttachmentRenditionSourcePixels bounds the size of the images renditions are generated from, as the decoded
+	// image is held in memory.
+	maxAttachmentRenditionSourcePixels = 50 * 1000 * 1000
+
+	// maxAttachmentRenditionSourceBytes bounds the decompressed size of gzip encoded attachments that renditions are
+	// generated from.
+	maxAttachmentRenditionSourceBytes = 64 * 1024 * 1024
+
+	// attachmentRenditionJPEGQuality is the quality renditions are encoded with in JPEG format.
+	attachmentRenditionJPEGQuality = 85
+)
+
+// DefaultAttachmentRenditionSizes are the widths and heights of the renditions that are stored once generated, when
+// the database doesn't configure them.
+var DefaultAttachmentRenditionSizes = []int{64, 128, 256, 512, 1024}
+
+// Rendition formats.  WebP isn't supported, as there's no pure Go WebP encoder.
+const (
+	AttachmentRenditionFormatJPEG = "jpeg"
+	AttachmentRenditionFormatPNG  = "png"
+	AttachmentRenditionFormatGIF  = "gif"
+)
+
+// AttachmentRenditionSpec describes a resized rendition of an image attachment.  The image is scaled to fit within the
+// width and height, preserving its aspect ratio, and is never enlarged.  A zero width or height doesn't constrain
+// that dimension, and an empty format keeps the format of the source image.
+type AttachmentRenditionSpec struct {
+	Width  int
+	Height int
+	Format string
+}
+
+// NewAttachmentRenditionSpec validates and returns the rendition spec for the requested width, height and format.
+// Width and height are optional, and an empty format keeps the format of the source image.
+func NewAttachmentRenditionSpec(width, height, format string) (*AttachmentRenditionSpec, error) {
+	spec := &AttachmentRenditionSpec{}
+	var err error
+	if spec.Width, err = parseRenditionDimension("width", width); err != nil {
+		return nil, err
+	}
+	if spec.Height, err = parseRenditionDimension("height", height); err != nil {
+		return nil, err
+	}
+
+	switch format = strings.ToLower(format); format {
+	case "", AttachmentRenditionFormatJPEG, AttachmentRenditionFormatPNG, AttachmentRenditionFormatGIF:
+		spec.Format = format
+	case "jpg":
+		spec.Format = AttachmentRenditionFormatJPEG
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unsupported rendition format %q - supported formats are %s, %s and %s",
+			format, AttachmentRenditionFormatJPEG, AttachmentRenditionFormatPNG, AttachmentRenditionFormatGIF)
+	}
+
+	if spec.Width == 0 && spec.Height == 0 && spec.Format == "" {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Rendition requires a width, height or format")
+	}
+	return spec, nil
+}
+
+func parseRenditionDimension(name, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	dimension, err := strconv.Atoi(value)
+	if err != nil || dimension <= 0 || dimension > MaxAttachmentRenditionDimension {
+		return 0, base.HTTPErrorf(http.StatusBadRequest, "Invalid rendition %s %q - must be between 1 and %d", name, value, MaxAttachmentRenditionDimension)
+	}
+	return dimension, nil
+}
+
+func (spec *AttachmentRenditionSpec) String() string {
+	return fmt.Sprintf("w%d-h%d-%s", spec.Width, spec.Height, spec.Format)
+}
+
+// MakeAttachmentRenditionKey returns the key a rendition of the attachment with the given digest is stored under.
+// Renditions depend only on the attachment data, so are shared by every document with the same attachment.
+func MakeAttachmentRenditionKey(digest string, spec *AttachmentRenditionSpec) string {
+	return base.AttRenditionPrefix + digest + ":" + spec.String()
+}
+
+// GetAttachmentRendition returns a rendition of the image attachment with the given key and digest, along with its
+// content type.  Renditions of the database's AttachmentRenditionSizes are generated on first request and stored
+// alongside the attachment data until the next attachment compaction, and other sizes are generated on every request.
+// Callers must check the user has access to the attachment.
+func (db *Database) GetAttachmentRendition(attachmentKey, digest string, spec *AttachmentRenditionSpec) (data []byte, contentType string, err error) {
+	stored := db.isStoredRendition(spec)
+	if spec.Format != "" && stored {
+		data, err = db.getAttachmentRendition(digest, spec)
+		if data != nil || err != nil {
+			return data, "image/" + spec.Format, err
+		}
+	}
+
+	source, err := db.GetAttachment(attachmentKey)
+	if err != nil {
+		return nil, "", err
+	}
+	source, config, sourceFormat, err := decodeRenditionSource(source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Renditions in the source format are stored under the resolved format
+	resolvedSpec := *spec
+	if resolvedSpec.Format == "" {
+		resolvedSpec.Format = sourceFormat
+		if stored {
+			data, err = db.getAttachmentRendition(digest, &resolvedSpec)
+			if data != nil || err != nil {
+				return data, "image/" + resolvedSpec.Format, err
+			}
+		}
+	}
+
+	data, err = generateAttachmentRendition(source, config, &resolvedSpec)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !stored {
+		return data, "image/" + resolvedSpec.Format, nil
+	}
+
+	// Concurrent requests may both generate the rendition, in which case the first one stored is kept
+	renditionKey := MakeAttachmentRenditionKey(digest, &resolvedSpec)
+	if _, err := db.attachmentStore.Add(renditionKey, data); err != nil {
+		base.WarnfCtx(db.Ctx, "Unable to store attachment rendition %s: %v", base.UD(renditionKey), err)
+	} else {
+		base.DebugfCtx(db.Ctx, base.KeyCRUD, "Generated attachment rendition %s (%d bytes)", base.UD(renditionKey), len(data))
+	}
+	return data, "image/" + resolvedSpec.Format, nil
+}
+
+// getAttachmentRendition returns a previously generated rendition, or nil if it hasn't been generated.
+func (db *Database) getAttachmentRendition(digest string, spec *AttachmentRenditionSpec) ([]byte, error) {
+	data, err := db.attachmentStore.Get(MakeAttachmentRenditionKey(digest, spec))
+	if base.IsDocNotFoundError(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// isStoredRendition returns whether renditions with the spec's dimensions are stored once generated.  Only renditions
+// of the configured sizes are stored, as the number of renditions of arbitrary sizes is unbounded.
+func (db *Database) isStoredRendition(spec *AttachmentRenditionSpec) bool {
+	return isAttachmentRenditionSize(db.Options.AttachmentRenditionSizes, spec.Width) &&
+		isAttachmentRenditionSize(db.Options.AttachmentRenditionSizes, spec.Height)
+}
+
+func isAttachmentRenditionSize(sizes []int, dimension int) bool {
+	if dimension == 0 {
+		return true
+	}
+	for _, size := range sizes {
+		if size == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeRenditionSource returns the decoded attachment data, along with the dimensions and format of the image.
+func decodeRenditionSource(source []byte) ([]byte, image.Config, string, error) {
+	// Attachments may be stored gzip encoded
+	if len(source) > 2 && source[0] == 0x1f && source[1] == 0x8b {
+		reader, err := gzip.NewReader(bytes.NewReader(source))
+		if err != nil {
+			return nil, image.Config{}, "", err
+		}
+		if source, err = ioutil.ReadAll(io.LimitReader(reader, maxAttachmentRenditionSourceBytes+1)); err != nil {
+			return nil, image.Config{}, "", err
+		}
+		if len(source) > maxAttachmentRenditionSourceBytes {
+			return nil, image.Config{}, "", base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Attachment image is too large to generate renditions from")
+		}
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(source))
+	if err != nil {
+		return nil, image.Config{}, "", base.HTTPErrorf(http.StatusUnsupportedMediaType, "Attachment isn't a supported image type")
+	}
+	return source, config, format, nil
+}
+
+// generateAttachmentRendition decodes the image and returns the rendition described by the spec, which must have a
+// format.
+func generateAttachmentRendition(source []byte, config image.Config, spec *AttachmentRenditionSpec) ([]byte, error) {
+	if config.Width*config.Height > maxAttachmentRenditionSourcePixels {
+		return nil, base.HTTPErrorf(http.StatusRequestEntityTooLarge, "Attachment image is too large to generate renditions from")
+	}
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err != nil {
+		return nil, base.HTTPErrorf(http.StatusUnsupportedMediaType, "Unable to decode attachment image: %v", err)
+	}
+
+	bounds := img.Bounds()
+	width, height := renditionSize(bounds.Dx(), bounds.Dy(), spec.Width, spec.Height)
+	if width != bounds.Dx() || height != bounds.Dy() {
+		img = resizeImage(img, width, height)
+	}
+
+	var buf bytes.Buffer
+	switch spec.Format {
+	case AttachmentRenditionFormatJPEG:
+		// JPEG has no alpha channel, so transparent areas are rendered on white rather than black
+		if !isOpaque(img) {
+			flattened := image.NewRGBA(img.Bounds())
+			draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+			draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+			img = flattened
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: attachmentRenditionJPEGQuality})
+	case AttachmentRenditionFormatPNG:
+		err = png.Encode(&buf, img)
+	case AttachmentRenditionFormatGIF:
+		err = gif.Encode(&buf, img, nil)
+	default:
+		return nil, base.HTTPErrorf(http.StatusUnsupportedMediaType, "Renditions can't be generated in %s format", spec.Format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renditionSize returns the size of an image scaled to fit within maxWidth and maxHeight (zero for unconstrained),
+// preserving the aspect ratio without enlarging it.
+func renditionSize(width, height, maxWidth, maxHeight int) (int, int) {
+	scaledWidth, scaledHeight := width, height
+	if maxWidth > 0 && scaledWidth > maxWidth {
+		scaledHeight = scaledHeight * maxWidth / scaledWidth
+		scaledWidth = maxWidth
+	}
+	if maxHeight > 0 && scaledHeight > maxHeight {
+		scaledWidth = width * maxHeight / height
+		scaledHeight = maxHeight
+	}
+	if scaledWidth < 1 {
+		scaledWidth = 1
+	}
+	if scaledHeight < 1 {
+		scaledHeight = 1
+	}
+	return scaledWidth, scaledHeight
+}
+
+// resizeImage downscales the image to the given size by averaging the source pixels covered by each pixel of the
+// result.  The size must not be larger than the image.
+func resizeImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	srcBounds := src.Bounds()
+	srcWidth, srcHeight := srcBounds.Dx(), srcBounds.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, (y+1)*srcHeight/height
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, (x+1)*srcWidth/width
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(srcBounds.Min.X+x0, srcBounds.Min.Y+sy)
+				for sx := x0; sx < x1; sx++ {
+					r += uint64(src.Pix[offset])
+					g += uint64(src.Pix[offset+1])
+					b += uint64(src.Pix[offset+2])
+					a += uint64(src.Pix[offset+3])
+					offset += 4
+					n++
+				}
+			}
+			offset := dst.PixOffset(x, y)
+			dst.Pix[offset] = uint8(r / n)
+			dst.Pix[offset+1] = uint8(g / n)
+			dst.Pix[offset+2] = uint8(b / n)
+			dst.Pix[offset+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+func isOpaque(img image.Image) bool {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok {
+		return opaque.Opaque()
+	}
+	return false
+}
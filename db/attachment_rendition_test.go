@@ -0,0 +1,184 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"compress/gzip"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPNG returns a PNG image of the given size, with the left half red and the right half blue.
+func testPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			if x < width/2 {
+				img.Set(x, y, color.RGBA{R: 255, A: 255})
+			} else {
+				img.Set(x, y, color.RGBA{B: 255, A: 255})
+			}
+		}
+	}
+	var buf bytes.Buffer
+	require.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestNewAttachmentRenditionSpec(t *testing.T) {
+	spec, err := NewAttachmentRenditionSpec("200", "", "JPG")
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentRenditionSpec{Width: 200, Format: AttachmentRenditionFormatJPEG}, *spec)
+
+	spec, err = NewAttachmentRenditionSpec("", "100", "")
+	require.NoError(t, err)
+	assert.Equal(t, AttachmentRenditionSpec{Height: 100}, *spec)
+
+	for _, invalid := range [][3]string{
+		{"", "", ""},
+		{"0", "", ""},
+		{"-1", "", ""},
+		{"abc", "", ""},
+		{"", "4097", ""},
+		{"200", "", "webp"},
+		{"200", "", "tiff"},
+	} {
+		_, err := NewAttachmentRenditionSpec(invalid[0], invalid[1], invalid[2])
+		assertHTTPError(t, err, http.StatusBadRequest)
+	}
+}
+
+func TestRenditionSize(t *testing.T) {
+	testCases := []struct {
+		width, height, maxWidth, maxHeight int
+		expectedWidth, expectedHeight      int
+	}{
+		{400, 200, 200, 0, 200, 100},
+		{400, 200, 0, 50, 100, 50},
+		{400, 200, 200, 50, 100, 50},
+		{400, 200, 1000, 1000, 400, 200}, // Never enlarged
+		{1000, 1, 10, 0, 10, 1},          // At least one pixel
+	}
+	for _, tc := range testCases {
+		width, height := renditionSize(tc.width, tc.height, tc.maxWidth, tc.maxHeight)
+		assert.Equal(t, tc.expectedWidth, width, "width for %+v", tc)
+		assert.Equal(t, tc.expectedHeight, height, "height for %+v", tc)
+	}
+}
+
+func TestResizeImage(t *testing.T) {
+	src, _, err := image.Decode(bytes.NewReader(testPNG(t, 40, 20)))
+	require.NoError(t, err)
+
+	resized := resizeImage(src, 4, 2)
+	assert.Equal(t, image.Rect(0, 0, 4, 2), resized.Bounds())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, resized.RGBAAt(0, 0))
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, resized.RGBAAt(1, 1))
+	assert.Equal(t, color.RGBA{B: 255, A: 255}, resized.RGBAAt(2, 0))
+	assert.Equal(t, color.RGBA{B: 255, A: 255}, resized.RGBAAt(3, 1))
+
+	// Pixels spanning both halves are averaged
+	resized = resizeImage(src, 1, 1)
+	assert.Equal(t, color.RGBA{R: 127, B: 127, A: 255}, resized.RGBAAt(0, 0))
+}
+
+func TestGetAttachmentRendition(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	source := testPNG(t, 400, 200)
+	digest := Sha1DigestKey(source)
+	attachmentKey := MakeAttachmentKey(AttVersion2, "doc1", digest)
+	require.NoError(t, db.setAttachment(attachmentKey, source))
+
+	// Rendition in the source format
+	spec := &AttachmentRenditionSpec{Width: 128}
+	data, contentType, err := db.GetAttachmentRendition(attachmentKey, digest, spec)
+	require.NoError(t, err)
+	assert.Equal(t, "image/png", contentType)
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "png", format)
+	assert.Equal(t, 128, config.Width)
+	assert.Equal(t, 64, config.Height)
+
+	// The rendition is stored under the resolved format
+	stored, err := db.GetAttachment(MakeAttachmentRenditionKey(digest, &AttachmentRenditionSpec{Width: 128, Format: AttachmentRenditionFormatPNG}))
+	require.NoError(t, err)
+	assert.Equal(t, data, stored)
+
+	// Rendition in another format
+	data, contentType, err = db.GetAttachmentRendition(attachmentKey, digest, &AttachmentRenditionSpec{Height: 64, Format: AttachmentRenditionFormatJPEG})
+	require.NoError(t, err)
+	assert.Equal(t, "image/jpeg", contentType)
+	config, format, err = image.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 128, config.Width)
+	assert.Equal(t, 64, config.Height)
+
+	// Stored renditions in a requested format are served without reading the source attachment
+	data, _, err = db.GetAttachmentRendition("missing", digest, &AttachmentRenditionSpec{Width: 128, Format: AttachmentRenditionFormatPNG})
+	require.NoError(t, err)
+	assert.Equal(t, stored, data)
+
+	// Renditions of other sizes are generated, but not stored
+	data, _, err = db.GetAttachmentRendition(attachmentKey, digest, &AttachmentRenditionSpec{Width: 100})
+	require.NoError(t, err)
+	config, err = png.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 100, config.Width)
+	_, err = db.GetAttachment(MakeAttachmentRenditionKey(digest, &AttachmentRenditionSpec{Width: 100, Format: AttachmentRenditionFormatPNG}))
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// gzip encoded attachments are decoded
+	var gzipped bytes.Buffer
+	writer := gzip.NewWriter(&gzipped)
+	_, err = writer.Write(testPNG(t, 10, 10))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	gzippedKey := MakeAttachmentKey(AttVersion2, "doc1", "sha1-gzipped")
+	require.NoError(t, db.setAttachment(gzippedKey, gzipped.Bytes()))
+	data, _, err = db.GetAttachmentRendition(gzippedKey, "sha1-gzipped", &AttachmentRenditionSpec{Width: 5})
+	require.NoError(t, err)
+	config, err = png.DecodeConfig(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, 5, config.Width)
+
+	// gzip encoded attachments that decompress beyond the limit are rejected without being fully decompressed
+	gzipped.Reset()
+	writer, err = gzip.NewWriterLevel(&gzipped, gzip.BestSpeed)
+	require.NoError(t, err)
+	_, err = writer.Write(make([]byte, maxAttachmentRenditionSourceBytes+1))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	bombKey := MakeAttachmentKey(AttVersion2, "doc1", "sha1-bomb")
+	require.NoError(t, db.setAttachment(bombKey, gzipped.Bytes()))
+	_, _, err = db.GetAttachmentRendition(bombKey, "sha1-bomb", spec)
+	assertHTTPError(t, err, http.StatusRequestEntityTooLarge)
+
+	// Attachments that aren't images are rejected
+	textKey := MakeAttachmentKey(AttVersion2, "doc1", "sha1-text")
+	require.NoError(t, db.setAttachment(textKey, []byte("hello")))
+	_, _, err = db.GetAttachmentRendition(textKey, "sha1-text", spec)
+	assertHTTPError(t, err, http.StatusUnsupportedMediaType)
+
+	_, _, err = db.GetAttachmentRendition(MakeAttachmentKey(AttVersion2, "doc1", "sha1-missing"), "sha1-missing", spec)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
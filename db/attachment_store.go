@@ -0,0 +1,393 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// AttachmentStoreType identifies an AttachmentStore implementation.
+type AttachmentStoreType string
+
+const (
+	AttachmentStoreTypeBucket     AttachmentStoreType = "bucket"     // Attachments stored as documents in the database bucket (default)
+	AttachmentStoreTypeFilesystem AttachmentStoreType = "filesystem" // Attachments stored as files in a local or shared directory
+	AttachmentStoreTypeS3         AttachmentStoreType = "s3"         // Attachments stored as objects in an S3-compatible object store
+)
+
+// AttachmentStore stores attachment data by attachment key (see MakeAttachmentKey).  Attachment data is immutable, so
+// an existing attachment is never overwritten.
+type AttachmentStore interface {
+	// Get returns the attachment data for the key, or a not found error if the attachment doesn't exist.
+	Get(key string) ([]byte, error)
+
+	// GetRange returns up to length bytes of the attachment data starting at offset, or all data from offset when
+	// length is zero, along with the total length of the attachment.  No data is returned when offset is at or
+	// beyond the end of the attachment.
+	GetRange(key string, offset, length int64) (data []byte, totalLength int64, err error)
+
+	// Add stores the attachment data, returning false if an attachment with the key already exists.
+	Add(key string, data []byte) (added bool, err error)
+
+	// Delete removes the attachment.  Deleting a missing attachment isn't an error.
+	Delete(key string) error
+
+	// Mark records that the attachment is referenced by a document during the compaction run with the given ID.
+	Mark(key string, compactionID string) error
+}
+
+// externalAttachmentStore is an AttachmentStore outside of the database bucket.  Attachments in the bucket are
+// enumerated via DCP, but external stores are enumerated directly by attachment compaction and migration.
+type externalAttachmentStore interface {
+	AttachmentStore
+
+	// ForEach invokes the callback with each stored attachment key, stopping when the callback returns false.
+	ForEach(callback func(key string) bool) error
+
+	// IsMarked returns true if the attachment was marked during the compaction run with the given ID.
+	IsMarked(key string, compactionID string) (bool, error)
+
+	// ClearMarks removes the marks recorded during the compaction run with the given ID.
+	ClearMarks(compactionID string) error
+}
+
+type AttachmentStoreOptions struct {
+	Type        AttachmentStoreType
+	Path        string                    // Directory attachments are stored in (filesystem)
+	S3          *S3AttachmentStoreOptions // Object store connection details (s3)
+	MigrateFrom *AttachmentStoreOptions   // Store attachments are being migrated from, read when an attachment isn't found
+}
+
+// NewAttachmentStore returns the AttachmentStore for the options, defaulting to the database bucket when options is nil.
+func NewAttachmentStore(bucket base.Bucket, options *AttachmentStoreOptions) (AttachmentStore, error) {
+	if options == nil {
+		return &bucketAttachmentStore{bucket: bucket}, nil
+	}
+	switch options.Type {
+	case AttachmentStoreTypeBucket, "":
+		return &bucketAttachmentStore{bucket: bucket}, nil
+	case AttachmentStoreTypeFilesystem:
+		store, err := newFilesystemAttachmentStore(options.Path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case AttachmentStoreTypeS3:
+		if options.S3 == nil {
+			return nil, fmt.Errorf("s3 attachment store requires s3 options")
+		}
+		store, err := newS3AttachmentStore(*options.S3)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, fmt.Errorf("unknown attachment store type %q", options.Type)
+}
+
+// newDatabaseAttachmentStore returns the store used by a database.  While attachments are being migrated, reads of
+// attachments not yet copied to the configured store fall back to the store being migrated from.
+func newDatabaseAttachmentStore(bucket base.Bucket, options *AttachmentStoreOptions) (store AttachmentStore, migrationSource AttachmentStore, err error) {
+	store, err = NewAttachmentStore(bucket, options)
+	if err != nil {
+		return nil, nil, err
+	}
+	if options == nil || options.MigrateFrom == nil {
+		return store, nil, nil
+	}
+	migrationSource, err = NewAttachmentStore(bucket, options.MigrateFrom)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &migratingAttachmentStore{AttachmentStore: store, source: migrationSource}, migrationSource, nil
+}
+
+// migratingAttachmentStore reads attachments from the migration source when they haven't yet been copied to the
+// destination store.  Writes only go to the destination.
+type migratingAttachmentStore struct {
+	AttachmentStore
+	source AttachmentStore
+}
+
+func (s *migratingAttachmentStore) Get(key string) ([]byte, error) {
+	data, err := s.AttachmentStore.Get(key)
+	if base.IsDocNotFoundError(err) {
+		return s.source.Get(key)
+	}
+	return data, err
+}
+
+func (s *migratingAttachmentStore) GetRange(key string, offset, length int64) ([]byte, int64, error) {
+	data, totalLength, err := s.AttachmentStore.GetRange(key, offset, length)
+	if base.IsDocNotFoundError(err) {
+		return s.source.GetRange(key, offset, length)
+	}
+	return data, totalLength, err
+}
+
+// Mark marks the attachment in both stores, so that compaction during a migration doesn't remove attachments that
+// haven't yet been copied.
+func (s *migratingAttachmentStore) Mark(key string, compactionID string) error {
+	if err := s.AttachmentStore.Mark(key, compactionID); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	if err := s.source.Mark(key, compactionID); err != nil && !base.IsDocNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// AttachmentMigrationConfigured returns true if the database has an attachment store to migrate attachments from.
+func (context *DatabaseContext) AttachmentMigrationConfigured() bool {
+	return context.attachmentMigrationSource != nil
+}
+
+// attachmentStoresForCompaction returns whether attachments are stored in the bucket, along with any external stores
+// holding attachments.  While attachments are being migrated both the configured store and the store being migrated
+// from are included.
+func (context *DatabaseContext) attachmentStoresForCompaction() (inBucket bool, externalStores []externalAttachmentStore) {
+	stores := []AttachmentStore{context.attachmentStore}
+	if migratingStore, ok := context.attachmentStore.(*migratingAttachmentStore); ok {
+		stores = []AttachmentStore{migratingStore.AttachmentStore, migratingStore.source}
+	}
+	for _, store := range stores {
+		switch store := store.(type) {
+		case *bucketAttachmentStore:
+			inBucket = true
+		case externalAttachmentStore:
+			externalStores = append(externalStores, store)
+		}
+	}
+	return inBucket, externalStores
+}
+
+// bucketAttachmentStore stores attachments as raw documents in the database bucket.  Compaction marks are stored in
+// an xattr on the attachment document.
+type bucketAttachmentStore struct {
+	bucket base.Bucket
+}
+
+var _ AttachmentStore = &bucketAttachmentStore{}
+
+func (s *bucketAttachmentStore) Get(key string) ([]byte, error) {
+	v, _, err := s.bucket.GetRaw(key)
+	return v, err
+}
+
+// GetRange reads the whole attachment, as documents can't be partially read.  Attachments in the bucket are limited
+// by the maximum document size.
+func (s *bucketAttachmentStore) GetRange(key string, offset, length int64) ([]byte, int64, error) {
+	data, err := s.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sliceAttachmentRange(data, offset, length), int64(len(data)), nil
+}
+
+// sliceAttachmentRange returns the requested range of the attachment data, as described by AttachmentStore.GetRange.
+func sliceAttachmentRange(data []byte, offset, length int64) []byte {
+	totalLength := int64(len(data))
+	if offset >= totalLength {
+		return []byte{}
+	}
+	end := totalLength
+	if length > 0 && offset+length < totalLength {
+		end = offset + length
+	}
+	return data[offset:end]
+}
+
+func (s *bucketAttachmentStore) Add(key string, data []byte) (added bool, err error) {
+	return s.bucket.AddRaw(key, 0, data)
+}
+
+func (s *bucketAttachmentStore) Delete(key string) error {
+	err := s.bucket.Delete(key)
+	if base.IsDocNotFoundError(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *bucketAttachmentStore) Mark(key string, compactionID string) error {
+	_, err := s.bucket.SetXattr(key, getCompactionIDSubDocPath(compactionID), []byte(strconv.Itoa(int(time.Now().Unix()))))
+	return err
+}
+
+// Attachment keys contain characters that aren't safe in file and object names, so external stores use the
+// URL-safe base64 encoding of the key.
+func encodeAttachmentStoreKey(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeAttachmentStoreKey(name string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(name)
+	return string(key), err
+}
+
+const (
+	attachmentStoreDataDir  = "attachments" // Directory (or object prefix) for attachment data in external stores
+	attachmentStoreMarksDir = "marks"       // Directory (or object prefix) for compaction marks in external stores
+)
+
+// filesystemAttachmentStore stores each attachment as a file, named by encoded attachment key.  Compaction marks are
+// stored as empty files in a directory per compaction run.
+type filesystemAttachmentStore struct {
+	path string
+}
+
+var _ externalAttachmentStore = &filesystemAttachmentStore{}
+
+// newFilesystemAttachmentStore returns a store for attachments in the given directory, creating it if necessary.
+func newFilesystemAttachmentStore(path string) (*filesystemAttachmentStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("filesystem attachment store requires a path")
+	}
+	if err := os.MkdirAll(filepath.Join(path, attachmentStoreDataDir), 0700); err != nil {
+		return nil, fmt.Errorf("unable to create attachment store directory: %w", err)
+	}
+	return &filesystemAttachmentStore{path: path}, nil
+}
+
+func (s *filesystemAttachmentStore) dataPath(key string) string {
+	return filepath.Join(s.path, attachmentStoreDataDir, encodeAttachmentStoreKey(key))
+}
+
+func (s *filesystemAttachmentStore) marksPath(compactionID string) string {
+	return filepath.Join(s.path, attachmentStoreMarksDir, compactionID)
+}
+
+func (s *filesystemAttachmentStore) Get(key string) ([]byte, error) {
+	data, err := ioutil.ReadFile(s.dataPath(key))
+	if os.IsNotExist(err) {
+		return nil, base.ErrNotFound
+	}
+	return data, err
+}
+
+func (s *filesystemAttachmentStore) GetRange(key string, offset, length int64) ([]byte, int64, error) {
+	file, err := os.Open(s.dataPath(key))
+	if os.IsNotExist(err) {
+		return nil, 0, base.ErrNotFound
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	totalLength := info.Size()
+	if offset >= totalLength {
+		return []byte{}, totalLength, nil
+	}
+	if length <= 0 || offset+length > totalLength {
+		length = totalLength - offset
+	}
+	data := make([]byte, length)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return nil, 0, err
+	}
+	return data, totalLength, nil
+}
+
+// Add writes the data to a temporary file and then links it into place, so that readers never see a partially
+// written attachment and an existing attachment is never replaced.
+func (s *filesystemAttachmentStore) Add(key string, data []byte) (added bool, err error) {
+	tempFile, err := ioutil.TempFile(filepath.Join(s.path, attachmentStoreDataDir), ".tmp-")
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = os.Remove(tempFile.Name()) }()
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Link(tempFile.Name(), s.dataPath(key))
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *filesystemAttachmentStore) Delete(key string) error {
+	err := os.Remove(s.dataPath(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *filesystemAttachmentStore) Mark(key string, compactionID string) error {
+	if err := os.MkdirAll(s.marksPath(compactionID), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.marksPath(compactionID), encodeAttachmentStoreKey(key)), nil, 0600)
+}
+
+func (s *filesystemAttachmentStore) IsMarked(key string, compactionID string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.marksPath(compactionID), encodeAttachmentStoreKey(key)))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *filesystemAttachmentStore) ClearMarks(compactionID string) error {
+	return os.RemoveAll(s.marksPath(compactionID))
+}
+
+func (s *filesystemAttachmentStore) ForEach(callback func(key string) bool) error {
+	dir, err := os.Open(filepath.Join(s.path, attachmentStoreDataDir))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = dir.Close() }()
+
+	for {
+		names, err := dir.Readdirnames(1000)
+		for _, name := range names {
+			if strings.HasPrefix(name, ".tmp-") {
+				continue
+			}
+			key, decodeErr := decodeAttachmentStoreKey(name)
+			if decodeErr != nil {
+				continue
+			}
+			if !callback(key) {
+				return nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,380 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultS3AttachmentStoreRegion is the region used to sign requests when none is configured.  S3-compatible stores
+// such as MinIO accept any region.
+const DefaultS3AttachmentStoreRegion = "us-east-1"
+
+// s3RequestTimeout bounds the time spent on a single object store request.
+const s3RequestTimeout = 60 * time.Second
+
+type S3AttachmentStoreOptions struct {
+	Endpoint  string // Object store URL, e.g. https://s3.us-east-1.amazonaws.com or a MinIO server
+	Bucket    string // Object store bucket
+	Region    string // Region used for request signing.  Defaults to DefaultS3AttachmentStoreRegion
+	Prefix    string // Prefix of all object names, allowing multiple databases to share a bucket
+	AccessKey string // Access key ID.  Requests are unsigned when empty
+	SecretKey string // Secret access key
+}
+
+// s3AttachmentStore stores each attachment as an object in an S3-compatible object store, named by encoded
+// attachment key.  Requests are path-style and signed with AWS Signature Version 4.  Compaction marks are stored as
+// empty objects under a prefix per compaction run.
+type s3AttachmentStore struct {
+	options  S3AttachmentStoreOptions
+	endpoint *url.URL
+	client   *http.Client
+}
+
+var _ externalAttachmentStore = &s3AttachmentStore{}
+
+func newS3AttachmentStore(options S3AttachmentStoreOptions) (*s3AttachmentStore, error) {
+	endpoint, err := url.Parse(options.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("s3 attachment store endpoint must be an http or https URL")
+	}
+	if options.Bucket == "" {
+		return nil, fmt.Errorf("s3 attachment store requires a bucket")
+	}
+	if options.Region == "" {
+		options.Region = DefaultS3AttachmentStoreRegion
+	}
+	return &s3AttachmentStore{
+		options:  options,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+func (s *s3AttachmentStore) dataObject(key string) string {
+	return s.options.Prefix + attachmentStoreDataDir + "/" + encodeAttachmentStoreKey(key)
+}
+
+func (s *s3AttachmentStore) marksPrefix(compactionID string) string {
+	return s.options.Prefix + attachmentStoreMarksDir + "/" + compactionID + "/"
+}
+
+func (s *s3AttachmentStore) Get(key string) ([]byte, error) {
+	resp, err := s.do(http.MethodGet, s.dataObject(key), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return nil, base.ErrNotFound
+	}
+	return nil, s3ResponseError(resp)
+}
+
+// GetRange requests only the given range of the object.  The total length is taken from the Content-Range of the
+// response, which is also returned when the range starts beyond the end of the object.
+func (s *s3AttachmentStore) GetRange(key string, offset, length int64) ([]byte, int64, error) {
+	rangeHeader := "bytes=" + strconv.FormatInt(offset, 10) + "-"
+	if length > 0 {
+		rangeHeader += strconv.FormatInt(offset+length-1, 10)
+	}
+	resp, err := s.doWithHeader(http.MethodGet, s.dataObject(key), nil, nil, http.Header{"Range": []string{rangeHeader}})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// The store ignored the range
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, err
+		}
+		return sliceAttachmentRange(data, offset, length), int64(len(data)), nil
+	case http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		totalLength, err := s3ContentRangeLength(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, 0, err
+		}
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return []byte{}, totalLength, nil
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		return data, totalLength, err
+	case http.StatusNotFound:
+		return nil, 0, base.ErrNotFound
+	}
+	return nil, 0, s3ResponseError(resp)
+}
+
+// s3ContentRangeLength returns the total length from a Content-Range header, e.g. "bytes 0-99/1234" or "bytes */1234".
+func s3ContentRangeLength(contentRange string) (int64, error) {
+	slash := strings.LastIndex(contentRange, "/")
+	if slash < 0 {
+		return 0, fmt.Errorf("object store returned invalid Content-Range %q", contentRange)
+	}
+	totalLength, err := strconv.ParseInt(contentRange[slash+1:], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("object store returned invalid Content-Range %q", contentRange)
+	}
+	return totalLength, nil
+}
+
+// Add checks for an existing object before writing.  Concurrent adds of the same key may both write, but as
+// attachment keys are derived from the content digest they write identical data.
+func (s *s3AttachmentStore) Add(key string, data []byte) (added bool, err error) {
+	exists, err := s.exists(s.dataObject(key))
+	if err != nil || exists {
+		return false, err
+	}
+	if err := s.put(s.dataObject(key), data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *s3AttachmentStore) Delete(key string) error {
+	return s.delete(s.dataObject(key))
+}
+
+func (s *s3AttachmentStore) Mark(key string, compactionID string) error {
+	return s.put(s.marksPrefix(compactionID)+encodeAttachmentStoreKey(key), nil)
+}
+
+func (s *s3AttachmentStore) IsMarked(key string, compactionID string) (bool, error) {
+	return s.exists(s.marksPrefix(compactionID) + encodeAttachmentStoreKey(key))
+}
+
+func (s *s3AttachmentStore) ClearMarks(compactionID string) error {
+	var deleteErr error
+	err := s.list(s.marksPrefix(compactionID), func(object string) bool {
+		deleteErr = s.delete(object)
+		return deleteErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	return deleteErr
+}
+
+func (s *s3AttachmentStore) ForEach(callback func(key string) bool) error {
+	prefix := s.options.Prefix + attachmentStoreDataDir + "/"
+	return s.list(prefix, func(object string) bool {
+		key, err := decodeAttachmentStoreKey(strings.TrimPrefix(object, prefix))
+		if err != nil {
+			return true
+		}
+		return callback(key)
+	})
+}
+
+func (s *s3AttachmentStore) exists(object string) (bool, error) {
+	resp, err := s.do(http.MethodHead, object, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, s3ResponseError(resp)
+}
+
+func (s *s3AttachmentStore) put(object string, data []byte) error {
+	resp, err := s.do(http.MethodPut, object, nil, data)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	return nil
+}
+
+func (s *s3AttachmentStore) delete(object string) error {
+	resp, err := s.do(http.MethodDelete, object, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3ResponseError(resp)
+	}
+	return nil
+}
+
+// s3ListResult is the subset of the ListObjectsV2 response used to enumerate objects.
+type s3ListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list invokes the callback with the name of each object with the given prefix, stopping when the callback returns
+// false.
+func (s *s3AttachmentStore) list(prefix string, callback func(object string) bool) error {
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		resp, err := s.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			err = s3ResponseError(resp)
+			_ = resp.Body.Close()
+			return err
+		}
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		_ = resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("unable to parse object store list response: %w", err)
+		}
+		for _, content := range result.Contents {
+			if !callback(content.Key) {
+				return nil
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// do sends a signed request for the object (or the bucket, when object is empty).
+func (s *s3AttachmentStore) do(method string, object string, query url.Values, body []byte) (*http.Response, error) {
+	return s.doWithHeader(method, object, query, body, nil)
+}
+
+// doWithHeader sends a signed request with additional headers, which aren't included in the signature.
+func (s *s3AttachmentStore) doWithHeader(method string, object string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	requestURL := *s.endpoint
+	requestURL.Path = strings.TrimSuffix(requestURL.Path, "/") + "/" + s.options.Bucket
+	if object != "" {
+		requestURL.Path += "/" + object
+	}
+	requestURL.RawPath = ""
+	requestURL.RawQuery = s3CanonicalQuery(query)
+
+	ctx, cancel := context.WithTimeout(context.Background(), s3RequestTimeout)
+	req, err := http.NewRequestWithContext(ctx, method, requestURL.String(), bytes.NewReader(body))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	s.sign(req, body, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnCloseBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+func (s *s3AttachmentStore) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := hexSHA256(body)
+	amzDate := now.UTC().Format("20060102T150405Z")
+	dateStamp := now.UTC().Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.options.AccessKey == "" {
+		return
+	}
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := dateStamp + "/" + s.options.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(canonicalRequest))
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.options.SecretKey), dateStamp)
+	signingKey = hmacSHA256(signingKey, s.options.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.options.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3CanonicalQuery encodes the query with sorted keys and %20 for spaces, as required for signing.
+func s3CanonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3ResponseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("object store returned status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+}
+
+// cancelOnCloseBody releases the request context once the response body has been read.
+type cancelOnCloseBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnCloseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testS3Server is a minimal in-memory S3-compatible object store, supporting the requests made by s3AttachmentStore.
+// Object listings are paginated with listPageSize objects per page.
+type testS3Server struct {
+	*httptest.Server
+	bucket       string
+	listPageSize int
+	lock         sync.Mutex
+	objects      map[string][]byte
+	requests     []*http.Request
+}
+
+func newTestS3Server(t *testing.T, bucket string) *testS3Server {
+	s := &testS3Server{
+		bucket:       bucket,
+		listPageSize: 2,
+		objects:      make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testS3Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r)
+
+	bucketPath := "/" + s.bucket
+	if r.URL.Path == bucketPath && r.Method == http.MethodGet {
+		s.list(w, r)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, bucketPath+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	object := strings.TrimPrefix(r.URL.Path, bucketPath+"/")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[object]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodGet {
+			// Handles Range requests
+			http.ServeContent(w, r, object, time.Time{}, bytes.NewReader(data))
+		}
+	case http.MethodPut:
+		data, _ := ioutil.ReadAll(r.Body)
+		s.objects[object] = data
+	case http.MethodDelete:
+		delete(s.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *testS3Server) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	end := start + s.listPageSize
+	var result s3ListResult
+	if end < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(end)
+	} else {
+		end = len(keys)
+	}
+	for _, key := range keys[start:end] {
+		result.Contents = append(result.Contents, struct {
+			Key string `xml:"Key"`
+		}{Key: key})
+	}
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func (s *testS3Server) objectCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.objects)
+}
+
+// testAttachmentStore exercises the behaviour common to all external attachment stores.
+func testAttachmentStore(t *testing.T, store externalAttachmentStore) {
+	_, err := store.Get("_sync:att:sha1-missing")
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	keys := []string{"_sync:att:sha1-a/b+c=", "_sync:att:sha1-d", "_sync:att2:sha1-e"}
+	for _, key := range keys {
+		added, err := store.Add(key, []byte("data for "+key))
+		require.NoError(t, err)
+		assert.True(t, added)
+	}
+
+	// Existing attachments aren't replaced
+	added, err := store.Add(keys[0], []byte("replacement"))
+	require.NoError(t, err)
+	assert.False(t, added)
+	data, err := store.Get(keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, "data for "+keys[0], string(data))
+
+	testAttachmentStoreGetRange(t, store, keys[1])
+
+	var found []string
+	require.NoError(t, store.ForEach(func(key string) bool {
+		found = append(found, key)
+		return true
+	}))
+	assert.ElementsMatch(t, keys, found)
+
+	// Iteration stops when the callback returns false
+	found = nil
+	require.NoError(t, store.ForEach(func(key string) bool {
+		found = append(found, key)
+		return false
+	}))
+	assert.Len(t, found, 1)
+
+	require.NoError(t, store.Mark(keys[1], "compact1"))
+	marked, err := store.IsMarked(keys[1], "compact1")
+	require.NoError(t, err)
+	assert.True(t, marked)
+	marked, err = store.IsMarked(keys[0], "compact1")
+	require.NoError(t, err)
+	assert.False(t, marked)
+	marked, err = store.IsMarked(keys[1], "compact2")
+	require.NoError(t, err)
+	assert.False(t, marked)
+
+	require.NoError(t, store.ClearMarks("compact1"))
+	marked, err = store.IsMarked(keys[1], "compact1")
+	require.NoError(t, err)
+	assert.False(t, marked)
+
+	require.NoError(t, store.Delete(keys[0]))
+	_, err = store.Get(keys[0])
+	assert.True(t, base.IsDocNotFoundError(err))
+	require.NoError(t, store.Delete(keys[0]))
+}
+
+// testAttachmentStoreGetRange checks ranged reads of an attachment with data "data for " + key.
+func testAttachmentStoreGetRange(t *testing.T, store AttachmentStore, key string) {
+	expected := "data for " + key
+	tests := []struct {
+		offset, length int64
+		data           string
+	}{
+		{offset: 0, length: 4, data: expected[:4]},
+		{offset: 5, length: 3, data: expected[5:8]},
+		{offset: 5, length: 0, data: expected[5:]},
+		{offset: 5, length: 1000, data: expected[5:]},
+		{offset: int64(len(expected)), length: 4, data: ""},
+		{offset: int64(len(expected)) + 10, length: 4, data: ""},
+	}
+	for _, test := range tests {
+		data, totalLength, err := store.GetRange(key, test.offset, test.length)
+		require.NoError(t, err, "offset %d length %d", test.offset, test.length)
+		assert.Equal(t, test.data, string(data), "offset %d length %d", test.offset, test.length)
+		assert.Equal(t, int64(len(expected)), totalLength)
+	}
+	_, _, err := store.GetRange("_sync:att:sha1-missing", 0, 1)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestBucketAttachmentStoreGetRange(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+	store, err := NewAttachmentStore(bucket, nil)
+	require.NoError(t, err)
+	key := "_sync:att:sha1-a"
+	_, err = store.Add(key, []byte("data for "+key))
+	require.NoError(t, err)
+	testAttachmentStoreGetRange(t, store, key)
+}
+
+func TestFilesystemAttachmentStore(t *testing.T) {
+	store, err := NewAttachmentStore(nil, &AttachmentStoreOptions{Type: AttachmentStoreTypeFilesystem, Path: t.TempDir()})
+	require.NoError(t, err)
+	testAttachmentStore(t, store.(externalAttachmentStore))
+
+	_, err = NewAttachmentStore(nil, &AttachmentStoreOptions{Type: AttachmentStoreTypeFilesystem})
+	assert.Error(t, err)
+}
+
+func TestS3AttachmentStore(t *testing.T) {
+	server := newTestS3Server(t, "attachments")
+	store, err := NewAttachmentStore(nil, &AttachmentStoreOptions{
+		Type: AttachmentStoreTypeS3,
+		S3: &S3AttachmentStoreOptions{
+			Endpoint:  server.URL,
+			Bucket:    "attachments",
+			Prefix:    "db1/",
+			AccessKey: "AKIDEXAMPLE",
+			SecretKey: "secret",
+		},
+	})
+	require.NoError(t, err)
+	testAttachmentStore(t, store.(externalAttachmentStore))
+
+	// All objects are stored under the prefix, and all requests are signed
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	for object := range server.objects {
+		assert.True(t, strings.HasPrefix(object, "db1/"), "object %s outside of prefix", object)
+	}
+	rangeRequests := 0
+	for _, r := range server.requests {
+		if r.Header.Get("Range") != "" {
+			rangeRequests++
+		}
+		auth := r.Header.Get("Authorization")
+		assert.True(t, strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/"), "unexpected Authorization header %q", auth)
+		assert.Contains(t, auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=")
+		assert.NotEmpty(t, r.Header.Get("x-amz-date"))
+		assert.NotEmpty(t, r.Header.Get("x-amz-content-sha256"))
+	}
+	assert.Greater(t, rangeRequests, 0)
+}
+
+func TestS3AttachmentStoreOptions(t *testing.T) {
+	_, err := NewAttachmentStore(nil, &AttachmentStoreOptions{Type: AttachmentStoreTypeS3})
+	assert.Error(t, err)
+	_, err = NewAttachmentStore(nil, &AttachmentStoreOptions{Type: AttachmentStoreTypeS3, S3: &S3AttachmentStoreOptions{Endpoint: "ftp://example.com", Bucket: "b"}})
+	assert.Error(t, err)
+	_, err = NewAttachmentStore(nil, &AttachmentStoreOptions{Type: AttachmentStoreTypeS3, S3: &S3AttachmentStoreOptions{Endpoint: "http://example.com"}})
+	assert.Error(t, err)
+	_, err = NewAttachmentStore(nil, &AttachmentStoreOptions{Type: "unknown"})
+	assert.Error(t, err)
+}
+
+func TestFilesystemAttachmentStoreDatabase(t *testing.T) {
+	path := t.TempDir()
+	db := setupTestDBWithOptions(t, DatabaseContextOptions{
+		AttachmentStoreOptions: &AttachmentStoreOptions{Type: AttachmentStoreTypeFilesystem, Path: path},
+	})
+	defer db.Close()
+
+	var body Body
+	require.NoError(t, base.JSONUnmarshal([]byte(`{"_attachments": {"hello.txt": {"data":"aGVsbG8gd29ybGQ="}}}`), &body))
+	_, _, err := db.Put("doc1", body)
+	require.NoError(t, err)
+
+	store, err := newFilesystemAttachmentStore(path)
+	require.NoError(t, err)
+	var keys []string
+	require.NoError(t, store.ForEach(func(key string) bool {
+		keys = append(keys, key)
+		return true
+	}))
+	require.Len(t, keys, 1)
+
+	data, err := db.GetAttachment(keys[0])
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	// The attachment isn't stored in the bucket
+	_, _, err = db.Bucket.GetRaw(keys[0])
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestMigrateAttachments(t *testing.T) {
+	sourcePath := t.TempDir()
+	server := newTestS3Server(t, "attachments")
+	db := setupTestDBWithOptions(t, DatabaseContextOptions{
+		AttachmentStoreOptions: &AttachmentStoreOptions{
+			Type: AttachmentStoreTypeS3,
+			S3:   &S3AttachmentStoreOptions{Endpoint: server.URL, Bucket: "attachments"},
+			MigrateFrom: &AttachmentStoreOptions{
+				Type: AttachmentStoreTypeFilesystem,
+				Path: sourcePath,
+			},
+		},
+	})
+	defer db.Close()
+	require.True(t, db.AttachmentMigrationConfigured())
+
+	source, err := newFilesystemAttachmentStore(sourcePath)
+	require.NoError(t, err)
+	for _, key := range []string{"_sync:att:sha1-a", "_sync:att:sha1-b", "_sync:att2:sha1-c"} {
+		_, err := source.Add(key, []byte(key))
+		require.NoError(t, err)
+	}
+
+	// Attachments not yet migrated are read from the source
+	data, err := db.GetAttachment("_sync:att:sha1-a")
+	require.NoError(t, err)
+	assert.Equal(t, "_sync:att:sha1-a", string(data))
+
+	// Attachments already in the destination are skipped
+	_, err = db.attachmentStore.Add("_sync:att:sha1-b", []byte("_sync:att:sha1-b"))
+	require.NoError(t, err)
+
+	var migrated, skipped base.AtomicInt
+	require.NoError(t, migrateAttachments(db, true, base.NewSafeTerminator(), &migrated, &skipped))
+	assert.Equal(t, int64(2), migrated.Value())
+	assert.Equal(t, int64(1), skipped.Value())
+	assert.Equal(t, 3, server.objectCount())
+
+	// The source attachments were deleted, and the attachments are read from the destination
+	_, err = source.Get("_sync:att:sha1-a")
+	assert.True(t, base.IsDocNotFoundError(err))
+	data, err = db.GetAttachment("_sync:att2:sha1-c")
+	require.NoError(t, err)
+	assert.Equal(t, "_sync:att2:sha1-c", string(data))
+}
+
+func TestMigrateAttachmentsNotConfigured(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	assert.False(t, db.AttachmentMigrationConfigured())
+
+	var migrated, skipped base.AtomicInt
+	err := migrateAttachments(db, false, base.NewSafeTerminator(), &migrated, &skipped)
+	assert.Equal(t, ErrNoAttachmentMigration, err)
+}
+
+func TestAttachmentCompactExternalSweep(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	store, err := newFilesystemAttachmentStore(t.TempDir())
+	require.NoError(t, err)
+	for _, key := range []string{"_sync:att:sha1-marked", "_sync:att:sha1-unmarked", "_sync:att2:sha1-v2", "_sync:attr:sha1-marked:w64-h0-png"} {
+		_, err := store.Add(key, []byte(key))
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Mark("_sync:att:sha1-marked", "compact1"))
+
+	// Dry run doesn't remove anything
+	var purged base.AtomicInt
+	require.NoError(t, attachmentCompactExternalSweep(db, store, "compact1", true, base.NewSafeTerminator(), &purged))
+	assert.Equal(t, int64(1), purged.Value())
+	_, err = store.Get("_sync:att:sha1-unmarked")
+	require.NoError(t, err)
+	_, err = store.Get("_sync:attr:sha1-marked:w64-h0-png")
+	require.NoError(t, err)
+
+	// Only unmarked v1 attachments and renditions are removed
+	purged.Set(0)
+	require.NoError(t, attachmentCompactExternalSweep(db, store, "compact1", false, base.NewSafeTerminator(), &purged))
+	assert.Equal(t, int64(1), purged.Value())
+	_, err = store.Get("_sync:att:sha1-unmarked")
+	assert.True(t, base.IsDocNotFoundError(err))
+	_, err = store.Get("_sync:att:sha1-marked")
+	assert.NoError(t, err)
+	_, err = store.Get("_sync:att2:sha1-v2")
+	assert.NoError(t, err)
+	_, err = store.Get("_sync:attr:sha1-marked:w64-h0-png")
+	assert.True(t, base.IsDocNotFoundError(err))
+}
@@ -0,0 +1,79 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package db
+
+import (
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// =====================================================================
+// Attachment Migration Implementation of Background Manager Process
+// =====================================================================
+
+type AttachmentMigrationManager struct {
+	MigratedAttachments base.AtomicInt
+	SkippedAttachments  base.AtomicInt
+	deleteSource        bool
+	lock                sync.Mutex
+}
+
+var _ BackgroundManagerProcessI = &AttachmentMigrationManager{}
+
+func NewAttachmentMigrationManager() *BackgroundManager {
+	return &BackgroundManager{
+		Process:    &AttachmentMigrationManager{},
+		terminator: base.NewSafeTerminator(),
+	}
+}
+
+func (a *AttachmentMigrationManager) Init(options map[string]interface{}, clusterStatus []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.deleteSource, _ = options["deleteSource"].(bool)
+	return nil
+}
+
+func (a *AttachmentMigrationManager) Run(options map[string]interface{}, persistClusterStatusCallback updateStatusCallbackFunc, terminator *base.SafeTerminator) error {
+	database := options["database"].(*Database)
+	return migrateAttachments(database, a.deleteSource, terminator, &a.MigratedAttachments, &a.SkippedAttachments)
+}
+
+type AttachmentMigrationManagerResponse struct {
+	BackgroundManagerStatus
+	MigratedAttachments int64 `json:"migrated_attachments"`
+	SkippedAttachments  int64 `json:"skipped_attachments"`
+	DeleteSource        bool  `json:"delete_source,omitempty"`
+}
+
+func (a *AttachmentMigrationManager) GetProcessStatus(status BackgroundManagerStatus) ([]byte, []byte, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	response := AttachmentMigrationManagerResponse{
+		BackgroundManagerStatus: status,
+		MigratedAttachments:     a.MigratedAttachments.Value(),
+		SkippedAttachments:      a.SkippedAttachments.Value(),
+		DeleteSource:            a.deleteSource,
+	}
+
+	statusJSON, err := base.JSONMarshal(response)
+	return statusJSON, nil, err
+}
+
+func (a *AttachmentMigrationManager) ResetStatus() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.MigratedAttachments.Set(0)
+	a.SkippedAttachments.Set(0)
+	a.deleteSource = false
+}
@@ -23,14 +23,27 @@ const (
 	// sub protocol.  One must match identically with one provided by the peer (CBLite / ISGR)
 	BlipCBMobileReplicationV2 = "CBMobile_2"
 	BlipCBMobileReplicationV3 = "CBMobile_3"
+
+	// BlipCBMobileReplicationV3Chunked is BlipCBMobileReplicationV3 with support for chunked getAttachment requests
+	// (see GetAttachmentOffset/GetAttachmentLength), allowing large attachment transfers to resume after a disconnect.
+	BlipCBMobileReplicationV3Chunked = "CBMobile_3_chunked"
 )
 
 // NewSGBlipContext returns a go-blip context with the given ID, initialized for use in Sync Gateway.
 func NewSGBlipContext(ctx context.Context, id string) (bc *blip.Context, err error) {
-	// V3 is first here as it is the preferred communication method
-	// In the host case this means SGW can accept both V3 and V2 clients
-	// In the client case this means we prefer V3 but can fallback to V2
-	return NewSGBlipContextWithProtocols(ctx, id, BlipCBMobileReplicationV3, BlipCBMobileReplicationV2)
+	// V3 chunked is first here as it is the preferred communication method
+	// In the host case this means SGW can accept V3 chunked, V3 and V2 clients
+	// In the client case this means we prefer V3 chunked but can fallback to V3 or V2
+	return NewSGBlipContextWithProtocols(ctx, id, BlipCBMobileReplicationV3Chunked, BlipCBMobileReplicationV3, BlipCBMobileReplicationV2)
+}
+
+// BlipSubprotocolVersion returns the replication protocol version for the negotiated subprotocol.  Subprotocols that
+// extend V3 with additional capabilities are reported as BlipCBMobileReplicationV3.
+func BlipSubprotocolVersion(subprotocol string) string {
+	if subprotocol == BlipCBMobileReplicationV3Chunked {
+		return BlipCBMobileReplicationV3
+	}
+	return subprotocol
 }
 
 func NewSGBlipContextWithProtocols(ctx context.Context, id string, protocol ...string) (bc *blip.Context, err error) {
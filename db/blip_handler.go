@@ -23,6 +23,7 @@ import (
 
 	"github.com/couchbase/go-blip"
 	sgbucket "github.com/couchbase/sg-bucket"
+	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/couchbase/sync_gateway/channels"
 )
@@ -32,12 +33,12 @@ var kHandlersByProfile = map[string]blipHandlerFunc{
 	MessageGetCheckpoint:   (*blipHandler).handleGetCheckpoint,
 	MessageSetCheckpoint:   (*blipHandler).handleSetCheckpoint,
 	MessageSubChanges:      userBlipHandler((*blipHandler).handleSubChanges),
-	MessageChanges:         userBlipHandler((*blipHandler).handleChanges),
-	MessageRev:             userBlipHandler((*blipHandler).handleRev),
+	MessageChanges:         writeBlipHandler(userBlipHandler((*blipHandler).handleChanges)),
+	MessageRev:             writeBlipHandler(userBlipHandler((*blipHandler).handleRev)),
 	MessageNoRev:           (*blipHandler).handleNoRev,
 	MessageGetAttachment:   userBlipHandler((*blipHandler).handleGetAttachment),
 	MessageProveAttachment: userBlipHandler((*blipHandler).handleProveAttachment),
-	MessageProposeChanges:  (*blipHandler).handleProposeChanges,
+	MessageProposeChanges:  writeBlipHandler((*blipHandler).handleProposeChanges),
 }
 
 // maxInFlightChangesBatches is the maximum number of in-flight changes batches a client is allowed to send without being throttled.
@@ -89,6 +90,17 @@ func userBlipHandler(next blipHandlerFunc) blipHandlerFunc {
 	}
 }
 
+// writeBlipHandler wraps a blip handler for a message that pushes changes, rejecting it when the replication was
+// authenticated with a read-only API key.
+func writeBlipHandler(next blipHandlerFunc) blipHandlerFunc {
+	return func(bh *blipHandler, bm *blip.Message) error {
+		if key, ok := auth.AuthenticatedAPIKey(bh.db.User()); ok && key.Scopes.ReadOnly {
+			return base.HTTPErrorf(http.StatusForbidden, "API key is read-only")
+		}
+		return next(bh, bm)
+	}
+}
+
 func (bh *blipHandler) refreshUser() error {
 
 	bc := bh.BlipSyncContext
@@ -105,6 +117,7 @@ func (bh *blipHandler) refreshUser() error {
 				bc.dbUserLock.Unlock()
 				return err
 			}
+			newUser = auth.WithAPIKeyScopes(bc.blipContextDb.User(), newUser)
 			newUser.InitializeRoles()
 			bc.userChangeWaiter.RefreshUserKeys(newUser)
 			bc.blipContextDb.SetUser(newUser)
@@ -185,9 +198,13 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 		return base.HTTPErrorf(http.StatusBadRequest, "Invalid subChanges parameters")
 	}
 
-	// Ensure that only _one_ subChanges subscription can be open on this blip connection at any given time.  SG #3222.
-	if !bh.activeSubChanges.CASRetry(false, true) {
-		return fmt.Errorf("blipHandler already has an outstanding continous subChanges.  Cannot open another one.")
+	if sinceTime, found := subChangesParams.sinceTime(); found {
+		if _, found := rq.Properties[SubChangesSince]; found {
+			return base.HTTPErrorf(http.StatusBadRequest, "Only one of '%s' and '%s' can be specified", SubChangesSince, SubChangesSinceTime)
+		}
+		if subChangesParams._since, err = bh.db.ParseSinceTime(sinceTime); err != nil {
+			return err
+		}
 	}
 
 	if len(subChangesParams.docIDs()) > 0 && subChangesParams.continuous() {
@@ -197,6 +214,7 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 	bh.logEndpointEntry(rq.Profile(), subChangesParams.String())
 
 	var channels base.Set
+	var predicate *ChangesPredicate
 	if filter := subChangesParams.filter(); filter == base.ByChannelFilter {
 		var err error
 
@@ -207,8 +225,14 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 			return base.HTTPErrorf(http.StatusBadRequest, "Empty channel list")
 
 		}
+	} else if filter == base.PredicateFilter {
+		var err error
+		predicate, err = subChangesParams.predicate()
+		if err != nil {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid predicate: %s", err)
+		}
 	} else if filter != "" {
-		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel")
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try sync_gateway/bychannel or sync_gateway/predicate")
 	}
 
 	clientType := clientTypeCBL2
@@ -216,6 +240,11 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 		clientType = clientTypeSGR2
 	}
 
+	// Ensure that only _one_ subChanges subscription can be open on this blip connection at any given time.  SG #3222.
+	if !bh.activeSubChanges.CASRetry(false, true) {
+		return fmt.Errorf("blipHandler already has an outstanding continous subChanges.  Cannot open another one.")
+	}
+
 	continuous := subChangesParams.continuous()
 	// used for stats tracking
 	bh.continuous = continuous
@@ -226,6 +255,12 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 			bh.replicationStats.SubChangesContinuousActive.Add(1)
 			defer bh.replicationStats.SubChangesContinuousActive.Add(-1)
 			bh.replicationStats.SubChangesContinuousTotal.Add(1)
+			// Clients with an active continuous replication don't need to be woken by push notifications
+			if pushNotifier := bh.db.pushNotifier; pushNotifier != nil && bh.db.User() != nil {
+				username := bh.db.User().Name()
+				pushNotifier.clientConnected(username)
+				defer pushNotifier.clientDisconnected(username)
+			}
 		} else {
 			bh.replicationStats.SubChangesOneShotActive.Add(1)
 			defer bh.replicationStats.SubChangesOneShotActive.Add(-1)
@@ -244,6 +279,7 @@ func (bh *blipHandler) handleSubChanges(rq *blip.Message) error {
 			activeOnly:        subChangesParams.activeOnly(),
 			batchSize:         subChangesParams.batchSize(),
 			channels:          channels,
+			predicate:         predicate,
 			revocations:       subChangesParams.revocations(),
 			clientType:        clientType,
 			ignoreNoConflicts: clientType == clientTypeSGR2, // force this side to accept a "changes" message, even in no conflicts mode for SGR2.
@@ -268,6 +304,7 @@ type sendChangesOptions struct {
 	activeOnly        bool
 	batchSize         int
 	channels          base.Set
+	predicate         *ChangesPredicate // Only send changes to documents matching the predicate, when set
 	clientType        clientType
 	revocations       bool
 	ignoreNoConflicts bool
@@ -334,9 +371,23 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, opts *sendChangesOptions
 				for _, item := range change.Changes {
 					changeRow := bh.buildChangesRow(change, item["rev"])
 
+					// Filter changes by predicate.  Tombstones and channel removals are always sent, as the client may
+					// have a previous revision of the document.
+					if opts.predicate != nil && !change.Deleted && !change.allRemoved {
+						matches, sendRemoval := bh.evaluateChangesPredicate(changesDb, opts, change.ID, item["rev"])
+						if !matches {
+							if !sendRemoval {
+								continue
+							}
+							removal := *change
+							removal.allRemoved = true
+							changeRow = bh.buildChangesRow(&removal, item["rev"])
+						}
+					}
+
 					// If change is a removal and we're running with protocol V3 and change change is not a tombstone
 					// fall into 3.0 removal handling
-					if change.allRemoved && bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3 && !change.Deleted {
+					if change.allRemoved && bh.activeSubprotocol() == BlipCBMobileReplicationV3 && !change.Deleted {
 
 						// If client doesn't want removals / revocations, don't send change
 						if !opts.revocations {
@@ -396,10 +447,41 @@ func (bh *blipHandler) sendChanges(sender *blip.Sender, opts *sendChangesOptions
 	return !forceClose
 }
 
+// evaluateChangesPredicate determines whether the given revision matches the predicate for a predicate-filtered
+// changes feed.  When it doesn't match, sendRemoval identifies whether the document has left the predicate (the parent
+// revision matched), and the client should be sent a removal.  Removals are only sent to clients using protocol V3
+// that requested revocations, and not for feeds starting from zero, where the client can't have a previous revision.
+func (bh *blipHandler) evaluateChangesPredicate(changesDb *Database, opts *sendChangesOptions, docID, revID string) (matches bool, sendRemoval bool) {
+	rev, matches, err := changesDb.revisionMatchesPredicate(opts.predicate, docID, revID)
+	if err != nil {
+		// Unable to evaluate, so send the change - the client is authorized to see the document regardless of the predicate
+		base.WarnfCtx(bh.loggingCtx, "Unable to evaluate predicate for %s/%s, will send change: %v", base.UD(docID), revID, err)
+		return true, false
+	}
+	if matches {
+		return true, false
+	}
+
+	if !opts.revocations || !opts.since.IsNonZero() || bh.activeSubprotocol() != BlipCBMobileReplicationV3 {
+		return false, false
+	}
+	history := rev.History.ParseRevisions()
+	if len(history) < 2 {
+		return false, false
+	}
+	_, parentMatches, err := changesDb.revisionMatchesPredicate(opts.predicate, docID, history[1])
+	if err != nil {
+		// As for revocations, if the parent revision isn't available the safer option is to send the removal
+		base.DebugfCtx(bh.loggingCtx, base.KeySync, "Unable to evaluate predicate for parent revision %s/%s, will send removal: %v", base.UD(docID), history[1], err)
+		return false, true
+	}
+	return false, parentMatches
+}
+
 func (bh *blipHandler) buildChangesRow(change *ChangeEntry, revID string) []interface{} {
 	var changeRow []interface{}
 
-	if bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3 {
+	if bh.activeSubprotocol() == BlipCBMobileReplicationV3 {
 		deletedFlags := changesDeletedFlag(0)
 		if change.Deleted {
 			deletedFlags |= changesDeletedFlagDeleted
@@ -559,7 +641,7 @@ func (bh *blipHandler) handleChanges(rq *blip.Message) error {
 
 		}
 
-		if bh.purgeOnRemoval && bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3 &&
+		if bh.purgeOnRemoval && bh.activeSubprotocol() == BlipCBMobileReplicationV3 &&
 			(deletedFlags.HasFlag(changesDeletedFlagRevoked) || deletedFlags.HasFlag(changesDeletedFlagRemoved)) {
 			err := bh.db.Purge(docID)
 			if err != nil {
@@ -661,6 +743,10 @@ func (bh *blipHandler) handleProposeChanges(rq *blip.Message) error {
 			parentRevID = change[2].(string)
 		}
 		status, currentRev := bh.db.CheckProposedRev(docID, revID, parentRevID)
+		if status == ProposedRev_Conflict && bh.conflictResolver != nil {
+			// Conflicts will be resolved when the revision is pushed, so the client can send it
+			status = ProposedRev_OK
+		}
 		if status != 0 {
 			// Skip writing trailing zeroes; but if we write a number afterwards we have to catch up
 			if nWritten > 0 {
@@ -746,7 +832,7 @@ func (bh *blipHandler) handleNoRev(rq *blip.Message) error {
 		rq.String(), base.UD(rq.Properties[NorevMessageId]), rq.Properties[NorevMessageRev], rq.Properties[NorevMessageError], rq.Properties[NorevMessageReason])
 
 	if bh.sgr2PullProcessedSeqCallback != nil {
-		if bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV2 && bh.clientType == BLIPClientTypeSGR2 {
+		if bh.activeSubprotocol() == BlipCBMobileReplicationV2 && bh.clientType == BLIPClientTypeSGR2 {
 			bh.sgr2PullProcessedSeqCallback(rq.Properties[NorevMessageSeq], IDAndRev{DocID: rq.Properties[NorevMessageId], RevID: rq.Properties[NorevMessageRev]})
 		} else {
 			bh.sgr2PullProcessedSeqCallback(rq.Properties[NorevMessageSequence], IDAndRev{DocID: rq.Properties[NorevMessageId], RevID: rq.Properties[NorevMessageRev]})
@@ -942,8 +1028,10 @@ func (bh *blipHandler) handleRev(rq *blip.Message) (err error) {
 	// If a conflict resolver is defined for the handler, write with conflict resolution.
 
 	// If the doc is a tombstone we want to allow conflicts when running SGR2
-	// bh.conflictResolver != nil represents an active SGR2 and BLIPClientTypeSGR2 represents a passive SGR2
-	forceAllowConflictingTombstone := newDoc.Deleted && (bh.conflictResolver != nil || bh.clientType == BLIPClientTypeSGR2)
+	// bh.conflictResolver != nil represents an active SGR2 (unless the client is CBL, when it represents client conflict
+	// resolution) and BLIPClientTypeSGR2 represents a passive SGR2
+	isActiveSGR2 := bh.conflictResolver != nil && bh.clientType != BLIPClientTypeCBL2
+	forceAllowConflictingTombstone := newDoc.Deleted && (isActiveSGR2 || bh.clientType == BLIPClientTypeSGR2)
 	if bh.conflictResolver != nil {
 		_, _, err = bh.db.PutExistingRevWithConflictResolution(newDoc, history, true, bh.conflictResolver, forceAllowConflictingTombstone, rawBucketDoc)
 	} else {
@@ -1011,7 +1099,7 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 
 	docID := ""
 	attachmentAllowedKey := digest
-	if bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3 {
+	if bh.activeSubprotocol() == BlipCBMobileReplicationV3 {
 		docID = getAttachmentParams.docID()
 		if docID == "" {
 			return base.HTTPErrorf(http.StatusBadRequest, "Missing 'docID'")
@@ -1024,18 +1112,54 @@ func (bh *blipHandler) handleGetAttachment(rq *blip.Message) error {
 		return base.HTTPErrorf(http.StatusForbidden, "Attachment's doc not being synced")
 	}
 
-	if bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV2 {
+	if bh.activeSubprotocol() == BlipCBMobileReplicationV2 {
 		docID = allowedAttachment.docID
 	}
 
-	attachmentKey := MakeAttachmentKey(allowedAttachment.version, docID, digest)
-	attachment, err := bh.db.GetAttachment(attachmentKey)
+	offset, length, isChunk, err := getAttachmentParams.chunk()
 	if err != nil {
 		return err
+	}
+	if isChunk && !bh.chunkedAttachments() {
+		return base.HTTPErrorf(http.StatusBadRequest, "Chunked getAttachment requires the %s subprotocol", BlipCBMobileReplicationV3Chunked)
+	}
 
+	rendition, err := getAttachmentParams.rendition()
+	if err != nil {
+		return err
 	}
-	base.DebugfCtx(bh.loggingCtx, base.KeySync, "Sending attachment with digest=%q (%.2f KB)", digest, float64(len(attachment))/float64(1024))
+
 	response := rq.Response()
+	attachmentKey := MakeAttachmentKey(allowedAttachment.version, docID, digest)
+	var attachment []byte
+	var totalLength int64
+	if rendition != nil {
+		var contentType string
+		attachment, contentType, err = bh.db.GetAttachmentRendition(attachmentKey, digest, rendition)
+		response.Properties[GetAttachmentResponseContentType] = contentType
+		totalLength = int64(len(attachment))
+		if isChunk {
+			attachment = sliceAttachmentRange(attachment, offset, length)
+		}
+	} else if isChunk {
+		// Only the requested chunk is read from the attachment store
+		attachment, totalLength, err = bh.db.GetAttachmentRange(attachmentKey, offset, length)
+	} else {
+		attachment, err = bh.db.GetAttachment(attachmentKey)
+	}
+	if err != nil {
+		return err
+
+	}
+	if isChunk {
+		if offset > totalLength {
+			return base.HTTPErrorf(http.StatusBadRequest, "Offset %d is beyond the end of the attachment (%d bytes)", offset, totalLength)
+		}
+		response.Properties[GetAttachmentResponseTotalLength] = strconv.FormatInt(totalLength, 10)
+		base.DebugfCtx(bh.loggingCtx, base.KeySync, "Sending attachment chunk with digest=%q at offset %d (%.2f KB of %.2f KB)", digest, offset, float64(len(attachment))/float64(1024), float64(totalLength)/float64(1024))
+	} else {
+		base.DebugfCtx(bh.loggingCtx, base.KeySync, "Sending attachment with digest=%q (%.2f KB)", digest, float64(len(attachment))/float64(1024))
+	}
 	response.SetBody(attachment)
 	response.SetCompressed(rq.Properties[BlipCompress] == "true")
 	bh.replicationStats.HandleGetAttachment.Add(1)
@@ -1048,6 +1172,10 @@ var NoBLIPHandlerError = fmt.Errorf("404 - No handler for BLIP request")
 
 // sendGetAttachment requests the full attachment from the peer.
 func (bh *blipHandler) sendGetAttachment(sender *blip.Sender, docID string, name string, digest string, meta map[string]interface{}) ([]byte, error) {
+	if bh.chunkedAttachments() {
+		return bh.sendGetAttachmentChunks(sender, docID, name, digest, meta)
+	}
+
 	base.DebugfCtx(bh.loggingCtx, base.KeySync, "    Asking for attachment %q for doc %s (digest %s)", base.UD(name), base.UD(docID), digest)
 	outrq := blip.NewRequest()
 	outrq.Properties = map[string]string{BlipProfile: MessageGetAttachment, GetAttachmentDigest: digest}
@@ -1055,7 +1183,7 @@ func (bh *blipHandler) sendGetAttachment(sender *blip.Sender, docID string, name
 		outrq.Properties[BlipCompress] = "true"
 	}
 
-	if bh.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3 {
+	if bh.activeSubprotocol() == BlipCBMobileReplicationV3 {
 		outrq.Properties[GetAttachmentID] = docID
 	}
 
@@ -1087,6 +1215,85 @@ func (bh *blipHandler) sendGetAttachment(sender *blip.Sender, docID string, name
 	return respBody, nil
 }
 
+// sendGetAttachmentChunks requests the attachment from the peer in chunks of attachmentChunkSize, verifying the digest
+// incrementally as chunks are received.  If the transfer is interrupted the data received so far is retained, and the
+// transfer resumes from the last received chunk when the peer resends the revision.
+func (bh *blipHandler) sendGetAttachmentChunks(sender *blip.Sender, docID string, name string, digest string, meta map[string]interface{}) ([]byte, error) {
+	metaLength, ok := base.ToInt64(meta["length"])
+	if !ok {
+		return nil, fmt.Errorf("invalid attachment length found in meta")
+	}
+
+	transfer := bh.db.partialAttachments.take(digest)
+	if transfer != nil && transfer.length == metaLength {
+		base.DebugfCtx(bh.loggingCtx, base.KeySync, "    Resuming attachment %q for doc %s (digest %s) at offset %d", base.UD(name), base.UD(docID), digest, transfer.offset())
+	} else {
+		base.DebugfCtx(bh.loggingCtx, base.KeySync, "    Asking for attachment %q for doc %s (digest %s) in chunks", base.UD(name), base.UD(docID), digest)
+		transfer = newPartialAttachment(metaLength)
+	}
+
+	for transfer.offset() < metaLength {
+		length := metaLength - transfer.offset()
+		if length > attachmentChunkSize {
+			length = attachmentChunkSize
+		}
+		chunk, err := bh.sendGetAttachmentChunk(sender, docID, name, digest, meta, transfer.offset(), length)
+		if err != nil {
+			bh.db.partialAttachments.put(digest, transfer)
+			return nil, err
+		}
+		if len(chunk) == 0 || int64(len(chunk)) > length {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
+		}
+		transfer.write(chunk)
+	}
+
+	// Verify that the attachment we received matches the metadata stored in the document
+	if transfer.digest() != digest {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Incorrect data sent for attachment with digest: %s", digest)
+	}
+
+	bh.replicationStats.GetAttachment.Add(1)
+	bh.replicationStats.GetAttachmentBytes.Add(metaLength)
+
+	return transfer.data, nil
+}
+
+// sendGetAttachmentChunk requests up to length bytes of the attachment from the peer, starting at offset.
+func (bh *blipHandler) sendGetAttachmentChunk(sender *blip.Sender, docID, name, digest string, meta map[string]interface{}, offset, length int64) ([]byte, error) {
+	outrq := blip.NewRequest()
+	outrq.Properties = map[string]string{
+		BlipProfile:         MessageGetAttachment,
+		GetAttachmentDigest: digest,
+		GetAttachmentID:     docID,
+		GetAttachmentOffset: strconv.FormatInt(offset, 10),
+		GetAttachmentLength: strconv.FormatInt(length, 10),
+	}
+	if isCompressible(name, meta) {
+		outrq.Properties[BlipCompress] = "true"
+	}
+
+	if !bh.sendBLIPMessage(sender, outrq) {
+		return nil, ErrClosedBLIPSender
+	}
+
+	resp := outrq.Response()
+	respBody, err := resp.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Type() == blip.ErrorType {
+		status, _ := strconv.Atoi(resp.Properties["Error-Code"])
+		if resp.Properties["Error-Domain"] == "HTTP" && status > 0 {
+			return nil, base.HTTPErrorf(status, "Error getting attachment chunk for digest %s at offset %d: %s", digest, offset, respBody)
+		}
+		return nil, fmt.Errorf("error %s %s getting attachment chunk for digest %s at offset %d: %s", resp.Properties["Error-Domain"], resp.Properties["Error-Code"], digest, offset, respBody)
+	}
+
+	return respBody, nil
+}
+
 // sendProveAttachment asks the peer to prove they have the attachment, without actually sending it.
 // This is to prevent clients from creating a doc with a digest for an attachment they otherwise can't access, in order to download it.
 func (bh *blipHandler) sendProveAttachment(sender *blip.Sender, docID, name, digest string, knownData []byte) error {
@@ -1135,8 +1342,16 @@ func (bh *blipHandler) sendProveAttachment(sender *blip.Sender, docID, name, dig
 func (bh *blipHandler) downloadOrVerifyAttachments(sender *blip.Sender, body Body, minRevpos int, docID string) error {
 	return bh.db.ForEachStubAttachment(body, minRevpos, docID,
 		func(name string, digest string, knownData []byte, meta map[string]interface{}) ([]byte, error) {
-			// request attachment if we don't have it
+			// request attachment if we don't have it, unless the attachment policy would reject it anyway
 			if knownData == nil {
+				contentType, _ := meta["content_type"].(string)
+				length, ok := base.ToInt64(meta["length"])
+				if !ok {
+					length = -1
+				}
+				if err := bh.db.CheckAttachmentUpload(name, contentType, length); err != nil {
+					return nil, err
+				}
 				return bh.sendGetAttachment(sender, docID, name, digest, meta)
 			}
 
@@ -28,6 +28,7 @@ type SubChangesRequest struct {
 	Continuous     bool     // Continuous can be set to true if the requester wants change notifications to be sent indefinitely (optional)
 	Batch          uint16   // Batch controls the maximum number of changes to send in a single change message (optional)
 	Since          string   // Since represents the latest sequence ID already known to the requester (optional)
+	SinceTime      string   // SinceTime requests changes from an RFC 3339 time, when there's no since (optional)
 	Filter         string   // Filter is the name of a filter function known to the recipient (optional)
 	FilterChannels []string // FilterChannels are a set of channels used with a 'sync_gateway/bychannel' filter (optional)
 	DocIDs         []string // DocIDs specifies which doc IDs the recipient should send changes for (optional)
@@ -58,6 +59,7 @@ func (rq *SubChangesRequest) marshalBLIPRequest() (*blip.Message, error) {
 	setOptionalProperty(msg.Properties, SubChangesContinuous, rq.Continuous)
 	setOptionalProperty(msg.Properties, SubChangesBatch, rq.Batch)
 	setOptionalProperty(msg.Properties, SubChangesSince, rq.Since)
+	setOptionalProperty(msg.Properties, SubChangesSinceTime, rq.SinceTime)
 	setOptionalProperty(msg.Properties, SubChangesFilter, rq.Filter)
 	setOptionalProperty(msg.Properties, SubChangesChannels, strings.Join(rq.FilterChannels, ","))
 	setOptionalProperty(msg.Properties, SubChangesRevocations, rq.Revocations)
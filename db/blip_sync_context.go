@@ -108,10 +108,12 @@ type BlipSyncContext struct {
 	sgr2PushAddExpectedSeqsCallback  func(expectedSeqs ...string)              // sgr2PushAddExpectedSeqsCallback is called after sync gateway has sent a revision, but is still awaiting an acknowledgement
 	sgr2PushProcessedSeqCallback     func(remoteSeq string)                    // sgr2PushProcessedSeqCallback is called after receiving acknowledgement of a sent revision
 	sgr2PushAlreadyKnownSeqsCallback func(alreadyKnownSeqs ...string)          // sgr2PushAlreadyKnownSeqsCallback is called to mark the sequence as being immediately processed
+	sgr2PushRevFailedCallback        func(entry DeadLetterEntry)               // sgr2PushRevFailedCallback is called when the remote rejects a sent revision
+	sgr2PushRevSucceededCallback     func(docID string)                        // sgr2PushRevSucceededCallback is called when the remote accepts a sent revision
 	emptyChangesMessageCallback      func()                                    // emptyChangesMessageCallback is called when an empty changes message is received
 	replicationStats                 *BlipSyncStats                            // Replication stats
 	purgeOnRemoval                   bool                                      // Purges the document when we pull a _removed:true revision.
-	conflictResolver                 *ConflictResolver                         // Conflict resolver for active replications
+	conflictResolver                 *ConflictResolver                         // Conflict resolver for active replications, and for CBL clients when client conflict resolution is enabled
 	changesPendingResponseCount      int64                                     // Number of changes messages pending changesResponse
 	// TODO: For review, whether sendRevAllConflicts needs to be per sendChanges invocation
 	sendRevNoConflicts bool                      // Whether to set noconflicts=true when sending revisions
@@ -135,8 +137,23 @@ type AllowedAttachment struct {
 	docID   string // docID, used for BlipCBMobileReplicationV2 retrieval of V2 attachments
 }
 
+// SetClientType sets the type of the client for a passive replication.  For CBL clients, the database's client
+// conflict resolver (if configured) is used to resolve conflicting revisions pushed by the client.
 func (bsc *BlipSyncContext) SetClientType(clientType BLIPSyncContextClientType) {
 	bsc.clientType = clientType
+	if clientType == BLIPClientTypeCBL2 {
+		bsc.conflictResolver = NewClientConflictResolver(bsc.blipContextDb.DatabaseContext)
+	}
+}
+
+// activeSubprotocol returns the replication protocol version negotiated for the connection.
+func (bsc *BlipSyncContext) activeSubprotocol() string {
+	return BlipSubprotocolVersion(bsc.blipContext.ActiveSubprotocol())
+}
+
+// chunkedAttachments returns true if the peer supports chunked getAttachment requests.
+func (bsc *BlipSyncContext) chunkedAttachments() bool {
+	return bsc.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV3Chunked
 }
 
 // Registers a BLIP handler including the outer-level work of logging & error handling.
@@ -330,12 +347,13 @@ func (bsc *BlipSyncContext) handleChangesResponse(sender *blip.Sender, response
 			revSendTimeLatency += time.Since(changesResponseReceived).Nanoseconds()
 			revSendCount++
 
-			if bsc.sgr2PushAddExpectedSeqsCallback != nil {
+			// Revisions re-sent from the dead letter queue have a zero sequence, and aren't checkpointed
+			if bsc.sgr2PushAddExpectedSeqsCallback != nil && seq.IsNonZero() {
 				sentSeqs = append(sentSeqs, seq.String())
 			}
 		} else {
 			base.DebugfCtx(bsc.loggingCtx, base.KeySync, "Peer didn't want revision %s / %s (seq:%v)", base.UD(docID), revID, seq)
-			if bsc.sgr2PushAlreadyKnownSeqsCallback != nil {
+			if bsc.sgr2PushAlreadyKnownSeqsCallback != nil && seq.IsNonZero() {
 				alreadyKnownSeqs = append(alreadyKnownSeqs, seq.String())
 			}
 		}
@@ -384,7 +402,7 @@ func (bsc *BlipSyncContext) sendRevisionWithProperties(sender *blip.Sender, docI
 	// asynchronously wait for a response if we have attachment digests to verify, if we sent a delta and want to error check, or if we have a registered callback.
 	awaitResponse := len(attMeta) > 0 || properties[RevMessageDeltaSrc] != "" || bsc.sgr2PushProcessedSeqCallback != nil
 
-	activeSubprotocol := bsc.blipContext.ActiveSubprotocol()
+	activeSubprotocol := bsc.activeSubprotocol()
 	if awaitResponse {
 		// Allow client to download attachments in 'atts', but only while pulling this rev
 		bsc.addAllowedAttachments(docID, attMeta, activeSubprotocol)
@@ -421,15 +439,20 @@ func (bsc *BlipSyncContext) sendRevisionWithProperties(sender *blip.Sender, docI
 				bsc.replicationStats.SendRevErrorTotal.Add(1)
 				base.InfofCtx(bsc.loggingCtx, base.KeySync, "error %s in response to rev: %s", resp.Properties["Error-Code"], respBody)
 
+				// Conflicts and revisions being re-sent in full aren't treated as dead letters - the former will be
+				// resolved by the pull side of the replication.
+				deadLetter := true
 				if resp.Properties["Error-Domain"] == "HTTP" {
 					switch resp.Properties["Error-Code"] {
 					case "409":
 						bsc.replicationStats.SendRevErrorConflictCount.Add(1)
+						deadLetter = false
 					case "403":
 						bsc.replicationStats.SendRevErrorRejectedCount.Add(1)
 					case "422", "404":
 						// unprocessable entity, CBL has not been able to use the delta we sent, so we should re-send the revision in full
 						if resendFullRevisionFunc != nil {
+							deadLetter = false
 							base.DebugfCtx(bsc.loggingCtx, base.KeySync, "sending full body replication for doc %s/%s due to unprocessable entity", base.UD(docID), revID)
 							if err := resendFullRevisionFunc(); err != nil {
 								base.WarnfCtx(bsc.loggingCtx, "unable to resend revision: %v", err)
@@ -444,13 +467,31 @@ func (bsc *BlipSyncContext) sendRevisionWithProperties(sender *blip.Sender, docI
 						}
 					}
 				}
+
+				if deadLetter && bsc.sgr2PushRevFailedCallback != nil {
+					failedSeq := ""
+					if seq.IsNonZero() {
+						failedSeq = seq.String()
+					}
+					bsc.sgr2PushRevFailedCallback(DeadLetterEntry{
+						DocID:        docID,
+						RevID:        revID,
+						Seq:          failedSeq,
+						ErrorDomain:  resp.Properties["Error-Domain"],
+						ErrorCode:    resp.Properties["Error-Code"],
+						ErrorMessage: string(respBody),
+					})
+				}
 			} else {
 				bsc.replicationStats.SendRevCount.Add(1)
+				if bsc.sgr2PushRevSucceededCallback != nil {
+					bsc.sgr2PushRevSucceededCallback(docID)
+				}
 			}
 
 			bsc.removeAllowedAttachments(docID, attMeta, activeSubprotocol)
 
-			if bsc.sgr2PushProcessedSeqCallback != nil {
+			if bsc.sgr2PushProcessedSeqCallback != nil && seq.IsNonZero() {
 				bsc.sgr2PushProcessedSeqCallback(seq.String())
 			}
 		}(activeSubprotocol)
@@ -528,7 +569,7 @@ func (bsc *BlipSyncContext) sendNoRev(sender *blip.Sender, docID, revID string,
 	noRevRq := NewNoRevMessage()
 	noRevRq.SetId(docID)
 	noRevRq.SetRev(revID)
-	if bsc.blipContext.ActiveSubprotocol() == BlipCBMobileReplicationV2 && bsc.clientType == BLIPClientTypeSGR2 {
+	if bsc.activeSubprotocol() == BlipCBMobileReplicationV2 && bsc.clientType == BLIPClientTypeSGR2 {
 		noRevRq.SetSeq(seq)
 	} else {
 		noRevRq.SetSequence(seq)
@@ -545,7 +586,7 @@ func (bsc *BlipSyncContext) sendNoRev(sender *blip.Sender, docID, revID string,
 		return ErrClosedBLIPSender
 	}
 
-	if bsc.sgr2PushProcessedSeqCallback != nil {
+	if bsc.sgr2PushProcessedSeqCallback != nil && seq.IsNonZero() {
 		bsc.sgr2PushProcessedSeqCallback(seq.String())
 	}
 
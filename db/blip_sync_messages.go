@@ -13,8 +13,11 @@ package db
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math"
+	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/couchbase/go-blip"
@@ -57,6 +60,7 @@ const (
 	SubChangesFilter      = "filter"
 	SubChangesChannels    = "channels"
 	SubChangesSince       = "since"
+	SubChangesSinceTime   = "sinceTime" // RFC 3339 time to replay changes from, in place of since
 	SubChangesContinuous  = "continuous"
 	SubChangesBatch       = "batch"
 	SubChangesRevocations = "revocations"
@@ -94,6 +98,15 @@ const (
 	// getAttachment message properties
 	GetAttachmentID     = "docID"
 	GetAttachmentDigest = "digest"
+	GetAttachmentOffset = "offset" // Offset of the requested chunk (BlipCBMobileReplicationV3Chunked only)
+	GetAttachmentLength = "length" // Maximum length of the requested chunk (BlipCBMobileReplicationV3Chunked only)
+	GetAttachmentWidth  = "width"  // Max width of the requested image rendition (see AttachmentRenditionSpec)
+	GetAttachmentHeight = "height" // Max height of the requested image rendition
+	GetAttachmentFormat = "format" // Format of the requested image rendition
+
+	// getAttachment response properties
+	GetAttachmentResponseTotalLength = "totalLength" // Total length of the attachment, set on chunked responses
+	GetAttachmentResponseContentType = "contentType" // Content type of the rendition, set on rendition responses
 
 	// proveAttachment
 	ProveAttachmentDigest = "digest"
@@ -108,13 +121,15 @@ type SequenceIDParser func(since string) (SequenceID, error)
 
 // Helper for handling BLIP subChanges requests.  Supports Stringer() interface to log aspects of the request.
 type SubChangesParams struct {
-	rq      *blip.Message // The underlying BLIP message
-	_since  SequenceID    // Since value on the incoming request
-	_docIDs []string      // Document ID filter specified on the incoming request
+	rq         *blip.Message   // The underlying BLIP message
+	_since     SequenceID      // Since value on the incoming request
+	_docIDs    []string        // Document ID filter specified on the incoming request
+	_predicate json.RawMessage // Predicate expression for the sync_gateway/predicate filter, specified on the incoming request
 }
 
 type SubChangesBody struct {
-	DocIDs []string `json:"docIDs"`
+	DocIDs    []string        `json:"docIDs"`
+	Predicate json.RawMessage `json:"predicate,omitempty"`
 }
 
 // Create a new subChanges helper
@@ -136,12 +151,13 @@ func NewSubChangesParams(logCtx context.Context, rq *blip.Message, zeroSeq Seque
 	params._since = sinceSequenceId
 
 	// rq.BodyReader() returns an EOF for a non-existent body, so using rq.Body() here
-	docIDs, err := readDocIDsFromRequest(rq)
+	body, err := readSubChangesBody(rq)
 	if err != nil {
 		base.InfofCtx(logCtx, base.KeySync, "%s: Error reading doc IDs on subChanges request: %s", rq, err)
 		return params, err
 	}
-	params._docIDs = docIDs
+	params._docIDs = body.DocIDs
+	params._predicate = body.Predicate
 
 	return params, nil
 }
@@ -150,28 +166,39 @@ func (s *SubChangesParams) Since() SequenceID {
 	return s._since
 }
 
+// sinceTime returns the requested sinceTime, which is resolved to a since sequence by the handler.
+func (s *SubChangesParams) sinceTime() (sinceTime string, found bool) {
+	sinceTime, found = s.rq.Properties[SubChangesSinceTime]
+	return sinceTime, found
+}
+
 func (s *SubChangesParams) docIDs() []string {
 	return s._docIDs
 }
 
-func readDocIDsFromRequest(rq *blip.Message) (docIDs []string, err error) {
+// predicate parses the predicate expression specified for the sync_gateway/predicate filter.
+func (s *SubChangesParams) predicate() (*ChangesPredicate, error) {
+	if len(s._predicate) == 0 {
+		return nil, fmt.Errorf("Missing 'predicate' in subChanges body")
+	}
+	return ParseChangesPredicate(s._predicate)
+}
+
+func readSubChangesBody(rq *blip.Message) (body SubChangesBody, err error) {
 	// Get Body from request.  Not using BodyReader(), to avoid EOF on empty body
 	rawBody, err := rq.Body()
 	if err != nil {
-		return nil, err
+		return body, err
 	}
 
-	// If there's a non-empty body, unmarshal to get the docIDs
+	// If there's a non-empty body, unmarshal to get the docIDs and predicate
 	if len(rawBody) > 0 {
-		var body SubChangesBody
 		unmarshalErr := base.JSONUnmarshal(rawBody, &body)
 		if unmarshalErr != nil {
-			return nil, err
-		} else {
-			docIDs = body.DocIDs
+			return SubChangesBody{}, err
 		}
 	}
-	return docIDs, err
+	return body, err
 
 }
 
@@ -246,6 +273,10 @@ func (s *SubChangesParams) String() string {
 	if len(s.docIDs()) > 0 {
 		buffer.WriteString(fmt.Sprintf("DocIDs:%v ", s.docIDs()))
 	}
+
+	if len(s._predicate) > 0 {
+		buffer.WriteString(fmt.Sprintf("Predicate:%s ", base.UD(string(s._predicate))))
+	}
 	return buffer.String()
 
 }
@@ -451,8 +482,48 @@ func (g *getAttachmentParams) docID() string {
 	return g.rq.Properties[GetAttachmentID]
 }
 
+// chunk returns the offset and length of the requested chunk.  isChunk is false when the request is for the whole
+// attachment, and length is zero when the chunk extends to the end of the attachment.
+func (g *getAttachmentParams) chunk() (offset, length int64, isChunk bool, err error) {
+	offsetStr, hasOffset := g.rq.Properties[GetAttachmentOffset]
+	lengthStr, hasLength := g.rq.Properties[GetAttachmentLength]
+	if !hasOffset && !hasLength {
+		return 0, 0, false, nil
+	}
+	if hasOffset {
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, false, base.HTTPErrorf(http.StatusBadRequest, "Invalid '%s': %q", GetAttachmentOffset, offsetStr)
+		}
+	}
+	if hasLength {
+		length, err = strconv.ParseInt(lengthStr, 10, 64)
+		if err != nil || length <= 0 {
+			return 0, 0, false, base.HTTPErrorf(http.StatusBadRequest, "Invalid '%s': %q", GetAttachmentLength, lengthStr)
+		}
+	}
+	return offset, length, true, nil
+}
+
+// rendition returns the requested image rendition, or nil if the request is for the attachment itself.
+func (g *getAttachmentParams) rendition() (*AttachmentRenditionSpec, error) {
+	width, height, format := g.rq.Properties[GetAttachmentWidth], g.rq.Properties[GetAttachmentHeight], g.rq.Properties[GetAttachmentFormat]
+	if width == "" && height == "" && format == "" {
+		return nil, nil
+	}
+	return NewAttachmentRenditionSpec(width, height, format)
+}
+
 func (g *getAttachmentParams) String() string {
-	return fmt.Sprintf("Digest:%v, DocID: %v ", g.digest(), base.UD(g.docID()))
+	var buffer bytes.Buffer
+	buffer.WriteString(fmt.Sprintf("Digest:%v, DocID: %v ", g.digest(), base.UD(g.docID())))
+	if offset, length, isChunk, _ := g.chunk(); isChunk {
+		buffer.WriteString(fmt.Sprintf("Offset: %d, Length: %d ", offset, length))
+	}
+	if spec, _ := g.rendition(); spec != nil {
+		buffer.WriteString(fmt.Sprintf("Rendition: %s ", spec))
+	}
+	return buffer.String()
 }
 
 type IncludeConflictRevEntry struct {
@@ -0,0 +1,394 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Limits on the size of a changes predicate, to bound the cost of evaluating it against every change sent to a client.
+const (
+	maxChangesPredicateDepth = 8
+	maxChangesPredicateNodes = 64
+)
+
+// Predicate operators.  Field conditions are either a literal value (shorthand for $eq) or an object of operators,
+// which must all be satisfied.
+const (
+	predicateOpAnd      = "$and"
+	predicateOpOr       = "$or"
+	predicateOpNot      = "$not"
+	predicateOpEq       = "$eq"
+	predicateOpNe       = "$ne"
+	predicateOpGt       = "$gt"
+	predicateOpGte      = "$gte"
+	predicateOpLt       = "$lt"
+	predicateOpLte      = "$lte"
+	predicateOpIn       = "$in"
+	predicateOpNin      = "$nin"
+	predicateOpExists   = "$exists"
+	predicateOpContains = "$contains"
+)
+
+// ChangesPredicate is a filter expression evaluated against the body of each change sent to a client, used by the
+// sync_gateway/predicate subChanges filter.  Expressions are JSON objects whose properties are either a field path
+// (dot-separated for nested properties) mapped to a condition, or one of the logical operators $and, $or (arrays of
+// expressions) and $not (an expression).  Multiple properties in an expression must all match, e.g.
+//
+//	{"type": "order", "status": {"$in": ["open", "pending"]}, "total": {"$gte": 100}}
+type ChangesPredicate struct {
+	root predicateNode
+}
+
+type predicateNode interface {
+	matches(body map[string]interface{}) bool
+}
+
+type predicateAnd []predicateNode
+
+type predicateOr []predicateNode
+
+type predicateNot struct {
+	node predicateNode
+}
+
+// predicateField applies the operator to the value found at the field path.
+type predicateField struct {
+	path     []string
+	operator string
+	operand  interface{}
+}
+
+// ParseChangesPredicate parses and validates a JSON predicate expression.
+func ParseChangesPredicate(raw []byte) (*ChangesPredicate, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, fmt.Errorf("predicate is empty")
+	}
+	var expression interface{}
+	decoder := base.JSONDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	if err := decoder.Decode(&expression); err != nil {
+		return nil, fmt.Errorf("predicate is not valid JSON: %w", err)
+	}
+	parser := &predicateParser{}
+	root, err := parser.parseExpression(expression, 1)
+	if err != nil {
+		return nil, err
+	}
+	return &ChangesPredicate{root: root}, nil
+}
+
+// Matches returns true if the document body satisfies the predicate.
+func (p *ChangesPredicate) Matches(body map[string]interface{}) bool {
+	return p.root.matches(body)
+}
+
+type predicateParser struct {
+	nodeCount int
+}
+
+func (pp *predicateParser) addNode(depth int) error {
+	pp.nodeCount++
+	if pp.nodeCount > maxChangesPredicateNodes {
+		return fmt.Errorf("predicate exceeds the maximum of %d conditions", maxChangesPredicateNodes)
+	}
+	if depth > maxChangesPredicateDepth {
+		return fmt.Errorf("predicate exceeds the maximum nesting depth of %d", maxChangesPredicateDepth)
+	}
+	return nil
+}
+
+func (pp *predicateParser) parseExpression(expression interface{}, depth int) (predicateNode, error) {
+	object, ok := expression.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("predicate expression must be an object, got %T", expression)
+	}
+	if len(object) == 0 {
+		return nil, fmt.Errorf("predicate expression must not be empty")
+	}
+	if err := pp.addNode(depth); err != nil {
+		return nil, err
+	}
+
+	// Sort keys so that evaluation order (and therefore any errors) are deterministic
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	nodes := make(predicateAnd, 0, len(keys))
+	for _, key := range keys {
+		value := object[key]
+		switch key {
+		case predicateOpAnd, predicateOpOr:
+			list, ok := value.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array of expressions", key)
+			}
+			children := make([]predicateNode, 0, len(list))
+			for _, item := range list {
+				child, err := pp.parseExpression(item, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				children = append(children, child)
+			}
+			if key == predicateOpAnd {
+				nodes = append(nodes, predicateAnd(children))
+			} else {
+				nodes = append(nodes, predicateOr(children))
+			}
+		case predicateOpNot:
+			child, err := pp.parseExpression(value, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, predicateNot{node: child})
+		default:
+			if strings.HasPrefix(key, "$") {
+				return nil, fmt.Errorf("unknown predicate operator %q", key)
+			}
+			fieldNodes, err := pp.parseFieldCondition(key, value, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, fieldNodes...)
+		}
+	}
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+func (pp *predicateParser) parseFieldCondition(field string, condition interface{}, depth int) ([]predicateNode, error) {
+	path := strings.Split(field, ".")
+	for _, element := range path {
+		if element == "" {
+			return nil, fmt.Errorf("invalid predicate field %q", field)
+		}
+	}
+
+	operators, ok := condition.(map[string]interface{})
+	if !ok || !isOperatorObject(operators) {
+		// A literal value is shorthand for $eq
+		if err := pp.addNode(depth); err != nil {
+			return nil, err
+		}
+		return []predicateNode{&predicateField{path: path, operator: predicateOpEq, operand: condition}}, nil
+	}
+
+	operatorNames := make([]string, 0, len(operators))
+	for operator := range operators {
+		operatorNames = append(operatorNames, operator)
+	}
+	sort.Strings(operatorNames)
+
+	nodes := make([]predicateNode, 0, len(operators))
+	for _, operator := range operatorNames {
+		operand := operators[operator]
+		if err := pp.addNode(depth); err != nil {
+			return nil, err
+		}
+		switch operator {
+		case predicateOpEq, predicateOpNe, predicateOpContains:
+		case predicateOpGt, predicateOpGte, predicateOpLt, predicateOpLte:
+			if _, isNumber := predicateNumber(operand); !isNumber {
+				if _, isString := operand.(string); !isString {
+					return nil, fmt.Errorf("%s operand for %q must be a number or string", operator, field)
+				}
+			}
+		case predicateOpIn, predicateOpNin:
+			if _, ok := operand.([]interface{}); !ok {
+				return nil, fmt.Errorf("%s operand for %q must be an array", operator, field)
+			}
+		case predicateOpExists:
+			if _, ok := operand.(bool); !ok {
+				return nil, fmt.Errorf("%s operand for %q must be a boolean", operator, field)
+			}
+		default:
+			return nil, fmt.Errorf("unknown predicate operator %q for %q", operator, field)
+		}
+		nodes = append(nodes, &predicateField{path: path, operator: operator, operand: operand})
+	}
+	return nodes, nil
+}
+
+// isOperatorObject returns true if all of the object's keys are operators, identifying an operator condition rather
+// than a literal object value.
+func isOperatorObject(object map[string]interface{}) bool {
+	if len(object) == 0 {
+		return false
+	}
+	for key := range object {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func (nodes predicateAnd) matches(body map[string]interface{}) bool {
+	for _, node := range nodes {
+		if !node.matches(body) {
+			return false
+		}
+	}
+	return true
+}
+
+func (nodes predicateOr) matches(body map[string]interface{}) bool {
+	for _, node := range nodes {
+		if node.matches(body) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n predicateNot) matches(body map[string]interface{}) bool {
+	return !n.node.matches(body)
+}
+
+func (f *predicateField) matches(body map[string]interface{}) bool {
+	value, found := predicateLookup(body, f.path)
+	switch f.operator {
+	case predicateOpExists:
+		return found == f.operand.(bool)
+	case predicateOpNe:
+		return !found || !predicateEqual(value, f.operand)
+	case predicateOpNin:
+		return !found || !predicateIn(value, f.operand.([]interface{}))
+	}
+	if !found {
+		return false
+	}
+	switch f.operator {
+	case predicateOpEq:
+		return predicateEqual(value, f.operand)
+	case predicateOpIn:
+		return predicateIn(value, f.operand.([]interface{}))
+	case predicateOpContains:
+		values, ok := value.([]interface{})
+		return ok && predicateIn(f.operand, values)
+	case predicateOpGt, predicateOpGte, predicateOpLt, predicateOpLte:
+		comparison, ok := predicateCompare(value, f.operand)
+		if !ok {
+			return false
+		}
+		switch f.operator {
+		case predicateOpGt:
+			return comparison > 0
+		case predicateOpGte:
+			return comparison >= 0
+		case predicateOpLt:
+			return comparison < 0
+		default:
+			return comparison <= 0
+		}
+	}
+	return false
+}
+
+func predicateLookup(body map[string]interface{}, path []string) (value interface{}, found bool) {
+	var current interface{} = body
+	for _, element := range path {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, found = object[element]
+		if !found {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func predicateIn(value interface{}, candidates []interface{}) bool {
+	for _, candidate := range candidates {
+		if predicateEqual(value, candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+func predicateEqual(a, b interface{}) bool {
+	if aNumber, ok := predicateNumber(a); ok {
+		bNumber, ok := predicateNumber(b)
+		return ok && aNumber == bNumber
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// predicateCompare compares two numbers or two strings, returning false if the values aren't comparable.
+func predicateCompare(a, b interface{}) (comparison int, ok bool) {
+	if aNumber, ok := predicateNumber(a); ok {
+		bNumber, ok := predicateNumber(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case aNumber < bNumber:
+			return -1, true
+		case aNumber > bNumber:
+			return 1, true
+		}
+		return 0, true
+	}
+	aString, aOk := a.(string)
+	bString, bOk := b.(string)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	return strings.Compare(aString, bString), true
+}
+
+func predicateNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		number, err := v.Float64()
+		return number, err == nil
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// revisionMatchesPredicate retrieves the given revision from the revision cache and evaluates the predicate against its
+// body.
+func (db *Database) revisionMatchesPredicate(predicate *ChangesPredicate, docID, revID string) (rev DocumentRevision, matches bool, err error) {
+	rev, err = db.revisionCache.Get(docID, revID, RevCacheIncludeBody, RevCacheOmitDelta)
+	if err != nil {
+		return rev, false, err
+	}
+	if rev.BodyBytes == nil || rev.Removed {
+		return rev, false, base.HTTPErrorf(404, "missing")
+	}
+	var body Body
+	if err := body.Unmarshal(rev.BodyBytes); err != nil {
+		return rev, false, err
+	}
+	return rev, predicate.Matches(body), nil
+}
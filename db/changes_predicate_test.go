@@ -0,0 +1,102 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChangesPredicateMatches(t *testing.T) {
+
+	var body Body
+	require.NoError(t, body.Unmarshal([]byte(`{
+		"type": "order",
+		"status": "open",
+		"total": 150,
+		"tags": ["urgent", "wholesale"],
+		"customer": {"id": "c1", "region": "emea"}
+	}`)))
+
+	tests := []struct {
+		predicate string
+		matches   bool
+	}{
+		{`{"type": "order"}`, true},
+		{`{"type": "order", "status": "closed"}`, false},
+		{`{"type": "order", "status": {"$in": ["open", "pending"]}}`, true},
+		{`{"status": {"$nin": ["open", "pending"]}}`, false},
+		{`{"status": {"$ne": "closed"}}`, true},
+		{`{"missing": {"$ne": "closed"}}`, true},
+		{`{"total": 150.0}`, true},
+		{`{"total": {"$gte": 100, "$lt": 200}}`, true},
+		{`{"total": {"$gt": 150}}`, false},
+		{`{"status": {"$lte": "open"}}`, true},
+		{`{"total": {"$gt": "100"}}`, false},
+		{`{"tags": {"$contains": "urgent"}}`, true},
+		{`{"tags": {"$contains": "retail"}}`, false},
+		{`{"customer.region": "emea"}`, true},
+		{`{"customer.region.code": "emea"}`, false},
+		{`{"customer": {"id": "c1", "region": "emea"}}`, true},
+		{`{"customer.id": {"$exists": true}, "discount": {"$exists": false}}`, true},
+		{`{"$or": [{"status": "closed"}, {"total": {"$gt": 100}}]}`, true},
+		{`{"$and": [{"status": "open"}, {"total": {"$gt": 200}}]}`, false},
+		{`{"$not": {"status": "closed"}}`, true},
+		{`{"type": "order", "$not": {"tags": {"$contains": "wholesale"}}}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.predicate, func(t *testing.T) {
+			predicate, err := ParseChangesPredicate([]byte(test.predicate))
+			require.NoError(t, err)
+			assert.Equal(t, test.matches, predicate.Matches(body))
+		})
+	}
+}
+
+func TestParseChangesPredicateErrors(t *testing.T) {
+
+	nested := strings.Repeat(`{"$not": `, maxChangesPredicateDepth) + `{"a": 1}` + strings.Repeat(`}`, maxChangesPredicateDepth)
+	conditions := make([]string, 0, maxChangesPredicateNodes)
+	for i := 0; i < maxChangesPredicateNodes; i++ {
+		conditions = append(conditions, fmt.Sprintf(`"field%d": %d`, i, i))
+	}
+	tooMany := "{" + strings.Join(conditions, ",") + "}"
+
+	tests := []struct {
+		predicate string
+		err       string
+	}{
+		{``, "predicate is empty"},
+		{`{"a": `, "predicate is not valid JSON"},
+		{`"open"`, "predicate expression must be an object, got string"},
+		{`{}`, "predicate expression must not be empty"},
+		{`{"$where": "true"}`, `unknown predicate operator "$where"`},
+		{`{"a": {"$regex": "x"}}`, `unknown predicate operator "$regex" for "a"`},
+		{`{"a..b": 1}`, `invalid predicate field "a..b"`},
+		{`{"$or": []}`, "$or must be a non-empty array of expressions"},
+		{`{"a": {"$in": "x"}}`, `$in operand for "a" must be an array`},
+		{`{"a": {"$gt": true}}`, `$gt operand for "a" must be a number or string`},
+		{`{"a": {"$exists": 1}}`, `$exists operand for "a" must be a boolean`},
+		{nested, "predicate exceeds the maximum nesting depth of 8"},
+		{tooMany, "predicate exceeds the maximum of 64 conditions"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseChangesPredicate([]byte(test.predicate))
+		require.Error(t, err, "Expected error for predicate %s", test.predicate)
+		assert.Contains(t, err.Error(), test.err)
+	}
+}
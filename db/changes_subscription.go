@@ -0,0 +1,448 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+const (
+	// DefaultChangesSubscriptionBatchSize is the maximum number of changes in a subscription batch, when not configured.
+	DefaultChangesSubscriptionBatchSize = 100
+
+	// DefaultChangesSubscriptionAckTimeout is how long a consumer has to ack a batch before it's redelivered to another
+	// consumer, when not configured.
+	DefaultChangesSubscriptionAckTimeout = time.Minute
+
+	// maxChangesSubscriptionLeases bounds the number of batches in flight for a subscription, to bound the size of the
+	// subscription document.
+	maxChangesSubscriptionLeases = 1000
+
+	// maxChangesSubscriptionReadAttempts bounds the number of times a read is retried when other consumers read the
+	// same changes concurrently.
+	maxChangesSubscriptionReadAttempts = 10
+)
+
+// errChangesSubscriptionMoved is returned by update callbacks when the changes read for a batch have already been
+// dispatched to another consumer.
+var errChangesSubscriptionMoved = errors.New("changes subscription moved")
+
+var changesSubscriptionNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.\-]{1,100}$`)
+
+// ChangesSubscriptionConfig defines the changes delivered to the consumers of a subscription.
+type ChangesSubscriptionConfig struct {
+	Channels       []string        `json:"channels,omitempty"`         // Channels to deliver changes from, defaults to all channels
+	Filter         string          `json:"filter,omitempty"`           // sync_gateway/bychannel (default) or sync_gateway/predicate
+	Predicate      json.RawMessage `json:"predicate,omitempty"`        // Predicate changes must match, for sync_gateway/predicate
+	IncludeDocs    bool            `json:"include_docs,omitempty"`     // Include document bodies in batches
+	BatchSize      int             `json:"batch_size,omitempty"`       // Maximum number of changes per batch
+	AckTimeoutSecs int             `json:"ack_timeout_secs,omitempty"` // Time allowed to ack a batch before it's redelivered
+}
+
+// ChangesSubscription is a named, server-side changes feed cursor.  Consumers read batches of changes and ack each
+// batch once processed.  Batches are leased to one consumer at a time, so multiple consumers of a subscription
+// compete for changes rather than each receiving all of them, and batches that aren't acked before the lease
+// expires are redelivered.
+type ChangesSubscription struct {
+	ChangesSubscriptionConfig
+	Name          string               `json:"name"`
+	AckedSeq      SequenceID           `json:"acked_seq"`      // All changes up to and including this sequence have been acked
+	DispatchedSeq SequenceID           `json:"dispatched_seq"` // All changes up to and including this sequence have been read
+	Leases        []*subscriptionLease `json:"leases,omitempty"`
+	Redeliveries  int64                `json:"redeliveries,omitempty"`
+}
+
+// subscriptionLease is a batch of changes read by a consumer that hasn't been acked.
+type subscriptionLease struct {
+	Since    SequenceID `json:"since"`
+	LastSeq  SequenceID `json:"last_seq"`
+	Expiry   int64      `json:"expiry"` // Unix time in seconds
+	Consumer string     `json:"consumer,omitempty"`
+}
+
+// ChangesSubscriptionBatch is a batch of changes read from a subscription.  LastSeq must be acked once the batch has
+// been processed, and is nil when there were no changes to read.
+type ChangesSubscriptionBatch struct {
+	Results    []*ChangeEntry `json:"results"`
+	LastSeq    *SequenceID    `json:"last_seq,omitempty"`
+	Redelivery bool           `json:"redelivery,omitempty"`
+}
+
+// ChangesSubscriptionStatus reports the configuration and progress of a subscription.
+type ChangesSubscriptionStatus struct {
+	ChangesSubscriptionConfig
+	Name          string     `json:"name"`
+	AckedSeq      SequenceID `json:"acked_seq"`
+	DispatchedSeq SequenceID `json:"dispatched_seq"`
+	LastSeq       uint64     `json:"last_seq"`  // Latest sequence allocated in the database
+	Lag           uint64     `json:"lag"`       // Number of sequences allocated since acked_seq
+	InFlight      int        `json:"in_flight"` // Number of batches read but not yet acked
+	Redeliveries  int64      `json:"redeliveries"`
+}
+
+func changesSubscriptionKey(name string) string {
+	return base.ChangesSubscriptionPrefix + name
+}
+
+// validate checks the config and applies defaults, returning the parsed predicate for predicate subscriptions.
+func (config *ChangesSubscriptionConfig) validate() (*ChangesPredicate, error) {
+	if config.BatchSize < 0 || config.AckTimeoutSecs < 0 {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "batch_size and ack_timeout_secs must not be negative")
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultChangesSubscriptionBatchSize
+	}
+	if config.AckTimeoutSecs == 0 {
+		config.AckTimeoutSecs = int(DefaultChangesSubscriptionAckTimeout.Seconds())
+	}
+	if _, err := channels.SetFromArray(config.Channels, channels.KeepStar); err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid channels: %v", err)
+	}
+
+	switch config.Filter {
+	case "", base.ByChannelFilter:
+		if len(config.Predicate) > 0 {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "predicate requires the %s filter", base.PredicateFilter)
+		}
+		return nil, nil
+	case base.PredicateFilter:
+		predicate, err := ParseChangesPredicate(config.Predicate)
+		if err != nil {
+			return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid predicate: %s", err)
+		}
+		return predicate, nil
+	default:
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unknown filter; try %s or %s", base.ByChannelFilter, base.PredicateFilter)
+	}
+}
+
+// updateAckedSeq moves the acked sequence up to the start of the earliest batch in flight, or to the dispatched
+// sequence when there are none.
+func (sub *ChangesSubscription) updateAckedSeq() {
+	sub.AckedSeq = sub.DispatchedSeq
+	for _, lease := range sub.Leases {
+		if lease.Since.Before(sub.AckedSeq) {
+			sub.AckedSeq = lease.Since
+		}
+	}
+}
+
+// expiredLease returns the earliest batch in flight whose lease has expired, if any.
+func (sub *ChangesSubscription) expiredLease(now int64) *subscriptionLease {
+	var expired *subscriptionLease
+	for _, lease := range sub.Leases {
+		if lease.Expiry <= now && (expired == nil || lease.Since.Before(expired.Since)) {
+			expired = lease
+		}
+	}
+	return expired
+}
+
+// updateChangesSubscription applies the callback to the subscription with CAS retry.  The callback returns
+// base.ErrUpdateCancel to leave the subscription unchanged.
+func (db *DatabaseContext) updateChangesSubscription(name string, allowCreate bool, callback func(sub *ChangesSubscription) error) error {
+	_, err := db.Bucket.Update(changesSubscriptionKey(name), 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		sub := &ChangesSubscription{Name: name}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, sub); err != nil {
+				return nil, nil, false, err
+			}
+		} else if !allowCreate {
+			return nil, nil, false, base.HTTPErrorf(http.StatusNotFound, "Subscription not found")
+		}
+		if err := callback(sub); err != nil {
+			return nil, nil, false, err
+		}
+		subBytes, err := base.JSONMarshal(sub)
+		return subBytes, nil, false, err
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	return err
+}
+
+// PutChangesSubscription creates or reconfigures a subscription.  Reconfiguring leaves the subscription's progress
+// unchanged, unless since is given, in which case the subscription restarts from that sequence and any batches in
+// flight are discarded.  Returns true if the subscription was created.
+func (db *DatabaseContext) PutChangesSubscription(name string, config ChangesSubscriptionConfig, since *SequenceID) (created bool, err error) {
+	if !changesSubscriptionNameRegex.MatchString(name) {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid subscription name %q", name)
+	}
+	if _, err := config.validate(); err != nil {
+		return false, err
+	}
+
+	err = db.updateChangesSubscription(name, true, func(sub *ChangesSubscription) error {
+		// Stored configs always have a batch size, as validate applies the default
+		created = sub.BatchSize == 0
+		sub.ChangesSubscriptionConfig = config
+		if since != nil {
+			sub.DispatchedSeq = *since
+			sub.Leases = nil
+			sub.updateAckedSeq()
+		}
+		return nil
+	})
+	return created, err
+}
+
+// GetChangesSubscription returns the subscription with the given name.
+func (db *DatabaseContext) GetChangesSubscription(name string) (*ChangesSubscription, error) {
+	sub := &ChangesSubscription{}
+	if _, err := db.Bucket.Get(changesSubscriptionKey(name), sub); err != nil {
+		if base.IsDocNotFoundError(err) {
+			return nil, base.HTTPErrorf(http.StatusNotFound, "Subscription not found")
+		}
+		return nil, err
+	}
+	return sub, nil
+}
+
+// GetChangesSubscriptionStatus returns the configuration and progress of the subscription, including how far it lags
+// behind the database.
+func (db *DatabaseContext) GetChangesSubscriptionStatus(name string) (*ChangesSubscriptionStatus, error) {
+	sub, err := db.GetChangesSubscription(name)
+	if err != nil {
+		return nil, err
+	}
+	lastSeq, err := db.LastSequence()
+	if err != nil {
+		return nil, err
+	}
+	status := &ChangesSubscriptionStatus{
+		ChangesSubscriptionConfig: sub.ChangesSubscriptionConfig,
+		Name:                      sub.Name,
+		AckedSeq:                  sub.AckedSeq,
+		DispatchedSeq:             sub.DispatchedSeq,
+		LastSeq:                   lastSeq,
+		InFlight:                  len(sub.Leases),
+		Redeliveries:              sub.Redeliveries,
+	}
+	if ackedSeq := sub.AckedSeq.SafeSequence(); lastSeq > ackedSeq {
+		status.Lag = lastSeq - ackedSeq
+	}
+	return status, nil
+}
+
+// DeleteChangesSubscription removes the subscription, discarding its progress.
+func (db *DatabaseContext) DeleteChangesSubscription(name string) error {
+	err := db.Bucket.Delete(changesSubscriptionKey(name))
+	if base.IsDocNotFoundError(err) {
+		return base.HTTPErrorf(http.StatusNotFound, "Subscription not found")
+	}
+	return err
+}
+
+// ReadChangesSubscription returns the next batch of changes for a consumer of the subscription, leasing it to the
+// consumer until it's acked or the ack timeout expires.  Batches whose lease has expired are redelivered before any
+// new changes are read.  The batch is empty when there are no changes to read.
+//
+// Changes are read before the subscription is updated, so that CAS retries don't repeat the read.  If another
+// consumer is dispatched the same changes first, the read is retried from the subscription's new state.
+func (db *Database) ReadChangesSubscription(name, consumer string) (*ChangesSubscriptionBatch, error) {
+	for attempt := 0; attempt < maxChangesSubscriptionReadAttempts; attempt++ {
+		sub, err := db.GetChangesSubscription(name)
+		if err != nil {
+			return nil, err
+		}
+		predicate, err := sub.validate()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+
+		var batch *ChangesSubscriptionBatch
+		if lease := sub.expiredLease(now.Unix()); lease != nil {
+			batch, err = db.redeliverChangesSubscriptionBatch(sub, predicate, lease, consumer, now)
+		} else {
+			batch, err = db.readNextChangesSubscriptionBatch(sub, predicate, consumer, now)
+		}
+		if err == errChangesSubscriptionMoved {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return batch, nil
+	}
+	return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Too many concurrent reads for subscription")
+}
+
+// redeliverChangesSubscriptionBatch reads the changes for the expired lease, and leases them to the consumer.
+func (db *Database) redeliverChangesSubscriptionBatch(sub *ChangesSubscription, predicate *ChangesPredicate, lease *subscriptionLease, consumer string, now time.Time) (*ChangesSubscriptionBatch, error) {
+	since, lastSeq := lease.Since, lease.LastSeq
+	changes, err := db.getChangesSubscriptionChanges(sub, predicate, since, &lastSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.updateChangesSubscription(sub.Name, false, func(current *ChangesSubscription) error {
+		// The lease must still be expired, or it's been redelivered, acked or discarded since it was read
+		var currentLease *subscriptionLease
+		for _, l := range current.Leases {
+			if l.Since == since && l.LastSeq == lastSeq {
+				currentLease = l
+				break
+			}
+		}
+		if currentLease == nil || currentLease.Expiry > now.Unix() {
+			return errChangesSubscriptionMoved
+		}
+		currentLease.Expiry = now.Add(time.Duration(current.AckTimeoutSecs) * time.Second).Unix()
+		currentLease.Consumer = consumer
+		current.Redeliveries++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ChangesSubscriptionBatch{Results: changes, LastSeq: &lastSeq, Redelivery: true}, nil
+}
+
+// readNextChangesSubscriptionBatch reads the changes after the subscription's dispatched sequence, and leases them
+// to the consumer.
+func (db *Database) readNextChangesSubscriptionBatch(sub *ChangesSubscription, predicate *ChangesPredicate, consumer string, now time.Time) (*ChangesSubscriptionBatch, error) {
+	if len(sub.Leases) >= maxChangesSubscriptionLeases {
+		return nil, base.HTTPErrorf(http.StatusServiceUnavailable, "Too many unacked batches for subscription")
+	}
+	since := sub.DispatchedSeq
+	changes, lastSeq, err := db.getNextChangesSubscriptionChanges(sub, predicate)
+	if err != nil {
+		return nil, err
+	}
+	batch := &ChangesSubscriptionBatch{Results: changes}
+	if lastSeq == nil {
+		return batch, nil
+	}
+
+	err = db.updateChangesSubscription(sub.Name, false, func(current *ChangesSubscription) error {
+		// Another consumer has been dispatched the changes since they were read
+		if current.DispatchedSeq != since {
+			return errChangesSubscriptionMoved
+		}
+		if len(current.Leases) >= maxChangesSubscriptionLeases {
+			return base.HTTPErrorf(http.StatusServiceUnavailable, "Too many unacked batches for subscription")
+		}
+		current.DispatchedSeq = *lastSeq
+		if len(changes) > 0 {
+			expiry := now.Add(time.Duration(current.AckTimeoutSecs) * time.Second).Unix()
+			current.Leases = append(current.Leases, &subscriptionLease{Since: since, LastSeq: *lastSeq, Expiry: expiry, Consumer: consumer})
+		}
+		// Batches with no changes matching the filter don't need to be acked
+		current.updateAckedSeq()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(changes) > 0 {
+		batch.LastSeq = lastSeq
+	}
+	return batch, nil
+}
+
+// getNextChangesSubscriptionChanges returns the changes after the subscription's dispatched sequence, along with the
+// last sequence read.  The last sequence is nil when there are no changes.
+func (db *Database) getNextChangesSubscriptionChanges(sub *ChangesSubscription, predicate *ChangesPredicate) ([]*ChangeEntry, *SequenceID, error) {
+	changes, err := db.GetChanges(changesSubscriptionChannels(sub), ChangesOptions{
+		Since:       sub.DispatchedSeq,
+		Limit:       sub.BatchSize,
+		IncludeDocs: sub.IncludeDocs,
+		Ctx:         db.Ctx,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(changes) == 0 {
+		return changes, nil, nil
+	}
+	lastSeq := changes[len(changes)-1].Seq
+	return db.filterChangesSubscriptionChanges(changes, predicate), &lastSeq, nil
+}
+
+// getChangesSubscriptionChanges returns the changes after since, up to and including lastSeq, to redeliver a batch.
+// Documents updated since the batch was first read are omitted, as their latest change follows the batch.
+func (db *Database) getChangesSubscriptionChanges(sub *ChangesSubscription, predicate *ChangesPredicate, since SequenceID, lastSeq *SequenceID) ([]*ChangeEntry, error) {
+	changes, err := db.GetChanges(changesSubscriptionChannels(sub), ChangesOptions{
+		Since:       since,
+		Limit:       sub.BatchSize,
+		IncludeDocs: sub.IncludeDocs,
+		Ctx:         db.Ctx,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, change := range changes {
+		if lastSeq.Before(change.Seq) {
+			changes = changes[:i]
+			break
+		}
+	}
+	return db.filterChangesSubscriptionChanges(changes, predicate), nil
+}
+
+// filterChangesSubscriptionChanges removes changes that don't match the predicate.  Tombstones and removals are
+// always delivered.
+func (db *Database) filterChangesSubscriptionChanges(changes []*ChangeEntry, predicate *ChangesPredicate) []*ChangeEntry {
+	if predicate == nil {
+		return changes
+	}
+	filtered := changes[:0]
+	for _, change := range changes {
+		if change.Deleted || len(change.Removed) > 0 || len(change.Changes) == 0 {
+			filtered = append(filtered, change)
+			continue
+		}
+		_, matches, err := db.revisionMatchesPredicate(predicate, change.ID, change.Changes[0]["rev"])
+		if err != nil {
+			base.WarnfCtx(db.Ctx, "Unable to evaluate subscription predicate for %s, will deliver change: %v", base.UD(change.ID), err)
+			matches = true
+		}
+		if matches {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+func changesSubscriptionChannels(sub *ChangesSubscription) base.Set {
+	if len(sub.Channels) == 0 {
+		return base.SetOf(channels.UserStarChannel)
+	}
+	chans, _ := channels.SetFromArray(sub.Channels, channels.KeepStar)
+	return chans
+}
+
+// AckChangesSubscription acks the batch of the subscription ending at the given sequence, so its changes aren't
+// redelivered.  Acking a batch that has already been acked is a no-op.
+func (db *DatabaseContext) AckChangesSubscription(name string, seq SequenceID) error {
+	return db.updateChangesSubscription(name, false, func(sub *ChangesSubscription) error {
+		for i, lease := range sub.Leases {
+			if lease.LastSeq.Equals(seq) {
+				sub.Leases = append(sub.Leases[:i], sub.Leases[i+1:]...)
+				sub.updateAckedSeq()
+				return nil
+			}
+		}
+		if sub.DispatchedSeq.Before(seq) {
+			return base.HTTPErrorf(http.StatusConflict, "Sequence %s hasn't been read from the subscription", seq)
+		}
+		return base.ErrUpdateCancel
+	})
+}
@@ -0,0 +1,235 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func changeIDs(changes []*ChangeEntry) []string {
+	ids := make([]string, 0, len(changes))
+	for _, change := range changes {
+		ids = append(ids, change.ID)
+	}
+	return ids
+}
+
+func putSubscriptionTestDocs(t *testing.T, db *Database, count int) {
+	for i := 1; i <= count; i++ {
+		_, _, err := db.Put(fmt.Sprintf("doc%d", i), Body{"n": i, "channels": []string{"A"}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.changeCache.waitForSequence(context.TODO(), uint64(count), base.DefaultWaitForSequence))
+}
+
+func TestChangesSubscriptionCompetingConsumers(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	putSubscriptionTestDocs(t, db, 5)
+
+	created, err := db.PutChangesSubscription("sub1", ChangesSubscriptionConfig{BatchSize: 2}, nil)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	// Each consumer gets a different batch
+	batchA, err := db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc1", "doc2"}, changeIDs(batchA.Results))
+	batchB, err := db.ReadChangesSubscription("sub1", "B")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc3", "doc4"}, changeIDs(batchB.Results))
+
+	// The acked sequence only moves past batches once all earlier batches are acked
+	require.NoError(t, db.AckChangesSubscription("sub1", *batchB.LastSeq))
+	status, err := db.GetChangesSubscriptionStatus("sub1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), status.AckedSeq.Seq)
+	assert.Equal(t, uint64(4), status.DispatchedSeq.Seq)
+	assert.Equal(t, 1, status.InFlight)
+	assert.Equal(t, uint64(5), status.Lag)
+
+	require.NoError(t, db.AckChangesSubscription("sub1", *batchA.LastSeq))
+	status, err = db.GetChangesSubscriptionStatus("sub1")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), status.AckedSeq.Seq)
+	assert.Equal(t, 0, status.InFlight)
+	assert.Equal(t, uint64(1), status.Lag)
+
+	// Acks are idempotent, but sequences that haven't been read can't be acked
+	require.NoError(t, db.AckChangesSubscription("sub1", *batchA.LastSeq))
+	assertHTTPError(t, db.AckChangesSubscription("sub1", SequenceID{Seq: 5}), http.StatusConflict)
+
+	batch, err := db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc5"}, changeIDs(batch.Results))
+	require.NoError(t, db.AckChangesSubscription("sub1", *batch.LastSeq))
+
+	// No changes to read
+	batch, err = db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	assert.Empty(t, batch.Results)
+	assert.Nil(t, batch.LastSeq)
+
+	// Reconfiguring keeps the cursor, unless since is given
+	created, err = db.PutChangesSubscription("sub1", ChangesSubscriptionConfig{BatchSize: 10}, nil)
+	require.NoError(t, err)
+	assert.False(t, created)
+	batch, err = db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	assert.Empty(t, batch.Results)
+	_, err = db.PutChangesSubscription("sub1", ChangesSubscriptionConfig{BatchSize: 10}, &SequenceID{Seq: 3})
+	require.NoError(t, err)
+	batch, err = db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc4", "doc5"}, changeIDs(batch.Results))
+
+	require.NoError(t, db.DeleteChangesSubscription("sub1"))
+	_, err = db.ReadChangesSubscription("sub1", "A")
+	assertHTTPError(t, err, http.StatusNotFound)
+	assertHTTPError(t, db.DeleteChangesSubscription("sub1"), http.StatusNotFound)
+}
+
+func TestChangesSubscriptionRedelivery(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	putSubscriptionTestDocs(t, db, 3)
+
+	_, err := db.PutChangesSubscription("sub1", ChangesSubscriptionConfig{BatchSize: 2}, nil)
+	require.NoError(t, err)
+	batchA, err := db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	require.Len(t, batchA.Results, 2)
+
+	// Expire the lease, so the batch is redelivered to the next consumer before any new changes
+	require.NoError(t, db.updateChangesSubscription("sub1", false, func(sub *ChangesSubscription) error {
+		sub.Leases[0].Expiry = 0
+		return nil
+	}))
+	batchB, err := db.ReadChangesSubscription("sub1", "B")
+	require.NoError(t, err)
+	assert.True(t, batchB.Redelivery)
+	assert.Equal(t, []string{"doc1", "doc2"}, changeIDs(batchB.Results))
+	assert.Equal(t, batchA.LastSeq, batchB.LastSeq)
+
+	batch, err := db.ReadChangesSubscription("sub1", "B")
+	require.NoError(t, err)
+	assert.False(t, batch.Redelivery)
+	assert.Equal(t, []string{"doc3"}, changeIDs(batch.Results))
+
+	status, err := db.GetChangesSubscriptionStatus("sub1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), status.Redeliveries)
+	assert.Equal(t, 2, status.InFlight)
+}
+
+func TestChangesSubscriptionConcurrentReads(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	putSubscriptionTestDocs(t, db, 20)
+
+	_, err := db.PutChangesSubscription("sub1", ChangesSubscriptionConfig{BatchSize: 2}, nil)
+	require.NoError(t, err)
+
+	// Changes read from a subscription that another consumer has since read from aren't dispatched
+	stale, err := db.GetChangesSubscription("sub1")
+	require.NoError(t, err)
+	predicate, err := stale.validate()
+	require.NoError(t, err)
+	_, err = db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	_, err = db.readNextChangesSubscriptionBatch(stale, predicate, "B", time.Now())
+	assert.Equal(t, errChangesSubscriptionMoved, err)
+
+	// Likewise for an expired lease that's been redelivered to another consumer
+	require.NoError(t, db.updateChangesSubscription("sub1", false, func(sub *ChangesSubscription) error {
+		sub.Leases[0].Expiry = 0
+		return nil
+	}))
+	stale, err = db.GetChangesSubscription("sub1")
+	require.NoError(t, err)
+	batch, err := db.ReadChangesSubscription("sub1", "A")
+	require.NoError(t, err)
+	require.True(t, batch.Redelivery)
+	_, err = db.redeliverChangesSubscriptionBatch(stale, predicate, stale.Leases[0], "B", time.Now())
+	assert.Equal(t, errChangesSubscriptionMoved, err)
+	require.NoError(t, db.AckChangesSubscription("sub1", *batch.LastSeq))
+
+	// Concurrent consumers are each dispatched different changes
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	dispatched := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(consumer string) {
+			defer wg.Done()
+			for {
+				batch, err := db.ReadChangesSubscription("sub1", consumer)
+				if !assert.NoError(t, err) || len(batch.Results) == 0 {
+					return
+				}
+				lock.Lock()
+				for _, id := range changeIDs(batch.Results) {
+					dispatched[id]++
+				}
+				lock.Unlock()
+				assert.NoError(t, db.AckChangesSubscription("sub1", *batch.LastSeq))
+			}
+		}(fmt.Sprintf("consumer%d", i))
+	}
+	wg.Wait()
+	assert.Len(t, dispatched, 18)
+	for id, count := range dispatched {
+		assert.Equal(t, 1, count, "%s dispatched more than once", id)
+	}
+}
+
+func TestChangesSubscriptionFilters(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	putSubscriptionTestDocs(t, db, 4)
+
+	_, err := db.PutChangesSubscription("predicate", ChangesSubscriptionConfig{
+		Filter:    base.PredicateFilter,
+		Predicate: json.RawMessage(`{"n": {"$gte": 3}}`),
+	}, nil)
+	require.NoError(t, err)
+	batch, err := db.ReadChangesSubscription("predicate", "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"doc3", "doc4"}, changeIDs(batch.Results))
+
+	_, err = db.PutChangesSubscription("channel", ChangesSubscriptionConfig{Channels: []string{"B"}}, nil)
+	require.NoError(t, err)
+	batch, err = db.ReadChangesSubscription("channel", "")
+	require.NoError(t, err)
+	assert.Empty(t, batch.Results)
+
+	for _, invalid := range []ChangesSubscriptionConfig{
+		{Filter: "unknown"},
+		{Filter: base.PredicateFilter, Predicate: json.RawMessage(`{"$unknown": 1}`)},
+		{Predicate: json.RawMessage(`{"n": 1}`)},
+		{BatchSize: -1},
+	} {
+		_, err = db.PutChangesSubscription("invalid", invalid, nil)
+		assertHTTPError(t, err, http.StatusBadRequest)
+	}
+	_, err = db.PutChangesSubscription("invalid/name", ChangesSubscriptionConfig{}, nil)
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"fmt"
+	"hash/crc32"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+)
+
+// conflictIndexShardCount is the number of documents the conflict index is spread across, to limit both the size of
+// each index document and CAS contention between concurrent writers.
+const conflictIndexShardCount = 16
+
+// maxConflictIndexShardBytes bounds the size of a single shard document.  Entries vary in size with the number of
+// conflicting revisions and channels, so the bound is on the serialized shard rather than the number of entries.  Each
+// conflicted write rewrites its shard, so this is kept small to limit write amplification.
+const maxConflictIndexShardBytes = 1024 * 1024
+
+// ConflictedDoc is an entry in the conflict index, identifying a document with more than one non-tombstoned leaf
+// revision.
+type ConflictedDoc struct {
+	DocID     string   `json:"id"`
+	RevID     string   `json:"rev"`                // Current (winning) revision
+	Conflicts []string `json:"conflicts"`          // Non-winning, non-tombstoned leaf revisions
+	Channels  []string `json:"channels,omitempty"` // Union of the channels of all non-tombstoned leaf revisions
+	Sequence  uint64   `json:"seq"`
+}
+
+// newConflictedDoc builds the conflict index entry for the given document from its revision tree.
+func newConflictedDoc(doc *Document) *ConflictedDoc {
+	entry := &ConflictedDoc{
+		DocID:     doc.ID,
+		RevID:     doc.CurrentRev,
+		Conflicts: []string{},
+		Sequence:  doc.Sequence,
+	}
+	channelSet := base.Set{}
+	for _, leafRevID := range doc.History.GetLeaves() {
+		leaf := doc.History[leafRevID]
+		if leaf.Deleted {
+			continue
+		}
+		if leafRevID != doc.CurrentRev {
+			entry.Conflicts = append(entry.Conflicts, leafRevID)
+		}
+		for channelName := range leaf.Channels {
+			channelSet = channelSet.Add(channelName)
+		}
+	}
+	sort.Strings(entry.Conflicts)
+	entry.Channels = channelSet.ToArray()
+	sort.Strings(entry.Channels)
+	return entry
+}
+
+// inChannels returns true if the entry is in any of the given channels.
+func (entry *ConflictedDoc) inChannels(channelFilter base.Set) bool {
+	for _, channelName := range entry.Channels {
+		if channelFilter.Contains(channelName) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictIndexShard is the persisted form of a single shard of the conflict index, keyed by doc ID.
+type conflictIndexShard struct {
+	Docs map[string]*ConflictedDoc `json:"docs"`
+}
+
+// conflictIndex tracks documents that are in conflict.  Entries are maintained on write by updateAndReturnDoc, and
+// persisted across a fixed set of _sync:conflicts shard documents so that the index is shared by all nodes.  Writes to
+// the index are not atomic with the document write, so entries are re-validated against the document when the index
+// is read, and stale entries are removed at that point.  Documents that were already in conflict before the index
+// existed aren't indexed until their next write, or until the index is rebuilt with RebuildConflictIndex.
+type conflictIndex struct {
+	bucket      base.Bucket
+	stat        *base.SgwIntStat // Gauge tracking the number of entries in the index, may be nil
+	lock        sync.Mutex       // lock guards shardCounts
+	shardCounts [conflictIndexShardCount]int
+}
+
+func newConflictIndex(bucket base.Bucket, stat *base.SgwIntStat) *conflictIndex {
+	return &conflictIndex{
+		bucket: bucket,
+		stat:   stat,
+	}
+}
+
+// conflictIndexShardKey returns the key of the shard document that holds the entry for the given doc ID.
+func conflictIndexShardKey(docID string) string {
+	return conflictIndexShardKeyForIndex(int(crc32.ChecksumIEEE([]byte(docID)) % conflictIndexShardCount))
+}
+
+func conflictIndexShardKeyForIndex(shardIndex int) string {
+	return base.ConflictIndexPrefix + strconv.Itoa(shardIndex)
+}
+
+// load reads all shards, to initialize the conflicted docs stat.
+func (ci *conflictIndex) load() error {
+	_, err := ci.listAll()
+	return err
+}
+
+// update adds, replaces or removes the entry for the given document based on the document's current conflict flag.
+// An update for a document sequence older than the one already indexed is ignored.
+func (ci *conflictIndex) update(doc *Document) error {
+	if !doc.hasFlag(channels.Conflict) {
+		return ci.remove(doc.ID, doc.Sequence)
+	}
+	entry := newConflictedDoc(doc)
+	return ci.updateShard(conflictIndexShardKey(doc.ID), func(shard *conflictIndexShard) bool {
+		existing, ok := shard.Docs[entry.DocID]
+		if ok && existing.Sequence > entry.Sequence {
+			return false
+		}
+		shard.Docs[entry.DocID] = entry
+		return true
+	})
+}
+
+// remove deletes the entry for the given doc ID, if the indexed entry isn't newer than the given sequence.
+func (ci *conflictIndex) remove(docID string, sequence uint64) error {
+	return ci.updateShard(conflictIndexShardKey(docID), func(shard *conflictIndexShard) bool {
+		existing, ok := shard.Docs[docID]
+		if !ok || existing.Sequence > sequence {
+			return false
+		}
+		delete(shard.Docs, docID)
+		return true
+	})
+}
+
+// listAll returns all entries in the index, ordered by doc ID.
+func (ci *conflictIndex) listAll() ([]*ConflictedDoc, error) {
+	entries := make([]*ConflictedDoc, 0)
+	for i := 0; i < conflictIndexShardCount; i++ {
+		shard := &conflictIndexShard{}
+		_, err := ci.bucket.Get(conflictIndexShardKeyForIndex(i), shard)
+		if err != nil && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		for _, entry := range shard.Docs {
+			entries = append(entries, entry)
+		}
+		ci.setShardCount(i, len(shard.Docs))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DocID < entries[j].DocID
+	})
+	return entries, nil
+}
+
+// updateShard applies updateFn to the persisted shard with CAS handling.  When updateFn returns false the write is
+// cancelled.  The shard document is removed once its last entry has been removed.
+func (ci *conflictIndex) updateShard(key string, updateFn func(shard *conflictIndexShard) (updated bool)) error {
+	var shardSize int
+	_, err := ci.bucket.Update(key, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		shard := &conflictIndexShard{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, shard); err != nil {
+				return nil, nil, false, fmt.Errorf("unable to unmarshal conflict index shard %s: %w", key, err)
+			}
+		}
+		if shard.Docs == nil {
+			shard.Docs = map[string]*ConflictedDoc{}
+		}
+		if !updateFn(shard) {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		shardSize = len(shard.Docs)
+		if shardSize == 0 {
+			return nil, nil, true, nil
+		}
+		shardBytes, err := base.JSONMarshal(shard)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		// Removals are always allowed, so that a full shard can drain
+		if len(shardBytes) > maxConflictIndexShardBytes && len(shardBytes) > len(current) {
+			base.Warnf("Conflict index shard %s is full (%d entries) - not recording conflict", base.MD(key), len(shard.Docs))
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		return shardBytes, nil, false, nil
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	shardIndex, _ := strconv.Atoi(key[len(base.ConflictIndexPrefix):])
+	ci.setShardCount(shardIndex, shardSize)
+	return nil
+}
+
+func (ci *conflictIndex) setShardCount(shardIndex int, count int) {
+	ci.lock.Lock()
+	ci.shardCounts[shardIndex] = count
+	total := 0
+	for _, shardCount := range ci.shardCounts {
+		total += shardCount
+	}
+	ci.lock.Unlock()
+	if ci.stat != nil {
+		ci.stat.Set(int64(total))
+	}
+}
+
+// ConflictedDocs is a page of results from the conflict index.
+type ConflictedDocs struct {
+	Rows         []*ConflictedDoc `json:"rows"`
+	TotalRows    int              `json:"total_rows"`              // Number of indexed docs matching the channel filter
+	NextStartKey string           `json:"next_startkey,omitempty"` // Set when there are further results after this page
+}
+
+// GetConflictedDocs returns the documents currently in conflict, ordered by doc ID and starting at startKey.  When
+// channelFilter is non-empty, only documents with a non-tombstoned leaf revision in one of the given channels are
+// returned.  A limit of zero returns all matching documents.
+func (db *Database) GetConflictedDocs(startKey string, limit int, channelFilter base.Set) (*ConflictedDocs, error) {
+	entries, err := db.conflictIndex.listAll()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ConflictedDocs{Rows: []*ConflictedDoc{}}
+	for _, entry := range entries {
+		if len(channelFilter) == 0 || entry.inChannels(channelFilter) {
+			result.TotalRows++
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.DocID < startKey {
+			continue
+		}
+		if limit > 0 && len(result.Rows) >= limit {
+			result.NextStartKey = entry.DocID
+			break
+		}
+
+		// The index may lag the document, so use the current state of the document in the response.
+		current, err := db.getConflictedDoc(entry)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+		if len(channelFilter) > 0 && !current.inChannels(channelFilter) {
+			continue
+		}
+		result.Rows = append(result.Rows, current)
+	}
+	return result, nil
+}
+
+// getConflictedDoc validates an index entry against the document, returning the refreshed entry, or nil when the
+// document is no longer in conflict.  Stale entries are removed from the index.
+func (db *Database) getConflictedDoc(entry *ConflictedDoc) (*ConflictedDoc, error) {
+	doc, err := db.GetDocument(entry.DocID, DocUnmarshalSync)
+	if base.IsDocNotFoundError(err) {
+		if removeErr := db.conflictIndex.remove(entry.DocID, math.MaxUint64); removeErr != nil {
+			base.Warnf("Unable to remove conflict index entry for missing doc %s: %v", base.UD(entry.DocID), removeErr)
+		}
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !doc.hasFlag(channels.Conflict) {
+		if removeErr := db.conflictIndex.remove(doc.ID, doc.Sequence); removeErr != nil {
+			base.Warnf("Unable to remove conflict index entry for doc %s: %v", base.UD(doc.ID), removeErr)
+		}
+		return nil, nil
+	}
+	return newConflictedDoc(doc), nil
+}
+
+// RebuildConflictIndex scans all documents, adding those in conflict to the conflict index.  It's used to index
+// conflicts that predate the index, e.g. after upgrading.  Entries for documents that are no longer in conflict are
+// left to be removed when the index is read.  Returns the number of conflicted documents found.
+func (db *Database) RebuildConflictIndex() (int, error) {
+	base.Infof(base.KeyAll, "Rebuilding conflict index for database %s...", base.MD(db.Name))
+	conflictedDocs := 0
+	err := db.ForEachDocID(func(id IDRevAndSequence, _ []string) (bool, error) {
+		doc, err := db.GetDocument(id.DocID, DocUnmarshalSync)
+		if base.IsDocNotFoundError(err) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		if !doc.hasFlag(channels.Conflict) {
+			return false, nil
+		}
+		if err := db.conflictIndex.update(doc); err != nil {
+			return false, err
+		}
+		conflictedDocs++
+		return true, nil
+	}, ForEachDocIDOptions{})
+	if err != nil {
+		return conflictedDocs, err
+	}
+	base.Infof(base.KeyAll, "Rebuilt conflict index for database %s, found %d conflicted documents", base.MD(db.Name), conflictedDocs)
+	return conflictedDocs, nil
+}
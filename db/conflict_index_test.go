@@ -0,0 +1,215 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// createConflictedDoc creates a document with two conflicting 2-a and 2-b revisions in the given channels.
+func createConflictedDoc(t *testing.T, db *Database, docID string, channelA, channelB string) {
+	_, _, err := db.PutExistingRevWithBody(docID, Body{"n": 1, "channels": []string{channelA}}, []string{"1-a"}, false)
+	require.NoError(t, err)
+	_, _, err = db.PutExistingRevWithBody(docID, Body{"n": 2, "channels": []string{channelA}}, []string{"2-a", "1-a"}, false)
+	require.NoError(t, err)
+	_, _, err = db.PutExistingRevWithBody(docID, Body{"n": 3, "channels": []string{channelB}}, []string{"2-b", "1-a"}, false)
+	require.NoError(t, err)
+}
+
+func activeLeaves(doc *Document) []string {
+	return doc.History.GetLeavesFiltered(func(revID string) bool {
+		return !doc.History[revID].Deleted
+	})
+}
+
+func TestConflictIndex(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer db.Close()
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	createConflictedDoc(t, db, "doc1", "A", "B")
+	createConflictedDoc(t, db, "doc2", "A", "A")
+	createConflictedDoc(t, db, "doc3", "C", "C")
+	_, _, err := db.Put("doc4", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+
+	conflicts, err := db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, conflicts.TotalRows)
+	require.Len(t, conflicts.Rows, 3)
+	assert.Equal(t, "doc1", conflicts.Rows[0].DocID)
+	assert.Equal(t, "2-b", conflicts.Rows[0].RevID)
+	assert.Equal(t, []string{"2-a"}, conflicts.Rows[0].Conflicts)
+	assert.Equal(t, []string{"A", "B"}, conflicts.Rows[0].Channels)
+	assert.Equal(t, int64(3), db.DbStats.Database().ConflictedDocsCount.Value())
+
+	// Channel filter
+	conflicts, err = db.GetConflictedDocs("", 0, base.SetOf("B", "C"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, conflicts.TotalRows)
+	require.Len(t, conflicts.Rows, 2)
+	assert.Equal(t, "doc1", conflicts.Rows[0].DocID)
+	assert.Equal(t, "doc3", conflicts.Rows[1].DocID)
+
+	// Paging
+	conflicts, err = db.GetConflictedDocs("", 2, nil)
+	require.NoError(t, err)
+	require.Len(t, conflicts.Rows, 2)
+	assert.Equal(t, "doc3", conflicts.NextStartKey)
+	conflicts, err = db.GetConflictedDocs(conflicts.NextStartKey, 2, nil)
+	require.NoError(t, err)
+	require.Len(t, conflicts.Rows, 1)
+	assert.Equal(t, "doc3", conflicts.Rows[0].DocID)
+	assert.Equal(t, "", conflicts.NextStartKey)
+
+	// Tombstoning a conflicting branch removes the doc from the index
+	_, _, err = db.PutExistingRevWithBody("doc2", Body{BodyDeleted: true}, []string{"3-a", "2-a"}, false)
+	require.NoError(t, err)
+	conflicts, err = db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, conflicts.TotalRows)
+	assert.Equal(t, int64(2), db.DbStats.Database().ConflictedDocsCount.Value())
+
+	// A purged doc is lazily removed from the index when listed
+	require.NoError(t, db.Purge("doc3"))
+	conflicts, err = db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, conflicts.Rows, 1)
+	assert.Equal(t, "doc1", conflicts.Rows[0].DocID)
+	conflicts, err = db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, conflicts.TotalRows)
+}
+
+func TestRebuildConflictIndex(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer db.Close()
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	createConflictedDoc(t, db, "doc1", "A", "B")
+	createConflictedDoc(t, db, "doc2", "A", "A")
+	_, _, err := db.Put("doc3", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+
+	// Simulate conflicts that predate the index
+	for i := 0; i < conflictIndexShardCount; i++ {
+		err := db.Bucket.Delete(conflictIndexShardKeyForIndex(i))
+		if err != nil && !base.IsDocNotFoundError(err) {
+			require.NoError(t, err)
+		}
+	}
+	conflicts, err := db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, conflicts.TotalRows)
+
+	count, err := db.RebuildConflictIndex()
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+	conflicts, err = db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	require.Len(t, conflicts.Rows, 2)
+	assert.Equal(t, "doc1", conflicts.Rows[0].DocID)
+	assert.Equal(t, "doc2", conflicts.Rows[1].DocID)
+	assert.Equal(t, int64(2), db.DbStats.Database().ConflictedDocsCount.Value())
+}
+
+func TestConflictIndexShardSizeBound(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+	ci := newConflictIndex(bucket, nil)
+
+	// A shard over the size bound, e.g. due to a doc with many conflicting revisions
+	key := conflictIndexShardKey("large")
+	conflicts := make([]string, 0)
+	for i := 0; len(conflicts)*50 < maxConflictIndexShardBytes; i++ {
+		conflicts = append(conflicts, fmt.Sprintf("2-%047d", i))
+	}
+	require.NoError(t, bucket.Set(key, 0, conflictIndexShard{Docs: map[string]*ConflictedDoc{
+		"large": {DocID: "large", RevID: "2-a", Conflicts: conflicts, Sequence: 1},
+	}}))
+
+	// Entries aren't added to a full shard
+	require.NoError(t, ci.updateShard(key, func(shard *conflictIndexShard) bool {
+		shard.Docs["doc1"] = &ConflictedDoc{DocID: "doc1", RevID: "2-a", Conflicts: []string{"2-b"}, Sequence: 2}
+		return true
+	}))
+	shard := &conflictIndexShard{}
+	_, err := bucket.Get(key, shard)
+	require.NoError(t, err)
+	assert.NotContains(t, shard.Docs, "doc1")
+
+	// Entries can still be removed
+	require.NoError(t, ci.remove("large", math.MaxUint64))
+	_, _, err = bucket.GetRaw(key)
+	assert.True(t, base.IsDocNotFoundError(err))
+}
+
+func TestResolveConflict(t *testing.T) {
+
+	db := setupTestDB(t)
+	defer db.Close()
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	// Winner is the non-winning branch, so the current rev must be tombstoned
+	createConflictedDoc(t, db, "doc1", "A", "B")
+	newRevID, err := db.ResolveConflict("doc1", "2-a", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, genOfRevID(newRevID))
+
+	doc, err := db.GetDocument("doc1", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	assert.Equal(t, newRevID, doc.CurrentRev)
+	assert.Equal(t, "2-a", doc.History[newRevID].Parent)
+	assert.Equal(t, json.Number("2"), doc.Body()["n"])
+	assert.Equal(t, []string{newRevID}, activeLeaves(doc))
+
+	// Merged body as a child of the current rev, the other branch is tombstoned
+	createConflictedDoc(t, db, "doc2", "A", "B")
+	newRevID, err = db.ResolveConflict("doc2", "", Body{"n": 5, "channels": []string{"A", "B"}})
+	require.NoError(t, err)
+
+	doc, err = db.GetDocument("doc2", DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.False(t, doc.hasFlag(channels.Conflict))
+	assert.Equal(t, newRevID, doc.CurrentRev)
+	assert.Equal(t, "2-b", doc.History[newRevID].Parent)
+	assert.Equal(t, []string{newRevID}, activeLeaves(doc))
+
+	conflicts, err := db.GetConflictedDocs("", 0, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, conflicts.TotalRows)
+	assert.Equal(t, int64(2), db.DbStats.Database().ConflictsResolvedCount.Value())
+
+	// Doc no longer in conflict
+	_, err = db.ResolveConflict("doc2", "", Body{"n": 6})
+	assertHTTPError(t, err, http.StatusConflict)
+
+	// Winner isn't a leaf
+	createConflictedDoc(t, db, "doc3", "A", "B")
+	_, err = db.ResolveConflict("doc3", "1-a", nil)
+	assertHTTPError(t, err, http.StatusBadRequest)
+
+	// Missing doc
+	_, err = db.ResolveConflict("missing", "1-a", nil)
+	assertHTTPError(t, err, http.StatusNotFound)
+}
@@ -0,0 +1,417 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// couchDBClient issues CouchDB replication protocol requests (_changes, _revs_diff, _bulk_get, _bulk_docs and _local
+// checkpoints) against a remote database.
+type couchDBClient struct {
+	dbURL  url.URL       // Remote database URL, without credentials
+	user   *url.Userinfo // Basic auth credentials, may be nil
+	client *http.Client
+}
+
+func newCouchDBClient(remoteURL *url.URL, insecureSkipVerify bool) *couchDBClient {
+	dbURL := *remoteURL
+	dbURL.User = nil
+	dbURL.Path = strings.TrimSuffix(dbURL.Path, "/")
+	return &couchDBClient{
+		dbURL:  dbURL,
+		user:   remoteURL.User, // Userinfo is immutable, so can be shared
+		client: base.GetHttpClient(insecureSkipVerify),
+	}
+}
+
+// couchDBChange is a row in a _changes response.
+type couchDBChange struct {
+	Seq     interface{} `json:"seq"`
+	ID      string      `json:"id"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+	Deleted bool     `json:"deleted,omitempty"`
+	Removed []string `json:"removed,omitempty"` // Channels the doc was removed from, Sync Gateway only
+}
+
+// couchDBChanges is a _changes response.  LastSeq is opaque - CouchDB and Sync Gateway return sequences in different
+// forms, so it's retained as the string to be passed back as since in the next request.
+type couchDBChanges struct {
+	Results []couchDBChange `json:"results"`
+	LastSeq string          `json:"-"`
+}
+
+// couchDBRevsDiff is the _revs_diff response for a single document.
+type couchDBRevsDiff struct {
+	Missing           []string `json:"missing"`
+	PossibleAncestors []string `json:"possible_ancestors,omitempty"`
+}
+
+// couchDBBulkGetItem identifies a revision requested via _bulk_get.
+type couchDBBulkGetItem struct {
+	ID        string   `json:"id"`
+	Rev       string   `json:"rev"`
+	AttsSince []string `json:"atts_since,omitempty"`
+}
+
+// couchDBBulkGetResult is a revision returned by _bulk_get.  Err is set when the remote was unable to return the
+// requested revision.
+type couchDBBulkGetResult struct {
+	DocID string
+	RevID string
+	Body  Body
+	Err   error
+}
+
+// couchDBDocStatus is the per-document result of a _bulk_docs request.
+type couchDBDocStatus struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	Status int    `json:"status,omitempty"`
+}
+
+// statusCode returns the HTTP status associated with a _bulk_docs error.  CouchDB only returns the error name, so the
+// status is derived from that when not present.
+func (s *couchDBDocStatus) statusCode() int {
+	if s.Status != 0 {
+		return s.Status
+	}
+	switch s.Error {
+	case "conflict":
+		return http.StatusConflict
+	case "forbidden":
+		return http.StatusForbidden
+	case "unauthorized":
+		return http.StatusUnauthorized
+	case "not_found":
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// checkRemote verifies the remote database is reachable, to exit early with a clearer error message.
+func (c *couchDBClient) checkRemote(ctx context.Context) error {
+	return c.doJSON(ctx, http.MethodGet, "", nil, nil, nil)
+}
+
+// changes requests a page of changes since the given sequence.
+func (c *couchDBClient) changes(ctx context.Context, since string, params url.Values) (*couchDBChanges, error) {
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+
+	var response struct {
+		Results []couchDBChange `json:"results"`
+		LastSeq interface{}     `json:"last_seq"`
+	}
+	if err := c.doJSON(ctx, http.MethodGet, "/_changes", query, nil, &response); err != nil {
+		return nil, err
+	}
+
+	changes := &couchDBChanges{Results: response.Results}
+	switch lastSeq := response.LastSeq.(type) {
+	case nil:
+	case string:
+		changes.LastSeq = lastSeq
+	default:
+		changes.LastSeq = fmt.Sprintf("%v", lastSeq)
+	}
+	return changes, nil
+}
+
+// revsDiff returns the revisions in the given set that are missing on the remote, keyed by doc ID.
+func (c *couchDBClient) revsDiff(ctx context.Context, revs map[string][]string) (map[string]couchDBRevsDiff, error) {
+	response := make(map[string]couchDBRevsDiff)
+	if err := c.doJSON(ctx, http.MethodPost, "/_revs_diff", nil, revs, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// bulkDocs writes existing revisions to the remote (new_edits=false), returning the status of any documents the
+// remote reported on.
+func (c *couchDBClient) bulkDocs(ctx context.Context, docs []Body) ([]couchDBDocStatus, error) {
+	request := map[string]interface{}{
+		"docs":      docs,
+		"new_edits": false,
+	}
+	var response []couchDBDocStatus
+	if err := c.doJSON(ctx, http.MethodPost, "/_bulk_docs", nil, request, &response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// bulkGet retrieves the requested revisions, with revision history and attachments.  Both the multipart response
+// returned by Sync Gateway and the JSON response returned by CouchDB are supported.
+func (c *couchDBClient) bulkGet(ctx context.Context, items []couchDBBulkGetItem) ([]couchDBBulkGetResult, error) {
+	query := url.Values{}
+	query.Set("revs", "true")
+	query.Set("attachments", "true")
+	resp, err := c.do(ctx, http.MethodPost, "/_bulk_get", query, map[string]interface{}{"docs": items})
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse _bulk_get content type: %w", err)
+	}
+	if mediaType == "multipart/mixed" {
+		return readBulkGetMultipart(multipart.NewReader(resp.Body, params["boundary"]))
+	}
+	return readBulkGetJSON(resp.Body)
+}
+
+// getCheckpoint returns the remote checkpoint for the given client, or an empty checkpoint if none exists.
+func (c *couchDBClient) getCheckpoint(clientID string) (*replicationCheckpoint, error) {
+	var checkpoint *replicationCheckpoint
+	err := c.doJSON(context.Background(), http.MethodGet, "/_local/"+url.PathEscape(clientID), nil, nil, &checkpoint)
+	if err != nil {
+		if base.IsDocNotFoundError(err) {
+			return &replicationCheckpoint{}, nil
+		}
+		return &replicationCheckpoint{}, err
+	}
+	return checkpoint, nil
+}
+
+// setCheckpoint writes the remote checkpoint for the given client, returning the new checkpoint rev.
+func (c *couchDBClient) setCheckpoint(clientID string, checkpoint *replicationCheckpoint) (newRev string, err error) {
+	body := checkpoint.AsBody()
+	delete(body, checkpointBodyStatus)
+	if checkpoint.Rev == "" {
+		delete(body, checkpointBodyRev)
+	}
+	var response couchDBDocStatus
+	err = c.doJSON(context.Background(), http.MethodPut, "/_local/"+url.PathEscape(clientID), nil, body, &response)
+	if err != nil {
+		return "", err
+	}
+	return response.Rev, nil
+}
+
+// do sends a request to the given (escaped) path relative to the remote database, returning an HTTPError for non-2xx
+// responses.
+func (c *couchDBClient) do(ctx context.Context, method, path string, query url.Values, body interface{}) (*http.Response, error) {
+	target, err := url.Parse(c.dbURL.String() + path)
+	if err != nil {
+		return nil, err
+	}
+	if query != nil {
+		target.RawQuery = query.Encode()
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyBytes, err := base.JSONMarshal(body)
+		if err != nil {
+			return nil, err
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json, multipart/mixed")
+	if c.user != nil {
+		req.Header.Set("Authorization", "Basic "+base64UserInfo(c.user))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer func() { _ = resp.Body.Close() }()
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		var errResponse struct {
+			Error  string `json:"error"`
+			Reason string `json:"reason"`
+		}
+		message := string(respBody)
+		if base.JSONUnmarshal(respBody, &errResponse) == nil && errResponse.Reason != "" {
+			message = errResponse.Reason
+		}
+		return nil, base.HTTPErrorf(resp.StatusCode, "%s %s: %s", method, path, message)
+	}
+	return resp, nil
+}
+
+// doJSON sends a request and unmarshals the JSON response into result, when non-nil.
+func (c *couchDBClient) doJSON(ctx context.Context, method, path string, query url.Values, body interface{}, result interface{}) error {
+	resp, err := c.do(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if result == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	return base.JSONDecoder(resp.Body).Decode(result)
+}
+
+// newCouchDBBulkGetResult builds a result from a revision body, or an error body returned in its place.
+func newCouchDBBulkGetResult(body Body) couchDBBulkGetResult {
+	result := couchDBBulkGetResult{}
+	result.DocID, _ = body[BodyId].(string)
+	result.RevID, _ = body[BodyRev].(string)
+	if errName, ok := body["error"].(string); ok {
+		status, _ := base.ToInt64(body["status"])
+		if status == 0 {
+			docStatus := couchDBDocStatus{Error: errName}
+			status = int64(docStatus.statusCode())
+		}
+		reason, _ := body["reason"].(string)
+		result.Err = base.HTTPErrorf(int(status), "%s", reason)
+		return result
+	}
+	result.Body = body
+	return result
+}
+
+// readBulkGetMultipart reads a multipart/mixed _bulk_get response, as returned by Sync Gateway.  Each part is either a
+// JSON revision body (or error), or a multipart/related revision whose attachments follow the JSON body.
+func readBulkGetMultipart(reader *multipart.Reader) ([]couchDBBulkGetResult, error) {
+	results := make([]couchDBBulkGetResult, 0)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return results, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		mediaType, params, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse _bulk_get part content type: %w", err)
+		}
+
+		var body Body
+		if mediaType == "multipart/related" {
+			body, err = readRelatedRevision(multipart.NewReader(part, params["boundary"]))
+		} else {
+			body, err = readJSONBody(part)
+		}
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, newCouchDBBulkGetResult(body))
+	}
+}
+
+// readRelatedRevision reads a multipart/related revision, replacing attachments marked 'follows' with the data of the
+// corresponding part.
+func readRelatedRevision(reader *multipart.Reader) (Body, error) {
+	mainPart, err := reader.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	body, err := readJSONBody(mainPart)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments := GetBodyAttachments(body)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := part.FileName()
+		meta, ok := attachments[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unexpected attachment %q in _bulk_get response", name)
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		meta["data"] = data
+		delete(meta, "follows")
+	}
+	return body, nil
+}
+
+// readBulkGetJSON reads a JSON _bulk_get response, as returned by CouchDB.
+func readBulkGetJSON(reader io.Reader) ([]couchDBBulkGetResult, error) {
+	var response struct {
+		Results []struct {
+			ID   string `json:"id"`
+			Docs []struct {
+				OK    Body `json:"ok,omitempty"`
+				Error Body `json:"error,omitempty"`
+			} `json:"docs"`
+		} `json:"results"`
+	}
+	if err := base.JSONDecoder(reader).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	results := make([]couchDBBulkGetResult, 0, len(response.Results))
+	for _, result := range response.Results {
+		for _, doc := range result.Docs {
+			if doc.OK != nil {
+				results = append(results, newCouchDBBulkGetResult(doc.OK))
+				continue
+			}
+			errBody := Body{BodyId: result.ID, "error": doc.Error["error"], "reason": doc.Error["reason"]}
+			if rev, ok := doc.Error["rev"]; ok {
+				errBody[BodyRev] = rev
+			}
+			results = append(results, newCouchDBBulkGetResult(errBody))
+		}
+	}
+	return results, nil
+}
+
+func readJSONBody(reader io.Reader) (Body, error) {
+	bodyBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	var body Body
+	if err := body.Unmarshal(bodyBytes); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
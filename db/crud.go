@@ -1109,6 +1109,9 @@ func (db *Database) resolveConflict(localDoc *Document, remoteDoc *Document, doc
 		LocalDocument:  localDocBody,
 		RemoteDocument: remoteDocBody,
 	}
+	if resolver.includeAncestor {
+		conflict.AncestorDocument = db.getConflictAncestorBody(localDoc, docHistory)
+	}
 
 	resolvedBody, resolutionType, resolveFuncError := resolver.Resolve(conflict)
 	if resolveFuncError != nil {
@@ -1131,6 +1134,33 @@ func (db *Database) resolveConflict(localDoc *Document, remoteDoc *Document, doc
 	}
 }
 
+// getConflictAncestorBody returns the body of the common ancestor of the local revision and the incoming revision
+// history, or the body of the nearest ancestor of the common ancestor that's still available.  Returns nil when no
+// ancestor body is available.
+func (db *Database) getConflictAncestorBody(localDoc *Document, docHistory []string) Body {
+	commonAncestorRevID := localDoc.History.findAncestorFromSet(localDoc.CurrentRev, docHistory)
+	if commonAncestorRevID == "" {
+		return nil
+	}
+
+	bodyBytes, ancestorRevID, attachments, err := db.getAvailableRev(localDoc, commonAncestorRevID)
+	if err != nil {
+		base.Debugf(base.KeyReplicate, "No ancestor body available for common ancestor %s of doc %s: %v", commonAncestorRevID, base.UD(localDoc.ID), err)
+		return nil
+	}
+
+	var ancestorBody Body
+	if err := ancestorBody.Unmarshal(bodyBytes); err != nil {
+		base.Infof(base.KeyReplicate, "Unable to unmarshal ancestor body %s of doc %s: %v", ancestorRevID, base.UD(localDoc.ID), err)
+		return nil
+	}
+	ancestorBody[BodyRev] = ancestorRevID
+	if len(attachments) > 0 {
+		ancestorBody[BodyAttachments] = map[string]interface{}(attachments)
+	}
+	return ancestorBody
+}
+
 // resolveDocRemoteWins makes the following changes to the document:
 //   - Tombstones the local revision
 // The remote revision is added to the revision tree by the standard update processing.
@@ -1316,6 +1346,143 @@ func (db *Database) tombstoneActiveRevision(doc *Document, revID string) (tombst
 	return newRevID, nil
 }
 
+// tombstoneNonWinningRevision adds a tombstone revision as a child of the given non-winning leaf revision, and removes
+// the leaf's body from the revision tree.
+func (db *Database) tombstoneNonWinningRevision(doc *Document, revID string) (tombstoneRevID string, err error) {
+
+	if doc.CurrentRev == revID {
+		return "", fmt.Errorf("Attempted to tombstone non-winning revision for doc (%s), but provided rev (%s) is the current rev", base.UD(doc.ID), revID)
+	}
+
+	newGeneration := genOfRevID(revID) + 1
+	newRevID := CreateRevIDWithBytes(newGeneration, revID, []byte(DeletedDocument))
+	err = doc.History.addRevision(doc.ID,
+		RevInfo{
+			ID:      newRevID,
+			Parent:  revID,
+			Deleted: true,
+		})
+	if err != nil {
+		return "", err
+	}
+
+	// Backup the leaf's body, then remove it from the rev tree
+	if bodyBytes := doc.getRevisionBodyJSON(revID, db.RevisionBodyLoader); bodyBytes != nil {
+		_ = db.setOldRevisionJSON(doc.ID, revID, bodyBytes, db.Options.OldRevExpirySeconds)
+	}
+	doc.removeRevisionBody(revID)
+
+	return newRevID, nil
+}
+
+// ResolveConflict resolves a conflicted document by adding a new revision and tombstoning every other non-tombstoned
+// leaf revision.  When mergedBody is nil, the new revision is a copy of winnerRevID.  Otherwise the new revision has
+// the merged body, as a child of winnerRevID if specified or the current revision if not.
+func (db *Database) ResolveConflict(docid string, winnerRevID string, mergedBody Body) (newRevID string, err error) {
+
+	newDoc := &Document{
+		ID: docid,
+	}
+
+	allowImport := db.UseXattrs()
+	_, newRevID, err = db.updateAndReturnDoc(docid, allowImport, 0, nil, func(doc *Document) (resultDoc *Document, resultAttachmentData AttachmentData, createNewRevIDSkipped bool, updatedExpiry *uint32, resultErr error) {
+		// (Be careful: this block can be invoked multiple times if there are races!)
+		if doc.CurrentRev == "" {
+			return nil, nil, false, nil, base.HTTPErrorf(http.StatusNotFound, "missing")
+		}
+		if isSgWrite, _, _ := doc.IsSGWrite(nil); !isSgWrite && db.UseXattrs() {
+			if err := db.OnDemandImportForWrite(docid, doc, false); err != nil {
+				return nil, nil, false, nil, err
+			}
+		}
+		if !doc.hasFlag(channels.Conflict) {
+			return nil, nil, false, nil, base.HTTPErrorf(http.StatusConflict, "Document is not in conflict")
+		}
+
+		parentRevID := winnerRevID
+		if parentRevID == "" {
+			parentRevID = doc.CurrentRev
+		}
+		if !doc.History.isLeaf(parentRevID) || doc.History[parentRevID].Deleted {
+			return nil, nil, false, nil, base.HTTPErrorf(http.StatusBadRequest, "Revision %s is not a non-tombstoned leaf revision", parentRevID)
+		}
+
+		// Build the body of the resolved revision before any leaves are tombstoned
+		var body Body
+		if mergedBody != nil {
+			body = mergedBody.ShallowCopy()
+			newDoc.DocAttachments = GetBodyAttachments(body)
+		} else {
+			bodyBytes, _, attachments, err := db.getRevision(doc, parentRevID)
+			if err != nil {
+				return nil, nil, false, nil, err
+			}
+			if bodyBytes == nil {
+				return nil, nil, false, nil, base.HTTPErrorf(http.StatusNotFound, "Body of revision %s is not available", parentRevID)
+			}
+			if err := body.Unmarshal(bodyBytes); err != nil {
+				return nil, nil, false, nil, err
+			}
+			newDoc.DocAttachments = attachments.ShallowCopy()
+		}
+		delete(body, BodyAttachments)
+		delete(body, BodyId)
+		delete(body, BodyRev)
+		delete(body, BodyDeleted)
+		delete(body, BodyRevisions)
+
+		generation := genOfRevID(parentRevID) + 1
+		newAttachments, err := db.storeAttachments(doc, newDoc.DocAttachments, generation, parentRevID, nil)
+		if err != nil {
+			return nil, nil, false, nil, err
+		}
+
+		for _, leafRevID := range doc.History.GetLeaves() {
+			if leafRevID == parentRevID || doc.History[leafRevID].Deleted {
+				continue
+			}
+			var tombstoneRevID string
+			var tombstoneErr error
+			if leafRevID == doc.CurrentRev {
+				tombstoneRevID, tombstoneErr = db.tombstoneActiveRevision(doc, leafRevID)
+			} else {
+				tombstoneRevID, tombstoneErr = db.tombstoneNonWinningRevision(doc, leafRevID)
+			}
+			if tombstoneErr != nil {
+				return nil, nil, false, nil, tombstoneErr
+			}
+			base.DebugfCtx(db.Ctx, base.KeyCRUD, "Resolving conflict for doc %s - tombstoned leaf rev %s with %s", base.UD(docid), leafRevID, tombstoneRevID)
+		}
+
+		bodyWithoutSpecialProps, wasStripped := stripSpecialProperties(body)
+		canonicalBytesForRevID, err := base.JSONMarshalCanonical(bodyWithoutSpecialProps)
+		if err != nil {
+			return nil, nil, false, nil, err
+		}
+		newRev := CreateRevIDWithBytes(generation, parentRevID, canonicalBytesForRevID)
+
+		newDoc.UpdateBody(body)
+		if !wasStripped {
+			newDoc._rawBody = canonicalBytesForRevID
+		}
+
+		if err := doc.History.addRevision(docid, RevInfo{ID: newRev, Parent: parentRevID}); err != nil {
+			base.InfofCtx(db.Ctx, base.KeyCRUD, "Failed to add revision ID: %s, for doc: %s, error: %v", newRev, base.UD(docid), err)
+			return nil, nil, false, nil, base.ErrRevTreeAddRevFailure
+		}
+		newDoc.RevID = newRev
+
+		return newDoc, newAttachments, false, nil, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	db.DbStats.Database().ConflictsResolvedCount.Add(1)
+	base.InfofCtx(db.Ctx, base.KeyCRUD, "Resolved conflict for doc %s with new rev %s", base.UD(docid), newRevID)
+	return newRevID, nil
+}
+
 func (db *Database) validateExistingDoc(doc *Document, importAllowed, docExists bool) error {
 	if !importAllowed && docExists && !doc.HasValidSyncData() {
 		return base.HTTPErrorf(409, "Not imported")
@@ -1745,6 +1912,7 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 
 	// Update the document
 	inConflict := false
+	wasInConflict := false
 	upgradeInProgress := false
 	docBytes := 0   // Track size of document written, for write stats
 	xattrBytes := 0 // Track size of xattr written, for write stats
@@ -1763,6 +1931,7 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 				base.ErrorfCtx(db.Ctx, "Error retrieving previous leaf attachments of doc: %s, Error: %v", base.UD(docid), err)
 			}
 			prevCurrentRev = doc.CurrentRev
+			wasInConflict = doc.hasFlag(channels.Conflict)
 			docExists := currentValue != nil
 			syncFuncExpiry, newRevID, storedDoc, oldBodyJSON, unusedSequences, changedAccessPrincipals, changedRoleAccessUsers, createNewRevIDSkipped, err = db.documentUpdateFunc(docExists, doc, allowImport, docSequence, unusedSequences, callback, expiry)
 			if err != nil {
@@ -1797,6 +1966,7 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 				return
 			}
 			prevCurrentRev = doc.CurrentRev
+			wasInConflict = doc.hasFlag(channels.Conflict)
 
 			// Check whether Sync Data originated in body
 			if currentXattr == nil && doc.Sequence > 0 {
@@ -1891,6 +2061,11 @@ func (db *Database) updateAndReturnDoc(docid string, allowImport bool, expiry ui
 	if inConflict {
 		db.DbStats.Database().ConflictWriteCount.Add(1)
 	}
+	if inConflict || wasInConflict {
+		if err := db.conflictIndex.update(doc); err != nil {
+			base.WarnfCtx(db.Ctx, "Unable to update conflict index for doc %s: %v", base.UD(docid), err)
+		}
+	}
 
 	if doc.History[newRevID] != nil {
 		// Store the new revision in the cache
@@ -2103,7 +2278,7 @@ func (db *Database) MarkPrincipalsChanged(docid string, newRevID string, changed
 		if err != nil {
 			base.WarnfCtx(db.Ctx, "Error reloading active db.user[%s], security information will not be recalculated until next authentication --> %+v", base.UD(db.user.Name()), err)
 		} else {
-			db.user = user
+			db.user = auth.WithAPIKeyScopes(db.user, user)
 		}
 	}
 
@@ -2155,10 +2330,18 @@ func (db *Database) Purge(key string) error {
 	}
 
 	if db.UseXattrs() {
-		return db.Bucket.DeleteWithXattr(key, base.SyncXattrName)
+		err = db.Bucket.DeleteWithXattr(key, base.SyncXattrName)
 	} else {
-		return db.Bucket.Delete(key)
+		err = db.Bucket.Delete(key)
 	}
+	if err != nil {
+		return err
+	}
+
+	if err := db.EventMgr.RaiseDocumentPurgeEvent(db.Name, key); err != nil {
+		base.DebugfCtx(db.Ctx, base.KeyEvents, "Unable to raise document purge event for %s: %v", base.UD(key), err)
+	}
+	return nil
 }
 
 //////// CHANNELS:
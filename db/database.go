@@ -97,6 +97,12 @@ type DatabaseContext struct {
 	autoImport                  bool                    // Add sync data to new untracked couchbase server docs?  (Xattr mode specific)
 	revisionCache               RevisionCache           // Cache of recently-accessed doc revisions
 	changeCache                 *changeCache            // Cache of recently-access channels
+	conflictIndex               *conflictIndex          // Index of documents in conflict
+	pushNotifier                *pushNotifier           // Sends push notifications to idle clients, when configured
+	partialAttachments          *partialAttachmentCache // Interrupted chunked attachment transfers, for resumption
+	attachmentStore             AttachmentStore         // Storage for attachment data
+	attachmentMigrationSource   AttachmentStore         // Store attachments are being migrated from, if any
+	attachmentPolicy            *attachmentPolicy       // Limits and scanning applied to uploaded attachments, when configured
 	EventMgr                    *EventManager           // Manages notification events
 	AllowEmptyPassword          bool                    // Allow empty passwords?  Defaults to false
 	Options                     DatabaseContextOptions  // Database Context Options
@@ -105,8 +111,10 @@ type DatabaseContext struct {
 	ResyncManager               *BackgroundManager
 	TombstoneCompactionManager  *BackgroundManager
 	AttachmentCompactionManager *BackgroundManager
+	AttachmentMigrationManager  *BackgroundManager
 	ExitChanges                 chan struct{}            // Active _changes feeds on the DB will close when this channel is closed
 	OIDCProviders               auth.OIDCProviderMap     // OIDC clients
+	LocalJWTProviders           auth.LocalJWTProviderMap // Providers of bearer tokens verified with locally configured keys
 	PurgeInterval               time.Duration            // Metadata purge interval
 	serverUUID                  string                   // UUID of the server, if available
 	DbStats                     *base.DbStats            // stats that correspond to this database context
@@ -148,6 +156,17 @@ type DatabaseContextOptions struct {
 	ClientPartitionWindow     time.Duration
 	BcryptCost                int
 	GroupID                   string
+	ClientConflictResolution  *ClientConflictResolutionOptions // When set, conflicting revisions pushed by CBL clients are resolved instead of rejected
+	PushNotificationOptions   *PushNotificationOptions         // When set, changes are pushed to the registered devices of idle users
+	MFAOptions                *auth.MFAOptions                 // When set, users can enroll in TOTP multi-factor authentication
+	LockoutOptions            *auth.LockoutOptions             // When set, users and source IPs are locked out after repeated failed password logins
+	PasswordPolicyOptions     *auth.PasswordPolicyOptions      // When set, new passwords must meet the policy, and passwords may expire
+	SignupOptions             *SignupOptions                   // When set, users can sign up, verify their email address and reset their password via the public API
+	LocalJWTProviders         auth.LocalJWTProviderMap         // Providers of bearer tokens verified with locally configured keys
+	AttachmentStoreOptions    *AttachmentStoreOptions          // Attachment storage.  When nil, attachments are stored in the bucket
+	AttachmentPolicyOptions   *AttachmentPolicyOptions         // Limits and scanning applied to uploaded attachments
+	AttachmentRenditionSizes  []int                            // Widths and heights of image renditions that are stored once generated.  Defaults to DefaultAttachmentRenditionSizes
+	SequenceTimeInterval      time.Duration                    // How often the sequence time index used for since_time is sampled
 }
 
 type SGReplicateOptions struct {
@@ -155,6 +174,11 @@ type SGReplicateOptions struct {
 	WebsocketPingInterval time.Duration // BLIP Websocket Ping interval (for active replicators)
 }
 
+type ClientConflictResolutionOptions struct {
+	ResolverType ConflictResolverType // Conflict resolver type, used to identify resolvers that require the ancestor body
+	ResolverFunc ConflictResolverFunc // Conflict resolver invoked with the local (Sync Gateway) and remote (client) revisions
+}
+
 type OidcTestProviderOptions struct {
 	Enabled bool `json:"enabled,omitempty"` // Whether the oidc_test_provider endpoints should be exposed on the public API
 }
@@ -325,9 +349,19 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		dbContext.DbStats.Cache(),
 	)
 
+	dbContext.partialAttachments = newPartialAttachmentCache()
+	if options.AttachmentPolicyOptions != nil {
+		dbContext.attachmentPolicy = newAttachmentPolicy(options.AttachmentPolicyOptions)
+	}
+
 	dbContext.EventMgr = NewEventManager()
 
 	var err error
+	dbContext.attachmentStore, dbContext.attachmentMigrationSource, err = newDatabaseAttachmentStore(bucket, dbContext.Options.AttachmentStoreOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	dbContext.sequences, err = newSequenceAllocator(bucket, dbContext.DbStats.Database())
 	if err != nil {
 		return nil, err
@@ -337,6 +371,11 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		dbContext.sequences.Stop()
 	})
 
+	dbContext.conflictIndex = newConflictIndex(bucket, dbContext.DbStats.Database().ConflictedDocsCount)
+	if err := dbContext.conflictIndex.load(); err != nil {
+		base.Warnf("Unable to load conflict index for database %s: %v", base.MD(dbName), err)
+	}
+
 	// Get current value of _sync:seq
 	initialSequence, seqErr := dbContext.sequences.lastSequence()
 	if seqErr != nil {
@@ -347,9 +386,20 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	// In-memory channel cache
 	dbContext.changeCache = &changeCache{}
 
+	if options.PushNotificationOptions != nil {
+		dbContext.pushNotifier = newPushNotifier(dbContext, options.PushNotificationOptions)
+		dbContext.pushNotifier.start()
+		cleanupFunctions = append(cleanupFunctions, func() {
+			dbContext.pushNotifier.stop()
+		})
+	}
+
 	// Callback that is invoked whenever a set of channels is changed in the ChangeCache
 	notifyChange := func(changedChannels base.Set) {
 		dbContext.mutationListener.Notify(changedChannels)
+		if dbContext.pushNotifier != nil {
+			dbContext.pushNotifier.notifyChange(changedChannels)
+		}
 	}
 
 	// Initialize the active channel counter
@@ -489,6 +539,9 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 				return nil, base.RedactErrorf("OpenID Connect provider names cannot contain underscore:%s", base.UD(name))
 			}
 			provider.Name = name
+			if err := provider.ValidateClaimMappings(); err != nil {
+				return nil, err
+			}
 			if _, ok := dbContext.OIDCProviders[provider.Issuer]; ok {
 				return nil, base.RedactErrorf("Multiple OIDC providers defined for issuer %v", base.UD(provider.Issuer))
 			}
@@ -522,6 +575,22 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 
 	}
 
+	// Load the keys of local JWT providers.  Issuers must be unique, as they identify the provider for a token.
+	if len(options.LocalJWTProviders) > 0 {
+		dbContext.LocalJWTProviders = make(auth.LocalJWTProviderMap, len(options.LocalJWTProviders))
+		issuers := make(base.Set, len(options.LocalJWTProviders))
+		for name, provider := range options.LocalJWTProviders {
+			if issuers.Contains(provider.Issuer) {
+				return nil, base.RedactErrorf("Multiple local JWT providers defined for issuer %v", base.UD(provider.Issuer))
+			}
+			issuers.Add(provider.Issuer)
+			if err := provider.Init(name); err != nil {
+				return nil, err
+			}
+			dbContext.LocalJWTProviders[name] = provider
+		}
+	}
+
 	if dbContext.UseXattrs() {
 		// Set the purge interval for tombstone compaction
 		dbContext.PurgeInterval = DefaultPurgeInterval
@@ -569,6 +638,17 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 		}
 	}
 
+	if dbContext.Options.AttachmentRenditionSizes == nil {
+		dbContext.Options.AttachmentRenditionSizes = DefaultAttachmentRenditionSizes
+	}
+
+	if dbContext.Options.SequenceTimeInterval <= 0 {
+		dbContext.Options.SequenceTimeInterval = DefaultSequenceTimeInterval
+	}
+	if err := dbContext.startSequenceTimeIndex(); err != nil {
+		return nil, err
+	}
+
 	dbContext.ExitChanges = make(chan struct{})
 
 	// Start checking heartbeats for other nodes.  Must be done after caching feed starts, to ensure any removals
@@ -584,6 +664,7 @@ func NewDatabaseContext(dbName string, bucket base.Bucket, autoImport bool, opti
 	dbContext.ResyncManager = NewResyncManager()
 	dbContext.TombstoneCompactionManager = NewTombstoneCompactionManager()
 	dbContext.AttachmentCompactionManager = NewAttachmentCompactionManager(bucket)
+	dbContext.AttachmentMigrationManager = NewAttachmentMigrationManager()
 
 	return dbContext, nil
 }
@@ -658,6 +739,9 @@ func (context *DatabaseContext) Close() {
 	context.sequences.Stop()
 	context.mutationListener.Stop()
 	context.changeCache.Stop()
+	if context.pushNotifier != nil {
+		context.pushNotifier.stop()
+	}
 	context.ImportListener.Stop()
 	if context.Heartbeater != nil {
 		context.Heartbeater.Stop()
@@ -793,12 +877,24 @@ func (context *DatabaseContext) Authenticator() *auth.Authenticator {
 		channelsWarningThreshold = context.Options.UnsupportedOptions.WarningThresholds.ChannelsPerUser
 	}
 
+	var lockoutOptions *auth.LockoutOptions
+	if context.Options.LockoutOptions != nil {
+		options := *context.Options.LockoutOptions
+		if context.DbStats != nil {
+			options.LockoutCount = context.DbStats.Security().LockoutCount
+		}
+		lockoutOptions = &options
+	}
+
 	// Authenticators are lightweight & stateless, so it's OK to return a new one every time
 	authenticator := auth.NewAuthenticator(context.Bucket, context, auth.AuthenticatorOptions{
 		ClientPartitionWindow:    context.Options.ClientPartitionWindow,
 		ChannelsWarningThreshold: channelsWarningThreshold,
 		SessionCookieName:        sessionCookieName,
 		BcryptCost:               context.Options.BcryptCost,
+		MFA:                      context.Options.MFAOptions,
+		Lockout:                  lockoutOptions,
+		PasswordPolicy:           context.Options.PasswordPolicyOptions,
 	})
 
 	return authenticator
@@ -842,7 +938,7 @@ func (db *Database) ReloadUser() error {
 	if user == nil {
 		return errors.New("User not found during reload")
 	} else {
-		db.user = user
+		db.user = auth.WithAPIKeyScopes(db.user, user)
 		return nil
 	}
 }
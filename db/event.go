@@ -24,13 +24,20 @@ import (
 type EventType uint8
 
 const (
-	DocumentChange EventType = iota // fires whenever a document is updated (even if the change did not cause the winning rev to change)
-	DBStateChange                   // fires when the database is created or is taken offline/online
+	DocumentChange         EventType = iota // fires whenever a document is updated (even if the change did not cause the winning rev to change)
+	DBStateChange                           // fires when the database is created or is taken offline/online
+	PrincipalChange                         // fires when a user or role is created, updated or deleted
+	ReplicationStateChange                  // fires when an sg-replicate replication changes state
+	AuthFailure                             // fires when a request fails authentication
+	SessionCreate                           // fires when a session is created for a user
+	DocumentPurge                           // fires when a document is purged
+	DocumentExpiry                          // fires when an expired document is removed by the server
 
 	eventTypeCount
 )
 
-var eventTypeNames = []string{"DocumentChange", "DBStateChange"}
+var eventTypeNames = []string{"DocumentChange", "DBStateChange", "PrincipalChange", "ReplicationStateChange",
+	"AuthFailure", "SessionCreate", "DocumentPurge", "DocumentExpiry"}
 
 // String returns the string representation of an event type (e.g. "DBStateChange")
 func (et EventType) String() string {
@@ -58,6 +65,12 @@ func (ae AsyncEvent) Synchronous() bool {
 	return false
 }
 
+// BodyEvent is an event described by a JSON object, which is posted by webhooks and passed to filter functions.
+type BodyEvent interface {
+	Event
+	Body() Body
+}
+
 // DocumentChangeEvent is raised when a document has been successfully written to the backing
 // data store.  Event has the document body and channel set as properties.
 type DocumentChangeEvent struct {
@@ -93,6 +106,168 @@ func (dsce *DBStateChangeEvent) EventType() EventType {
 	return DBStateChange
 }
 
+func (dsce *DBStateChangeEvent) Body() Body {
+	return dsce.Doc
+}
+
+// PrincipalChangeEvent is raised when a user or role is created, updated or deleted.
+//
+//	{
+//		"dbname": "db",
+//		"name": "alice",
+//		"type": "user",
+//		"action": "updated",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type PrincipalChangeEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (pce *PrincipalChangeEvent) String() string {
+	return fmt.Sprintf("Principal change event for %s %s", pce.Doc["type"], pce.Doc["name"])
+}
+
+func (pce *PrincipalChangeEvent) EventType() EventType {
+	return PrincipalChange
+}
+
+func (pce *PrincipalChangeEvent) Body() Body {
+	return pce.Doc
+}
+
+// ReplicationStateChangeEvent is raised when an sg-replicate replication running on this node changes state.  The
+// error property is only present when the replication has an error.
+//
+//	{
+//		"dbname": "db",
+//		"replication_id": "replication1",
+//		"direction": "push",
+//		"old_state": "running",
+//		"state": "error",
+//		"error": "...",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type ReplicationStateChangeEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (rsce *ReplicationStateChangeEvent) String() string {
+	return fmt.Sprintf("Replication state change event for replication %s", rsce.Doc["replication_id"])
+}
+
+func (rsce *ReplicationStateChangeEvent) EventType() EventType {
+	return ReplicationStateChange
+}
+
+func (rsce *ReplicationStateChangeEvent) Body() Body {
+	return rsce.Doc
+}
+
+// AuthFailureEvent is raised when a request fails authentication.  The username is empty when the request didn't
+// provide one, e.g. for invalid session cookies or tokens.
+//
+//	{
+//		"dbname": "db",
+//		"username": "alice",
+//		"remote_addr": "10.0.0.1:51234",
+//		"path": "/db/_changes",
+//		"reason": "Invalid login",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type AuthFailureEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (afe *AuthFailureEvent) String() string {
+	return fmt.Sprintf("Auth failure event for username: %s", afe.Doc["username"])
+}
+
+func (afe *AuthFailureEvent) EventType() EventType {
+	return AuthFailure
+}
+
+func (afe *AuthFailureEvent) Body() Body {
+	return afe.Doc
+}
+
+// SessionCreateEvent is raised when a session is created for a user.  The session ID isn't included.
+//
+//	{
+//		"dbname": "db",
+//		"username": "alice",
+//		"expires": "2022-03-08T11:20:29.138+01:00",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type SessionCreateEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (sce *SessionCreateEvent) String() string {
+	return fmt.Sprintf("Session create event for username: %s", sce.Doc["username"])
+}
+
+func (sce *SessionCreateEvent) EventType() EventType {
+	return SessionCreate
+}
+
+func (sce *SessionCreateEvent) Body() Body {
+	return sce.Doc
+}
+
+// DocumentPurgeEvent is raised when a document is purged.
+//
+//	{
+//		"dbname": "db",
+//		"doc_id": "doc1",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type DocumentPurgeEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (dpe *DocumentPurgeEvent) String() string {
+	return fmt.Sprintf("Document purge event for doc id: %s", dpe.Doc["doc_id"])
+}
+
+func (dpe *DocumentPurgeEvent) EventType() EventType {
+	return DocumentPurge
+}
+
+func (dpe *DocumentPurgeEvent) Body() Body {
+	return dpe.Doc
+}
+
+// DocumentExpiryEvent is raised when the server removes a document whose expiry has passed.  It's raised by the
+// node that imports the removal, so requires import to be enabled.
+//
+//	{
+//		"dbname": "db",
+//		"doc_id": "doc1",
+//		"expiry": "2022-03-07T11:20:00Z",
+//		"localtime": "2022-03-07T11:20:29.138+01:00"
+//	}
+type DocumentExpiryEvent struct {
+	AsyncEvent
+	Doc Body
+}
+
+func (dee *DocumentExpiryEvent) String() string {
+	return fmt.Sprintf("Document expiry event for doc id: %s", dee.Doc["doc_id"])
+}
+
+func (dee *DocumentExpiryEvent) EventType() EventType {
+	return DocumentExpiry
+}
+
+func (dee *DocumentExpiryEvent) Body() Body {
+	return dee.Doc
+}
+
 // Javascript function handling for events
 const kTaskCacheSize = 4
 
@@ -171,8 +346,8 @@ func (ef *JSEventFunction) CallFunction(event Event) (interface{}, error) {
 
 	case *DocumentChangeEvent:
 		result, err = ef.Call(sgbucket.JSONString(event.DocBytes), sgbucket.JSONString(event.OldDoc))
-	case *DBStateChangeEvent:
-		result, err = ef.Call(event.Doc)
+	case BodyEvent:
+		result, err = ef.Call(event.Body())
 	default:
 		base.Warnf("unknown event %v tried to call function", event.EventType())
 		return "", fmt.Errorf("unknown event %v tried to call function", event.EventType())
@@ -0,0 +1,379 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/google/uuid"
+)
+
+const (
+	// Broker types
+	BrokerTypeNATS      = "nats"       // NATS core protocol
+	BrokerTypeKafkaREST = "kafka_rest" // Kafka, via the Confluent REST Proxy v2 API
+
+	DefaultBrokerBatchSize    = 100
+	DefaultBrokerPollInterval = time.Second
+	DefaultBrokerMaxRetries   = 5
+	DefaultBrokerRetryBackoff = 500 * time.Millisecond
+	maxBrokerRetryBackoff     = 30 * time.Second
+	defaultBrokerKeyTemplate  = "{{.DocID}}"
+	brokerPublishTimeout      = 60 * time.Second
+
+	// The lease is renewed before each publish attempt, so must outlast a single attempt for no other node to publish
+	// concurrently.
+	defaultBrokerLeaseTTL = brokerPublishTimeout + 30*time.Second
+)
+
+var errBrokerLeaseLost = errors.New("lease lost while publishing")
+
+// BrokerConfig configures an event handler that publishes document changes to a message broker.
+type BrokerConfig struct {
+	Type            string `json:"type"`                       // nats or kafka_rest
+	Topic           string `json:"topic"`                      // Topic (Kafka) or subject (NATS) to publish to
+	KeyTemplate     string `json:"key_template,omitempty"`     // Template for the message key, defaults to the document ID
+	PayloadTemplate string `json:"payload_template,omitempty"` // Template for the message payload, defaults to the document body
+	BatchSize       int    `json:"batch_size,omitempty"`       // Maximum number of messages published at once
+	PollIntervalMs  int    `json:"poll_interval_ms,omitempty"` // How often to check for changes made on other nodes
+	MaxRetries      *int   `json:"max_retries,omitempty"`      // Attempts to publish a batch before waiting for the next poll
+	RetryBackoffMs  int    `json:"retry_backoff_ms,omitempty"` // Initial delay between retries, doubled on each retry
+}
+
+// BrokerMessage is a message published to a broker.
+type BrokerMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// BrokerPublisher publishes messages to a topic on a message broker.  Publish must only return once the broker has
+// accepted every message, as the handler's checkpoint is advanced past them.
+type BrokerPublisher interface {
+	Publish(ctx context.Context, topic string, messages []BrokerMessage) error
+	Close() error
+}
+
+// BrokerTemplateData is the data available to broker key and payload templates.
+type BrokerTemplateData struct {
+	DocID   string
+	RevID   string
+	Seq     uint64
+	Deleted bool
+	Doc     json.RawMessage
+}
+
+// brokerCheckpoint is the persisted position of a broker handler.  Only the node holding the lease publishes, so
+// changes are published in sequence order and each node doesn't publish every change.
+type brokerCheckpoint struct {
+	Seq         SequenceID `json:"seq"`
+	Owner       string     `json:"owner,omitempty"`
+	LeaseExpiry int64      `json:"lease_expiry,omitempty"` // Unix time in seconds
+}
+
+// BrokerEventHandler is an implementation of EventHandler that publishes document changes to a message broker.
+// Rather than publishing the changes it's notified of, it publishes the changes feed from a checkpoint persisted in
+// the bucket, so changes are published in order, in batches, and changes made while no node was publishing (e.g.
+// during a restart) aren't dropped.  Delivery is at least once.
+type BrokerEventHandler struct {
+	AsyncEventHandler
+	dbContext       *DatabaseContext
+	config          BrokerConfig
+	publisher       BrokerPublisher
+	filter          *JSEventFunction
+	keyTemplate     *template.Template
+	payloadTemplate *template.Template
+	checkpointKey   string
+	owner           string
+	pollInterval    time.Duration
+	retryBackoff    time.Duration
+	maxRetries      int
+	wake            chan struct{}
+}
+
+// NewBrokerEventHandler creates a broker event handler and starts publishing changes, until the database is closed.
+func (context *DatabaseContext) NewBrokerEventHandler(config BrokerConfig, publisher BrokerPublisher, filterFnString string) (*BrokerEventHandler, error) {
+	if config.Topic == "" {
+		return nil, errors.New("topic must be defined for broker events")
+	}
+	if config.BatchSize < 0 || config.PollIntervalMs < 0 || config.RetryBackoffMs < 0 || (config.MaxRetries != nil && *config.MaxRetries < 0) {
+		return nil, errors.New("broker batch_size, poll_interval_ms, max_retries and retry_backoff_ms must not be negative")
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = DefaultBrokerBatchSize
+	}
+
+	h := &BrokerEventHandler{
+		dbContext:     context,
+		config:        config,
+		publisher:     publisher,
+		checkpointKey: base.BrokerCheckpointPrefix + config.Type + ":" + config.Topic,
+		owner:         uuid.New().String(),
+		pollInterval:  DefaultBrokerPollInterval,
+		retryBackoff:  DefaultBrokerRetryBackoff,
+		maxRetries:    DefaultBrokerMaxRetries,
+		wake:          make(chan struct{}, 1),
+	}
+	if config.PollIntervalMs > 0 {
+		h.pollInterval = time.Duration(config.PollIntervalMs) * time.Millisecond
+	}
+	if config.RetryBackoffMs > 0 {
+		h.retryBackoff = time.Duration(config.RetryBackoffMs) * time.Millisecond
+	}
+	if config.MaxRetries != nil {
+		h.maxRetries = *config.MaxRetries
+	}
+	if filterFnString != "" {
+		h.filter = NewJSEventFunction(filterFnString)
+	}
+
+	keyTemplate := config.KeyTemplate
+	if keyTemplate == "" {
+		keyTemplate = defaultBrokerKeyTemplate
+	}
+	var err error
+	if h.keyTemplate, err = template.New("key").Parse(keyTemplate); err != nil {
+		return nil, fmt.Errorf("invalid broker key_template: %w", err)
+	}
+	if config.PayloadTemplate != "" {
+		if h.payloadTemplate, err = template.New("payload").Parse(config.PayloadTemplate); err != nil {
+			return nil, fmt.Errorf("invalid broker payload_template: %w", err)
+		}
+	}
+
+	// Start new handlers from the current sequence, rather than publishing the existing contents of the database
+	lastSeq, err := context.LastSequence()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := context.Bucket.Add(h.checkpointKey, 0, brokerCheckpoint{Seq: SequenceID{Seq: lastSeq}}); err != nil {
+		return nil, err
+	}
+
+	bgt := BackgroundTask{taskName: "BrokerPublisher:" + config.Topic, doneChan: make(chan struct{})}
+	go h.run(bgt.doneChan, context.terminator)
+	context.backgroundTasks = append(context.backgroundTasks, bgt)
+	return h, nil
+}
+
+// HandleEvent wakes the publisher to publish the change.
+func (h *BrokerEventHandler) HandleEvent(event Event) bool {
+	if _, ok := event.(*DocumentChangeEvent); !ok {
+		base.Warnf("Broker handler invoked for unsupported event type.")
+		return false
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (h *BrokerEventHandler) String() string {
+	return fmt.Sprintf("Broker handler [%s:%s]", h.config.Type, h.config.Topic)
+}
+
+func (h *BrokerEventHandler) run(doneChan chan struct{}, terminator chan bool) {
+	defer close(doneChan)
+	defer base.FatalPanicHandler()
+	defer func() {
+		if err := h.publisher.Close(); err != nil {
+			base.Debugf(base.KeyEvents, "Error closing broker publisher: %v", err)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), base.LogContextKey{},
+		base.LogContext{CorrelationID: base.NewTaskID(h.dbContext.Name, "BrokerPublisher")}))
+	defer cancel()
+	go func() {
+		<-terminator
+		cancel()
+	}()
+
+	ticker := time.NewTicker(h.pollInterval)
+	defer ticker.Stop()
+	for {
+		// Keep publishing while there are full batches, then wait for more changes
+		for {
+			published, err := h.publishNextBatch(ctx)
+			if err != nil && ctx.Err() == nil {
+				base.WarnfCtx(ctx, "%s unable to publish changes, will retry: %v", h, err)
+			}
+			if err != nil || published < h.config.BatchSize {
+				break
+			}
+		}
+		select {
+		case <-h.wake:
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateCheckpoint applies the callback to the checkpoint, returning false if another node holds the lease.
+func (h *BrokerEventHandler) updateCheckpoint(callback func(checkpoint *brokerCheckpoint)) (checkpoint *brokerCheckpoint, leased bool, err error) {
+	_, err = h.dbContext.Bucket.Update(h.checkpointKey, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		checkpoint = &brokerCheckpoint{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, checkpoint); err != nil {
+				return nil, nil, false, err
+			}
+		}
+		now := time.Now()
+		if checkpoint.Owner != h.owner && checkpoint.LeaseExpiry > now.Unix() {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		checkpoint.Owner = h.owner
+		checkpoint.LeaseExpiry = now.Add(defaultBrokerLeaseTTL).Unix()
+		callback(checkpoint)
+		checkpointBytes, err := base.JSONMarshal(checkpoint)
+		return checkpointBytes, nil, false, err
+	})
+	if err == base.ErrUpdateCancel {
+		return checkpoint, false, nil
+	}
+	return checkpoint, err == nil, err
+}
+
+// publishNextBatch publishes the next batch of changes after the checkpoint, if this node holds the lease, and
+// returns the number of changes read.
+func (h *BrokerEventHandler) publishNextBatch(ctx context.Context) (int, error) {
+	checkpoint, leased, err := h.updateCheckpoint(func(*brokerCheckpoint) {})
+	if err != nil || !leased {
+		return 0, err
+	}
+
+	database, err := CreateDatabase(h.dbContext)
+	if err != nil {
+		return 0, err
+	}
+	database.Ctx = ctx
+	changes, err := database.GetChanges(base.SetOf(channels.UserStarChannel), ChangesOptions{
+		Since:       checkpoint.Seq,
+		Limit:       h.config.BatchSize,
+		IncludeDocs: true,
+		Ctx:         ctx,
+	})
+	if err != nil || len(changes) == 0 {
+		return 0, err
+	}
+
+	messages := make([]BrokerMessage, 0, len(changes))
+	for _, change := range changes {
+		message, ok, err := h.buildMessage(change)
+		if err != nil {
+			// Skip changes that can't be published rather than blocking all following changes
+			base.WarnfCtx(ctx, "%s unable to build message for %s, skipping: %v", h, base.UD(change.ID), err)
+			continue
+		}
+		if ok {
+			messages = append(messages, message)
+		}
+	}
+
+	if len(messages) > 0 {
+		if err := h.publishWithRetry(ctx, checkpoint.Seq, messages); err != nil {
+			return 0, err
+		}
+	}
+
+	lastSeq := changes[len(changes)-1].Seq
+	if _, leased, err := h.updateCheckpoint(func(checkpoint *brokerCheckpoint) { checkpoint.Seq = lastSeq }); err != nil {
+		return 0, err
+	} else if !leased {
+		return 0, errBrokerLeaseLost
+	}
+	base.DebugfCtx(ctx, base.KeyEvents, "%s published %d messages, checkpoint %s", h, len(messages), lastSeq)
+	return len(changes), nil
+}
+
+// buildMessage returns the message for the change, or false if the filter function rejects it.
+func (h *BrokerEventHandler) buildMessage(change *ChangeEntry) (message BrokerMessage, ok bool, err error) {
+	data := BrokerTemplateData{
+		DocID:   change.ID,
+		Seq:     change.Seq.Seq,
+		Deleted: change.Deleted,
+		Doc:     change.Doc,
+	}
+	if len(change.Changes) > 0 {
+		data.RevID = change.Changes[0]["rev"]
+	}
+	if len(data.Doc) == 0 {
+		data.Doc = json.RawMessage(`{"_id":` + base.ConvertToJSONString(change.ID) + `,"_rev":"` + data.RevID + `","_deleted":true}`)
+	}
+
+	if h.filter != nil {
+		matches, err := h.filter.CallValidateFunction(&DocumentChangeEvent{DocBytes: data.Doc, DocID: change.ID, WinningRevChange: true})
+		if err != nil {
+			base.Warnf("Error calling broker filter function: %v", err)
+		}
+		if !matches {
+			return message, false, nil
+		}
+	}
+
+	var key bytes.Buffer
+	if err := h.keyTemplate.Execute(&key, data); err != nil {
+		return message, false, err
+	}
+	message.Key = key.Bytes()
+	if h.payloadTemplate == nil {
+		message.Value = data.Doc
+	} else {
+		var payload bytes.Buffer
+		if err := h.payloadTemplate.Execute(&payload, data); err != nil {
+			return message, false, err
+		}
+		message.Value = payload.Bytes()
+	}
+	return message, true, nil
+}
+
+// publishWithRetry publishes the messages read after since, retrying with exponential backoff.  The lease is renewed
+// before each attempt, and publishing stops if the lease has been lost or the checkpoint has moved past since, as
+// another node may have published the messages.
+func (h *BrokerEventHandler) publishWithRetry(ctx context.Context, since SequenceID, messages []BrokerMessage) error {
+	backoff := h.retryBackoff
+	for attempt := 0; ; attempt++ {
+		checkpoint, leased, err := h.updateCheckpoint(func(*brokerCheckpoint) {})
+		if err != nil {
+			return err
+		}
+		if !leased || checkpoint.Seq != since {
+			return errBrokerLeaseLost
+		}
+
+		publishCtx, cancel := context.WithTimeout(ctx, brokerPublishTimeout)
+		err = h.publisher.Publish(publishCtx, h.config.Topic, messages)
+		cancel()
+		if err == nil || attempt >= h.maxRetries {
+			return err
+		}
+		base.DebugfCtx(ctx, base.KeyEvents, "%s publish attempt %d failed, retrying in %v: %v", h, attempt+1, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if backoff *= 2; backoff > maxBrokerRetryBackoff {
+			backoff = maxBrokerRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,286 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// NewBrokerPublisher returns a publisher for the given broker type and URL.  A zero timeout uses the default.
+func NewBrokerPublisher(brokerType, brokerURL string, timeout time.Duration) (BrokerPublisher, error) {
+	if brokerURL == "" {
+		return nil, fmt.Errorf("url must be defined for broker events")
+	}
+	if timeout <= 0 {
+		timeout = brokerPublishTimeout
+	}
+	switch brokerType {
+	case BrokerTypeNATS:
+		return newNATSPublisher(brokerURL, timeout)
+	case BrokerTypeKafkaREST:
+		return newKafkaRESTPublisher(brokerURL, timeout)
+	default:
+		return nil, fmt.Errorf("unknown broker type %q - supported types are %s and %s", brokerType, BrokerTypeNATS, BrokerTypeKafkaREST)
+	}
+}
+
+// natsPublisher publishes messages using the NATS core protocol.  The message key is sent as the Sg-Key header when
+// the server supports headers.  Each batch is followed by a PING, so Publish returns once the server has processed
+// the batch.
+type natsPublisher struct {
+	url     *url.URL
+	timeout time.Duration
+	lock    sync.Mutex
+	conn    net.Conn
+	reader  *bufio.Reader
+	headers bool // Whether the connected server supports message headers
+}
+
+const natsKeyHeader = "Sg-Key"
+
+func newNATSPublisher(brokerURL string, timeout time.Duration) (*natsPublisher, error) {
+	u, err := url.Parse(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("NATS broker url must be of the form nats://host:port")
+	}
+	return &natsPublisher{url: u, timeout: timeout}, nil
+}
+
+// connect opens the connection and completes the handshake, if not already connected.
+func (p *natsPublisher) connect(ctx context.Context) error {
+	if p.conn != nil {
+		return nil
+	}
+	host := p.url.Host
+	if p.url.Port() == "" {
+		host = net.JoinHostPort(host, "4222")
+	}
+	dialer := net.Dialer{Timeout: p.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(conn)
+	p.setDeadline(ctx, conn)
+
+	// The server starts by sending INFO
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		_ = conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		Headers bool `json:"headers"`
+	}
+	if err := base.JSONUnmarshal([]byte(strings.TrimSpace(line[5:])), &info); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("invalid NATS INFO: %w", err)
+	}
+
+	connectOptions := map[string]interface{}{"verbose": false, "pedantic": false, "name": "sync_gateway", "headers": info.Headers}
+	if p.url.User != nil {
+		connectOptions["user"] = p.url.User.Username()
+		connectOptions["pass"], _ = p.url.User.Password()
+	}
+	connectJSON, err := base.JSONMarshal(connectOptions)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connectJSON); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn, p.reader, p.headers = conn, reader, info.Headers
+	return nil
+}
+
+func (p *natsPublisher) setDeadline(ctx context.Context, conn net.Conn) {
+	deadline := time.Now().Add(p.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, topic string, messages []BrokerMessage) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if err := p.connect(ctx); err != nil {
+		return err
+	}
+	if err := p.publish(ctx, topic, messages); err != nil {
+		// Reconnect on the next attempt, as the connection state is unknown
+		_ = p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (p *natsPublisher) publish(ctx context.Context, topic string, messages []BrokerMessage) error {
+	p.setDeadline(ctx, p.conn)
+
+	var buf bytes.Buffer
+	for _, message := range messages {
+		if p.headers && len(message.Key) > 0 {
+			// Header values can't span lines
+			key := strings.NewReplacer("\r", "", "\n", "").Replace(string(message.Key))
+			header := "NATS/1.0\r\n" + natsKeyHeader + ": " + key + "\r\n\r\n"
+			fmt.Fprintf(&buf, "HPUB %s %d %d\r\n%s", topic, len(header), len(header)+len(message.Value), header)
+		} else {
+			fmt.Fprintf(&buf, "PUB %s %d\r\n", topic, len(message.Value))
+		}
+		buf.Write(message.Value)
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("PING\r\n")
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	// Errors for the batch are returned before the PONG
+	for {
+		line, err := p.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", strings.TrimSpace(line[4:]))
+		}
+	}
+}
+
+func (p *natsPublisher) Close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn = nil
+	return err
+}
+
+// kafkaRESTPublisher publishes messages to Kafka via the Confluent REST Proxy v2 API.  Keys and values are sent in
+// binary format, so payloads don't need to be JSON.
+type kafkaRESTPublisher struct {
+	url    string
+	client *http.Client
+}
+
+const (
+	kafkaRESTContentType = "application/vnd.kafka.binary.v2+json"
+	kafkaRESTAccept      = "application/vnd.kafka.v2+json"
+)
+
+func newKafkaRESTPublisher(brokerURL string, timeout time.Duration) (*kafkaRESTPublisher, error) {
+	if _, err := url.Parse(brokerURL); err != nil {
+		return nil, err
+	}
+	transport := base.DefaultHTTPTransport()
+	transport.DisableKeepAlives = false
+	return &kafkaRESTPublisher{
+		url:    strings.TrimSuffix(brokerURL, "/"),
+		client: &http.Client{Transport: transport, Timeout: timeout},
+	}, nil
+}
+
+type kafkaRESTRecord struct {
+	Key   *string `json:"key,omitempty"`
+	Value string  `json:"value"`
+}
+
+func (p *kafkaRESTPublisher) Publish(ctx context.Context, topic string, messages []BrokerMessage) error {
+	records := make([]kafkaRESTRecord, 0, len(messages))
+	for _, message := range messages {
+		record := kafkaRESTRecord{Value: base64.StdEncoding.EncodeToString(message.Value)}
+		if len(message.Key) > 0 {
+			key := base64.StdEncoding.EncodeToString(message.Key)
+			record.Key = &key
+		}
+		records = append(records, record)
+	}
+	body, err := base.JSONMarshal(map[string]interface{}{"records": records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", kafkaRESTContentType)
+	req.Header.Set("Accept", kafkaRESTAccept)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %w", base.RedactBasicAuthURLUserAndPassword(p.url), err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kafka REST proxy returned %s: %s", resp.Status, respBody)
+	}
+
+	// Records can fail individually
+	var result struct {
+		Offsets []struct {
+			Error *string `json:"error"`
+		} `json:"offsets"`
+	}
+	if err := base.JSONUnmarshal(respBody, &result); err != nil {
+		return fmt.Errorf("invalid Kafka REST proxy response: %w", err)
+	}
+	for _, offset := range result.Offsets {
+		if offset.Error != nil {
+			return fmt.Errorf("Kafka REST proxy failed to produce record: %s", *offset.Error)
+		}
+	}
+	return nil
+}
+
+func (p *kafkaRESTPublisher) Close() error {
+	p.client.CloseIdleConnections()
+	return nil
+}
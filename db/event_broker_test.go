@@ -0,0 +1,323 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testBroker is an in-process BrokerPublisher that records published messages, failing the first failures attempts.
+// onFailure is called on each failed attempt.
+type testBroker struct {
+	lock      sync.Mutex
+	messages  []BrokerMessage
+	topics    []string
+	failures  int
+	attempts  int
+	onFailure func()
+}
+
+func (b *testBroker) Publish(ctx context.Context, topic string, messages []BrokerMessage) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.attempts++
+	if b.failures > 0 {
+		b.failures--
+		if b.onFailure != nil {
+			b.onFailure()
+		}
+		return errors.New("broker unavailable")
+	}
+	b.messages = append(b.messages, messages...)
+	b.topics = append(b.topics, topic)
+	return nil
+}
+
+func (b *testBroker) Close() error {
+	return nil
+}
+
+func (b *testBroker) keys() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	keys := make([]string, 0, len(b.messages))
+	for _, message := range b.messages {
+		keys = append(keys, string(message.Key))
+	}
+	return keys
+}
+
+func (b *testBroker) waitForMessages(t *testing.T, count int) {
+	require.Eventually(t, func() bool { return len(b.keys()) >= count }, 10*time.Second, 10*time.Millisecond,
+		"Expected %d messages, got %v", count, b.keys())
+}
+
+func putBrokerTestDocs(t *testing.T, db *Database, first, last int) {
+	for i := first; i <= last; i++ {
+		_, _, err := db.Put(fmt.Sprintf("doc%d", i), Body{"n": i})
+		require.NoError(t, err)
+	}
+	require.NoError(t, db.changeCache.waitForSequence(context.TODO(), uint64(last), base.DefaultWaitForSequence))
+}
+
+func TestBrokerEventHandler(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	// Changes made before the handler is created aren't published
+	putBrokerTestDocs(t, db, 1, 2)
+
+	broker := &testBroker{failures: 2}
+	handler, err := db.NewBrokerEventHandler(BrokerConfig{
+		Type:            BrokerTypeNATS,
+		Topic:           "changes",
+		KeyTemplate:     "key-{{.DocID}}",
+		PayloadTemplate: `{"id":"{{.DocID}}","rev":"{{.RevID}}","seq":{{.Seq}},"doc":{{printf "%s" .Doc}}}`,
+		BatchSize:       2,
+		PollIntervalMs:  10,
+		RetryBackoffMs:  1,
+	}, broker, `function(doc) { return doc.n != 4; }`)
+	require.NoError(t, err)
+
+	putBrokerTestDocs(t, db, 3, 6)
+	assert.True(t, handler.HandleEvent(&DocumentChangeEvent{}))
+	broker.waitForMessages(t, 3)
+
+	// Published in order, with the filtered change skipped, after retrying the failed attempts
+	assert.Equal(t, []string{"key-doc3", "key-doc5", "key-doc6"}, broker.keys())
+	assert.Equal(t, "changes", broker.topics[0])
+	var payload map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(broker.messages[0].Value, &payload))
+	assert.Equal(t, "doc3", payload["id"])
+	assert.Equal(t, float64(3), payload["seq"])
+	assert.Equal(t, float64(3), payload["doc"].(map[string]interface{})["n"])
+	assert.GreaterOrEqual(t, broker.attempts, 4)
+
+	require.Eventually(t, func() bool {
+		var checkpoint brokerCheckpoint
+		_, err := db.Bucket.Get(handler.checkpointKey, &checkpoint)
+		return err == nil && checkpoint.Seq.Seq == 6
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
+func TestBrokerEventHandlerResume(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	putBrokerTestDocs(t, db, 1, 4)
+
+	// Checkpoint left by a node that stopped after publishing sequence 2
+	config := BrokerConfig{Type: BrokerTypeKafkaREST, Topic: "changes", PollIntervalMs: 10}
+	checkpointKey := base.BrokerCheckpointPrefix + config.Type + ":" + config.Topic
+	_, err := db.Bucket.Add(checkpointKey, 0, brokerCheckpoint{Seq: SequenceID{Seq: 2}, Owner: "stopped", LeaseExpiry: time.Now().Add(-time.Second).Unix()})
+	require.NoError(t, err)
+
+	broker := &testBroker{}
+	_, err = db.NewBrokerEventHandler(config, broker, "")
+	require.NoError(t, err)
+	broker.waitForMessages(t, 2)
+	assert.Equal(t, []string{"doc3", "doc4"}, broker.keys())
+
+	// The default payload is the document body
+	var body Body
+	require.NoError(t, base.JSONUnmarshal(broker.messages[0].Value, &body))
+	assert.Equal(t, "doc3", body[BodyId])
+	assert.Equal(t, float64(3), body["n"])
+}
+
+func TestBrokerEventHandlerLease(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	config := BrokerConfig{Type: BrokerTypeNATS, Topic: "changes", PollIntervalMs: 10}
+	checkpointKey := base.BrokerCheckpointPrefix + config.Type + ":" + config.Topic
+	_, err := db.Bucket.Add(checkpointKey, 0, brokerCheckpoint{Owner: "other", LeaseExpiry: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+
+	// Another node holds the lease, so nothing is published
+	broker := &testBroker{}
+	_, err = db.NewBrokerEventHandler(config, broker, "")
+	require.NoError(t, err)
+	putBrokerTestDocs(t, db, 1, 2)
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, broker.keys())
+}
+
+func TestBrokerEventHandlerLeaseLostBetweenRetries(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	config := BrokerConfig{Type: BrokerTypeNATS, Topic: "changes", PollIntervalMs: 10, RetryBackoffMs: 1}
+	checkpointKey := base.BrokerCheckpointPrefix + config.Type + ":" + config.Topic
+
+	// Another node takes over the lease while the first attempt is failing, so the batch isn't retried
+	leaseTaken := make(chan struct{})
+	broker := &testBroker{failures: 1}
+	broker.onFailure = func() {
+		_, err := db.Bucket.Update(checkpointKey, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+			var checkpoint brokerCheckpoint
+			if err := base.JSONUnmarshal(current, &checkpoint); err != nil {
+				return nil, nil, false, err
+			}
+			checkpoint.Owner = "other"
+			checkpoint.LeaseExpiry = time.Now().Add(time.Hour).Unix()
+			updated, err := base.JSONMarshal(checkpoint)
+			return updated, nil, false, err
+		})
+		assert.NoError(t, err)
+		close(leaseTaken)
+	}
+	handler, err := db.NewBrokerEventHandler(config, broker, "")
+	require.NoError(t, err)
+	putBrokerTestDocs(t, db, 1, 2)
+	handler.HandleEvent(&DocumentChangeEvent{})
+
+	select {
+	case <-leaseTaken:
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "Publish wasn't attempted")
+	}
+	time.Sleep(100 * time.Millisecond)
+	broker.lock.Lock()
+	defer broker.lock.Unlock()
+	assert.Equal(t, 1, broker.attempts)
+	assert.Empty(t, broker.messages)
+}
+
+func TestNewBrokerEventHandlerErrors(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	for _, config := range []BrokerConfig{
+		{Type: BrokerTypeNATS},
+		{Type: BrokerTypeNATS, Topic: "changes", BatchSize: -1},
+		{Type: BrokerTypeNATS, Topic: "changes", KeyTemplate: "{{.DocID"},
+		{Type: BrokerTypeNATS, Topic: "changes", PayloadTemplate: "{{"},
+	} {
+		_, err := db.NewBrokerEventHandler(config, &testBroker{}, "")
+		assert.Error(t, err, "config %+v", config)
+	}
+
+	for _, brokerURL := range [][2]string{
+		{BrokerTypeNATS, ""},
+		{BrokerTypeNATS, "http://localhost:4222"},
+		{"rabbitmq", "amqp://localhost"},
+	} {
+		_, err := NewBrokerPublisher(brokerURL[0], brokerURL[1], 0)
+		assert.Error(t, err, "broker %v", brokerURL)
+	}
+}
+
+// Runs the publisher against a minimal NATS server stand-in.
+func TestNATSPublisher(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		_, _ = conn.Write([]byte(`INFO {"server_id":"test","headers":true}` + "\r\n"))
+		reader := bufio.NewReader(conn)
+		var lines []string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "HPUB":
+				size, _ := strconv.Atoi(fields[3])
+				payload := make([]byte, size+2)
+				_, _ = io.ReadFull(reader, payload)
+				lines = append(lines, fields[1]+" "+strings.TrimSpace(string(payload)))
+			case "PING":
+				_, _ = conn.Write([]byte("PONG\r\n"))
+				received <- lines
+				return
+			}
+		}
+	}()
+
+	publisher, err := NewBrokerPublisher(BrokerTypeNATS, "nats://"+listener.Addr().String(), time.Second)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, publisher.Close()) }()
+	require.NoError(t, publisher.Publish(context.Background(), "sg.changes", []BrokerMessage{
+		{Key: []byte("doc1"), Value: []byte(`{"n":1}`)},
+		{Key: []byte("doc2"), Value: []byte(`{"n":2}`)},
+	}))
+	lines := <-received
+	require.Len(t, lines, 2)
+	assert.Equal(t, "sg.changes NATS/1.0\r\nSg-Key: doc1\r\n\r\n{\"n\":1}", lines[0])
+	assert.Equal(t, "sg.changes NATS/1.0\r\nSg-Key: doc2\r\n\r\n{\"n\":2}", lines[1])
+}
+
+// Runs the publisher against a Kafka REST proxy stand-in.
+func TestKafkaRESTPublisher(t *testing.T) {
+	var records []kafkaRESTRecord
+	failRecords := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/changes", r.URL.Path)
+		assert.Equal(t, kafkaRESTContentType, r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		var request struct {
+			Records []kafkaRESTRecord `json:"records"`
+		}
+		require.NoError(t, base.JSONUnmarshal(body, &request))
+		records = request.Records
+		if failRecords {
+			_, _ = w.Write([]byte(`{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"timeout"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"offsets":[{"partition":0,"offset":1,"error_code":null,"error":null}]}`))
+	}))
+	defer server.Close()
+
+	publisher, err := NewBrokerPublisher(BrokerTypeKafkaREST, server.URL, time.Second)
+	require.NoError(t, err)
+	defer func() { assert.NoError(t, publisher.Close()) }()
+
+	require.NoError(t, publisher.Publish(context.Background(), "changes", []BrokerMessage{{Key: []byte("doc1"), Value: []byte("payload")}}))
+	require.Len(t, records, 1)
+	key, err := base64.StdEncoding.DecodeString(*records[0].Key)
+	require.NoError(t, err)
+	assert.Equal(t, "doc1", string(key))
+	value, err := base64.StdEncoding.DecodeString(records[0].Value)
+	require.NoError(t, err)
+	assert.Equal(t, "payload", string(value))
+
+	failRecords = true
+	assert.Error(t, publisher.Publish(context.Background(), "changes", []BrokerMessage{{Value: []byte("payload")}}))
+}
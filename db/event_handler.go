@@ -12,11 +12,16 @@ package db
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/couchbase/sync_gateway/base"
@@ -40,6 +45,13 @@ type Webhook struct {
 	options struct {
 		DocumentChangedWinningRevOnly bool
 	}
+	signingSecret string           // Secret used to sign requests, when set
+	id            string           // Identifies the outbox of a durable webhook
+	outbox        *webhookOutbox   // Outbox of undelivered events, for durable webhooks
+	transform     *JSEventFunction // Returns the request body for an event, when set
+	method        string           // HTTP method, defaults to POST
+	contentType   string           // Content-Type of requests, defaults to application/json
+	headers       http.Header      // Headers added to each request
 }
 
 const (
@@ -47,6 +59,11 @@ const (
 	kDefaultWebhookTimeout = 60
 	// EventOptionDocumentChangedWinningRevOnly controls whether a document_changed event is processed for winning revs only.
 	EventOptionDocumentChangedWinningRevOnly = "winning_rev_only"
+
+	// WebhookSignatureHeader is the request header holding the signature, for webhooks with a signing secret
+	WebhookSignatureHeader = "X-Sync-Gateway-Signature"
+	// WebhookDeliveryHeader is the request header holding the outbox entry ID, for durable webhooks
+	WebhookDeliveryHeader = "X-Sync-Gateway-Delivery"
 )
 
 // Creates a new webhook handler based on the url and filter function.
@@ -79,6 +96,9 @@ func NewWebhook(url string, filterFnString string, timeout *uint64, options map[
 
 	if options != nil {
 		wh.options.DocumentChangedWinningRevOnly, _ = options[EventOptionDocumentChangedWinningRevOnly].(bool)
+		if err := wh.applyOptions(options); err != nil {
+			return nil, err
+		}
 	}
 
 	return wh, err
@@ -86,22 +106,50 @@ func NewWebhook(url string, filterFnString string, timeout *uint64, options map[
 
 // Performs an HTTP POST to the url defined for the handler.  If a filter function is defined,
 // calls it to determine whether to POST.  The payload for the POST is depends
-// on the event type.
+// on the event type.  Durable webhooks write the payload to the outbox, to be posted by the outbox worker.
 func (wh *Webhook) HandleEvent(event Event) bool {
 
-	const contentType = "application/json"
-	var payload []byte
+	payload, ok := wh.eventPayload(event)
+	if !ok {
+		return false
+	}
+
+	if wh.outbox != nil {
+		if err := wh.outbox.add(event.EventType().String(), payload); err != nil {
+			base.Warnf("Error adding %s to outbox for %s: %v", base.UD(event.String()), wh, err)
+			return false
+		}
+		return true
+	}
+
+	resp, err := wh.post(payload, "")
+	if err != nil {
+		base.Warnf("Error attempting to post %s to url %s: %s", base.UD(event.String()), base.UD(wh.SanitizedUrl()), err)
+		return false
+	}
+
+	// Check Log Level first, as SanitizedUrl is expensive to evaluate.
+	if base.LogDebugEnabled(base.KeyEvents) {
+		base.Debugf(base.KeyEvents, "Webhook handler ran for event.  Payload %s posted to URL %s, got status %s",
+			base.UD(string(payload)), base.UD(wh.SanitizedUrl()), resp.Status)
+	}
+	return true
+}
+
+// eventPayload returns the payload to post for the event, or false if the event is skipped.
+func (wh *Webhook) eventPayload(event Event) (payload []byte, ok bool) {
 
 	// Different events post different content by default
 	switch event := event.(type) {
 	case *DocumentChangeEvent:
 		// skip event if this is for a non-winning rev and the winning rev only option is enabled
 		if !event.WinningRevChange && wh.options.DocumentChangedWinningRevOnly {
-			return false
+			return nil, false
 		}
 		payload = event.DocBytes
-	case *DBStateChangeEvent:
-		// for DBStateChangeEvent, post JSON document with the following format
+	case BodyEvent:
+		// for DBStateChangeEvent, post JSON document with the following format.  Other events post the payloads
+		// documented on their event types.
 		//{
 		//	“admininterface":"127.0.0.1:4985",
 		//	“dbname":"db",
@@ -109,15 +157,15 @@ func (wh *Webhook) HandleEvent(event Event) bool {
 		//	"reason":"DB started from config”,
 		//	“state”:"online"
 		//}
-		jsonOut, err := base.JSONMarshal(event.Doc)
+		jsonOut, err := base.JSONMarshal(event.Body())
 		if err != nil {
 			base.Warnf("Error marshalling doc for webhook post")
-			return false
+			return nil, false
 		}
 		payload = jsonOut
 	default:
 		base.Warnf("Webhook invoked for unsupported event type.")
-		return false
+		return nil, false
 	}
 
 	if wh.filter != nil {
@@ -129,39 +177,112 @@ func (wh *Webhook) HandleEvent(event Event) bool {
 
 		// If filter returns false, cancel webhook post
 		if !success {
-			return false
+			return nil, false
 		}
 	}
 
-	success := func() bool {
-		resp, err := wh.client.Post(wh.url, contentType, bytes.NewBuffer(payload))
-		defer func() {
-			// Ensure we're closing the response, so it can be reused
-			if resp != nil && resp.Body != nil {
-				_, err := io.Copy(ioutil.Discard, resp.Body)
-				if err != nil {
-					base.Debugf(base.KeyEvents, "Error copying response body: %v", err)
-				}
-				err = resp.Body.Close()
-				if err != nil {
-					base.Debugf(base.KeyEvents, "Error closing response body: %v", err)
-				}
-			}
-		}()
-
+	if wh.transform != nil {
+		result, err := wh.transform.CallFunction(event)
 		if err != nil {
-			base.Warnf("Error attempting to post %s to url %s: %s", base.UD(event.String()), base.UD(wh.SanitizedUrl()), err)
-			return false
+			base.Warnf("Error calling webhook transform function: %v", err)
+			return nil, false
+		}
+		switch result := result.(type) {
+		case nil:
+			// Transform returned null or undefined, cancel webhook post
+			return nil, false
+		case string:
+			payload = []byte(result)
+		default:
+			payload, err = base.JSONMarshal(result)
+			if err != nil {
+				base.Warnf("Error marshalling webhook transform function result: %v", err)
+				return nil, false
+			}
 		}
+	}
+	return payload, true
+}
+
+// post sends the payload to the webhook url, signing the request when a signing secret is set.  deliveryID is sent
+// as a header when non-empty, so that receivers can ignore redelivered events.
+func (wh *Webhook) post(payload []byte, deliveryID string) (*http.Response, error) {
+	method := wh.method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequest(method, wh.url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range wh.headers {
+		req.Header[name] = values
+	}
+	contentType := wh.contentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	if deliveryID != "" {
+		req.Header.Set(WebhookDeliveryHeader, deliveryID)
+	}
+	if wh.signingSecret != "" {
+		req.Header.Set(WebhookSignatureHeader, WebhookSignature(wh.signingSecret, time.Now(), payload))
+	}
 
-		// Check Log Level first, as SanitizedUrl is expensive to evaluate.
-		if base.LogDebugEnabled(base.KeyEvents) {
-			base.Debugf(base.KeyEvents, "Webhook handler ran for event.  Payload %s posted to URL %s, got status %s",
-				base.UD(string(payload)), base.UD(wh.SanitizedUrl()), resp.Status)
+	resp, err := wh.client.Do(req)
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		// Basic auth credentials may have been included in the URL
+		urlErr.URL = wh.SanitizedUrl()
+	}
+	// Ensure we're closing the response, so it can be reused
+	if resp != nil && resp.Body != nil {
+		_, copyErr := io.Copy(ioutil.Discard, resp.Body)
+		if copyErr != nil {
+			base.Debugf(base.KeyEvents, "Error copying response body: %v", copyErr)
 		}
-		return true
-	}()
-	return success
+		closeErr := resp.Body.Close()
+		if closeErr != nil {
+			base.Debugf(base.KeyEvents, "Error closing response body: %v", closeErr)
+		}
+	}
+	return resp, err
+}
+
+// deliver posts an outbox entry, treating any non-2xx response as a failure so that the entry is retried.
+func (wh *Webhook) deliver(entry *WebhookOutboxEntry) error {
+	resp, err := wh.post(entry.Payload, entry.ID)
+	if err != nil {
+		return fmt.Errorf("error posting to %s: %v", wh.SanitizedUrl(), err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", wh.SanitizedUrl(), resp.Status)
+	}
+	base.Debugf(base.KeyEvents, "Webhook outbox entry %s posted to URL %s, got status %s", entry.ID, base.UD(wh.SanitizedUrl()), resp.Status)
+	return nil
+}
+
+// SetSigningSecret enables HMAC signing of webhook requests.  See WebhookSignature.
+func (wh *Webhook) SetSigningSecret(secret string) {
+	wh.signingSecret = secret
+}
+
+// WebhookSignature returns the signature header value for a webhook request, of the form t=<timestamp>,v1=<hmac>.
+// The HMAC is the hex encoded HMAC-SHA256 of the unix timestamp, a period, and the request body, keyed with the
+// signing secret.  Receivers should recompute the HMAC and reject requests with old timestamps to prevent replay.
+func WebhookSignature(secret string, timestamp time.Time, payload []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(payload)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ID returns the identifier used to manage a durable webhook's outbox through the admin API, or empty if the
+// webhook isn't durable.
+func (wh *Webhook) ID() string {
+	return wh.id
 }
 
 func (wh *Webhook) String() string {
@@ -21,10 +21,14 @@ import (
 
 // EventManager routes raised events to corresponding event handlers.  Incoming events are just dumped in the
 // eventChannel to minimize time spent blocking whatever process is raising the event.
-// The event queue worker goroutine works the event channel and sends events to the appropriate handlers
+// The event queue worker goroutine works the event channel and sends events to the appropriate handlers.  Durable
+// handlers are the exception - they write the event to their outbox before raising returns, so that events aren't lost
+// when the queue is full or the node stops.
 type EventManager struct {
 	activeEventTypes       map[EventType]bool
 	eventHandlers          map[EventType][]EventHandler
+	handlerStats           map[EventType][]*eventHandlerStats // Per-handler counts, in the same order as eventHandlers
+	asyncHandlerCounts     map[EventType]int                  // Number of handlers for each event type that aren't durable
 	asyncEventChannel      chan Event
 	activeCountChannel     chan bool
 	waitTime               int
@@ -48,6 +52,60 @@ func (em *EventManager) IncrementEventsProcessedFail(delta int64) int64 {
 	return atomic.AddInt64(&em.eventsProcessedFail, delta)
 }
 
+// eventHandlerStats counts the events processed by a single registered handler.
+type eventHandlerStats struct {
+	success int64
+	fail    int64
+}
+
+// EventHandlerStats reports the events processed by a registered handler.  For durable webhooks, success counts
+// events written to the outbox, and Outbox reports their delivery.
+type EventHandlerStats struct {
+	Handler   string               `json:"handler"`
+	EventType string               `json:"event_type"`
+	WebhookID string               `json:"webhook_id,omitempty"`
+	Success   int64                `json:"success"`
+	Fail      int64                `json:"fail"`
+	Outbox    *WebhookOutboxStatus `json:"outbox,omitempty"`
+}
+
+// GetEventHandlerStats returns the processed event counts for each registered handler.
+func (em *EventManager) GetEventHandlerStats() ([]EventHandlerStats, error) {
+	stats := make([]EventHandlerStats, 0)
+	for eventType := EventType(0); eventType < eventTypeCount; eventType++ {
+		for i, handler := range em.eventHandlers[eventType] {
+			handlerStats := EventHandlerStats{
+				Handler:   handler.String(),
+				EventType: eventType.String(),
+				Success:   atomic.LoadInt64(&em.handlerStats[eventType][i].success),
+				Fail:      atomic.LoadInt64(&em.handlerStats[eventType][i].fail),
+			}
+			if wh, ok := handler.(*Webhook); ok && wh.outbox != nil {
+				outboxStatus, err := wh.outbox.status()
+				if err != nil {
+					return nil, err
+				}
+				handlerStats.WebhookID = wh.id
+				handlerStats.Outbox = outboxStatus
+			}
+			stats = append(stats, handlerStats)
+		}
+	}
+	return stats, nil
+}
+
+// durableWebhook returns the registered durable webhook with the given ID, or nil if there isn't one.
+func (em *EventManager) durableWebhook(id string) *Webhook {
+	for _, handlers := range em.eventHandlers {
+		for _, handler := range handlers {
+			if wh, ok := handler.(*Webhook); ok && wh.outbox != nil && wh.id == id {
+				return wh
+			}
+		}
+	}
+	return nil
+}
+
 const kMaxActiveEvents = 500 // number of events that are processed concurrently
 const kEventWaitTime = 100   // time (ms) to wait before dropping event, when event queue is full
 
@@ -55,8 +113,10 @@ const kEventWaitTime = 100   // time (ms) to wait before dropping event, when ev
 // monitor and process that channel.
 func NewEventManager() *EventManager {
 	return &EventManager{
-		eventHandlers:    make(map[EventType][]EventHandler, 0),
-		activeEventTypes: make(map[EventType]bool),
+		eventHandlers:      make(map[EventType][]EventHandler, 0),
+		handlerStats:       make(map[EventType][]*eventHandlerStats),
+		asyncHandlerCounts: make(map[EventType]int),
+		activeEventTypes:   make(map[EventType]bool),
 	}
 }
 
@@ -98,29 +158,57 @@ func (em *EventManager) ProcessEvent(event Event) {
 	// Send event to all registered handlers concurrently.  WaitGroup blocks
 	// until all are finished
 	var wg sync.WaitGroup
-	for _, handler := range em.eventHandlers[event.EventType()] {
+	for i, handler := range em.eventHandlers[event.EventType()] {
+		// Durable handlers have already handled the event, when it was raised
+		if isDurableHandler(handler) {
+			continue
+		}
 		base.Debugf(base.KeyEvents, "Event queue worker sending event %s to: %s", base.UD(event.String()), handler)
 		wg.Add(1)
-		go func(event Event, handler EventHandler) {
+		go func(event Event, handler EventHandler, stats *eventHandlerStats) {
 			defer wg.Done()
-			//TODO: Currently we're not tracking success/fail from event handlers.  When this
-			// is needed, could pass a channel to HandleEvent for tracking results
-			if handler.HandleEvent(event) {
-				em.IncrementEventsProcessedSuccess(1)
-			} else {
-				em.IncrementEventsProcessedFail(1)
-			}
+			em.handleEvent(event, handler, stats)
 			base.Tracef(base.KeyAll, "Webhook event processed %s", event)
 
-		}(event, handler)
+		}(event, handler, em.handlerStats[event.EventType()][i])
 	}
 	wg.Wait()
 }
 
+// processDurableEvent sends the event to each durable handler registered for the event type, which writes it to the
+// handler's outbox.
+func (em *EventManager) processDurableEvent(event Event) {
+	for i, handler := range em.eventHandlers[event.EventType()] {
+		if isDurableHandler(handler) {
+			em.handleEvent(event, handler, em.handlerStats[event.EventType()][i])
+		}
+	}
+}
+
+func (em *EventManager) handleEvent(event Event, handler EventHandler, stats *eventHandlerStats) {
+	if handler.HandleEvent(event) {
+		atomic.AddInt64(&stats.success, 1)
+		em.IncrementEventsProcessedSuccess(1)
+	} else {
+		atomic.AddInt64(&stats.fail, 1)
+		em.IncrementEventsProcessedFail(1)
+	}
+}
+
+// isDurableHandler returns true for handlers that write events to an outbox for delivery.
+func isDurableHandler(handler EventHandler) bool {
+	wh, ok := handler.(*Webhook)
+	return ok && wh.outbox != nil
+}
+
 // Register a new event handler to the EventManager.  The event manager will route events of
 // type eventType to the handler.
 func (em *EventManager) RegisterEventHandler(handler EventHandler, eventType EventType) {
 	em.eventHandlers[eventType] = append(em.eventHandlers[eventType], handler)
+	em.handlerStats[eventType] = append(em.handlerStats[eventType], &eventHandlerStats{})
+	if !isDurableHandler(handler) {
+		em.asyncHandlerCounts[eventType]++
+	}
 	em.activeEventTypes[eventType] = true
 	base.Infof(base.KeyEvents, "Registered event handler: %v, for event type %v", handler, eventType)
 }
@@ -130,9 +218,15 @@ func (em *EventManager) HasHandlerForEvent(eventType EventType) bool {
 	return em.activeEventTypes[eventType]
 }
 
-// Adds async events to the channel for processing
+// Adds async events to the channel for processing.  Durable handlers are sent the event before returning, as events
+// may be discarded when the channel is full.
 func (em *EventManager) raiseEvent(event Event) error {
 	if !event.Synchronous() {
+		em.processDurableEvent(event)
+		if em.asyncHandlerCounts[event.EventType()] == 0 {
+			return nil
+		}
+
 		// When asyncEventChannel is full, the raiseEvent method will block for (waitTime).
 		// Default value of (waitTime) is 5 ms.
 		timer := time.NewTimer(time.Duration(em.waitTime) * time.Millisecond)
@@ -195,3 +289,115 @@ func (em *EventManager) RaiseDBStateChangeEvent(dbName string, state string, rea
 
 	return em.raiseEvent(event)
 }
+
+// eventBody returns the body of an event for the given db, with the local system time.
+func eventBody(dbName string) Body {
+	return Body{
+		"dbname":    dbName,
+		"localtime": time.Now().Format(base.ISO8601Format),
+	}
+}
+
+// Principal change actions
+const (
+	PrincipalCreated = "created"
+	PrincipalUpdated = "updated"
+	PrincipalDeleted = "deleted"
+)
+
+// Raises a principal change event when a user or role is created, updated or deleted.  If the event manager doesn't
+// have a listener for this event, ignores.
+func (em *EventManager) RaisePrincipalChangeEvent(dbName string, name string, isUser bool, action string) error {
+
+	if !em.activeEventTypes[PrincipalChange] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["name"] = name
+	body["action"] = action
+	if isUser {
+		body["type"] = "user"
+	} else {
+		body["type"] = "role"
+	}
+
+	return em.raiseEvent(&PrincipalChangeEvent{Doc: body})
+}
+
+// Raises a replication state change event.  lastError is only included when non-empty.  If the event manager
+// doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseReplicationStateChangeEvent(dbName string, replicationID string, direction ActiveReplicatorDirection, oldState string, state string, lastError string) error {
+
+	if !em.activeEventTypes[ReplicationStateChange] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["replication_id"] = replicationID
+	body["direction"] = string(direction)
+	body["old_state"] = oldState
+	body["state"] = state
+	if lastError != "" {
+		body["error"] = lastError
+	}
+
+	return em.raiseEvent(&ReplicationStateChangeEvent{Doc: body})
+}
+
+// Raises an auth failure event.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseAuthFailureEvent(dbName string, username string, remoteAddr string, path string, reason string) error {
+
+	if !em.activeEventTypes[AuthFailure] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["username"] = username
+	body["remote_addr"] = remoteAddr
+	body["path"] = path
+	body["reason"] = reason
+
+	return em.raiseEvent(&AuthFailureEvent{Doc: body})
+}
+
+// Raises a session create event.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseSessionCreateEvent(dbName string, username string, expires time.Time) error {
+
+	if !em.activeEventTypes[SessionCreate] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["username"] = username
+	body["expires"] = expires.Format(base.ISO8601Format)
+
+	return em.raiseEvent(&SessionCreateEvent{Doc: body})
+}
+
+// Raises a document purge event.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseDocumentPurgeEvent(dbName string, docID string) error {
+
+	if !em.activeEventTypes[DocumentPurge] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["doc_id"] = docID
+
+	return em.raiseEvent(&DocumentPurgeEvent{Doc: body})
+}
+
+// Raises a document expiry event.  If the event manager doesn't have a listener for this event, ignores.
+func (em *EventManager) RaiseDocumentExpiryEvent(dbName string, docID string, expiry time.Time) error {
+
+	if !em.activeEventTypes[DocumentExpiry] {
+		return nil
+	}
+
+	body := eventBody(dbName)
+	body["doc_id"] = docID
+	body["expiry"] = expiry.Format(base.ISO8601Format)
+
+	return em.raiseEvent(&DocumentExpiryEvent{Doc: body})
+}
@@ -12,6 +12,7 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -26,6 +27,7 @@ import (
 
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const DefaultWaitForWebhook = time.Second * 5
@@ -951,3 +953,151 @@ func TestWebhookHandleEventDBStateChangeMarshalDocError(t *testing.T) {
 	success := wh.HandleEvent(event)
 	assert.False(t, success, "It should throw marshalling doc error and log warnings")
 }
+
+// bodyEventHandler sends the body of each event it handles to events.
+type bodyEventHandler struct {
+	events chan Body
+}
+
+func (h *bodyEventHandler) HandleEvent(event Event) bool {
+	h.events <- event.(BodyEvent).Body()
+	return true
+}
+
+func (h *bodyEventHandler) String() string {
+	return "bodyEventHandler"
+}
+
+func registerBodyEventHandler(db *Database, eventTypes ...EventType) chan Body {
+	handler := &bodyEventHandler{events: make(chan Body, 10)}
+	for _, eventType := range eventTypes {
+		db.EventMgr.RegisterEventHandler(handler, eventType)
+	}
+	db.EventMgr.Start(0, -1)
+	return handler.events
+}
+
+func waitForBodyEvent(t *testing.T, events chan Body) Body {
+	select {
+	case body := <-events:
+		assert.Equal(t, "db", body["dbname"])
+		_, err := time.Parse(base.ISO8601Format, body["localtime"].(string))
+		assert.NoError(t, err)
+		return body
+	case <-time.After(DefaultWaitForWebhook):
+		require.FailNow(t, "Timed out waiting for event")
+		return nil
+	}
+}
+
+func TestPrincipalChangeEvent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	events := registerBodyEventHandler(db, PrincipalChange)
+
+	_, err := db.UpdatePrincipal(PrincipalConfig{Name: base.StringPtr("alice"), Password: base.StringPtr("letmein")}, true, true)
+	require.NoError(t, err)
+	body := waitForBodyEvent(t, events)
+	assert.Equal(t, "alice", body["name"])
+	assert.Equal(t, "user", body["type"])
+	assert.Equal(t, PrincipalCreated, body["action"])
+
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: base.StringPtr("alice"), ExplicitChannels: base.SetOf("A")}, true, true)
+	require.NoError(t, err)
+	assert.Equal(t, PrincipalUpdated, waitForBodyEvent(t, events)["action"])
+
+	// Unchanged principals don't raise events
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: base.StringPtr("alice"), ExplicitChannels: base.SetOf("A")}, true, true)
+	require.NoError(t, err)
+
+	require.NoError(t, db.DeleteUser("alice"))
+	body = waitForBodyEvent(t, events)
+	assert.Equal(t, "alice", body["name"])
+	assert.Equal(t, PrincipalDeleted, body["action"])
+	assert.Equal(t, base.ErrNotFound, db.DeleteUser("alice"))
+
+	_, err = db.UpdatePrincipal(PrincipalConfig{Name: base.StringPtr("role1")}, false, true)
+	require.NoError(t, err)
+	body = waitForBodyEvent(t, events)
+	assert.Equal(t, "role", body["type"])
+	assert.Equal(t, PrincipalCreated, body["action"])
+	require.NoError(t, db.DeleteRole("role1", false))
+	assert.Equal(t, PrincipalDeleted, waitForBodyEvent(t, events)["action"])
+
+	assert.Len(t, events, 0)
+}
+
+func TestReplicationStateChangeEvent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	events := registerBodyEventHandler(db, ReplicationStateChange)
+
+	replicator := &activeReplicatorCommon{
+		config:    &ActiveReplicatorConfig{ID: "rep1", ActiveDB: db},
+		direction: ActiveReplicatorTypePush,
+		state:     ReplicationStateStopped,
+		ctx:       context.Background(),
+	}
+	replicator.setState(ReplicationStateRunning)
+	body := waitForBodyEvent(t, events)
+	assert.Equal(t, "rep1", body["replication_id"])
+	assert.Equal(t, "push", body["direction"])
+	assert.Equal(t, ReplicationStateStopped, body["old_state"])
+	assert.Equal(t, ReplicationStateRunning, body["state"])
+	assert.NotContains(t, body, "error")
+
+	// Setting the same state doesn't raise an event
+	replicator.setState(ReplicationStateRunning)
+	_ = replicator.setError(errors.New("connection refused"))
+	body = waitForBodyEvent(t, events)
+	assert.Equal(t, ReplicationStateRunning, body["old_state"])
+	assert.Equal(t, ReplicationStateError, body["state"])
+	assert.Equal(t, "connection refused", body["error"])
+	assert.Len(t, events, 0)
+}
+
+func TestDocumentPurgeEvent(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	events := registerBodyEventHandler(db, DocumentPurge)
+
+	_, _, err := db.Put("doc1", Body{"foo": "bar"})
+	require.NoError(t, err)
+	require.NoError(t, db.Purge("doc1"))
+	assert.Equal(t, "doc1", waitForBodyEvent(t, events)["doc_id"])
+}
+
+func TestWebhookBodyEvents(t *testing.T) {
+	ts, wr := InitWebhookTest()
+	defer ts.Close()
+
+	em := NewEventManager()
+	em.Start(0, -1)
+	wh, err := NewWebhook(fmt.Sprintf("%s/echo", ts.URL), `function(event) { return event.username == "alice"; }`, nil, nil)
+	require.NoError(t, err)
+	em.RegisterEventHandler(wh, AuthFailure)
+	em.RegisterEventHandler(wh, SessionCreate)
+
+	require.NoError(t, em.RaiseAuthFailureEvent("db", "bob", "127.0.0.1:1234", "/db/", "Invalid login"))
+	require.NoError(t, em.RaiseAuthFailureEvent("db", "alice", "127.0.0.1:1234", "/db/", "Invalid login"))
+	require.NoError(t, em.RaiseSessionCreateEvent("db", "alice", time.Now().Add(time.Hour)))
+	// Events without a handler are ignored
+	require.NoError(t, em.RaiseDocumentExpiryEvent("db", "doc1", time.Now()))
+	require.NoError(t, em.waitForProcessedTotal(context.TODO(), 3, DefaultWaitForWebhook))
+	assert.Equal(t, int64(2), em.GetEventsProcessedSuccess())
+
+	payloads := wr.GetPayloads()
+	require.Len(t, payloads, 2)
+	var bodies []Body
+	for _, payload := range payloads {
+		var body Body
+		require.NoError(t, base.JSONUnmarshal(payload, &body))
+		assert.Equal(t, "alice", body["username"])
+		bodies = append(bodies, body)
+	}
+	if _, ok := bodies[0]["expires"]; ok {
+		bodies[0], bodies[1] = bodies[1], bodies[0]
+	}
+	assert.Equal(t, "Invalid login", bodies[0]["reason"])
+	assert.Contains(t, bodies[1], "expires")
+}
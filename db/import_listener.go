@@ -12,6 +12,7 @@ package db
 
 import (
 	"strings"
+	"time"
 
 	sgbucket "github.com/couchbase/sg-bucket"
 	"github.com/couchbase/sync_gateway/base"
@@ -137,6 +138,13 @@ func (il *importListener) ImportFeedEvent(event sgbucket.FeedEvent) {
 		}
 		docID := string(event.Key)
 
+		// Deletions of documents whose expiry has passed were made by the server when the document expired
+		if isDelete && syncData != nil && syncData.Expiry != nil && !syncData.Expiry.After(time.Now()) {
+			if err := il.database.EventMgr.RaiseDocumentExpiryEvent(il.database.Name, docID, *syncData.Expiry); err != nil {
+				base.Debugf(base.KeyImport, "Unable to raise document expiry event for %s: %v", base.UD(docID), err)
+			}
+		}
+
 		// last attempt to exit processing if the importListener has been closed before attempting to write to the bucket
 		select {
 		case <-il.terminator:
@@ -0,0 +1,428 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// DefaultPushNotificationDebounce is the default minimum interval between push notifications sent to the devices of a
+// single user.
+const DefaultPushNotificationDebounce = 60 * time.Second
+
+// pushNotificationBatchInterval is how long changed channels are accumulated before the registered users are
+// evaluated, so that a burst of mutations results in a single pass over the registered users.
+const pushNotificationBatchInterval = 500 * time.Millisecond
+
+// pushGatewayRequestTimeout bounds the time spent sending a single notification to the push gateway.
+const pushGatewayRequestTimeout = 10 * time.Second
+
+// pushUserCacheTTL is how long a registered user is cached by the notifier before being reloaded, so that changes to
+// the user's channel access and devices made on other nodes are picked up.
+const pushUserCacheTTL = time.Minute
+
+// pushDeviceRegistryShardCount is the number of documents the registry is spread across, to limit the size of each
+// document and CAS contention when claiming notifications.
+const pushDeviceRegistryShardCount = 16
+
+// maxPushDeviceRegistryShardBytes bounds the size of a single registry shard document, which is rewritten each time a
+// user in the shard is notified.  At up to ~300 bytes per user this holds at least 3500 users per shard, or ~20000
+// users with typical usernames.
+const maxPushDeviceRegistryShardBytes = 1024 * 1024
+
+type PushNotificationOptions struct {
+	GatewayURL       string        // Push gateway (FCM/APNs relay) endpoint that notifications are POSTed to
+	DebounceInterval time.Duration // Minimum interval between notifications sent to a single user's devices, zero to disable
+}
+
+// PushNotification is the payload POSTed to the push gateway to wake up a user's devices.  It identifies the channels
+// that changed, but never includes document content.
+type PushNotification struct {
+	Database string            `json:"db"`
+	Username string            `json:"username"`
+	Devices  []auth.PushDevice `json:"devices"`
+	Channels []string          `json:"channels"`
+}
+
+// pushDeviceRegistry is the persisted set of users with at least one registered push device, along with the time
+// each user was last notified.  The last notified time is shared between nodes, so that a change seen by every
+// node's caching feed only results in a single notification per debounce interval.  Users are spread across
+// pushDeviceRegistryShardCount shard documents by username.
+type pushDeviceRegistry struct {
+	Users map[string]int64 `json:"users"` // Username to unix time (nanos) of last notification, zero if never notified
+}
+
+// pushNotifier watches the channels changed in the change cache and sends wake-up notifications to the push gateway
+// for users with registered devices that don't have an active continuous replication on this node.
+type pushNotifier struct {
+	dbName           string
+	bucket           base.Bucket
+	authenticator    *auth.Authenticator
+	gatewayURL       string
+	debounceInterval time.Duration
+	client           *http.Client
+	sentStat         *base.SgwIntStat
+	errorStat        *base.SgwIntStat
+
+	lock            sync.Mutex
+	pendingChannels base.Set                   // Channels changed since the last batch was processed
+	activeClients   map[string]int             // Count of active continuous replications on this node, by username
+	users           map[string]*cachedPushUser // Registered users, cached between batches
+
+	wake       chan struct{}
+	terminator chan struct{}
+	done       chan struct{}
+}
+
+func newPushNotifier(dbContext *DatabaseContext, options *PushNotificationOptions) *pushNotifier {
+	return &pushNotifier{
+		dbName:           dbContext.Name,
+		bucket:           dbContext.Bucket,
+		authenticator:    dbContext.Authenticator(),
+		gatewayURL:       options.GatewayURL,
+		debounceInterval: options.DebounceInterval,
+		client:           &http.Client{Timeout: pushGatewayRequestTimeout},
+		sentStat:         dbContext.DbStats.Database().PushNotificationsSent,
+		errorStat:        dbContext.DbStats.Database().PushNotificationErrors,
+		pendingChannels:  base.Set{},
+		activeClients:    map[string]int{},
+		users:            map[string]*cachedPushUser{},
+		wake:             make(chan struct{}, 1),
+		terminator:       make(chan struct{}),
+		done:             make(chan struct{}),
+	}
+}
+
+// start launches the goroutine that processes changed channels.
+func (pn *pushNotifier) start() {
+	go func() {
+		defer close(pn.done)
+		for {
+			select {
+			case <-pn.terminator:
+				return
+			case <-pn.wake:
+			}
+			// Accumulate further changes before evaluating users
+			select {
+			case <-pn.terminator:
+				return
+			case <-time.After(pushNotificationBatchInterval):
+			}
+			pn.processPending()
+		}
+	}()
+}
+
+func (pn *pushNotifier) stop() {
+	close(pn.terminator)
+	<-pn.done
+}
+
+// notifyChange is invoked by the change cache with the set of changed channels.  Must not block.
+func (pn *pushNotifier) notifyChange(changedChannels base.Set) {
+	pn.lock.Lock()
+	for channelName := range changedChannels {
+		pn.pendingChannels.Add(channelName)
+	}
+	pn.lock.Unlock()
+
+	select {
+	case pn.wake <- struct{}{}:
+	default:
+	}
+}
+
+// clientConnected records an active continuous replication for the user.  Users with an active replication aren't
+// idle, and so aren't sent notifications.
+func (pn *pushNotifier) clientConnected(username string) {
+	pn.lock.Lock()
+	pn.activeClients[username]++
+	pn.lock.Unlock()
+}
+
+func (pn *pushNotifier) clientDisconnected(username string) {
+	pn.lock.Lock()
+	pn.activeClients[username]--
+	if pn.activeClients[username] <= 0 {
+		delete(pn.activeClients, username)
+	}
+	pn.lock.Unlock()
+}
+
+func (pn *pushNotifier) isClientActive(username string) bool {
+	pn.lock.Lock()
+	defer pn.lock.Unlock()
+	return pn.activeClients[username] > 0
+}
+
+// cachedPushUser is a registered user loaded by the notifier.  A nil user is cached for users that no longer exist.
+type cachedPushUser struct {
+	user   auth.User
+	expiry time.Time
+}
+
+// getUser returns the registered user, from the cache if it was loaded within pushUserCacheTTL.
+func (pn *pushNotifier) getUser(username string, now time.Time) (auth.User, error) {
+	pn.lock.Lock()
+	cached, ok := pn.users[username]
+	pn.lock.Unlock()
+	if ok && now.Before(cached.expiry) {
+		return cached.user, nil
+	}
+	user, err := pn.authenticator.GetUser(username)
+	if err != nil {
+		return nil, err
+	}
+	pn.lock.Lock()
+	pn.users[username] = &cachedPushUser{user: user, expiry: now.Add(pushUserCacheTTL)}
+	pn.lock.Unlock()
+	return user, nil
+}
+
+// invalidateUser removes the user from the cache, after their devices have changed on this node.
+func (pn *pushNotifier) invalidateUser(username string) {
+	pn.lock.Lock()
+	delete(pn.users, username)
+	pn.lock.Unlock()
+}
+
+// pruneUsers removes users that are no longer registered from the cache.
+func (pn *pushNotifier) pruneUsers(registry *pushDeviceRegistry) {
+	pn.lock.Lock()
+	for username := range pn.users {
+		if _, ok := registry.Users[username]; !ok {
+			delete(pn.users, username)
+		}
+	}
+	pn.lock.Unlock()
+}
+
+// processPending notifies every idle registered user with access to any of the channels changed since the last batch.
+// Users are cached between batches, so that each batch only loads users whose cached entry has expired.
+func (pn *pushNotifier) processPending() {
+	pn.lock.Lock()
+	changedChannels := pn.pendingChannels
+	pn.pendingChannels = base.Set{}
+	pn.lock.Unlock()
+
+	if len(changedChannels) == 0 {
+		return
+	}
+
+	registry, err := pn.getRegistry()
+	if err != nil {
+		base.Warnf("Unable to load push device registry for database %s: %v", base.MD(pn.dbName), err)
+		return
+	}
+	pn.pruneUsers(registry)
+
+	now := time.Now()
+	for username, lastNotified := range registry.Users {
+		if pn.isClientActive(username) || now.Sub(time.Unix(0, lastNotified)) < pn.debounceInterval {
+			continue
+		}
+		user, err := pn.getUser(username, now)
+		if err != nil {
+			base.Warnf("Unable to load user %s for push notification: %v", base.UD(username), err)
+			continue
+		}
+		if user == nil || user.Disabled() || len(user.PushDevices()) == 0 {
+			continue
+		}
+		userChannels := make([]string, 0)
+		for channelName := range changedChannels {
+			if user.CanSeeChannel(channelName) {
+				userChannels = append(userChannels, channelName)
+			}
+		}
+		if len(userChannels) == 0 {
+			continue
+		}
+		sort.Strings(userChannels)
+
+		// Claim the notification in the registry first, so that other nodes processing the same change don't also
+		// notify the user
+		claimed, err := pn.claimNotification(username, now)
+		if err != nil {
+			base.Warnf("Unable to update push device registry for user %s: %v", base.UD(username), err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+
+		notification := &PushNotification{
+			Database: pn.dbName,
+			Username: username,
+			Devices:  user.PushDevices(),
+			Channels: userChannels,
+		}
+		if err := pn.send(notification); err != nil {
+			pn.errorStat.Add(1)
+			base.Warnf("Unable to send push notification for user %s: %v", base.UD(username), err)
+			continue
+		}
+		pn.sentStat.Add(1)
+		base.Debugf(base.KeyChanges, "Sent push notification to %d device(s) for user %s", len(notification.Devices), base.UD(username))
+	}
+}
+
+func (pn *pushNotifier) send(notification *PushNotification) error {
+	body, err := base.JSONMarshal(notification)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pushGatewayRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pn.gatewayURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := pn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("push gateway returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// getRegistry returns the registered users from all shards of the registry.
+func (pn *pushNotifier) getRegistry() (*pushDeviceRegistry, error) {
+	registry := &pushDeviceRegistry{Users: map[string]int64{}}
+	for i := 0; i < pushDeviceRegistryShardCount; i++ {
+		shard := &pushDeviceRegistry{}
+		_, err := pn.bucket.Get(pushDeviceRegistryShardKeyForIndex(i), shard)
+		if err != nil && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		for username, lastNotified := range shard.Users {
+			registry.Users[username] = lastNotified
+		}
+	}
+	return registry, nil
+}
+
+// pushDeviceRegistryShardKey returns the key of the registry shard document that holds the given user.
+func pushDeviceRegistryShardKey(username string) string {
+	return pushDeviceRegistryShardKeyForIndex(int(crc32.ChecksumIEEE([]byte(username)) % pushDeviceRegistryShardCount))
+}
+
+func pushDeviceRegistryShardKeyForIndex(shardIndex int) string {
+	return base.PushDeviceRegistryPrefix + strconv.Itoa(shardIndex)
+}
+
+// claimNotification sets the user's last notified time in the registry, unless the user has been notified within the
+// debounce interval (potentially by another node).  Returns false if the user shouldn't be notified.
+func (pn *pushNotifier) claimNotification(username string, now time.Time) (claimed bool, err error) {
+	err = updatePushDeviceRegistry(pn.bucket, username, func(registry *pushDeviceRegistry) bool {
+		lastNotified, ok := registry.Users[username]
+		if !ok || now.Sub(time.Unix(0, lastNotified)) < pn.debounceInterval {
+			return false
+		}
+		registry.Users[username] = now.UnixNano()
+		claimed = true
+		return true
+	})
+	return claimed, err
+}
+
+// updatePushDeviceRegistry applies updateFn to the registry shard holding the given user, with CAS handling.  When
+// updateFn returns false the write is cancelled.  Returns an error if the update would grow the shard beyond
+// maxPushDeviceRegistryShardBytes.
+func updatePushDeviceRegistry(bucket base.Bucket, username string, updateFn func(registry *pushDeviceRegistry) (updated bool)) error {
+	_, err := bucket.Update(pushDeviceRegistryShardKey(username), 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		registry := &pushDeviceRegistry{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, registry); err != nil {
+				return nil, nil, false, fmt.Errorf("unable to unmarshal push device registry: %w", err)
+			}
+		}
+		if registry.Users == nil {
+			registry.Users = map[string]int64{}
+		}
+		if !updateFn(registry) {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		if len(registry.Users) == 0 {
+			return nil, nil, true, nil
+		}
+		registryBytes, err := base.JSONMarshal(registry)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if len(registryBytes) > maxPushDeviceRegistryShardBytes && len(registryBytes) > len(current) {
+			return nil, nil, false, base.HTTPErrorf(http.StatusServiceUnavailable, "Push device registry is full")
+		}
+		return registryBytes, nil, false, nil
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	return err
+}
+
+// RegisterPushDevice registers a device to receive push notifications for the user.
+func (db *Database) RegisterPushDevice(user auth.User, device auth.PushDevice) error {
+	if err := db.Authenticator().RegisterPushDevice(user, device); err != nil {
+		return err
+	}
+	if db.pushNotifier != nil {
+		db.pushNotifier.invalidateUser(user.Name())
+	}
+	return updatePushDeviceRegistry(db.Bucket, user.Name(), func(registry *pushDeviceRegistry) bool {
+		if _, ok := registry.Users[user.Name()]; ok {
+			return false
+		}
+		registry.Users[user.Name()] = 0
+		return true
+	})
+}
+
+// UnregisterPushDevice removes the device with the given token from the user's push devices.  The user is removed
+// from the registry once their last device has been removed.
+func (db *Database) UnregisterPushDevice(user auth.User, token string) error {
+	if err := db.Authenticator().UnregisterPushDevice(user, token); err != nil {
+		return err
+	}
+	if db.pushNotifier != nil {
+		db.pushNotifier.invalidateUser(user.Name())
+	}
+	updatedUser, err := db.Authenticator().GetUser(user.Name())
+	if err != nil {
+		return err
+	}
+	if updatedUser != nil && len(updatedUser.PushDevices()) > 0 {
+		return nil
+	}
+	return updatePushDeviceRegistry(db.Bucket, user.Name(), func(registry *pushDeviceRegistry) bool {
+		if _, ok := registry.Users[user.Name()]; !ok {
+			return false
+		}
+		delete(registry.Users, user.Name())
+		return true
+	})
+}
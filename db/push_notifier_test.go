@@ -0,0 +1,198 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/channels"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushNotifications(t *testing.T) {
+
+	notifications := make(chan PushNotification, 10)
+	pushGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification PushNotification
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&notification))
+		notifications <- notification
+	}))
+	defer pushGateway.Close()
+
+	cacheOptions := DefaultCacheOptions()
+	db := setupTestDBWithOptions(t, DatabaseContextOptions{
+		CacheOptions:            &cacheOptions,
+		PushNotificationOptions: &PushNotificationOptions{GatewayURL: pushGateway.URL},
+	})
+	defer db.Close()
+	db.ChannelMapper = channels.NewDefaultChannelMapper()
+
+	authenticator := db.Authenticator()
+	for username, channelName := range map[string]string{"alice": "A", "bob": "B", "carol": "A"} {
+		user, err := authenticator.NewUser(username, "password", base.SetOf(channelName))
+		require.NoError(t, err)
+		require.NoError(t, authenticator.Save(user))
+		if username != "carol" {
+			require.NoError(t, db.RegisterPushDevice(user, auth.PushDevice{Token: username + "-token", Platform: auth.PushPlatformFCM}))
+		}
+	}
+
+	waitForNotification := func() PushNotification {
+		select {
+		case notification := <-notifications:
+			return notification
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "Timed out waiting for push notification")
+		}
+		return PushNotification{}
+	}
+
+	// Only users with registered devices and access to the changed channel are notified
+	_, _, err := db.Put("doc1", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+	notification := waitForNotification()
+	assert.Equal(t, "db", notification.Database)
+	assert.Equal(t, "alice", notification.Username)
+	assert.Equal(t, []string{"A"}, notification.Channels)
+	require.Len(t, notification.Devices, 1)
+	assert.Equal(t, "alice-token", notification.Devices[0].Token)
+
+	// Users with an active continuous replication aren't notified
+	db.pushNotifier.clientConnected("alice")
+	_, _, err = db.Put("doc2", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+	_, _, err = db.Put("doc3", Body{"channels": []string{"B"}})
+	require.NoError(t, err)
+	notification = waitForNotification()
+	assert.Equal(t, "bob", notification.Username)
+	assert.Equal(t, []string{"B"}, notification.Channels)
+
+	db.pushNotifier.clientDisconnected("alice")
+	_, _, err = db.Put("doc4", Body{"channels": []string{"A"}})
+	require.NoError(t, err)
+	notification = waitForNotification()
+	assert.Equal(t, "alice", notification.Username)
+
+	assert.Len(t, notifications, 0)
+	_, ok := base.WaitForStat(db.DbStats.Database().PushNotificationsSent.Value, 3)
+	assert.True(t, ok)
+
+	// Users are removed from the registry once their last device is unregistered
+	alice, err := authenticator.GetUser("alice")
+	require.NoError(t, err)
+	require.NoError(t, db.UnregisterPushDevice(alice, "alice-token"))
+	registry, err := db.pushNotifier.getRegistry()
+	require.NoError(t, err)
+	assert.NotContains(t, registry.Users, "alice")
+	assert.Contains(t, registry.Users, "bob")
+}
+
+func TestPushNotificationDebounce(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	pn := &pushNotifier{bucket: bucket, debounceInterval: time.Minute}
+	require.NoError(t, updatePushDeviceRegistry(bucket, "alice", func(registry *pushDeviceRegistry) bool {
+		registry.Users["alice"] = 0
+		return true
+	}))
+
+	now := time.Now()
+	claimed, err := pn.claimNotification("alice", now)
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// Notifications within the debounce interval aren't claimed, regardless of which node attempts the claim
+	claimed, err = pn.claimNotification("alice", now.Add(30*time.Second))
+	require.NoError(t, err)
+	assert.False(t, claimed)
+
+	claimed, err = pn.claimNotification("alice", now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, claimed)
+
+	// Users not in the registry are never notified
+	claimed, err = pn.claimNotification("bob", now)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+}
+
+func TestPushNotifierUserCache(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+	authenticator := auth.NewAuthenticator(bucket, nil, auth.DefaultAuthenticatorOptions())
+	pn := &pushNotifier{bucket: bucket, authenticator: authenticator, users: map[string]*cachedPushUser{}}
+
+	user, err := authenticator.NewUser("alice", "password", base.SetOf("A"))
+	require.NoError(t, err)
+	require.NoError(t, authenticator.Save(user))
+
+	// Users are loaded once per cache TTL, rather than for every batch
+	now := time.Now()
+	cached, err := pn.getUser("alice", now)
+	require.NoError(t, err)
+	require.NotNil(t, cached)
+	user.SetExplicitChannels(channels.AtSequence(base.SetOf("A", "B"), 2), 2)
+	require.NoError(t, authenticator.Save(user))
+	cached, err = pn.getUser("alice", now.Add(pushUserCacheTTL/2))
+	require.NoError(t, err)
+	assert.False(t, cached.CanSeeChannel("B"))
+	cached, err = pn.getUser("alice", now.Add(pushUserCacheTTL))
+	require.NoError(t, err)
+	assert.True(t, cached.CanSeeChannel("B"))
+
+	// Users that are no longer registered are removed from the cache
+	pn.pruneUsers(&pushDeviceRegistry{Users: map[string]int64{}})
+	assert.Empty(t, pn.users)
+}
+
+func TestPushDeviceRegistryShardSizeBound(t *testing.T) {
+	bucket := base.GetTestBucket(t)
+	defer bucket.Close()
+
+	// A shard at the size bound
+	users := map[string]int64{}
+	for i := 0; len(users)*50 < maxPushDeviceRegistryShardBytes; i++ {
+		users[fmt.Sprintf("user%026d", i)] = time.Now().UnixNano()
+	}
+	require.NoError(t, bucket.Set(pushDeviceRegistryShardKey("alice"), 0, pushDeviceRegistry{Users: users}))
+
+	// Users can't be added to a full shard, but can be removed
+	err := updatePushDeviceRegistry(bucket, "alice", func(registry *pushDeviceRegistry) bool {
+		registry.Users["alice"] = 0
+		return true
+	})
+	status, _ := base.ErrorAsHTTPStatus(err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	require.NoError(t, updatePushDeviceRegistry(bucket, "alice", func(registry *pushDeviceRegistry) bool {
+		delete(registry.Users, "user00000000000000000000000000")
+		return true
+	}))
+
+	// Users are spread across shards
+	pn := &pushNotifier{bucket: bucket}
+	require.NoError(t, updatePushDeviceRegistry(bucket, "bob", func(registry *pushDeviceRegistry) bool {
+		registry.Users["bob"] = 0
+		return true
+	}))
+	registry, err := pn.getRegistry()
+	require.NoError(t, err)
+	assert.Contains(t, registry.Users, "bob")
+	assert.Len(t, registry.Users, len(users))
+}
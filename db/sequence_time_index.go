@@ -0,0 +1,158 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	// DefaultSequenceTimeInterval is how often each node samples the current sequence for the sequence time
+	// index.
+	DefaultSequenceTimeInterval = time.Minute
+
+	// maxSequenceTimeCheckpoints bounds the size of the sequence time index.  When exceeded, every other checkpoint in
+	// the older half of the index is dropped, so recent history keeps full resolution while older history gets
+	// progressively coarser.
+	maxSequenceTimeCheckpoints = 4096
+
+	// sequenceTimeCheckpointMargin is added to the time a checkpoint is recorded, as sequences reserved by a node
+	// before the checkpoint may still be allocated to documents until they're released (see defaultReleaseSequenceWait).
+	sequenceTimeCheckpointMargin = 3 * time.Second
+)
+
+// sequenceTimeCheckpoint records the last allocated sequence at a point in time.  Any sequence allocated after Time is
+// greater than Seq.
+type sequenceTimeCheckpoint struct {
+	Time int64  `json:"t"` // Unix time in seconds
+	Seq  uint64 `json:"s"`
+}
+
+// sequenceTimeIndex is the persisted list of checkpoints used to translate times into sequences, in time order.
+type sequenceTimeIndex struct {
+	Checkpoints []sequenceTimeCheckpoint `json:"checkpoints"`
+}
+
+// add appends a checkpoint, unless one was recorded (potentially by another node) within minInterval or the sequence
+// hasn't changed since the last checkpoint.  Returns false if the checkpoint wasn't added.
+func (index *sequenceTimeIndex) add(checkpoint sequenceTimeCheckpoint, minInterval time.Duration) bool {
+	if n := len(index.Checkpoints); n > 0 {
+		last := index.Checkpoints[n-1]
+		if checkpoint.Seq <= last.Seq || time.Duration(checkpoint.Time-last.Time)*time.Second < minInterval {
+			return false
+		}
+	}
+	index.Checkpoints = append(index.Checkpoints, checkpoint)
+
+	if len(index.Checkpoints) > maxSequenceTimeCheckpoints {
+		older := index.Checkpoints[:len(index.Checkpoints)/2]
+		thinned := make([]sequenceTimeCheckpoint, 0, maxSequenceTimeCheckpoints)
+		for i := 0; i < len(older); i += 2 {
+			thinned = append(thinned, older[i])
+		}
+		index.Checkpoints = append(thinned, index.Checkpoints[len(older):]...)
+	}
+	return true
+}
+
+// sequenceAt returns the sequence of the latest checkpoint at or before t, or zero if there isn't one.
+func (index *sequenceTimeIndex) sequenceAt(t time.Time) uint64 {
+	unixTime := t.Unix()
+	i := sort.Search(len(index.Checkpoints), func(i int) bool {
+		return index.Checkpoints[i].Time > unixTime
+	})
+	if i == 0 {
+		return 0
+	}
+	return index.Checkpoints[i-1].Seq
+}
+
+func (context *DatabaseContext) getSequenceTimeIndex() (*sequenceTimeIndex, error) {
+	index := &sequenceTimeIndex{}
+	_, err := context.Bucket.Get(base.SeqTimeIndexKey, index)
+	if err != nil && !base.IsDocNotFoundError(err) {
+		return nil, err
+	}
+	return index, nil
+}
+
+// recordSequenceTimeCheckpoint adds the current sequence to the sequence time index.
+func (context *DatabaseContext) recordSequenceTimeCheckpoint(now time.Time) error {
+	seq, err := context.LastSequence()
+	if err != nil {
+		return err
+	}
+	checkpoint := sequenceTimeCheckpoint{Time: now.Add(sequenceTimeCheckpointMargin).Unix(), Seq: seq}
+
+	_, err = context.Bucket.Update(base.SeqTimeIndexKey, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		index := &sequenceTimeIndex{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, index); err != nil {
+				return nil, nil, false, fmt.Errorf("unable to unmarshal sequence time index: %w", err)
+			}
+		}
+		// Allow for nodes sampling at slightly different times, so only one checkpoint is recorded per interval
+		if !index.add(checkpoint, context.Options.SequenceTimeInterval/2) {
+			return nil, nil, false, base.ErrUpdateCancel
+		}
+		indexBytes, err := base.JSONMarshal(index)
+		return indexBytes, nil, false, err
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	return err
+}
+
+// startSequenceTimeIndex records a checkpoint now and then at every SequenceTimeInterval, until the database
+// is closed.
+func (dbContext *DatabaseContext) startSequenceTimeIndex() error {
+	if err := dbContext.recordSequenceTimeCheckpoint(time.Now()); err != nil {
+		base.Warnf("Unable to update sequence time index for database %s: %v", base.MD(dbContext.Name), err)
+	}
+	bgt, err := NewBackgroundTask("SequenceTimeIndex", dbContext.Name, func(ctx context.Context) error {
+		if err := dbContext.recordSequenceTimeCheckpoint(time.Now()); err != nil {
+			base.WarnfCtx(ctx, "Unable to update sequence time index: %v", err)
+		}
+		return nil
+	}, dbContext.Options.SequenceTimeInterval, dbContext.terminator)
+	if err != nil {
+		return err
+	}
+	dbContext.backgroundTasks = append(dbContext.backgroundTasks, bgt)
+	return nil
+}
+
+// SequenceIDForTime returns a sequence ID that can be used as a since value to get the changes made after t.  The
+// sequence time index is sampled, so the changes may also include some made up to SequenceTimeInterval
+// before t.
+func (context *DatabaseContext) SequenceIDForTime(t time.Time) (SequenceID, error) {
+	index, err := context.getSequenceTimeIndex()
+	if err != nil {
+		return SequenceID{}, err
+	}
+	return SequenceID{Seq: index.sequenceAt(t)}, nil
+}
+
+// ParseSinceTime parses an RFC 3339 since_time value, returning the corresponding since sequence ID.
+func (context *DatabaseContext) ParseSinceTime(sinceTime string) (SequenceID, error) {
+	t, err := time.Parse(time.RFC3339, sinceTime)
+	if err != nil {
+		return SequenceID{}, base.HTTPErrorf(http.StatusBadRequest, "Invalid since_time %q - must be an RFC 3339 timestamp", sinceTime)
+	}
+	return context.SequenceIDForTime(t)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSequenceTimeIndexAdd(t *testing.T) {
+	index := &sequenceTimeIndex{}
+	assert.True(t, index.add(sequenceTimeCheckpoint{Time: 100, Seq: 10}, time.Minute))
+
+	// Unchanged sequence or too soon after the last checkpoint
+	assert.False(t, index.add(sequenceTimeCheckpoint{Time: 200, Seq: 10}, time.Minute))
+	assert.False(t, index.add(sequenceTimeCheckpoint{Time: 130, Seq: 20}, time.Minute))
+	assert.True(t, index.add(sequenceTimeCheckpoint{Time: 160, Seq: 20}, time.Minute))
+	assert.Equal(t, []sequenceTimeCheckpoint{{Time: 100, Seq: 10}, {Time: 160, Seq: 20}}, index.Checkpoints)
+}
+
+func TestSequenceTimeIndexThinning(t *testing.T) {
+	index := &sequenceTimeIndex{}
+	for i := 1; i <= maxSequenceTimeCheckpoints+1; i++ {
+		require.True(t, index.add(sequenceTimeCheckpoint{Time: int64(i), Seq: uint64(i)}, 0))
+	}
+
+	// Every other checkpoint in the older half is dropped
+	older := (maxSequenceTimeCheckpoints + 1) / 2
+	require.Len(t, index.Checkpoints, maxSequenceTimeCheckpoints+1-older/2)
+	assert.Equal(t, uint64(1), index.Checkpoints[0].Seq)
+	assert.Equal(t, uint64(3), index.Checkpoints[1].Seq)
+	assert.Equal(t, uint64(maxSequenceTimeCheckpoints+1), index.Checkpoints[len(index.Checkpoints)-1].Seq)
+}
+
+func TestSequenceTimeIndexSequenceAt(t *testing.T) {
+	index := &sequenceTimeIndex{Checkpoints: []sequenceTimeCheckpoint{
+		{Time: 100, Seq: 10},
+		{Time: 200, Seq: 20},
+		{Time: 300, Seq: 30},
+	}}
+	assert.Equal(t, uint64(0), index.sequenceAt(time.Unix(99, 0)))
+	assert.Equal(t, uint64(10), index.sequenceAt(time.Unix(100, 0)))
+	assert.Equal(t, uint64(10), index.sequenceAt(time.Unix(199, 0)))
+	assert.Equal(t, uint64(20), index.sequenceAt(time.Unix(250, 0)))
+	assert.Equal(t, uint64(30), index.sequenceAt(time.Unix(1000, 0)))
+}
+
+func TestSequenceIDForTime(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	start := time.Now()
+	_, _, err := db.Put("doc1", Body{"foo": "bar"})
+	require.NoError(t, err)
+
+	// A checkpoint is only used for times after the margin has elapsed
+	require.NoError(t, db.recordSequenceTimeCheckpoint(start.Add(time.Hour)))
+	since, err := db.SequenceIDForTime(start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), since.Seq)
+	since, err = db.SequenceIDForTime(start.Add(time.Hour + sequenceTimeCheckpointMargin))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), since.Seq)
+
+	// Checkpoints within half an interval of the last are skipped
+	_, _, err = db.Put("doc2", Body{"foo": "bar"})
+	require.NoError(t, err)
+	require.NoError(t, db.recordSequenceTimeCheckpoint(start.Add(time.Hour+time.Second)))
+	index, err := db.getSequenceTimeIndex()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), index.Checkpoints[len(index.Checkpoints)-1].Seq)
+
+	since, err = db.ParseSinceTime(start.Add(2 * time.Hour).Format(time.RFC3339))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), since.Seq)
+
+	_, err = db.ParseSinceTime("yesterday")
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
+
+func TestSequenceTimeIndexRecordedAtStartup(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	var index sequenceTimeIndex
+	_, err := db.Bucket.Get(base.SeqTimeIndexKey, &index)
+	require.NoError(t, err)
+	assert.Len(t, index.Checkpoints, 1)
+}
@@ -53,9 +53,11 @@ const (
 	ConfigErrorDuplicateCredentials             = "Auth credentials can be specified using remote_username/remote_password config properties or remote URL, but not both"
 	ConfigErrorConfigBasedAdhoc                 = "adhoc=true is invalid for replication in Sync Gateway configuration"
 	ConfigErrorConfigBasedCancel                = "cancel=true is invalid for replication in Sync Gateway configuration"
-	ConfigErrorInvalidConflictResolutionTypeFmt = "Conflict resolution type is invalid, valid values are %s/%s/%s/%s"
+	ConfigErrorInvalidConflictResolutionTypeFmt = "Conflict resolution type is invalid, valid values are %s/%s/%s/%s/%s"
 	ConfigErrorInvalidDirectionFmt              = "Invalid replication direction %q, valid values are %s/%s/%s"
 	ConfigErrorBadChannelsArray                 = "Bad channels array in query_params for sync_gateway/bychannel filter"
+	ConfigErrorInvalidProtocolFmt               = "Invalid replication protocol %q, valid values are %s/%s"
+	ConfigErrorCouchDBProtocolUnsupportedFmt    = "%s is not supported for replications using protocol=%s"
 )
 
 // ClusterUpdateFunc is callback signature used when updating the cluster configuration
@@ -99,6 +101,7 @@ type ReplicationConfig struct {
 	Direction              ActiveReplicatorDirection `json:"direction"`
 	ConflictResolutionType ConflictResolverType      `json:"conflict_resolution_type,omitempty"`
 	ConflictResolutionFn   string                    `json:"custom_conflict_resolver,omitempty"`
+	MergePolicies          MergePolicies             `json:"merge_policies,omitempty"`
 	PurgeOnRemoval         bool                      `json:"purge_on_removal,omitempty"`
 	DeltaSyncEnabled       bool                      `json:"enable_delta_sync,omitempty"`
 	MaxBackoff             int                       `json:"max_backoff_time,omitempty"`
@@ -110,6 +113,7 @@ type ReplicationConfig struct {
 	Adhoc                  bool                      `json:"adhoc,omitempty"`
 	BatchSize              int                       `json:"batch_size,omitempty"`
 	RunAs                  string                    `json:"run_as,omitempty"`
+	Protocol               ReplicationProtocol       `json:"protocol,omitempty"`
 }
 
 func DefaultReplicationConfig() ReplicationConfig {
@@ -130,30 +134,34 @@ type ReplicationCfg struct {
 	ReplicationConfig
 	AssignedNode string `json:"assigned_node"`          // UUID of node assigned to this replication
 	TargetState  string `json:"target_state,omitempty"` // Target state for replication.
+	// RFC 3339 time to restart the replication from, when TargetState is resetting.  Resets to zero when empty
+	ResetSinceTime string `json:"reset_since_time,omitempty"`
 }
 
 // ReplicationUpsertConfig is used for operations that support upsert of a subset of replication properties.
 type ReplicationUpsertConfig struct {
-	ID                     string      `json:"replication_id"`
-	Remote                 *string     `json:"remote"`
-	Username               *string     `json:"username,omitempty"` // Deprecated
-	Password               *string     `json:"password,omitempty"` // Deprecated
-	RemoteUsername         *string     `json:"remote_username,omitempty"`
-	RemotePassword         *string     `json:"remote_password,omitempty"`
-	Direction              *string     `json:"direction"`
-	ConflictResolutionType *string     `json:"conflict_resolution_type,omitempty"`
-	ConflictResolutionFn   *string     `json:"custom_conflict_resolver,omitempty"`
-	PurgeOnRemoval         *bool       `json:"purge_on_removal,omitempty"`
-	DeltaSyncEnabled       *bool       `json:"enable_delta_sync,omitempty"`
-	MaxBackoff             *int        `json:"max_backoff_time,omitempty"`
-	InitialState           *string     `json:"initial_state,omitempty"`
-	Continuous             *bool       `json:"continuous"`
-	Filter                 *string     `json:"filter,omitempty"`
-	QueryParams            interface{} `json:"query_params,omitempty"`
-	Cancel                 *bool       `json:"cancel,omitempty"`
-	Adhoc                  *bool       `json:"adhoc,omitempty"`
-	BatchSize              *int        `json:"batch_size,omitempty"`
-	RunAs                  *string     `json:"run_as,omitempty"`
+	ID                     string        `json:"replication_id"`
+	Remote                 *string       `json:"remote"`
+	Username               *string       `json:"username,omitempty"` // Deprecated
+	Password               *string       `json:"password,omitempty"` // Deprecated
+	RemoteUsername         *string       `json:"remote_username,omitempty"`
+	RemotePassword         *string       `json:"remote_password,omitempty"`
+	Direction              *string       `json:"direction"`
+	ConflictResolutionType *string       `json:"conflict_resolution_type,omitempty"`
+	ConflictResolutionFn   *string       `json:"custom_conflict_resolver,omitempty"`
+	MergePolicies          MergePolicies `json:"merge_policies,omitempty"`
+	PurgeOnRemoval         *bool         `json:"purge_on_removal,omitempty"`
+	DeltaSyncEnabled       *bool         `json:"enable_delta_sync,omitempty"`
+	MaxBackoff             *int          `json:"max_backoff_time,omitempty"`
+	InitialState           *string       `json:"initial_state,omitempty"`
+	Continuous             *bool         `json:"continuous"`
+	Filter                 *string       `json:"filter,omitempty"`
+	QueryParams            interface{}   `json:"query_params,omitempty"`
+	Cancel                 *bool         `json:"cancel,omitempty"`
+	Adhoc                  *bool         `json:"adhoc,omitempty"`
+	BatchSize              *int          `json:"batch_size,omitempty"`
+	RunAs                  *string       `json:"run_as,omitempty"`
+	Protocol               *string       `json:"protocol,omitempty"`
 }
 
 func (rc *ReplicationConfig) ValidateReplication(fromConfig bool) (err error) {
@@ -200,13 +208,22 @@ func (rc *ReplicationConfig) ValidateReplication(fromConfig bool) (err error) {
 
 	if !rc.ConflictResolutionType.IsValid() && rc.ConflictResolutionType != "" {
 		return base.HTTPErrorf(http.StatusBadRequest, ConfigErrorInvalidConflictResolutionTypeFmt,
-			ConflictResolverLocalWins, ConflictResolverRemoteWins, ConflictResolverDefault, ConflictResolverCustom)
+			ConflictResolverLocalWins, ConflictResolverRemoteWins, ConflictResolverDefault, ConflictResolverCustom, ConflictResolverMerge)
 	}
 
 	if rc.ConflictResolutionType == ConflictResolverCustom && rc.ConflictResolutionFn == "" {
 		return base.HTTPErrorf(http.StatusBadRequest, "Custom conflict resolution type has been set but no conflict resolution function has been defined")
 	}
 
+	if len(rc.MergePolicies) > 0 {
+		if rc.ConflictResolutionType != ConflictResolverMerge {
+			return base.HTTPErrorf(http.StatusBadRequest, "merge_policies can only be set when conflict_resolution_type is %s", ConflictResolverMerge)
+		}
+		if err := rc.MergePolicies.Validate(); err != nil {
+			return err
+		}
+	}
+
 	remoteURL, err := url.Parse(rc.Remote)
 	if err != nil {
 		return base.HTTPErrorf(http.StatusBadRequest, "Replication remote URL is invalid")
@@ -244,6 +261,20 @@ func (rc *ReplicationConfig) ValidateReplication(fromConfig bool) (err error) {
 	} else if rc.Filter != "" {
 		return base.HTTPErrorf(http.StatusBadRequest, ConfigErrorUnknownFilter)
 	}
+
+	if !rc.Protocol.IsValid() {
+		return base.HTTPErrorf(http.StatusBadRequest, ConfigErrorInvalidProtocolFmt,
+			rc.Protocol, ReplicationProtocolBLIP, ReplicationProtocolCouchDB)
+	}
+
+	if rc.Protocol == ReplicationProtocolCouchDB {
+		if rc.PurgeOnRemoval {
+			return base.HTTPErrorf(http.StatusBadRequest, ConfigErrorCouchDBProtocolUnsupportedFmt, "purge_on_removal", ReplicationProtocolCouchDB)
+		}
+		if rc.DeltaSyncEnabled {
+			return base.HTTPErrorf(http.StatusBadRequest, ConfigErrorCouchDBProtocolUnsupportedFmt, "enable_delta_sync", ReplicationProtocolCouchDB)
+		}
+	}
 	return nil
 }
 
@@ -281,6 +312,9 @@ func (rc *ReplicationConfig) Upsert(c *ReplicationUpsertConfig) {
 	if c.ConflictResolutionFn != nil {
 		rc.ConflictResolutionFn = *c.ConflictResolutionFn
 	}
+	if c.MergePolicies != nil {
+		rc.MergePolicies = c.MergePolicies
+	}
 	if c.PurgeOnRemoval != nil {
 		rc.PurgeOnRemoval = *c.PurgeOnRemoval
 	}
@@ -318,6 +352,10 @@ func (rc *ReplicationConfig) Upsert(c *ReplicationUpsertConfig) {
 		rc.RunAs = *c.RunAs
 	}
 
+	if c.Protocol != nil {
+		rc.Protocol = ReplicationProtocol(*c.Protocol)
+	}
+
 	if c.QueryParams != nil {
 		// QueryParams can be either []interface{} or map[string]interface{}, so requires type-specific copying
 		// avoid later mutating c.QueryParams
@@ -388,7 +426,7 @@ type sgReplicateManager struct {
 //     stopped -> resetting
 //     resetting -> stopped
 //     running -> stopped
-func (ar *ActiveReplicator) alignState(targetState string) error {
+func (ar *ActiveReplicator) alignState(targetState string, resetSinceTime string) error {
 	if ar == nil {
 		return nil
 	}
@@ -420,7 +458,7 @@ func (ar *ActiveReplicator) alignState(targetState string) error {
 			return fmt.Errorf("Replication must be stopped before it can be reset")
 		}
 		base.Infof(base.KeyReplicate, "Resetting replication %s - previous state %s", ar.ID, currentState)
-		resetErr := ar.Reset()
+		resetErr := ar.ResetSince(resetSinceTime)
 		if resetErr != nil {
 			return fmt.Errorf("Unable to reset active replicator for replication %s: %v", ar.ID, resetErr)
 		}
@@ -526,6 +564,7 @@ func (m *sgReplicateManager) NewActiveReplicatorConfig(config *ReplicationCfg) (
 		InsecureSkipVerify: insecureSkipVerify,
 		CheckpointInterval: m.CheckpointInterval,
 		RunAs:              config.RunAs,
+		Protocol:           config.Protocol,
 	}
 
 	rc.MaxReconnectInterval = defaultMaxReconnectInterval
@@ -557,11 +596,12 @@ func (m *sgReplicateManager) NewActiveReplicatorConfig(config *ReplicationCfg) (
 	// Set conflict resolver for pull replications
 	if rc.Direction == ActiveReplicatorTypePull || rc.Direction == ActiveReplicatorTypePushAndPull {
 		if config.ConflictResolutionType == "" {
-			rc.ConflictResolverFunc, err = NewConflictResolverFunc(ConflictResolverDefault, "")
+			rc.ConflictResolverFunc, err = NewConflictResolverFunc(ConflictResolverDefault, "", nil)
 
 		} else {
-			rc.ConflictResolverFunc, err = NewConflictResolverFunc(config.ConflictResolutionType, config.ConflictResolutionFn)
+			rc.ConflictResolverFunc, err = NewConflictResolverFunc(config.ConflictResolutionType, config.ConflictResolutionFn, config.MergePolicies)
 			rc.ConflictResolverFuncSrc = config.ConflictResolutionFn
+			rc.MergePolicies = config.MergePolicies
 		}
 		if err != nil {
 			return nil, err
@@ -720,7 +760,7 @@ func (m *sgReplicateManager) RefreshReplicationCfg() error {
 				}
 			}
 
-			stateErr := activeReplicator.alignState(replicationCfg.TargetState)
+			stateErr := activeReplicator.alignState(replicationCfg.TargetState, replicationCfg.ResetSinceTime)
 			if stateErr != nil {
 				base.Warnf("Error updating active replication %s to state %s: %v", replicationID, replicationCfg.TargetState, stateErr)
 			}
@@ -1031,6 +1071,12 @@ func (m *sgReplicateManager) UpsertReplication(replication *ReplicationUpsertCon
 }
 
 func (m *sgReplicateManager) UpdateReplicationState(replicationID string, state string) error {
+	return m.updateReplicationState(replicationID, state, "")
+}
+
+// updateReplicationState sets the target state for the replication, along with the time to reset it to when the
+// target state is resetting.
+func (m *sgReplicateManager) updateReplicationState(replicationID string, state string, resetSinceTime string) error {
 
 	updateReplicationStatusCallback := func(cluster *SGRCluster) (cancel bool, err error) {
 		replicationCfg, exists := cluster.Replications[replicationID]
@@ -1050,6 +1096,7 @@ func (m *sgReplicateManager) UpdateReplicationState(replicationID string, state
 		}
 
 		cluster.Replications[replicationID].TargetState = state
+		cluster.Replications[replicationID].ResetSinceTime = resetSinceTime
 		cluster.RebalanceReplications()
 		return false, nil
 	}
@@ -1344,7 +1391,20 @@ func (m *sgReplicateManager) PutReplicationStatus(replicationID, action string)
 		return nil, base.HTTPErrorf(http.StatusBadRequest, "Unrecognized action %q.  Valid values are start/stop/reset.", action)
 	}
 
-	err = m.UpdateReplicationState(replicationID, targetState)
+	return m.putReplicationStatus(replicationID, targetState, "")
+}
+
+// ResetReplicationSince resets a stopped replication to restart from the changes made since the given RFC 3339 time,
+// rather than from zero.
+func (m *sgReplicateManager) ResetReplicationSince(replicationID, sinceTime string) (status *ReplicationStatus, err error) {
+	if _, err := time.Parse(time.RFC3339, sinceTime); err != nil {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "Invalid since_time %q - must be an RFC 3339 timestamp", sinceTime)
+	}
+	return m.putReplicationStatus(replicationID, ReplicationStateResetting, sinceTime)
+}
+
+func (m *sgReplicateManager) putReplicationStatus(replicationID, targetState, resetSinceTime string) (status *ReplicationStatus, err error) {
+	err = m.updateReplicationState(replicationID, targetState, resetSinceTime)
 	if err != nil {
 		return nil, err
 	}
@@ -1392,6 +1452,68 @@ func (m *sgReplicateManager) GetReplicationStatusAll(options ReplicationStatusOp
 	return statuses, nil
 }
 
+// deadLetterQueue returns the dead letter queue for the given replication.  When the replication is running on this
+// node, the push replicator is also returned.
+func (m *sgReplicateManager) deadLetterQueue(replicationID string) (*deadLetterQueue, *ActivePushReplicator, error) {
+	if _, err := m.GetReplication(replicationID); err != nil {
+		return nil, nil, err
+	}
+
+	m.activeReplicatorsLock.RLock()
+	replicator, isLocal := m.activeReplicators[replicationID]
+	m.activeReplicatorsLock.RUnlock()
+	if isLocal && replicator.Push != nil {
+		return replicator.Push.deadLetters, replicator.Push, nil
+	}
+
+	checkpointPrefix := ""
+	if m.dbContext.Options.GroupID != "" {
+		checkpointPrefix = m.dbContext.Options.GroupID + ":"
+	}
+	return newDeadLetterQueue(m.dbContext.Bucket, deadLetterQueueKey(checkpointPrefix, replicationID), nil), nil, nil
+}
+
+// GetDeadLetters returns the revisions rejected by the remote for the given replication.
+func (m *sgReplicateManager) GetDeadLetters(replicationID string) ([]*DeadLetterEntry, error) {
+	queue, _, err := m.deadLetterQueue(replicationID)
+	if err != nil {
+		return nil, err
+	}
+	return queue.list()
+}
+
+// GetDeadLetter returns the dead letter entry for a single document in the given replication.
+func (m *sgReplicateManager) GetDeadLetter(replicationID, docID string) (*DeadLetterEntry, error) {
+	queue, _, err := m.deadLetterQueue(replicationID)
+	if err != nil {
+		return nil, err
+	}
+	return queue.get(docID)
+}
+
+// RetryDeadLetters re-sends the given documents (or all documents when none are specified) from the replication's
+// dead letter queue.  The replication must be running on this node.
+func (m *sgReplicateManager) RetryDeadLetters(replicationID string, docIDs ...string) (retried int, err error) {
+	_, pushReplicator, err := m.deadLetterQueue(replicationID)
+	if err != nil {
+		return 0, err
+	}
+	if pushReplicator == nil {
+		return 0, base.HTTPErrorf(http.StatusServiceUnavailable, "Push replication %s is not running on this node", replicationID)
+	}
+	return pushReplicator.retryDeadLetters(docIDs...)
+}
+
+// DiscardDeadLetters removes the given documents (or all documents when none are specified) from the replication's
+// dead letter queue, without re-sending them.
+func (m *sgReplicateManager) DiscardDeadLetters(replicationID string, docIDs ...string) (discarded int, err error) {
+	queue, _, err := m.deadLetterQueue(replicationID)
+	if err != nil {
+		return 0, err
+	}
+	return queue.remove(docIDs...)
+}
+
 // ImportHeartbeatListener uses replication cfg to manage node list
 type ReplicationHeartbeatListener struct {
 	mgr        *sgReplicateManager
@@ -26,11 +26,12 @@ const (
 	ConflictResolverRemoteWins ConflictResolverType = "remoteWins"
 	ConflictResolverDefault    ConflictResolverType = "default"
 	ConflictResolverCustom     ConflictResolverType = "custom"
+	ConflictResolverMerge      ConflictResolverType = "merge"
 )
 
 func (d ConflictResolverType) IsValid() bool {
 	switch d {
-	case ConflictResolverLocalWins, ConflictResolverRemoteWins, ConflictResolverDefault, ConflictResolverCustom:
+	case ConflictResolverLocalWins, ConflictResolverRemoteWins, ConflictResolverDefault, ConflictResolverCustom, ConflictResolverMerge:
 		return true
 	default:
 		return false
@@ -49,10 +50,13 @@ const (
 
 // Conflict is the input to all conflict resolvers.  LocalDocument and RemoteDocument
 // are expected to be document bodies with metadata injected into the body following
-// the same approach used for doc and oldDoc in the Sync Function
+// the same approach used for doc and oldDoc in the Sync Function.  AncestorDocument is the body of the most recent
+// available common ancestor of the two, and is only populated for resolvers that require it (see
+// ConflictResolver.includeAncestor).  It may be nil if no ancestor body is available.
 type Conflict struct {
-	LocalDocument  Body `json:"LocalDocument"`
-	RemoteDocument Body `json:"RemoteDocument"`
+	LocalDocument    Body `json:"LocalDocument"`
+	RemoteDocument   Body `json:"RemoteDocument"`
+	AncestorDocument Body `json:"AncestorDocument,omitempty"`
 }
 
 // Definition of the ConflictResolverFunc API.  Winner may be one of
@@ -90,9 +94,22 @@ func NewConflictResolverStats(container *base.DbReplicatorStats) *ConflictResolv
 	}
 }
 
+// NewClientConflictResolverStats returns a ConflictResolverStats backed by the database's CBL push replication stats.
+func NewClientConflictResolverStats(container *base.CBLReplicationPushStats) *ConflictResolverStats {
+	if container == nil {
+		return DefaultConflictResolverStats()
+	}
+	return &ConflictResolverStats{
+		ConflictResultMergeCount:  container.ConflictResolvedMergedCount,
+		ConflictResultLocalCount:  container.ConflictResolvedLocalCount,
+		ConflictResultRemoteCount: container.ConflictResolvedRemoteCount,
+	}
+}
+
 type ConflictResolver struct {
-	crf   ConflictResolverFunc
-	stats *ConflictResolverStats
+	crf             ConflictResolverFunc
+	stats           *ConflictResolverStats
+	includeAncestor bool // When true, Conflict.AncestorDocument is populated before invoking crf
 }
 
 func NewConflictResolver(crf ConflictResolverFunc, statsContainer *base.DbReplicatorStats) *ConflictResolver {
@@ -103,6 +120,24 @@ func NewConflictResolver(crf ConflictResolverFunc, statsContainer *base.DbReplic
 	return resolver
 }
 
+// NewClientConflictResolver returns the ConflictResolver to be used for revisions pushed by CBL clients, based on the
+// database's ClientConflictResolution options.  Returns nil if client conflict resolution isn't enabled.
+func NewClientConflictResolver(dbc *DatabaseContext) *ConflictResolver {
+	options := dbc.Options.ClientConflictResolution
+	if options == nil || options.ResolverFunc == nil {
+		return nil
+	}
+	var statsContainer *base.CBLReplicationPushStats
+	if dbc.DbStats != nil {
+		statsContainer = dbc.DbStats.CBLReplicationPush()
+	}
+	return &ConflictResolver{
+		crf:             options.ResolverFunc,
+		stats:           NewClientConflictResolverStats(statsContainer),
+		includeAncestor: options.ResolverType == ConflictResolverMerge,
+	}
+}
+
 // Wrapper for ConflictResolverFunc that evaluates whether conflict resolution resulted in
 // localWins, remoteWins, or merge
 func (c *ConflictResolver) Resolve(conflict Conflict) (winner Body, resolutionType ConflictResolutionType, err error) {
@@ -168,7 +203,7 @@ func RemoteWinsConflictResolver(conflict Conflict) (winner Body, err error) {
 	return conflict.RemoteDocument, nil
 }
 
-func NewConflictResolverFunc(resolverType ConflictResolverType, customResolverSource string) (ConflictResolverFunc, error) {
+func NewConflictResolverFunc(resolverType ConflictResolverType, customResolverSource string, mergePolicies MergePolicies) (ConflictResolverFunc, error) {
 	switch resolverType {
 	case ConflictResolverLocalWins:
 		return LocalWinsConflictResolver, nil
@@ -178,6 +213,8 @@ func NewConflictResolverFunc(resolverType ConflictResolverType, customResolverSo
 		return DefaultConflictResolver, nil
 	case ConflictResolverCustom:
 		return NewCustomConflictResolver(customResolverSource)
+	case ConflictResolverMerge:
+		return NewMergeConflictResolver(mergePolicies), nil
 	default:
 		return nil, fmt.Errorf("Unknown Conflict Resolver type: %s", resolverType)
 	}
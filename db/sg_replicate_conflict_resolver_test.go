@@ -11,6 +11,7 @@ licenses/APL2.txt.
 package db
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -170,3 +171,128 @@ func TestCustomConflictResolver(t *testing.T) {
 		})
 	}
 }
+
+func TestMergeConflictResolver(t *testing.T) {
+
+	policies := MergePolicies{
+		"tags":        {Type: MergePolicyUnion},
+		"count":       {Type: MergePolicyMax},
+		"status":      {Type: MergePolicyLatestTimestampWins, TimestampProperty: "meta.updated"},
+		"address.zip": {Type: MergePolicyMax},
+	}
+
+	mergeConflictResolverTests := []struct {
+		name             string
+		ancestorDocument Body
+		localDocument    Body
+		remoteDocument   Body
+		expectedWinner   Body
+	}{
+		{
+			name:             "nonOverlapping",
+			ancestorDocument: Body{"_rev": "1-abc", "a": 1, "b": 1},
+			localDocument:    Body{"_rev": "2-abc", "a": 2, "b": 1},
+			remoteDocument:   Body{"_rev": "2-def", "a": 1, "b": 2, "c": 3},
+			expectedWinner:   Body{"a": 2, "b": 2, "c": 3},
+		},
+		{
+			name:             "removedProperty",
+			ancestorDocument: Body{"_rev": "1-abc", "a": 1, "b": 1},
+			localDocument:    Body{"_rev": "2-abc", "b": 1},
+			remoteDocument:   Body{"_rev": "2-def", "a": 1, "b": 2},
+			expectedWinner:   Body{"b": 2},
+		},
+		{
+			name:             "nested",
+			ancestorDocument: Body{"_rev": "1-abc", "address": map[string]interface{}{"city": "a", "zip": "1"}},
+			localDocument:    Body{"_rev": "2-abc", "address": map[string]interface{}{"city": "b", "zip": "1"}},
+			remoteDocument:   Body{"_rev": "2-def", "address": map[string]interface{}{"city": "a", "zip": "2"}},
+			expectedWinner:   Body{"address": map[string]interface{}{"city": "b", "zip": "2"}},
+		},
+		{
+			name:             "nestedCollisionPolicy",
+			ancestorDocument: Body{"_rev": "1-abc", "address": map[string]interface{}{"zip": "1"}},
+			localDocument:    Body{"_rev": "2-abc", "address": map[string]interface{}{"zip": "3"}},
+			remoteDocument:   Body{"_rev": "2-def", "address": map[string]interface{}{"zip": "2", "city": "a"}},
+			expectedWinner:   Body{"address": map[string]interface{}{"zip": "3", "city": "a"}},
+		},
+		{
+			name:             "max",
+			ancestorDocument: Body{"_rev": "1-abc", "count": 1, "a": 1, "b": 1},
+			localDocument:    Body{"_rev": "2-abc", "count": json.Number("5"), "a": 1, "b": 2},
+			remoteDocument:   Body{"_rev": "2-def", "count": json.Number("10"), "a": 2, "b": 1},
+			expectedWinner:   Body{"count": json.Number("10"), "a": 2, "b": 2},
+		},
+		{
+			name:             "union",
+			ancestorDocument: Body{"_rev": "1-abc", "tags": []interface{}{"x", "y"}},
+			localDocument:    Body{"_rev": "2-abc", "tags": []interface{}{"x", "y", "l"}},
+			remoteDocument:   Body{"_rev": "2-def", "tags": []interface{}{"x", "r"}},
+			expectedWinner:   Body{"tags": []interface{}{"x", "l", "r"}},
+		},
+		{
+			name:             "latestTimestampWins",
+			ancestorDocument: Body{"_rev": "1-abc", "status": "new", "meta": map[string]interface{}{"updated": "2022-01-01T00:00:00Z"}},
+			localDocument:    Body{"_rev": "2-def", "status": "closed", "meta": map[string]interface{}{"updated": "2022-01-03T00:00:00Z"}},
+			remoteDocument:   Body{"_rev": "2-abc", "status": "open", "c": 1, "meta": map[string]interface{}{"updated": "2022-01-02T00:00:00Z"}},
+			expectedWinner:   Body{"status": "closed", "c": 1, "meta": map[string]interface{}{"updated": "2022-01-03T00:00:00Z"}},
+		},
+		{
+			name:             "collisionWithoutPolicy",
+			ancestorDocument: Body{"_rev": "1-abc", "a": 1, "b": 1},
+			localDocument:    Body{"_rev": "2-abc", "a": 2, "b": 2},
+			remoteDocument:   Body{"_rev": "2-def", "a": 3, "b": 1},
+			expectedWinner:   Body{"a": 3, "b": 2},
+		},
+		{
+			name:             "noAncestor",
+			ancestorDocument: nil,
+			localDocument:    Body{"_rev": "2-abc", "a": 1, "b": 1},
+			remoteDocument:   Body{"_rev": "2-def", "a": 1, "c": 1},
+			expectedWinner:   Body{"a": 1, "b": 1, "c": 1},
+		},
+		{
+			name:             "matchesLocal",
+			ancestorDocument: Body{"_rev": "1-abc", "a": 1},
+			localDocument:    Body{"_rev": "2-abc", "a": 2},
+			remoteDocument:   Body{"_rev": "2-def", "a": 1},
+			expectedWinner:   Body{"_rev": "2-abc", "a": 2},
+		},
+		{
+			name:             "deleted",
+			ancestorDocument: Body{"_rev": "1-abc", "a": 1},
+			localDocument:    Body{"_rev": "2-abc", "_deleted": true},
+			remoteDocument:   Body{"_rev": "2-def", "a": 2},
+			expectedWinner:   Body{"_rev": "2-abc", "_deleted": true},
+		},
+		{
+			name:             "attachments",
+			ancestorDocument: Body{"_rev": "1-abc", "_attachments": map[string]interface{}{"a": map[string]interface{}{"digest": "sha1-a", "revpos": 1}}},
+			localDocument:    Body{"_rev": "2-abc", "_attachments": AttachmentsMeta{"a": map[string]interface{}{"digest": "sha1-a", "revpos": 1}, "l": map[string]interface{}{"digest": "sha1-l", "revpos": 2}}},
+			remoteDocument:   Body{"_rev": "3-def", "_attachments": AttachmentsMeta{"r": map[string]interface{}{"digest": "sha1-r", "revpos": 3}}},
+			expectedWinner:   Body{"_attachments": map[string]interface{}{"l": map[string]interface{}{"digest": "sha1-l", "revpos": 4}, "r": map[string]interface{}{"digest": "sha1-r", "revpos": 3}}},
+		},
+	}
+
+	for _, test := range mergeConflictResolverTests {
+		t.Run(test.name, func(t *testing.T) {
+			conflict := Conflict{
+				LocalDocument:    test.localDocument,
+				RemoteDocument:   test.remoteDocument,
+				AncestorDocument: test.ancestorDocument,
+			}
+			mergeConflictResolverFunc, err := NewConflictResolverFunc(ConflictResolverMerge, "", policies)
+			require.NoError(t, err)
+			result, err := mergeConflictResolverFunc(conflict)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedWinner, result)
+		})
+	}
+}
+
+func TestMergePoliciesValidate(t *testing.T) {
+	assert.NoError(t, MergePolicies{"a.b": {Type: MergePolicyMax}}.Validate())
+	assert.Error(t, MergePolicies{"a": {Type: "min"}}.Validate())
+	assert.Error(t, MergePolicies{"_id": {Type: MergePolicyMax}}.Validate())
+	assert.Error(t, MergePolicies{"a": {Type: MergePolicyLatestTimestampWins}}.Validate())
+}
@@ -0,0 +1,409 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// MergePolicyType identifies how a property modified on both sides of a conflict is resolved by the merge
+// conflict resolver.
+type MergePolicyType string
+
+const (
+	MergePolicyLatestTimestampWins MergePolicyType = "latestTimestampWins" // Value from the document with the later timestamp_property wins
+	MergePolicyMax                 MergePolicyType = "max"                 // Greater of the two numeric or string values wins
+	MergePolicyUnion               MergePolicyType = "union"               // Arrays are combined, retaining removals made on either side
+)
+
+func (p MergePolicyType) IsValid() bool {
+	switch p {
+	case MergePolicyLatestTimestampWins, MergePolicyMax, MergePolicyUnion:
+		return true
+	default:
+		return false
+	}
+}
+
+// MergePolicy defines the handling for a single property path when both local and remote have modified it.
+type MergePolicy struct {
+	Type MergePolicyType `json:"type"`
+	// TimestampProperty is the dot-separated path of the document property holding the modification time, used by
+	// latestTimestampWins.  Values may be RFC3339 strings or numeric unix timestamps.
+	TimestampProperty string `json:"timestamp_property,omitempty"`
+}
+
+// MergePolicies maps dot-separated property paths (e.g. "address.city") to the policy used to resolve collisions
+// on that property.
+type MergePolicies map[string]MergePolicy
+
+func (mp MergePolicies) Validate() error {
+	for path, policy := range mp {
+		if path == "" || strings.HasPrefix(path, "_") {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid merge policy path %q", path)
+		}
+		if !policy.Type.IsValid() {
+			return base.HTTPErrorf(http.StatusBadRequest, "Invalid merge policy type %q for path %q, valid values are %s/%s/%s",
+				policy.Type, path, MergePolicyLatestTimestampWins, MergePolicyMax, MergePolicyUnion)
+		}
+		if policy.Type == MergePolicyLatestTimestampWins && policy.TimestampProperty == "" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Merge policy %s for path %q requires timestamp_property", policy.Type, path)
+		}
+	}
+	return nil
+}
+
+// NewMergeConflictResolver returns a ConflictResolverFunc that performs a three-way merge of the local and remote
+// documents against conflict.AncestorDocument.  Properties modified on only one side are combined into the result,
+// and properties modified on both sides are resolved using the policy configured for that path.  When no policy
+// applies (or the policy can't be applied to the values), the value from the revision DefaultConflictResolver would
+// pick is used.
+//   - Tombstones aren't merged - when either side is deleted, the result of DefaultConflictResolver is returned.
+//   - If no ancestor body is available, the merge is performed as if the ancestor was an empty document.
+//   - If the merged body matches the local or remote body, that document is returned unmodified.
+func NewMergeConflictResolver(policies MergePolicies) ConflictResolverFunc {
+	return func(conflict Conflict) (Body, error) {
+		localDeleted, _ := conflict.LocalDocument[BodyDeleted].(bool)
+		remoteDeleted, _ := conflict.RemoteDocument[BodyDeleted].(bool)
+		if localDeleted || remoteDeleted {
+			return DefaultConflictResolver(conflict)
+		}
+
+		defaultWinner, _ := DefaultConflictResolver(conflict)
+		localRevID, _ := conflict.LocalDocument[BodyRev].(string)
+		winner, _ := defaultWinner[BodyRev].(string)
+
+		m := &bodyMerger{
+			policies:  policies,
+			local:     conflict.LocalDocument,
+			remote:    conflict.RemoteDocument,
+			localWins: winner == localRevID,
+		}
+
+		local, _ := stripAllSpecialProperties(conflict.LocalDocument)
+		remote, _ := stripAllSpecialProperties(conflict.RemoteDocument)
+		ancestor, _ := stripAllSpecialProperties(conflict.AncestorDocument)
+		merged := Body(m.mergeObjects("", ancestor, local, remote))
+
+		remoteRevID, _ := conflict.RemoteDocument[BodyRev].(string)
+		mergedAtts := m.mergeAttachments(conflict.AncestorDocument[BodyAttachments], conflict.LocalDocument[BodyAttachments], conflict.RemoteDocument[BodyAttachments], remoteRevID)
+
+		localAtts := toAttachmentsMap(conflict.LocalDocument[BodyAttachments])
+		remoteAtts := toAttachmentsMap(conflict.RemoteDocument[BodyAttachments])
+		if reflect.DeepEqual(merged, local) && attachmentDigestsEqual(mergedAtts, localAtts) {
+			return conflict.LocalDocument, nil
+		}
+		if reflect.DeepEqual(merged, remote) && attachmentDigestsEqual(mergedAtts, remoteAtts) {
+			return conflict.RemoteDocument, nil
+		}
+
+		if len(mergedAtts) > 0 {
+			merged[BodyAttachments] = mergedAtts
+		}
+		return merged, nil
+	}
+}
+
+// bodyMerger holds the state for a single merge conflict resolution.
+type bodyMerger struct {
+	policies  MergePolicies
+	local     Body // Full local document, used to look up timestamp properties
+	remote    Body // Full remote document, used to look up timestamp properties
+	localWins bool // Whether the local revision is the winner according to DefaultConflictResolver
+}
+
+// mergeObjects performs a three-way merge of the properties of local and remote.  ancestor may be nil.
+func (m *bodyMerger) mergeObjects(path string, ancestor, local, remote map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(local))
+	keys := make(map[string]struct{}, len(local)+len(remote))
+	for k := range local {
+		keys[k] = struct{}{}
+	}
+	for k := range remote {
+		keys[k] = struct{}{}
+	}
+
+	for k := range keys {
+		propertyPath := k
+		if path != "" {
+			propertyPath = path + "." + k
+		}
+		ancestorVal, ancestorOk := ancestor[k]
+		localVal, localOk := local[k]
+		remoteVal, remoteOk := remote[k]
+
+		localChanged := localOk != ancestorOk || !reflect.DeepEqual(localVal, ancestorVal)
+		remoteChanged := remoteOk != ancestorOk || !reflect.DeepEqual(remoteVal, ancestorVal)
+
+		var value interface{}
+		var ok bool
+		switch {
+		case !localChanged:
+			value, ok = remoteVal, remoteOk
+		case !remoteChanged:
+			value, ok = localVal, localOk
+		case localOk == remoteOk && reflect.DeepEqual(localVal, remoteVal):
+			value, ok = localVal, localOk
+		default:
+			value, ok = m.resolveCollision(propertyPath, ancestorVal, localVal, localOk, remoteVal, remoteOk)
+		}
+		if ok {
+			result[k] = value
+		}
+	}
+	return result
+}
+
+// resolveCollision resolves a property that has been modified on both sides.  Nested objects without an explicit
+// policy are merged recursively.  Returns ok=false when the property should be removed from the result.
+func (m *bodyMerger) resolveCollision(path string, ancestorVal, localVal interface{}, localOk bool, remoteVal interface{}, remoteOk bool) (value interface{}, ok bool) {
+	policy, hasPolicy := m.policies[path]
+	if localOk && remoteOk {
+		if !hasPolicy {
+			localMap, localIsMap := localVal.(map[string]interface{})
+			remoteMap, remoteIsMap := remoteVal.(map[string]interface{})
+			if localIsMap && remoteIsMap {
+				ancestorMap, _ := ancestorVal.(map[string]interface{})
+				return m.mergeObjects(path, ancestorMap, localMap, remoteMap), true
+			}
+		}
+
+		switch policy.Type {
+		case MergePolicyMax:
+			if result, ok := maxValue(localVal, remoteVal); ok {
+				return result, true
+			}
+		case MergePolicyUnion:
+			if result, ok := unionArrays(ancestorVal, localVal, remoteVal); ok {
+				return result, true
+			}
+		case MergePolicyLatestTimestampWins:
+			localTime, localTimeOk := getTimestampProperty(m.local, policy.TimestampProperty)
+			remoteTime, remoteTimeOk := getTimestampProperty(m.remote, policy.TimestampProperty)
+			if localTimeOk && remoteTimeOk && !localTime.Equal(remoteTime) {
+				if localTime.After(remoteTime) {
+					return localVal, true
+				}
+				return remoteVal, true
+			}
+		}
+	}
+
+	if hasPolicy {
+		base.Debugf(base.KeyReplicate, "Merge policy %s not applicable to property %s, using default winner", policy.Type, base.UD(path))
+	}
+	if m.localWins {
+		return localVal, localOk
+	}
+	return remoteVal, remoteOk
+}
+
+// mergeAttachments merges the attachment metadata of local and remote by attachment name, comparing by digest.
+// Attachments taken from the local side that aren't present on the remote revision have their revpos set to the
+// generation of the merged revision, as the merged revision is added as a child of the remote revision.
+func (m *bodyMerger) mergeAttachments(ancestorAtts, localAtts, remoteAtts interface{}, remoteRevID string) map[string]interface{} {
+	ancestor := toAttachmentsMap(ancestorAtts)
+	local := toAttachmentsMap(localAtts)
+	remote := toAttachmentsMap(remoteAtts)
+	mergedGeneration := genOfRevID(remoteRevID) + 1
+
+	result := make(map[string]interface{}, len(local)+len(remote))
+	names := make(map[string]struct{}, len(local)+len(remote))
+	for name := range local {
+		names[name] = struct{}{}
+	}
+	for name := range remote {
+		names[name] = struct{}{}
+	}
+
+	for name := range names {
+		ancestorDigest, ancestorOk := attachmentDigest(ancestor, name)
+		localDigest, localOk := attachmentDigest(local, name)
+		remoteDigest, remoteOk := attachmentDigest(remote, name)
+
+		localChanged := localOk != ancestorOk || localDigest != ancestorDigest
+		remoteChanged := remoteOk != ancestorOk || remoteDigest != ancestorDigest
+
+		useLocal := false
+		switch {
+		case !localChanged:
+			useLocal = false
+		case !remoteChanged:
+			useLocal = true
+		case localOk == remoteOk && localDigest == remoteDigest:
+			useLocal = false
+		default:
+			useLocal = m.localWins
+		}
+
+		if !useLocal {
+			if remoteOk {
+				result[name] = remote[name]
+			}
+			continue
+		}
+		if !localOk {
+			continue
+		}
+		if remoteOk && localDigest == remoteDigest {
+			result[name] = remote[name]
+			continue
+		}
+		meta, ok := local[name].(map[string]interface{})
+		if !ok {
+			result[name] = local[name]
+			continue
+		}
+		metaCopy := make(map[string]interface{}, len(meta))
+		for k, v := range meta {
+			metaCopy[k] = v
+		}
+		metaCopy["revpos"] = mergedGeneration
+		result[name] = metaCopy
+	}
+	return result
+}
+
+func toAttachmentsMap(atts interface{}) map[string]interface{} {
+	switch atts := atts.(type) {
+	case AttachmentsMeta:
+		return atts
+	case map[string]interface{}:
+		return atts
+	default:
+		return nil
+	}
+}
+
+func attachmentDigest(atts map[string]interface{}, name string) (digest string, ok bool) {
+	value, ok := atts[name]
+	if !ok {
+		return "", false
+	}
+	meta, _ := value.(map[string]interface{})
+	digest, _ = meta["digest"].(string)
+	return digest, true
+}
+
+func attachmentDigestsEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name := range a {
+		aDigest, _ := attachmentDigest(a, name)
+		bDigest, ok := attachmentDigest(b, name)
+		if !ok || aDigest != bDigest {
+			return false
+		}
+	}
+	return true
+}
+
+// maxValue returns the greater of two numeric or two string values.
+func maxValue(localVal, remoteVal interface{}) (interface{}, bool) {
+	localNum, localIsNum := mergeNumber(localVal)
+	remoteNum, remoteIsNum := mergeNumber(remoteVal)
+	if localIsNum && remoteIsNum {
+		if localNum >= remoteNum {
+			return localVal, true
+		}
+		return remoteVal, true
+	}
+	localStr, localIsStr := localVal.(string)
+	remoteStr, remoteIsStr := remoteVal.(string)
+	if localIsStr && remoteIsStr {
+		if localStr >= remoteStr {
+			return localVal, true
+		}
+		return remoteVal, true
+	}
+	return nil, false
+}
+
+// unionArrays returns the elements of local followed by any elements of remote not already present.  Elements that
+// were present in the ancestor but have been removed on either side are omitted.
+func unionArrays(ancestorVal, localVal, remoteVal interface{}) ([]interface{}, bool) {
+	local, localOk := localVal.([]interface{})
+	remote, remoteOk := remoteVal.([]interface{})
+	if !localOk || !remoteOk {
+		return nil, false
+	}
+	ancestor, _ := ancestorVal.([]interface{})
+
+	removed := func(item interface{}) bool {
+		return containsValue(ancestor, item) && (!containsValue(local, item) || !containsValue(remote, item))
+	}
+
+	result := make([]interface{}, 0, len(local)+len(remote))
+	for _, items := range [][]interface{}{local, remote} {
+		for _, item := range items {
+			if !removed(item) && !containsValue(result, item) {
+				result = append(result, item)
+			}
+		}
+	}
+	return result, true
+}
+
+func containsValue(items []interface{}, value interface{}) bool {
+	for _, item := range items {
+		if reflect.DeepEqual(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func mergeNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case float64:
+		return value, true
+	case int:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	default:
+		return 0, false
+	}
+}
+
+// getTimestampProperty returns the value of the dot-separated property path in body as a time.  Supports RFC3339
+// strings and numeric unix timestamps (seconds).
+func getTimestampProperty(body Body, path string) (time.Time, bool) {
+	var value interface{} = map[string]interface{}(body)
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return time.Time{}, false
+		}
+		if value, ok = obj[part]; !ok {
+			return time.Time{}, false
+		}
+	}
+
+	if timeStr, ok := value.(string); ok {
+		t, err := time.Parse(time.RFC3339Nano, timeStr)
+		return t, err == nil
+	}
+	if seconds, ok := mergeNumber(value); ok {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return time.Time{}, false
+}
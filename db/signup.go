@@ -0,0 +1,232 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+const (
+	DefaultVerificationTokenTTL  = 24 * time.Hour // Default time a signup's email verification token is valid for
+	DefaultPasswordResetTokenTTL = time.Hour      // Default time a password reset token is valid for
+
+	accountLinkTokenPlaceholder = "{token}" // Replaced with the token in SignupOptions.LinkURL
+)
+
+var (
+	ErrSignupNotConfigured        = base.HTTPErrorf(http.StatusBadRequest, "Signup isn't configured for this database")
+	ErrPasswordResetNotConfigured = base.HTTPErrorf(http.StatusBadRequest, "Password reset isn't configured for this database")
+)
+
+// SignupOptions enables self-service user registration, email verification and password reset.
+type SignupOptions struct {
+	DefaultRoles             []string             // Roles granted to new users
+	DefaultChannels          []string             // Channels granted to new users
+	RequireEmailVerification bool                 // If true, new users are disabled until their email address is verified
+	VerificationTokenTTL     time.Duration        // Time an email verification token is valid for
+	PasswordResetTokenTTL    time.Duration        // Time a password reset token is valid for
+	LinkURL                  string               // URL included in messages, with {token} replaced by the token
+	Sender                   AccountMessageSender // Delivers verification and password reset tokens.  Nil if not configured
+}
+
+// SignupUser creates a user with the default roles and channels.  If email verification is required, the user is
+// disabled until verified, and the verification token is sent to their email address.  Failure to send the token
+// doesn't fail the signup, as the user can request it again with ResendVerification.  To avoid revealing which
+// addresses are registered, signing up with an existing user's email address succeeds without creating a user, and
+// the existing user is sent a token instead.
+func (db *DatabaseContext) SignupUser(name, email, password string) (verificationRequired bool, err error) {
+	options := db.Options.SignupOptions
+	if options == nil {
+		return false, ErrSignupNotConfigured
+	}
+	if name == "" {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Name is required")
+	}
+	if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Invalid email address")
+	}
+
+	authenticator := db.Authenticator()
+	existing, err := authenticator.GetUserByEmail(email)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		base.Infof(base.KeyAuth, "Signup for user %s used the email address of existing user %s", base.UD(name), base.UD(existing.Name()))
+		db.notifyExistingUserOfSignup(existing)
+		return options.RequireEmailVerification, nil
+	}
+
+	newUser := PrincipalConfig{
+		Name:              &name,
+		Email:             email,
+		Password:          &password,
+		ExplicitChannels:  base.SetFromArray(options.DefaultChannels),
+		ExplicitRoleNames: options.DefaultRoles,
+		Disabled:          base.BoolPtr(options.RequireEmailVerification),
+	}
+	if isValid, reason := newUser.IsPasswordValid(false); !isValid {
+		return false, base.HTTPErrorf(http.StatusBadRequest, "Error creating user: %s", reason)
+	}
+	if _, err := db.UpdatePrincipal(newUser, true, false); err != nil {
+		return false, err
+	}
+	base.Infof(base.KeyAuth, "User %s signed up", base.UD(name))
+
+	if !options.RequireEmailVerification {
+		return false, nil
+	}
+	user, err := authenticator.GetUser(name)
+	if err != nil {
+		return true, err
+	}
+	if user == nil {
+		return true, base.ErrNotFound
+	}
+	token, expiration, err := authenticator.StartEmailVerification(user, options.VerificationTokenTTL)
+	if err != nil {
+		return true, err
+	}
+	if err := db.sendAccountMessage(user, auth.AccountTokenVerifyEmail, token, expiration); err != nil {
+		base.Warnf("Unable to send email verification for user %s: %v", base.UD(name), err)
+	}
+	return true, nil
+}
+
+// notifyExistingUserOfSignup sends a user a token when their email address is used to sign up again: a new
+// verification token if they haven't verified their address yet, otherwise a password reset token, in case they've
+// forgotten their password.  Failures are only logged, so that the signup response is the same as for a new user.
+func (db *DatabaseContext) notifyExistingUserOfSignup(user auth.User) {
+	options := db.Options.SignupOptions
+	if options.Sender == nil || (user.Disabled() && !user.EmailUnverified()) {
+		return
+	}
+	authenticator := db.Authenticator()
+	var token string
+	var expiration time.Time
+	var err error
+	tokenType := auth.AccountTokenPasswordReset
+	if user.EmailUnverified() {
+		tokenType = auth.AccountTokenVerifyEmail
+		token, expiration, err = authenticator.StartEmailVerification(user, options.VerificationTokenTTL)
+	} else {
+		token, expiration, err = authenticator.CreateAccountToken(user.Name(), tokenType, options.PasswordResetTokenTTL)
+	}
+	if err == nil {
+		err = db.sendAccountMessage(user, tokenType, token, expiration)
+	}
+	if err != nil {
+		base.Warnf("Unable to notify user %s of signup with their email address: %v", base.UD(user.Name()), err)
+	}
+}
+
+// VerifyEmail enables a signed up user with the token sent to their email address.
+func (db *DatabaseContext) VerifyEmail(token string) error {
+	if options := db.Options.SignupOptions; options == nil || !options.RequireEmailVerification {
+		return ErrSignupNotConfigured
+	}
+	_, err := db.Authenticator().VerifyEmail(token)
+	return err
+}
+
+// ResendVerification sends a new email verification token to a signed up user that hasn't verified their email
+// address.  To avoid revealing which addresses are registered, no error is returned if there's no such user, or the
+// token can't be sent.
+func (db *DatabaseContext) ResendVerification(email string) error {
+	options := db.Options.SignupOptions
+	if options == nil || !options.RequireEmailVerification {
+		return ErrSignupNotConfigured
+	}
+	authenticator := db.Authenticator()
+	user, err := authenticator.GetUserByEmail(email)
+	if err != nil || user == nil || !user.EmailUnverified() {
+		return err
+	}
+	token, expiration, err := authenticator.StartEmailVerification(user, options.VerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+	if err := db.sendAccountMessage(user, auth.AccountTokenVerifyEmail, token, expiration); err != nil {
+		base.Warnf("Unable to send email verification for user %s: %v", base.UD(user.Name()), err)
+	}
+	return nil
+}
+
+// RequestPasswordReset sends a password reset token to the user with the given email address.  To avoid revealing
+// which addresses are registered, no error is returned if there's no such user, or the token can't be sent.
+func (db *DatabaseContext) RequestPasswordReset(email string) error {
+	options := db.Options.SignupOptions
+	if options == nil || options.Sender == nil {
+		return ErrPasswordResetNotConfigured
+	}
+	authenticator := db.Authenticator()
+	user, err := authenticator.GetUserByEmail(email)
+	if err != nil || user == nil || user.Disabled() {
+		return err
+	}
+	token, expiration, err := authenticator.CreateAccountToken(user.Name(), auth.AccountTokenPasswordReset, options.PasswordResetTokenTTL)
+	if err != nil {
+		return err
+	}
+	if err := db.sendAccountMessage(user, auth.AccountTokenPasswordReset, token, expiration); err != nil {
+		base.Warnf("Unable to send password reset for user %s: %v", base.UD(user.Name()), err)
+	}
+	return nil
+}
+
+// ResetPassword sets a new password with a token from RequestPasswordReset.  As the user has proven they control
+// their email address, any lockout is also removed.
+func (db *DatabaseContext) ResetPassword(token, newPassword string) error {
+	options := db.Options.SignupOptions
+	if options == nil || options.Sender == nil {
+		return ErrPasswordResetNotConfigured
+	}
+	if isValid, reason := (PrincipalConfig{Name: base.StringPtr(""), Password: &newPassword}).IsPasswordValid(false); !isValid {
+		return base.HTTPErrorf(http.StatusBadRequest, "Error resetting password: %s", reason)
+	}
+	authenticator := db.Authenticator()
+	user, err := authenticator.ResetPassword(token, newPassword)
+	if err != nil {
+		return err
+	}
+	if db.Options.LockoutOptions != nil {
+		if err := authenticator.UnlockUser(user.Name()); err != nil {
+			base.Warnf("Unable to unlock user %s after password reset: %v", base.UD(user.Name()), err)
+		}
+	}
+	return nil
+}
+
+func (db *DatabaseContext) sendAccountMessage(user auth.User, tokenType auth.AccountTokenType, token string, expiration time.Time) error {
+	options := db.Options.SignupOptions
+	if options.Sender == nil {
+		return base.HTTPErrorf(http.StatusInternalServerError, "No account message sender configured")
+	}
+	message := &AccountMessage{
+		Type:     tokenType,
+		Database: db.Name,
+		Username: user.Name(),
+		Email:    user.Email(),
+		Token:    token,
+		Expires:  expiration,
+	}
+	if options.LinkURL != "" {
+		message.Link = strings.ReplaceAll(options.LinkURL, accountLinkTokenPlaceholder, url.QueryEscape(token))
+	}
+	return options.Sender.SendAccountMessage(message)
+}
@@ -32,6 +32,9 @@ type PrincipalConfig struct {
 	Password          *string  `json:"password,omitempty"`
 	ExplicitRoleNames []string `json:"admin_roles,omitempty"`
 	RoleNames         []string `json:"roles,omitempty"`
+	// Roles and channels granted by token claims.  These are output only, and ignored by UpdatePrincipal:
+	JWTRoleNames []string `json:"jwt_roles,omitempty"`
+	JWTChannels  base.Set `json:"jwt_channels,omitempty"`
 }
 
 // Check if the password in this PrincipalConfig is valid.  Only allow
@@ -110,7 +113,36 @@ func (db *DatabaseContext) DeleteRole(name string, purge bool) error {
 		return err
 	}
 
-	return authenticator.DeleteRole(role, purge, seq)
+	if err := authenticator.DeleteRole(role, purge, seq); err != nil {
+		return err
+	}
+	db.raisePrincipalChangeEvent(name, false, PrincipalDeleted)
+	return nil
+}
+
+func (db *DatabaseContext) DeleteUser(name string) error {
+	authenticator := db.Authenticator()
+
+	user, err := authenticator.GetUser(name)
+	if err != nil {
+		return err
+	}
+
+	if user == nil {
+		return base.ErrNotFound
+	}
+
+	if err := authenticator.DeleteUser(user); err != nil {
+		return err
+	}
+	db.raisePrincipalChangeEvent(name, true, PrincipalDeleted)
+	return nil
+}
+
+func (db *DatabaseContext) raisePrincipalChangeEvent(name string, isUser bool, action string) {
+	if err := db.EventMgr.RaisePrincipalChangeEvent(db.Name, name, isUser, action); err != nil {
+		base.Debugf(base.KeyEvents, "Unable to raise principal change event for %s: %v", base.UD(name), err)
+	}
 }
 
 // Updates or creates a principal from a PrincipalConfig structure.
@@ -143,6 +175,11 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 					err = base.HTTPErrorf(http.StatusBadRequest, "Error creating user: %s", reason)
 					return replaced, err
 				}
+				if newInfo.Password != nil && *newInfo.Password != "" {
+					if err = authenticator.ValidatePassword(nil, *newInfo.Password); err != nil {
+						return replaced, err
+					}
+				}
 				user, err = authenticator.NewUser(*newInfo.Name, "", nil)
 				princ = user
 			} else {
@@ -161,6 +198,11 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 				err = base.HTTPErrorf(http.StatusBadRequest, "Error updating user/role: %s", reason)
 				return replaced, err
 			}
+			if *newInfo.Password != "" {
+				if err = authenticator.ValidatePassword(user, *newInfo.Password); err != nil {
+					return replaced, err
+				}
+			}
 		}
 
 		updatedChannels := princ.ExplicitChannels()
@@ -228,6 +270,13 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 		if base.IsCasMismatch(err) {
 			base.Infof(base.KeyAuth, "CAS mismatch updating principal %s - will retry", base.UD(princ.Name()))
 		} else {
+			if err == nil {
+				action := PrincipalCreated
+				if replaced {
+					action = PrincipalUpdated
+				}
+				dbc.raisePrincipalChangeEvent(princ.Name(), isUser, action)
+			}
 			return replaced, err
 		}
 	}
@@ -235,3 +284,62 @@ func (dbc *DatabaseContext) UpdatePrincipal(newInfo PrincipalConfig, isUser bool
 	base.Errorf("CAS mismatch updating principal %s - exceeded retry count. Latest failure: %v", base.UD(princ.Name()), err)
 	return replaced, err
 }
+
+// UpdateUserJWTGrants replaces the roles and channels granted to a user by the claims of the token they authenticated
+// with, if they've changed since the user's last token login.  Roles and channels granted through the admin API aren't
+// affected.  Returns the user with their roles and channels recomputed.
+func (dbc *DatabaseContext) UpdateUserJWTGrants(user auth.User, grants *auth.JWTGrants) (auth.User, error) {
+	if grants == nil {
+		return user, nil
+	}
+	authenticator := dbc.Authenticator()
+
+	var err error
+	for i := 1; i <= auth.PrincipalUpdateMaxCasRetries; i++ {
+		jwtRoles := user.JWTRoles()
+		if jwtRoles == nil {
+			jwtRoles = ch.TimedSet{}
+		}
+		jwtChannels := user.JWTChannels()
+		if jwtChannels == nil {
+			jwtChannels = ch.TimedSet{}
+		}
+		if jwtRoles.Equals(grants.Roles) && jwtChannels.Equals(grants.Channels) {
+			return user, nil
+		}
+
+		nextSeq, seqErr := dbc.sequences.nextSequence()
+		if seqErr != nil {
+			return nil, seqErr
+		}
+		user.SetSequence(nextSeq)
+		if jwtRoles.UpdateAtSequence(grants.Roles, nextSeq) {
+			user.SetJWTRoles(jwtRoles, nextSeq)
+		}
+		if jwtChannels.UpdateAtSequence(grants.Channels, nextSeq) {
+			user.SetJWTChannels(jwtChannels, nextSeq)
+		}
+
+		err = authenticator.Save(user)
+		if err == nil {
+			base.Infof(base.KeyAuth, "Updated roles and channels granted by token claims for user %s", base.UD(user.Name()))
+			dbc.raisePrincipalChangeEvent(user.Name(), true, PrincipalUpdated)
+			// Reload the user, to recompute their roles and channels
+			return authenticator.GetUser(user.Name())
+		}
+		if !base.IsCasMismatch(err) {
+			return nil, err
+		}
+		base.Infof(base.KeyAuth, "CAS mismatch updating token grants for user %s - will retry", base.UD(user.Name()))
+		var getErr error
+		if user, getErr = authenticator.GetUser(user.Name()); getErr != nil {
+			return nil, getErr
+		}
+		if user == nil {
+			return nil, base.ErrNotFound
+		}
+	}
+
+	base.Errorf("CAS mismatch updating token grants for user %s - exceeded retry count. Latest failure: %v", base.UD(user.Name()), err)
+	return nil, err
+}
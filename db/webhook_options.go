@@ -0,0 +1,198 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// Webhook options, supported for all event types.
+const (
+	// EventOptionTransform is a JavaScript function that returns the request body for an event.  It's called with the
+	// same arguments as the filter function, and can return a string to be sent as-is, an object to be sent as JSON,
+	// or null to skip the event.
+	EventOptionTransform = "transform"
+	// EventOptionMethod overrides the HTTP method used for requests.  One of POST (default), PUT or PATCH.
+	EventOptionMethod = "method"
+	// EventOptionContentType overrides the Content-Type of requests, which defaults to application/json.
+	EventOptionContentType = "content_type"
+	// EventOptionHeaders are headers added to each request.
+	EventOptionHeaders = "headers"
+	// EventOptionSecretHeaders are headers added to each request, whose values are secrets.  See ResolveWebhookSecret.
+	EventOptionSecretHeaders = "secret_headers"
+	// EventOptionBearerToken is a secret sent as a bearer token in the Authorization header.
+	EventOptionBearerToken = "bearer_token"
+	// EventOptionBasicAuth is a username and secret password sent using basic auth.
+	EventOptionBasicAuth = "basic_auth"
+	// EventOptionTLS configures a client certificate and root CA, for webhooks using mutual TLS.
+	EventOptionTLS = "tls"
+)
+
+// WebhookOptionNames are the names of the options supported by webhooks for all event types.
+var WebhookOptionNames = []string{EventOptionTransform, EventOptionMethod, EventOptionContentType, EventOptionHeaders,
+	EventOptionSecretHeaders, EventOptionBearerToken, EventOptionBasicAuth, EventOptionTLS}
+
+// Prefixes of secret references, for secrets that aren't given in the config.
+const (
+	webhookSecretEnvPrefix  = "env:"
+	webhookSecretFilePrefix = "file:"
+)
+
+// WebhookBasicAuth is the basic_auth webhook option.
+type WebhookBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"` // Secret, see ResolveWebhookSecret
+}
+
+// WebhookTLSConfig is the tls webhook option.
+type WebhookTLSConfig struct {
+	CertPath   string `json:"cert_path,omitempty"`    // Client certificate, for mutual TLS
+	KeyPath    string `json:"key_path,omitempty"`     // Client certificate key, for mutual TLS
+	CACertPath string `json:"ca_cert_path,omitempty"` // Root CA used to verify the webhook's certificate, instead of the system roots
+}
+
+// webhookOptions are the webhook options parsed from an event handler's options.
+type webhookOptions struct {
+	Transform     string            `json:"transform"`
+	Method        string            `json:"method"`
+	ContentType   string            `json:"content_type"`
+	Headers       map[string]string `json:"headers"`
+	SecretHeaders map[string]string `json:"secret_headers"`
+	BearerToken   string            `json:"bearer_token"`
+	BasicAuth     *WebhookBasicAuth `json:"basic_auth"`
+	TLS           *WebhookTLSConfig `json:"tls"`
+}
+
+// IsWebhookSecretReference returns true if the value refers to a secret held outside the config.
+func IsWebhookSecretReference(value string) bool {
+	return strings.HasPrefix(value, webhookSecretEnvPrefix) || strings.HasPrefix(value, webhookSecretFilePrefix)
+}
+
+// ResolveWebhookSecret returns the value of a secret webhook option.  Values of the form env:NAME are read from
+// the NAME environment variable, and values of the form file:PATH are read from the file at PATH, without any
+// trailing newline.  Other values are the secret itself.
+func ResolveWebhookSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, webhookSecretEnvPrefix):
+		name := strings.TrimPrefix(value, webhookSecretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q for webhook secret is not set", name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, webhookSecretFilePrefix):
+		secret, err := ioutil.ReadFile(strings.TrimPrefix(value, webhookSecretFilePrefix))
+		if err != nil {
+			return "", fmt.Errorf("unable to read webhook secret: %w", err)
+		}
+		return strings.TrimRight(string(secret), "\r\n"), nil
+	default:
+		return value, nil
+	}
+}
+
+// applyOptions configures the webhook from its event handler options.
+func (wh *Webhook) applyOptions(options map[string]interface{}) error {
+	optionsJSON, err := base.JSONMarshal(options)
+	if err != nil {
+		return err
+	}
+	var opts webhookOptions
+	if err := base.JSONUnmarshal(optionsJSON, &opts); err != nil {
+		return fmt.Errorf("invalid webhook options: %w", err)
+	}
+
+	if opts.Transform != "" {
+		wh.transform = NewJSEventFunction(opts.Transform)
+	}
+
+	switch method := strings.ToUpper(opts.Method); method {
+	case "":
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		wh.method = method
+	default:
+		return fmt.Errorf("webhook %s option must be one of POST, PUT or PATCH", EventOptionMethod)
+	}
+	wh.contentType = opts.ContentType
+
+	wh.headers = make(http.Header)
+	for name, value := range opts.Headers {
+		wh.headers.Set(name, value)
+	}
+	for name, value := range opts.SecretHeaders {
+		secret, err := ResolveWebhookSecret(value)
+		if err != nil {
+			return fmt.Errorf("webhook secret header %s: %w", name, err)
+		}
+		wh.headers.Set(name, secret)
+	}
+	if opts.BearerToken != "" && opts.BasicAuth != nil {
+		return fmt.Errorf("webhook %s and %s options can't be used together", EventOptionBearerToken, EventOptionBasicAuth)
+	}
+	if opts.BearerToken != "" {
+		token, err := ResolveWebhookSecret(opts.BearerToken)
+		if err != nil {
+			return fmt.Errorf("webhook bearer token: %w", err)
+		}
+		wh.headers.Set("Authorization", "Bearer "+token)
+	}
+	if opts.BasicAuth != nil {
+		password, err := ResolveWebhookSecret(opts.BasicAuth.Password)
+		if err != nil {
+			return fmt.Errorf("webhook basic auth password: %w", err)
+		}
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(opts.BasicAuth.Username, password)
+		wh.headers.Set("Authorization", req.Header.Get("Authorization"))
+	}
+
+	if opts.TLS != nil {
+		tlsConfig, err := opts.TLS.tlsConfig()
+		if err != nil {
+			return err
+		}
+		wh.client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+	}
+	return nil
+}
+
+func (c *WebhookTLSConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if c.CertPath != "" || c.KeyPath != "" {
+		if c.CertPath == "" || c.KeyPath == "" {
+			return nil, fmt.Errorf("webhook tls cert_path and key_path must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load webhook client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if c.CACertPath != "" {
+		caCert, err := ioutil.ReadFile(c.CACertPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read webhook CA certificate: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in webhook CA certificate %s", c.CACertPath)
+		}
+	}
+	return tlsConfig, nil
+}
@@ -0,0 +1,572 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultWebhookMaxAttempts    = 10
+	DefaultWebhookInitialBackoff = time.Second
+	DefaultWebhookMaxBackoff     = time.Hour
+
+	// webhookOutboxPollInterval is how often the outbox is checked for entries due for a retry.
+	webhookOutboxPollInterval = time.Second
+
+	// webhookOutboxIndexShardCount is the number of documents a webhook's outbox index is spread across.  The index is
+	// updated for every event and delivery, so sharding keeps each rewrite small and limits CAS contention between
+	// concurrent writers.
+	webhookOutboxIndexShardCount = 16
+
+	// maxWebhookOutboxEntries is the upper bound on the number of pending and failed entries for a webhook, enforced
+	// per index shard.  Each entry takes ~60 bytes in its shard, so this bounds each shard to ~200KB.
+	maxWebhookOutboxEntries      = 50000
+	maxWebhookOutboxShardEntries = maxWebhookOutboxEntries / webhookOutboxIndexShardCount
+
+	// Outbox entry states
+	WebhookOutboxStatePending = "pending"
+	WebhookOutboxStateFailed  = "failed"
+)
+
+// WebhookDeliveryConfig configures durable delivery for a webhook.  Durable webhooks write events to an outbox in the
+// bucket, and retry failed deliveries with exponential backoff until max_attempts is reached, after which the event
+// is marked as failed and can be replayed through the admin API.
+type WebhookDeliveryConfig struct {
+	Durable          bool `json:"durable"`                      // Write events to the outbox and retry failed deliveries
+	MaxAttempts      int  `json:"max_attempts,omitempty"`       // Delivery attempts before an event is marked as failed
+	InitialBackoffMs int  `json:"initial_backoff_ms,omitempty"` // Delay before the first retry, doubled for each retry
+	MaxBackoffMs     int  `json:"max_backoff_ms,omitempty"`     // Upper bound on the delay between retries
+}
+
+// WebhookOutboxEntry is an event waiting to be delivered by a durable webhook, or one that has failed delivery.
+type WebhookOutboxEntry struct {
+	ID          string    `json:"id"`
+	Event       string    `json:"event"`
+	Payload     []byte    `json:"payload"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	Created     time.Time `json:"created"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	LeaseExpiry time.Time `json:"lease_expiry"` // A node is delivering the entry until this time
+}
+
+// webhookOutboxIndex lists a webhook's outbox entry IDs, in the order they were added.  It's assembled from the index
+// shards when read.
+type webhookOutboxIndex struct {
+	Pending []string
+	Failed  []string
+}
+
+// webhookOutboxIndexShard is the persisted form of a single shard of a webhook's outbox index.  Entry IDs are mapped
+// to the entry's creation time in Unix nanoseconds, so that entries can be ordered across shards.
+type webhookOutboxIndexShard struct {
+	Pending map[string]int64 `json:"pending,omitempty"`
+	Failed  map[string]int64 `json:"failed,omitempty"`
+}
+
+// webhookOutbox stores a durable webhook's undelivered events.  Each entry is stored in its own document, with index
+// shard documents listing the pending and failed entry IDs so that they can be delivered and inspected from any node.
+type webhookOutbox struct {
+	bucket         base.Bucket
+	prefix         string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	leaseTimeout   time.Duration
+	wake           chan struct{}
+	delivered      int64 // Entries delivered by this node
+	failedAttempts int64 // Failed delivery attempts made by this node
+}
+
+// indexShardKey returns the key of the index shard document that lists the given entry.
+func (o *webhookOutbox) indexShardKey(entryID string) string {
+	return o.indexShardKeyForIndex(int(crc32.ChecksumIEEE([]byte(entryID)) % webhookOutboxIndexShardCount))
+}
+
+func (o *webhookOutbox) indexShardKeyForIndex(shardIndex int) string {
+	return o.prefix + ":index:" + strconv.Itoa(shardIndex)
+}
+
+func (o *webhookOutbox) entryKey(entryID string) string {
+	return o.prefix + ":" + entryID
+}
+
+// backoff returns the delay before the next attempt, after the given number of failed attempts.
+func (o *webhookOutbox) backoff(attempts int) time.Duration {
+	backoff := o.initialBackoff
+	for i := 1; i < attempts && backoff < o.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > o.maxBackoff {
+		backoff = o.maxBackoff
+	}
+	return backoff
+}
+
+// add writes a new pending entry for the event.
+func (o *webhookOutbox) add(event string, payload []byte) error {
+	now := time.Now().UTC()
+	entry := &WebhookOutboxEntry{
+		ID:          uuid.New().String(),
+		Event:       event,
+		Payload:     payload,
+		State:       WebhookOutboxStatePending,
+		Created:     now,
+		NextAttempt: now,
+	}
+	if _, err := o.bucket.Add(o.entryKey(entry.ID), 0, entry); err != nil {
+		return err
+	}
+	err := o.updateIndexShard(entry.ID, func(shard *webhookOutboxIndexShard) error {
+		if len(shard.Pending)+len(shard.Failed) >= maxWebhookOutboxShardEntries {
+			return fmt.Errorf("webhook outbox is full (%d entries)", maxWebhookOutboxEntries)
+		}
+		shard.Pending[entry.ID] = entry.Created.UnixNano()
+		return nil
+	})
+	if err != nil {
+		_ = o.bucket.Delete(o.entryKey(entry.ID))
+		return err
+	}
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// getIndex reads all index shards, returning the entry IDs in the order the entries were added.
+func (o *webhookOutbox) getIndex() (*webhookOutboxIndex, error) {
+	type indexedEntry struct {
+		id      string
+		created int64
+	}
+	var pending, failed []indexedEntry
+	for i := 0; i < webhookOutboxIndexShardCount; i++ {
+		shard := &webhookOutboxIndexShard{}
+		if _, err := o.bucket.Get(o.indexShardKeyForIndex(i), shard); err != nil && !base.IsDocNotFoundError(err) {
+			return nil, err
+		}
+		for entryID, created := range shard.Pending {
+			pending = append(pending, indexedEntry{entryID, created})
+		}
+		for entryID, created := range shard.Failed {
+			failed = append(failed, indexedEntry{entryID, created})
+		}
+	}
+	sortedIDs := func(entries []indexedEntry) []string {
+		sort.Slice(entries, func(i, j int) bool {
+			if entries[i].created != entries[j].created {
+				return entries[i].created < entries[j].created
+			}
+			return entries[i].id < entries[j].id
+		})
+		entryIDs := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			entryIDs = append(entryIDs, entry.id)
+		}
+		return entryIDs
+	}
+	return &webhookOutboxIndex{Pending: sortedIDs(pending), Failed: sortedIDs(failed)}, nil
+}
+
+// updateIndexShard applies the callback to the index shard listing the given entry, with CAS retry.  The shard
+// document is removed once its last entry has been removed.
+func (o *webhookOutbox) updateIndexShard(entryID string, callback func(shard *webhookOutboxIndexShard) error) error {
+	key := o.indexShardKey(entryID)
+	_, err := o.bucket.Update(key, 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		shard := &webhookOutboxIndexShard{}
+		if len(current) > 0 {
+			if err := base.JSONUnmarshal(current, shard); err != nil {
+				return nil, nil, false, fmt.Errorf("unable to unmarshal webhook outbox index shard %s: %w", base.MD(key), err)
+			}
+		}
+		if shard.Pending == nil {
+			shard.Pending = map[string]int64{}
+		}
+		if shard.Failed == nil {
+			shard.Failed = map[string]int64{}
+		}
+		if err := callback(shard); err != nil {
+			return nil, nil, false, err
+		}
+		if len(shard.Pending) == 0 && len(shard.Failed) == 0 {
+			if len(current) == 0 {
+				return nil, nil, false, base.ErrUpdateCancel
+			}
+			return nil, nil, true, nil
+		}
+		shardBytes, err := base.JSONMarshal(shard)
+		return shardBytes, nil, false, err
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	}
+	return err
+}
+
+// updateEntry applies the callback to an outbox entry with CAS retry.  The callback returns base.ErrUpdateCancel to
+// leave the entry unchanged, and the entry is deleted when the callback returns a nil entry.
+func (o *webhookOutbox) updateEntry(entryID string, callback func(entry *WebhookOutboxEntry) (*WebhookOutboxEntry, error)) (updated *WebhookOutboxEntry, err error) {
+	_, err = o.bucket.Update(o.entryKey(entryID), 0, func(current []byte) ([]byte, *uint32, bool, error) {
+		if len(current) == 0 {
+			return nil, nil, false, base.ErrNotFound
+		}
+		entry := &WebhookOutboxEntry{}
+		if err := base.JSONUnmarshal(current, entry); err != nil {
+			return nil, nil, false, err
+		}
+		updated, err = callback(entry)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if updated == nil {
+			return nil, nil, true, nil
+		}
+		entryBytes, err := base.JSONMarshal(updated)
+		return entryBytes, nil, false, err
+	})
+	return updated, err
+}
+
+// get returns the outbox entry with the given ID.
+func (o *webhookOutbox) get(entryID string) (*WebhookOutboxEntry, error) {
+	entry := &WebhookOutboxEntry{}
+	if _, err := o.bucket.Get(o.entryKey(entryID), entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// list returns the entries in the given state, or all entries when state is empty, in the order they were added.
+func (o *webhookOutbox) list(state string) ([]*WebhookOutboxEntry, error) {
+	index, err := o.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	var entryIDs []string
+	if state == "" || state == WebhookOutboxStateFailed {
+		entryIDs = append(entryIDs, index.Failed...)
+	}
+	if state == "" || state == WebhookOutboxStatePending {
+		entryIDs = append(entryIDs, index.Pending...)
+	}
+	entries := make([]*WebhookOutboxEntry, 0, len(entryIDs))
+	for _, entryID := range entryIDs {
+		entry, err := o.get(entryID)
+		if base.IsDocNotFoundError(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// deliverDue attempts delivery of each pending entry that's due, in the order they were added.
+func (o *webhookOutbox) deliverDue(deliver func(entry *WebhookOutboxEntry) error) error {
+	index, err := o.getIndex()
+	if err != nil {
+		return err
+	}
+	for _, entryID := range index.Pending {
+		if err := o.deliverEntry(entryID, deliver); err != nil {
+			base.Debugf(base.KeyEvents, "Unable to deliver webhook outbox entry %s: %v", entryID, err)
+		}
+	}
+	return nil
+}
+
+// deliverEntry claims the entry, if it's due and not being delivered by another node, and attempts delivery.
+func (o *webhookOutbox) deliverEntry(entryID string, deliver func(entry *WebhookOutboxEntry) error) error {
+	now := time.Now().UTC()
+	claimed, err := o.updateEntry(entryID, func(entry *WebhookOutboxEntry) (*WebhookOutboxEntry, error) {
+		if entry.State != WebhookOutboxStatePending || entry.NextAttempt.After(now) || entry.LeaseExpiry.After(now) {
+			return nil, base.ErrUpdateCancel
+		}
+		entry.LeaseExpiry = now.Add(o.leaseTimeout)
+		return entry, nil
+	})
+	if err == base.ErrUpdateCancel {
+		return nil
+	} else if base.IsDocNotFoundError(err) {
+		// Entry was delivered or discarded by another node, or its write failed
+		return o.removeFromIndex(entryID)
+	} else if err != nil {
+		return err
+	}
+
+	deliveryErr := deliver(claimed)
+	if deliveryErr == nil {
+		atomic.AddInt64(&o.delivered, 1)
+		if err := o.bucket.Delete(o.entryKey(entryID)); err != nil && !base.IsDocNotFoundError(err) {
+			return err
+		}
+		return o.removeFromIndex(entryID)
+	}
+
+	atomic.AddInt64(&o.failedAttempts, 1)
+	failed := false
+	updated, err := o.updateEntry(entryID, func(entry *WebhookOutboxEntry) (*WebhookOutboxEntry, error) {
+		entry.Attempts++
+		entry.LastError = deliveryErr.Error()
+		entry.LeaseExpiry = time.Time{}
+		if entry.Attempts >= o.maxAttempts {
+			entry.State = WebhookOutboxStateFailed
+		} else {
+			entry.NextAttempt = time.Now().UTC().Add(o.backoff(entry.Attempts))
+		}
+		failed = entry.State == WebhookOutboxStateFailed
+		return entry, nil
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		base.Warnf("Webhook outbox entry %s failed after %d attempts: %v", entryID, o.maxAttempts, deliveryErr)
+		return o.updateIndexShard(entryID, func(shard *webhookOutboxIndexShard) error {
+			delete(shard.Pending, entryID)
+			shard.Failed[entryID] = updated.Created.UnixNano()
+			return nil
+		})
+	}
+	return deliveryErr
+}
+
+func (o *webhookOutbox) removeFromIndex(entryID string) error {
+	return o.updateIndexShard(entryID, func(shard *webhookOutboxIndexShard) error {
+		if _, ok := shard.Pending[entryID]; !ok {
+			if _, ok := shard.Failed[entryID]; !ok {
+				return base.ErrUpdateCancel
+			}
+		}
+		delete(shard.Pending, entryID)
+		delete(shard.Failed, entryID)
+		return nil
+	})
+}
+
+// replay moves the given failed entries, or all failed entries when none are specified, back to pending with their
+// attempts reset.  Returns the number of entries replayed.
+func (o *webhookOutbox) replay(entryIDs ...string) (replayed int, err error) {
+	if len(entryIDs) == 0 {
+		index, err := o.getIndex()
+		if err != nil {
+			return 0, err
+		}
+		entryIDs = index.Failed
+	}
+	now := time.Now().UTC()
+	for _, entryID := range entryIDs {
+		updated, err := o.updateEntry(entryID, func(entry *WebhookOutboxEntry) (*WebhookOutboxEntry, error) {
+			if entry.State != WebhookOutboxStateFailed {
+				return nil, base.ErrUpdateCancel
+			}
+			entry.State = WebhookOutboxStatePending
+			entry.Attempts = 0
+			entry.NextAttempt = now
+			return entry, nil
+		})
+		if err == base.ErrUpdateCancel || base.IsDocNotFoundError(err) {
+			continue
+		} else if err != nil {
+			return replayed, err
+		}
+		if err := o.updateIndexShard(entryID, func(shard *webhookOutboxIndexShard) error {
+			delete(shard.Failed, entryID)
+			shard.Pending[entryID] = updated.Created.UnixNano()
+			return nil
+		}); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+	return replayed, nil
+}
+
+// discard deletes the given failed entries, or all failed entries when none are specified.  Returns the number of
+// entries discarded.
+func (o *webhookOutbox) discard(entryIDs ...string) (discarded int, err error) {
+	index, err := o.getIndex()
+	if err != nil {
+		return 0, err
+	}
+	if len(entryIDs) == 0 {
+		entryIDs = index.Failed
+	}
+	for _, entryID := range entryIDs {
+		if !base.StringSliceContains(index.Failed, entryID) {
+			continue
+		}
+		if err := o.bucket.Delete(o.entryKey(entryID)); err != nil && !base.IsDocNotFoundError(err) {
+			return discarded, err
+		}
+		if err := o.removeFromIndex(entryID); err != nil {
+			return discarded, err
+		}
+		discarded++
+	}
+	return discarded, nil
+}
+
+// run delivers pending entries until the terminator is closed.
+func (o *webhookOutbox) run(deliver func(entry *WebhookOutboxEntry) error, doneChan chan struct{}, terminator chan bool) {
+	defer close(doneChan)
+	defer base.FatalPanicHandler()
+	ticker := time.NewTicker(webhookOutboxPollInterval)
+	defer ticker.Stop()
+	for {
+		if err := o.deliverDue(deliver); err != nil {
+			base.Warnf("Unable to read webhook outbox %s: %v", base.MD(o.prefix), err)
+		}
+		select {
+		case <-o.wake:
+		case <-ticker.C:
+		case <-terminator:
+			return
+		}
+	}
+}
+
+// WebhookOutboxStatus reports the number of entries in a durable webhook's outbox, and this node's delivery counts.
+type WebhookOutboxStatus struct {
+	Pending        int   `json:"pending"`
+	Failed         int   `json:"failed"`
+	Delivered      int64 `json:"delivered"`
+	FailedAttempts int64 `json:"failed_attempts"`
+}
+
+func (o *webhookOutbox) status() (*WebhookOutboxStatus, error) {
+	index, err := o.getIndex()
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookOutboxStatus{
+		Pending:        len(index.Pending),
+		Failed:         len(index.Failed),
+		Delivered:      atomic.LoadInt64(&o.delivered),
+		FailedAttempts: atomic.LoadInt64(&o.failedAttempts),
+	}, nil
+}
+
+// EnableWebhookOutbox makes the webhook durable.  Events handled by the webhook are written to an outbox in the
+// bucket, and delivered by a background worker that retries failures with exponential backoff.  The outbox is
+// identified by the event type and url, so that events written before a restart are delivered once the webhook
+// is configured again.
+func (context *DatabaseContext) EnableWebhookOutbox(wh *Webhook, eventType EventType, config WebhookDeliveryConfig) error {
+	if config.MaxAttempts < 0 || config.InitialBackoffMs < 0 || config.MaxBackoffMs < 0 {
+		return fmt.Errorf("webhook delivery max_attempts, initial_backoff_ms and max_backoff_ms must not be negative")
+	}
+	outbox := &webhookOutbox{
+		bucket:         context.Bucket,
+		maxAttempts:    DefaultWebhookMaxAttempts,
+		initialBackoff: DefaultWebhookInitialBackoff,
+		maxBackoff:     DefaultWebhookMaxBackoff,
+		wake:           make(chan struct{}, 1),
+	}
+	if config.MaxAttempts > 0 {
+		outbox.maxAttempts = config.MaxAttempts
+	}
+	if config.InitialBackoffMs > 0 {
+		outbox.initialBackoff = time.Duration(config.InitialBackoffMs) * time.Millisecond
+	}
+	if config.MaxBackoffMs > 0 {
+		outbox.maxBackoff = time.Duration(config.MaxBackoffMs) * time.Millisecond
+	}
+
+	// A node that stops mid-delivery leaves the entry leased, so it's retried by another node once the request
+	// would have timed out
+	outbox.leaseTimeout = wh.timeout + 30*time.Second
+	if wh.timeout == 0 {
+		outbox.leaseTimeout = 10 * time.Minute
+	}
+
+	wh.id = base.Sha1HashString(eventType.String()+":"+wh.url, "")[:16]
+	outbox.prefix = base.WebhookOutboxPrefix + wh.id
+	wh.outbox = outbox
+
+	bgt := BackgroundTask{taskName: "WebhookOutbox:" + wh.id, doneChan: make(chan struct{})}
+	go outbox.run(wh.deliver, bgt.doneChan, context.terminator)
+	context.backgroundTasks = append(context.backgroundTasks, bgt)
+	return nil
+}
+
+// webhookOutbox returns the outbox of the durable webhook with the given ID.
+func (context *DatabaseContext) webhookOutbox(webhookID string) (*webhookOutbox, error) {
+	if wh := context.EventMgr.durableWebhook(webhookID); wh != nil {
+		return wh.outbox, nil
+	}
+	return nil, base.HTTPErrorf(http.StatusNotFound, "Durable webhook %s not found", webhookID)
+}
+
+// GetWebhookOutboxEntries returns the entries in a durable webhook's outbox, optionally filtered by state.
+func (context *DatabaseContext) GetWebhookOutboxEntries(webhookID, state string) ([]*WebhookOutboxEntry, error) {
+	if state != "" && state != WebhookOutboxStatePending && state != WebhookOutboxStateFailed {
+		return nil, base.HTTPErrorf(http.StatusBadRequest, "state must be %s or %s", WebhookOutboxStatePending, WebhookOutboxStateFailed)
+	}
+	outbox, err := context.webhookOutbox(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	return outbox.list(state)
+}
+
+// GetWebhookOutboxEntry returns a single entry from a durable webhook's outbox.
+func (context *DatabaseContext) GetWebhookOutboxEntry(webhookID, entryID string) (*WebhookOutboxEntry, error) {
+	outbox, err := context.webhookOutbox(webhookID)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := outbox.get(entryID)
+	if base.IsDocNotFoundError(err) {
+		return nil, base.HTTPErrorf(http.StatusNotFound, "Outbox entry %s not found", entryID)
+	}
+	return entry, err
+}
+
+// ReplayWebhookOutbox queues failed entries for redelivery, with their attempts reset.  All failed entries are
+// replayed when no entry IDs are given.  Returns the number of entries replayed.
+func (context *DatabaseContext) ReplayWebhookOutbox(webhookID string, entryIDs ...string) (int, error) {
+	outbox, err := context.webhookOutbox(webhookID)
+	if err != nil {
+		return 0, err
+	}
+	return outbox.replay(entryIDs...)
+}
+
+// DiscardWebhookOutbox deletes failed entries.  All failed entries are discarded when no entry IDs are given.
+// Returns the number of entries discarded.
+func (context *DatabaseContext) DiscardWebhookOutbox(webhookID string, entryIDs ...string) (int, error) {
+	outbox, err := context.webhookOutbox(webhookID)
+	if err != nil {
+		return 0, err
+	}
+	return outbox.discard(entryIDs...)
+}
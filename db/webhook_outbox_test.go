@@ -0,0 +1,273 @@
+/*
+Copyright 2022-Present Couchbase, Inc.
+
+Use of this software is governed by the Business Source License included in
+the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+file, in accordance with the Business Source License, use of this software will
+be governed by the Apache License, Version 2.0, included in the file
+licenses/APL2.txt.
+*/
+
+package db
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver is a webhook endpoint that fails the first failures requests.
+type webhookReceiver struct {
+	lock       sync.Mutex
+	failures   int
+	payloads   []string
+	deliveries []string
+	signatures []string
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	if wr.failures > 0 {
+		wr.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	wr.payloads = append(wr.payloads, string(body))
+	wr.deliveries = append(wr.deliveries, r.Header.Get(WebhookDeliveryHeader))
+	wr.signatures = append(wr.signatures, r.Header.Get(WebhookSignatureHeader))
+}
+
+func (wr *webhookReceiver) received() []string {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+	return append([]string(nil), wr.payloads...)
+}
+
+func newDurableTestWebhook(t *testing.T, db *Database, url string, config WebhookDeliveryConfig) *Webhook {
+	wh, err := NewWebhook(url, "", nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, db.EnableWebhookOutbox(wh, DocumentChange, config))
+	db.EventMgr.RegisterEventHandler(wh, DocumentChange)
+	return wh
+}
+
+func TestWebhookOutboxRetries(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	receiver := &webhookReceiver{failures: 2}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	wh := newDurableTestWebhook(t, db, server.URL, WebhookDeliveryConfig{Durable: true, InitialBackoffMs: 1})
+	wh.SetSigningSecret("secret")
+	require.NotEmpty(t, wh.ID())
+
+	assert.True(t, wh.HandleEvent(&DocumentChangeEvent{DocBytes: []byte(`{"n":1}`), WinningRevChange: true}))
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, `{"n":1}`, receiver.received()[0])
+	assert.NotEmpty(t, receiver.deliveries[0])
+
+	// The signature covers the timestamp and body
+	signature := receiver.signatures[0]
+	require.True(t, strings.HasPrefix(signature, "t="))
+	timestamp, err := strconv.ParseInt(strings.SplitN(signature[2:], ",", 2)[0], 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, WebhookSignature("secret", time.Unix(timestamp, 0), []byte(`{"n":1}`)), signature)
+	assert.NotEqual(t, WebhookSignature("other", time.Unix(timestamp, 0), []byte(`{"n":1}`)), signature)
+
+	// Delivered entries are removed from the outbox
+	require.Eventually(t, func() bool {
+		status, err := wh.outbox.status()
+		return err == nil && status.Pending == 0 && status.Delivered == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	status, err := wh.outbox.status()
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), status.FailedAttempts)
+	entries, err := db.GetWebhookOutboxEntries(wh.ID(), "")
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestWebhookOutboxFailedReplay(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	receiver := &webhookReceiver{failures: 4}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	wh := newDurableTestWebhook(t, db, server.URL, WebhookDeliveryConfig{Durable: true, MaxAttempts: 2, InitialBackoffMs: 1})
+	assert.True(t, wh.HandleEvent(&DocumentChangeEvent{DocBytes: []byte(`{"n":1}`), WinningRevChange: true}))
+	assert.True(t, wh.HandleEvent(&DocumentChangeEvent{DocBytes: []byte(`{"n":2}`), WinningRevChange: true}))
+
+	// Both entries fail after max attempts
+	var failed []*WebhookOutboxEntry
+	require.Eventually(t, func() bool {
+		var err error
+		failed, err = db.GetWebhookOutboxEntries(wh.ID(), WebhookOutboxStateFailed)
+		return err == nil && len(failed) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 2, failed[0].Attempts)
+	assert.Contains(t, failed[0].LastError, "503")
+	assert.Equal(t, DocumentChange.String(), failed[0].Event)
+	assert.Empty(t, receiver.received())
+
+	// Replay one entry, and discard the other
+	replayed, err := db.ReplayWebhookOutbox(wh.ID(), failed[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, string(failed[0].Payload), receiver.received()[0])
+
+	discarded, err := db.DiscardWebhookOutbox(wh.ID())
+	require.NoError(t, err)
+	assert.Equal(t, 1, discarded)
+	_, err = db.GetWebhookOutboxEntry(wh.ID(), failed[1].ID)
+	assertHTTPError(t, err, http.StatusNotFound)
+
+	_, err = db.GetWebhookOutboxEntries("unknown", "")
+	assertHTTPError(t, err, http.StatusNotFound)
+	_, err = db.GetWebhookOutboxEntries(wh.ID(), "unknown")
+	assertHTTPError(t, err, http.StatusBadRequest)
+}
+
+// Entries written before a restart are delivered once the webhook is configured again.
+func TestWebhookOutboxResume(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	stopped := &webhookOutbox{bucket: db.Bucket, prefix: base.WebhookOutboxPrefix + base.Sha1HashString(DocumentChange.String()+":"+server.URL, "")[:16], wake: make(chan struct{}, 1)}
+	require.NoError(t, stopped.add(DocumentChange.String(), []byte(`{"n":1}`)))
+
+	newDurableTestWebhook(t, db, server.URL, WebhookDeliveryConfig{Durable: true})
+	require.Eventually(t, func() bool { return len(receiver.received()) == 1 }, 10*time.Second, 10*time.Millisecond)
+}
+
+// Events for durable webhooks are written to the outbox when raised, so aren't lost when the event queue is full.
+func TestWebhookOutboxEventQueueFull(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	// A slow handler, with the smallest queue and no wait, fills the event queue
+	em := db.EventMgr
+	em.Start(1, 0)
+	slowHandler := &TestingHandler{handleDelay: 100, ResultChannel: make(chan interface{}, 100), t: t}
+	em.RegisterEventHandler(slowHandler, DocumentChange)
+	durable := newDurableTestWebhook(t, db, server.URL, WebhookDeliveryConfig{Durable: true})
+
+	const numEvents = 20
+	discarded := 0
+	for i := 0; i < numEvents; i++ {
+		if err := em.RaiseDocumentChangeEvent([]byte(`{"n":`+strconv.Itoa(i)+`}`), "doc", "", nil, true); err != nil {
+			discarded++
+		}
+	}
+	assert.Greater(t, discarded, 0, "expected the event queue to be full")
+
+	require.Eventually(t, func() bool { return len(receiver.received()) == numEvents }, 10*time.Second, 10*time.Millisecond)
+	stats, err := em.GetEventHandlerStats()
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, durable.ID(), stats[1].WebhookID)
+	assert.Equal(t, int64(numEvents), stats[1].Success)
+}
+
+// The outbox index is spread across shard documents, and entries are listed in the order they were added.
+func TestWebhookOutboxIndexShards(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	outbox := &webhookOutbox{bucket: db.Bucket, prefix: base.WebhookOutboxPrefix + "test", wake: make(chan struct{}, 1)}
+	const numEntries = 50
+	for i := 0; i < numEntries; i++ {
+		require.NoError(t, outbox.add(DocumentChange.String(), []byte(`{"n":`+strconv.Itoa(i)+`}`)))
+	}
+	entries, err := outbox.list("")
+	require.NoError(t, err)
+	require.Len(t, entries, numEntries)
+	for i, entry := range entries {
+		assert.Equal(t, `{"n":`+strconv.Itoa(i)+`}`, string(entry.Payload))
+	}
+
+	shards := 0
+	for i := 0; i < webhookOutboxIndexShardCount; i++ {
+		if _, _, err := db.Bucket.GetRaw(outbox.indexShardKeyForIndex(i)); err == nil {
+			shards++
+		}
+	}
+	assert.Greater(t, shards, 1)
+
+	// Shards are removed once empty
+	for _, entry := range entries {
+		require.NoError(t, db.Bucket.Delete(outbox.entryKey(entry.ID)))
+		require.NoError(t, outbox.removeFromIndex(entry.ID))
+	}
+	for i := 0; i < webhookOutboxIndexShardCount; i++ {
+		_, _, err := db.Bucket.GetRaw(outbox.indexShardKeyForIndex(i))
+		assert.True(t, base.IsDocNotFoundError(err))
+	}
+}
+
+func TestWebhookOutboxBackoff(t *testing.T) {
+	outbox := &webhookOutbox{initialBackoff: time.Second, maxBackoff: 5 * time.Second}
+	assert.Equal(t, time.Second, outbox.backoff(1))
+	assert.Equal(t, 2*time.Second, outbox.backoff(2))
+	assert.Equal(t, 4*time.Second, outbox.backoff(3))
+	assert.Equal(t, 5*time.Second, outbox.backoff(4))
+	assert.Equal(t, 5*time.Second, outbox.backoff(100))
+}
+
+func TestEventHandlerStats(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	receiver := &webhookReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	em := db.EventMgr
+	em.Start(0, -1)
+	wh, err := NewWebhook(server.URL, `function(doc) { return doc.n > 1; }`, nil, nil)
+	require.NoError(t, err)
+	em.RegisterEventHandler(wh, DocumentChange)
+	durable := newDurableTestWebhook(t, db, server.URL, WebhookDeliveryConfig{Durable: true})
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, em.RaiseDocumentChangeEvent([]byte(`{"n":`+strconv.Itoa(i)+`}`), "doc", "", nil, true))
+	}
+	require.Eventually(t, func() bool { return len(receiver.received()) == 5 }, 10*time.Second, 10*time.Millisecond)
+	require.NoError(t, em.waitForProcessedTotal(context.TODO(), 6, DefaultWaitForWebhook))
+
+	stats, err := em.GetEventHandlerStats()
+	require.NoError(t, err)
+	require.Len(t, stats, 2)
+	assert.Equal(t, DocumentChange.String(), stats[0].EventType)
+	assert.Equal(t, int64(2), stats[0].Success)
+	assert.Equal(t, int64(1), stats[0].Fail)
+	assert.Empty(t, stats[0].WebhookID)
+	assert.Nil(t, stats[0].Outbox)
+	assert.Equal(t, int64(3), stats[1].Success)
+	assert.Equal(t, durable.ID(), stats[1].WebhookID)
+	require.NotNil(t, stats[1].Outbox)
+}
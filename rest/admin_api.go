@@ -264,11 +264,10 @@ func (h *handler) handleGetDbConfig() error {
 		responseConfig.Sync = nil
 		responseConfig.ImportFilter = nil
 		if responseConfig.EventHandlers != nil {
-			for _, evt := range responseConfig.EventHandlers.DocumentChanged {
-				evt.Filter = ""
-			}
-			for _, evt := range responseConfig.EventHandlers.DBStateChanged {
-				evt.Filter = ""
+			for _, events := range responseConfig.EventHandlers.eventConfigsByType() {
+				for _, evt := range events {
+					evt.Filter = ""
+				}
 			}
 		}
 	}
@@ -1177,6 +1176,8 @@ func marshalPrincipal(princ auth.Principal, includeDynamicGrantInfo bool) ([]byt
 		if includeDynamicGrantInfo {
 			info.Channels = user.InheritedChannels().AsSet()
 			info.RoleNames = user.RoleNames().AllKeys()
+			info.JWTRoleNames = user.JWTRoles().AllKeys()
+			info.JWTChannels = user.JWTChannels().AsSet()
 		}
 	} else {
 		if includeDynamicGrantInfo {
@@ -1253,14 +1254,11 @@ func (h *handler) deleteUser() error {
 			"The %s user cannot be deleted. Only disabled via an update.", base.GuestUsername)
 	}
 
-	user, err := h.db.Authenticator().GetUser(username)
-	if user == nil {
-		if err == nil {
-			err = kNotFoundError
-		}
-		return err
+	err := h.db.DeleteUser(username)
+	if err == base.ErrNotFound {
+		return kNotFoundError
 	}
-	return h.db.Authenticator().DeleteUser(user)
+	return err
 }
 
 func (h *handler) deleteRole() error {
@@ -1507,10 +1505,266 @@ func (h *handler) putReplicationStatus() error {
 		return base.HTTPErrorf(http.StatusBadRequest, "Query parameter 'action' must be specified")
 	}
 
-	updatedStatus, err := h.db.SGReplicateMgr.PutReplicationStatus(replicationID, action)
+	var updatedStatus *db.ReplicationStatus
+	var err error
+	if sinceTime := h.getQuery("since_time"); sinceTime != "" {
+		if action != "reset" {
+			return base.HTTPErrorf(http.StatusBadRequest, "Query parameter 'since_time' is only supported for the reset action")
+		}
+		updatedStatus, err = h.db.SGReplicateMgr.ResetReplicationSince(replicationID, sinceTime)
+	} else {
+		updatedStatus, err = h.db.SGReplicateMgr.PutReplicationStatus(replicationID, action)
+	}
 	if err != nil {
 		return err
 	}
 	h.writeJSON(updatedStatus)
 	return nil
 }
+
+// GET /{db}/_replication/{replicationID}/_deadletter
+func (h *handler) getReplicationDeadLetters() error {
+	replicationID := mux.Vars(h.rq)["replicationID"]
+	entries, err := h.db.SGReplicateMgr.GetDeadLetters(replicationID)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(entries)
+	return nil
+}
+
+// GET /{db}/_replication/{replicationID}/_deadletter/{docid}
+func (h *handler) getReplicationDeadLetter() error {
+	replicationID := mux.Vars(h.rq)["replicationID"]
+	entry, err := h.db.SGReplicateMgr.GetDeadLetter(replicationID, mux.Vars(h.rq)["docid"])
+	if err != nil {
+		return err
+	}
+	h.writeJSON(entry)
+	return nil
+}
+
+// POST /{db}/_replication/{replicationID}/_deadletter/_retry and /{db}/_replication/{replicationID}/_deadletter/{docid}/_retry
+func (h *handler) retryReplicationDeadLetters() error {
+	replicationID := mux.Vars(h.rq)["replicationID"]
+	var docIDs []string
+	if docID := mux.Vars(h.rq)["docid"]; docID != "" {
+		if _, err := h.db.SGReplicateMgr.GetDeadLetter(replicationID, docID); err != nil {
+			return err
+		}
+		docIDs = append(docIDs, docID)
+	}
+	retried, err := h.db.SGReplicateMgr.RetryDeadLetters(replicationID, docIDs...)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"retried": retried})
+	return nil
+}
+
+// DELETE /{db}/_replication/{replicationID}/_deadletter and /{db}/_replication/{replicationID}/_deadletter/{docid}
+func (h *handler) deleteReplicationDeadLetters() error {
+	replicationID := mux.Vars(h.rq)["replicationID"]
+	var docIDs []string
+	if docID := mux.Vars(h.rq)["docid"]; docID != "" {
+		if _, err := h.db.SGReplicateMgr.GetDeadLetter(replicationID, docID); err != nil {
+			return err
+		}
+		docIDs = append(docIDs, docID)
+	}
+	discarded, err := h.db.SGReplicateMgr.DiscardDeadLetters(replicationID, docIDs...)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"discarded": discarded})
+	return nil
+}
+
+// GET /{db}/_event_handlers
+func (h *handler) handleGetEventHandlers() error {
+	stats, err := h.db.EventMgr.GetEventHandlerStats()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(stats)
+	return nil
+}
+
+// GET /{db}/_webhook/{webhookID}/_outbox
+func (h *handler) getWebhookOutbox() error {
+	entries, err := h.db.GetWebhookOutboxEntries(mux.Vars(h.rq)["webhookID"], h.getQuery("state"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(entries)
+	return nil
+}
+
+// GET /{db}/_webhook/{webhookID}/_outbox/{entryID}
+func (h *handler) getWebhookOutboxEntry() error {
+	entry, err := h.db.GetWebhookOutboxEntry(mux.Vars(h.rq)["webhookID"], mux.Vars(h.rq)["entryID"])
+	if err != nil {
+		return err
+	}
+	h.writeJSON(entry)
+	return nil
+}
+
+// POST /{db}/_webhook/{webhookID}/_outbox/_replay and /{db}/_webhook/{webhookID}/_outbox/{entryID}/_replay
+func (h *handler) replayWebhookOutboxEntries() error {
+	webhookID := mux.Vars(h.rq)["webhookID"]
+	var entryIDs []string
+	if entryID := mux.Vars(h.rq)["entryID"]; entryID != "" {
+		if _, err := h.db.GetWebhookOutboxEntry(webhookID, entryID); err != nil {
+			return err
+		}
+		entryIDs = append(entryIDs, entryID)
+	}
+	replayed, err := h.db.ReplayWebhookOutbox(webhookID, entryIDs...)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"replayed": replayed})
+	return nil
+}
+
+// DELETE /{db}/_webhook/{webhookID}/_outbox and /{db}/_webhook/{webhookID}/_outbox/{entryID}
+func (h *handler) deleteWebhookOutboxEntries() error {
+	webhookID := mux.Vars(h.rq)["webhookID"]
+	var entryIDs []string
+	if entryID := mux.Vars(h.rq)["entryID"]; entryID != "" {
+		if _, err := h.db.GetWebhookOutboxEntry(webhookID, entryID); err != nil {
+			return err
+		}
+		entryIDs = append(entryIDs, entryID)
+	}
+	discarded, err := h.db.DiscardWebhookOutbox(webhookID, entryIDs...)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"discarded": discarded})
+	return nil
+}
+
+// GET /{db}/_conflicts
+func (h *handler) handleGetConflicts() error {
+	limit := int(h.getIntQuery("limit", 0))
+	startKey := h.getQuery("startkey")
+
+	var channelFilter base.Set
+	if channelsParam := h.getQuery("channels"); channelsParam != "" {
+		channelFilter = base.SetFromArray(strings.Split(channelsParam, ","))
+	}
+
+	conflicts, err := h.db.GetConflictedDocs(startKey, limit, channelFilter)
+	if err != nil {
+		return err
+	}
+	h.writeJSON(conflicts)
+	return nil
+}
+
+// POST /{db}/_conflicts/_rebuild indexes documents that were in conflict before the conflict index existed
+func (h *handler) handlePostConflictsRebuild() error {
+	conflictedDocs, err := h.db.RebuildConflictIndex()
+	if err != nil {
+		return err
+	}
+	h.writeJSON(db.Body{"conflicted_docs": conflictedDocs})
+	return nil
+}
+
+// POST /{db}/{docid}/_resolve
+func (h *handler) handleResolveConflict() error {
+	docid := h.PathVar("docid")
+
+	var input struct {
+		Winner string  `json:"winner"`
+		Merged db.Body `json:"merged"`
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	if input.Winner == "" && input.Merged == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "Either winner or merged must be specified")
+	}
+
+	newRev, err := h.db.ResolveConflict(docid, input.Winner, input.Merged)
+	if err != nil {
+		return err
+	}
+	h.writeRawJSONStatus(http.StatusCreated, []byte(`{"id":`+base.ConvertToJSONString(docid)+`,"ok":true,"rev":"`+newRev+`"}`))
+	return nil
+}
+
+// PUT /{db}/_subscription/{name}
+func (h *handler) handlePutChangesSubscription() error {
+	var input struct {
+		db.ChangesSubscriptionConfig
+		Since     *db.SequenceID `json:"since"`
+		SinceTime string         `json:"since_time"`
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	if input.SinceTime != "" {
+		if input.Since != nil {
+			return errSinceAndSinceTime
+		}
+		since, err := h.db.ParseSinceTime(input.SinceTime)
+		if err != nil {
+			return err
+		}
+		input.Since = &since
+	}
+
+	created, err := h.db.PutChangesSubscription(h.PathVar("name"), input.ChangesSubscriptionConfig, input.Since)
+	if err != nil {
+		return err
+	}
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	h.writeRawJSONStatus(status, []byte(`{"ok":true}`))
+	return nil
+}
+
+// GET /{db}/_subscription/{name}
+func (h *handler) handleGetChangesSubscription() error {
+	status, err := h.db.GetChangesSubscriptionStatus(h.PathVar("name"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(status)
+	return nil
+}
+
+// DELETE /{db}/_subscription/{name}
+func (h *handler) handleDeleteChangesSubscription() error {
+	return h.db.DeleteChangesSubscription(h.PathVar("name"))
+}
+
+// POST /{db}/_subscription/{name}/_read
+func (h *handler) handleReadChangesSubscription() error {
+	batch, err := h.db.ReadChangesSubscription(h.PathVar("name"), h.getQuery("consumer"))
+	if err != nil {
+		return err
+	}
+	h.writeJSON(batch)
+	return nil
+}
+
+// POST /{db}/_subscription/{name}/_ack
+func (h *handler) handleAckChangesSubscription() error {
+	var input struct {
+		Seq *db.SequenceID `json:"seq"`
+	}
+	if err := h.readJSONInto(&input); err != nil {
+		return err
+	}
+	if input.Seq == nil {
+		return base.HTTPErrorf(http.StatusBadRequest, "seq must be specified")
+	}
+	return h.db.AckChangesSubscription(h.PathVar("name"), *input.Seq)
+}
@@ -67,3 +67,18 @@ var (
 	PermDevOps               = Permission{".sgw.dev_ops!all", false}
 	PermStatsExport          = Permission{".admin.stats_export!read", false}
 )
+
+// allPermissions are the permissions that can be granted to local admin users.
+var allPermissions = []Permission{PermCreateDb, PermDeleteDb, PermUpdateDb, PermConfigureSyncFn, PermConfigureAuth,
+	PermWritePrincipal, PermReadPrincipal, PermReadAppData, PermReadPrincipalAppData, PermWriteAppData,
+	PermWriteReplications, PermReadReplications, PermDevOps, PermStatsExport}
+
+// permissionFromName returns the permission with the given name, without the leading period, e.g. sgw.db!create.
+func permissionFromName(name string) (Permission, bool) {
+	for _, perm := range allPermissions {
+		if perm.PermissionName == "."+name {
+			return perm, true
+		}
+	}
+	return Permission{}, false
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/couchbase/sync_gateway/base"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func MakeUser(t *testing.T, httpClient *http.Client, serverURL, username, password string, roles []string) {
@@ -572,6 +573,62 @@ func TestAdminAPIAuth(t *testing.T) {
 			Method:   "DELETE",
 			DBScoped: true,
 			Endpoint: "/_user/user/_session/id",
+		}, {
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_user/user/_devices",
+		}, {
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_user/user/_devices",
+		}, {
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_user/user/_devices/token",
+		}, {
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_user/user/_apikey",
+		}, {
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_user/user/_apikey",
+		}, {
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_user/user/_apikey/id",
+		}, {
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_user/user/_apikey/id",
+		}, {
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_user/user/_mfa",
+		}, {
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_user/user/_mfa",
+		}, {
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_user/user/_mfa",
+		}, {
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_user/user/_mfa/verify",
+		}, {
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_user/user/_mfa/recovery_codes",
+		}, {
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_user/user/_lockout",
+		}, {
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_user/user/_lockout",
 		},
 		{
 			Method:   "GET",
@@ -617,6 +674,36 @@ func TestAdminAPIAuth(t *testing.T) {
 			DBScoped: true,
 			Endpoint: "/_replication/id",
 		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter",
+		},
+		{
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter/_retry",
+		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter/doc",
+		},
+		{
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter/doc",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_replication/id/_deadletter/doc/_retry",
+		},
 		{
 			Method:   "GET",
 			DBScoped: true,
@@ -754,6 +841,76 @@ func TestAdminAPIAuth(t *testing.T) {
 			DBScoped: true,
 			Endpoint: "/_purge",
 		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_conflicts",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/doc/_resolve",
+		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_subscription/sub1",
+		},
+		{
+			Method:   "PUT",
+			DBScoped: true,
+			Endpoint: "/_subscription/sub1",
+		},
+		{
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_subscription/sub1",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_subscription/sub1/_read",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_subscription/sub1/_ack",
+		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_event_handlers",
+		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox",
+		},
+		{
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox/_replay",
+		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox/entry1",
+		},
+		{
+			Method:   "DELETE",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox/entry1",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_webhook/wh1/_outbox/entry1/_replay",
+		},
 		{
 			Method:   "POST",
 			DBScoped: true,
@@ -810,6 +967,16 @@ func TestAdminAPIAuth(t *testing.T) {
 			DBScoped: true,
 			Endpoint: "/_compact",
 		},
+		{
+			Method:   "GET",
+			DBScoped: true,
+			Endpoint: "/_attachment_migration",
+		},
+		{
+			Method:   "POST",
+			DBScoped: true,
+			Endpoint: "/_attachment_migration",
+		},
 		{
 			Method:          "GET",
 			DBScoped:        true,
@@ -1259,6 +1426,76 @@ func TestNewlyCreateSGWPermissions(t *testing.T) {
 			Endpoint: "/db/_user/user/_session/session",
 			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
 		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_user/user/_devices",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_user/user/_devices",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_user/user/_devices/token",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_user/user/_apikey",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_user/user/_apikey",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_user/user/_apikey/id",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_user/user/_apikey/id",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_user/user/_mfa",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_user/user/_mfa",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_user/user/_mfa",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_user/user/_mfa/verify",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_user/user/_mfa/recovery_codes",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_user/user/_lockout",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_user/user/_lockout",
+			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
+		},
 		{
 			Method:   "GET",
 			Endpoint: "/db/_role/",
@@ -1284,6 +1521,21 @@ func TestNewlyCreateSGWPermissions(t *testing.T) {
 			Endpoint: "/db/_role/role",
 			Users:    []string{syncGatewayConfigurator, syncGatewayApp},
 		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_replication/repl/_deadletter",
+			Users:    []string{syncGatewayReplicator},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_replication/repl/_deadletter/_retry",
+			Users:    []string{syncGatewayReplicator},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_replication/repl/_deadletter/doc",
+			Users:    []string{syncGatewayReplicator},
+		},
 		{
 			Method:   "GET",
 			Endpoint: "/db/_replicationStatus/",
@@ -1434,6 +1686,76 @@ func TestNewlyCreateSGWPermissions(t *testing.T) {
 			Endpoint: "/db/_purge",
 			Users:    []string{syncGatewayApp},
 		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_conflicts",
+			Users:    []string{syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/doc/_resolve",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_subscription/sub1",
+			Users:    []string{syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "PUT",
+			Endpoint: "/db/_subscription/sub1",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_subscription/sub1",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_subscription/sub1/_read",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_subscription/sub1/_ack",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_event_handlers",
+			Users:    []string{syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_webhook/wh1/_outbox",
+			Users:    []string{syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_webhook/wh1/_outbox",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_webhook/wh1/_outbox/_replay",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_webhook/wh1/_outbox/entry1",
+			Users:    []string{syncGatewayApp, syncGatewayAppRo},
+		},
+		{
+			Method:   "DELETE",
+			Endpoint: "/db/_webhook/wh1/_outbox/entry1",
+			Users:    []string{syncGatewayApp},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_webhook/wh1/_outbox/entry1/_replay",
+			Users:    []string{syncGatewayApp},
+		},
 		{
 			Method:   "POST",
 			Endpoint: "/db/_flush",
@@ -1479,6 +1801,16 @@ func TestNewlyCreateSGWPermissions(t *testing.T) {
 			Endpoint: "/db/_compact",
 			Users:    []string{syncGatewayConfigurator},
 		},
+		{
+			Method:   "GET",
+			Endpoint: "/db/_attachment_migration",
+			Users:    []string{syncGatewayConfigurator},
+		},
+		{
+			Method:   "POST",
+			Endpoint: "/db/_attachment_migration",
+			Users:    []string{syncGatewayConfigurator},
+		},
 		{
 			Method:   "DELETE",
 			Endpoint: "/db/",
@@ -1542,3 +1874,87 @@ func TestCreateDBSpecificBucketPerm(t *testing.T) {
 	resp := rt.SendAdminRequestWithAuth("PUT", "/db2/", `{"bucket": "`+tb.GetName()+`", "username": "`+base.TestClusterUsername()+`", "password": "`+base.TestClusterPassword()+`", "num_index_replicas": 0, "use_views": `+strconv.FormatBool(base.TestsDisableGSI())+`}`, mobileSyncGateway, "password")
 	assertStatus(t, resp, http.StatusCreated)
 }
+
+func TestLocalAdminUsers(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	rt := NewRestTester(t, &RestTesterConfig{
+		adminInterfaceAuthentication: true,
+		localAdminUsers: LocalAdminUsersConfig{
+			"reader": {PasswordHash: string(passwordHash), Permissions: map[string][]string{"db": {"sgw.principal!read"}}},
+			"ops":    {PasswordHash: string(passwordHash), Permissions: map[string][]string{"*": {"sgw.dev_ops!all", "sgw.principal!write"}}},
+			"admin":  {PasswordHash: string(passwordHash), Permissions: map[string][]string{"*": {"*"}}},
+		},
+	})
+	defer rt.Close()
+
+	testCases := []struct {
+		method, endpoint, body string
+		username, password     string
+		expectedStatus         int
+	}{
+		{"GET", "/db/_user/", "", "", "", http.StatusUnauthorized},
+		{"GET", "/db/_user/", "", "reader", "wrong", http.StatusUnauthorized},
+		{"GET", "/db/_user/", "", "reader", "password", http.StatusOK},
+		{"PUT", "/db/_user/alice", `{"password": "letmein"}`, "reader", "password", http.StatusForbidden},
+		{"GET", "/db/", "", "reader", "password", http.StatusForbidden},
+		{"GET", "/db/", "", "ops", "password", http.StatusOK},
+		{"PUT", "/db/_user/alice", `{"password": "letmein"}`, "ops", "password", http.StatusCreated},
+		{"GET", "/db/_user/", "", "ops", "password", http.StatusForbidden},
+		{"GET", "/db/_user/alice", "", "admin", "password", http.StatusOK},
+		{"GET", "/_expvar", "", "admin", "password", http.StatusOK},
+		// Local admin users can't determine whether a database exists without being authenticated
+		{"GET", "/missing/", "", "reader", "wrong", http.StatusUnauthorized},
+		{"GET", "/missing/", "", "reader", "password", http.StatusForbidden},
+		// Users that aren't local admin users are authenticated against the server, which isn't possible with walrus
+		{"GET", "/db/_user/", "", "unknown", "password", http.StatusUnauthorized},
+	}
+	for _, testCase := range testCases {
+		t.Run(fmt.Sprintf("%s %s as %q", testCase.method, testCase.endpoint, testCase.username), func(t *testing.T) {
+			if testCase.username == "unknown" && !base.UnitTestUrlIsWalrus() {
+				t.Skip("Only walrus rejects users that aren't local admin users")
+			}
+			resp := rt.SendAdminRequestWithAuth(testCase.method, testCase.endpoint, testCase.body, testCase.username, testCase.password)
+			assertStatus(t, resp, testCase.expectedStatus)
+		})
+	}
+
+	// Response permissions are checked against the local admin user's permissions
+	resp := rt.SendAdminRequestWithAuth("GET", "/db/_user/alice", "", "reader", "password")
+	assertStatus(t, resp, http.StatusOK)
+	assert.NotContains(t, string(resp.BodyBytes()), "all_channels")
+	resp = rt.SendAdminRequestWithAuth("GET", "/db/_user/alice", "", "admin", "password")
+	assertStatus(t, resp, http.StatusOK)
+	assert.Contains(t, string(resp.BodyBytes()), "all_channels")
+}
+
+func TestLocalAdminUserConfigValidate(t *testing.T) {
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name          string
+		username      string
+		user          *LocalAdminUserConfig
+		expectedError string
+	}{
+		{"valid", "ops", &LocalAdminUserConfig{PasswordHash: string(passwordHash), Permissions: map[string][]string{"*": {"*", "sgw.dev_ops!all"}, "db": {"sgw.appdata!read"}}}, ""},
+		{"no username", "", &LocalAdminUserConfig{PasswordHash: string(passwordHash)}, "must have a username"},
+		{"null", "ops", nil, "must not be null"},
+		{"plain text password", "ops", &LocalAdminUserConfig{PasswordHash: "password"}, "must have a bcrypt password_hash"},
+		{"unknown permission", "ops", &LocalAdminUserConfig{PasswordHash: string(passwordHash), Permissions: map[string][]string{"*": {"sgw.everything"}}}, `unknown permission "sgw.everything"`},
+		{"database scoped cluster permission", "ops", &LocalAdminUserConfig{PasswordHash: string(passwordHash), Permissions: map[string][]string{"db": {"sgw.dev_ops!all"}}}, "can't be granted for a single database"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			err := testCase.user.validate(testCase.username)
+			if testCase.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), testCase.expectedError)
+			}
+		})
+	}
+}
@@ -11,6 +11,11 @@ package rest
 import (
 	"bufio"
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -2618,6 +2623,48 @@ func TestConfigRedaction(t *testing.T) {
 	assert.Equal(t, base.RedactedStr, unmarshaledServerConfig.Bootstrap.Password)
 }
 
+func TestWebhookOptionsConfigRedaction(t *testing.T) {
+	require.NoError(t, os.Setenv("SG_TEST_WEBHOOK_TOKEN", "envtoken"))
+	defer func() { _ = os.Unsetenv("SG_TEST_WEBHOOK_TOKEN") }()
+
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{EventHandlers: &EventHandlerConfig{
+		DocumentChanged: []*EventConfig{{
+			HandlerType: "webhook",
+			Url:         "http://localhost:8081/changed",
+			Options: map[string]interface{}{
+				db.EventOptionMethod:        "PUT",
+				db.EventOptionHeaders:       map[string]interface{}{"X-Static": "static"},
+				db.EventOptionSecretHeaders: map[string]interface{}{"X-Api-Key": "secretkey", "X-Env-Key": "env:SG_TEST_WEBHOOK_TOKEN"},
+				db.EventOptionBearerToken:   "env:SG_TEST_WEBHOOK_TOKEN",
+			},
+		}},
+		DBStateChanged: []*EventConfig{{
+			HandlerType: "webhook",
+			Url:         "http://localhost:8081/state",
+			Options: map[string]interface{}{
+				db.EventOptionBasicAuth: map[string]interface{}{"username": "alice", "password": "letmein"},
+			},
+		}},
+	}}}})
+	defer rt.Close()
+
+	var config DbConfig
+	response := rt.SendAdminRequest("GET", "/db/_config", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, json.Unmarshal(response.BodyBytes(), &config))
+
+	options := config.EventHandlers.DocumentChanged[0].Options
+	assert.Equal(t, "PUT", options[db.EventOptionMethod])
+	assert.Equal(t, map[string]interface{}{"X-Static": "static"}, options[db.EventOptionHeaders])
+	assert.Equal(t, map[string]interface{}{"X-Api-Key": base.RedactedStr, "X-Env-Key": "env:SG_TEST_WEBHOOK_TOKEN"}, options[db.EventOptionSecretHeaders])
+	assert.Equal(t, "env:SG_TEST_WEBHOOK_TOKEN", options[db.EventOptionBearerToken])
+	assert.Equal(t, map[string]interface{}{"username": "alice", "password": base.RedactedStr}, config.EventHandlers.DBStateChanged[0].Options[db.EventOptionBasicAuth])
+
+	// Options for other handler types are still rejected
+	err := validateEventConfigOptions(db.DBStateChange, &EventConfig{HandlerType: "broker", Options: map[string]interface{}{db.EventOptionMethod: "PUT"}})
+	assert.Error(t, err)
+}
+
 // Reproduces panic seen in CBG-1053
 func TestAdhocReplicationStatus(t *testing.T) {
 	defer base.SetUpTestLogging(base.LevelDebug, base.KeyAll, base.KeyReplicate)()
@@ -4563,3 +4610,552 @@ func TestReplicatorCheckpointOnStop(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, seq, config.LastSeq)
 }
+
+func TestConflictsAPI(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	// Create a doc with an attachment, then two conflicting branches that both retain the attachment
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"channels":["A"], "_attachments":{"att":{"data":"aGVsbG8="}}}`)
+	assertStatus(t, response, http.StatusCreated)
+	var body db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	_, revIDHash := db.ParseRevID(body["rev"].(string))
+	response = rt.SendAdminRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	digest := body[db.BodyAttachments].(map[string]interface{})["att"].(map[string]interface{})["digest"].(string)
+
+	for _, branch := range []struct{ hash, channel string }{{"a", "A"}, {"b", "B"}} {
+		response = rt.SendAdminRequest("PUT", "/db/doc1?new_edits=false", fmt.Sprintf(
+			`{"branch":%q, "channels":[%q], "_attachments":{"att":{"stub":true,"revpos":1,"digest":%q}}, "_revisions":{"start":2, "ids":[%q, %q]}}`,
+			branch.hash, branch.channel, digest, branch.hash, revIDHash))
+		assertStatus(t, response, http.StatusCreated)
+	}
+	response = rt.SendAdminRequest("PUT", "/db/doc2", `{"channels":["A"]}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	// List conflicts, with and without a channel filter
+	var conflicts db.ConflictedDocs
+	response = rt.SendAdminRequest("GET", "/db/_conflicts", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &conflicts))
+	require.Len(t, conflicts.Rows, 1)
+	assert.Equal(t, "doc1", conflicts.Rows[0].DocID)
+	assert.Equal(t, "2-b", conflicts.Rows[0].RevID)
+	assert.Equal(t, []string{"2-a"}, conflicts.Rows[0].Conflicts)
+	assert.Equal(t, []string{"A", "B"}, conflicts.Rows[0].Channels)
+
+	response = rt.SendAdminRequest("GET", "/db/_conflicts?channels=C&limit=10", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &conflicts))
+	assert.Len(t, conflicts.Rows, 0)
+
+	// Rebuilding the index finds existing conflicts
+	response = rt.SendAdminRequest("POST", "/db/_conflicts/_rebuild", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.JSONEq(t, `{"conflicted_docs":1}`, response.Body.String())
+
+	// Invalid resolve requests
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/doc1/_resolve", `{}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/doc1/_resolve", `{"winner":"1-`+revIDHash+`"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/doc2/_resolve", `{"winner":"1-abc"}`), http.StatusConflict)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/missing/_resolve", `{"winner":"1-abc"}`), http.StatusNotFound)
+
+	// Resolve with the non-winning branch, retaining its attachment
+	response = rt.SendAdminRequest("POST", "/db/doc1/_resolve", `{"winner":"2-a"}`)
+	assertStatus(t, response, http.StatusCreated)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	resolvedRevID := body["rev"].(string)
+
+	response = rt.SendAdminRequest("GET", "/db/doc1", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, resolvedRevID, body[db.BodyRev])
+	assert.Equal(t, "a", body["branch"])
+	response = rt.SendAdminRequest("GET", "/db/doc1/att", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, "hello", response.Body.String())
+
+	response = rt.SendAdminRequest("GET", "/db/_conflicts", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &conflicts))
+	assert.Len(t, conflicts.Rows, 0)
+	assert.Equal(t, int64(1), rt.GetDatabase().DbStats.Database().ConflictsResolvedCount.Value())
+}
+
+func TestPushDevicesAPI(t *testing.T) {
+
+	pushGateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pushGateway.Close()
+
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		PushNotifications: &PushNotificationsConfig{GatewayURL: pushGateway.URL},
+	}}})
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["A"]}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	// Admin API
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_devices", `{"token":"abc"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_devices", `{"token":"abc", "platform":"sms"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/missing/_devices", `{"token":"abc", "platform":"fcm"}`), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_devices", `{"token":"abc", "platform":"fcm"}`), http.StatusCreated)
+
+	var devices []auth.PushDevice
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_devices", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &devices))
+	require.Len(t, devices, 1)
+	assert.Equal(t, "abc", devices[0].Token)
+	assert.Equal(t, auth.PushPlatformFCM, devices[0].Platform)
+
+	// Devices are retained when the user is updated
+	response = rt.SendAdminRequest("PUT", "/db/_user/alice", `{"admin_channels":["A", "B"]}`)
+	assertStatus(t, response, http.StatusOK)
+
+	// Public API, for the authenticated user
+	assertStatus(t, rt.Send(request("GET", "/db/_devices", "")), http.StatusUnauthorized)
+	assertStatus(t, rt.Send(requestByUser("POST", "/db/_devices", `{"token":"def", "platform":"apns"}`, "alice")), http.StatusCreated)
+	response = rt.Send(requestByUser("GET", "/db/_devices", "", "alice"))
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &devices))
+	require.Len(t, devices, 2)
+	assert.Equal(t, "abc", devices[0].Token)
+	assert.Equal(t, "def", devices[1].Token)
+
+	assertStatus(t, rt.Send(requestByUser("DELETE", "/db/_devices/abc", "", "alice")), http.StatusOK)
+	assertStatus(t, rt.Send(requestByUser("DELETE", "/db/_devices/abc", "", "alice")), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_devices/def", ""), http.StatusOK)
+
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_devices", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, "[]", string(response.BodyBytes()))
+}
+
+func TestPushDevicesAPINotEnabled(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_devices", `{"token":"abc", "platform":"fcm"}`), http.StatusNotFound)
+	assertStatus(t, rt.Send(requestByUser("POST", "/db/_devices", `{"token":"abc", "platform":"fcm"}`, "alice")), http.StatusNotFound)
+}
+
+func TestAPIKeysAPI(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	response := rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["A", "B"]}`)
+	assertStatus(t, response, http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/docA", `{"channels":["A"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/docB", `{"channels":["B"]}`), http.StatusCreated)
+
+	// Admin API
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_apikey", `{}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/missing/_apikey", `{"name":"job"}`), http.StatusNotFound)
+	response = rt.SendAdminRequest("POST", "/db/_user/alice/_apikey", `{"name":"job", "scopes":{"read_only":true, "channels":["A"]}}`)
+	assertStatus(t, response, http.StatusCreated)
+	var created struct {
+		auth.APIKey
+		Key string `json:"key"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &created))
+	require.NotEmpty(t, created.Key)
+	assert.Equal(t, "job", created.Name)
+	assert.Empty(t, created.Hash)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/alice/_apikey", `{"name":"job"}`), http.StatusConflict)
+
+	apiKeyHeaders := map[string]string{"Authorization": "ApiKey " + created.Key}
+
+	// The key can read documents in its channels, but not write
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docA", "", apiKeyHeaders), http.StatusOK)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docB", "", apiKeyHeaders), http.StatusForbidden)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/docC", `{"channels":["A"]}`, apiKeyHeaders), http.StatusForbidden)
+	assertStatus(t, rt.SendRequestWithHeaders("POST", "/db/_session", `{}`, apiKeyHeaders), http.StatusForbidden)
+	response = rt.SendRequestWithHeaders("GET", "/db/_changes", "", apiKeyHeaders)
+	assertStatus(t, response, http.StatusOK)
+	var changes changesResults
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	var changedIDs []string
+	for _, change := range changes.Results {
+		changedIDs = append(changedIDs, change.ID)
+	}
+	assert.Equal(t, []string{"_user/alice", "docA"}, changedIDs)
+
+	// Invalid keys are rejected
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docA", "", map[string]string{"Authorization": "ApiKey " + created.Key + "x"}), http.StatusUnauthorized)
+
+	// Keys can be listed and retrieved without their hashes, and record when they were last used
+	var keys []auth.APIKey
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_apikey", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &keys))
+	require.Len(t, keys, 1)
+	assert.Equal(t, created.ID, keys[0].ID)
+	assert.Empty(t, keys[0].Hash)
+	assert.NotNil(t, keys[0].LastUsed)
+	assert.Equal(t, []string{"A"}, keys[0].Scopes.Channels)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_apikey/"+created.ID, ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_apikey/unknown", ""), http.StatusNotFound)
+
+	// Keys are retained when the user is updated
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"admin_channels":["A", "B", "C"]}`), http.StatusOK)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docA", "", apiKeyHeaders), http.StatusOK)
+
+	// Unscoped keys have the same access as the user
+	response = rt.SendAdminRequest("POST", "/db/_user/alice/_apikey", `{"name":"full", "expiry":"2100-01-01T00:00:00Z"}`)
+	assertStatus(t, response, http.StatusCreated)
+	var full struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &full))
+	fullHeaders := map[string]string{"Authorization": "ApiKey " + full.Key}
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docB", "", fullHeaders), http.StatusOK)
+	assertStatus(t, rt.SendRequestWithHeaders("PUT", "/db/docC", `{"channels":["A"]}`, fullHeaders), http.StatusCreated)
+
+	// Revoked keys can't be used
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_apikey/"+created.ID, ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_apikey/"+created.ID, ""), http.StatusNotFound)
+	assertStatus(t, rt.SendRequestWithHeaders("GET", "/db/docA", "", apiKeyHeaders), http.StatusUnauthorized)
+}
+
+func TestMFASessionLogin(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		MFA: &MFAConfig{EncryptionKey: base64.StdEncoding.EncodeToString(make([]byte, 32))},
+	}}})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), http.StatusCreated)
+	mfaFailedCount := rt.GetDatabase().DbStats.Security().MFAFailedCount
+
+	// Enrollment is pending until verified, so doesn't affect logins
+	response := rt.SendUserRequestWithHeaders("POST", "/db/_mfa", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusCreated)
+	var enrollment auth.MFAEnrollment
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &enrollment))
+	assert.Contains(t, enrollment.URI, "otpauth://totp/")
+	response = rt.SendUserRequestWithHeaders("GET", "/db/_mfa", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusOK)
+	assert.JSONEq(t, `{"enabled":false, "pending":true, "recovery_codes_remaining":0}`, response.Body.String())
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), http.StatusOK)
+
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_mfa/verify", `{"code":"abcdef"}`, nil, "alice", "letmein"), http.StatusUnauthorized)
+	assert.Equal(t, int64(1), mfaFailedCount.Value())
+	response = rt.SendUserRequestWithHeaders("POST", "/db/_mfa/verify", `{"code":"`+testTOTPCode(t, enrollment.Secret)+`"}`, nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusOK)
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &recovery))
+	require.Len(t, recovery.RecoveryCodes, 10)
+
+	// Once enabled, basic auth is rejected and password logins need a second step
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusUnauthorized)
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`)
+	assertStatus(t, response, http.StatusAccepted)
+	assert.Empty(t, response.Header().Get("Set-Cookie"))
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &challenge))
+	assert.True(t, challenge.MFARequired)
+	require.NotEmpty(t, challenge.MFAToken)
+
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"mfa_token":"`+challenge.MFAToken+`", "code":"000000x"}`), http.StatusUnauthorized)
+	assert.Equal(t, int64(2), mfaFailedCount.Value())
+	response = rt.SendRequest("POST", "/db/_session", `{"mfa_token":"`+challenge.MFAToken+`", "code":"`+recovery.RecoveryCodes[0]+`"}`)
+	assertStatus(t, response, http.StatusOK)
+	cookie := response.Header().Get("Set-Cookie")
+	require.NotEmpty(t, cookie)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"mfa_token":"`+challenge.MFAToken+`", "code":"`+recovery.RecoveryCodes[1]+`"}`), http.StatusUnauthorized)
+
+	cookieHeaders := map[string]string{"Cookie": cookie}
+	response = rt.SendRequestWithHeaders("GET", "/db/_mfa", "", cookieHeaders)
+	assertStatus(t, response, http.StatusOK)
+	assert.JSONEq(t, `{"enabled":true, "pending":false, "recovery_codes_remaining":9}`, response.Body.String())
+
+	// A session alone isn't enough to change MFA settings
+	assertStatus(t, rt.SendRequestWithHeaders("POST", "/db/_mfa/recovery_codes", `{"code":"000000"}`, cookieHeaders), http.StatusUnauthorized)
+	assertStatus(t, rt.SendRequestWithHeaders("DELETE", "/db/_mfa", `{}`, cookieHeaders), http.StatusUnauthorized)
+	assert.Equal(t, int64(4), mfaFailedCount.Value())
+	response = rt.SendRequestWithHeaders("POST", "/db/_mfa/recovery_codes", `{"code":"`+recovery.RecoveryCodes[1]+`"}`, cookieHeaders)
+	assertStatus(t, response, http.StatusOK)
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_mfa", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.JSONEq(t, `{"enabled":true, "pending":false, "recovery_codes_remaining":10}`, response.Body.String())
+
+	// Disabling MFA, e.g. after losing the authenticator, allows basic auth again
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_mfa", ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_mfa", ""), http.StatusNotFound)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusOK)
+}
+
+func TestMFARequired(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		MFA: &MFAConfig{EncryptionKey: base64.StdEncoding.EncodeToString(make([]byte, 32)), Required: base.BoolPtr(true)},
+	}}})
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password":"letmein"}`), http.StatusCreated)
+
+	// Users that haven't enrolled can't create sessions, but can use basic auth to enroll
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"bob", "password":"letmein"}`), http.StatusForbidden)
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_session", `{}`, nil, "bob", "letmein"), http.StatusForbidden)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "bob", "letmein"), http.StatusOK)
+
+	response := rt.SendAdminRequest("POST", "/db/_user/bob/_mfa", "")
+	assertStatus(t, response, http.StatusCreated)
+	var enrollment auth.MFAEnrollment
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &enrollment))
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/bob/_mfa", ""), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/bob/_mfa/verify", `{"code":"`+testTOTPCode(t, enrollment.Secret)+`"}`), http.StatusUnauthorized)
+	response = rt.SendAdminRequest("POST", "/db/_user/bob/_mfa", "")
+	assertStatus(t, response, http.StatusCreated)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &enrollment))
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/bob/_mfa/verify", `{"code":"`+testTOTPCode(t, enrollment.Secret)+`"}`), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_user/bob/_mfa", ""), http.StatusConflict)
+
+	response = rt.SendRequest("POST", "/db/_session", `{"name":"bob", "password":"letmein"}`)
+	assertStatus(t, response, http.StatusAccepted)
+}
+
+func TestMFANotConfigured(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), http.StatusCreated)
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_mfa", "", nil, "alice", "letmein"), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/alice/_mfa", ""), http.StatusBadRequest)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), http.StatusOK)
+}
+
+func TestUserLockout(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		Lockout: &LockoutConfig{MaxFailedAttempts: base.Uint32Ptr(3)},
+	}}})
+	defer rt.Close()
+
+	lockoutCount := rt.GetDatabase().DbStats.Security().LockoutCount
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein"}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_user/nobody/_lockout", ""), http.StatusNotFound)
+
+	// Failed logins via basic auth and _session count towards the same lockout
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "wrong"), http.StatusUnauthorized)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"wrong"}`), http.StatusUnauthorized)
+	response := rt.SendAdminRequest("GET", "/db/_user/alice/_lockout", "")
+	assertStatus(t, response, http.StatusOK)
+	var state auth.LockoutState
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &state))
+	assert.Equal(t, uint(2), state.FailedAttempts)
+	assert.False(t, state.Locked)
+
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "wrong"), http.StatusUnauthorized)
+	assert.Equal(t, int64(1), lockoutCount.Value())
+
+	// Locked out users can't log in with the correct password, including for BLIP connections
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusTooManyRequests)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), http.StatusTooManyRequests)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/_blipsync", "", nil, "alice", "letmein"), http.StatusTooManyRequests)
+	response = rt.SendAdminRequest("GET", "/db/_user/alice/_lockout", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &state))
+	assert.True(t, state.Locked)
+	assert.Equal(t, uint(1), state.Lockouts)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_user/alice/_lockout", ""), http.StatusOK)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusOK)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"letmein"}`), http.StatusOK)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		PasswordPolicy: &PasswordPolicyConfig{MinLength: base.Uint32Ptr(8), RequireDigit: base.BoolPtr(true), HistoryCount: base.Uint32Ptr(1)},
+	}}})
+	defer rt.Close()
+
+	// New passwords set via the admin API must meet the policy, but unchanged passwords are allowed
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"short1"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password1"}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"password1", "admin_channels":["a"]}`), http.StatusOK)
+
+	// Users can change their own password, identified by their login or name
+	assertStatus(t, rt.SendRequest("POST", "/db/_user/me/_password", `{"old_password":"password1", "new_password":"password2"}`), http.StatusUnauthorized)
+	assertStatus(t, rt.SendRequest("POST", "/db/_user/me/_password", `{"name":"alice", "old_password":"wrong", "new_password":"password2"}`), http.StatusUnauthorized)
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_user/me/_password", `{"old_password":"password1", "new_password":"weak"}`, nil, "alice", "password1"), http.StatusBadRequest)
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_user/me/_password", `{"name":"bob", "old_password":"password1", "new_password":"password2"}`, nil, "alice", "password1"), http.StatusForbidden)
+	assertStatus(t, rt.SendUserRequestWithHeaders("POST", "/db/_user/me/_password", `{"old_password":"password1", "new_password":"password2"}`, nil, "alice", "password1"), http.StatusOK)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "password2"), http.StatusOK)
+	response := rt.SendRequest("POST", "/db/_user/me/_password", `{"name":"alice", "old_password":"password2", "new_password":"password1"}`)
+	assertStatus(t, response, http.StatusBadRequest)
+	assert.Contains(t, response.Body.String(), "Password has been used recently")
+
+	// Once the password has expired, logins are rejected until it's changed
+	rt.GetDatabase().Options.PasswordPolicyOptions.MaxAge = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "password2"), http.StatusForbidden)
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"password2"}`), http.StatusForbidden)
+	assertStatus(t, rt.SendRequest("POST", "/db/_user/me/_password", `{"name":"alice", "old_password":"password2", "new_password":"password3"}`), http.StatusOK)
+	rt.GetDatabase().Options.PasswordPolicyOptions.MaxAge = time.Hour
+	assertStatus(t, rt.SendRequest("POST", "/db/_session", `{"name":"alice", "password":"password3"}`), http.StatusOK)
+}
+
+func TestSignup(t *testing.T) {
+	messages := make(chan db.AccountMessage, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message db.AccountMessage
+		require.NoError(t, base.JSONDecoder(r.Body).Decode(&message))
+		messages <- message
+	}))
+	defer server.Close()
+	nextMessage := func(expectedType auth.AccountTokenType) db.AccountMessage {
+		select {
+		case message := <-messages:
+			require.Equal(t, expectedType, message.Type)
+			return message
+		case <-time.After(10 * time.Second):
+			t.Fatal("Timed out waiting for account message")
+		}
+		return db.AccountMessage{}
+	}
+
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		Signup: &SignupConfig{
+			DefaultChannels: []string{"public"},
+			LinkURL:         "https://example.com/verify?token={token}",
+			Sender:          &AccountMessageSenderConfig{Type: "webhook", WebhookURL: server.URL},
+		},
+	}}})
+	defer rt.Close()
+
+	// Signing up creates a disabled user, and sends a verification token
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup", `{"name":"alice", "email":"not an email", "password":"letmein"}`), http.StatusBadRequest)
+	response := rt.SendRequest("POST", "/db/_signup", `{"name":"alice", "email":"alice@example.com", "password":"letmein"}`)
+	assertStatus(t, response, http.StatusAccepted)
+	var body db.Body
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &body))
+	assert.Equal(t, true, body["verification_required"])
+	message := nextMessage(auth.AccountTokenVerifyEmail)
+	assert.Equal(t, "alice", message.Username)
+	assert.Equal(t, "alice@example.com", message.Email)
+	assert.Equal(t, "https://example.com/verify?token="+message.Token, message.Link)
+
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup", `{"name":"alice", "email":"alice2@example.com", "password":"letmein"}`), http.StatusConflict)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusUnauthorized)
+
+	// Signing up with a registered address looks the same as a new signup, but the existing user is sent the token
+	response = rt.SendRequest("POST", "/db/_signup", `{"name":"alice2", "email":"alice@example.com", "password":"letmein"}`)
+	assertStatus(t, response, http.StatusAccepted)
+	assert.JSONEq(t, `{"ok":true, "verification_required":true}`, response.Body.String())
+	message = nextMessage(auth.AccountTokenVerifyEmail)
+	assert.Equal(t, "alice", message.Username)
+	user, err := rt.GetDatabase().Authenticator().GetUser("alice2")
+	require.NoError(t, err)
+	assert.Nil(t, user)
+
+	// Resending replaces the token, without revealing whether the address is registered
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/resend", `{"email":"nobody@example.com"}`), http.StatusAccepted)
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/resend", `{"email":"alice@example.com"}`), http.StatusAccepted)
+	resent := nextMessage(auth.AccountTokenVerifyEmail)
+	assert.NotEqual(t, message.Token, resent.Token)
+
+	// Verifying enables the user, with the default channels
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/verify", `{"token":"wrong"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/verify", fmt.Sprintf(`{"token":%q}`, resent.Token)), http.StatusOK)
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/verify", fmt.Sprintf(`{"token":%q}`, resent.Token)), http.StatusBadRequest)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusOK)
+	user, err = rt.GetDatabase().Authenticator().GetUser("alice")
+	require.NoError(t, err)
+	assert.True(t, user.ExplicitChannels().Contains("public"))
+	assert.False(t, user.EmailUnverified())
+
+	// Users that have forgotten their password can reset it with a token sent to their email address
+	assertStatus(t, rt.SendRequest("POST", "/db/_password_reset", `{"email":"nobody@example.com"}`), http.StatusAccepted)
+	assertStatus(t, rt.SendRequest("POST", "/db/_password_reset", `{"email":"alice@example.com"}`), http.StatusAccepted)
+	reset := nextMessage(auth.AccountTokenPasswordReset)
+	assertStatus(t, rt.SendRequest("POST", "/db/_password_reset/confirm", fmt.Sprintf(`{"token":%q, "new_password":"ab"}`, reset.Token)), http.StatusBadRequest)
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup/verify", fmt.Sprintf(`{"token":%q}`, reset.Token)), http.StatusBadRequest)
+	assertStatus(t, rt.SendRequest("POST", "/db/_password_reset/confirm", fmt.Sprintf(`{"token":%q, "new_password":"newpassword"}`, reset.Token)), http.StatusOK)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "letmein"), http.StatusUnauthorized)
+	assertStatus(t, rt.SendUserRequestWithHeaders("GET", "/db/", "", nil, "alice", "newpassword"), http.StatusOK)
+
+	// Once verified, signing up with the address sends the existing user a password reset token
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup", `{"name":"alice3", "email":"alice@example.com", "password":"letmein"}`), http.StatusAccepted)
+	reset = nextMessage(auth.AccountTokenPasswordReset)
+	assert.Equal(t, "alice", reset.Username)
+
+	// Without signup configured, the endpoints are rejected
+	rt.GetDatabase().Options.SignupOptions = nil
+	assertStatus(t, rt.SendRequest("POST", "/db/_signup", `{"name":"bob", "email":"bob@example.com", "password":"letmein"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendRequest("POST", "/db/_password_reset", `{"email":"alice@example.com"}`), http.StatusBadRequest)
+}
+
+// testTOTPCode returns the current RFC 6238 code for a base32 encoded secret.
+func testTOTPCode(t *testing.T, secret string) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.NoError(t, err)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	_, _ = mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+func TestChangesSubscriptionAPI(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	for i := 1; i <= 3; i++ {
+		response := rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{"channels":["A"]}`)
+		assertStatus(t, response, http.StatusCreated)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_subscription/sub1", ""), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_subscription/sub1/_read", ""), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_subscription/sub1", `{"filter":"unknown"}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_subscription/sub1", `{"since":1, "since_time":"2000-01-01T00:00:00Z"}`), http.StatusBadRequest)
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_subscription/sub1", `{"channels":["A"], "batch_size":2, "since":1}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_subscription/sub1", `{"channels":["A"], "batch_size":2}`), http.StatusOK)
+
+	var batch db.ChangesSubscriptionBatch
+	response := rt.SendAdminRequest("POST", "/db/_subscription/sub1/_read?consumer=c1", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &batch))
+	require.Len(t, batch.Results, 2)
+	assert.Equal(t, "doc2", batch.Results[0].ID)
+	assert.Equal(t, "doc3", batch.Results[1].ID)
+	require.NotNil(t, batch.LastSeq)
+
+	var status db.ChangesSubscriptionStatus
+	response = rt.SendAdminRequest("GET", "/db/_subscription/sub1", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &status))
+	assert.Equal(t, 1, status.InFlight)
+	assert.Equal(t, uint64(2), status.Lag)
+
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_subscription/sub1/_ack", `{}`), http.StatusBadRequest)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_subscription/sub1/_ack", `{"seq":10}`), http.StatusConflict)
+	assertStatus(t, rt.SendAdminRequest("POST", "/db/_subscription/sub1/_ack", fmt.Sprintf(`{"seq":%q}`, batch.LastSeq.String())), http.StatusOK)
+
+	response = rt.SendAdminRequest("GET", "/db/_subscription/sub1", "")
+	assertStatus(t, response, http.StatusOK)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &status))
+	assert.Equal(t, 0, status.InFlight)
+	assert.Equal(t, uint64(0), status.Lag)
+
+	assertStatus(t, rt.SendAdminRequest("DELETE", "/db/_subscription/sub1", ""), http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/_subscription/sub1", ""), http.StatusNotFound)
+}
@@ -187,6 +187,51 @@ func (h *handler) handleCompact() error {
 	return nil
 }
 
+func (h *handler) handleGetAttachmentMigration() error {
+	status, err := h.db.AttachmentMigrationManager.GetStatus()
+	if err != nil {
+		return err
+	}
+	h.writeRawJSON(status)
+	return nil
+}
+
+func (h *handler) handlePostAttachmentMigration() error {
+	action := h.getQuery("action")
+	if action == "" {
+		action = string(db.BackgroundProcessActionStart)
+	}
+
+	if action != string(db.BackgroundProcessActionStart) && action != string(db.BackgroundProcessActionStop) {
+		return base.HTTPErrorf(http.StatusBadRequest, "Unknown parameter for 'action'. Must be start or stop")
+	}
+
+	if action == string(db.BackgroundProcessActionStart) {
+		if !h.db.AttachmentMigrationConfigured() {
+			return base.HTTPErrorf(http.StatusBadRequest, "Attachment migration requires attachment_store.migrate_from to be configured")
+		}
+		err := h.db.AttachmentMigrationManager.Start(map[string]interface{}{
+			"database":     h.db,
+			"deleteSource": h.getBoolQuery("delete_source"),
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		err := h.db.AttachmentMigrationManager.Stop()
+		if err != nil {
+			return err
+		}
+	}
+
+	status, err := h.db.AttachmentMigrationManager.GetStatus()
+	if err != nil {
+		return err
+	}
+	h.writeRawJSON(status)
+	return nil
+}
+
 func (h *handler) handleFlush() error {
 
 	baseBucket := base.GetBaseBucket(h.db.Bucket)
@@ -0,0 +1,139 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// apiKeyAuthScheme is the Authorization header scheme used to authenticate with an API key
+const apiKeyAuthScheme = "ApiKey "
+
+// GET /{db}/_user/{name}/_apikey returns the user's API keys
+func (h *handler) getUserAPIKeys() error {
+	h.assertAdminOnly()
+	user, err := h.apiKeyNamedUser()
+	if err != nil {
+		return err
+	}
+	keys := make([]auth.APIKey, 0, len(user.APIKeys()))
+	for _, key := range user.APIKeys() {
+		keys = append(keys, redactedAPIKey(key))
+	}
+	h.writeJSON(keys)
+	return nil
+}
+
+// POST /{db}/_user/{name}/_apikey creates an API key for the user.  The response includes the key's token, which
+// can't be retrieved later.
+func (h *handler) postUserAPIKey() error {
+	h.assertAdminOnly()
+	user, err := h.apiKeyNamedUser()
+	if err != nil {
+		return err
+	}
+	var params struct {
+		Name   string            `json:"name"`
+		Scopes auth.APIKeyScopes `json:"scopes"`
+		Expiry *time.Time        `json:"expiry"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	key, token, err := h.db.Authenticator().CreateAPIKey(user, params.Name, params.Scopes, params.Expiry)
+	if err != nil {
+		return err
+	}
+	response := struct {
+		auth.APIKey
+		Key string `json:"key"`
+	}{redactedAPIKey(*key), token}
+	h.writeJSONStatus(http.StatusCreated, response)
+	return nil
+}
+
+// GET /{db}/_user/{name}/_apikey/{keyid} returns one of the user's API keys
+func (h *handler) getUserAPIKey() error {
+	h.assertAdminOnly()
+	user, err := h.apiKeyNamedUser()
+	if err != nil {
+		return err
+	}
+	for _, key := range user.APIKeys() {
+		if key.ID == h.PathVar("keyid") {
+			h.writeJSON(redactedAPIKey(key))
+			return nil
+		}
+	}
+	return base.HTTPErrorf(http.StatusNotFound, "API key not found")
+}
+
+// DELETE /{db}/_user/{name}/_apikey/{keyid} revokes one of the user's API keys
+func (h *handler) deleteUserAPIKey() error {
+	h.assertAdminOnly()
+	user, err := h.apiKeyNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.db.Authenticator().RevokeAPIKey(user, h.PathVar("keyid"))
+}
+
+// apiKeyNamedUser returns the user identified by the name path variable.
+func (h *handler) apiKeyNamedUser() (auth.User, error) {
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// redactedAPIKey returns the key without its secret hash, for API responses.
+func redactedAPIKey(key auth.APIKey) auth.APIKey {
+	key.Hash = ""
+	return key
+}
+
+// getAPIKeyToken returns the API key token from the Authorization header, if present.
+func (h *handler) getAPIKeyToken() string {
+	authHeader := h.rq.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, apiKeyAuthScheme) {
+		return strings.TrimSpace(authHeader[len(apiKeyAuthScheme):])
+	}
+	return ""
+}
+
+// checkAPIKeyScopes returns a 403 error if the request was authenticated with a read-only API key, and the handler
+// writes app data.  Handlers that don't declare permissions are assumed to write unless called with GET or HEAD.
+// BLIP sync is allowed, so that read-only keys can pull, as the BLIP handler rejects the messages that push.
+func (h *handler) checkAPIKeyScopes(accessPermissions []Permission) error {
+	key, ok := auth.AuthenticatedAPIKey(h.user)
+	if !ok || !key.Scopes.ReadOnly {
+		return nil
+	}
+	if strings.HasSuffix(h.rq.URL.Path, "/_blipsync") {
+		return nil
+	}
+	for _, permission := range accessPermissions {
+		if permission == PermWriteAppData {
+			return base.HTTPErrorf(http.StatusForbidden, "API key is read-only")
+		}
+	}
+	if accessPermissions == nil && h.rq.Method != http.MethodGet && h.rq.Method != http.MethodHead {
+		return base.HTTPErrorf(http.StatusForbidden, "API key is read-only")
+	}
+	return nil
+}
@@ -14,6 +14,10 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
@@ -4627,6 +4631,176 @@ func TestWebhookProperties(t *testing.T) {
 
 }
 
+// Publishes document changes to a Kafka REST proxy stand-in using a broker event handler.
+func TestBrokerEventHandlerKafkaREST(t *testing.T) {
+	received := make(chan string, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/topics/doc-changes", r.URL.Path)
+		var request struct {
+			Records []struct {
+				Key string `json:"key"`
+			} `json:"records"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		for _, record := range request.Records {
+			key, err := base64.StdEncoding.DecodeString(record.Key)
+			assert.NoError(t, err)
+			received <- string(key)
+		}
+		_, _ = w.Write([]byte(`{"offsets":[]}`))
+	}))
+	defer s.Close()
+
+	rtConfig := &RestTesterConfig{
+		DatabaseConfig: &DatabaseConfig{
+			DbConfig: DbConfig{
+				EventHandlers: &EventHandlerConfig{
+					DocumentChanged: []*EventConfig{
+						{Url: s.URL, HandlerType: "broker", Broker: &db.BrokerConfig{Type: db.BrokerTypeKafkaREST, Topic: "doc-changes"}},
+					},
+				},
+			},
+		},
+	}
+	rt := NewRestTester(t, rtConfig)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/doc1", `{"foo": "bar"}`), http.StatusCreated)
+	select {
+	case key := <-received:
+		assert.Equal(t, "doc1", key)
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out waiting for change to be published")
+	}
+}
+
+func TestWebhookOutboxAPI(t *testing.T) {
+	var accept int32
+	var signature atomic.Value
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&accept) == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		signature.Store(r.Header.Get(db.WebhookSignatureHeader))
+	}))
+	defer s.Close()
+
+	rtConfig := &RestTesterConfig{
+		DatabaseConfig: &DatabaseConfig{
+			DbConfig: DbConfig{
+				EventHandlers: &EventHandlerConfig{
+					DocumentChanged: []*EventConfig{
+						{
+							Url:           s.URL,
+							HandlerType:   "webhook",
+							SigningSecret: "secret",
+							Delivery:      &db.WebhookDeliveryConfig{Durable: true, MaxAttempts: 1},
+						},
+					},
+				},
+			},
+		},
+	}
+	rt := NewRestTester(t, rtConfig)
+	defer rt.Close()
+
+	response := rt.SendAdminRequest(http.MethodGet, "/db/_event_handlers", "")
+	assertStatus(t, response, http.StatusOK)
+	var stats []db.EventHandlerStats
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &stats))
+	require.Len(t, stats, 1)
+	webhookID := stats[0].WebhookID
+	require.NotEmpty(t, webhookID)
+
+	// The signing secret is redacted from the config
+	response = rt.SendAdminRequest(http.MethodGet, "/db/_config", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.NotContains(t, response.Body.String(), `"secret"`)
+
+	// The webhook fails, so the event is marked as failed after its single attempt
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/doc1", `{"foo": "bar"}`), http.StatusCreated)
+	var entries []db.WebhookOutboxEntry
+	require.Eventually(t, func() bool {
+		response := rt.SendAdminRequest(http.MethodGet, "/db/_webhook/"+webhookID+"/_outbox?state=failed", "")
+		return response.Code == http.StatusOK && base.JSONUnmarshal(response.Body.Bytes(), &entries) == nil && len(entries) == 1
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, entries[0].Attempts)
+
+	response = rt.SendAdminRequest(http.MethodGet, "/db/_webhook/"+webhookID+"/_outbox/"+entries[0].ID, "")
+	assertStatus(t, response, http.StatusOK)
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/_webhook/"+webhookID+"/_outbox/unknown", ""), http.StatusNotFound)
+	assertStatus(t, rt.SendAdminRequest(http.MethodGet, "/db/_webhook/unknown/_outbox", ""), http.StatusNotFound)
+
+	// Replaying delivers the event once the webhook accepts it
+	atomic.StoreInt32(&accept, 1)
+	response = rt.SendAdminRequest(http.MethodPost, "/db/_webhook/"+webhookID+"/_outbox/"+entries[0].ID+"/_replay", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, `{"replayed":1}`, response.Body.String())
+	require.Eventually(t, func() bool {
+		response := rt.SendAdminRequest(http.MethodGet, "/db/_webhook/"+webhookID+"/_outbox", "")
+		return response.Code == http.StatusOK && base.JSONUnmarshal(response.Body.Bytes(), &entries) == nil && len(entries) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Contains(t, signature.Load(), ",v1=")
+
+	response = rt.SendAdminRequest(http.MethodDelete, "/db/_webhook/"+webhookID+"/_outbox", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, `{"discarded":0}`, response.Body.String())
+}
+
+func TestAuthEventHandlers(t *testing.T) {
+	events := make(chan db.Body, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body db.Body
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		events <- body
+	}))
+	defer s.Close()
+
+	rtConfig := &RestTesterConfig{
+		DatabaseConfig: &DatabaseConfig{
+			DbConfig: DbConfig{
+				EventHandlers: &EventHandlerConfig{
+					AuthFailed:       []*EventConfig{{Url: s.URL, HandlerType: "webhook"}},
+					SessionCreated:   []*EventConfig{{Url: s.URL, HandlerType: "webhook"}},
+					PrincipalChanged: []*EventConfig{{Url: s.URL, HandlerType: "webhook", Filter: `function(event) { return event.action == "deleted"; }`}},
+				},
+			},
+		},
+	}
+	rt := NewRestTester(t, rtConfig)
+	defer rt.Close()
+
+	waitForEvent := func() db.Body {
+		select {
+		case body := <-events:
+			return body
+		case <-time.After(10 * time.Second):
+			require.FailNow(t, "Timed out waiting for event")
+			return nil
+		}
+	}
+
+	assertStatus(t, rt.SendAdminRequest(http.MethodPut, "/db/_user/alice", `{"password": "letmein"}`), http.StatusCreated)
+
+	assertStatus(t, rt.SendUserRequestWithHeaders(http.MethodGet, "/db/", "", nil, "alice", "wrong"), http.StatusUnauthorized)
+	body := waitForEvent()
+	assert.Equal(t, "alice", body["username"])
+	assert.Equal(t, "/db/", body["path"])
+
+	assertStatus(t, rt.SendRequest(http.MethodPost, "/db/_session", `{"name": "alice", "password": "letmein"}`), http.StatusOK)
+	body = waitForEvent()
+	assert.Equal(t, "alice", body["username"])
+	assert.Contains(t, body, "expires")
+
+	// The filter skips the created event, so the next event is the deletion
+	assertStatus(t, rt.SendAdminRequest(http.MethodDelete, "/db/_user/alice", ""), http.StatusOK)
+	body = waitForEvent()
+	assert.Equal(t, "alice", body["name"])
+	assert.Equal(t, "deleted", body["action"])
+	assertStatus(t, rt.SendAdminRequest(http.MethodDelete, "/db/_user/alice", ""), http.StatusNotFound)
+}
+
 func TestBasicGetReplicator2(t *testing.T) {
 	rt := NewRestTester(t, nil)
 	defer rt.Close()
@@ -5321,6 +5495,81 @@ func TestImportOnWriteMigration(t *testing.T) {
 	assertStatus(t, response, http.StatusCreated)
 }
 
+func TestAttachmentPolicy(t *testing.T) {
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		AttachmentPolicy: &AttachmentPolicyConfig{
+			MaxSize:             base.Int64Ptr(10),
+			AllowedContentTypes: []string{"text/*", "image/png"},
+		},
+	}}})
+	defer rt.Close()
+
+	response := rt.SendAdminRequestWithHeaders("PUT", "/db/doc1/att.txt", "hello", map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, http.StatusCreated)
+
+	response = rt.SendAdminRequestWithHeaders("PUT", "/db/doc2/att.txt", "hello world", map[string]string{"Content-Type": "text/plain"})
+	assertStatus(t, response, http.StatusRequestEntityTooLarge)
+
+	response = rt.SendAdminRequestWithHeaders("PUT", "/db/doc2/att.exe", "hello", map[string]string{"Content-Type": "application/octet-stream"})
+	assertStatus(t, response, http.StatusUnsupportedMediaType)
+
+	// Inline attachments in _bulk_docs are rejected per document
+	response = rt.SendAdminRequest("POST", "/db/_bulk_docs", `{"docs": [
+		{"_id": "bulk1", "_attachments": {"a.png": {"data": "aGVsbG8=", "content_type": "image/png"}}},
+		{"_id": "bulk2", "_attachments": {"a.gif": {"data": "aGVsbG8=", "content_type": "image/gif"}}}]}`)
+	assertStatus(t, response, http.StatusCreated)
+	var bulkResponse []map[string]interface{}
+	require.NoError(t, base.JSONUnmarshal(response.BodyBytes(), &bulkResponse))
+	require.Len(t, bulkResponse, 2)
+	assert.Nil(t, bulkResponse[0]["error"])
+	assert.Equal(t, float64(http.StatusUnsupportedMediaType), bulkResponse[1]["status"])
+
+	assert.Equal(t, int64(3), rt.GetDatabase().DbStats.Database().NumAttachmentsRejected.Value())
+}
+
+func TestAttachmentRendition(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 255, A: 255}), image.Point{}, draw.Src)
+	var source bytes.Buffer
+	require.NoError(t, png.Encode(&source, img))
+
+	response := rt.SendAdminRequest("PUT", "/db/doc1", `{"channels": ["alpha"], "_attachments": {"photo.png": {"content_type": "image/png", "data": "`+base64.StdEncoding.EncodeToString(source.Bytes())+`"}}}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password": "letmein", "admin_channels": ["alpha"]}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = rt.SendAdminRequest("PUT", "/db/_user/bob", `{"password": "letmein", "admin_channels": ["beta"]}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1/photo.png?width=200&format=jpeg", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	config, format, err := image.DecodeConfig(bytes.NewReader(response.BodyBytes()))
+	require.NoError(t, err)
+	assert.Equal(t, "jpeg", format)
+	assert.Equal(t, 200, config.Width)
+	assert.Equal(t, 100, config.Height)
+
+	// Renditions keep the source format by default
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1/photo.png?height=50", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	config, err = png.DecodeConfig(bytes.NewReader(response.BodyBytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 100, config.Width)
+
+	// Renditions are authorized like the attachment
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1/photo.png?width=200", "", nil, "bob", "letmein")
+	assertStatus(t, response, http.StatusForbidden)
+
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1/photo.png?width=200&format=webp", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusBadRequest)
+	response = rt.SendUserRequestWithHeaders("GET", "/db/doc1/photo.png?width=0", "", nil, "alice", "letmein")
+	assertStatus(t, response, http.StatusBadRequest)
+}
+
 func TestAttachmentContentType(t *testing.T) {
 	rt := NewRestTester(t, &RestTesterConfig{guestEnabled: true})
 	defer rt.Close()
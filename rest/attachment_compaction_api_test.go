@@ -442,3 +442,61 @@ func CreateLegacyAttachmentDoc(t *testing.T, testDB *db.Database, docID string,
 
 	return attDocID
 }
+
+func TestAttachmentMigrationAPI(t *testing.T) {
+	sourcePath := t.TempDir()
+	rt := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+		AttachmentStore: &AttachmentStoreConfig{
+			Type: db.AttachmentStoreTypeFilesystem,
+			Path: t.TempDir(),
+			MigrateFrom: &AttachmentStoreConfig{
+				Type: db.AttachmentStoreTypeFilesystem,
+				Path: sourcePath,
+			},
+		},
+	}}})
+	defer rt.Close()
+
+	source, err := db.NewAttachmentStore(nil, &db.AttachmentStoreOptions{Type: db.AttachmentStoreTypeFilesystem, Path: sourcePath})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := source.Add(fmt.Sprintf("%ssha1-%d", base.AttPrefix, i), []byte(strconv.Itoa(i)))
+		require.NoError(t, err)
+	}
+
+	resp := rt.SendAdminRequest("POST", "/db/_attachment_migration?action=restart", "")
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	resp = rt.SendAdminRequest("POST", "/db/_attachment_migration?delete_source=true", "")
+	assertStatus(t, resp, http.StatusOK)
+
+	var response db.AttachmentMigrationManagerResponse
+	err = rt.WaitForCondition(func() bool {
+		resp := rt.SendAdminRequest("GET", "/db/_attachment_migration", "")
+		assertStatus(t, resp, http.StatusOK)
+		require.NoError(t, base.JSONUnmarshal(resp.BodyBytes(), &response))
+		return response.State == db.BackgroundProcessStateCompleted
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), response.MigratedAttachments)
+	assert.Equal(t, int64(0), response.SkippedAttachments)
+	assert.True(t, response.DeleteSource)
+
+	// Migrated attachments were removed from the source, and are served from the configured store
+	_, err = source.Get(base.AttPrefix + "sha1-0")
+	assert.True(t, base.IsDocNotFoundError(err))
+	data, err := (&db.Database{DatabaseContext: rt.GetDatabase()}).GetAttachment(base.AttPrefix + "sha1-0")
+	require.NoError(t, err)
+	assert.Equal(t, "0", string(data))
+}
+
+func TestAttachmentMigrationAPINotConfigured(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	resp := rt.SendAdminRequest("POST", "/db/_attachment_migration", "")
+	assertStatus(t, resp, http.StatusBadRequest)
+
+	resp = rt.SendAdminRequest("GET", "/db/_attachment_migration", "")
+	assertStatus(t, resp, http.StatusOK)
+}
@@ -12,6 +12,7 @@ package rest
 
 import (
 	"context"
+	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -432,6 +433,115 @@ func TestBlipOneShotChangesSubscription(t *testing.T) {
 }
 
 // Test subChanges w/ docID filter
+// TestBlipSubChangesPredicateFilter validates that subChanges with the sync_gateway/predicate filter only sends
+// changes for documents matching the predicate, and sends removals for documents that stop matching.
+func TestBlipSubChangesPredicateFilter(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTester(t)
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+	rt := bt.restTester
+
+	const predicate = `{"type": "order", "status": {"$in": ["open", "pending"]}}`
+
+	// getChanges runs a one-shot predicate-filtered subChanges, returning the changes received
+	getChanges := func(since string, revocations bool, predicateBody string) (changes [][]interface{}, errorCode string) {
+		changesReceived := make(chan [][]interface{}, 10)
+		bt.blipContext.HandlerForProfile["changes"] = func(request *blip.Message) {
+			body, err := request.Body()
+			assert.NoError(t, err)
+			var changesBatch [][]interface{}
+			assert.NoError(t, base.JSONUnmarshal(body, &changesBatch))
+			changesReceived <- changesBatch
+			if !request.NoReply() {
+				request.Response().SetBody([]byte(`[]`))
+			}
+		}
+		defer delete(bt.blipContext.HandlerForProfile, "changes")
+
+		subChangesRequest := blip.NewRequest()
+		subChangesRequest.SetProfile(db.MessageSubChanges)
+		subChangesRequest.Properties[db.SubChangesContinuous] = "false"
+		subChangesRequest.Properties[db.SubChangesSince] = since
+		subChangesRequest.Properties[db.SubChangesFilter] = base.PredicateFilter
+		if revocations {
+			subChangesRequest.Properties[db.SubChangesRevocations] = "true"
+		}
+		subChangesRequest.SetBody([]byte(`{"predicate": ` + predicateBody + `}`))
+		require.True(t, bt.sender.Send(subChangesRequest))
+		if errorCode = subChangesRequest.Response().Properties["Error-Code"]; errorCode != "" {
+			return nil, errorCode
+		}
+
+		for {
+			select {
+			case changesBatch := <-changesReceived:
+				if changesBatch == nil {
+					return changes, ""
+				}
+				changes = append(changes, changesBatch...)
+			case <-time.After(10 * time.Second):
+				require.FailNow(t, "Timed out waiting for changes")
+			}
+		}
+	}
+
+	response := rt.SendAdminRequest(http.MethodPut, "/db/order1", `{"type": "order", "status": "open"}`)
+	assertStatus(t, response, http.StatusCreated)
+	order1RevID := respRevID(t, response)
+	response = rt.SendAdminRequest(http.MethodPut, "/db/order2", `{"type": "order", "status": "closed"}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = rt.SendAdminRequest(http.MethodPut, "/db/note1", `{"type": "note", "status": "open"}`)
+	assertStatus(t, response, http.StatusCreated)
+	note1RevID := respRevID(t, response)
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	changes, errorCode := getChanges("0", true, predicate)
+	require.Equal(t, "", errorCode)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "order1", changes[0][1])
+	assert.Equal(t, order1RevID, changes[0][2])
+	assert.Len(t, changes[0], 3)
+
+	lastSeq, err := rt.GetDatabase().LastSequence()
+	require.NoError(t, err)
+	since := strconv.FormatUint(lastSeq, 10)
+
+	// order1 leaves the predicate, note1 is updated but never matched
+	response = rt.SendAdminRequest(http.MethodPut, "/db/order1?rev="+order1RevID, `{"type": "order", "status": "closed"}`)
+	assertStatus(t, response, http.StatusCreated)
+	order1RevID = respRevID(t, response)
+	response = rt.SendAdminRequest(http.MethodPut, "/db/note1?rev="+note1RevID, `{"type": "note", "status": "closed"}`)
+	assertStatus(t, response, http.StatusCreated)
+	response = rt.SendAdminRequest(http.MethodPut, "/db/order3", `{"type": "order", "status": "pending"}`)
+	assertStatus(t, response, http.StatusCreated)
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	changes, errorCode = getChanges(since, true, predicate)
+	require.Equal(t, "", errorCode)
+	require.Len(t, changes, 2)
+	assert.Equal(t, "order1", changes[0][1])
+	assert.Equal(t, order1RevID, changes[0][2])
+	require.Len(t, changes[0], 4)
+	assert.Equal(t, float64(4), changes[0][3]) // removed
+	assert.Equal(t, "order3", changes[1][1])
+	assert.Len(t, changes[1], 3)
+
+	// Removals are only sent when revocations are requested
+	changes, errorCode = getChanges(since, false, predicate)
+	require.Equal(t, "", errorCode)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "order3", changes[0][1])
+
+	// Invalid predicates are rejected
+	_, errorCode = getChanges("0", false, `{"status": {"$regex": "open"}}`)
+	assert.Equal(t, "400", errorCode)
+	_, errorCode = getChanges("0", false, `"open"`)
+	assert.Equal(t, "400", errorCode)
+}
+
 func TestBlipSubChangesDocIDFilter(t *testing.T) {
 
 	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
@@ -1840,6 +1950,97 @@ func TestPutRevConflictsMode(t *testing.T) {
 
 }
 
+// TestPutRevClientConflictResolution validates that when client_conflict_resolution is configured, conflicting
+// revisions pushed by a CBL client are accepted by proposeChanges and resolved on write instead of being rejected.
+func TestPutRevClientConflictResolution(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg, base.KeyReplicate)()
+
+	testCases := []struct {
+		name                   string
+		resolverType           db.ConflictResolverType
+		expectedBody           string
+		expectedGeneration     int
+		expectedResolutionStat func(stats *base.CBLReplicationPushStats) *base.SgwIntStat
+	}{
+		{
+			name:               "remoteWins",
+			resolverType:       db.ConflictResolverRemoteWins,
+			expectedBody:       `{"a": 2, "b": 1}`,
+			expectedGeneration: 2,
+			expectedResolutionStat: func(stats *base.CBLReplicationPushStats) *base.SgwIntStat {
+				return stats.ConflictResolvedRemoteCount
+			},
+		},
+		{
+			name:               "localWins",
+			resolverType:       db.ConflictResolverLocalWins,
+			expectedBody:       `{"a": 1, "b": 2}`,
+			expectedGeneration: 3,
+			expectedResolutionStat: func(stats *base.CBLReplicationPushStats) *base.SgwIntStat {
+				return stats.ConflictResolvedLocalCount
+			},
+		},
+		{
+			name:               "merge",
+			resolverType:       db.ConflictResolverMerge,
+			expectedBody:       `{"a": 2, "b": 2}`,
+			expectedGeneration: 3,
+			expectedResolutionStat: func(stats *base.CBLReplicationPushStats) *base.SgwIntStat {
+				return stats.ConflictResolvedMergedCount
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			rt := NewRestTester(t, &RestTesterConfig{
+				EnableNoConflictsMode: true,
+				guestEnabled:          true,
+				DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+					ClientConflictResolution: &ClientConflictResolutionConfig{Type: test.resolverType},
+				}},
+			})
+			defer rt.Close()
+
+			bt, err := NewBlipTesterFromSpecWithRT(t, &BlipTesterSpec{noConflictsMode: true, guestEnabled: true}, rt)
+			require.NoError(t, err)
+			defer bt.Close()
+
+			// Create a common ancestor, then update it on the server
+			rev1 := rt.putDoc("doc", `{"a": 1, "b": 1}`).Rev
+			rt.updateDoc("doc", rev1, `{"a": 1, "b": 2}`)
+
+			// Conflicting revision should be accepted by proposeChanges
+			proposeChangesRequest := blip.NewRequest()
+			proposeChangesRequest.SetProfile("proposeChanges")
+			proposeChangesRequest.SetBody([]byte(`[["doc", "2-client", "` + rev1 + `"]]`))
+			require.True(t, bt.sender.Send(proposeChangesRequest))
+			body, err := proposeChangesRequest.Response().Body()
+			require.NoError(t, err)
+			var changeList []interface{}
+			require.NoError(t, base.JSONUnmarshal(body, &changeList))
+			assert.Len(t, changeList, 0)
+
+			sent, _, resp, err := bt.SendRevWithHistory("doc", "2-client", []string{rev1}, []byte(`{"a": 2, "b": 1}`), blip.Properties{})
+			require.True(t, sent)
+			require.NoError(t, err)
+			assert.Equal(t, "", resp.Properties["Error-Code"])
+
+			doc, err := rt.GetDatabase().GetDocument("doc", db.DocUnmarshalAll)
+			require.NoError(t, err)
+			generation, _ := db.ParseRevID(doc.CurrentRev)
+			assert.Equal(t, test.expectedGeneration, generation)
+			bodyBytes, err := base.JSONMarshal(doc.Body())
+			require.NoError(t, err)
+			assert.JSONEq(t, test.expectedBody, string(bodyBytes))
+
+			pushStats := rt.GetDatabase().DbStats.CBLReplicationPush()
+			assert.Equal(t, int64(1), test.expectedResolutionStat(pushStats).Value())
+		})
+	}
+}
+
 // Repro attempt for SG #3281
 //
 // - Set up a user w/ access to channel A
@@ -3867,3 +4068,185 @@ func TestMultipleOutstandingChangesSubscriptions(t *testing.T) {
 	base.RequireWaitForStat(t, pullStats.NumPullReplActiveOneShot.Value, 0)
 	base.RequireWaitForStat(t, pullStats.NumPullReplActiveContinuous.Value, 0)
 }
+
+// TestBlipGetAttachmentChunks fetches an attachment in chunks over the chunked subprotocol, verifying the digest
+// incrementally as each chunk is received.
+func TestBlipGetAttachmentChunks(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	bt, err := NewBlipTesterFromSpec(t, BlipTesterSpec{
+		guestEnabled:  true,
+		blipProtocols: []string{db.BlipCBMobileReplicationV3Chunked, db.BlipCBMobileReplicationV3},
+	})
+	require.NoError(t, err, "Error creating BlipTester")
+	defer bt.Close()
+	require.Equal(t, db.BlipCBMobileReplicationV3Chunked, bt.blipContext.ActiveSubprotocol())
+
+	attachmentData := []byte(strings.Repeat("0123456789", 100))
+	digest := db.Sha1DigestKey(attachmentData)
+	response := bt.restTester.SendAdminRequest(http.MethodPut, "/db/doc1", `{"_attachments":{"video.mp4":{"data":"`+base64.StdEncoding.EncodeToString(attachmentData)+`"}}}`)
+	assertStatus(t, response, http.StatusCreated)
+
+	getChunk := func(offset, length int) *blip.Message {
+		request := blip.NewRequest()
+		request.SetProfile(db.MessageGetAttachment)
+		request.Properties[db.GetAttachmentDigest] = digest
+		request.Properties[db.GetAttachmentID] = "doc1"
+		request.Properties[db.GetAttachmentOffset] = strconv.Itoa(offset)
+		if length > 0 {
+			request.Properties[db.GetAttachmentLength] = strconv.Itoa(length)
+		}
+		assert.True(t, bt.sender.Send(request))
+		return request.Response()
+	}
+
+	// Attachments can only be requested while the revision is being pulled, so fetch the chunks from the rev handler
+	revDone := make(chan struct{})
+	bt.blipContext.HandlerForProfile[db.MessageChanges] = func(request *blip.Message) {
+		if !request.NoReply() {
+			request.Response().SetBody([]byte(`[[]]`))
+		}
+	}
+	bt.blipContext.HandlerForProfile[db.MessageRev] = func(request *blip.Message) {
+		defer close(revDone)
+
+		// Request the attachment in chunks, with the final chunk extending to the end of the attachment
+		digester := sha1.New()
+		var received []byte
+		for _, chunk := range []struct{ offset, length int }{{0, 300}, {300, 300}, {600, 0}} {
+			chunkResponse := getChunk(chunk.offset, chunk.length)
+			body, err := chunkResponse.Body()
+			assert.NoError(t, err)
+			assert.Equal(t, "", chunkResponse.Properties["Error-Code"], "Unexpected error: %s", body)
+			assert.Equal(t, "1000", chunkResponse.Properties[db.GetAttachmentResponseTotalLength])
+			_, _ = digester.Write(body)
+			received = append(received, body...)
+		}
+		assert.Equal(t, attachmentData, received)
+		assert.Equal(t, digest, "sha1-"+base64.StdEncoding.EncodeToString(digester.Sum(nil)))
+
+		// A chunk extending beyond the end of the attachment is truncated
+		chunkResponse := getChunk(900, 300)
+		body, err := chunkResponse.Body()
+		assert.NoError(t, err)
+		assert.Equal(t, attachmentData[900:], body)
+
+		// An offset beyond the end of the attachment is rejected
+		chunkResponse = getChunk(1001, 10)
+		assert.Equal(t, "400", chunkResponse.Properties["Error-Code"])
+
+		if !request.NoReply() {
+			request.Response().SetBody([]byte{})
+		}
+	}
+
+	subChangesRequest := blip.NewRequest()
+	subChangesRequest.SetProfile(db.MessageSubChanges)
+	subChangesRequest.Properties[db.SubChangesContinuous] = "false"
+	require.True(t, bt.sender.Send(subChangesRequest))
+	require.Equal(t, "", subChangesRequest.Response().Properties["Error-Code"])
+
+	select {
+	case <-revDone:
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "Timed out waiting for rev")
+	}
+}
+
+// TestBlipChunkedAttachmentPushResume verifies that an attachment pushed by a client over the chunked subprotocol is
+// requested in chunks, and that an interrupted transfer resumes from the last received chunk when the revision is
+// pushed again.
+func TestBlipChunkedAttachmentPushResume(t *testing.T) {
+
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeySyncMsg)()
+
+	rt := NewRestTester(t, &RestTesterConfig{guestEnabled: true})
+	defer rt.Close()
+
+	btc, err := NewBlipTesterClientOptsWithRT(t, rt, &BlipTesterClientOpts{
+		SupportedBLIPProtocols: []string{db.BlipCBMobileReplicationV3Chunked},
+	})
+	require.NoError(t, err)
+	defer btc.Close()
+
+	// Fail the first request for the second chunk, as though the connection dropped mid-transfer
+	const chunkSize = 1024 * 1024
+	var offsetsLock sync.Mutex
+	var offsets []string
+	failedChunk := false
+	serveChunk := btc.pushReplication.bt.blipContext.HandlerForProfile[db.MessageGetAttachment]
+	btc.pushReplication.bt.blipContext.HandlerForProfile[db.MessageGetAttachment] = func(msg *blip.Message) {
+		offset := msg.Properties[db.GetAttachmentOffset]
+		offsetsLock.Lock()
+		offsets = append(offsets, offset)
+		failChunk := offset == strconv.Itoa(chunkSize) && !failedChunk
+		failedChunk = failedChunk || failChunk
+		offsetsLock.Unlock()
+		if failChunk {
+			msg.Response().SetError("HTTP", http.StatusServiceUnavailable, "connection lost")
+			return
+		}
+		serveChunk(msg)
+	}
+
+	attachmentData := make([]byte, 2*chunkSize+chunkSize/2)
+	for i := range attachmentData {
+		attachmentData[i] = byte(i % 251)
+	}
+	digest := db.Sha1DigestKey(attachmentData)
+
+	_, err = btc.PushRev("doc1", "", []byte(`{"_attachments":{"video.mp4":{"data":"`+base64.StdEncoding.EncodeToString(attachmentData)+`"}}}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "503")
+
+	// Push the revision again, as the client would after reconnecting
+	revID, err := btc.PushRev("doc1", "", []byte(fmt.Sprintf(`{"_attachments":{"video.mp4":{"stub":true,"revpos":1,"length":%d,"digest":"%s"}}}`, len(attachmentData), digest)))
+	require.NoError(t, err)
+	assert.Equal(t, "1-abc", revID)
+
+	offsetsLock.Lock()
+	assert.Equal(t, []string{"0", strconv.Itoa(chunkSize), strconv.Itoa(chunkSize), strconv.Itoa(2 * chunkSize)}, offsets)
+	offsetsLock.Unlock()
+
+	response := rt.SendAdminRequest(http.MethodGet, "/db/doc1/video.mp4", "")
+	assertStatus(t, response, http.StatusOK)
+	assert.Equal(t, attachmentData, response.Body.Bytes())
+}
+
+func TestAPIKeyReadOnlyBLIPSync(t *testing.T) {
+
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/_user/alice", `{"password":"letmein", "admin_channels":["A"]}`), http.StatusCreated)
+	assertStatus(t, rt.SendAdminRequest("PUT", "/db/docA", `{"channels":["A"]}`), http.StatusCreated)
+	response := rt.SendAdminRequest("POST", "/db/_user/alice/_apikey", `{"name":"pull", "scopes":{"read_only":true}}`)
+	assertStatus(t, response, http.StatusCreated)
+	var created struct {
+		Key string `json:"key"`
+	}
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &created))
+
+	// Read-only keys can pull
+	bt, err := NewBlipTesterFromSpecWithRT(t, &BlipTesterSpec{connectingAPIKey: created.Key}, rt)
+	require.NoError(t, err)
+	defer bt.Close()
+	docs, ok := bt.WaitForNumDocsViaChanges(1)
+	require.True(t, ok)
+	assert.Contains(t, docs, "docA")
+
+	// But not push
+	_, _, revResponse, err := bt.SendRev("docB", "1-abc", []byte(`{"channels":["A"]}`), blip.Properties{})
+	assert.Error(t, err)
+	assert.Equal(t, "403", revResponse.Properties["Error-Code"])
+
+	for _, profile := range []string{db.MessageProposeChanges, db.MessageChanges} {
+		request := blip.NewRequest()
+		request.SetProfile(profile)
+		request.SetBody([]byte(`[["docB", "1-abc"]]`))
+		require.True(t, bt.sender.Send(request))
+		assert.Equal(t, "403", request.Response().Properties["Error-Code"], "profile %s", profile)
+	}
+	assertStatus(t, rt.SendAdminRequest("GET", "/db/docB", ""), http.StatusNotFound)
+}
@@ -309,7 +309,7 @@ func (btr *BlipTesterReplicator) initHandlers(btc *BlipTesterClient) {
 					outrq := blip.NewRequest()
 					outrq.SetProfile(db.MessageGetAttachment)
 					outrq.Properties[db.GetAttachmentDigest] = digest
-					if btr.bt.blipContext.ActiveSubprotocol() == db.BlipCBMobileReplicationV3 {
+					if db.BlipSubprotocolVersion(btr.bt.blipContext.ActiveSubprotocol()) == db.BlipCBMobileReplicationV3 {
 						outrq.Properties[db.GetAttachmentID] = docID
 					}
 
@@ -382,6 +382,16 @@ func (btr *BlipTesterReplicator) initHandlers(btc *BlipTesterClient) {
 		}
 
 		response := msg.Response()
+		if offsetStr, ok := msg.Properties[db.GetAttachmentOffset]; ok {
+			offset, _ := strconv.Atoi(offsetStr)
+			length, _ := strconv.Atoi(msg.Properties[db.GetAttachmentLength])
+			end := len(attachment)
+			if length > 0 && offset+length < end {
+				end = offset + length
+			}
+			response.Properties[db.GetAttachmentResponseTotalLength] = strconv.Itoa(len(attachment))
+			attachment = attachment[offset:end]
+		}
 		response.SetBody(attachment)
 		btr.replicationStats.GetAttachment.Add(1)
 	}
@@ -36,6 +36,8 @@ const kDefaultTimeoutMS = 5 * 60 * 1000
 // Maximum value of _changes?timeout property
 const kMaxTimeoutMS = 15 * 60 * 1000
 
+var errSinceAndSinceTime = base.HTTPErrorf(http.StatusBadRequest, "Only one of 'since' and 'since_time' can be specified")
+
 func (h *handler) handleRevsDiff() error {
 	var input map[string][]string
 	err := h.readJSONInto(&input)
@@ -88,6 +90,15 @@ func (h *handler) updateChangesOptionsFromQuery(feed *string, options *db.Change
 		}
 	}
 
+	if _, ok := values["since_time"]; ok {
+		if _, ok := values["since"]; ok {
+			return nil, nil, errSinceAndSinceTime
+		}
+		if options.Since, err = h.db.ParseSinceTime(h.getQuery("since_time")); err != nil {
+			return nil, nil, err
+		}
+	}
+
 	if _, ok := values["limit"]; ok {
 		options.Limit = int(h.getIntQuery("limit", 0))
 	}
@@ -171,7 +182,14 @@ func (h *handler) handleChanges() error {
 		// GET request has parameters in URL:
 		feed = h.getQuery("feed")
 		var err error
-		if options.Since, err = h.db.ParseSequenceID(h.getJSONStringQuery("since")); err != nil {
+		if sinceTime := h.getQuery("since_time"); sinceTime != "" {
+			if h.getQuery("since") != "" {
+				return errSinceAndSinceTime
+			}
+			if options.Since, err = h.db.ParseSinceTime(sinceTime); err != nil {
+				return err
+			}
+		} else if options.Since, err = h.db.ParseSequenceID(h.getJSONStringQuery("since")); err != nil {
 			return err
 		}
 		options.Limit = int(h.getIntQuery("limit", 0))
@@ -560,6 +578,7 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 	var input struct {
 		Feed           string        `json:"feed"`
 		Since          db.SequenceID `json:"since"`
+		SinceTime      string        `json:"since_time"` // RFC 3339 alternative to since
 		Limit          int           `json:"limit"`
 		Style          string        `json:"style"`
 		IncludeDocs    bool          `json:"include_docs"`
@@ -582,6 +601,15 @@ func (h *handler) readChangesOptionsFromJSON(jsonData []byte) (feed string, opti
 	}
 	feed = input.Feed
 	options.Since = input.Since
+	if input.SinceTime != "" && h.db != nil {
+		if input.Since.Seq != 0 {
+			err = errSinceAndSinceTime
+			return
+		}
+		if options.Since, err = h.db.ParseSinceTime(input.SinceTime); err != nil {
+			return
+		}
+	}
 	options.Limit = input.Limit
 
 	options.Conflicts = input.Style == "all_docs"
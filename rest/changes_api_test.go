@@ -3936,6 +3936,38 @@ func waitForCompactStopped(dbc *db.DatabaseContext) error {
 	return errors.New("waitForCompactStopped didn't stop")
 }
 
+// Test since_time on the changes feed.  The sequence time index is sampled, so since_time returns every change
+// made after the latest checkpoint before that time.
+func TestChangesSinceTime(t *testing.T) {
+	rt := NewRestTester(t, nil)
+	defer rt.Close()
+
+	for i := 0; i < 3; i++ {
+		response := rt.SendAdminRequest("PUT", fmt.Sprintf("/db/doc%d", i), `{"foo":"bar"}`)
+		assertStatus(t, response, 201)
+	}
+	require.NoError(t, rt.WaitForPendingChanges())
+
+	// No checkpoint precedes a time before the database was started, so every change is returned
+	var changes changesResults
+	response := rt.SendAdminRequest("GET", "/db/_changes?since_time=2000-01-01T00:00:00Z", "")
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	assert.Len(t, changes.Results, 3)
+
+	response = rt.SendAdminRequest("POST", "/db/_changes", `{"since_time":"2000-01-01T00:00:00Z"}`)
+	assertStatus(t, response, 200)
+	require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &changes))
+	assert.Len(t, changes.Results, 3)
+
+	response = rt.SendAdminRequest("GET", "/db/_changes?since_time=yesterday", "")
+	assertStatus(t, response, 400)
+	response = rt.SendAdminRequest("GET", "/db/_changes?since=1&since_time=2000-01-01T00:00:00Z", "")
+	assertStatus(t, response, 400)
+	response = rt.SendAdminRequest("POST", "/db/_changes", `{"since":1, "since_time":"2000-01-01T00:00:00Z"}`)
+	assertStatus(t, response, 400)
+}
+
 //////// HELPERS:
 
 func WriteDirect(testDb *db.DatabaseContext, channelArray []string, sequence uint64) {
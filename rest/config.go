@@ -22,8 +22,10 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -58,6 +60,9 @@ const (
 	DefaultNumIndexReplicas = uint(1)
 
 	DefaultUseTLSServer = true
+
+	// Maximum value of PasswordPolicyConfig.HistoryCount, as a new password is compared with each previous password hash
+	maxPasswordHistoryCount = 24
 )
 
 // Bucket configuration elements - used by db, index
@@ -152,6 +157,16 @@ type DbConfig struct {
 	UserXattrKey                     string                           `json:"user_xattr_key,omitempty"`                       // Key of user xattr that will be accessible from the Sync Function. If empty the feature will be disabled.
 	ClientPartitionWindowSecs        *int                             `json:"client_partition_window_secs,omitempty"`         // How long clients can remain offline for without losing replication metadata. Default 30 days (in seconds)
 	Guest                            *db.PrincipalConfig              `json:"guest,omitempty"`                                // Guest user settings
+	ClientConflictResolution         *ClientConflictResolutionConfig  `json:"client_conflict_resolution,omitempty"`           // Conflict resolution for conflicting revisions pushed by Couchbase Lite clients
+	PushNotifications                *PushNotificationsConfig         `json:"push_notifications,omitempty"`                   // Push notifications sent to the registered devices of idle users
+	AttachmentStore                  *AttachmentStoreConfig           `json:"attachment_store,omitempty"`                     // Where attachment data is stored.  Defaults to the bucket
+	AttachmentPolicy                 *AttachmentPolicyConfig          `json:"attachment_policy,omitempty"`                    // Limits and content scanning for uploaded attachments
+	AttachmentRenditionSizes         []int                            `json:"attachment_rendition_sizes,omitempty"`           // Widths and heights of image renditions that are stored once generated.  Other sizes are generated on every request
+	MFA                              *MFAConfig                       `json:"mfa,omitempty"`                                  // TOTP multi-factor authentication for password logins
+	Lockout                          *LockoutConfig                   `json:"lockout,omitempty"`                              // Lockout of users and source IPs after repeated failed password logins
+	PasswordPolicy                   *PasswordPolicyConfig            `json:"password_policy,omitempty"`                      // Requirements for users' passwords, and password expiry
+	Signup                           *SignupConfig                    `json:"signup,omitempty"`                               // Self-service user registration, email verification and password reset
+	LocalJWTConfig                   auth.LocalJWTProviderMap         `json:"local_jwt,omitempty"`                            // Providers of bearer tokens verified with locally configured keys
 }
 
 type DeltaSyncConfig struct {
@@ -159,21 +174,434 @@ type DeltaSyncConfig struct {
 	RevMaxAgeSeconds *uint32 `json:"rev_max_age_seconds,omitempty"` // The number of seconds deltas for old revs are available for
 }
 
+// ClientConflictResolutionConfig enables server-side resolution of conflicting revisions pushed by Couchbase Lite clients,
+// instead of rejecting them with a 409.  Local refers to the revision on Sync Gateway, remote to the pushed revision.
+type ClientConflictResolutionConfig struct {
+	Type           db.ConflictResolverType `json:"type"`                      // Conflict resolver type - default, localWins, remoteWins, custom or merge
+	CustomResolver string                  `json:"custom_resolver,omitempty"` // Conflict resolver function (custom)
+	MergePolicies  db.MergePolicies        `json:"merge_policies,omitempty"`  // Per-path merge policies (merge)
+}
+
+// PushNotificationsConfig enables wake-up notifications for users with registered devices, sent via a push gateway
+// (e.g. an FCM/APNs relay) when a change is made to a channel the user has access to.
+type PushNotificationsConfig struct {
+	GatewayURL   string  `json:"gateway_url"`             // Push gateway endpoint that notifications are POSTed to
+	DebounceSecs *uint32 `json:"debounce_secs,omitempty"` // Minimum interval between notifications sent to a single user's devices. Default 60 seconds
+}
+
+// MFAConfig enables TOTP multi-factor authentication, which users can enroll in via the _mfa endpoints.  Users that
+// have enabled MFA must complete a second step with a TOTP or recovery code when creating a session with a password.
+type MFAConfig struct {
+	EncryptionKey string `json:"encryption_key"`     // Base64 encoded 256-bit AES key used to encrypt users' TOTP secrets
+	Issuer        string `json:"issuer,omitempty"`   // Issuer shown in authenticator apps.  Default "Sync Gateway"
+	Required      *bool  `json:"required,omitempty"` // If true, all users must enroll before they can create a session with a password.  Default false
+}
+
+// LockoutConfig enables locking out users, and optionally source IP addresses, after repeated failed password logins
+// via basic auth, _session or BLIP.  Each consecutive lockout doubles in duration, up to max_lockout_secs.
+type LockoutConfig struct {
+	MaxFailedAttempts      *uint32 `json:"max_failed_attempts,omitempty"`        // Failed logins within window_secs after which a user is locked out.  Default 5
+	MaxFailedAttemptsPerIP *uint32 `json:"max_failed_attempts_per_ip,omitempty"` // Failed logins within window_secs after which a source IP is locked out.  Default 0 (disabled)
+	WindowSecs             *uint32 `json:"window_secs,omitempty"`                // Window in which failed logins are counted.  Default 300 seconds
+	LockoutSecs            *uint32 `json:"lockout_secs,omitempty"`               // Duration of a first lockout.  Default 60 seconds
+	MaxLockoutSecs         *uint32 `json:"max_lockout_secs,omitempty"`           // Maximum duration of a lockout.  Default 3600 seconds
+}
+
+func (c *LockoutConfig) options() *auth.LockoutOptions {
+	options := &auth.LockoutOptions{
+		MaxFailedAttempts:  auth.DefaultLockoutMaxFailedAttempts,
+		Window:             auth.DefaultLockoutWindow,
+		LockoutDuration:    auth.DefaultLockoutDuration,
+		MaxLockoutDuration: auth.DefaultMaxLockoutDuration,
+	}
+	if c.MaxFailedAttempts != nil {
+		options.MaxFailedAttempts = uint(*c.MaxFailedAttempts)
+	}
+	if c.MaxFailedAttemptsPerIP != nil {
+		options.MaxFailedAttemptsPerIP = uint(*c.MaxFailedAttemptsPerIP)
+	}
+	if c.WindowSecs != nil {
+		options.Window = time.Duration(*c.WindowSecs) * time.Second
+	}
+	if c.LockoutSecs != nil {
+		options.LockoutDuration = time.Duration(*c.LockoutSecs) * time.Second
+	}
+	if c.MaxLockoutSecs != nil {
+		options.MaxLockoutDuration = time.Duration(*c.MaxLockoutSecs) * time.Second
+	}
+	return options
+}
+
+// PasswordPolicyConfig sets requirements for users' passwords, which are checked when a password is set via the admin
+// API or changed via POST /{db}/_user/me/_password.  Existing passwords aren't affected until they're changed.
+type PasswordPolicyConfig struct {
+	MinLength                *uint32 `json:"min_length,omitempty"`                 // Minimum number of characters
+	RequireUppercase         *bool   `json:"require_uppercase,omitempty"`          // Require at least one uppercase letter.  Default false
+	RequireLowercase         *bool   `json:"require_lowercase,omitempty"`          // Require at least one lowercase letter.  Default false
+	RequireDigit             *bool   `json:"require_digit,omitempty"`              // Require at least one digit.  Default false
+	RequireSymbol            *bool   `json:"require_symbol,omitempty"`             // Require at least one character that isn't a letter or digit.  Default false
+	CompromisedPasswordsFile string  `json:"compromised_passwords_file,omitempty"` // File of compromised passwords, one per line, that aren't allowed
+	HistoryCount             *uint32 `json:"history_count,omitempty"`              // Number of previous passwords that can't be reused.  Default 0
+	MaxAgeSecs               *uint32 `json:"max_age_secs,omitempty"`               // Age after which a password expires, and must be changed before logging in.  Default no expiry
+}
+
+func (c *PasswordPolicyConfig) options() (*auth.PasswordPolicyOptions, error) {
+	options := &auth.PasswordPolicyOptions{
+		RequireUppercase: base.BoolDefault(c.RequireUppercase, false),
+		RequireLowercase: base.BoolDefault(c.RequireLowercase, false),
+		RequireDigit:     base.BoolDefault(c.RequireDigit, false),
+		RequireSymbol:    base.BoolDefault(c.RequireSymbol, false),
+	}
+	if c.MinLength != nil {
+		options.MinLength = int(*c.MinLength)
+	}
+	if c.HistoryCount != nil {
+		options.HistoryCount = int(*c.HistoryCount)
+	}
+	if c.MaxAgeSecs != nil {
+		options.MaxAge = time.Duration(*c.MaxAgeSecs) * time.Second
+	}
+	if c.CompromisedPasswordsFile != "" {
+		passwords, err := auth.LoadCompromisedPasswords(c.CompromisedPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		options.CompromisedPasswords = passwords
+	}
+	return options, nil
+}
+
+// SignupConfig enables self-service user registration via POST /{db}/_signup on the public API.  Verification and
+// password reset tokens are delivered by the configured sender.
+type SignupConfig struct {
+	DefaultRoles              []string                    `json:"default_roles,omitempty"`                 // Roles granted to new users
+	DefaultChannels           []string                    `json:"default_channels,omitempty"`              // Channels granted to new users
+	RequireEmailVerification  *bool                       `json:"require_email_verification,omitempty"`    // If true, new users are disabled until their email address is verified.  Default true
+	VerificationTokenTTLSecs  *uint32                     `json:"verification_token_ttl_secs,omitempty"`   // Time an email verification token is valid for.  Default 86400 seconds
+	PasswordResetTokenTTLSecs *uint32                     `json:"password_reset_token_ttl_secs,omitempty"` // Time a password reset token is valid for.  Default 3600 seconds
+	LinkURL                   string                      `json:"link_url,omitempty"`                      // URL included in messages, with {token} replaced by the token, e.g. https://example.com/verify?token={token}
+	Sender                    *AccountMessageSenderConfig `json:"sender,omitempty"`                        // Delivers tokens to users.  Required for email verification and password reset
+}
+
+// AccountMessageSenderConfig selects how verification and password reset tokens are delivered - by email via an SMTP
+// server, or by POSTing them to a webhook that delivers them.
+type AccountMessageSenderConfig struct {
+	Type       string            `json:"type"`                  // Sender type - smtp or webhook
+	SMTP       *SMTPSenderConfig `json:"smtp,omitempty"`        // SMTP server (smtp)
+	WebhookURL string            `json:"webhook_url,omitempty"` // URL that messages are POSTed to as JSON (webhook)
+}
+
+type SMTPSenderConfig struct {
+	Host     string `json:"host"`               // SMTP server host
+	Port     int    `json:"port,omitempty"`     // SMTP server port.  Default 587
+	Username string `json:"username,omitempty"` // Username for authentication, if required
+	Password string `json:"password,omitempty"` // Password for authentication
+	From     string `json:"from"`               // Sender address
+}
+
+const (
+	accountMessageSenderTypeSMTP    = "smtp"
+	accountMessageSenderTypeWebhook = "webhook"
+	defaultSMTPPort                 = 587
+)
+
+func (c *SignupConfig) validate() error {
+	if base.BoolDefault(c.RequireEmailVerification, true) && c.Sender == nil {
+		return fmt.Errorf("Invalid configuration - signup.sender must be set when signup.require_email_verification is true")
+	}
+	if (c.VerificationTokenTTLSecs != nil && *c.VerificationTokenTTLSecs == 0) || (c.PasswordResetTokenTTLSecs != nil && *c.PasswordResetTokenTTLSecs == 0) {
+		return fmt.Errorf("Invalid configuration - signup.verification_token_ttl_secs and signup.password_reset_token_ttl_secs must be greater than 0")
+	}
+	if c.LinkURL != "" && !strings.Contains(c.LinkURL, "{token}") {
+		return fmt.Errorf("Invalid configuration - signup.link_url must contain {token}")
+	}
+	if sender := c.Sender; sender != nil {
+		switch sender.Type {
+		case accountMessageSenderTypeSMTP:
+			if sender.SMTP == nil || sender.SMTP.Host == "" || sender.SMTP.From == "" {
+				return fmt.Errorf("Invalid configuration - signup.sender.smtp.host and signup.sender.smtp.from must be set when type is %s", sender.Type)
+			}
+			if sender.WebhookURL != "" {
+				return fmt.Errorf("Invalid configuration - signup.sender.webhook_url can't be set when type is %s", sender.Type)
+			}
+		case accountMessageSenderTypeWebhook:
+			if webhookURL, err := url.Parse(sender.WebhookURL); err != nil || (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Host == "" {
+				return fmt.Errorf("Invalid configuration - signup.sender.webhook_url must be an http or https URL")
+			}
+			if sender.SMTP != nil {
+				return fmt.Errorf("Invalid configuration - signup.sender.smtp can't be set when type is %s", sender.Type)
+			}
+		default:
+			return fmt.Errorf("Invalid configuration - signup.sender.type must be %s or %s", accountMessageSenderTypeSMTP, accountMessageSenderTypeWebhook)
+		}
+	}
+	return nil
+}
+
+func (c *SignupConfig) options() *db.SignupOptions {
+	options := &db.SignupOptions{
+		DefaultRoles:             c.DefaultRoles,
+		DefaultChannels:          c.DefaultChannels,
+		RequireEmailVerification: base.BoolDefault(c.RequireEmailVerification, true),
+		VerificationTokenTTL:     db.DefaultVerificationTokenTTL,
+		PasswordResetTokenTTL:    db.DefaultPasswordResetTokenTTL,
+		LinkURL:                  c.LinkURL,
+	}
+	if c.VerificationTokenTTLSecs != nil {
+		options.VerificationTokenTTL = time.Duration(*c.VerificationTokenTTLSecs) * time.Second
+	}
+	if c.PasswordResetTokenTTLSecs != nil {
+		options.PasswordResetTokenTTL = time.Duration(*c.PasswordResetTokenTTLSecs) * time.Second
+	}
+	if sender := c.Sender; sender != nil {
+		switch sender.Type {
+		case accountMessageSenderTypeSMTP:
+			smtpSender := &db.SMTPAccountMessageSender{
+				Host:     sender.SMTP.Host,
+				Port:     sender.SMTP.Port,
+				Username: sender.SMTP.Username,
+				Password: sender.SMTP.Password,
+				From:     sender.SMTP.From,
+			}
+			if smtpSender.Port == 0 {
+				smtpSender.Port = defaultSMTPPort
+			}
+			options.Sender = smtpSender
+		case accountMessageSenderTypeWebhook:
+			options.Sender = db.NewWebhookAccountMessageSender(sender.WebhookURL)
+		}
+	}
+	return options
+}
+
+// validateLocalJWTProvider checks the provider's configuration.  Keys are loaded when the database is created.
+func validateLocalJWTProvider(name string, provider *auth.LocalJWTProvider) error {
+	if strings.Contains(name, "_") {
+		return fmt.Errorf("Invalid configuration - local_jwt provider names cannot contain underscore: %s", name)
+	}
+	if provider == nil || provider.Issuer == "" || provider.Audience == "" {
+		return fmt.Errorf("Invalid configuration - local_jwt.%s.issuer and local_jwt.%s.audience must be set", name, name)
+	}
+	if len(provider.PublicKeys) == 0 && provider.JWKSFile == "" {
+		return fmt.Errorf("Invalid configuration - local_jwt.%s.public_keys or local_jwt.%s.jwks_file must be set", name, name)
+	}
+	for _, algorithm := range provider.Algorithms {
+		if !base.ContainsString(auth.DefaultLocalJWTAlgorithms, algorithm) {
+			return fmt.Errorf("Invalid configuration - local_jwt.%s.algorithms must be asymmetric signing algorithms, got %q", name, algorithm)
+		}
+	}
+	return nil
+}
+
+// AttachmentStoreConfig selects where attachment data is stored - in the bucket (the default), in a directory, or in
+// an S3-compatible object store.
+type AttachmentStoreConfig struct {
+	Type        db.AttachmentStoreType   `json:"type"`                   // Store type - bucket, filesystem or s3
+	Path        string                   `json:"path,omitempty"`         // Directory attachments are stored in (filesystem)
+	S3          *S3AttachmentStoreConfig `json:"s3,omitempty"`           // Object store connection details (s3)
+	MigrateFrom *AttachmentStoreConfig   `json:"migrate_from,omitempty"` // Store attachments are being migrated from, see /{db}/_attachment_migration
+}
+
+type S3AttachmentStoreConfig struct {
+	Endpoint  string `json:"endpoint"`             // Object store URL, e.g. https://s3.us-east-1.amazonaws.com
+	Bucket    string `json:"bucket"`               // Object store bucket
+	Region    string `json:"region,omitempty"`     // Region used for request signing.  Default us-east-1
+	Prefix    string `json:"prefix,omitempty"`     // Prefix of all object names
+	AccessKey string `json:"access_key,omitempty"` // Access key ID
+	SecretKey string `json:"secret_key,omitempty"` // Secret access key
+}
+
+// validate returns an error describing the first invalid setting, with field names relative to name.
+func (c *AttachmentStoreConfig) validate(name string) error {
+	switch c.Type {
+	case db.AttachmentStoreTypeBucket:
+		if c.Path != "" || c.S3 != nil {
+			return fmt.Errorf("Invalid configuration - %s.path and %s.s3 can't be set when type is %s", name, name, c.Type)
+		}
+	case db.AttachmentStoreTypeFilesystem:
+		if c.Path == "" {
+			return fmt.Errorf("Invalid configuration - %s.path must be set when type is %s", name, c.Type)
+		}
+		if c.S3 != nil {
+			return fmt.Errorf("Invalid configuration - %s.s3 can't be set when type is %s", name, c.Type)
+		}
+	case db.AttachmentStoreTypeS3:
+		if c.S3 == nil || c.S3.Bucket == "" {
+			return fmt.Errorf("Invalid configuration - %s.s3.bucket must be set when type is %s", name, c.Type)
+		}
+		if endpoint, err := url.Parse(c.S3.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+			return fmt.Errorf("Invalid configuration - %s.s3.endpoint must be an http or https URL", name)
+		}
+		if (c.S3.AccessKey == "") != (c.S3.SecretKey == "") {
+			return fmt.Errorf("Invalid configuration - %s.s3.access_key and %s.s3.secret_key must be set together", name, name)
+		}
+		if c.Path != "" {
+			return fmt.Errorf("Invalid configuration - %s.path can't be set when type is %s", name, c.Type)
+		}
+	default:
+		return fmt.Errorf("Invalid configuration - %s.type must be %s, %s or %s", name, db.AttachmentStoreTypeBucket, db.AttachmentStoreTypeFilesystem, db.AttachmentStoreTypeS3)
+	}
+	return nil
+}
+
+// sameStore returns true if both configs refer to the same underlying store.
+func (c *AttachmentStoreConfig) sameStore(other *AttachmentStoreConfig) bool {
+	if c.Type != other.Type {
+		return false
+	}
+	switch c.Type {
+	case db.AttachmentStoreTypeFilesystem:
+		return filepath.Clean(c.Path) == filepath.Clean(other.Path)
+	case db.AttachmentStoreTypeS3:
+		return c.S3.Endpoint == other.S3.Endpoint && c.S3.Bucket == other.S3.Bucket && c.S3.Prefix == other.S3.Prefix
+	}
+	return true
+}
+
+func (c *AttachmentStoreConfig) options() *db.AttachmentStoreOptions {
+	options := &db.AttachmentStoreOptions{
+		Type: c.Type,
+		Path: c.Path,
+	}
+	if c.S3 != nil {
+		options.S3 = &db.S3AttachmentStoreOptions{
+			Endpoint:  c.S3.Endpoint,
+			Bucket:    c.S3.Bucket,
+			Region:    c.S3.Region,
+			Prefix:    c.S3.Prefix,
+			AccessKey: c.S3.AccessKey,
+			SecretKey: c.S3.SecretKey,
+		}
+	}
+	if c.MigrateFrom != nil {
+		options.MigrateFrom = c.MigrateFrom.options()
+	}
+	return options
+}
+
+func (c *AttachmentStoreConfig) redactInPlace() {
+	if c.S3 != nil && c.S3.SecretKey != "" {
+		c.S3.SecretKey = base.RedactedStr
+	}
+	if c.MigrateFrom != nil {
+		c.MigrateFrom.redactInPlace()
+	}
+}
+
+// AttachmentPolicyConfig restricts the attachments clients can upload via the REST API and replication.
+type AttachmentPolicyConfig struct {
+	MaxSize             *int64                   `json:"max_size,omitempty"`              // Max size of a single attachment in bytes
+	MaxDocSize          *int64                   `json:"max_doc_size,omitempty"`          // Max total size of a document's attachments in bytes
+	AllowedContentTypes []string                 `json:"allowed_content_types,omitempty"` // Only allow these content types, e.g. image/jpeg or image/*
+	DeniedContentTypes  []string                 `json:"denied_content_types,omitempty"`  // Reject these content types
+	Scanner             *AttachmentScannerConfig `json:"scanner,omitempty"`               // Content scanning hook for new attachments
+}
+
+// AttachmentScannerConfig configures an HTTP endpoint that each new attachment is POSTed to before being stored.  A 2xx
+// response accepts the attachment, and a 403, 406 or 422 response rejects it.
+type AttachmentScannerConfig struct {
+	URL         string  `json:"url"`                    // Scanner endpoint
+	TimeoutSecs *uint32 `json:"timeout_secs,omitempty"` // Time allowed for the scanner to respond.  Default 30 seconds
+	FailOpen    *bool   `json:"fail_open,omitempty"`    // Accept attachments when the scanner is unavailable.  Default false
+}
+
+func (c *AttachmentPolicyConfig) options() *db.AttachmentPolicyOptions {
+	options := &db.AttachmentPolicyOptions{
+		AllowedContentTypes: c.AllowedContentTypes,
+		DeniedContentTypes:  c.DeniedContentTypes,
+	}
+	if c.MaxSize != nil {
+		options.MaxAttachmentSize = *c.MaxSize
+	}
+	if c.MaxDocSize != nil {
+		options.MaxDocAttachmentsSize = *c.MaxDocSize
+	}
+	if c.Scanner != nil {
+		options.Scanner = &db.AttachmentScannerOptions{
+			URL:      c.Scanner.URL,
+			Timeout:  db.DefaultAttachmentScannerTimeout,
+			FailOpen: base.BoolDefault(c.Scanner.FailOpen, false),
+		}
+		if c.Scanner.TimeoutSecs != nil {
+			options.Scanner.Timeout = time.Duration(*c.Scanner.TimeoutSecs) * time.Second
+		}
+	}
+	return options
+}
+
 type DbConfigMap map[string]*DbConfig
 
 type EventHandlerConfig struct {
-	MaxEventProc    uint           `json:"max_processes,omitempty"`    // Max concurrent event handling goroutines
-	WaitForProcess  string         `json:"wait_for_process,omitempty"` // Max wait time when event queue is full (ms)
-	DocumentChanged []*EventConfig `json:"document_changed,omitempty"` // Document changed
-	DBStateChanged  []*EventConfig `json:"db_state_changed,omitempty"` // DB state change
+	MaxEventProc            uint           `json:"max_processes,omitempty"`             // Max concurrent event handling goroutines
+	WaitForProcess          string         `json:"wait_for_process,omitempty"`          // Max wait time when event queue is full (ms)
+	DocumentChanged         []*EventConfig `json:"document_changed,omitempty"`          // Document changed
+	DBStateChanged          []*EventConfig `json:"db_state_changed,omitempty"`          // DB state change
+	PrincipalChanged        []*EventConfig `json:"principal_changed,omitempty"`         // User or role created, updated or deleted
+	ReplicationStateChanged []*EventConfig `json:"replication_state_changed,omitempty"` // sg-replicate replication state change
+	AuthFailed              []*EventConfig `json:"auth_failed,omitempty"`               // Request failed authentication
+	SessionCreated          []*EventConfig `json:"session_created,omitempty"`           // Session created
+	DocumentPurged          []*EventConfig `json:"document_purged,omitempty"`           // Document purged
+	DocumentExpired         []*EventConfig `json:"document_expired,omitempty"`          // Expired document removed
+}
+
+// eventConfigsByType returns the configured handlers for each event type.
+func (c *EventHandlerConfig) eventConfigsByType() map[db.EventType][]*EventConfig {
+	return map[db.EventType][]*EventConfig{
+		db.DocumentChange:         c.DocumentChanged,
+		db.DBStateChange:          c.DBStateChanged,
+		db.PrincipalChange:        c.PrincipalChanged,
+		db.ReplicationStateChange: c.ReplicationStateChanged,
+		db.AuthFailure:            c.AuthFailed,
+		db.SessionCreate:          c.SessionCreated,
+		db.DocumentPurge:          c.DocumentPurged,
+		db.DocumentExpiry:         c.DocumentExpired,
+	}
 }
 
 type EventConfig struct {
-	HandlerType string                 `json:"handler,omitempty"` // Handler type
-	Url         string                 `json:"url,omitempty"`     // Url (webhook)
-	Filter      string                 `json:"filter,omitempty"`  // Filter function (webhook)
-	Timeout     *uint64                `json:"timeout,omitempty"` // Timeout (webhook)
-	Options     map[string]interface{} `json:"options,omitempty"` // Options can be specified per-handler, and are specific to each type.
+	HandlerType   string                    `json:"handler,omitempty"`        // Handler type
+	Url           string                    `json:"url,omitempty"`            // Url (webhook)
+	Filter        string                    `json:"filter,omitempty"`         // Filter function (webhook)
+	Timeout       *uint64                   `json:"timeout,omitempty"`        // Timeout (webhook)
+	Options       map[string]interface{}    `json:"options,omitempty"`        // Options can be specified per-handler, and are specific to each type.
+	Broker        *db.BrokerConfig          `json:"broker,omitempty"`         // Broker settings (broker)
+	SigningSecret string                    `json:"signing_secret,omitempty"` // Secret used to HMAC sign requests (webhook)
+	Delivery      *db.WebhookDeliveryConfig `json:"delivery,omitempty"`       // Durable delivery settings (webhook)
+}
+
+// redactWebhookOptions redacts secrets given in webhook options.  References to secrets held outside the config
+// aren't redacted.
+func redactWebhookOptions(options map[string]interface{}) {
+	redact := func(value interface{}) interface{} {
+		if secret, ok := value.(string); ok && (secret == "" || db.IsWebhookSecretReference(secret)) {
+			return secret
+		}
+		return base.RedactedStr
+	}
+	if headers, ok := options[db.EventOptionSecretHeaders].(map[string]interface{}); ok {
+		for name, value := range headers {
+			headers[name] = redact(value)
+		}
+	}
+	if token, ok := options[db.EventOptionBearerToken]; ok {
+		options[db.EventOptionBearerToken] = redact(token)
+	}
+	if basicAuth, ok := options[db.EventOptionBasicAuth].(map[string]interface{}); ok {
+		if password, ok := basicAuth["password"]; ok {
+			basicAuth["password"] = redact(password)
+		}
+	}
+}
+
+func (c *EventHandlerConfig) redactInPlace() {
+	for _, events := range c.eventConfigsByType() {
+		for _, event := range events {
+			if event.SigningSecret != "" {
+				event.SigningSecret = base.RedactedStr
+			}
+			redactWebhookOptions(event.Options)
+		}
+	}
 }
 
 type CacheConfig struct {
@@ -183,7 +611,9 @@ type CacheConfig struct {
 }
 
 // ***************************************************************
+//
 //	Kept around for CBG-356 backwards compatability
+//
 // ***************************************************************
 type DeprecatedCacheConfig struct {
 	DeprecatedCachePendingSeqMaxWait *uint32 `json:"max_wait_pending,omitempty"`         // Max wait for pending sequence before skipping
@@ -346,6 +776,17 @@ func (dbConfig *DbConfig) setup(dbName string, bootstrapConfig BootstrapConfig,
 			rc.ConflictResolutionFn = conflictResolutionFn
 		}
 	}
+	if ccr := dbConfig.ClientConflictResolution; ccr != nil && ccr.CustomResolver != "" {
+		conflictResolutionFn, err := loadJavaScript(ccr.CustomResolver, insecureSkipVerify)
+		if err != nil {
+			return &JavaScriptLoadError{
+				JSLoadType: ConflictResolver,
+				Path:       ccr.CustomResolver,
+				Err:        err,
+			}
+		}
+		ccr.CustomResolver = conflictResolutionFn
+	}
 
 	return nil
 }
@@ -389,11 +830,12 @@ const (
 	ImportFilter                       // Import filter JavaScript load.
 	ConflictResolver                   // Conflict Resolver JavaScript load.
 	WebhookFilter                      // Webhook filter JavaScript load.
+	WebhookTransform                   // Webhook transform JavaScript load.
 	jsLoadTypeCount                    // Number of JSLoadType constants.
 )
 
 // jsLoadTypes represents the list of different possible JSLoadType.
-var jsLoadTypes = []string{"SyncFunction", "ImportFilter", "ConflictResolver", "WebhookFilter"}
+var jsLoadTypes = []string{"SyncFunction", "ImportFilter", "ConflictResolver", "WebhookFilter", "WebhookTransform"}
 
 // String returns the string representation of a specific JSLoadType.
 func (t JSLoadType) String() string {
@@ -596,6 +1038,121 @@ func (dbConfig *DbConfig) validateVersion(isEnterpriseEdition bool) error {
 		dbConfig.DeltaSync.Enabled = nil
 	}
 
+	if ccr := dbConfig.ClientConflictResolution; ccr != nil {
+		if !isEnterpriseEdition && ccr.Type != db.ConflictResolverDefault {
+			base.Warnf(eeOnlyWarningMsg, "client_conflict_resolution.type", ccr.Type, nil)
+			dbConfig.ClientConflictResolution = nil
+		} else if !ccr.Type.IsValid() {
+			multiError = multiError.Append(fmt.Errorf(db.ConfigErrorInvalidConflictResolutionTypeFmt,
+				db.ConflictResolverLocalWins, db.ConflictResolverRemoteWins, db.ConflictResolverDefault, db.ConflictResolverCustom, db.ConflictResolverMerge))
+		} else {
+			if *dbConfig.ConflictsAllowed() {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - client_conflict_resolution set, but allow_conflicts is not false"))
+			}
+			if ccr.Type == db.ConflictResolverCustom {
+				if strings.TrimSpace(ccr.CustomResolver) == "" {
+					multiError = multiError.Append(fmt.Errorf("Invalid configuration - client_conflict_resolution type is custom, but custom_resolver is not set"))
+				} else if _, err := sgbucket.NewJSRunner(ccr.CustomResolver); err != nil {
+					multiError = multiError.Append(fmt.Errorf("client_conflict_resolution custom_resolver contains invalid javascript syntax: %v", err))
+				}
+			}
+			if len(ccr.MergePolicies) > 0 {
+				if ccr.Type != db.ConflictResolverMerge {
+					multiError = multiError.Append(fmt.Errorf("Invalid configuration - client_conflict_resolution merge_policies can only be set when type is %s", db.ConflictResolverMerge))
+				} else if err := ccr.MergePolicies.Validate(); err != nil {
+					multiError = multiError.Append(err)
+				}
+			}
+		}
+	}
+
+	if pn := dbConfig.PushNotifications; pn != nil {
+		if gatewayURL, err := url.Parse(pn.GatewayURL); err != nil || (gatewayURL.Scheme != "http" && gatewayURL.Scheme != "https") || gatewayURL.Host == "" {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - push_notifications.gateway_url must be an http or https URL"))
+		}
+	}
+
+	if mfa := dbConfig.MFA; mfa != nil {
+		if _, err := auth.DecodeMFAEncryptionKey(mfa.EncryptionKey); err != nil {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - mfa.encryption_key must be a base64 encoded 256-bit key: %v", err))
+		}
+	}
+
+	if lockout := dbConfig.Lockout; lockout != nil {
+		if lockout.MaxFailedAttempts != nil && *lockout.MaxFailedAttempts == 0 {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - lockout.max_failed_attempts must be greater than 0"))
+		}
+		if (lockout.WindowSecs != nil && *lockout.WindowSecs == 0) || (lockout.LockoutSecs != nil && *lockout.LockoutSecs == 0) || (lockout.MaxLockoutSecs != nil && *lockout.MaxLockoutSecs == 0) {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - lockout.window_secs, lockout.lockout_secs and lockout.max_lockout_secs must be greater than 0"))
+		} else if options := lockout.options(); options.LockoutDuration > options.MaxLockoutDuration {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - lockout.lockout_secs must not be greater than lockout.max_lockout_secs"))
+		}
+	}
+
+	if pp := dbConfig.PasswordPolicy; pp != nil {
+		if pp.HistoryCount != nil && *pp.HistoryCount > maxPasswordHistoryCount {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - password_policy.history_count must not be greater than %d", maxPasswordHistoryCount))
+		}
+		if pp.MaxAgeSecs != nil && *pp.MaxAgeSecs == 0 {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - password_policy.max_age_secs must be greater than 0"))
+		}
+	}
+
+	if dbConfig.Signup != nil {
+		if err := dbConfig.Signup.validate(); err != nil {
+			multiError = multiError.Append(err)
+		}
+	}
+
+	for name, provider := range dbConfig.LocalJWTConfig {
+		if err := validateLocalJWTProvider(name, provider); err != nil {
+			multiError = multiError.Append(err)
+		}
+	}
+
+	if as := dbConfig.AttachmentStore; as != nil {
+		if err := as.validate("attachment_store"); err != nil {
+			multiError = multiError.Append(err)
+		} else if from := as.MigrateFrom; from != nil {
+			if from.MigrateFrom != nil {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_store.migrate_from.migrate_from can't be set"))
+			} else if err := from.validate("attachment_store.migrate_from"); err != nil {
+				multiError = multiError.Append(err)
+			} else if from.sameStore(as) {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_store.migrate_from must be a different store"))
+			}
+		}
+	}
+
+	if ap := dbConfig.AttachmentPolicy; ap != nil {
+		if ap.MaxSize != nil && *ap.MaxSize < 0 {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_policy.max_size can't be negative"))
+		}
+		if ap.MaxDocSize != nil && *ap.MaxDocSize < 0 {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_policy.max_doc_size can't be negative"))
+		}
+		for _, contentType := range append(append([]string{}, ap.AllowedContentTypes...), ap.DeniedContentTypes...) {
+			if parts := strings.Split(contentType, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_policy content type %q must be a media type such as image/jpeg or image/*", contentType))
+			}
+		}
+		if scanner := ap.Scanner; scanner != nil {
+			if scannerURL, err := url.Parse(scanner.URL); err != nil || (scannerURL.Scheme != "http" && scannerURL.Scheme != "https") || scannerURL.Host == "" {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_policy.scanner.url must be an http or https URL"))
+			}
+			if scanner.TimeoutSecs != nil && *scanner.TimeoutSecs == 0 {
+				multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_policy.scanner.timeout_secs must be greater than zero"))
+			}
+		}
+	}
+
+	for _, size := range dbConfig.AttachmentRenditionSizes {
+		if size <= 0 || size > db.MaxAttachmentRenditionDimension {
+			multiError = multiError.Append(fmt.Errorf("Invalid configuration - attachment_rendition_sizes must be between 1 and %d", db.MaxAttachmentRenditionDimension))
+			break
+		}
+	}
+
 	// Import validation
 	autoImportEnabled, err := dbConfig.AutoImportEnabled()
 	if err != nil {
@@ -824,6 +1381,22 @@ func (config *DbConfig) redactInPlace() error {
 		config.Replications[i] = config.Replications[i].Redacted()
 	}
 
+	if config.MFA != nil && config.MFA.EncryptionKey != "" {
+		config.MFA.EncryptionKey = base.RedactedStr
+	}
+
+	if config.Signup != nil && config.Signup.Sender != nil && config.Signup.Sender.SMTP != nil && config.Signup.Sender.SMTP.Password != "" {
+		config.Signup.Sender.SMTP.Password = base.RedactedStr
+	}
+
+	if config.AttachmentStore != nil {
+		config.AttachmentStore.redactInPlace()
+	}
+
+	if config.EventHandlers != nil {
+		config.EventHandlers.redactInPlace()
+	}
+
 	return nil
 }
 
@@ -996,6 +1569,12 @@ func (sc *StartupConfig) validate(isEnterpriseEdition bool) (errorMessages error
 		multiError = multiError.Append(fmt.Errorf("%v: %d outside allowed range: %d-%d", auth.ErrInvalidBcryptCost, sc.Auth.BcryptCost, auth.DefaultBcryptCost, bcrypt.MaxCost))
 	}
 
+	for username, localAdminUser := range sc.API.LocalAdminUsers {
+		if err := localAdminUser.validate(username); err != nil {
+			multiError = multiError.Append(err)
+		}
+	}
+
 	// EE only features
 	if !isEnterpriseEdition {
 		if sc.API.EnableAdminAuthenticationPermissionsCheck != nil && *sc.API.EnableAdminAuthenticationPermissionsCheck {
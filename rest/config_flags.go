@@ -46,6 +46,7 @@ func registerConfigFlags(config *StartupConfig, fs *flag.FlagSet) map[string]con
 		"api.max_connections":                               {&config.API.MaximumConnections, fs.Uint("api.max_connections", 0, "Max # of incoming HTTP connections to accept")},
 		"api.compress_responses":                            {&config.API.CompressResponses, fs.Bool("api.compress_responses", false, "If false, disables compression of HTTP responses")},
 		"api.hide_product_version":                          {&config.API.CompressResponses, fs.Bool("api.hide_product_version", false, "Whether product versions removed from Server headers and REST API responses")},
+		"api.local_admin_users":                             {&config.API.LocalAdminUsers, fs.String("api.local_admin_users", "null", "JSON-encoded admin users authenticated by Sync Gateway instead of Couchbase Server")},
 
 		"api.https.tls_minimum_version": {&config.API.HTTPS.TLSMinimumVersion, fs.String("api.https.tls_minimum_version", "", "The minimum allowable TLS version for the REST APIs")},
 		"api.https.tls_cert_path":       {&config.API.HTTPS.TLSCertPath, fs.String("api.https.tls_cert_path", "", "The TLS cert file to use for the REST APIs")},
@@ -205,6 +206,18 @@ func fillConfigWithFlags(fs *flag.FlagSet, flags map[string]configFlag) error {
 					return
 				}
 				*val.config.(*PerDatabaseCredentialsConfig) = dbCredentials
+			case *LocalAdminUsersConfig:
+				str := *val.flagValue.(*string)
+				var localAdminUsers LocalAdminUsersConfig
+				d := base.JSONDecoder(strings.NewReader(str))
+				d.DisallowUnknownFields()
+				err := d.Decode(&localAdminUsers)
+				if err != nil {
+					err = fmt.Errorf("flag %s for value %q error: %w", f.Name, str, err)
+					errorMessages = errorMessages.Append(err)
+					return
+				}
+				*val.config.(*LocalAdminUsersConfig) = localAdminUsers
 			default:
 				errorMessages = errorMessages.Append(fmt.Errorf("Unknown type %v for flag %v\n", rval.Type(), f.Name))
 			}
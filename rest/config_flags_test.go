@@ -38,6 +38,8 @@ func TestAllConfigFlags(t *testing.T) {
 				val = "trace"
 			case *PerDatabaseCredentialsConfig:
 				val = `{"db1":{"password":"foo"}}`
+			case *LocalAdminUsersConfig:
+				val = `{"ops":{"password_hash":"foo"}}`
 			}
 			flags = append(flags, "-"+name, val)
 		case bool:
@@ -100,6 +100,8 @@ type APIConfig struct {
 	MetricsInterfaceAuthentication            *bool `json:"metrics_interface_authentication,omitempty" help:"Whether the metrics API requires authentication"`
 	EnableAdminAuthenticationPermissionsCheck *bool `json:"enable_advanced_auth_dp,omitempty" help:"Whether to enable the DP permissions check feature of admin auth"`
 
+	LocalAdminUsers LocalAdminUsersConfig `json:"local_admin_users,omitempty" help:"Admin users authenticated by Sync Gateway instead of Couchbase Server"`
+
 	ServerReadTimeout  *base.ConfigDuration `json:"server_read_timeout,omitempty"  help:"Maximum duration.Second before timing out read of the HTTP(S) request"`
 	ServerWriteTimeout *base.ConfigDuration `json:"server_write_timeout,omitempty" help:"Maximum duration.Second before timing out write of the HTTP(S) response"`
 	ReadHeaderTimeout  *base.ConfigDuration `json:"read_header_timeout,omitempty"  help:"The amount of time allowed to read request headers"`
@@ -156,6 +158,16 @@ type DatabaseCredentialsConfig struct {
 	X509KeyPath  string `json:"x509_key_path,omitempty"  help:"Key path (private key) for X.509 bucket auth"`
 }
 
+// LocalAdminUsersConfig is a map of username to local admin user.
+type LocalAdminUsersConfig map[string]*LocalAdminUserConfig
+
+// LocalAdminUserConfig is an admin user authenticated by Sync Gateway, whose permissions are checked without
+// Couchbase Server RBAC.
+type LocalAdminUserConfig struct {
+	PasswordHash string              `json:"password_hash,omitempty" help:"bcrypt hash of the user's password"`
+	Permissions  map[string][]string `json:"permissions,omitempty"   help:"A map of database name, or * for all databases, to the names of the permissions granted"`
+}
+
 type DeprecatedConfig struct {
 	Facebook *FacebookConfigLegacy `json:"-" help:""`
 	Google   *GoogleConfigLegacy   `json:"-" help:""`
@@ -179,6 +191,12 @@ func (sc *StartupConfig) Redacted() (*StartupConfig, error) {
 		}
 	}
 
+	for _, localAdminUser := range config.API.LocalAdminUsers {
+		if localAdminUser != nil && localAdminUser.PasswordHash != "" {
+			localAdminUser.PasswordHash = base.RedactedStr
+		}
+	}
+
 	return &config, nil
 }
 
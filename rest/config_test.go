@@ -300,6 +300,487 @@ func TestConfigValidationImportPartitions(t *testing.T) {
 	}
 }
 
+func TestConfigValidationPushNotifications(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid",
+			config: `{"push_notifications": {"gateway_url": "https://push.example.com/notify", "debounce_secs": 30}}`,
+		},
+		{
+			name:   "Missing gateway URL",
+			config: `{"push_notifications": {"debounce_secs": 30}}`,
+			err:    "Invalid configuration - push_notifications.gateway_url must be an http or https URL",
+		},
+		{
+			name:   "Invalid gateway URL scheme",
+			config: `{"push_notifications": {"gateway_url": "ftp://push.example.com"}}`,
+			err:    "Invalid configuration - push_notifications.gateway_url must be an http or https URL",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationMFA(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid",
+			config: `{"mfa": {"encryption_key": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", "issuer": "Example", "required": true}}`,
+		},
+		{
+			name:   "Missing encryption key",
+			config: `{"mfa": {"required": true}}`,
+			err:    "Invalid configuration - mfa.encryption_key must be a base64 encoded 256-bit key: key must be 32 bytes, not 0",
+		},
+		{
+			name:   "Short encryption key",
+			config: `{"mfa": {"encryption_key": "AAAAAAAAAAAAAAAAAAAAAA=="}}`,
+			err:    "Invalid configuration - mfa.encryption_key must be a base64 encoded 256-bit key: key must be 32 bytes, not 16",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationLockout(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid",
+			config: `{"lockout": {"max_failed_attempts": 3, "max_failed_attempts_per_ip": 50, "window_secs": 60, "lockout_secs": 30, "max_lockout_secs": 600}}`,
+		},
+		{
+			name:   "Defaults",
+			config: `{"lockout": {}}`,
+		},
+		{
+			name:   "Zero max failed attempts",
+			config: `{"lockout": {"max_failed_attempts": 0}}`,
+			err:    "Invalid configuration - lockout.max_failed_attempts must be greater than 0",
+		},
+		{
+			name:   "Zero window",
+			config: `{"lockout": {"window_secs": 0}}`,
+			err:    "Invalid configuration - lockout.window_secs, lockout.lockout_secs and lockout.max_lockout_secs must be greater than 0",
+		},
+		{
+			name:   "Lockout longer than max",
+			config: `{"lockout": {"lockout_secs": 7200}}`,
+			err:    "Invalid configuration - lockout.lockout_secs must not be greater than lockout.max_lockout_secs",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationPasswordPolicy(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid",
+			config: `{"password_policy": {"min_length": 12, "require_uppercase": true, "require_digit": true, "history_count": 5, "max_age_secs": 7776000}}`,
+		},
+		{
+			name:   "History too long",
+			config: `{"password_policy": {"history_count": 100}}`,
+			err:    "Invalid configuration - password_policy.history_count must not be greater than 24",
+		},
+		{
+			name:   "Zero max age",
+			config: `{"password_policy": {"max_age_secs": 0}}`,
+			err:    "Invalid configuration - password_policy.max_age_secs must be greater than 0",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationSignup(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid smtp",
+			config: `{"signup": {"default_channels": ["public"], "link_url": "https://example.com/verify?token={token}", "sender": {"type": "smtp", "smtp": {"host": "smtp.example.com", "from": "noreply@example.com"}}}}`,
+		},
+		{
+			name:   "Valid without verification",
+			config: `{"signup": {"require_email_verification": false}}`,
+		},
+		{
+			name:   "Verification without sender",
+			config: `{"signup": {}}`,
+			err:    "Invalid configuration - signup.sender must be set when signup.require_email_verification is true",
+		},
+		{
+			name:   "Zero token TTL",
+			config: `{"signup": {"verification_token_ttl_secs": 0, "sender": {"type": "webhook", "webhook_url": "https://example.com/messages"}}}`,
+			err:    "Invalid configuration - signup.verification_token_ttl_secs and signup.password_reset_token_ttl_secs must be greater than 0",
+		},
+		{
+			name:   "Link without token",
+			config: `{"signup": {"link_url": "https://example.com/verify", "sender": {"type": "webhook", "webhook_url": "https://example.com/messages"}}}`,
+			err:    "Invalid configuration - signup.link_url must contain {token}",
+		},
+		{
+			name:   "SMTP without host",
+			config: `{"signup": {"sender": {"type": "smtp", "smtp": {"from": "noreply@example.com"}}}}`,
+			err:    "Invalid configuration - signup.sender.smtp.host and signup.sender.smtp.from must be set when type is smtp",
+		},
+		{
+			name:   "Invalid webhook URL",
+			config: `{"signup": {"sender": {"type": "webhook", "webhook_url": "ftp://example.com"}}}`,
+			err:    "Invalid configuration - signup.sender.webhook_url must be an http or https URL",
+		},
+		{
+			name:   "Invalid sender type",
+			config: `{"signup": {"sender": {"type": "carrier_pigeon"}}}`,
+			err:    "Invalid configuration - signup.sender.type must be smtp or webhook",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationLocalJWT(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid public keys",
+			config: `{"local_jwt": {"internal": {"issuer": "https://auth.example.com", "audience": "sync", "algorithms": ["RS256"], "public_keys": ["-----BEGIN PUBLIC KEY-----"]}}}`,
+		},
+		{
+			name:   "Valid jwks file",
+			config: `{"local_jwt": {"internal": {"issuer": "https://auth.example.com", "audience": "sync", "jwks_file": "/etc/sync_gateway/jwks.json"}}}`,
+		},
+		{
+			name:   "Missing audience",
+			config: `{"local_jwt": {"internal": {"issuer": "https://auth.example.com", "jwks_file": "/etc/sync_gateway/jwks.json"}}}`,
+			err:    "Invalid configuration - local_jwt.internal.issuer and local_jwt.internal.audience must be set",
+		},
+		{
+			name:   "Missing keys",
+			config: `{"local_jwt": {"internal": {"issuer": "https://auth.example.com", "audience": "sync"}}}`,
+			err:    "Invalid configuration - local_jwt.internal.public_keys or local_jwt.internal.jwks_file must be set",
+		},
+		{
+			name:   "Symmetric algorithm",
+			config: `{"local_jwt": {"internal": {"issuer": "https://auth.example.com", "audience": "sync", "algorithms": ["HS256"], "jwks_file": "/etc/sync_gateway/jwks.json"}}}`,
+			err:    `Invalid configuration - local_jwt.internal.algorithms must be asymmetric signing algorithms, got "HS256"`,
+		},
+		{
+			name:   "Underscore in name",
+			config: `{"local_jwt": {"my_provider": {"issuer": "https://auth.example.com", "audience": "sync", "jwks_file": "/etc/sync_gateway/jwks.json"}}}`,
+			err:    "Invalid configuration - local_jwt provider names cannot contain underscore: my_provider",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationAttachmentStore(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid filesystem",
+			config: `{"attachment_store": {"type": "filesystem", "path": "/data/attachments"}}`,
+		},
+		{
+			name:   "Valid s3 migrating from bucket",
+			config: `{"attachment_store": {"type": "s3", "s3": {"endpoint": "https://minio.example.com", "bucket": "attachments", "access_key": "key", "secret_key": "secret"}, "migrate_from": {"type": "bucket"}}}`,
+		},
+		{
+			name:   "Invalid type",
+			config: `{"attachment_store": {"type": "tape"}}`,
+			err:    "Invalid configuration - attachment_store.type must be bucket, filesystem or s3",
+		},
+		{
+			name:   "Filesystem without path",
+			config: `{"attachment_store": {"type": "filesystem"}}`,
+			err:    "Invalid configuration - attachment_store.path must be set when type is filesystem",
+		},
+		{
+			name:   "S3 without bucket",
+			config: `{"attachment_store": {"type": "s3", "s3": {"endpoint": "https://minio.example.com"}}}`,
+			err:    "Invalid configuration - attachment_store.s3.bucket must be set when type is s3",
+		},
+		{
+			name:   "S3 invalid endpoint",
+			config: `{"attachment_store": {"type": "s3", "s3": {"endpoint": "minio.example.com", "bucket": "attachments"}}}`,
+			err:    "Invalid configuration - attachment_store.s3.endpoint must be an http or https URL",
+		},
+		{
+			name:   "S3 access key without secret key",
+			config: `{"attachment_store": {"type": "s3", "s3": {"endpoint": "https://minio.example.com", "bucket": "attachments", "access_key": "key"}}}`,
+			err:    "Invalid configuration - attachment_store.s3.access_key and attachment_store.s3.secret_key must be set together",
+		},
+		{
+			name:   "Invalid migrate_from",
+			config: `{"attachment_store": {"type": "bucket", "migrate_from": {"type": "filesystem"}}}`,
+			err:    "Invalid configuration - attachment_store.migrate_from.path must be set when type is filesystem",
+		},
+		{
+			name:   "Nested migrate_from",
+			config: `{"attachment_store": {"type": "filesystem", "path": "/a", "migrate_from": {"type": "filesystem", "path": "/b", "migrate_from": {"type": "bucket"}}}}`,
+			err:    "Invalid configuration - attachment_store.migrate_from.migrate_from can't be set",
+		},
+		{
+			name:   "Migrate from same store",
+			config: `{"attachment_store": {"type": "filesystem", "path": "/a", "migrate_from": {"type": "filesystem", "path": "/a/"}}}`,
+			err:    "Invalid configuration - attachment_store.migrate_from must be a different store",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationAttachmentRenditionSizes(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid",
+			config: `{"attachment_rendition_sizes": [100, 200, 4096]}`,
+		},
+		{
+			name:   "Zero",
+			config: `{"attachment_rendition_sizes": [100, 0]}`,
+			err:    "Invalid configuration - attachment_rendition_sizes must be between 1 and 4096",
+		},
+		{
+			name:   "Too large",
+			config: `{"attachment_rendition_sizes": [4097]}`,
+			err:    "Invalid configuration - attachment_rendition_sizes must be between 1 and 4096",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestConfigValidationClientConflictResolution(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name:   "Valid merge",
+			config: `{"allow_conflicts": false, "client_conflict_resolution": {"type": "merge", "merge_policies": {"tags": {"type": "union"}}}}`,
+		},
+		{
+			name:   "Valid custom",
+			config: `{"allow_conflicts": false, "client_conflict_resolution": {"type": "custom", "custom_resolver": "function(conflict) {return conflict.LocalDocument;}"}}`,
+		},
+		{
+			name:   "Conflicts allowed",
+			config: `{"allow_conflicts": true, "client_conflict_resolution": {"type": "localWins"}}`,
+			err:    "Invalid configuration - client_conflict_resolution set, but allow_conflicts is not false",
+		},
+		{
+			name:   "Invalid type",
+			config: `{"allow_conflicts": false, "client_conflict_resolution": {"type": "random"}}`,
+			err: fmt.Sprintf(db.ConfigErrorInvalidConflictResolutionTypeFmt, db.ConflictResolverLocalWins, db.ConflictResolverRemoteWins,
+				db.ConflictResolverDefault, db.ConflictResolverCustom, db.ConflictResolverMerge),
+		},
+		{
+			name:   "Custom without resolver",
+			config: `{"allow_conflicts": false, "client_conflict_resolution": {"type": "custom"}}`,
+			err:    "Invalid configuration - client_conflict_resolution type is custom, but custom_resolver is not set",
+		},
+		{
+			name:   "Merge policies without merge",
+			config: `{"allow_conflicts": false, "client_conflict_resolution": {"type": "localWins", "merge_policies": {"tags": {"type": "union"}}}}`,
+			err:    "Invalid configuration - client_conflict_resolution merge_policies can only be set when type is merge",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var dbConfig DbConfig
+			require.NoError(t, base.JSONUnmarshal([]byte(test.config), &dbConfig))
+			dbConfig.Name = "db"
+			err := dbConfig.validateVersion(true)
+			if test.err != "" {
+				require.NotNil(t, err)
+				multiError, ok := err.(*base.MultiError)
+				require.True(t, ok)
+				require.Equal(t, multiError.Len(), 1)
+				assert.EqualError(t, multiError.Errors[0], test.err)
+			} else {
+				assert.NoError(t, err)
+				assert.NotNil(t, dbConfig.ClientConflictResolution)
+			}
+		})
+	}
+
+	// CE only supports the default resolver
+	var dbConfig DbConfig
+	require.NoError(t, base.JSONUnmarshal([]byte(`{"name": "db", "allow_conflicts": false, "client_conflict_resolution": {"type": "merge"}}`), &dbConfig))
+	assert.NoError(t, dbConfig.validateVersion(false))
+	assert.Nil(t, dbConfig.ClientConflictResolution)
+}
+
 // TestLoadServerConfigExamples will run LoadLegacyServerConfig for configs found under the legacy examples directory.
 func TestLoadServerConfigExamples(t *testing.T) {
 	const exampleLogDirectory = "../examples/legacy_config"
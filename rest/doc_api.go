@@ -200,12 +200,23 @@ func (h *handler) handleGetAttachment() error {
 		return db.ErrAttachmentVersion
 	}
 	attachmentKey := db.MakeAttachmentKey(version, docid, digest)
+	metaOption := h.getBoolQuery("meta")
+
+	// A resized rendition of an image attachment is requested with the width, height and format options
+	width, height, format := h.getQuery("width"), h.getQuery("height"), h.getQuery("format")
+	if !metaOption && (width != "" || height != "" || format != "") {
+		spec, err := db.NewAttachmentRenditionSpec(width, height, format)
+		if err != nil {
+			return err
+		}
+		return h.writeAttachmentRendition(attachmentKey, digest, spec)
+	}
+
 	data, err := h.db.GetAttachment(attachmentKey)
 	if err != nil {
 		return err
 	}
 
-	metaOption := h.getBoolQuery("meta")
 	if metaOption {
 		meta["key"] = attachmentKey
 		h.writeJSONStatus(http.StatusOK, meta)
@@ -279,6 +290,33 @@ func (h *handler) handleGetAttachment() error {
 
 }
 
+// writeAttachmentRendition writes a rendition of an image attachment the user has access to.
+func (h *handler) writeAttachmentRendition(attachmentKey, digest string, spec *db.AttachmentRenditionSpec) error {
+	data, contentType, err := h.db.GetAttachmentRendition(attachmentKey, digest, spec)
+	if err != nil {
+		return err
+	}
+
+	status, start, end := h.handleRange(uint64(len(data)))
+	if status > 299 {
+		return base.HTTPErrorf(status, "")
+	} else if status == http.StatusPartialContent {
+		data = data[start:end]
+	}
+	h.setHeader("Content-Length", strconv.FormatUint(uint64(len(data)), 10))
+	h.setHeader("Content-Type", contentType)
+	h.setHeader("Etag", strconv.Quote(digest+"/"+spec.String()))
+	// #720
+	if h.privs == adminPrivs {
+		h.setHeader("Content-Disposition", "attachment")
+	}
+	h.db.DbStats.CBLReplicationPull().AttachmentPullCount.Add(1)
+	h.db.DbStats.CBLReplicationPull().AttachmentPullBytes.Add(int64(len(data)))
+	h.response.WriteHeader(status)
+	_, _ = h.response.Write(data)
+	return nil
+}
+
 // HTTP handler for a PUT of an attachment
 func (h *handler) handlePutAttachment() error {
 	docid := h.PathVar("docid")
@@ -291,6 +329,15 @@ func (h *handler) handlePutAttachment() error {
 	if revid == "" {
 		revid = h.rq.Header.Get("If-Match")
 	}
+	// Reject attachments the attachment policy doesn't allow before reading the body.  The content length is only
+	// the attachment size when the body isn't compressed.
+	uploadSize := h.rq.ContentLength
+	if h.rq.Header.Get("Content-Encoding") != "" {
+		uploadSize = -1
+	}
+	if err := h.db.CheckAttachmentUpload(attachmentName, attachmentContentType, uploadSize); err != nil {
+		return err
+	}
 	attachmentData, err := h.readBody()
 	if err != nil {
 		return err
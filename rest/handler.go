@@ -20,6 +20,7 @@ import (
 	"math"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -257,9 +258,23 @@ func (h *handler) invoke(method handlerMethod, accessPermissions []Permission, r
 		if err = h.checkAuth(dbContext); err != nil {
 			return err
 		}
+		if err = h.checkAPIKeyScopes(accessPermissions); err != nil {
+			return err
+		}
 	}
 
+	// Local admin users are authenticated by Sync Gateway, rather than by Couchbase Server
+	var localAdminUsername, localAdminPassword string
+	var localAdmin *LocalAdminUserConfig
 	if shouldCheckAdminAuth {
+		localAdminUsername, localAdminPassword, localAdmin = h.localAdminUser()
+	}
+
+	if localAdmin != nil {
+		if err := h.checkLocalAdminAuth(localAdminUsername, localAdminPassword, localAdmin, accessPermissions, responsePermissions); err != nil {
+			return err
+		}
+	} else if shouldCheckAdminAuth {
 		// If server is walrus but auth is enabled we should just kick the user out as invalid as we have nothing to
 		// validate credentials against
 		if base.ServerIsWalrus(h.server.config.Bootstrap.Server) {
@@ -416,23 +431,31 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 		context.DbStats.Security().TotalAuthTime.Add(delta)
 		if err != nil {
 			context.DbStats.Security().AuthFailedCount.Add(1)
+			username, _ := h.getBasicAuth()
+			if raiseErr := context.EventMgr.RaiseAuthFailureEvent(context.Name, username, h.rq.RemoteAddr, h.rq.URL.Path, err.Error()); raiseErr != nil {
+				base.Debugf(base.KeyEvents, "Unable to raise auth failure event: %v", raiseErr)
+			}
 		} else {
 			context.DbStats.Security().AuthSuccessCount.Add(1)
 		}
 
 	}(time.Now())
 
-	// If oidc enabled, check for bearer ID token
-	if context.Options.OIDCOptions != nil {
+	// If oidc or local JWT providers are enabled, check for bearer ID token
+	if context.Options.OIDCOptions != nil || len(context.LocalJWTProviders) > 0 {
 		if token := h.getBearerToken(); token != "" {
 			var authJwtErr error
-			h.user, authJwtErr = context.Authenticator().AuthenticateUntrustedJWT(token, context.OIDCProviders, h.getOIDCCallbackURL)
+			var grants *auth.JWTGrants
+			h.user, grants, authJwtErr = context.Authenticator().AuthenticateUntrustedJWT(token, context.OIDCProviders, context.LocalJWTProviders, h.getOIDCCallbackURL)
 			if h.user == nil || authJwtErr != nil {
 				return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 			}
-			return nil
+			h.user, err = context.UpdateUserJWTGrants(h.user, grants)
+			return err
 		}
+	}
 
+	if context.Options.OIDCOptions != nil {
 		/*
 		* If unsupported/oidc testing is enabled
 		* and this is a call on the token endpoint
@@ -452,9 +475,22 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 		}
 	}
 
+	// Check API key
+	if token := h.getAPIKeyToken(); token != "" {
+		h.user, err = context.Authenticator().AuthenticateAPIKey(token)
+		if err != nil {
+			return err
+		}
+		if h.user == nil {
+			base.Infof(base.KeyAll, "HTTP auth failed for API key")
+			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid API key")
+		}
+		return nil
+	}
+
 	// Check basic auth first
 	if userName, password := h.getBasicAuth(); userName != "" {
-		h.user, err = context.Authenticator().AuthenticateUser(userName, password)
+		h.user, err = context.Authenticator().AuthenticateUserFromSource(userName, password, h.clientIP())
 		if err != nil {
 			return err
 		}
@@ -465,6 +501,12 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 			}
 			return base.HTTPErrorf(http.StatusUnauthorized, "Invalid login")
 		}
+		// A password alone isn't enough for users with MFA enabled, who need to create a session
+		if context.Options.MFAOptions != nil && auth.MFAEnabled(h.user) {
+			base.Infof(base.KeyAll, "HTTP auth failed for username=%q, multi-factor authentication required", base.UD(userName))
+			h.user = nil
+			return base.HTTPErrorf(http.StatusUnauthorized, "Multi-factor authentication required")
+		}
 		return nil
 	}
 
@@ -493,6 +535,10 @@ func (h *handler) checkAuth(context *db.DatabaseContext) (err error) {
 // checkAdminAuthenticationOnly simply checks whether a username / password combination is authenticated pulling the
 // credentials from the handler
 func (h *handler) checkAdminAuthenticationOnly() (bool, error) {
+	if _, password, localAdmin := h.localAdminUser(); localAdmin != nil {
+		return auth.CompareHashAndPassword([]byte(localAdmin.PasswordHash), password), nil
+	}
+
 	managementEndpoints, httpClient, err := h.server.ObtainManagementEndpointsAndHTTPClient()
 	if err != nil {
 		return false, base.HTTPErrorf(http.StatusInternalServerError, "Error getting management endpoints: %v", err)
@@ -808,6 +854,15 @@ func (h *handler) getBasicAuth() (username string, password string) {
 	return
 }
 
+// clientIP returns the IP address of the client making the request, without the port.
+func (h *handler) clientIP() string {
+	host, _, err := net.SplitHostPort(h.rq.RemoteAddr)
+	if err != nil {
+		return h.rq.RemoteAddr
+	}
+	return host
+}
+
 func (h *handler) getBearerToken() string {
 	auth := h.rq.Header.Get("Authorization")
 	if strings.HasPrefix(auth, "Bearer ") {
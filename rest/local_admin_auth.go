@@ -0,0 +1,116 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// localAdminWildcard grants a local admin user all permissions, or permissions for all databases.
+const localAdminWildcard = "*"
+
+func (c *LocalAdminUserConfig) validate(username string) error {
+	if c == nil {
+		return fmt.Errorf("local admin user %q must not be null", username)
+	}
+	if username == "" {
+		return fmt.Errorf("local admin users must have a username")
+	}
+	if _, err := bcrypt.Cost([]byte(c.PasswordHash)); err != nil {
+		return fmt.Errorf("local admin user %q must have a bcrypt password_hash: %v", username, err)
+	}
+	for dbName, permissionNames := range c.Permissions {
+		for _, name := range permissionNames {
+			if name == localAdminWildcard {
+				continue
+			}
+			perm, ok := permissionFromName(name)
+			if !ok {
+				return fmt.Errorf("local admin user %q has unknown permission %q", username, name)
+			}
+			if dbName != localAdminWildcard && !perm.DatabaseScoped {
+				return fmt.Errorf("local admin user %q permission %q can't be granted for a single database", username, name)
+			}
+		}
+	}
+	return nil
+}
+
+// hasPermission returns true if the user has the permission for the database.  Permissions granted for all databases
+// also apply to requests that aren't for a database.
+func (c *LocalAdminUserConfig) hasPermission(perm Permission, dbName string) bool {
+	granted := c.Permissions[localAdminWildcard]
+	if perm.DatabaseScoped && dbName != "" {
+		granted = append(granted[:len(granted):len(granted)], c.Permissions[dbName]...)
+	}
+	for _, name := range granted {
+		if name == localAdminWildcard || "."+name == perm.PermissionName {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the user's password, and that the user has any of the access permissions for the database.  As
+// with Couchbase Server RBAC, returns the results of checking each of the response permissions.  A user can access
+// handlers that don't require any permissions once authenticated.
+func (c *LocalAdminUserConfig) authorize(password, dbName string, accessPermissions []Permission, responsePermissions []Permission) (responsePermissionResults map[string]bool, statusCode int) {
+	if !auth.CompareHashAndPassword([]byte(c.PasswordHash), password) {
+		return nil, http.StatusUnauthorized
+	}
+
+	authorized := len(accessPermissions) == 0
+	for _, perm := range accessPermissions {
+		if c.hasPermission(perm, dbName) {
+			authorized = true
+			break
+		}
+	}
+	if !authorized {
+		return nil, http.StatusForbidden
+	}
+
+	responsePermissionResults = make(map[string]bool, len(responsePermissions))
+	for _, perm := range responsePermissions {
+		responsePermissionResults[perm.PermissionName] = c.hasPermission(perm, dbName)
+	}
+	return responsePermissionResults, http.StatusOK
+}
+
+// localAdminUser returns the local admin user matching the request's basic auth username, if any.
+func (h *handler) localAdminUser() (username, password string, user *LocalAdminUserConfig) {
+	username, password = h.getBasicAuth()
+	if username == "" {
+		return "", "", nil
+	}
+	return username, password, h.server.config.API.LocalAdminUsers[username]
+}
+
+// checkLocalAdminAuth authenticates and authorizes a local admin user, for requests to the admin or metrics APIs.
+func (h *handler) checkLocalAdminAuth(username, password string, user *LocalAdminUserConfig, accessPermissions []Permission, responsePermissions []Permission) error {
+	permissions, statusCode := user.authorize(password, h.PathVar("db"), accessPermissions, responsePermissions)
+	if statusCode != http.StatusOK {
+		base.Infof(base.KeyAuth, "%s: Local admin user %s failed to auth as an admin statusCode: %d", h.formatSerialNumber(), base.UD(username), statusCode)
+		if statusCode == http.StatusUnauthorized {
+			h.response.Header().Set("WWW-Authenticate", wwwAuthenticateHeader)
+		}
+		return base.HTTPErrorf(statusCode, "")
+	}
+
+	h.authorizedAdminUser = username
+	h.permissionsResults = permissions
+
+	base.Infof(base.KeyAuth, "%s: Local admin user %s was successfully authorized as an admin", h.formatSerialNumber(), base.UD(username))
+	return nil
+}
@@ -0,0 +1,53 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"github.com/couchbase/sync_gateway/auth"
+)
+
+// GET /{db}/_user/{name}/_lockout returns the user's failed logins and lockout status
+func (h *handler) getUserLockout() error {
+	h.assertAdminOnly()
+	name, err := h.lockoutNamedUser()
+	if err != nil {
+		return err
+	}
+	state, err := h.db.Authenticator().GetUserLockout(name)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		state = &auth.LockoutState{}
+	}
+	h.writeJSON(state)
+	return nil
+}
+
+// DELETE /{db}/_user/{name}/_lockout unlocks the user, and resets their failed logins
+func (h *handler) deleteUserLockout() error {
+	h.assertAdminOnly()
+	name, err := h.lockoutNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.db.Authenticator().UnlockUser(name)
+}
+
+// lockoutNamedUser returns the name of the existing user identified by the name path variable.
+func (h *handler) lockoutNamedUser() (string, error) {
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return "", err
+	}
+	return user.Name(), nil
+}
@@ -0,0 +1,270 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// GET /{db}/_mfa returns the current user's multi-factor authentication status
+func (h *handler) handleGetMFA() error {
+	user, err := h.mfaSessionUser()
+	if err != nil {
+		return err
+	}
+	h.writeMFAStatus(user)
+	return nil
+}
+
+// POST /{db}/_mfa starts multi-factor authentication enrollment for the current user
+func (h *handler) handlePostMFA() error {
+	user, err := h.mfaSessionUser()
+	if err != nil {
+		return err
+	}
+	return h.enrollMFA(user)
+}
+
+// POST /{db}/_mfa/verify completes multi-factor authentication enrollment for the current user
+func (h *handler) handlePostMFAVerify() error {
+	user, err := h.mfaSessionUser()
+	if err != nil {
+		return err
+	}
+	return h.confirmMFAEnrollment(user)
+}
+
+// POST /{db}/_mfa/recovery_codes replaces the current user's recovery codes.  Requires a current TOTP or recovery code.
+func (h *handler) handlePostMFARecoveryCodes() error {
+	user, err := h.mfaSessionUser()
+	if err != nil {
+		return err
+	}
+	if err := h.verifyMFACode(user); err != nil {
+		return err
+	}
+	return h.regenerateMFARecoveryCodes(user)
+}
+
+// DELETE /{db}/_mfa disables multi-factor authentication for the current user.  Requires a current TOTP or recovery
+// code.
+func (h *handler) handleDeleteMFA() error {
+	user, err := h.mfaSessionUser()
+	if err != nil {
+		return err
+	}
+	if err := h.verifyMFACode(user); err != nil {
+		return err
+	}
+	return h.db.Authenticator().DisableMFA(user)
+}
+
+// GET /{db}/_user/{name}/_mfa returns the user's multi-factor authentication status
+func (h *handler) getUserMFA() error {
+	h.assertAdminOnly()
+	user, err := h.mfaNamedUser()
+	if err != nil {
+		return err
+	}
+	h.writeMFAStatus(user)
+	return nil
+}
+
+// POST /{db}/_user/{name}/_mfa starts multi-factor authentication enrollment for the user
+func (h *handler) postUserMFA() error {
+	h.assertAdminOnly()
+	user, err := h.mfaNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.enrollMFA(user)
+}
+
+// POST /{db}/_user/{name}/_mfa/verify completes multi-factor authentication enrollment for the user
+func (h *handler) postUserMFAVerify() error {
+	h.assertAdminOnly()
+	user, err := h.mfaNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.confirmMFAEnrollment(user)
+}
+
+// POST /{db}/_user/{name}/_mfa/recovery_codes replaces the user's recovery codes
+func (h *handler) postUserMFARecoveryCodes() error {
+	h.assertAdminOnly()
+	user, err := h.mfaNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.regenerateMFARecoveryCodes(user)
+}
+
+// DELETE /{db}/_user/{name}/_mfa disables multi-factor authentication for the user, e.g. when they've lost their
+// authenticator and recovery codes
+func (h *handler) deleteUserMFA() error {
+	h.assertAdminOnly()
+	user, err := h.mfaNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.db.Authenticator().DisableMFA(user)
+}
+
+func (h *handler) writeMFAStatus(user auth.User) {
+	var status struct {
+		Enabled                bool `json:"enabled"`
+		Pending                bool `json:"pending"`
+		RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+	}
+	if mfa := user.MFA(); mfa != nil {
+		status.Enabled = mfa.Enabled
+		status.Pending = !mfa.Enabled
+		status.RecoveryCodesRemaining = len(mfa.RecoveryCodes)
+	}
+	h.writeJSON(status)
+}
+
+func (h *handler) enrollMFA(user auth.User) error {
+	enrollment, err := h.db.Authenticator().EnrollMFA(user)
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusCreated, enrollment)
+	return nil
+}
+
+func (h *handler) confirmMFAEnrollment(user auth.User) error {
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	recoveryCodes, err := h.db.Authenticator().ConfirmMFAEnrollment(user, params.Code)
+	if err != nil {
+		if err == auth.ErrInvalidMFACode {
+			h.db.DbStats.Security().MFAFailedCount.Add(1)
+		}
+		return err
+	}
+	h.writeMFARecoveryCodes(recoveryCodes)
+	return nil
+}
+
+// verifyMFACode checks the TOTP or recovery code in the request body, so that a session alone isn't enough to change
+// the user's multi-factor authentication settings.  No code is needed while enrollment is pending.
+func (h *handler) verifyMFACode(user auth.User) error {
+	if !auth.MFAEnabled(user) {
+		return nil
+	}
+	var params struct {
+		Code string `json:"code"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	err := h.db.Authenticator().VerifyMFA(user, params.Code)
+	if err == auth.ErrInvalidMFACode {
+		h.db.DbStats.Security().MFAFailedCount.Add(1)
+	}
+	return err
+}
+
+func (h *handler) regenerateMFARecoveryCodes(user auth.User) error {
+	recoveryCodes, err := h.db.Authenticator().RegenerateMFARecoveryCodes(user)
+	if err != nil {
+		return err
+	}
+	h.writeMFARecoveryCodes(recoveryCodes)
+	return nil
+}
+
+func (h *handler) writeMFARecoveryCodes(recoveryCodes []string) {
+	h.writeJSON(map[string][]string{"recovery_codes": recoveryCodes})
+}
+
+// mfaSessionUser returns the authenticated (non-guest) user making the request.  API keys can't be used to manage
+// multi-factor authentication.
+func (h *handler) mfaSessionUser() (auth.User, error) {
+	if h.db.Options.MFAOptions == nil {
+		return nil, auth.ErrMFANotConfigured
+	}
+	if h.user == nil || h.user.Name() == "" {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	}
+	if _, ok := auth.AuthenticatedAPIKey(h.user); ok {
+		return nil, base.HTTPErrorf(http.StatusForbidden, "API keys can't be used to manage multi-factor authentication")
+	}
+	return h.user, nil
+}
+
+// mfaNamedUser returns the user identified by the name path variable.
+func (h *handler) mfaNamedUser() (auth.User, error) {
+	if h.db.Options.MFAOptions == nil {
+		return nil, auth.ErrMFANotConfigured
+	}
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// checkPasswordLoginMFA returns true if a user that has authenticated with their password needs to complete
+// multi-factor authentication to create a session.  Returns a 403 error if the database requires multi-factor
+// authentication, and the user hasn't enrolled.
+func (h *handler) checkPasswordLoginMFA(user auth.User) (challengeRequired bool, err error) {
+	mfaOptions := h.db.Options.MFAOptions
+	if mfaOptions == nil {
+		return false, nil
+	}
+	if auth.MFAEnabled(user) {
+		return true, nil
+	}
+	if mfaOptions.Required {
+		return false, base.HTTPErrorf(http.StatusForbidden, "Multi-factor authentication enrollment is required")
+	}
+	return false, nil
+}
+
+// getUserFromMFAChallenge completes a password login with a TOTP or recovery code.
+func (h *handler) getUserFromMFAChallenge(challengeID, code string) (auth.User, error) {
+	if h.db.Options.MFAOptions == nil {
+		return nil, auth.ErrMFANotConfigured
+	}
+	user, err := h.db.Authenticator().AuthenticateMFAChallenge(challengeID, code)
+	if err == auth.ErrInvalidMFACode {
+		h.db.DbStats.Security().MFAFailedCount.Add(1)
+	}
+	if err != nil || user == nil {
+		if raiseErr := h.db.EventMgr.RaiseAuthFailureEvent(h.db.Name, "", h.rq.RemoteAddr, h.rq.URL.Path, "Invalid multi-factor authentication"); raiseErr != nil {
+			base.Debugf(base.KeyEvents, "Unable to raise auth failure event: %v", raiseErr)
+		}
+	}
+	return user, err
+}
+
+// respondWithMFAChallenge responds to a password login that needs a second step, with the token to complete it with.
+func (h *handler) respondWithMFAChallenge(challenge *auth.MFAChallenge) error {
+	response := struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Expires     string `json:"expires"`
+	}{true, challenge.ID, challenge.Expiration.UTC().Format(time.RFC3339)}
+	h.writeJSONStatus(http.StatusAccepted, response)
+	return nil
+}
@@ -28,6 +28,7 @@ import (
 
 	"github.com/couchbase/sync_gateway/auth"
 	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -1144,6 +1145,130 @@ func checkGoodAuthResponse(t *testing.T, response *http.Response, username strin
 	assert.Equal(t, responseBodyExpected, responseBodyActual, "Session response mismatch")
 }
 
+// E2E test that checks roles and channels are granted from token claims on each login, without affecting those
+// granted through the admin API.
+func TestOpenIDConnectClaimGrants(t *testing.T) {
+	mockAuthServer, err := newMockAuthServer()
+	require.NoError(t, err, "Error creating mock oauth2 server")
+	mockAuthServer.Start()
+	defer mockAuthServer.Shutdown()
+	mockAuthServer.options.issuer = mockAuthServer.URL + "/foo"
+
+	provider := mockProviderWithRegister("foo")
+	provider.RolesClaim = "groups"
+	provider.ChannelsClaim = "tenant"
+	providers := auth.OIDCProviderMap{"foo": provider}
+	refreshProviderConfig(providers, mockAuthServer.URL)
+
+	defaultProvider := "foo"
+	opts := auth.OIDCOptions{Providers: providers, DefaultProvider: &defaultProvider}
+	restTester := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{OIDCConfig: &opts}}})
+	require.NoError(t, restTester.SetAdminParty(false))
+	defer restTester.Close()
+
+	mockSyncGateway := httptest.NewServer(restTester.TestPublicHandler())
+	defer mockSyncGateway.Close()
+	sessionEndpoint := mockSyncGateway.URL + "/" + restTester.DatabaseConfig.Name + "/_session"
+
+	login := func(groups []string, tenant string) {
+		claims := claimsAuthentic()
+		claims.secondaryClaims["groups"] = groups
+		claims.secondaryClaims["tenant"] = tenant
+		token, err := mockAuthServer.makeToken(claims)
+		require.NoError(t, err, "Error obtaining signed token from OpenID Connect provider")
+		response, err := http.DefaultClient.Do(createOIDCRequest(t, sessionEndpoint, token))
+		require.NoError(t, err, "Error sending request with bearer token")
+		require.NoError(t, response.Body.Close())
+		require.Equal(t, http.StatusOK, response.StatusCode)
+	}
+	getUser := func() db.PrincipalConfig {
+		response := restTester.SendAdminRequest(http.MethodGet, "/db/_user/foo_noah", "")
+		assertStatus(t, response, http.StatusOK)
+		var user db.PrincipalConfig
+		require.NoError(t, base.JSONUnmarshal(response.Body.Bytes(), &user))
+		return user
+	}
+
+	login([]string{"editors", "viewers"}, "acme")
+	user := getUser()
+	assert.ElementsMatch(t, []string{"editors", "viewers"}, user.JWTRoleNames)
+	assert.ElementsMatch(t, []string{"editors", "viewers"}, user.RoleNames)
+	assert.Equal(t, base.SetOf("acme"), user.JWTChannels)
+	assert.True(t, user.Channels.Contains("acme"))
+
+	// Roles granted through the admin API are kept when the claims change
+	response := restTester.SendAdminRequest(http.MethodPut, "/db/_user/foo_noah", `{"admin_roles":["admins"], "admin_channels":["shared"]}`)
+	assertStatus(t, response, http.StatusOK)
+	login([]string{"viewers"}, "globex")
+	user = getUser()
+	assert.ElementsMatch(t, []string{"viewers"}, user.JWTRoleNames)
+	assert.ElementsMatch(t, []string{"admins"}, user.ExplicitRoleNames)
+	assert.ElementsMatch(t, []string{"admins", "viewers"}, user.RoleNames)
+	assert.Equal(t, base.SetOf("globex", "shared", "!"), user.Channels)
+
+	// Logging in with unchanged claims doesn't update the user
+	sequence := restTester.GetDatabase().DbStats.Database().SequenceAssignedCount.Value()
+	login([]string{"viewers"}, "globex")
+	assert.Equal(t, sequence, restTester.GetDatabase().DbStats.Database().SequenceAssignedCount.Value())
+}
+
+func TestLocalJWTBearerToken(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	jwks := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &privateKey.PublicKey, KeyID: "internal-1", Algorithm: string(jose.RS256), Use: "sig"}}}
+	data, err := base.JSONMarshal(jwks)
+	require.NoError(t, err)
+	jwksFile := t.TempDir() + "/jwks.json"
+	require.NoError(t, ioutil.WriteFile(jwksFile, data, 0600))
+
+	localJWT := auth.LocalJWTProviderMap{"internal": {
+		Issuer:        "https://auth.example.com",
+		Audience:      "sync",
+		JWKSFile:      jwksFile,
+		Register:      true,
+		ChannelsClaim: "tenant",
+	}}
+	restTester := NewRestTester(t, &RestTesterConfig{DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{LocalJWTConfig: localJWT}}})
+	require.NoError(t, restTester.SetAdminParty(false))
+	defer restTester.Close()
+
+	mockSyncGateway := httptest.NewServer(restTester.TestPublicHandler())
+	defer mockSyncGateway.Close()
+	sessionEndpoint := mockSyncGateway.URL + "/" + restTester.DatabaseConfig.Name + "/_session"
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: privateKey}, (&jose.SignerOptions{}).WithHeader("kid", "internal-1"))
+	require.NoError(t, err)
+	makeToken := func(issuer string) string {
+		claims := map[string]interface{}{
+			"iss":    issuer,
+			"aud":    "sync",
+			"sub":    "noah",
+			"exp":    time.Now().Add(time.Hour).Unix(),
+			"tenant": "acme",
+		}
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+
+	response, err := http.DefaultClient.Do(createOIDCRequest(t, sessionEndpoint, makeToken("https://auth.example.com")))
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	require.Equal(t, http.StatusOK, response.StatusCode)
+
+	adminResponse := restTester.SendAdminRequest(http.MethodGet, "/db/_user/internal_noah", "")
+	assertStatus(t, adminResponse, http.StatusOK)
+	var user db.PrincipalConfig
+	require.NoError(t, base.JSONUnmarshal(adminResponse.Body.Bytes(), &user))
+	assert.Equal(t, base.SetOf("acme"), user.JWTChannels)
+
+	// Tokens from an unknown issuer are rejected
+	response, err = http.DefaultClient.Do(createOIDCRequest(t, sessionEndpoint, makeToken("https://other.example.com")))
+	require.NoError(t, err)
+	require.NoError(t, response.Body.Close())
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode)
+}
+
 // E2E test that checks OpenID Connect Implicit Flow edge cases.
 func TestOpenIDConnectImplicitFlowEdgeCases(t *testing.T) {
 	const emailClaim = "email"
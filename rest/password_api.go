@@ -0,0 +1,58 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// POST /{db}/_user/me/_password changes the current user's password.  The current password is required, so that
+// users whose password has expired (and so can't authenticate otherwise) can identify themselves with a name instead.
+func (h *handler) handlePostUserPassword() error {
+	var params struct {
+		Name        string `json:"name"`
+		OldPassword string `json:"old_password"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+
+	name := params.Name
+	if h.user != nil && h.user.Name() != "" {
+		if _, ok := auth.AuthenticatedAPIKey(h.user); ok {
+			return base.HTTPErrorf(http.StatusForbidden, "API keys can't be used to change passwords")
+		}
+		if name != "" && name != h.user.Name() {
+			return base.HTTPErrorf(http.StatusForbidden, "Can't change another user's password")
+		}
+		name = h.user.Name()
+	}
+	if name == "" {
+		return base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	}
+
+	if isValid, reason := (db.PrincipalConfig{Name: &name, Password: &params.NewPassword}).IsPasswordValid(false); !isValid {
+		return base.HTTPErrorf(http.StatusBadRequest, "Error changing password: %s", reason)
+	}
+	err := h.db.Authenticator().ChangePassword(name, params.OldPassword, params.NewPassword, h.clientIP())
+	if err != nil {
+		if status, _ := base.ErrorAsHTTPStatus(err); status == http.StatusUnauthorized {
+			if raiseErr := h.db.EventMgr.RaiseAuthFailureEvent(h.db.Name, name, h.rq.RemoteAddr, h.rq.URL.Path, "Invalid login"); raiseErr != nil {
+				base.Debugf(base.KeyEvents, "Unable to raise auth failure event: %v", raiseErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
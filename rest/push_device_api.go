@@ -0,0 +1,128 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/auth"
+	"github.com/couchbase/sync_gateway/base"
+)
+
+// GET /{db}/_devices returns the push devices registered for the current user
+func (h *handler) handleGetPushDevices() error {
+	user, err := h.pushDeviceSessionUser()
+	if err != nil {
+		return err
+	}
+	h.writePushDevices(user)
+	return nil
+}
+
+// POST /{db}/_devices registers a push device for the current user
+func (h *handler) handlePostPushDevice() error {
+	user, err := h.pushDeviceSessionUser()
+	if err != nil {
+		return err
+	}
+	return h.registerPushDevice(user)
+}
+
+// DELETE /{db}/_devices/{token} unregisters a push device for the current user
+func (h *handler) handleDeletePushDevice() error {
+	user, err := h.pushDeviceSessionUser()
+	if err != nil {
+		return err
+	}
+	return h.db.UnregisterPushDevice(user, h.PathVar("token"))
+}
+
+// GET /{db}/_user/{name}/_devices returns the push devices registered for the user
+func (h *handler) getUserPushDevices() error {
+	h.assertAdminOnly()
+	user, err := h.pushDeviceNamedUser()
+	if err != nil {
+		return err
+	}
+	h.writePushDevices(user)
+	return nil
+}
+
+// POST /{db}/_user/{name}/_devices registers a push device for the user
+func (h *handler) postUserPushDevice() error {
+	h.assertAdminOnly()
+	user, err := h.pushDeviceNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.registerPushDevice(user)
+}
+
+// DELETE /{db}/_user/{name}/_devices/{token} unregisters a push device for the user
+func (h *handler) deleteUserPushDevice() error {
+	h.assertAdminOnly()
+	user, err := h.pushDeviceNamedUser()
+	if err != nil {
+		return err
+	}
+	return h.db.UnregisterPushDevice(user, h.PathVar("token"))
+}
+
+func (h *handler) registerPushDevice(user auth.User) error {
+	var device auth.PushDevice
+	if err := h.readJSONInto(&device); err != nil {
+		return err
+	}
+	if err := h.db.RegisterPushDevice(user, device); err != nil {
+		return err
+	}
+	h.writeRawJSONStatus(http.StatusCreated, []byte(`{"ok":true}`))
+	return nil
+}
+
+func (h *handler) writePushDevices(user auth.User) {
+	devices := user.PushDevices()
+	if devices == nil {
+		devices = []auth.PushDevice{}
+	}
+	h.writeJSON(devices)
+}
+
+// pushDeviceSessionUser returns the authenticated (non-guest) user making the request.
+func (h *handler) pushDeviceSessionUser() (auth.User, error) {
+	if err := h.checkPushNotificationsEnabled(); err != nil {
+		return nil, err
+	}
+	if h.user == nil || h.user.Name() == "" {
+		return nil, base.HTTPErrorf(http.StatusUnauthorized, "Login required")
+	}
+	return h.user, nil
+}
+
+// pushDeviceNamedUser returns the user identified by the name path variable.
+func (h *handler) pushDeviceNamedUser() (auth.User, error) {
+	if err := h.checkPushNotificationsEnabled(); err != nil {
+		return nil, err
+	}
+	user, err := h.db.Authenticator().GetUser(h.PathVar("name"))
+	if user == nil {
+		if err == nil {
+			err = kNotFoundError
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (h *handler) checkPushNotificationsEnabled() error {
+	if h.db.Options.PushNotificationOptions == nil {
+		return base.HTTPErrorf(http.StatusNotFound, "Push notifications are not enabled for this database")
+	}
+	return nil
+}
@@ -1409,7 +1409,65 @@ func TestValidateReplication(t *testing.T) {
 			},
 			eeOnly: true,
 			expectedErrorMsg: fmt.Sprintf(db.ConfigErrorInvalidConflictResolutionTypeFmt, db.ConflictResolverLocalWins,
-				db.ConflictResolverRemoteWins, db.ConflictResolverDefault, db.ConflictResolverCustom),
+				db.ConflictResolverRemoteWins, db.ConflictResolverDefault, db.ConflictResolverCustom, db.ConflictResolverMerge),
+		},
+		{
+			name: "merge conflict resolution type",
+			replicationConfig: db.ReplicationConfig{
+				ID:                     "replication2",
+				Remote:                 "http://remote:4984/db",
+				Direction:              "pull",
+				Adhoc:                  true,
+				ConflictResolutionType: db.ConflictResolverMerge,
+				MergePolicies:          db.MergePolicies{"tags": {Type: db.MergePolicyUnion}},
+			},
+			eeOnly: true,
+		},
+		{
+			name: "merge policies without merge conflict resolution type",
+			replicationConfig: db.ReplicationConfig{
+				ID:                     "replication2",
+				Remote:                 "http://remote:4984/db",
+				Direction:              "pull",
+				Adhoc:                  true,
+				ConflictResolutionType: db.ConflictResolverLocalWins,
+				MergePolicies:          db.MergePolicies{"tags": {Type: db.MergePolicyUnion}},
+			},
+			eeOnly:           true,
+			expectedErrorMsg: "merge_policies can only be set when conflict_resolution_type is merge",
+		},
+		{
+			name: "couchdb protocol",
+			replicationConfig: db.ReplicationConfig{
+				ID:        "replication1",
+				Remote:    "http://remote:5984/db",
+				Direction: "pushAndPull",
+				Adhoc:     true,
+				Protocol:  db.ReplicationProtocolCouchDB,
+			},
+		},
+		{
+			name: "invalid protocol",
+			replicationConfig: db.ReplicationConfig{
+				ID:        "replication1",
+				Remote:    "http://remote:5984/db",
+				Direction: "pull",
+				Adhoc:     true,
+				Protocol:  "websocket",
+			},
+			expectedErrorMsg: fmt.Sprintf(db.ConfigErrorInvalidProtocolFmt, "websocket", db.ReplicationProtocolBLIP, db.ReplicationProtocolCouchDB),
+		},
+		{
+			name: "couchdb protocol with purge_on_removal",
+			replicationConfig: db.ReplicationConfig{
+				ID:             "replication1",
+				Remote:         "http://remote:5984/db",
+				Direction:      "pull",
+				Adhoc:          true,
+				Protocol:       db.ReplicationProtocolCouchDB,
+				PurgeOnRemoval: true,
+			},
+			expectedErrorMsg: fmt.Sprintf(db.ConfigErrorCouchDBProtocolUnsupportedFmt, "purge_on_removal", db.ReplicationProtocolCouchDB),
 		},
 	}
 
@@ -1772,3 +1830,129 @@ func TestReplicationHeartbeatRemoval(t *testing.T) {
 	activeRT2.GetDatabase().SGReplicateMgr.Stop()
 	activeRT2.GetDatabase().SGReplicateMgr = nil
 }
+
+// TestReplicationDeadLetterAPI
+//   - Starts a push replication to a passive node whose sync function rejects some documents
+//   - Validates rejected revisions are recorded in the replication's dead letter queue
+//   - Retries a dead letter after the remote has granted access, and discards another
+func TestReplicationDeadLetterAPI(t *testing.T) {
+
+	base.RequireNumTestBuckets(t, 2)
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyReplicate, base.KeySync)()
+
+	// Passive
+	passiveRT := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+		SyncFn: `function(doc) {
+			if (doc.blocked) {
+				throw({forbidden: "blocked"});
+			}
+			if (doc.gated) {
+				requireAccess("gate");
+			}
+			channel(doc.channels);
+		}`,
+		DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+			Users: map[string]*db.PrincipalConfig{
+				"alice": {
+					Password:         base.StringPtr("pass"),
+					ExplicitChannels: base.SetOf("public"),
+				},
+			},
+		}},
+	})
+	defer passiveRT.Close()
+
+	srv := httptest.NewServer(passiveRT.TestPublicHandler())
+	defer srv.Close()
+
+	passiveDBURL, err := url.Parse(srv.URL + "/db")
+	require.NoError(t, err)
+	passiveDBURL.User = url.UserPassword("alice", "pass")
+
+	// Active
+	activeRT := NewRestTester(t, &RestTesterConfig{
+		TestBucket:         base.GetTestBucket(t),
+		sgReplicateEnabled: true,
+	})
+	defer activeRT.Close()
+	require.NoError(t, activeRT.GetDatabase().SGReplicateMgr.StartReplications())
+
+	_ = activeRT.putDoc("allowed", `{"channels":["public"]}`)
+	_ = activeRT.putDoc("gated", `{"gated":true, "channels":["public"]}`)
+	_ = activeRT.putDoc("blocked", `{"blocked":true, "channels":["public"]}`)
+
+	replicationID := t.Name()
+	activeRT.createReplication(replicationID, passiveDBURL.String(), db.ActiveReplicatorTypePush, nil, true, db.ConflictResolverDefault)
+	activeRT.waitForReplicationStatus(replicationID, db.ReplicationStateRunning)
+
+	_, err = passiveRT.WaitForChanges(1, "/db/_changes?since=0", "", true)
+	require.NoError(t, err)
+
+	deadLettersURI := "/db/_replication/" + replicationID + "/_deadletter"
+	getDeadLetters := func() (entries []db.DeadLetterEntry) {
+		resp := activeRT.SendAdminRequest(http.MethodGet, deadLettersURI, "")
+		assertStatus(t, resp, http.StatusOK)
+		require.NoError(t, base.JSONUnmarshal(resp.BodyBytes(), &entries))
+		return entries
+	}
+
+	var entries []db.DeadLetterEntry
+	require.NoError(t, activeRT.WaitForCondition(func() bool {
+		entries = getDeadLetters()
+		return len(entries) == 2
+	}))
+	assert.Equal(t, "blocked", entries[0].DocID)
+	assert.Equal(t, "gated", entries[1].DocID)
+	for _, entry := range entries {
+		assert.Equal(t, "HTTP", entry.ErrorDomain)
+		assert.Equal(t, "403", entry.ErrorCode)
+		assert.Equal(t, 1, entry.Attempts)
+	}
+	replicationStats := activeRT.GetDatabase().DbStats.DBReplicatorStats(replicationID)
+	assert.Equal(t, int64(2), replicationStats.DeadLetterCount.Value())
+
+	resp := activeRT.SendAdminRequest(http.MethodGet, deadLettersURI+"/allowed", "")
+	assertStatus(t, resp, http.StatusNotFound)
+
+	// Grant access on the remote, and retry the gated doc
+	resp = passiveRT.SendAdminRequest(http.MethodPut, "/db/_user/alice", `{"admin_channels":["public","gate"]}`)
+	assertStatus(t, resp, http.StatusOK)
+
+	resp = activeRT.SendAdminRequest(http.MethodPost, deadLettersURI+"/gated/_retry", "")
+	assertStatus(t, resp, http.StatusOK)
+	assert.Equal(t, `{"retried":1}`, string(resp.BodyBytes()))
+
+	require.NoError(t, passiveRT.WaitForCondition(func() bool {
+		resp := passiveRT.SendAdminRequest(http.MethodGet, "/db/gated", "")
+		return resp.Code == http.StatusOK
+	}))
+	require.NoError(t, activeRT.WaitForCondition(func() bool {
+		entries = getDeadLetters()
+		return len(entries) == 1
+	}))
+	assert.Equal(t, "blocked", entries[0].DocID)
+
+	// Retrying the blocked doc fails again, and increments attempts
+	resp = activeRT.SendAdminRequest(http.MethodPost, deadLettersURI+"/_retry", "")
+	assertStatus(t, resp, http.StatusOK)
+	require.NoError(t, activeRT.WaitForCondition(func() bool {
+		entries = getDeadLetters()
+		return len(entries) == 1 && entries[0].Attempts == 2
+	}))
+
+	// Discard the blocked doc
+	resp = activeRT.SendAdminRequest(http.MethodDelete, deadLettersURI+"/blocked", "")
+	assertStatus(t, resp, http.StatusOK)
+	assert.Equal(t, `{"discarded":1}`, string(resp.BodyBytes()))
+	assert.Len(t, getDeadLetters(), 0)
+	assert.Equal(t, int64(0), replicationStats.DeadLetterCount.Value())
+
+	resp = activeRT.SendAdminRequest(http.MethodGet, "/db/_replication/unknown/_deadletter", "")
+	assertStatus(t, resp, http.StatusNotFound)
+
+	// Stop the replication before teardown
+	resp = activeRT.SendAdminRequest(http.MethodPut, "/db/_replicationStatus/"+replicationID+"?action=stop", "")
+	assertStatus(t, resp, http.StatusOK)
+	activeRT.waitForReplicationStatus(replicationID, db.ReplicationStateStopped)
+}
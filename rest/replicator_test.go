@@ -1994,6 +1994,95 @@ func TestActiveReplicatorPullConflict(t *testing.T) {
 	}
 }
 
+// TestActiveReplicatorPullMergeConflict:
+//   - Starts 2 RestTesters, one active, and one passive.
+//   - Creates a common ancestor revision on both, then updates different properties on each
+//   - Uses an ActiveReplicator configured for pull with the merge conflict resolver
+//   - verifies the ancestor is used to combine non-overlapping changes, and merge policies are applied to collisions
+func TestActiveReplicatorPullMergeConflict(t *testing.T) {
+
+	base.RequireNumTestBuckets(t, 2)
+	defer base.SetUpTestLogging(base.LevelInfo, base.KeyHTTP, base.KeySync, base.KeyReplicate, base.KeyCRUD)()
+
+	// Passive
+	tb2 := base.GetTestBucket(t)
+	rt2 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: tb2,
+		DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+			Users: map[string]*db.PrincipalConfig{
+				"alice": {
+					Password:         base.StringPtr("pass"),
+					ExplicitChannels: base.SetOf("*"),
+				},
+			},
+		}},
+	})
+	defer rt2.Close()
+
+	// Active
+	tb1 := base.GetTestBucket(t)
+	rt1 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: tb1,
+	})
+	defer rt1.Close()
+
+	docID := t.Name()
+	ancestorBody := db.Body{"a": 1, "b": 1, "count": 1, "tags": []interface{}{"x", "y"}}
+	for _, rt := range []*RestTester{rt1, rt2} {
+		resp, err := rt.PutDocumentWithRevID(docID, "1-a", "", ancestorBody)
+		require.NoError(t, err)
+		assertStatus(t, resp, http.StatusCreated)
+	}
+
+	resp := rt1.SendAdminRequest(http.MethodPut, "/db/"+docID+"?rev=1-a", `{"a": 2, "b": 1, "count": 5, "tags": ["x", "y", "local"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+	resp = rt2.SendAdminRequest(http.MethodPut, "/db/"+docID+"?rev=1-a", `{"a": 1, "b": 2, "count": 3, "tags": ["x", "remote"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	// Make rt2 listen on an actual HTTP port, so it can receive the blipsync request from rt1.
+	srv := httptest.NewServer(rt2.TestPublicHandler())
+	defer srv.Close()
+
+	passiveDBURL, err := url.Parse(srv.URL + "/db")
+	require.NoError(t, err)
+	passiveDBURL.User = url.UserPassword("alice", "pass")
+
+	mergeConflictResolver, err := db.NewConflictResolverFunc(db.ConflictResolverMerge, "", db.MergePolicies{
+		"count": {Type: db.MergePolicyMax},
+		"tags":  {Type: db.MergePolicyUnion},
+	})
+	require.NoError(t, err)
+	replicationStats := base.SyncGatewayStats.NewDBStats(t.Name(), false, false, false).DBReplicatorStats(t.Name())
+	ar := db.NewActiveReplicator(&db.ActiveReplicatorConfig{
+		ID:          t.Name(),
+		Direction:   db.ActiveReplicatorTypePull,
+		RemoteDBURL: passiveDBURL,
+		ActiveDB: &db.Database{
+			DatabaseContext: rt1.GetDatabase(),
+		},
+		ChangesBatchSize:       200,
+		ConflictResolverFunc:   mergeConflictResolver,
+		ConflictResolutionType: db.ConflictResolverMerge,
+		Continuous:             true,
+		ReplicationStatsMap:    replicationStats,
+	})
+	defer func() { assert.NoError(t, ar.Stop()) }()
+
+	assert.NoError(t, ar.Start())
+
+	waitAndRequireCondition(t, func() bool { return ar.GetStatus().DocsRead == 1 }, "Expecting DocsRead == 1")
+	assert.Equal(t, int64(1), replicationStats.ConflictResolvedMergedCount.Value())
+
+	doc, err := rt1.GetDatabase().GetDocument(docID, db.DocUnmarshalAll)
+	require.NoError(t, err)
+	generation, _ := db.ParseRevID(doc.CurrentRev)
+	assert.Equal(t, 3, generation)
+
+	bodyBytes, err := base.JSONMarshal(doc.Body())
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"a": 2, "b": 2, "count": 5, "tags": ["x", "local", "remote"]}`, string(bodyBytes))
+}
+
 // TestActiveReplicatorPushAndPullConflict:
 //   - Starts 2 RestTesters, one active, and one passive.
 //   - Create the same document id with different content on rt1 and rt2
@@ -5915,3 +6004,258 @@ func requireRevID(t *testing.T, rt *RestTester, docID, revID string) {
 	require.NoError(t, err, "Error reading document from bucket")
 	require.Equal(t, revID, doc.SyncData.CurrentRev)
 }
+
+// TestActiveReplicatorCouchDBProtocolPull runs a one-shot pull replication over the CouchDB replication protocol,
+// and ensures a subsequent replication resumes from the checkpoint.
+func TestActiveReplicatorCouchDBProtocolPull(t *testing.T) {
+
+	base.RequireNumTestBuckets(t, 2)
+
+	defer base.SetUpTestLogging(base.LevelDebug, base.KeyHTTP, base.KeySync, base.KeyReplicate, base.KeyCRUD)()
+
+	// Passive
+	rt2 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+		DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+			Users: map[string]*db.PrincipalConfig{
+				"alice": {
+					Password:         base.StringPtr("pass"),
+					ExplicitChannels: base.SetOf("alice"),
+				},
+			},
+		}},
+	})
+	defer rt2.Close()
+
+	resp := rt2.SendAdminRequest(http.MethodPut, "/db/doc1", `{"source":"rt2","channels":["alice"],"_attachments":{"hello.txt":{"data":"aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, resp, http.StatusCreated)
+	doc1RevID := respRevID(t, resp)
+	resp = rt2.SendAdminRequest(http.MethodPut, "/db/doc2", `{"source":"rt2","channels":["alice"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+	resp = rt2.SendAdminRequest(http.MethodPut, "/db/doc3", `{"source":"rt2","channels":["bob"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	srv := httptest.NewServer(rt2.TestPublicHandler())
+	defer srv.Close()
+
+	passiveDBURL, err := url.Parse(srv.URL + "/db")
+	require.NoError(t, err)
+	passiveDBURL.User = url.UserPassword("alice", "pass")
+
+	// Active
+	rt1 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+	})
+	defer rt1.Close()
+
+	newReplicator := func() *db.ActiveReplicator {
+		return db.NewActiveReplicator(&db.ActiveReplicatorConfig{
+			ID:          t.Name(),
+			Direction:   db.ActiveReplicatorTypePull,
+			Protocol:    db.ReplicationProtocolCouchDB,
+			RemoteDBURL: passiveDBURL,
+			ActiveDB: &db.Database{
+				DatabaseContext: rt1.GetDatabase(),
+			},
+			ChangesBatchSize:    200,
+			ReplicationStatsMap: base.SyncGatewayStats.NewDBStats(t.Name(), false, false, false).DBReplicatorStats(t.Name()),
+		})
+	}
+
+	ar := newReplicator()
+	require.NoError(t, ar.Start())
+	waitAndRequireCondition(t, func() bool {
+		return ar.GetStatus().Status == db.ReplicationStateStopped
+	}, "Expected one-shot replication to complete")
+
+	status := ar.GetStatus()
+	assert.Equal(t, int64(2), status.DocsRead)
+	assert.Equal(t, int64(0), status.RejectedLocal)
+	assert.NotEqual(t, "", status.LastSeqPull)
+
+	doc, err := rt1.GetDatabase().GetDocument("doc1", db.DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Equal(t, doc1RevID, doc.CurrentRev)
+	assert.Equal(t, "rt2", doc.Body()["source"])
+	resp = rt1.SendAdminRequest(http.MethodGet, "/db/doc1/hello.txt", "")
+	assertStatus(t, resp, http.StatusOK)
+	assert.Equal(t, "hello world", resp.Body.String())
+
+	_, err = rt1.GetDatabase().GetDocument("doc3", db.DocUnmarshalAll)
+	assert.True(t, base.IsDocNotFoundError(err))
+
+	// Only the new revision should be pulled when the replication is restarted
+	resp = rt2.SendAdminRequest(http.MethodPut, "/db/doc4", `{"source":"rt2","channels":["alice"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	ar = newReplicator()
+	require.NoError(t, ar.Start())
+	waitAndRequireCondition(t, func() bool {
+		return ar.GetStatus().Status == db.ReplicationStateStopped
+	}, "Expected one-shot replication to complete")
+
+	pullStats := ar.Pull.GetStats()
+	assert.Equal(t, int64(1), pullStats.HandleRevCount.Value())
+	assert.Equal(t, int64(1), pullStats.HandleChangesCount.Value())
+	_, err = rt1.GetDatabase().GetDocument("doc4", db.DocUnmarshalAll)
+	require.NoError(t, err)
+}
+
+// TestActiveReplicatorCouchDBProtocolPullRevisionError ensures the checkpoint isn't advanced past a page of changes
+// containing a revision that couldn't be written locally.
+func TestActiveReplicatorCouchDBProtocolPullRevisionError(t *testing.T) {
+
+	base.RequireNumTestBuckets(t, 2)
+
+	defer base.SetUpTestLogging(base.LevelDebug, base.KeyHTTP, base.KeySync, base.KeyReplicate, base.KeyCRUD)()
+
+	// Passive
+	rt2 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+	})
+	defer rt2.Close()
+
+	resp := rt2.SendAdminRequest(http.MethodPut, "/db/doc1", `{"source":"rt2"}`)
+	assertStatus(t, resp, http.StatusCreated)
+	resp = rt2.SendAdminRequest(http.MethodPut, "/db/doc2", `{"source":"rt2","reject":true}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	srv := httptest.NewServer(rt2.TestAdminHandler())
+	defer srv.Close()
+
+	passiveDBURL, err := url.Parse(srv.URL + "/db")
+	require.NoError(t, err)
+
+	// Active
+	rt1 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+		SyncFn:     `function(doc) { if (doc.reject) { throw({forbidden: "rejected"}); } channel(doc.channels); }`,
+	})
+	defer rt1.Close()
+
+	ar := db.NewActiveReplicator(&db.ActiveReplicatorConfig{
+		ID:          t.Name(),
+		Direction:   db.ActiveReplicatorTypePull,
+		Protocol:    db.ReplicationProtocolCouchDB,
+		RemoteDBURL: passiveDBURL,
+		ActiveDB: &db.Database{
+			DatabaseContext: rt1.GetDatabase(),
+		},
+		ChangesBatchSize:    200,
+		ReplicationStatsMap: base.SyncGatewayStats.NewDBStats(t.Name(), false, false, false).DBReplicatorStats(t.Name()),
+	})
+	require.NoError(t, ar.Start())
+	defer func() { assert.NoError(t, ar.Stop()) }()
+
+	waitAndRequireCondition(t, func() bool {
+		return ar.Pull.GetStats().HandleRevErrorCount.Value() > 0
+	}, "Expected rejected revision")
+	waitAndRequireCondition(t, func() bool {
+		return ar.GetStatus().Status == db.ReplicationStateReconnecting
+	}, "Expected replication to reconnect")
+
+	// Revisions that were written are kept, but the page is retried
+	_, err = rt1.GetDatabase().GetDocument("doc1", db.DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Equal(t, "", ar.GetStatus().LastSeqPull)
+}
+
+// TestActiveReplicatorCouchDBProtocolPush runs a continuous push replication over the CouchDB replication protocol,
+// including conflicting revisions and attachments.
+func TestActiveReplicatorCouchDBProtocolPush(t *testing.T) {
+
+	base.RequireNumTestBuckets(t, 2)
+
+	defer base.SetUpTestLogging(base.LevelDebug, base.KeyHTTP, base.KeySync, base.KeyReplicate, base.KeyCRUD)()
+
+	// Passive
+	rt2 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+		DatabaseConfig: &DatabaseConfig{DbConfig: DbConfig{
+			Users: map[string]*db.PrincipalConfig{
+				"alice": {
+					Password:         base.StringPtr("pass"),
+					ExplicitChannels: base.SetOf("alice"),
+				},
+			},
+		}},
+		SyncFn: `function(doc) { if (doc.reject) { throw({forbidden: "rejected"}); } channel(doc.channels); }`,
+	})
+	defer rt2.Close()
+
+	// Active
+	rt1 := NewRestTester(t, &RestTesterConfig{
+		TestBucket: base.GetTestBucket(t),
+	})
+	defer rt1.Close()
+
+	resp := rt1.SendAdminRequest(http.MethodPut, "/db/doc1", `{"source":"rt1","channels":["alice"],"_attachments":{"hello.txt":{"data":"aGVsbG8gd29ybGQ="}}}`)
+	assertStatus(t, resp, http.StatusCreated)
+	doc1RevID := respRevID(t, resp)
+
+	// Conflicting branches are all pushed
+	resp = rt1.SendAdminRequest(http.MethodPost, "/db/_bulk_docs", `{"new_edits":false, "docs":[
+		{"_id":"doc2", "_rev":"2-a", "_revisions":{"start":2, "ids":["a","x"]}, "channels":["alice"]},
+		{"_id":"doc2", "_rev":"2-b", "_revisions":{"start":2, "ids":["b","x"]}, "channels":["alice"]}]}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	resp = rt1.SendAdminRequest(http.MethodPut, "/db/rejected", `{"reject":true}`)
+	assertStatus(t, resp, http.StatusCreated)
+
+	srv := httptest.NewServer(rt2.TestPublicHandler())
+	defer srv.Close()
+
+	passiveDBURL, err := url.Parse(srv.URL + "/db")
+	require.NoError(t, err)
+	passiveDBURL.User = url.UserPassword("alice", "pass")
+
+	ar := db.NewActiveReplicator(&db.ActiveReplicatorConfig{
+		ID:          t.Name(),
+		Direction:   db.ActiveReplicatorTypePush,
+		Protocol:    db.ReplicationProtocolCouchDB,
+		RemoteDBURL: passiveDBURL,
+		ActiveDB: &db.Database{
+			DatabaseContext: rt1.GetDatabase(),
+		},
+		Continuous:          true,
+		ChangesBatchSize:    200,
+		ReplicationStatsMap: base.SyncGatewayStats.NewDBStats(t.Name(), false, false, false).DBReplicatorStats(t.Name()),
+	})
+	defer func() { assert.NoError(t, ar.Stop()) }()
+
+	require.NoError(t, ar.Start())
+
+	changesResults, err := rt2.WaitForChanges(2, "/db/_changes?since=0", "", true)
+	require.NoError(t, err)
+	require.Len(t, changesResults.Results, 2)
+
+	doc, err := rt2.GetDatabase().GetDocument("doc1", db.DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.Equal(t, doc1RevID, doc.CurrentRev)
+	resp = rt2.SendAdminRequest(http.MethodGet, "/db/doc1/hello.txt", "")
+	assertStatus(t, resp, http.StatusOK)
+	assert.Equal(t, "hello world", resp.Body.String())
+
+	doc, err = rt2.GetDatabase().GetDocument("doc2", db.DocUnmarshalAll)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"2-a", "2-b"}, doc.History.GetLeaves())
+
+	waitAndRequireCondition(t, func() bool {
+		return ar.GetStatus().RejectedRemote == 1
+	}, "Expected rejected doc to be reported")
+	status := ar.GetStatus()
+	assert.Equal(t, int64(3), status.DocsWritten)
+	assert.Equal(t, int64(1), status.DocWriteFailures)
+
+	// Continuous replication picks up new changes
+	resp = rt1.SendAdminRequest(http.MethodPut, "/db/doc3", `{"source":"rt1","channels":["alice"]}`)
+	assertStatus(t, resp, http.StatusCreated)
+	_, err = rt2.WaitForChanges(3, "/db/_changes?since=0", "", true)
+	require.NoError(t, err)
+
+	// Remote checkpoint is stored as a _local document
+	ar.Push.Checkpointer.CheckpointNow()
+	assert.Equal(t, int64(1), ar.Push.Checkpointer.Stats().SetCheckpointCount)
+	resp = rt2.SendAdminRequest(http.MethodGet, "/db/_local/"+db.PushCheckpointID(t.Name()), "")
+	assertStatus(t, resp, http.StatusOK)
+}
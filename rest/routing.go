@@ -115,6 +115,20 @@ func CreatePublicHandler(sc *ServerContext) http.Handler {
 
 	dbr.Handle("/_session", makeHandler(sc, publicPrivs, nil, nil, (*handler).handleSessionPOST)).Methods("POST")
 	dbr.Handle("/_session", makeHandler(sc, regularPrivs, nil, nil, (*handler).handleSessionDELETE)).Methods("DELETE")
+	dbr.Handle("/_devices", makeHandler(sc, regularPrivs, nil, nil, (*handler).handleGetPushDevices)).Methods("GET", "HEAD")
+	dbr.Handle("/_devices", makeHandler(sc, regularPrivs, nil, nil, (*handler).handlePostPushDevice)).Methods("POST")
+	dbr.Handle("/_devices/{token}", makeHandler(sc, regularPrivs, nil, nil, (*handler).handleDeletePushDevice)).Methods("DELETE")
+	dbr.Handle("/_mfa", makeHandler(sc, regularPrivs, nil, nil, (*handler).handleGetMFA)).Methods("GET", "HEAD")
+	dbr.Handle("/_mfa", makeHandler(sc, regularPrivs, nil, nil, (*handler).handlePostMFA)).Methods("POST")
+	dbr.Handle("/_mfa", makeHandler(sc, regularPrivs, nil, nil, (*handler).handleDeleteMFA)).Methods("DELETE")
+	dbr.Handle("/_mfa/verify", makeHandler(sc, regularPrivs, nil, nil, (*handler).handlePostMFAVerify)).Methods("POST")
+	dbr.Handle("/_mfa/recovery_codes", makeHandler(sc, regularPrivs, nil, nil, (*handler).handlePostMFARecoveryCodes)).Methods("POST")
+	dbr.Handle("/_user/me/_password", makeHandler(sc, publicPrivs, nil, nil, (*handler).handlePostUserPassword)).Methods("POST")
+	dbr.Handle("/_signup", makeHandler(sc, publicPrivs, nil, nil, (*handler).handleSignup)).Methods("POST")
+	dbr.Handle("/_signup/verify", makeHandler(sc, publicPrivs, nil, nil, (*handler).handleSignupVerify)).Methods("POST")
+	dbr.Handle("/_signup/resend", makeHandler(sc, publicPrivs, nil, nil, (*handler).handleSignupResend)).Methods("POST")
+	dbr.Handle("/_password_reset", makeHandler(sc, publicPrivs, nil, nil, (*handler).handlePasswordReset)).Methods("POST")
+	dbr.Handle("/_password_reset/confirm", makeHandler(sc, publicPrivs, nil, nil, (*handler).handlePasswordResetConfirm)).Methods("POST")
 	// The routine below is part of the CouchDB REST API, users can't create DB's via the pblic API
 	// but if the client set the 'createTarget' property of the Replicatior SG should return HTTP status 412
 	// if the db exists, and 403 if it doesn't.
@@ -165,6 +179,34 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserSessions)).Methods("DELETE")
 	dbr.Handle("/_user/{name}/_session/{sessionid}",
 		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserSession)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_devices",
+		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getUserPushDevices)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_devices",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).postUserPushDevice)).Methods("POST")
+	dbr.Handle("/_user/{name}/_devices/{token}",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserPushDevice)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_apikey",
+		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getUserAPIKeys)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_apikey",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).postUserAPIKey)).Methods("POST")
+	dbr.Handle("/_user/{name}/_apikey/{keyid}",
+		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getUserAPIKey)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_apikey/{keyid}",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserAPIKey)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_mfa",
+		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getUserMFA)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_mfa",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).postUserMFA)).Methods("POST")
+	dbr.Handle("/_user/{name}/_mfa",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserMFA)).Methods("DELETE")
+	dbr.Handle("/_user/{name}/_mfa/verify",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).postUserMFAVerify)).Methods("POST")
+	dbr.Handle("/_user/{name}/_mfa/recovery_codes",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).postUserMFARecoveryCodes)).Methods("POST")
+	dbr.Handle("/_user/{name}/_lockout",
+		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getUserLockout)).Methods("GET", "HEAD")
+	dbr.Handle("/_user/{name}/_lockout",
+		makeHandler(sc, adminPrivs, []Permission{PermWritePrincipal}, nil, (*handler).deleteUserLockout)).Methods("DELETE")
 
 	dbr.Handle("/_role/",
 		makeHandler(sc, adminPrivs, []Permission{PermReadPrincipal}, nil, (*handler).getRoles)).Methods("GET", "HEAD")
@@ -188,6 +230,19 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 	dbr.Handle("/_replication/{replicationID}",
 		makeHandler(sc, adminPrivs, []Permission{PermWriteReplications}, nil, (*handler).deleteReplication)).Methods("DELETE")
 
+	dbr.Handle("/_replication/{replicationID}/_deadletter",
+		makeHandler(sc, adminPrivs, []Permission{PermReadReplications}, nil, (*handler).getReplicationDeadLetters)).Methods("GET", "HEAD")
+	dbr.Handle("/_replication/{replicationID}/_deadletter",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteReplications}, nil, (*handler).deleteReplicationDeadLetters)).Methods("DELETE")
+	dbr.Handle("/_replication/{replicationID}/_deadletter/_retry",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteReplications}, nil, (*handler).retryReplicationDeadLetters)).Methods("POST")
+	dbr.Handle("/_replication/{replicationID}/_deadletter/{docid:"+docRegex+"}",
+		makeHandler(sc, adminPrivs, []Permission{PermReadReplications}, nil, (*handler).getReplicationDeadLetter)).Methods("GET", "HEAD")
+	dbr.Handle("/_replication/{replicationID}/_deadletter/{docid:"+docRegex+"}",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteReplications}, nil, (*handler).deleteReplicationDeadLetters)).Methods("DELETE")
+	dbr.Handle("/_replication/{replicationID}/_deadletter/{docid:"+docRegex+"}/_retry",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteReplications}, nil, (*handler).retryReplicationDeadLetters)).Methods("POST")
+
 	dbr.Handle("/_replicationStatus/",
 		makeHandler(sc, adminPrivs, []Permission{PermReadReplications}, nil, (*handler).getReplicationsStatus)).Methods("GET", "HEAD")
 	dbr.Handle("/_replicationStatus/{replicationID}",
@@ -275,6 +330,36 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeOfflineHandler(sc, adminPrivs, []Permission{PermUpdateDb}, nil, (*handler).handlePostResync)).Methods("POST")
 	dbr.Handle("/_purge",
 		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handlePurge)).Methods("POST")
+	dbr.Handle("/_conflicts",
+		makeHandler(sc, adminPrivs, []Permission{PermReadAppData}, nil, (*handler).handleGetConflicts)).Methods("GET", "HEAD")
+	dbr.Handle("/_conflicts/_rebuild",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handlePostConflictsRebuild)).Methods("POST")
+	dbr.Handle("/{docid:"+docRegex+"}/_resolve",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handleResolveConflict)).Methods("POST")
+	dbr.Handle("/_subscription/{name}",
+		makeHandler(sc, adminPrivs, []Permission{PermReadAppData}, nil, (*handler).handleGetChangesSubscription)).Methods("GET", "HEAD")
+	dbr.Handle("/_subscription/{name}",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handlePutChangesSubscription)).Methods("PUT")
+	dbr.Handle("/_subscription/{name}",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handleDeleteChangesSubscription)).Methods("DELETE")
+	dbr.Handle("/_subscription/{name}/_read",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handleReadChangesSubscription)).Methods("POST")
+	dbr.Handle("/_subscription/{name}/_ack",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).handleAckChangesSubscription)).Methods("POST")
+	dbr.Handle("/_event_handlers",
+		makeHandler(sc, adminPrivs, []Permission{PermReadAppData}, nil, (*handler).handleGetEventHandlers)).Methods("GET", "HEAD")
+	dbr.Handle("/_webhook/{webhookID}/_outbox",
+		makeHandler(sc, adminPrivs, []Permission{PermReadAppData}, nil, (*handler).getWebhookOutbox)).Methods("GET", "HEAD")
+	dbr.Handle("/_webhook/{webhookID}/_outbox",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).deleteWebhookOutboxEntries)).Methods("DELETE")
+	dbr.Handle("/_webhook/{webhookID}/_outbox/_replay",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).replayWebhookOutboxEntries)).Methods("POST")
+	dbr.Handle("/_webhook/{webhookID}/_outbox/{entryID}",
+		makeHandler(sc, adminPrivs, []Permission{PermReadAppData}, nil, (*handler).getWebhookOutboxEntry)).Methods("GET", "HEAD")
+	dbr.Handle("/_webhook/{webhookID}/_outbox/{entryID}",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).deleteWebhookOutboxEntries)).Methods("DELETE")
+	dbr.Handle("/_webhook/{webhookID}/_outbox/{entryID}/_replay",
+		makeHandler(sc, adminPrivs, []Permission{PermWriteAppData}, nil, (*handler).replayWebhookOutboxEntries)).Methods("POST")
 	dbr.Handle("/_flush",
 		makeHandler(sc, adminPrivs, []Permission{PermDevOps}, nil, (*handler).handleFlush)).Methods("POST")
 	dbr.Handle("/_online",
@@ -303,6 +388,10 @@ func CreateAdminRouter(sc *ServerContext) *mux.Router {
 		makeHandler(sc, adminPrivs, []Permission{PermUpdateDb}, nil, (*handler).handleCompact)).Methods("POST")
 	dbr.Handle("/_compact",
 		makeHandler(sc, adminPrivs, []Permission{PermUpdateDb}, nil, (*handler).handleGetCompact)).Methods("GET")
+	dbr.Handle("/_attachment_migration",
+		makeHandler(sc, adminPrivs, []Permission{PermUpdateDb}, nil, (*handler).handlePostAttachmentMigration)).Methods("POST")
+	dbr.Handle("/_attachment_migration",
+		makeHandler(sc, adminPrivs, []Permission{PermUpdateDb}, nil, (*handler).handleGetAttachmentMigration)).Methods("GET")
 
 	return r
 }
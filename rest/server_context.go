@@ -108,8 +108,8 @@ func NewServerContext(config *StartupConfig, persistentConfig bool) *ServerConte
 		sc.persistentConfig = false
 
 		// Disable Admin API authentication when running as walrus on the default admin interface to support dev
-		// environments.
-		if sc.config.API.AdminInterface == DefaultAdminInterface {
+		// environments, unless local admin users have been configured.
+		if sc.config.API.AdminInterface == DefaultAdminInterface && len(sc.config.API.LocalAdminUsers) == 0 {
 			sc.config.API.AdminInterfaceAuthentication = base.BoolPtr(false)
 			sc.config.API.MetricsInterfaceAuthentication = base.BoolPtr(false)
 		}
@@ -781,6 +781,71 @@ func dbcOptionsFromConfig(sc *ServerContext, config *DbConfig, dbName string) (d
 	// Register the cbgt pindex type for the configGroup
 	db.RegisterImportPindexImpl(groupID)
 
+	var clientConflictResolution *db.ClientConflictResolutionOptions
+	if ccr := config.ClientConflictResolution; ccr != nil {
+		resolverFunc, err := db.NewConflictResolverFunc(ccr.Type, ccr.CustomResolver, ccr.MergePolicies)
+		if err != nil {
+			return db.DatabaseContextOptions{}, err
+		}
+		clientConflictResolution = &db.ClientConflictResolutionOptions{
+			ResolverType: ccr.Type,
+			ResolverFunc: resolverFunc,
+		}
+	}
+
+	var mfaOptions *auth.MFAOptions
+	if mfa := config.MFA; mfa != nil {
+		encryptionKey, err := auth.DecodeMFAEncryptionKey(mfa.EncryptionKey)
+		if err != nil {
+			return db.DatabaseContextOptions{}, fmt.Errorf("Invalid mfa.encryption_key: %w", err)
+		}
+		mfaOptions = &auth.MFAOptions{
+			EncryptionKey: encryptionKey,
+			Issuer:        mfa.Issuer,
+			Required:      base.BoolDefault(mfa.Required, false),
+		}
+	}
+
+	var pushNotificationOptions *db.PushNotificationOptions
+	if pn := config.PushNotifications; pn != nil {
+		pushNotificationOptions = &db.PushNotificationOptions{
+			GatewayURL:       pn.GatewayURL,
+			DebounceInterval: db.DefaultPushNotificationDebounce,
+		}
+		if pn.DebounceSecs != nil {
+			pushNotificationOptions.DebounceInterval = time.Duration(*pn.DebounceSecs) * time.Second
+		}
+	}
+
+	var lockoutOptions *auth.LockoutOptions
+	if config.Lockout != nil {
+		lockoutOptions = config.Lockout.options()
+	}
+
+	var passwordPolicyOptions *auth.PasswordPolicyOptions
+	if config.PasswordPolicy != nil {
+		var err error
+		passwordPolicyOptions, err = config.PasswordPolicy.options()
+		if err != nil {
+			return db.DatabaseContextOptions{}, fmt.Errorf("Unable to load password_policy.compromised_passwords_file: %w", err)
+		}
+	}
+
+	var signupOptions *db.SignupOptions
+	if config.Signup != nil {
+		signupOptions = config.Signup.options()
+	}
+
+	var attachmentStoreOptions *db.AttachmentStoreOptions
+	if config.AttachmentStore != nil {
+		attachmentStoreOptions = config.AttachmentStore.options()
+	}
+
+	var attachmentPolicyOptions *db.AttachmentPolicyOptions
+	if config.AttachmentPolicy != nil {
+		attachmentPolicyOptions = config.AttachmentPolicy.options()
+	}
+
 	contextOptions := db.DatabaseContextOptions{
 		CacheOptions:              &cacheOptions,
 		RevisionCacheOptions:      revCacheOptions,
@@ -809,6 +874,16 @@ func dbcOptionsFromConfig(sc *ServerContext, config *DbConfig, dbName string) (d
 		ClientPartitionWindow:     clientPartitionWindow,
 		BcryptCost:                bcryptCost,
 		GroupID:                   groupID,
+		ClientConflictResolution:  clientConflictResolution,
+		PushNotificationOptions:   pushNotificationOptions,
+		MFAOptions:                mfaOptions,
+		LockoutOptions:            lockoutOptions,
+		PasswordPolicyOptions:     passwordPolicyOptions,
+		SignupOptions:             signupOptions,
+		LocalJWTProviders:         config.LocalJWTConfig,
+		AttachmentStoreOptions:    attachmentStoreOptions,
+		AttachmentPolicyOptions:   attachmentPolicyOptions,
+		AttachmentRenditionSizes:  config.AttachmentRenditionSizes,
 	}
 
 	return contextOptions, nil
@@ -847,20 +922,17 @@ func validateEventConfigOptions(eventType db.EventType, eventConfig *EventConfig
 
 	var errs *base.MultiError
 
-	switch eventType {
-	case db.DocumentChange:
-		for k, v := range eventConfig.Options {
-			switch k {
-			case db.EventOptionDocumentChangedWinningRevOnly:
-				if _, ok := v.(bool); !ok {
-					errs = errs.Append(fmt.Errorf("Event option %q must be of type bool", db.EventOptionDocumentChangedWinningRevOnly))
-				}
-			default:
-				errs = errs.Append(fmt.Errorf("unknown option %q found for event type %q", k, eventType))
+	for k, v := range eventConfig.Options {
+		switch {
+		case eventConfig.HandlerType == "webhook" && base.StringSliceContains(db.WebhookOptionNames, k):
+			// Webhook options are validated when the webhook is created
+		case eventType == db.DocumentChange && k == db.EventOptionDocumentChangedWinningRevOnly:
+			if _, ok := v.(bool); !ok {
+				errs = errs.Append(fmt.Errorf("Event option %q must be of type bool", db.EventOptionDocumentChangedWinningRevOnly))
 			}
+		default:
+			errs = errs.Append(fmt.Errorf("unknown option %q found for event type %q", k, eventType))
 		}
-	default:
-		errs = errs.Append(fmt.Errorf("unknown options %v found for event type %q", eventConfig.Options, eventType))
 	}
 
 	// If we only have 1 error, return it as-is for clarity in the logs.
@@ -881,12 +953,7 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 	}
 
 	// Load Webhook Filter Function.
-	eventHandlersByType := map[db.EventType][]*EventConfig{
-		db.DocumentChange: config.EventHandlers.DocumentChanged,
-		db.DBStateChange:  config.EventHandlers.DBStateChanged,
-	}
-
-	for eventType, handlers := range eventHandlersByType {
+	for eventType, handlers := range config.EventHandlers.eventConfigsByType() {
 		for _, conf := range handlers {
 			if err := validateEventConfigOptions(eventType, conf); err != nil {
 				return err
@@ -906,6 +973,18 @@ func (sc *ServerContext) initEventHandlers(dbcontext *db.DatabaseContext, config
 				}
 			}
 			conf.Filter = filter
+
+			// Load external webhook transform function
+			if transform, ok := conf.Options[db.EventOptionTransform].(string); ok && transform != "" {
+				conf.Options[db.EventOptionTransform], err = loadJavaScript(transform, insecureSkipVerify)
+				if err != nil {
+					return &JavaScriptLoadError{
+						JSLoadType: WebhookTransform,
+						Path:       transform,
+						Err:        err,
+					}
+				}
+			}
 		}
 
 		// Register event handlers
@@ -950,7 +1029,35 @@ func (sc *ServerContext) processEventHandlersForEvent(events []*EventConfig, eve
 				base.Warnf("Error creating webhook %v", err)
 				return err
 			}
+			wh.SetSigningSecret(event.SigningSecret)
+			if event.Delivery != nil && event.Delivery.Durable {
+				if err := dbcontext.EnableWebhookOutbox(wh, eventType, *event.Delivery); err != nil {
+					base.Warnf("Error enabling durable delivery for webhook %v", err)
+					return err
+				}
+			}
 			dbcontext.EventMgr.RegisterEventHandler(wh, eventType)
+		case "broker":
+			if eventType != db.DocumentChange {
+				return fmt.Errorf("broker event handlers are only supported for document_changed events")
+			}
+			if event.Broker == nil {
+				return errors.New("broker must be defined for broker events")
+			}
+			var timeout time.Duration
+			if event.Timeout != nil {
+				timeout = time.Duration(*event.Timeout) * time.Second
+			}
+			publisher, err := db.NewBrokerPublisher(event.Broker.Type, event.Url, timeout)
+			if err != nil {
+				return err
+			}
+			handler, err := dbcontext.NewBrokerEventHandler(*event.Broker, publisher, event.Filter)
+			if err != nil {
+				base.Warnf("Error creating broker event handler %v", err)
+				return err
+			}
+			dbcontext.EventMgr.RegisterEventHandler(handler, eventType)
 		default:
 			return errors.New(fmt.Sprintf("Unknown event handler type %s", event.HandlerType))
 		}
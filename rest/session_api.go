@@ -48,10 +48,23 @@ func (h *handler) handleSessionPOST() error {
 		}
 	}
 
-	user, err := h.getUserFromSessionRequestBody()
+	user, challenge, err := h.getUserFromSessionRequestBody()
+	if challenge != nil {
+		return h.respondWithMFAChallenge(challenge)
+	}
 
 	// If we fail to get a user from the body and we've got a non-GUEST authenticated user, create the session based on that user
 	if user == nil && h.user != nil && h.user.Name() != "" {
+		// Sessions aren't restricted to an API key's scopes
+		if _, ok := auth.AuthenticatedAPIKey(h.user); ok {
+			return base.HTTPErrorf(http.StatusForbidden, "API keys can't be used to create sessions")
+		}
+		// Users with MFA enabled can't use basic auth, but users that haven't enrolled can
+		if username, _ := h.getBasicAuth(); username != "" {
+			if _, err := h.checkPasswordLoginMFA(h.user); err != nil {
+				return err
+			}
+		}
 		return h.makeSession(h.user)
 	} else {
 		if err != nil {
@@ -62,27 +75,54 @@ func (h *handler) handleSessionPOST() error {
 
 }
 
-func (h *handler) getUserFromSessionRequestBody() (auth.User, error) {
+// getUserFromSessionRequestBody authenticates the user with the name and password in the request body.  If the user
+// needs to complete multi-factor authentication, returns a challenge instead, which is completed by a request with the
+// challenge's mfa_token and a TOTP or recovery code.
+func (h *handler) getUserFromSessionRequestBody() (auth.User, *auth.MFAChallenge, error) {
 
 	var params struct {
 		Name     string `json:"name"`
 		Password string `json:"password"`
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
 	}
 	err := h.readJSONInto(&params)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	if params.MFAToken != "" {
+		user, err := h.getUserFromMFAChallenge(params.MFAToken, params.Code)
+		return user, nil, err
 	}
 
-	var user auth.User
-	user, err = h.db.Authenticator().GetUser(params.Name)
+	user, err := h.db.Authenticator().AuthenticateUserFromSource(params.Name, params.Password, h.clientIP())
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	if user == nil && params.Name != "" {
+		if raiseErr := h.db.EventMgr.RaiseAuthFailureEvent(h.db.Name, params.Name, h.rq.RemoteAddr, h.rq.URL.Path, "Invalid login"); raiseErr != nil {
+			base.Debugf(base.KeyEvents, "Unable to raise auth failure event: %v", raiseErr)
+		}
+	}
+	if user != nil {
+		challengeRequired, err := h.checkPasswordLoginMFA(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		if challengeRequired {
+			challenge, err := h.db.Authenticator().CreateMFAChallenge(user.Name())
+			return nil, challenge, err
+		}
+	}
+	return user, nil, err
+}
 
-	if user != nil && !user.Authenticate(params.Password) {
-		user = nil
+// raiseSessionCreateEvent raises a SessionCreate event for a newly created session.
+func (h *handler) raiseSessionCreateEvent(session *auth.LoginSession) {
+	if err := h.db.EventMgr.RaiseSessionCreateEvent(h.db.Name, session.Username, session.Expiration); err != nil {
+		base.Debugf(base.KeyEvents, "Unable to raise session create event: %v", err)
 	}
-	return user, err
 }
 
 // DELETE /_session logs out the current session
@@ -127,6 +167,7 @@ func (h *handler) makeSessionWithTTL(user auth.User, expiry time.Duration) (sess
 	if err != nil {
 		return "", err
 	}
+	h.raiseSessionCreateEvent(session)
 	cookie := auth.MakeSessionCookie(session, h.db.Options.SecureCookieOverride, h.db.Options.SessionCookieHttpOnly)
 	base.AddDbPathToCookie(h.rq, cookie)
 	http.SetCookie(h.response, cookie)
@@ -211,6 +252,7 @@ func (h *handler) createUserSession() error {
 	if err != nil {
 		return err
 	}
+	h.raiseSessionCreateEvent(session)
 	var response struct {
 		SessionID  string `json:"session_id"`
 		Expires    string `json:"expires"`
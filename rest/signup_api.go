@@ -0,0 +1,92 @@
+//  Copyright 2022-Present Couchbase, Inc.
+//
+//  Use of this software is governed by the Business Source License included
+//  in the file licenses/BSL-Couchbase.txt.  As of the Change Date specified
+//  in that file, in accordance with the Business Source License, use of this
+//  software will be governed by the Apache License, Version 2.0, included in
+//  the file licenses/APL2.txt.
+
+package rest
+
+import (
+	"net/http"
+
+	"github.com/couchbase/sync_gateway/db"
+)
+
+// POST /{db}/_signup creates a user with the database's default roles and channels.  The response doesn't reveal
+// whether the email address is already registered.
+func (h *handler) handleSignup() error {
+	var params struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	verificationRequired, err := h.db.SignupUser(params.Name, params.Email, params.Password)
+	if err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, db.Body{
+		"ok":                    true,
+		"verification_required": verificationRequired,
+	})
+	return nil
+}
+
+// POST /{db}/_signup/verify enables a signed up user with the token sent to their email address
+func (h *handler) handleSignupVerify() error {
+	var params struct {
+		Token string `json:"token"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	return h.db.VerifyEmail(params.Token)
+}
+
+// POST /{db}/_signup/resend sends a new verification token to a signed up user that hasn't verified their email
+// address.  The response doesn't reveal whether the address is registered.
+func (h *handler) handleSignupResend() error {
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	if err := h.db.ResendVerification(params.Email); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, db.Body{"ok": true})
+	return nil
+}
+
+// POST /{db}/_password_reset sends a password reset token to the user with the given email address.  The response
+// doesn't reveal whether the address is registered.
+func (h *handler) handlePasswordReset() error {
+	var params struct {
+		Email string `json:"email"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	if err := h.db.RequestPasswordReset(params.Email); err != nil {
+		return err
+	}
+	h.writeJSONStatus(http.StatusAccepted, db.Body{"ok": true})
+	return nil
+}
+
+// POST /{db}/_password_reset/confirm sets a new password with a token sent by POST /{db}/_password_reset
+func (h *handler) handlePasswordResetConfirm() error {
+	var params struct {
+		Token       string `json:"token"`
+		NewPassword string `json:"new_password"`
+	}
+	if err := h.readJSONInto(&params); err != nil {
+		return err
+	}
+	return h.db.ResetPassword(params.Token, params.NewPassword)
+}
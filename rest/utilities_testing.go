@@ -56,6 +56,7 @@ type RestTesterConfig struct {
 	adminInterfaceAuthentication    bool
 	metricsInterfaceAuthentication  bool
 	enableAdminAuthPermissionsCheck bool
+	localAdminUsers                 LocalAdminUsersConfig
 	useTLSServer                    bool // If true, TLS will be required for communications with CBS. Default: false
 	persistentConfig                bool
 	groupID                         *string
@@ -148,6 +149,7 @@ func (rt *RestTester) Bucket() base.Bucket {
 	sc.API.AdminInterfaceAuthentication = &rt.adminInterfaceAuthentication
 	sc.API.MetricsInterfaceAuthentication = &rt.metricsInterfaceAuthentication
 	sc.API.EnableAdminAuthenticationPermissionsCheck = &rt.enableAdminAuthPermissionsCheck
+	sc.API.LocalAdminUsers = rt.localAdminUsers
 	sc.Bootstrap.UseTLSServer = &rt.RestTesterConfig.useTLSServer
 	sc.Bootstrap.ServerTLSSkipVerify = base.BoolPtr(base.TestTLSSkipVerify())
 	if rt.RestTesterConfig.groupID != nil {
@@ -826,6 +828,9 @@ type BlipTesterSpec struct {
 	connectingUsername string
 	connectingPassword string
 
+	// An API key to connect with, instead of a username and password.  The key's user isn't created.
+	connectingAPIKey string
+
 	// By default, the created user will have access to a single channel that matches their username.
 	// If you need to grant the user access to more channels, you can override this behavior by specifying
 	// the channels the user should have access in this string slice
@@ -991,6 +996,8 @@ func createBlipTesterWithSpec(tb testing.TB, spec BlipTesterSpec, rt *RestTester
 		config.Header = http.Header{
 			"Authorization": {"Basic " + base64.StdEncoding.EncodeToString([]byte(spec.connectingUsername+":"+spec.connectingPassword))},
 		}
+	} else if spec.connectingAPIKey != "" {
+		config.Header = http.Header{"Authorization": {"ApiKey " + spec.connectingAPIKey}}
 	}
 
 	bt.sender, err = bt.blipContext.DialConfig(config)
@@ -1438,7 +1445,7 @@ func (bt *BlipTester) PullDocs() (docs map[string]RestDocument) {
 			getAttachmentRequest := blip.NewRequest()
 			getAttachmentRequest.SetProfile(db.MessageGetAttachment)
 			getAttachmentRequest.Properties[db.GetAttachmentDigest] = attachment.Digest
-			if bt.blipContext.ActiveSubprotocol() == db.BlipCBMobileReplicationV3 {
+			if db.BlipSubprotocolVersion(bt.blipContext.ActiveSubprotocol()) == db.BlipCBMobileReplicationV3 {
 				getAttachmentRequest.Properties[db.GetAttachmentID] = docId
 			}
 			sent := bt.sender.Send(getAttachmentRequest)